@@ -11,6 +11,8 @@ package main
 //    ImporterAccessKeyID  Optional. Access key is the user ID that uniquely identifies your
 //			      account.
 //    ImporterSecretKey     Optional. Secret key is the password to your account.
+//    ImporterBearerToken   Optional. Bearer token sent to http endpoints instead of the access and
+//			      secret keys.
 
 import (
 	"flag"
@@ -18,11 +20,21 @@ import (
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 
 	cdiv1 "kubevirt.io/containerized-data-importer/pkg/apis/core/v1beta1"
@@ -34,11 +46,76 @@ import (
 	prometheusutil "kubevirt.io/containerized-data-importer/pkg/util/prometheus"
 )
 
+// An import records a handful of phase events, the events of retrying imports are limited to a burst and a slow
+// refill.
+const (
+	eventBurstSize = 20
+	eventQPS       = 1. / 30.
+)
+
 func init() {
 	klog.InitFlags(nil)
 	flag.Parse()
 }
 
+// createEventRecorder returns a rate limited recorder of the events of the importer pod. The pod is identified by its
+// host name, and the UID passed through the downward API if any.
+func createEventRecorder(podUID string) (record.EventRecorder, runtime.Object, error) {
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to get the in cluster configuration")
+	}
+	client, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to create the kubernetes client")
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to get the pod name")
+	}
+	namespace := util.GetNamespace()
+	eventBroadcaster := record.NewBroadcasterWithCorrelatorOptions(record.CorrelatorOptions{BurstSize: eventBurstSize, QPS: eventQPS})
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events(namespace)})
+	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: common.ImporterPodName})
+	pod := &v1.ObjectReference{
+		Kind:       "Pod",
+		APIVersion: "v1",
+		Namespace:  namespace,
+		Name:       name,
+		UID:        types.UID(podUID),
+	}
+	return recorder, pod, nil
+}
+
+// newSignatureVerification returns the verification of the signatures of the sources with the GPG keyring at
+// publicKeyPath, nil if publicKeyPath is empty.
+func newSignatureVerification(publicKeyPath, signature, signatureURL string) (*importer.SignatureVerification, error) {
+	if publicKeyPath == "" {
+		return nil, nil
+	}
+	publicKeys, err := ioutil.ReadFile(publicKeyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read the signature public keys")
+	}
+	verifier, err := importer.NewGPGSignatureVerifier(publicKeys)
+	if err != nil {
+		return nil, err
+	}
+	return importer.NewSignatureVerification(verifier, []byte(signature), signatureURL)
+}
+
+// readS3CustomerKey returns the base64 encoded S3 SSE-C key in keyFile, empty if keyFile is empty.
+func readS3CustomerKey(keyFile string) (string, error) {
+	if keyFile == "" {
+		return "", nil
+	}
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to read the SSE-C key")
+	}
+	return strings.TrimSpace(string(key)), nil
+}
+
 func main() {
 	defer klog.Flush()
 
@@ -49,10 +126,22 @@ func main() {
 	defer os.RemoveAll(certsDirectory)
 	prometheusutil.StartPrometheusEndpoint(certsDirectory)
 
+	// The log level applies before anything is logged.
+	logLevel, _ := util.ParseEnvVar(common.ImporterLogLevel, false)
+	if err := util.SetLogLevel(logLevel); err != nil {
+		klog.Errorf("%+v", err)
+		err = util.WriteTerminationMessage(fmt.Sprintf("Invalid log level: %+v", err))
+		if err != nil {
+			klog.Errorf("%+v", err)
+		}
+		os.Exit(1)
+	}
+
 	klog.V(1).Infoln("Starting importer")
 	ep, _ := util.ParseEnvVar(common.ImporterEndpoint, false)
 	acc, _ := util.ParseEnvVar(common.ImporterAccessKeyID, false)
 	sec, _ := util.ParseEnvVar(common.ImporterSecretKey, false)
+	bearerToken, _ := util.ParseEnvVar(common.ImporterBearerToken, false)
 	source, _ := util.ParseEnvVar(common.ImporterSource, false)
 	contentType, _ := util.ParseEnvVar(common.ImporterContentType, false)
 	imageSize, _ := util.ParseEnvVar(common.ImporterImageSize, false)
@@ -66,12 +155,223 @@ func main() {
 	currentCheckpoint, _ := util.ParseEnvVar(common.ImporterCurrentCheckpoint, false)
 	previousCheckpoint, _ := util.ParseEnvVar(common.ImporterPreviousCheckpoint, false)
 	finalCheckpoint, _ := util.ParseEnvVar(common.ImporterFinalCheckpoint, false)
+	gitRef, _ := util.ParseEnvVar(common.ImporterGitRef, false)
+	gitPath, _ := util.ParseEnvVar(common.ImporterGitPath, false)
+	jsonURLPath, _ := util.ParseEnvVar(common.ImporterJSONURLPath, false)
+	jsonChecksumPath, _ := util.ParseEnvVar(common.ImporterJSONChecksumPath, false)
 	preallocation, err := strconv.ParseBool(os.Getenv(common.Preallocation))
+	archiveMemberSelection, _ := util.ParseEnvVar(common.ImporterArchiveMemberSelection, false)
+	prefetchBufferSize, _ := util.ParseEnvVar(common.ImporterPrefetchBufferSize, false)
+	strictFormatCheck, _ := strconv.ParseBool(os.Getenv(common.ImporterStrictFormatCheck))
+	scratchCacheDir, _ := util.ParseEnvVar(common.ImporterScratchCacheDir, false)
+	scratchCacheMaxSize, _ := util.ParseEnvVar(common.ImporterScratchCacheMaxSize, false)
+	checkImage, _ := strconv.ParseBool(os.Getenv(common.ImporterCheckImage))
+	verifyTransfer, _ := strconv.ParseBool(os.Getenv(common.ImporterVerifyTransfer))
+	qemuImgPath, _ := util.ParseEnvVar(common.ImporterQemuImgPath, false)
+	qemuImgConvertFlags, _ := util.ParseEnvVar(common.ImporterQemuImgConvertFlags, false)
+	manifestFile, _ := util.ParseEnvVar(common.ImporterManifestFile, false)
+	flushPolicy, _ := util.ParseEnvVar(common.ImporterFlushPolicy, false)
+	cleanRestartThreshold, _ := strconv.Atoi(os.Getenv(common.ImporterCleanRestartThreshold))
+	pipedConversion, _ := strconv.ParseBool(os.Getenv(common.ImporterPipedConversion))
+	normalizeQcow2, _ := strconv.ParseBool(os.Getenv(common.ImporterNormalizeQcow2))
+	expectedVirtualSize, _ := util.ParseEnvVar(common.ImporterExpectedVirtualSize, false)
+	virtualSizeTolerance, _ := util.ParseEnvVar(common.ImporterVirtualSizeTolerance, false)
+	registryTagConstraint, _ := util.ParseEnvVar(common.ImporterRegistryTagConstraint, false)
+	nbdTarget, _ := util.ParseEnvVar(common.ImporterNbdTarget, false)
+	chunkChecksumSize, _ := util.ParseEnvVar(common.ImporterChunkChecksumSize, false)
+	archiveExpectedEntries, _ := strconv.ParseInt(os.Getenv(common.ImporterArchiveExpectedEntries), 10, 64)
+	zeroImageThreshold, _ := strconv.ParseFloat(os.Getenv(common.ImporterZeroImageThreshold), 64)
+	zeroImageStrict, _ := strconv.ParseBool(os.Getenv(common.ImporterZeroImageStrict))
+	retryAfterBudget, _ := util.ParseEnvVar(common.ImporterRetryAfterBudget, false)
+	overlayTarget, _ := strconv.ParseBool(os.Getenv(common.ImporterOverlayTarget))
+	maxAllocatedClusters, _ := strconv.ParseInt(os.Getenv(common.ImporterMaxAllocatedClusters), 10, 64)
+	rangedFormatDetection, _ := strconv.ParseBool(os.Getenv(common.ImporterRangedFormatDetection))
+	phaseEvents, _ := strconv.ParseBool(os.Getenv(common.ImporterPhaseEvents))
+	podUID, _ := util.ParseEnvVar(common.ImporterPodUID, false)
+	pinnedSPKIHashes, _ := util.ParseEnvVar(common.ImporterPinnedSPKIHashes, false)
+	conversionSegmentSize, _ := util.ParseEnvVar(common.ImporterConversionSegmentSize, false)
+	checksumAllowlist, _ := util.ParseEnvVar(common.ImporterChecksumAllowlist, false)
+	progressAddress, _ := util.ParseEnvVar(common.ImporterProgressGRPCAddress, false)
+	progressCertDir, _ := util.ParseEnvVar(common.ImporterProgressGRPCCertDir, false)
+	s3AlternateEndpoints, _ := util.ParseEnvVar(common.ImporterS3AlternateEndpoints, false)
+	readRetries, _ := strconv.Atoi(os.Getenv(common.ImporterReadRetries))
+	readRetryBackoff, _ := util.ParseEnvVar(common.ImporterReadRetryBackoff, false)
+	s3Concurrency, _ := strconv.Atoi(os.Getenv(common.ImporterS3Concurrency))
+	expectedChecksum, _ := util.ParseEnvVar(common.ImporterExpectedChecksum, false)
+	s3GetAttempts, _ := strconv.Atoi(os.Getenv(common.ImporterS3GetAttempts))
+	s3GetBackoff, _ := util.ParseEnvVar(common.ImporterS3GetBackoff, false)
+	s3VersionID, _ := util.ParseEnvVar(common.ImporterS3VersionID, false)
+	s3SSECustomerKeyFile, _ := util.ParseEnvVar(common.ImporterS3SSECustomerKeyFile, false)
+	s3SSECustomerAlgorithm, _ := util.ParseEnvVar(common.ImporterS3SSECustomerAlgorithm, false)
+	phaseMetrics, _ := strconv.ParseBool(os.Getenv(common.ImporterPhaseMetrics))
+	tarExtraction, _ := strconv.ParseBool(os.Getenv(common.ImporterTarExtraction))
+	tarMemberPatterns, _ := util.ParseEnvVar(common.ImporterTarMemberPatterns, false)
+	rateLimit, _ := util.ParseEnvVar(common.ImporterRateLimit, false)
+	s3VerifyETag, _ := strconv.ParseBool(os.Getenv(common.ImporterS3VerifyETag))
+	s3ForcePathStyle, _ := strconv.ParseBool(os.Getenv(common.ImporterS3ForcePathStyle))
+	scratchPreallocation, _ := strconv.ParseBool(os.Getenv(common.ImporterScratchPreallocation))
+	s3RangeOffset, _ := strconv.ParseInt(os.Getenv(common.ImporterS3RangeOffset), 10, 64)
+	s3RangeLength, _ := strconv.ParseInt(os.Getenv(common.ImporterS3RangeLength), 10, 64)
+	fileSourceRoot, _ := util.ParseEnvVar(common.ImporterFileSourceRoot, false)
+	strictSourceSize, _ := strconv.ParseBool(os.Getenv(common.ImporterStrictSourceSize))
+	targetFormat, _ := util.ParseEnvVar(common.ImporterTargetFormat, false)
+	s3RequesterPays, _ := strconv.ParseBool(os.Getenv(common.ImporterS3RequesterPays))
+	transferResume, _ := strconv.ParseBool(os.Getenv(common.ImporterTransferResume))
+	userAgent, _ := util.ParseEnvVar(common.ImporterUserAgent, false)
+	maxSourceSize, _ := util.ParseEnvVar(common.ImporterMaxSourceBytes, false)
+	s3Region, _ := util.ParseEnvVar(common.ImporterS3Region, false)
+	s3DisableChecksums, _ := strconv.ParseBool(os.Getenv(common.ImporterS3DisableChecksums))
+	signaturePublicKey, _ := util.ParseEnvVar(common.ImporterSignaturePublicKey, false)
+	signature, _ := util.ParseEnvVar(common.ImporterSignature, false)
+	signatureURL, _ := util.ParseEnvVar(common.ImporterSignatureURL, false)
 	var preallocationApplied bool
+	var zeroImageWarning string
 	var dp importer.DataSourceInterface
 
+	policy, err := util.ParseFlushPolicy(flushPolicy)
+	if err != nil {
+		klog.Errorf("%+v", err)
+		err = util.WriteTerminationMessage(fmt.Sprintf("Invalid flush policy: %+v", err))
+		if err != nil {
+			klog.Errorf("%+v", err)
+		}
+		os.Exit(1)
+	}
+	memberSelection, err := importer.ParseArchiveMemberSelection(archiveMemberSelection)
+	if err != nil {
+		klog.Errorf("%+v", err)
+		err = util.WriteTerminationMessage(fmt.Sprintf("Invalid archive member selection: %+v", err))
+		if err != nil {
+			klog.Errorf("%+v", err)
+		}
+		os.Exit(1)
+	}
+	var retryBudget time.Duration
+	if retryAfterBudget != "" {
+		if retryBudget, err = time.ParseDuration(retryAfterBudget); err != nil {
+			klog.Errorf("Invalid retry after budget %q: %v", retryAfterBudget, err)
+			err = util.WriteTerminationMessage(fmt.Sprintf("Invalid retry after budget %q", retryAfterBudget))
+			if err != nil {
+				klog.Errorf("%+v", err)
+			}
+			os.Exit(1)
+		}
+	}
+	qemuOperations, err := image.NewQEMUOperationsWithOptions(image.QEMUOptions{
+		QemuImgPath:  qemuImgPath,
+		ConvertFlags: strings.Fields(qemuImgConvertFlags),
+	})
+	if err != nil {
+		klog.Errorf("%+v", err)
+		err = util.WriteTerminationMessage(fmt.Sprintf("Invalid qemu-img options: %+v", err))
+		if err != nil {
+			klog.Errorf("%+v", err)
+		}
+		os.Exit(1)
+	}
+	conversionFormat, err := image.ParseTargetFormat(targetFormat)
+	if err != nil {
+		klog.Errorf("%+v", err)
+		err = util.WriteTerminationMessage(fmt.Sprintf("Invalid target format: %+v", err))
+		if err != nil {
+			klog.Errorf("%+v", err)
+		}
+		os.Exit(1)
+	}
+	pins := strings.Split(pinnedSPKIHashes, ",")
+	allowlist, err := importer.ReadChecksumAllowlist(checksumAllowlist)
+	if err != nil {
+		klog.Errorf("%+v", err)
+		err = util.WriteTerminationMessage(fmt.Sprintf("Invalid checksum allowlist: %+v", err))
+		if err != nil {
+			klog.Errorf("%+v", err)
+		}
+		os.Exit(1)
+	}
+	signatureVerification, err := newSignatureVerification(signaturePublicKey, signature, signatureURL)
+	if err != nil {
+		klog.Errorf("%+v", err)
+		err = util.WriteTerminationMessage(fmt.Sprintf("Invalid signature verification: %+v", err))
+		if err != nil {
+			klog.Errorf("%+v", err)
+		}
+		os.Exit(1)
+	}
+	readBackoff := time.Second
+	if readRetryBackoff != "" {
+		if readBackoff, err = time.ParseDuration(readRetryBackoff); err != nil {
+			klog.Errorf("Invalid read retry backoff %q: %v", readRetryBackoff, err)
+			err = util.WriteTerminationMessage(fmt.Sprintf("Invalid read retry backoff %q", readRetryBackoff))
+			if err != nil {
+				klog.Errorf("%+v", err)
+			}
+			os.Exit(1)
+		}
+	}
+	s3Backoff := time.Second
+	if s3GetBackoff != "" {
+		if s3Backoff, err = time.ParseDuration(s3GetBackoff); err != nil {
+			klog.Errorf("Invalid s3 get backoff %q: %v", s3GetBackoff, err)
+			err = util.WriteTerminationMessage(fmt.Sprintf("Invalid s3 get backoff %q", s3GetBackoff))
+			if err != nil {
+				klog.Errorf("%+v", err)
+			}
+			os.Exit(1)
+		}
+	}
+	if phaseMetrics {
+		recorder, err := importer.NewPrometheusPhaseMetricsRecorder(prometheus.DefaultRegisterer)
+		if err != nil {
+			klog.Errorf("%+v", err)
+			err = util.WriteTerminationMessage(fmt.Sprintf("Unable to record the phase metrics: %+v", err))
+			if err != nil {
+				klog.Errorf("%+v", err)
+			}
+			os.Exit(1)
+		}
+		importer.SetPhaseMetricsRecorder(recorder)
+	}
+	var rateLimitBytes int64
+	if rateLimit != "" {
+		rateQuantity, err := resource.ParseQuantity(rateLimit)
+		if err != nil {
+			klog.Errorf("%+v", err)
+			err = util.WriteTerminationMessage(fmt.Sprintf("Invalid rate limit: %+v", err))
+			if err != nil {
+				klog.Errorf("%+v", err)
+			}
+			os.Exit(1)
+		}
+		rateLimitBytes = rateQuantity.Value()
+	}
+	var maxSourceBytes int64
+	if maxSourceSize != "" {
+		maxQuantity, err := resource.ParseQuantity(maxSourceSize)
+		if err != nil {
+			klog.Errorf("%+v", err)
+			err = util.WriteTerminationMessage(fmt.Sprintf("Invalid maximum source size: %+v", err))
+			if err != nil {
+				klog.Errorf("%+v", err)
+			}
+			os.Exit(1)
+		}
+		maxSourceBytes = maxQuantity.Value()
+	}
+	var progressService *importer.ProgressService
+	if progressAddress != "" {
+		progressService, err = importer.StartProgressService(progressAddress, progressCertDir)
+		if err != nil {
+			klog.Errorf("%+v", err)
+			err = util.WriteTerminationMessage(fmt.Sprintf("Unable to start the progress service: %+v", err))
+			if err != nil {
+				klog.Errorf("%+v", err)
+			}
+			os.Exit(1)
+		}
+	}
+
 	//Registry import currently support kubevirt content type only
-	if contentType != string(cdiv1.DataVolumeKubeVirt) && (source == controller.SourceRegistry || source == controller.SourceImageio) {
+	if contentType != string(cdiv1.DataVolumeKubeVirt) && (source == controller.SourceRegistry || source == controller.SourceImageio || source == controller.SourceGit || source == controller.SourceNBD || source == controller.SourceJSONResolver) {
 		klog.Errorf("Unsupported content type %s when importing from %s", contentType, source)
 		os.Exit(1)
 	}
@@ -109,7 +409,7 @@ func main() {
 		if volumeMode == v1.PersistentVolumeFilesystem {
 			quantityWithFSOverhead := importer.GetUsableSpace(filesystemOverhead, minSizeQuantity.Value())
 			klog.Infof("Space adjusted for filesystem overhead: %d.\n", quantityWithFSOverhead)
-			err = image.CreateBlankImage(common.ImporterWritePath, *resource.NewScaledQuantity(quantityWithFSOverhead, 0), preallocation)
+			err = qemuOperations.CreateBlankImage(common.ImporterWritePath, *resource.NewScaledQuantity(quantityWithFSOverhead, 0), preallocation)
 		} else if volumeMode == v1.PersistentVolumeBlock && preallocation {
 			klog.V(1).Info("Preallocating blank block volume")
 			err = image.PreallocateBlankBlock(common.WriteBlockPath, minSizeQuantity)
@@ -133,9 +433,123 @@ func main() {
 		os.Exit(1)
 	} else {
 		klog.V(1).Infoln("begin import process")
+		var prefetchBytes int64
+		if prefetchBufferSize != "" {
+			prefetchQuantity, err := resource.ParseQuantity(prefetchBufferSize)
+			if err != nil {
+				klog.Errorf("%+v", err)
+				err = util.WriteTerminationMessage(fmt.Sprintf("Invalid prefetch buffer size: %+v", err))
+				if err != nil {
+					klog.Errorf("%+v", err)
+				}
+				os.Exit(1)
+			}
+			prefetchBytes = prefetchQuantity.Value()
+		}
+		var expectedVirtualBytes, virtualSizeToleranceBytes int64
+		if expectedVirtualSize != "" {
+			expectedQuantity, err := resource.ParseQuantity(expectedVirtualSize)
+			if err != nil {
+				klog.Errorf("%+v", err)
+				err = util.WriteTerminationMessage(fmt.Sprintf("Invalid expected virtual size: %+v", err))
+				if err != nil {
+					klog.Errorf("%+v", err)
+				}
+				os.Exit(1)
+			}
+			expectedVirtualBytes = expectedQuantity.Value()
+		}
+		if virtualSizeTolerance != "" {
+			toleranceQuantity, err := resource.ParseQuantity(virtualSizeTolerance)
+			if err != nil {
+				klog.Errorf("%+v", err)
+				err = util.WriteTerminationMessage(fmt.Sprintf("Invalid virtual size tolerance: %+v", err))
+				if err != nil {
+					klog.Errorf("%+v", err)
+				}
+				os.Exit(1)
+			}
+			virtualSizeToleranceBytes = toleranceQuantity.Value()
+		}
+		// Images must fit in the target, archives are extracted as files instead.
+		var targetCapacity int64
+		if contentType == string(cdiv1.DataVolumeKubeVirt) {
+			targetCapacity = availableDestSpace
+			if volumeMode == v1.PersistentVolumeFilesystem {
+				targetCapacity = importer.GetUsableSpace(filesystemOverhead, availableDestSpace)
+			}
+		}
+		var chunkChecksumBytes int64
+		if chunkChecksumSize != "" {
+			chunkQuantity, err := resource.ParseQuantity(chunkChecksumSize)
+			if err != nil || chunkQuantity.Value() < 0 {
+				klog.Errorf("Invalid chunk checksum size %q: %v", chunkChecksumSize, err)
+				err = util.WriteTerminationMessage(fmt.Sprintf("Invalid chunk checksum size %q", chunkChecksumSize))
+				if err != nil {
+					klog.Errorf("%+v", err)
+				}
+				os.Exit(1)
+			}
+			chunkChecksumBytes = chunkQuantity.Value()
+		}
+		var conversionSegmentBytes int64
+		if conversionSegmentSize != "" {
+			segmentQuantity, err := resource.ParseQuantity(conversionSegmentSize)
+			if err != nil || segmentQuantity.Value() < 0 {
+				klog.Errorf("Invalid conversion segment size %q: %v", conversionSegmentSize, err)
+				err = util.WriteTerminationMessage(fmt.Sprintf("Invalid conversion segment size %q", conversionSegmentSize))
+				if err != nil {
+					klog.Errorf("%+v", err)
+				}
+				os.Exit(1)
+			}
+			conversionSegmentBytes = segmentQuantity.Value()
+		}
+		var scratchCache *importer.ScratchCache
+		if scratchCacheDir != "" {
+			var maxSize int64
+			if scratchCacheMaxSize != "" {
+				maxSizeQuantity, err := resource.ParseQuantity(scratchCacheMaxSize)
+				if err != nil {
+					klog.Errorf("%+v", err)
+					err = util.WriteTerminationMessage(fmt.Sprintf("Invalid scratch cache size: %+v", err))
+					if err != nil {
+						klog.Errorf("%+v", err)
+					}
+					os.Exit(1)
+				}
+				maxSize = maxSizeQuantity.Value()
+			}
+			scratchCache, err = importer.NewScratchCache(scratchCacheDir, maxSize)
+			if err != nil {
+				// The cache is an optimization, import without it.
+				klog.Warningf("Not using the scratch cache: %+v", err)
+				scratchCache = nil
+			}
+		}
+		sourceOptions := importer.SourceOptions{
+			StrictSourceSize:     strictSourceSize,
+			MaxSourceBytes:       maxSourceBytes,
+			ScratchPreallocation: scratchPreallocation,
+		}
 		switch source {
 		case controller.SourceHTTP:
-			dp, err = importer.NewHTTPDataSource(ep, acc, sec, certDir, cdiv1.DataVolumeContentType(contentType))
+			dp, err = importer.NewHTTPDataSourceWithOptions(ep, acc, sec, certDir, cdiv1.DataVolumeContentType(contentType), importer.HTTPOptions{
+				BearerToken:            bearerToken,
+				UserAgent:              userAgent,
+				PinnedSPKIHashes:       pins,
+				RetryAfterBudget:       retryBudget,
+				RangedFormatDetection:  rangedFormatDetection,
+				PrefetchBufferSize:     prefetchBytes,
+				RateLimit:              rateLimitBytes,
+				StrictFormatCheck:      strictFormatCheck,
+				ExpectedVirtualSize:    expectedVirtualBytes,
+				VirtualSizeTolerance:   virtualSizeToleranceBytes,
+				TargetCapacity:         targetCapacity,
+				ScratchCache:           scratchCache,
+				ExpectedArchiveEntries: archiveExpectedEntries,
+				SourceOptions:          sourceOptions,
+			})
 			if err != nil {
 				klog.Errorf("%+v", err)
 				err = util.WriteTerminationMessage(fmt.Sprintf("Unable to connect to http data source: %+v", err))
@@ -145,7 +559,10 @@ func main() {
 				os.Exit(1)
 			}
 		case controller.SourceImageio:
-			dp, err = importer.NewImageioDataSource(ep, acc, sec, certDir, diskID)
+			dp, err = importer.NewImageioDataSourceWithOptions(ep, acc, sec, certDir, diskID, importer.ImageioOptions{
+				PinnedSPKIHashes: pins,
+				SourceOptions:    sourceOptions,
+			})
 			if err != nil {
 				klog.Errorf("%+v", err)
 				err = util.WriteTerminationMessage(fmt.Sprintf("Unable to connect to imageio data source: %+v", err))
@@ -155,9 +572,62 @@ func main() {
 				os.Exit(1)
 			}
 		case controller.SourceRegistry:
-			dp = importer.NewRegistryDataSource(ep, acc, sec, certDir, insecureTLS)
+			dp, err = importer.NewRegistryDataSourceWithOptions(ep, acc, sec, certDir, importer.RegistryOptions{
+				InsecureTLS:            insecureTLS,
+				ArchiveMemberSelection: memberSelection,
+				TagConstraint:          registryTagConstraint,
+			})
+			if err != nil {
+				klog.Errorf("%+v", err)
+				err = util.WriteTerminationMessage(fmt.Sprintf("Unable to create registry data source: %+v", err))
+				if err != nil {
+					klog.Errorf("%+v", err)
+				}
+				os.Exit(1)
+			}
 		case controller.SourceS3:
-			dp, err = importer.NewS3DataSource(ep, acc, sec, certDir)
+			s3SSECustomerKey, err := readS3CustomerKey(s3SSECustomerKeyFile)
+			if err != nil {
+				klog.Errorf("%+v", err)
+				err = util.WriteTerminationMessage(fmt.Sprintf("Unable to read the S3 SSE-C key: %+v", err))
+				if err != nil {
+					klog.Errorf("%+v", err)
+				}
+				os.Exit(1)
+			}
+			dp, err = importer.NewS3DataSourceWithOptions(ep, acc, sec, certDir, importer.S3Options{
+				VersionID:              s3VersionID,
+				SSECustomerKey:         s3SSECustomerKey,
+				SSECustomerAlgorithm:   s3SSECustomerAlgorithm,
+				ForcePathStyle:         s3ForcePathStyle,
+				RequesterPays:          s3RequesterPays,
+				Region:                 s3Region,
+				DisableChecksums:       s3DisableChecksums,
+				GetAttempts:            s3GetAttempts,
+				GetBackoff:             s3Backoff,
+				ReadRetries:            readRetries,
+				ReadRetryBackoff:       readBackoff,
+				PinnedSPKIHashes:       pins,
+				RetryAfterBudget:       retryBudget,
+				AlternateEndpoints:     strings.Split(s3AlternateEndpoints, ","),
+				TransferResume:         transferResume,
+				ExpectedChecksum:       expectedChecksum,
+				VerifyETag:             s3VerifyETag,
+				RangeOffset:            s3RangeOffset,
+				RangeLength:            s3RangeLength,
+				TarExtraction:          tarExtraction,
+				TarMemberPatterns:      strings.Split(tarMemberPatterns, ","),
+				ArchiveMemberSelection: memberSelection,
+				Concurrency:            s3Concurrency,
+				PrefetchBufferSize:     prefetchBytes,
+				RateLimit:              rateLimitBytes,
+				StrictFormatCheck:      strictFormatCheck,
+				ExpectedVirtualSize:    expectedVirtualBytes,
+				VirtualSizeTolerance:   virtualSizeToleranceBytes,
+				TargetCapacity:         targetCapacity,
+				ScratchCache:           scratchCache,
+				SourceOptions:          sourceOptions,
+			})
 			if err != nil {
 				klog.Errorf("%+v", err)
 				err = util.WriteTerminationMessage(fmt.Sprintf("Unable to connect to s3 data source: %+v", err))
@@ -167,7 +637,15 @@ func main() {
 				os.Exit(1)
 			}
 		case controller.SourceVDDK:
-			dp, err = importer.NewVDDKDataSource(ep, acc, sec, thumbprint, uuid, backingFile, currentCheckpoint, previousCheckpoint, finalCheckpoint, volumeMode)
+			dp, err = importer.NewVDDKDataSourceWithOptions(ep, acc, sec, importer.VDDKOptions{
+				Thumbprint:         thumbprint,
+				UUID:               uuid,
+				BackingFile:        backingFile,
+				CurrentCheckpoint:  currentCheckpoint,
+				PreviousCheckpoint: previousCheckpoint,
+				FinalCheckpoint:    finalCheckpoint,
+				VolumeMode:         volumeMode,
+			})
 			if err != nil {
 				klog.Errorf("%+v", err)
 				err = util.WriteTerminationMessage(fmt.Sprintf("Unable to connect to vddk data source: %+v", err))
@@ -176,6 +654,145 @@ func main() {
 				}
 				os.Exit(1)
 			}
+		case controller.SourceWebSocket:
+			// The secret key holds the bearer token of the streaming endpoint.
+			dp, err = importer.NewWebSocketDataSource(ep, sec, certDir, importer.WebSocketOptions{
+				PinnedSPKIHashes: pins,
+				SourceOptions:    sourceOptions,
+			})
+			if err != nil {
+				klog.Errorf("%+v", err)
+				err = util.WriteTerminationMessage(fmt.Sprintf("Unable to connect to websocket data source: %+v", err))
+				if err != nil {
+					klog.Errorf("%+v", err)
+				}
+				os.Exit(1)
+			}
+		case controller.SourceGit:
+			dp, err = importer.NewGitDataSource(ep, gitPath, acc, sec, certDir, importer.GitOptions{
+				Ref:              gitRef,
+				PinnedSPKIHashes: pins,
+				InsecureTLS:      insecureTLS,
+				SourceOptions:    sourceOptions,
+			})
+			if err != nil {
+				klog.Errorf("%+v", err)
+				err = util.WriteTerminationMessage(fmt.Sprintf("Unable to connect to git data source: %+v", err))
+				if err != nil {
+					klog.Errorf("%+v", err)
+				}
+				os.Exit(1)
+			}
+		case controller.SourceNBD:
+			dp, err = importer.NewNBDDataSource(ep, certDir)
+			if err != nil {
+				klog.Errorf("%+v", err)
+				err = util.WriteTerminationMessage(fmt.Sprintf("Unable to connect to nbd data source: %+v", err))
+				if err != nil {
+					klog.Errorf("%+v", err)
+				}
+				os.Exit(1)
+			}
+		case controller.SourceJSONResolver:
+			// The secret key holds the bearer token of the metadata endpoint.
+			dp, err = importer.NewJSONResolverDataSource(ep, jsonURLPath, sec, certDir, importer.JSONResolverOptions{
+				ChecksumPath:     jsonChecksumPath,
+				PinnedSPKIHashes: pins,
+				RetryAfterBudget: retryBudget,
+				SourceOptions:    sourceOptions,
+			})
+			if err != nil {
+				klog.Errorf("%+v", err)
+				err = util.WriteTerminationMessage(fmt.Sprintf("Unable to connect to json resolver data source: %+v", err))
+				if err != nil {
+					klog.Errorf("%+v", err)
+				}
+				os.Exit(1)
+			}
+		case controller.SourceAzureBlob:
+			// The access key holds the storage account, the secret key a SAS token or the shared key.
+			dp, err = importer.NewAzureBlobDataSource(ep, acc, sec, certDir, importer.AzureBlobOptions{
+				PinnedSPKIHashes: pins,
+				RetryAfterBudget: retryBudget,
+				RateLimit:        rateLimitBytes,
+				ReadRetries:      readRetries,
+				ReadRetryBackoff: readBackoff,
+				SourceOptions:    sourceOptions,
+			})
+			if err != nil {
+				klog.Errorf("%+v", err)
+				err = util.WriteTerminationMessage(fmt.Sprintf("Unable to connect to azure blob data source: %+v", err))
+				if err != nil {
+					klog.Errorf("%+v", err)
+				}
+				os.Exit(1)
+			}
+		case controller.SourceFTP:
+			// The access and secret keys are the user and the password.
+			dp, err = importer.NewFTPDataSource(ep, acc, sec, certDir, importer.FTPOptions{
+				PinnedSPKIHashes: pins,
+				TargetCapacity:   targetCapacity,
+				RateLimit:        rateLimitBytes,
+				ReadRetries:      readRetries,
+				ReadRetryBackoff: readBackoff,
+				SourceOptions:    sourceOptions,
+			})
+			if err != nil {
+				klog.Errorf("%+v", err)
+				err = util.WriteTerminationMessage(fmt.Sprintf("Unable to connect to ftp data source: %+v", err))
+				if err != nil {
+					klog.Errorf("%+v", err)
+				}
+				os.Exit(1)
+			}
+		case controller.SourceWebDAV:
+			// The access and secret keys are the user and the app password.
+			dp, err = importer.NewWebDAVDataSource(ep, acc, sec, certDir, importer.WebDAVOptions{
+				UserAgent:        userAgent,
+				PinnedSPKIHashes: pins,
+				RetryAfterBudget: retryBudget,
+				TargetCapacity:   targetCapacity,
+				RateLimit:        rateLimitBytes,
+				ReadRetries:      readRetries,
+				ReadRetryBackoff: readBackoff,
+				SourceOptions:    sourceOptions,
+			})
+			if err != nil {
+				klog.Errorf("%+v", err)
+				err = util.WriteTerminationMessage(fmt.Sprintf("Unable to connect to webdav data source: %+v", err))
+				if err != nil {
+					klog.Errorf("%+v", err)
+				}
+				os.Exit(1)
+			}
+		case controller.SourceFile:
+			// The endpoint is the path of the file in the mounted share.
+			dp, err = importer.NewFileDataSource(fileSourceRoot, ep, importer.FileOptions{
+				TargetCapacity: targetCapacity,
+				SourceOptions:  sourceOptions,
+			})
+			if err != nil {
+				klog.Errorf("%+v", err)
+				err = util.WriteTerminationMessage(fmt.Sprintf("Unable to open file data source: %+v", err))
+				if err != nil {
+					klog.Errorf("%+v", err)
+				}
+				os.Exit(1)
+			}
+		case controller.SourceSMB:
+			// The share is mounted by the SMB CSI driver, with the credentials of the secret.
+			dp, err = importer.NewSMBDataSource(ep, fileSourceRoot, importer.FileOptions{
+				TargetCapacity: targetCapacity,
+				SourceOptions:  sourceOptions,
+			})
+			if err != nil {
+				klog.Errorf("%+v", err)
+				err = util.WriteTerminationMessage(fmt.Sprintf("Unable to create smb data source: %+v", err))
+				if err != nil {
+					klog.Errorf("%+v", err)
+				}
+				os.Exit(1)
+			}
 		default:
 			klog.Errorf("Unknown source type %s\n", source)
 			err = util.WriteTerminationMessage(fmt.Sprintf("Unknown data source: %s", source))
@@ -186,6 +803,39 @@ func main() {
 		}
 		defer dp.Close()
 		processor := importer.NewDataProcessor(dp, dest, dataDir, common.ScratchDataDir, imageSize, filesystemOverhead, preallocation)
+		processor.SetImageCheck(checkImage)
+		processor.SetTransferVerification(verifyTransfer)
+		processor.SetManifestFile(manifestFile)
+		processor.SetQcow2Normalization(normalizeQcow2)
+		processor.SetChunkChecksums(chunkChecksumBytes)
+		processor.SetZeroImageCheck(zeroImageThreshold, zeroImageStrict)
+		processor.SetOverlayTarget(overlayTarget)
+		processor.SetMaxAllocatedClusters(maxAllocatedClusters)
+		processor.SetResumableConversion(conversionSegmentBytes)
+		processor.SetCleanRestartThreshold(cleanRestartThreshold)
+		processor.SetPipedConversion(pipedConversion)
+		processor.SetProgressService(progressService)
+		processor.SetFlushPolicy(policy)
+		processor.SetTargetFormat(conversionFormat)
+		processor.SetQEMUOperations(qemuOperations)
+		processor.SetChecksumAllowlist(allowlist)
+		processor.SetSignatureVerification(signatureVerification)
+		if phaseEvents {
+			// Events only help debugging, the import goes on without them.
+			if recorder, pod, err := createEventRecorder(podUID); err != nil {
+				klog.Warningf("Not recording phase events: %v", err)
+			} else {
+				processor.SetEventRecorder(recorder, pod)
+			}
+		}
+		if err := processor.SetNbdTarget(nbdTarget); err != nil {
+			klog.Errorf("%+v", err)
+			err = util.WriteTerminationMessage(fmt.Sprintf("Invalid NBD target: %+v", err))
+			if err != nil {
+				klog.Errorf("%+v", err)
+			}
+			os.Exit(1)
+		}
 		err = processor.ProcessData()
 		if err != nil {
 			klog.Errorf("%+v", err)
@@ -198,14 +848,20 @@ func main() {
 				klog.Errorf("%+v", err)
 			}
 			dp.Close()
+			// Let the subscribers receive the failure.
+			progressService.Stop()
 			os.Exit(1)
 		}
 		preallocationApplied = processor.PreallocationApplied()
+		zeroImageWarning = processor.ZeroImageWarning()
 	}
 	message := "Import Complete"
 	if preallocationApplied {
 		message += ", " + common.PreallocationApplied
 	}
+	if zeroImageWarning != "" {
+		message += ", " + zeroImageWarning
+	}
 	err = util.WriteTerminationMessage(message)
 	if err != nil {
 		klog.Errorf("%+v", err)
@@ -214,5 +870,6 @@ func main() {
 		}
 		os.Exit(1)
 	}
+	progressService.Stop()
 	klog.V(1).Infoln(message)
 }
@@ -465,6 +465,10 @@ type CDIConfigSpec struct {
 	Preallocation *bool `json:"preallocation,omitempty"`
 	// InsecureRegistries is a list of TLS disabled registries
 	InsecureRegistries []string `json:"insecureRegistries,omitempty"`
+	// QemuImgPath is the absolute path of the qemu-img binary in the importer image the import pods run, qemu-img of the PATH if not set
+	QemuImgPath *string `json:"qemuImgPath,omitempty"`
+	// QemuImgConvertFlags are extra flags of the qemu-img convert invocations of the import pods, for instance -t none. Only -t, -T, -m, -r, -W, -U and --salvage are allowed
+	QemuImgConvertFlags []string `json:"qemuImgConvertFlags,omitempty"`
 }
 
 //CDIConfigStatus provides the most recently observed status of the CDI Config resource
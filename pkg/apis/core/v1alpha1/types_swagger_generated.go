@@ -212,6 +212,8 @@ func (CDIConfigSpec) SwaggerDoc() map[string]string {
 		"filesystemOverhead":       "FilesystemOverhead describes the space reserved for overhead when using Filesystem volumes. A value is between 0 and 1, if not defined it is 0.055 (5.5% overhead)",
 		"preallocation":            "Preallocation controls whether storage for DataVolumes should be allocated in advance.",
 		"insecureRegistries":       "InsecureRegistries is a list of TLS disabled registries",
+		"qemuImgPath":              "QemuImgPath is the absolute path of the qemu-img binary in the importer image the import pods run, qemu-img of the PATH if not set",
+		"qemuImgConvertFlags":      "QemuImgConvertFlags are extra flags of the qemu-img convert invocations of the import pods, for instance -t none. Only -t, -T, -m, -r, -W, -U and --salvage are allowed",
 	}
 }
 
@@ -14516,6 +14516,28 @@ func schema_pkg_apis_core_v1beta1_CDIConfigSpec(ref common.ReferenceCallback) co
 							},
 						},
 					},
+					"qemuImgPath": {
+						SchemaProps: spec.SchemaProps{
+							Description: "QemuImgPath is the absolute path of the qemu-img binary in the importer image the import pods run, qemu-img of the PATH if not set",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"qemuImgConvertFlags": {
+						SchemaProps: spec.SchemaProps{
+							Description: "QemuImgConvertFlags are extra flags of the qemu-img convert invocations of the import pods, for instance -t none. Only -t, -T, -m, -r, -W, -U and --salvage are allowed",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Default: "",
+										Type:    []string{"string"},
+										Format:  "",
+									},
+								},
+							},
+						},
+					},
 				},
 			},
 		},
@@ -184,6 +184,16 @@ func (in *CDIConfigSpec) DeepCopyInto(out *CDIConfigSpec) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.QemuImgPath != nil {
+		in, out := &in.QemuImgPath, &out.QemuImgPath
+		*out = new(string)
+		**out = **in
+	}
+	if in.QemuImgConvertFlags != nil {
+		in, out := &in.QemuImgConvertFlags, &out.QemuImgConvertFlags
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	return
 }
 
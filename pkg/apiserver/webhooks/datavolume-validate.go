@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"net/url"
 	"reflect"
+	"strings"
 
 	admissionv1 "k8s.io/api/admission/v1"
 	v1 "k8s.io/api/core/v1"
@@ -46,7 +47,9 @@ type dataVolumeValidatingWebhook struct {
 	cdiClient cdiclient.Interface
 }
 
-func validateSourceURL(sourceURL string) string {
+// validateSourceURL validates the source URL, if allowSRV is true the URL may also refer to a DNS SRV record
+// using the srv+http and srv+https schemes.
+func validateSourceURL(sourceURL string, allowSRV bool) string {
 	if sourceURL == "" {
 		return "source URL is empty"
 	}
@@ -54,7 +57,11 @@ func validateSourceURL(sourceURL string) string {
 	if err != nil {
 		return fmt.Sprintf("Invalid source URL: %s", sourceURL)
 	}
-	if url.Scheme != "http" && url.Scheme != "https" {
+	scheme := url.Scheme
+	if allowSRV {
+		scheme = strings.TrimPrefix(scheme, "srv+")
+	}
+	if scheme != "http" && scheme != "https" {
 		return fmt.Sprintf("Invalid source URL scheme: %s", sourceURL)
 	}
 	return ""
@@ -195,6 +202,8 @@ func (wh *dataVolumeValidatingWebhook) validateDataVolumeSpec(request *admission
 	}
 	// if source types are HTTP, Imageio, S3 or VDDK, check if URL is valid
 	if spec.Source.HTTP != nil || spec.Source.S3 != nil || spec.Source.Imageio != nil || spec.Source.VDDK != nil {
+		// HTTP and S3 endpoints can be resolved from a SRV record.
+		allowSRV := spec.Source.HTTP != nil || spec.Source.S3 != nil
 		if spec.Source.HTTP != nil {
 			url = spec.Source.HTTP.URL
 			sourceType = field.Child("source", "HTTP", "url").String()
@@ -208,7 +217,7 @@ func (wh *dataVolumeValidatingWebhook) validateDataVolumeSpec(request *admission
 			url = spec.Source.VDDK.URL
 			sourceType = field.Child("source", "VDDK", "url").String()
 		}
-		err := validateSourceURL(url)
+		err := validateSourceURL(url, allowSRV)
 		if err != "" {
 			causes = append(causes, metav1.StatusCause{
 				Type:    metav1.CauseTypeFieldValueInvalid,
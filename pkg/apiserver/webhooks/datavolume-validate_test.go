@@ -55,6 +55,18 @@ var _ = Describe("Validating Webhook", func() {
 			Expect(resp.Allowed).To(Equal(true))
 		})
 
+		It("should accept DataVolume with HTTP source referring to a SRV record on create", func() {
+			dataVolume := newHTTPDataVolume("testDV", "srv+https://_images._tcp.example.com/disk.img")
+			resp := validateDataVolumeCreate(dataVolume)
+			Expect(resp.Allowed).To(Equal(true))
+		})
+
+		It("should reject DataVolume with HTTP source referring to a SRV record with an unsupported scheme", func() {
+			dataVolume := newHTTPDataVolume("testDV", "srv+ftp://_images._tcp.example.com/disk.img")
+			resp := validateDataVolumeCreate(dataVolume)
+			Expect(resp.Allowed).To(Equal(false))
+		})
+
 		It("should reject DataVolume when target pvc exists", func() {
 			dataVolume := newPVCDataVolume("testDV", "testNamespace", "test")
 			pvc := &corev1.PersistentVolumeClaim{
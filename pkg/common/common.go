@@ -59,6 +59,20 @@ const (
 	ImportProxyConfigMapKey = "ca.pem"
 	// ImporterProxyCertDir is where the configmap containing proxy certs will be mounted
 	ImporterProxyCertDir = "/proxycerts/"
+	// ImporterSecretExtraHeadersDir is where the secrets containing extra HTTP headers will be mounted
+	ImporterSecretExtraHeadersDir = "/extraheaders"
+	// ImporterS3SSECustomerKeyDir is where the secret containing the S3 SSE-C key will be mounted
+	ImporterS3SSECustomerKeyDir = "/ssecustomerkey"
+	// ImporterChecksumAllowlistDir is where the configmap containing the checksum allowlist will be mounted
+	ImporterChecksumAllowlistDir = "/checksumallowlist"
+	// ImporterFileSourceDir is where the shares the file data source imports from are mounted
+	ImporterFileSourceDir = "/source"
+	// ScratchCacheDataDir is where the PVC the sources transferred to scratch space are cached in will be mounted
+	ScratchCacheDataDir = "/scratchcache"
+	// ImporterProgressCertDir is where the secret containing the certificates of the progress service will be mounted
+	ImporterProgressCertDir = "/progresscerts"
+	// ImporterSignaturePublicKeysDir is where the configmap containing the signature public keys will be mounted
+	ImporterSignaturePublicKeysDir = "/signaturepublickeys"
 
 	// PullPolicy provides a constant to capture our env variable "PULL_POLICY" (only used by cmd/cdi-controller/controller.go)
 	PullPolicy = "PULL_POLICY"
@@ -72,6 +86,8 @@ const (
 	ImporterAccessKeyID = "IMPORTER_ACCESS_KEY_ID"
 	// ImporterSecretKey provides a constant to capture our env variable "IMPORTER_SECRET_KEY"
 	ImporterSecretKey = "IMPORTER_SECRET_KEY"
+	// ImporterBearerToken provides a constant to capture our env variable "IMPORTER_BEARER_TOKEN"
+	ImporterBearerToken = "IMPORTER_BEARER_TOKEN"
 	// ImporterImageSize provides a constant to capture our env variable "IMPORTER_IMAGE_SIZE"
 	ImporterImageSize = "IMPORTER_IMAGE_SIZE"
 	// ImporterCertDirVar provides a constant to capture our env variable "IMPORTER_CERT_DIR"
@@ -92,6 +108,146 @@ const (
 	ImporterPreviousCheckpoint = "IMPORTER_PREVIOUS_CHECKPOINT"
 	// ImporterFinalCheckpoint provides a constant to capture our env variable "IMPORTER_FINAL_CHECKPOINT"
 	ImporterFinalCheckpoint = "IMPORTER_FINAL_CHECKPOINT"
+	// ImporterGitRef provides a constant to capture our env variable "IMPORTER_GIT_REF"
+	ImporterGitRef = "IMPORTER_GIT_REF"
+	// ImporterGitPath provides a constant to capture our env variable "IMPORTER_GIT_PATH"
+	ImporterGitPath = "IMPORTER_GIT_PATH"
+	// ImporterJSONURLPath provides a constant to capture our env variable "IMPORTER_JSON_URL_PATH"
+	ImporterJSONURLPath = "IMPORTER_JSON_URL_PATH"
+	// ImporterJSONChecksumPath provides a constant to capture our env variable "IMPORTER_JSON_CHECKSUM_PATH"
+	ImporterJSONChecksumPath = "IMPORTER_JSON_CHECKSUM_PATH"
+	// ImporterArchiveMemberSelection provides a constant to capture our env variable "IMPORTER_ARCHIVE_MEMBER_SELECTION"
+	ImporterArchiveMemberSelection = "IMPORTER_ARCHIVE_MEMBER_SELECTION"
+	// ImporterPrefetchBufferSize provides a constant to capture our env variable "IMPORTER_PREFETCH_BUFFER_SIZE"
+	ImporterPrefetchBufferSize = "IMPORTER_PREFETCH_BUFFER_SIZE"
+	// ImporterStrictFormatCheck provides a constant to capture our env variable "IMPORTER_STRICT_FORMAT_CHECK"
+	ImporterStrictFormatCheck = "IMPORTER_STRICT_FORMAT_CHECK"
+	// ImporterScratchCacheDir provides a constant to capture our env variable "IMPORTER_SCRATCH_CACHE_DIR"
+	ImporterScratchCacheDir = "IMPORTER_SCRATCH_CACHE_DIR"
+	// ImporterScratchCacheMaxSize provides a constant to capture our env variable "IMPORTER_SCRATCH_CACHE_MAX_SIZE"
+	ImporterScratchCacheMaxSize = "IMPORTER_SCRATCH_CACHE_MAX_SIZE"
+	// ImporterExtraHeader provides a constant to capture our env variables "IMPORTER_EXTRA_HEADER_<n>", each holding one extra HTTP header
+	ImporterExtraHeader = "IMPORTER_EXTRA_HEADER_"
+	// ImporterCheckImage provides a constant to capture our env variable "IMPORTER_CHECK_IMAGE"
+	ImporterCheckImage = "IMPORTER_CHECK_IMAGE"
+	// ImporterVerifyTransfer provides a constant to capture our env variable "IMPORTER_VERIFY_TRANSFER"
+	ImporterVerifyTransfer = "IMPORTER_VERIFY_TRANSFER"
+	// ImporterQemuImgPath provides a constant to capture our env variable "IMPORTER_QEMU_IMG_PATH"
+	ImporterQemuImgPath = "IMPORTER_QEMU_IMG_PATH"
+	// ImporterQemuImgConvertFlags provides a constant to capture our env variable "IMPORTER_QEMU_IMG_CONVERT_FLAGS"
+	ImporterQemuImgConvertFlags = "IMPORTER_QEMU_IMG_CONVERT_FLAGS"
+	// ImporterManifestFile provides a constant to capture our env variable "IMPORTER_MANIFEST_FILE"
+	ImporterManifestFile = "IMPORTER_MANIFEST_FILE"
+	// ImporterFlushPolicy provides a constant to capture our env variable "IMPORTER_FLUSH_POLICY"
+	ImporterFlushPolicy = "IMPORTER_FLUSH_POLICY"
+	// ImporterCleanRestartThreshold provides a constant to capture our env variable "IMPORTER_CLEAN_RESTART_THRESHOLD"
+	ImporterCleanRestartThreshold = "IMPORTER_CLEAN_RESTART_THRESHOLD"
+	// ImporterPipedConversion provides a constant to capture our env variable "IMPORTER_PIPED_CONVERSION"
+	ImporterPipedConversion = "IMPORTER_PIPED_CONVERSION"
+	// ImporterNormalizeQcow2 provides a constant to capture our env variable "IMPORTER_NORMALIZE_QCOW2"
+	ImporterNormalizeQcow2 = "IMPORTER_NORMALIZE_QCOW2"
+	// ImporterExpectedVirtualSize provides a constant to capture our env variable "IMPORTER_EXPECTED_VIRTUAL_SIZE"
+	ImporterExpectedVirtualSize = "IMPORTER_EXPECTED_VIRTUAL_SIZE"
+	// ImporterVirtualSizeTolerance provides a constant to capture our env variable "IMPORTER_VIRTUAL_SIZE_TOLERANCE"
+	ImporterVirtualSizeTolerance = "IMPORTER_VIRTUAL_SIZE_TOLERANCE"
+	// ImporterRegistryTagConstraint provides a constant to capture our env variable "IMPORTER_REGISTRY_TAG_CONSTRAINT"
+	ImporterRegistryTagConstraint = "IMPORTER_REGISTRY_TAG_CONSTRAINT"
+	// ImporterNbdTarget provides a constant to capture our env variable "IMPORTER_NBD_TARGET"
+	ImporterNbdTarget = "IMPORTER_NBD_TARGET"
+	// ImporterChunkChecksumSize provides a constant to capture our env variable "IMPORTER_CHUNK_CHECKSUM_SIZE"
+	ImporterChunkChecksumSize = "IMPORTER_CHUNK_CHECKSUM_SIZE"
+	// ImporterArchiveExpectedEntries provides a constant to capture our env variable "IMPORTER_ARCHIVE_EXPECTED_ENTRIES"
+	ImporterArchiveExpectedEntries = "IMPORTER_ARCHIVE_EXPECTED_ENTRIES"
+	// ImporterZeroImageThreshold provides a constant to capture our env variable "IMPORTER_ZERO_IMAGE_THRESHOLD"
+	ImporterZeroImageThreshold = "IMPORTER_ZERO_IMAGE_THRESHOLD"
+	// ImporterZeroImageStrict provides a constant to capture our env variable "IMPORTER_ZERO_IMAGE_STRICT"
+	ImporterZeroImageStrict = "IMPORTER_ZERO_IMAGE_STRICT"
+	// ImporterRetryAfterBudget provides a constant to capture our env variable "IMPORTER_RETRY_AFTER_BUDGET"
+	ImporterRetryAfterBudget = "IMPORTER_RETRY_AFTER_BUDGET"
+	// ImporterOverlayTarget provides a constant to capture our env variable "IMPORTER_OVERLAY_TARGET"
+	ImporterOverlayTarget = "IMPORTER_OVERLAY_TARGET"
+	// ImporterMaxAllocatedClusters provides a constant to capture our env variable "IMPORTER_MAX_ALLOCATED_CLUSTERS"
+	ImporterMaxAllocatedClusters = "IMPORTER_MAX_ALLOCATED_CLUSTERS"
+	// ImporterRangedFormatDetection provides a constant to capture our env variable "IMPORTER_RANGED_FORMAT_DETECTION"
+	ImporterRangedFormatDetection = "IMPORTER_RANGED_FORMAT_DETECTION"
+	// ImporterPhaseEvents provides a constant to capture our env variable "IMPORTER_PHASE_EVENTS"
+	ImporterPhaseEvents = "IMPORTER_PHASE_EVENTS"
+	// ImporterPodUID provides a constant to capture our env variable "IMPORTER_POD_UID"
+	ImporterPodUID = "IMPORTER_POD_UID"
+	// ImporterPinnedSPKIHashes provides a constant to capture our env variable "IMPORTER_PINNED_SPKI_HASHES"
+	ImporterPinnedSPKIHashes = "IMPORTER_PINNED_SPKI_HASHES"
+	// ImporterConversionSegmentSize provides a constant to capture our env variable "IMPORTER_CONVERSION_SEGMENT_SIZE"
+	ImporterConversionSegmentSize = "IMPORTER_CONVERSION_SEGMENT_SIZE"
+	// ImporterChecksumAllowlist provides a constant to capture our env variable "IMPORTER_CHECKSUM_ALLOWLIST"
+	ImporterChecksumAllowlist = "IMPORTER_CHECKSUM_ALLOWLIST"
+	// ImporterProgressGRPCAddress provides a constant to capture our env variable "IMPORTER_PROGRESS_GRPC_ADDRESS"
+	ImporterProgressGRPCAddress = "IMPORTER_PROGRESS_GRPC_ADDRESS"
+	// ImporterProgressGRPCCertDir provides a constant to capture our env variable "IMPORTER_PROGRESS_GRPC_CERT_DIR"
+	ImporterProgressGRPCCertDir = "IMPORTER_PROGRESS_GRPC_CERT_DIR"
+	// ImporterS3AlternateEndpoints provides a constant to capture our env variable "IMPORTER_S3_ALTERNATE_ENDPOINTS"
+	ImporterS3AlternateEndpoints = "IMPORTER_S3_ALTERNATE_ENDPOINTS"
+	// ImporterReadRetries provides a constant to capture our env variable "IMPORTER_READ_RETRIES"
+	ImporterReadRetries = "IMPORTER_READ_RETRIES"
+	// ImporterReadRetryBackoff provides a constant to capture our env variable "IMPORTER_READ_RETRY_BACKOFF"
+	ImporterReadRetryBackoff = "IMPORTER_READ_RETRY_BACKOFF"
+	// ImporterS3Concurrency provides a constant to capture our env variable "IMPORTER_S3_CONCURRENCY"
+	ImporterS3Concurrency = "IMPORTER_S3_CONCURRENCY"
+	// ImporterExpectedChecksum provides a constant to capture our env variable "IMPORTER_EXPECTED_CHECKSUM"
+	ImporterExpectedChecksum = "IMPORTER_EXPECTED_CHECKSUM"
+	// ImporterS3GetAttempts provides a constant to capture our env variable "IMPORTER_S3_GET_ATTEMPTS"
+	ImporterS3GetAttempts = "IMPORTER_S3_GET_ATTEMPTS"
+	// ImporterS3GetBackoff provides a constant to capture our env variable "IMPORTER_S3_GET_BACKOFF"
+	ImporterS3GetBackoff = "IMPORTER_S3_GET_BACKOFF"
+	// ImporterS3VersionID provides a constant to capture our env variable "IMPORTER_S3_VERSION_ID"
+	ImporterS3VersionID = "IMPORTER_S3_VERSION_ID"
+	// ImporterS3SSECustomerKeyFile provides a constant to capture our env variable "IMPORTER_S3_SSE_CUSTOMER_KEY_FILE"
+	ImporterS3SSECustomerKeyFile = "IMPORTER_S3_SSE_CUSTOMER_KEY_FILE"
+	// ImporterS3SSECustomerAlgorithm provides a constant to capture our env variable "IMPORTER_S3_SSE_CUSTOMER_ALGORITHM"
+	ImporterS3SSECustomerAlgorithm = "IMPORTER_S3_SSE_CUSTOMER_ALGORITHM"
+	// ImporterPhaseMetrics provides a constant to capture our env variable "IMPORTER_PHASE_METRICS"
+	ImporterPhaseMetrics = "IMPORTER_PHASE_METRICS"
+	// ImporterTarExtraction provides a constant to capture our env variable "IMPORTER_TAR_EXTRACTION"
+	ImporterTarExtraction = "IMPORTER_TAR_EXTRACTION"
+	// ImporterTarMemberPatterns provides a constant to capture our env variable "IMPORTER_TAR_MEMBER_PATTERNS"
+	ImporterTarMemberPatterns = "IMPORTER_TAR_MEMBER_PATTERNS"
+	// ImporterRateLimit provides a constant to capture our env variable "IMPORTER_RATE_LIMIT"
+	ImporterRateLimit = "IMPORTER_RATE_LIMIT"
+	// ImporterS3VerifyETag provides a constant to capture our env variable "IMPORTER_S3_VERIFY_ETAG"
+	ImporterS3VerifyETag = "IMPORTER_S3_VERIFY_ETAG"
+	// ImporterS3ForcePathStyle provides a constant to capture our env variable "IMPORTER_S3_FORCE_PATH_STYLE"
+	ImporterS3ForcePathStyle = "IMPORTER_S3_FORCE_PATH_STYLE"
+	// ImporterScratchPreallocation provides a constant to capture our env variable "IMPORTER_SCRATCH_PREALLOCATION"
+	ImporterScratchPreallocation = "IMPORTER_SCRATCH_PREALLOCATION"
+	// ImporterS3RangeOffset provides a constant to capture our env variable "IMPORTER_S3_RANGE_OFFSET"
+	ImporterS3RangeOffset = "IMPORTER_S3_RANGE_OFFSET"
+	// ImporterS3RangeLength provides a constant to capture our env variable "IMPORTER_S3_RANGE_LENGTH"
+	ImporterS3RangeLength = "IMPORTER_S3_RANGE_LENGTH"
+	// ImporterFileSourceRoot provides a constant to capture our env variable "IMPORTER_FILE_SOURCE_ROOT"
+	ImporterFileSourceRoot = "IMPORTER_FILE_SOURCE_ROOT"
+	// ImporterStrictSourceSize provides a constant to capture our env variable "IMPORTER_STRICT_SOURCE_SIZE"
+	ImporterStrictSourceSize = "IMPORTER_STRICT_SOURCE_SIZE"
+	// ImporterTargetFormat provides a constant to capture our env variable "IMPORTER_TARGET_FORMAT"
+	ImporterTargetFormat = "IMPORTER_TARGET_FORMAT"
+	// ImporterS3RequesterPays provides a constant to capture our env variable "IMPORTER_S3_REQUESTER_PAYS"
+	ImporterS3RequesterPays = "IMPORTER_S3_REQUESTER_PAYS"
+	// ImporterLogLevel provides a constant to capture our env variable "IMPORTER_LOG_LEVEL"
+	ImporterLogLevel = "IMPORTER_LOG_LEVEL"
+	// ImporterTransferResume provides a constant to capture our env variable "IMPORTER_TRANSFER_RESUME"
+	ImporterTransferResume = "IMPORTER_TRANSFER_RESUME"
+	// ImporterUserAgent provides a constant to capture our env variable "IMPORTER_USER_AGENT"
+	ImporterUserAgent = "IMPORTER_USER_AGENT"
+	// ImporterMaxSourceBytes provides a constant to capture our env variable "IMPORTER_MAX_SOURCE_BYTES"
+	ImporterMaxSourceBytes = "IMPORTER_MAX_SOURCE_BYTES"
+	// ImporterS3Region provides a constant to capture our env variable "IMPORTER_S3_REGION"
+	ImporterS3Region = "IMPORTER_S3_REGION"
+	// ImporterS3DisableChecksums provides a constant to capture our env variable "IMPORTER_S3_DISABLE_CHECKSUMS"
+	ImporterS3DisableChecksums = "IMPORTER_S3_DISABLE_CHECKSUMS"
+	// ImporterSignaturePublicKey provides a constant to capture our env variable "IMPORTER_SIGNATURE_PUBLIC_KEY"
+	ImporterSignaturePublicKey = "IMPORTER_SIGNATURE_PUBLIC_KEY"
+	// ImporterSignature provides a constant to capture our env variable "IMPORTER_SIGNATURE"
+	ImporterSignature = "IMPORTER_SIGNATURE"
+	// ImporterSignatureURL provides a constant to capture our env variable "IMPORTER_SIGNATURE_URL"
+	ImporterSignatureURL = "IMPORTER_SIGNATURE_URL"
 	// Preallocation provides a constant to capture out env variable "PREALLOCATION"
 	Preallocation = "PREALLOCATION"
 	// ImportProxyHTTP provides a constant to capture our env variable "HTTP_PROXY"
@@ -148,6 +304,15 @@ const (
 	KeyAccess = "accessKeyId"
 	// KeySecret provides a constant to the secretKey label using in controller pkg and transport_test.go
 	KeySecret = "secretKey"
+	// KeySSECustomerKey provides a constant to the sseCustomerKey label of the secret holding a base64 encoded S3
+	// SSE-C key
+	KeySSECustomerKey = "sseCustomerKey"
+	// KeyBearerToken provides a constant to the bearerToken label of the secret holding the bearer token of the http
+	// requests
+	KeyBearerToken = "bearerToken"
+	// KeySignaturePublicKeys provides a constant to the publicKeys label of the configmap holding the GPG public keys
+	// the signatures of the sources are verified with
+	KeySignaturePublicKeys = "publicKeys"
 
 	// DefaultResyncPeriod sets a 10 minute resync period, used in the controller pkg and the controller cmd executable
 	DefaultResyncPeriod = 10 * time.Minute
@@ -4,8 +4,11 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"path"
+	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	sdkapi "kubevirt.io/controller-lifecycle-operator-sdk/pkg/sdk/api"
@@ -29,6 +32,7 @@ import (
 	cdiv1 "kubevirt.io/containerized-data-importer/pkg/apis/core/v1beta1"
 	"kubevirt.io/containerized-data-importer/pkg/common"
 	featuregates "kubevirt.io/containerized-data-importer/pkg/feature-gates"
+	"kubevirt.io/containerized-data-importer/pkg/image"
 	"kubevirt.io/containerized-data-importer/pkg/util"
 	"kubevirt.io/containerized-data-importer/pkg/util/naming"
 )
@@ -50,6 +54,26 @@ const (
 	SourceImageio = "imageio"
 	// SourceVDDK is the source type of VDDK
 	SourceVDDK = "vddk"
+	// SourceWebSocket is the source type of a WebSocket streaming endpoint
+	SourceWebSocket = "websocket"
+	// SourceGit is the source type of a file in a git repository
+	SourceGit = "git"
+	// SourceNBD is the source type of an export of a running NBD server
+	SourceNBD = "nbd"
+	// SourceJSONResolver is the source type of a JSON metadata endpoint resolving the download URL
+	SourceJSONResolver = "json-resolver"
+	// SourceAzureBlob is the source type of an Azure Blob Storage blob
+	SourceAzureBlob = "azure-blob"
+	// SourceFTP is the source type of a file on an FTP or FTPS server
+	SourceFTP = "ftp"
+	// SourceWebDAV is the source type of a file on a WebDAV server
+	SourceWebDAV = "webdav"
+	// SourceFile is the source type of a file of a share mounted in the importer pod
+	SourceFile = "file"
+	// SourceSMB is the source type of a file on an SMB/CIFS share, mounted by the SMB CSI driver
+	SourceSMB = "smb"
+	// SMBCSIDriver is the CSI driver mounting the SMB/CIFS shares of the smb source
+	SMBCSIDriver = "smb.csi.k8s.io"
 
 	// AnnSource provide a const for our PVC import source annotation
 	AnnSource = AnnAPIGroup + "/storage.import.source"
@@ -73,6 +97,179 @@ const (
 	AnnBackingFile = AnnAPIGroup + "/storage.import.backingFile"
 	// AnnThumbprint provides a const for our PVC backing thumbprint annotation
 	AnnThumbprint = AnnAPIGroup + "/storage.import.vddk.thumbprint"
+	// AnnGitRef provides a const for our PVC git ref annotation
+	AnnGitRef = AnnAPIGroup + "/storage.import.git.ref"
+	// AnnGitPath provides a const for our PVC git path annotation
+	AnnGitPath = AnnAPIGroup + "/storage.import.git.path"
+	// AnnJSONURLPath provides a const for our PVC JSONPath of the download URL annotation
+	AnnJSONURLPath = AnnAPIGroup + "/storage.import.json.urlPath"
+	// AnnJSONChecksumPath provides a const for our PVC JSONPath of the checksum annotation
+	AnnJSONChecksumPath = AnnAPIGroup + "/storage.import.json.checksumPath"
+	// AnnExtraHeaders provides a const for our PVC extra http headers annotation, one "Name: value" header per line
+	AnnExtraHeaders = AnnAPIGroup + "/storage.import.extraHeaders"
+	// AnnSecretExtraHeaders provides a const for our PVC annotation listing the comma separated names of secrets
+	// holding extra http headers, each key of a secret holds one "Name: value" header
+	AnnSecretExtraHeaders = AnnAPIGroup + "/storage.import.secretExtraHeaders"
+	// AnnS3SSECustomerKeySecret provides a const for our PVC annotation naming the secret holding the base64 encoded
+	// S3 SSE-C key in its sseCustomerKey key
+	AnnS3SSECustomerKeySecret = AnnAPIGroup + "/storage.import.s3.sseCustomerKeySecret"
+	// AnnS3SSECustomerAlgorithm provides a const for our PVC annotation of the algorithm of the S3 SSE-C key
+	AnnS3SSECustomerAlgorithm = AnnAPIGroup + "/storage.import.s3.sseCustomerAlgorithm"
+	// AnnChecksumAllowlist provides a const for our PVC annotation naming the configmap listing the sha256 checksums
+	// the source data must match, one checksum per line of each key
+	AnnChecksumAllowlist = AnnAPIGroup + "/storage.import.checksumAllowlist"
+	// AnnArchiveMemberSelection provides a const for our PVC annotation of the strategy picking the disk image of
+	// archives holding several candidates
+	AnnArchiveMemberSelection = AnnAPIGroup + "/storage.import.archiveMemberSelection"
+	// AnnPrefetchBufferSize provides a const for our PVC annotation of the number of bytes the http and s3 sources read
+	// ahead of the import
+	AnnPrefetchBufferSize = AnnAPIGroup + "/storage.import.prefetchBufferSize"
+	// AnnStrictFormatCheck provides a const for our PVC annotation failing the import when the format declared by the
+	// extension of the source doesn't match the detected format
+	AnnStrictFormatCheck = AnnAPIGroup + "/storage.import.strictFormatCheck"
+	// AnnCheckImage provides a const for our PVC annotation failing the import early when qemu-img check finds the image
+	// corrupt
+	AnnCheckImage = AnnAPIGroup + "/storage.import.checkImage"
+	// AnnManifestFile provides a const for our PVC annotation of the file the importer writes the manifest of what was
+	// imported to
+	AnnManifestFile = AnnAPIGroup + "/storage.import.manifestFile"
+	// AnnFlushPolicy provides a const for our PVC annotation of how often the importer syncs the files it writes
+	AnnFlushPolicy = AnnAPIGroup + "/storage.import.flushPolicy"
+	// AnnCleanRestartThreshold provides a const for our PVC annotation of the number of failed resumes after which the
+	// import restarts from scratch
+	AnnCleanRestartThreshold = AnnAPIGroup + "/storage.import.cleanRestartThreshold"
+	// AnnNormalizeQcow2 provides a const for our PVC annotation normalizing qcow2 sources before their conversion
+	AnnNormalizeQcow2 = AnnAPIGroup + "/storage.import.normalizeQcow2"
+	// AnnExpectedVirtualSize provides a const for our PVC annotation of the virtual size the image must have
+	AnnExpectedVirtualSize = AnnAPIGroup + "/storage.import.expectedVirtualSize"
+	// AnnVirtualSizeTolerance provides a const for our PVC annotation of how much the virtual size of the image may differ
+	// from the expected virtual size
+	AnnVirtualSizeTolerance = AnnAPIGroup + "/storage.import.virtualSizeTolerance"
+	// AnnRegistryTagConstraint provides a const for our PVC annotation of the semver constraint the imported tag of the
+	// registry repository must satisfy
+	AnnRegistryTagConstraint = AnnAPIGroup + "/storage.import.registryTagConstraint"
+	// AnnNbdTarget provides a const for our PVC annotation of the NBD export the image is converted to
+	AnnNbdTarget = AnnAPIGroup + "/storage.import.nbdTarget"
+	// AnnChunkChecksumSize provides a const for our PVC annotation of the size of the chunks of the image the importer
+	// writes the checksums of
+	AnnChunkChecksumSize = AnnAPIGroup + "/storage.import.chunkChecksumSize"
+	// AnnArchiveExpectedEntries provides a const for our PVC annotation of the number of entries expected in an archive
+	AnnArchiveExpectedEntries = AnnAPIGroup + "/storage.import.archiveExpectedEntries"
+	// AnnZeroImageThreshold provides a const for our PVC annotation of the fraction of zeroes making an imported image a
+	// likely blank source
+	AnnZeroImageThreshold = AnnAPIGroup + "/storage.import.zeroImageThreshold"
+	// AnnZeroImageStrict provides a const for our PVC annotation failing the import of a likely blank source instead of
+	// warning
+	AnnZeroImageStrict = AnnAPIGroup + "/storage.import.zeroImageStrict"
+	// AnnRetryAfterBudget provides a const for our PVC annotation of the total delay the requests answered with a Retry-
+	// After header are retried for
+	AnnRetryAfterBudget = AnnAPIGroup + "/storage.import.retryAfterBudget"
+	// AnnOverlayTarget provides a const for our PVC annotation importing the image as the backing file of a qcow2 overlay
+	AnnOverlayTarget = AnnAPIGroup + "/storage.import.overlayTarget"
+	// AnnMaxAllocatedClusters provides a const for our PVC annotation of the maximum number of clusters a qcow2 image may
+	// allocate
+	AnnMaxAllocatedClusters = AnnAPIGroup + "/storage.import.maxAllocatedClusters"
+	// AnnRangedFormatDetection provides a const for our PVC annotation detecting the format of http sources from a ranged
+	// request
+	AnnRangedFormatDetection = AnnAPIGroup + "/storage.import.rangedFormatDetection"
+	// AnnPipedConversion provides a const for our PVC annotation writing the image to the target while it is downloaded
+	AnnPipedConversion = AnnAPIGroup + "/storage.import.pipedConversion"
+	// AnnPinnedSPKIHashes provides a const for our PVC annotation of the hashes of the subject public key infos the
+	// certificates of the endpoint are pinned to
+	AnnPinnedSPKIHashes = AnnAPIGroup + "/storage.import.pinnedSPKIHashes"
+	// AnnConversionSegmentSize provides a const for our PVC annotation of the size of the segments the image is converted
+	// in
+	AnnConversionSegmentSize = AnnAPIGroup + "/storage.import.conversionSegmentSize"
+	// AnnS3AlternateEndpoints provides a const for our PVC annotation of the endpoints the object is fetched from when its
+	// endpoint fails
+	AnnS3AlternateEndpoints = AnnAPIGroup + "/storage.import.s3.alternateEndpoints"
+	// AnnReadRetries provides a const for our PVC annotation of the number of times a failed read of the source is resumed
+	AnnReadRetries = AnnAPIGroup + "/storage.import.readRetries"
+	// AnnReadRetryBackoff provides a const for our PVC annotation of the delay before resuming a failed read of the source
+	AnnReadRetryBackoff = AnnAPIGroup + "/storage.import.readRetryBackoff"
+	// AnnS3Concurrency provides a const for our PVC annotation of the number of concurrent byte range requests the object
+	// is downloaded with
+	AnnS3Concurrency = AnnAPIGroup + "/storage.import.s3.concurrency"
+	// AnnExpectedChecksum provides a const for our PVC annotation of the checksum the object must match
+	AnnExpectedChecksum = AnnAPIGroup + "/storage.import.expectedChecksum"
+	// AnnS3GetAttempts provides a const for our PVC annotation of the number of times a request of the object failing with
+	// a transient error is made
+	AnnS3GetAttempts = AnnAPIGroup + "/storage.import.s3.getAttempts"
+	// AnnS3GetBackoff provides a const for our PVC annotation of the delay before the second request of the object
+	AnnS3GetBackoff = AnnAPIGroup + "/storage.import.s3.getBackoff"
+	// AnnS3VersionID provides a const for our PVC annotation of the version of the object to import
+	AnnS3VersionID = AnnAPIGroup + "/storage.import.s3.versionID"
+	// AnnPhaseMetrics provides a const for our PVC annotation recording the duration of the phases of the import as
+	// metrics
+	AnnPhaseMetrics = AnnAPIGroup + "/storage.import.phaseMetrics"
+	// AnnTarExtraction provides a const for our PVC annotation extracting the disk image from objects that are tar
+	// archives
+	AnnTarExtraction = AnnAPIGroup + "/storage.import.s3.tarExtraction"
+	// AnnTarMemberPatterns provides a const for our PVC annotation of the patterns of the names of the disk image in tar
+	// archives
+	AnnTarMemberPatterns = AnnAPIGroup + "/storage.import.s3.tarMemberPatterns"
+	// AnnRateLimit provides a const for our PVC annotation of the number of bytes per second read from the source
+	AnnRateLimit = AnnAPIGroup + "/storage.import.rateLimit"
+	// AnnS3VerifyETag provides a const for our PVC annotation verifying the object against its ETag
+	AnnS3VerifyETag = AnnAPIGroup + "/storage.import.s3.verifyETag"
+	// AnnS3ForcePathStyle provides a const for our PVC annotation reading the bucket from the path of the endpoint
+	AnnS3ForcePathStyle = AnnAPIGroup + "/storage.import.s3.forcePathStyle"
+	// AnnVerifyTransfer provides a const for our PVC annotation verifying the image transferred to scratch space before
+	// the conversion
+	AnnVerifyTransfer = AnnAPIGroup + "/storage.import.verifyTransfer"
+	// AnnScratchPreallocation provides a const for our PVC annotation preallocating the source data in scratch space
+	AnnScratchPreallocation = AnnAPIGroup + "/storage.import.scratchPreallocation"
+	// AnnS3RangeOffset provides a const for our PVC annotation of the offset of the range of the object to import
+	AnnS3RangeOffset = AnnAPIGroup + "/storage.import.s3.rangeOffset"
+	// AnnS3RangeLength provides a const for our PVC annotation of the length of the range of the object to import
+	AnnS3RangeLength = AnnAPIGroup + "/storage.import.s3.rangeLength"
+	// AnnStrictSourceSize provides a const for our PVC annotation failing the import of sources larger than the size they
+	// reported
+	AnnStrictSourceSize = AnnAPIGroup + "/storage.import.strictSourceSize"
+	// AnnTargetFormat provides a const for our PVC annotation of the format the image is converted to
+	AnnTargetFormat = AnnAPIGroup + "/storage.import.targetFormat"
+	// AnnS3RequesterPays provides a const for our PVC annotation accepting the charges of the requests to a requester pays
+	// bucket
+	AnnS3RequesterPays = AnnAPIGroup + "/storage.import.s3.requesterPays"
+	// AnnLogLevel provides a const for our PVC annotation of the verbosity of the importer logs
+	AnnLogLevel = AnnAPIGroup + "/storage.import.logLevel"
+	// AnnTransferResume provides a const for our PVC annotation resuming the transfers to scratch space of restarted
+	// importers
+	AnnTransferResume = AnnAPIGroup + "/storage.import.transferResume"
+	// AnnUserAgent provides a const for our PVC annotation of the User-Agent header of the requests of the importer
+	AnnUserAgent = AnnAPIGroup + "/storage.import.userAgent"
+	// AnnMaxSourceBytes provides a const for our PVC annotation of the maximum size of the source
+	AnnMaxSourceBytes = AnnAPIGroup + "/storage.import.maxSourceBytes"
+	// AnnS3Region provides a const for our PVC annotation of the region the requests to the object are signed for
+	AnnS3Region = AnnAPIGroup + "/storage.import.s3.region"
+	// AnnS3DisableChecksums provides a const for our PVC annotation disabling the checksums of the requests to the object
+	AnnS3DisableChecksums = AnnAPIGroup + "/storage.import.s3.disableChecksums"
+	// AnnScratchCacheClaim provides a const for our PVC annotation naming the PVC the importer caches the sources
+	// transferred to scratch space in
+	AnnScratchCacheClaim = AnnAPIGroup + "/storage.import.scratchCacheClaim"
+	// AnnScratchCacheMaxSize provides a const for our PVC annotation of the maximum size of the scratch cache
+	AnnScratchCacheMaxSize = AnnAPIGroup + "/storage.import.scratchCacheMaxSize"
+	// AnnPhaseEvents provides a const for our PVC annotation recording the phases of the import as events of the
+	// importer pod
+	AnnPhaseEvents = AnnAPIGroup + "/storage.import.phaseEvents"
+	// AnnProgressGRPCAddress provides a const for our PVC annotation of the address the importer serves the progress
+	// of the import on
+	AnnProgressGRPCAddress = AnnAPIGroup + "/storage.import.progressGRPCAddress"
+	// AnnProgressGRPCCertSecret provides a const for our PVC annotation naming the TLS secret of the progress service
+	AnnProgressGRPCCertSecret = AnnAPIGroup + "/storage.import.progressGRPCCertSecret"
+	// AnnBearerTokenSecret provides a const for our PVC annotation naming the secret holding the bearer token of the
+	// http requests in its bearerToken key
+	AnnBearerTokenSecret = AnnAPIGroup + "/storage.import.bearerTokenSecret"
+	// AnnFileSourceClaim provides a const for our PVC annotation naming the PVC of the share the file source imports
+	// from
+	AnnFileSourceClaim = AnnAPIGroup + "/storage.import.fileSourceClaim"
+	// AnnSignaturePublicKeys provides a const for our PVC annotation naming the configmap holding the GPG public keys
+	// the signature of the source data is verified with, in its publicKeys key
+	AnnSignaturePublicKeys = AnnAPIGroup + "/storage.import.signaturePublicKeys"
+	// AnnSignature provides a const for our PVC annotation of the detached signature of the source data
+	AnnSignature = AnnAPIGroup + "/storage.import.signature"
+	// AnnSignatureURL provides a const for our PVC annotation of the URL of the detached signature of the source data
+	AnnSignatureURL = AnnAPIGroup + "/storage.import.signatureURL"
 	// AnnPreallocationApplied provides a const for PVC preallocation annotation
 	AnnPreallocationApplied = AnnAPIGroup + "/storage.preallocation"
 
@@ -108,26 +305,111 @@ type ImportReconciler struct {
 }
 
 type importPodEnvVar struct {
-	ep                 string
-	secretName         string
-	source             string
-	contentType        string
-	imageSize          string
-	certConfigMap      string
-	diskID             string
-	uuid               string
-	backingFile        string
-	thumbprint         string
-	filesystemOverhead string
-	insecureTLS        bool
-	currentCheckpoint  string
-	previousCheckpoint string
-	finalCheckpoint    string
-	preallocation      bool
-	httpProxy          string
-	httpsProxy         string
-	noProxy            string
-	certConfigMapProxy string
+	ep                   string
+	secretName           string
+	source               string
+	contentType          string
+	imageSize            string
+	certConfigMap        string
+	diskID               string
+	uuid                 string
+	backingFile          string
+	thumbprint           string
+	gitRef               string
+	gitPath              string
+	jsonURLPath          string
+	jsonChecksumPath     string
+	extraHeaders         []string
+	secretExtraHeaders   []string
+	sseCustomerKeySecret string
+	sseCustomerAlgorithm string
+	checksumAllowlist    string
+	scratchCacheClaim    string
+	phaseEvents          string
+	progressCertSecret   string
+	bearerTokenSecret    string
+	fileSourceClaim      string
+	smbShare             string
+	signaturePublicKeys  string
+	filesystemOverhead   string
+	qemuImgPath          string
+	qemuImgConvertFlags  []string
+	insecureTLS          bool
+	currentCheckpoint    string
+	previousCheckpoint   string
+	finalCheckpoint      string
+	preallocation        bool
+	httpProxy            string
+	httpsProxy           string
+	noProxy              string
+	certConfigMapProxy   string
+	options              []corev1.EnvVar
+}
+
+// importerOption is a PVC annotation passed to an env variable of the importer once validated.
+type importerOption struct {
+	annotation string
+	env        string
+	// validate checks the value of the annotation.
+	validate func(value string) error
+}
+
+// importerOptions are the importer options set with PVC annotations, in the order of their env variables.
+var importerOptions = []importerOption{
+	{AnnArchiveMemberSelection, common.ImporterArchiveMemberSelection, validateOneOf("first", "largest", "by-extension-priority", "fail-if-ambiguous")},
+	{AnnPrefetchBufferSize, common.ImporterPrefetchBufferSize, validateQuantity},
+	{AnnStrictFormatCheck, common.ImporterStrictFormatCheck, validateBool},
+	{AnnScratchCacheMaxSize, common.ImporterScratchCacheMaxSize, validateQuantity},
+	{AnnCheckImage, common.ImporterCheckImage, validateBool},
+	{AnnManifestFile, common.ImporterManifestFile, validateManifestFile},
+	{AnnFlushPolicy, common.ImporterFlushPolicy, validateFlushPolicy},
+	{AnnCleanRestartThreshold, common.ImporterCleanRestartThreshold, validateCount},
+	{AnnNormalizeQcow2, common.ImporterNormalizeQcow2, validateBool},
+	{AnnExpectedVirtualSize, common.ImporterExpectedVirtualSize, validateQuantity},
+	{AnnVirtualSizeTolerance, common.ImporterVirtualSizeTolerance, validateQuantity},
+	{AnnRegistryTagConstraint, common.ImporterRegistryTagConstraint, validateText},
+	{AnnNbdTarget, common.ImporterNbdTarget, validateNbdTarget},
+	{AnnChunkChecksumSize, common.ImporterChunkChecksumSize, validateQuantity},
+	{AnnArchiveExpectedEntries, common.ImporterArchiveExpectedEntries, validateCount},
+	{AnnZeroImageThreshold, common.ImporterZeroImageThreshold, validateRatio},
+	{AnnZeroImageStrict, common.ImporterZeroImageStrict, validateBool},
+	{AnnRetryAfterBudget, common.ImporterRetryAfterBudget, validateDuration},
+	{AnnOverlayTarget, common.ImporterOverlayTarget, validateBool},
+	{AnnMaxAllocatedClusters, common.ImporterMaxAllocatedClusters, validateCount},
+	{AnnRangedFormatDetection, common.ImporterRangedFormatDetection, validateBool},
+	{AnnPipedConversion, common.ImporterPipedConversion, validateBool},
+	{AnnPinnedSPKIHashes, common.ImporterPinnedSPKIHashes, validateSPKIHashes},
+	{AnnConversionSegmentSize, common.ImporterConversionSegmentSize, validateQuantity},
+	{AnnProgressGRPCAddress, common.ImporterProgressGRPCAddress, validateAddress},
+	{AnnS3AlternateEndpoints, common.ImporterS3AlternateEndpoints, validateText},
+	{AnnReadRetries, common.ImporterReadRetries, validateCount},
+	{AnnReadRetryBackoff, common.ImporterReadRetryBackoff, validateDuration},
+	{AnnS3Concurrency, common.ImporterS3Concurrency, validateCount},
+	{AnnExpectedChecksum, common.ImporterExpectedChecksum, validateChecksum},
+	{AnnS3GetAttempts, common.ImporterS3GetAttempts, validateCount},
+	{AnnS3GetBackoff, common.ImporterS3GetBackoff, validateDuration},
+	{AnnS3VersionID, common.ImporterS3VersionID, validateText},
+	{AnnPhaseMetrics, common.ImporterPhaseMetrics, validateBool},
+	{AnnTarExtraction, common.ImporterTarExtraction, validateBool},
+	{AnnTarMemberPatterns, common.ImporterTarMemberPatterns, validateText},
+	{AnnRateLimit, common.ImporterRateLimit, validateQuantity},
+	{AnnS3VerifyETag, common.ImporterS3VerifyETag, validateBool},
+	{AnnS3ForcePathStyle, common.ImporterS3ForcePathStyle, validateBool},
+	{AnnVerifyTransfer, common.ImporterVerifyTransfer, validateBool},
+	{AnnScratchPreallocation, common.ImporterScratchPreallocation, validateBool},
+	{AnnS3RangeOffset, common.ImporterS3RangeOffset, validateCount},
+	{AnnS3RangeLength, common.ImporterS3RangeLength, validateCount},
+	{AnnStrictSourceSize, common.ImporterStrictSourceSize, validateBool},
+	{AnnTargetFormat, common.ImporterTargetFormat, validateOneOf("raw", "qcow2")},
+	{AnnS3RequesterPays, common.ImporterS3RequesterPays, validateBool},
+	{AnnLogLevel, common.ImporterLogLevel, validateOneOf(util.LogLevelDebug, util.LogLevelInfo, util.LogLevelError)},
+	{AnnTransferResume, common.ImporterTransferResume, validateBool},
+	{AnnUserAgent, common.ImporterUserAgent, validateText},
+	{AnnMaxSourceBytes, common.ImporterMaxSourceBytes, validateQuantity},
+	{AnnS3Region, common.ImporterS3Region, validateText},
+	{AnnS3DisableChecksums, common.ImporterS3DisableChecksums, validateBool},
+	{AnnSignature, common.ImporterSignature, validateSignature},
+	{AnnSignatureURL, common.ImporterSignatureURL, validateHTTPURL},
 }
 
 // NewImportController creates a new instance of the import controller.
@@ -476,7 +758,13 @@ func (r *ImportReconciler) createImportEnvVar(pvc *corev1.PersistentVolumeClaim)
 	podEnvVar.source = getSource(pvc)
 	podEnvVar.contentType = GetContentType(pvc)
 
+	//get the CDIConfig to extract the proxy and qemu-img configuration to be used to import an image
+	cdiConfig := &cdiv1.CDIConfig{}
+	r.client.Get(context.TODO(), types.NamespacedName{Name: common.ConfigName}, cdiConfig)
 	var err error
+	if podEnvVar.qemuImgPath, podEnvVar.qemuImgConvertFlags, err = getQemuImgConfig(cdiConfig); err != nil {
+		return nil, err
+	}
 	if podEnvVar.source != SourceNone {
 		podEnvVar.ep, err = getEndpoint(pvc)
 		if err != nil {
@@ -486,9 +774,6 @@ func (r *ImportReconciler) createImportEnvVar(pvc *corev1.PersistentVolumeClaim)
 		if podEnvVar.secretName == "" {
 			r.log.V(2).Info("no secret will be supplied to endpoint", "endPoint", podEnvVar.ep)
 		}
-		//get the CDIConfig to extract the proxy configuration to be used to import an image
-		cdiConfig := &cdiv1.CDIConfig{}
-		r.client.Get(context.TODO(), types.NamespacedName{Name: common.ConfigName}, cdiConfig)
 		podEnvVar.certConfigMap, err = r.getCertConfigMap(pvc)
 		if err != nil {
 			return nil, err
@@ -504,6 +789,69 @@ func (r *ImportReconciler) createImportEnvVar(pvc *corev1.PersistentVolumeClaim)
 		podEnvVar.previousCheckpoint = getValueFromAnnotation(pvc, AnnPreviousCheckpoint)
 		podEnvVar.currentCheckpoint = getValueFromAnnotation(pvc, AnnCurrentCheckpoint)
 		podEnvVar.finalCheckpoint = getValueFromAnnotation(pvc, AnnFinalCheckpoint)
+		podEnvVar.gitRef = getValueFromAnnotation(pvc, AnnGitRef)
+		podEnvVar.gitPath = getValueFromAnnotation(pvc, AnnGitPath)
+		podEnvVar.jsonURLPath = getValueFromAnnotation(pvc, AnnJSONURLPath)
+		podEnvVar.jsonChecksumPath = getValueFromAnnotation(pvc, AnnJSONChecksumPath)
+		for _, annotation := range []string{AnnGitRef, AnnGitPath, AnnJSONURLPath, AnnJSONChecksumPath} {
+			if err := validateText(getValueFromAnnotation(pvc, annotation)); err != nil {
+				return nil, errors.Wrapf(err, "invalid value of annotation %s", annotation)
+			}
+		}
+		podEnvVar.extraHeaders = getExtraHeaders(pvc)
+		for _, header := range podEnvVar.extraHeaders {
+			if err := validateText(header); err != nil {
+				return nil, errors.Wrapf(err, "invalid header %q of annotation %s", header, AnnExtraHeaders)
+			}
+		}
+		podEnvVar.secretExtraHeaders = getSecretExtraHeaders(pvc)
+		for _, name := range podEnvVar.secretExtraHeaders {
+			if err := r.checkMountedObject(pvc, AnnSecretExtraHeaders, name, &corev1.Secret{}); err != nil {
+				return nil, err
+			}
+		}
+		if podEnvVar.sseCustomerKeySecret, err = r.getMountedObjectName(pvc, AnnS3SSECustomerKeySecret, &corev1.Secret{}); err != nil {
+			return nil, err
+		}
+		podEnvVar.sseCustomerAlgorithm = getValueFromAnnotation(pvc, AnnS3SSECustomerAlgorithm)
+		if err := validateText(podEnvVar.sseCustomerAlgorithm); err != nil {
+			return nil, errors.Wrapf(err, "invalid value of annotation %s", AnnS3SSECustomerAlgorithm)
+		}
+		if podEnvVar.checksumAllowlist, err = r.getMountedObjectName(pvc, AnnChecksumAllowlist, &corev1.ConfigMap{}); err != nil {
+			return nil, err
+		}
+		if podEnvVar.scratchCacheClaim, err = r.getMountedClaimName(pvc, AnnScratchCacheClaim); err != nil {
+			return nil, err
+		}
+		podEnvVar.phaseEvents = getValueFromAnnotation(pvc, AnnPhaseEvents)
+		if podEnvVar.phaseEvents != "" {
+			if err := validateBool(podEnvVar.phaseEvents); err != nil {
+				return nil, errors.Wrapf(err, "invalid value of annotation %s", AnnPhaseEvents)
+			}
+		}
+		if podEnvVar.progressCertSecret, err = r.getMountedObjectName(pvc, AnnProgressGRPCCertSecret, &corev1.Secret{}); err != nil {
+			return nil, err
+		}
+		if podEnvVar.bearerTokenSecret, err = r.getMountedObjectName(pvc, AnnBearerTokenSecret, &corev1.Secret{}); err != nil {
+			return nil, err
+		}
+		if podEnvVar.fileSourceClaim, err = r.getMountedClaimName(pvc, AnnFileSourceClaim); err != nil {
+			return nil, err
+		}
+		if podEnvVar.source == SourceSMB {
+			if podEnvVar.smbShare, err = getSMBShare(podEnvVar.ep); err != nil {
+				return nil, err
+			}
+			if podEnvVar.fileSourceClaim != "" {
+				return nil, errors.Errorf("annotation %s can't be used with the smb source", AnnFileSourceClaim)
+			}
+		}
+		if podEnvVar.signaturePublicKeys, err = r.getMountedObjectName(pvc, AnnSignaturePublicKeys, &corev1.ConfigMap{}); err != nil {
+			return nil, err
+		}
+		if podEnvVar.options, err = getImporterOptions(pvc); err != nil {
+			return nil, err
+		}
 
 		var field string
 		if field, err = GetImportProxyConfig(cdiConfig, common.ImportProxyHTTP); err != nil {
@@ -587,6 +935,22 @@ func (r *ImportReconciler) isInsecureTLS(pvc *corev1.PersistentVolumeClaim, cdiC
 	return false, nil
 }
 
+// getQemuImgConfig returns the qemu-img path and extra convert flags of the CDI config, failing if the path isn't
+// absolute or a flag isn't allowed.
+func getQemuImgConfig(cdiConfig *cdiv1.CDIConfig) (string, []string, error) {
+	qemuImgPath := ""
+	if cdiConfig.Spec.QemuImgPath != nil {
+		qemuImgPath = *cdiConfig.Spec.QemuImgPath
+		if !filepath.IsAbs(qemuImgPath) || filepath.Clean(qemuImgPath) != qemuImgPath {
+			return "", nil, errors.Errorf("qemu-img path %q of the CDI config is not a clean absolute path", qemuImgPath)
+		}
+	}
+	if err := image.ValidateConvertFlags(cdiConfig.Spec.QemuImgConvertFlags); err != nil {
+		return "", nil, errors.Wrap(err, "invalid qemu-img convert flags of the CDI config")
+	}
+	return qemuImgPath, cdiConfig.Spec.QemuImgConvertFlags, nil
+}
+
 func (r *ImportReconciler) getCertConfigMap(pvc *corev1.PersistentVolumeClaim) (string, error) {
 	value, ok := pvc.Annotations[AnnCertConfigMap]
 	if !ok || value == "" {
@@ -710,7 +1074,16 @@ func getSource(pvc *corev1.PersistentVolumeClaim) string {
 		SourceNone,
 		SourceRegistry,
 		SourceImageio,
-		SourceVDDK:
+		SourceVDDK,
+		SourceWebSocket,
+		SourceGit,
+		SourceNBD,
+		SourceJSONResolver,
+		SourceAzureBlob,
+		SourceFTP,
+		SourceWebDAV,
+		SourceFile,
+		SourceSMB:
 	default:
 		source = SourceHTTP
 	}
@@ -752,6 +1125,41 @@ func getValueFromAnnotation(pvc *corev1.PersistentVolumeClaim, annotation string
 	return value
 }
 
+// getSMBShare returns the //host/share the SMB CSI driver mounts for an smb://host/share/path endpoint.
+func getSMBShare(endpoint string) (string, error) {
+	ep, err := url.Parse(endpoint)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid smb endpoint %q", endpoint)
+	}
+	share := strings.SplitN(strings.TrimPrefix(ep.Path, "/"), "/", 2)[0]
+	if ep.Scheme != SourceSMB || ep.Host == "" || share == "" {
+		return "", errors.Errorf("smb endpoint %q is not smb://host/share/path", endpoint)
+	}
+	return "//" + ep.Host + "/" + share, nil
+}
+
+// getExtraHeaders returns the non empty lines of the extra headers annotation.
+func getExtraHeaders(pvc *corev1.PersistentVolumeClaim) []string {
+	var headers []string
+	for _, header := range strings.Split(getValueFromAnnotation(pvc, AnnExtraHeaders), "\n") {
+		if header = strings.TrimSpace(header); header != "" {
+			headers = append(headers, header)
+		}
+	}
+	return headers
+}
+
+// getSecretExtraHeaders returns the secret names listed in the secret extra headers annotation.
+func getSecretExtraHeaders(pvc *corev1.PersistentVolumeClaim) []string {
+	var secretNames []string
+	for _, name := range strings.Split(getValueFromAnnotation(pvc, AnnSecretExtraHeaders), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			secretNames = append(secretNames, name)
+		}
+	}
+	return secretNames
+}
+
 func getImportPodNameFromPvc(pvc *corev1.PersistentVolumeClaim) string {
 	podName, ok := pvc.Annotations[AnnImportPod]
 	if ok {
@@ -953,6 +1361,175 @@ func makeImporterPodSpec(namespace, image, verbose, pullPolicy string, podEnvVar
 		pod.Spec.Volumes = append(pod.Spec.Volumes, createProxyConfigMapVolume(CertVolName, podEnvVar.certConfigMapProxy))
 	}
 
+	for index, secretName := range podEnvVar.secretExtraHeaders {
+		vm := corev1.VolumeMount{
+			Name:      fmt.Sprintf(SecretExtraHeadersVolumeName, index),
+			MountPath: path.Join(common.ImporterSecretExtraHeadersDir, fmt.Sprint(index)),
+		}
+
+		vol := corev1.Volume{
+			Name: fmt.Sprintf(SecretExtraHeadersVolumeName, index),
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: secretName,
+				},
+			},
+		}
+
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, vm)
+		pod.Spec.Volumes = append(pod.Spec.Volumes, vol)
+	}
+
+	if podEnvVar.sseCustomerKeySecret != "" {
+		vm := corev1.VolumeMount{
+			Name:      SSECustomerKeyVolName,
+			MountPath: common.ImporterS3SSECustomerKeyDir,
+		}
+
+		vol := corev1.Volume{
+			Name: SSECustomerKeyVolName,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: podEnvVar.sseCustomerKeySecret,
+				},
+			},
+		}
+
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, vm)
+		pod.Spec.Volumes = append(pod.Spec.Volumes, vol)
+	}
+
+	if podEnvVar.checksumAllowlist != "" {
+		vm := corev1.VolumeMount{
+			Name:      ChecksumAllowlistVolName,
+			MountPath: common.ImporterChecksumAllowlistDir,
+		}
+
+		vol := corev1.Volume{
+			Name: ChecksumAllowlistVolName,
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: podEnvVar.checksumAllowlist,
+					},
+				},
+			},
+		}
+
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, vm)
+		pod.Spec.Volumes = append(pod.Spec.Volumes, vol)
+	}
+
+	if podEnvVar.scratchCacheClaim != "" {
+		vm := corev1.VolumeMount{
+			Name:      ScratchCacheVolName,
+			MountPath: common.ScratchCacheDataDir,
+		}
+
+		vol := corev1.Volume{
+			Name: ScratchCacheVolName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: podEnvVar.scratchCacheClaim,
+				},
+			},
+		}
+
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, vm)
+		pod.Spec.Volumes = append(pod.Spec.Volumes, vol)
+	}
+
+	if podEnvVar.progressCertSecret != "" {
+		vm := corev1.VolumeMount{
+			Name:      ProgressCertVolName,
+			MountPath: common.ImporterProgressCertDir,
+		}
+
+		vol := corev1.Volume{
+			Name: ProgressCertVolName,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: podEnvVar.progressCertSecret,
+				},
+			},
+		}
+
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, vm)
+		pod.Spec.Volumes = append(pod.Spec.Volumes, vol)
+	}
+
+	if podEnvVar.fileSourceClaim != "" {
+		vm := corev1.VolumeMount{
+			Name:      FileSourceVolName,
+			MountPath: common.ImporterFileSourceDir,
+			ReadOnly:  true,
+		}
+
+		vol := corev1.Volume{
+			Name: FileSourceVolName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: podEnvVar.fileSourceClaim,
+					ReadOnly:  true,
+				},
+			},
+		}
+
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, vm)
+		pod.Spec.Volumes = append(pod.Spec.Volumes, vol)
+	}
+
+	if podEnvVar.smbShare != "" {
+		vm := corev1.VolumeMount{
+			Name:      FileSourceVolName,
+			MountPath: common.ImporterFileSourceDir,
+			ReadOnly:  true,
+		}
+
+		readOnly := true
+		csi := &corev1.CSIVolumeSource{
+			Driver:   SMBCSIDriver,
+			ReadOnly: &readOnly,
+			VolumeAttributes: map[string]string{
+				"source": podEnvVar.smbShare,
+			},
+		}
+		if podEnvVar.secretName != "" {
+			// The SMB CSI driver reads the username, password and domain keys of the secret.
+			csi.NodePublishSecretRef = &corev1.LocalObjectReference{Name: podEnvVar.secretName}
+		}
+		vol := corev1.Volume{
+			Name: FileSourceVolName,
+			VolumeSource: corev1.VolumeSource{
+				CSI: csi,
+			},
+		}
+
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, vm)
+		pod.Spec.Volumes = append(pod.Spec.Volumes, vol)
+	}
+
+	if podEnvVar.signaturePublicKeys != "" {
+		vm := corev1.VolumeMount{
+			Name:      SignaturePublicKeysVolName,
+			MountPath: common.ImporterSignaturePublicKeysDir,
+		}
+
+		vol := corev1.Volume{
+			Name: SignaturePublicKeysVolName,
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: podEnvVar.signaturePublicKeys,
+					},
+				},
+			},
+		}
+
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, vm)
+		pod.Spec.Volumes = append(pod.Spec.Volumes, vol)
+	}
+
 	if podEnvVar.contentType == string(cdiv1.DataVolumeKubeVirt) {
 		// Set the fsGroup on the security context to the QemuSubGid
 		if pod.Spec.SecurityContext == nil {
@@ -1036,6 +1613,22 @@ func makeImportEnv(podEnvVar *importPodEnvVar, uid types.UID) []corev1.EnvVar {
 			Name:  common.ImporterThumbprint,
 			Value: podEnvVar.thumbprint,
 		},
+		{
+			Name:  common.ImporterGitRef,
+			Value: podEnvVar.gitRef,
+		},
+		{
+			Name:  common.ImporterGitPath,
+			Value: podEnvVar.gitPath,
+		},
+		{
+			Name:  common.ImporterJSONURLPath,
+			Value: podEnvVar.jsonURLPath,
+		},
+		{
+			Name:  common.ImporterJSONChecksumPath,
+			Value: podEnvVar.jsonChecksumPath,
+		},
 		{
 			Name:  common.ImportProxyHTTP,
 			Value: podEnvVar.httpProxy,
@@ -1065,7 +1658,7 @@ func makeImportEnv(podEnvVar *importPodEnvVar, uid types.UID) []corev1.EnvVar {
 			Value: strconv.FormatBool(podEnvVar.preallocation),
 		},
 	}
-	if podEnvVar.secretName != "" {
+	if podEnvVar.secretName != "" && podEnvVar.smbShare == "" {
 		env = append(env, corev1.EnvVar{
 			Name: common.ImporterAccessKeyID,
 			ValueFrom: &corev1.EnvVarSource{
@@ -1089,6 +1682,12 @@ func makeImportEnv(podEnvVar *importPodEnvVar, uid types.UID) []corev1.EnvVar {
 		})
 
 	}
+	for index, header := range podEnvVar.extraHeaders {
+		env = append(env, corev1.EnvVar{
+			Name:  fmt.Sprintf("%s%d", common.ImporterExtraHeader, index),
+			Value: header,
+		})
+	}
 	if podEnvVar.certConfigMap != "" {
 		env = append(env, corev1.EnvVar{
 			Name:  common.ImporterCertDirVar,
@@ -1101,5 +1700,83 @@ func makeImportEnv(podEnvVar *importPodEnvVar, uid types.UID) []corev1.EnvVar {
 			Value: common.ImporterProxyCertDir,
 		})
 	}
-	return env
+	if podEnvVar.sseCustomerKeySecret != "" {
+		env = append(env, corev1.EnvVar{
+			Name:  common.ImporterS3SSECustomerKeyFile,
+			Value: path.Join(common.ImporterS3SSECustomerKeyDir, common.KeySSECustomerKey),
+		}, corev1.EnvVar{
+			Name:  common.ImporterS3SSECustomerAlgorithm,
+			Value: podEnvVar.sseCustomerAlgorithm,
+		})
+	}
+	if podEnvVar.checksumAllowlist != "" {
+		env = append(env, corev1.EnvVar{
+			Name:  common.ImporterChecksumAllowlist,
+			Value: common.ImporterChecksumAllowlistDir,
+		})
+	}
+	if podEnvVar.scratchCacheClaim != "" {
+		env = append(env, corev1.EnvVar{
+			Name:  common.ImporterScratchCacheDir,
+			Value: common.ScratchCacheDataDir,
+		})
+	}
+	if podEnvVar.phaseEvents != "" {
+		// The events of the importer are recorded on its pod.
+		env = append(env, corev1.EnvVar{
+			Name:  common.ImporterPhaseEvents,
+			Value: podEnvVar.phaseEvents,
+		}, corev1.EnvVar{
+			Name: common.ImporterPodUID,
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{
+					FieldPath: "metadata.uid",
+				},
+			},
+		})
+	}
+	if podEnvVar.progressCertSecret != "" {
+		env = append(env, corev1.EnvVar{
+			Name:  common.ImporterProgressGRPCCertDir,
+			Value: common.ImporterProgressCertDir,
+		})
+	}
+	if podEnvVar.bearerTokenSecret != "" {
+		env = append(env, corev1.EnvVar{
+			Name: common.ImporterBearerToken,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: podEnvVar.bearerTokenSecret,
+					},
+					Key: common.KeyBearerToken,
+				},
+			},
+		})
+	}
+	if podEnvVar.fileSourceClaim != "" || podEnvVar.smbShare != "" {
+		env = append(env, corev1.EnvVar{
+			Name:  common.ImporterFileSourceRoot,
+			Value: common.ImporterFileSourceDir,
+		})
+	}
+	if podEnvVar.qemuImgPath != "" {
+		env = append(env, corev1.EnvVar{
+			Name:  common.ImporterQemuImgPath,
+			Value: podEnvVar.qemuImgPath,
+		})
+	}
+	if len(podEnvVar.qemuImgConvertFlags) > 0 {
+		env = append(env, corev1.EnvVar{
+			Name:  common.ImporterQemuImgConvertFlags,
+			Value: strings.Join(podEnvVar.qemuImgConvertFlags, " "),
+		})
+	}
+	if podEnvVar.signaturePublicKeys != "" {
+		env = append(env, corev1.EnvVar{
+			Name:  common.ImporterSignaturePublicKey,
+			Value: path.Join(common.ImporterSignaturePublicKeysDir, common.KeySignaturePublicKeys),
+		})
+	}
+	return append(env, podEnvVar.options...)
 }
@@ -730,6 +730,610 @@ var _ = Describe("Create Importer Pod", func() {
 	)
 })
 
+var _ = Describe("Create Importer Pod with extra headers", func() {
+	It("should mount the secret extra headers", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName", AnnSecretExtraHeaders: "headers1, headers2"}, nil)
+		reconciler := createImportReconciler(pvc)
+		podEnvVar := &importPodEnvVar{
+			imageSize:          "1G",
+			filesystemOverhead: "0.055",
+			secretExtraHeaders: getSecretExtraHeaders(pvc),
+		}
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		for index, secretName := range []string{"headers1", "headers2"} {
+			volName := fmt.Sprintf(SecretExtraHeadersVolumeName, index)
+			Expect(pod.Spec.Volumes).To(ContainElement(corev1.Volume{
+				Name: volName,
+				VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{SecretName: secretName},
+				},
+			}))
+			Expect(pod.Spec.Containers[0].VolumeMounts).To(ContainElement(corev1.VolumeMount{
+				Name:      volName,
+				MountPath: fmt.Sprintf("%s/%d", common.ImporterSecretExtraHeadersDir, index),
+			}))
+		}
+	})
+
+	It("should split the extra headers annotation into headers", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnExtraHeaders: "X-Api-Version: 2\n\nX-Tenant: test\n"}, nil)
+		Expect(getExtraHeaders(pvc)).To(Equal([]string{"X-Api-Version: 2", "X-Tenant: test"}))
+	})
+})
+
+var _ = Describe("Create Importer Pod with an S3 SSE-C key", func() {
+	It("should mount the SSE-C key secret", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName", AnnS3SSECustomerKeySecret: "sse-key", AnnS3SSECustomerAlgorithm: "AES256"}, nil)
+		reconciler := createImportReconciler(pvc)
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pod.Spec.Volumes).To(ContainElement(corev1.Volume{
+			Name: SSECustomerKeyVolName,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{SecretName: "sse-key"},
+			},
+		}))
+		Expect(pod.Spec.Containers[0].VolumeMounts).To(ContainElement(corev1.VolumeMount{
+			Name:      SSECustomerKeyVolName,
+			MountPath: common.ImporterS3SSECustomerKeyDir,
+		}))
+		Expect(pod.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{
+			Name:  common.ImporterS3SSECustomerKeyFile,
+			Value: common.ImporterS3SSECustomerKeyDir + "/" + common.KeySSECustomerKey,
+		}))
+		Expect(pod.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{
+			Name:  common.ImporterS3SSECustomerAlgorithm,
+			Value: "AES256",
+		}))
+	})
+
+	It("should not mount an SSE-C key without the annotation", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName"}, nil)
+		reconciler := createImportReconciler(pvc)
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		for _, vol := range pod.Spec.Volumes {
+			Expect(vol.Name).ToNot(Equal(SSECustomerKeyVolName))
+		}
+		for _, env := range pod.Spec.Containers[0].Env {
+			Expect(env.Name).ToNot(Equal(common.ImporterS3SSECustomerKeyFile))
+		}
+	})
+})
+
+var _ = Describe("Create Importer Pod with a checksum allowlist", func() {
+	It("should mount the checksum allowlist configmap", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName", AnnChecksumAllowlist: "approved-images"}, nil)
+		reconciler := createImportReconciler(pvc)
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pod.Spec.Volumes).To(ContainElement(corev1.Volume{
+			Name: ChecksumAllowlistVolName,
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "approved-images"},
+				},
+			},
+		}))
+		Expect(pod.Spec.Containers[0].VolumeMounts).To(ContainElement(corev1.VolumeMount{
+			Name:      ChecksumAllowlistVolName,
+			MountPath: common.ImporterChecksumAllowlistDir,
+		}))
+		Expect(pod.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{
+			Name:  common.ImporterChecksumAllowlist,
+			Value: common.ImporterChecksumAllowlistDir,
+		}))
+	})
+
+	It("should not set a checksum allowlist without the annotation", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName"}, nil)
+		reconciler := createImportReconciler(pvc)
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		for _, vol := range pod.Spec.Volumes {
+			Expect(vol.Name).ToNot(Equal(ChecksumAllowlistVolName))
+		}
+		for _, env := range pod.Spec.Containers[0].Env {
+			Expect(env.Name).ToNot(Equal(common.ImporterChecksumAllowlist))
+		}
+	})
+})
+
+var _ = Describe("Create Importer Pod with a scratch cache", func() {
+	It("should mount the scratch cache PVC", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName", AnnScratchCacheClaim: "image-cache"}, nil)
+		reconciler := createImportReconciler(pvc)
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pod.Spec.Volumes).To(ContainElement(corev1.Volume{
+			Name: ScratchCacheVolName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "image-cache"},
+			},
+		}))
+		Expect(pod.Spec.Containers[0].VolumeMounts).To(ContainElement(corev1.VolumeMount{
+			Name:      ScratchCacheVolName,
+			MountPath: common.ScratchCacheDataDir,
+		}))
+		Expect(pod.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{
+			Name:  common.ImporterScratchCacheDir,
+			Value: common.ScratchCacheDataDir,
+		}))
+	})
+
+	It("should not mount a scratch cache without the annotation", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName"}, nil)
+		reconciler := createImportReconciler(pvc)
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		for _, vol := range pod.Spec.Volumes {
+			Expect(vol.Name).ToNot(Equal(ScratchCacheVolName))
+		}
+		for _, env := range pod.Spec.Containers[0].Env {
+			Expect(env.Name).ToNot(Equal(common.ImporterScratchCacheDir))
+		}
+	})
+})
+
+var _ = Describe("Create Importer Pod with phase events", func() {
+	It("should pass the pod UID with the phase events", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName", AnnPhaseEvents: "true"}, nil)
+		reconciler := createImportReconciler(pvc)
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pod.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{
+			Name:  common.ImporterPhaseEvents,
+			Value: "true",
+		}))
+		Expect(pod.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{
+			Name: common.ImporterPodUID,
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.uid"},
+			},
+		}))
+	})
+
+	It("should not pass the pod UID without the annotation", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName"}, nil)
+		reconciler := createImportReconciler(pvc)
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		for _, env := range pod.Spec.Containers[0].Env {
+			Expect(env.Name).ToNot(Equal(common.ImporterPhaseEvents))
+			Expect(env.Name).ToNot(Equal(common.ImporterPodUID))
+		}
+	})
+})
+
+var _ = Describe("Create Importer Pod with a progress service", func() {
+	It("should mount the progress service certificates secret", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName", AnnProgressGRPCAddress: ":8444", AnnProgressGRPCCertSecret: "progress-certs"}, nil)
+		reconciler := createImportReconciler(pvc)
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pod.Spec.Volumes).To(ContainElement(corev1.Volume{
+			Name: ProgressCertVolName,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{SecretName: "progress-certs"},
+			},
+		}))
+		Expect(pod.Spec.Containers[0].VolumeMounts).To(ContainElement(corev1.VolumeMount{
+			Name:      ProgressCertVolName,
+			MountPath: common.ImporterProgressCertDir,
+		}))
+		Expect(pod.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{
+			Name:  common.ImporterProgressGRPCCertDir,
+			Value: common.ImporterProgressCertDir,
+		}))
+		Expect(pod.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{
+			Name:  common.ImporterProgressGRPCAddress,
+			Value: ":8444",
+		}))
+	})
+
+	It("should not mount the progress service certificates without the annotation", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName"}, nil)
+		reconciler := createImportReconciler(pvc)
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		for _, vol := range pod.Spec.Volumes {
+			Expect(vol.Name).ToNot(Equal(ProgressCertVolName))
+		}
+		for _, env := range pod.Spec.Containers[0].Env {
+			Expect(env.Name).ToNot(Equal(common.ImporterProgressGRPCCertDir))
+		}
+	})
+})
+
+var _ = Describe("Create Importer Pod with a bearer token", func() {
+	It("should pass the bearer token of the secret", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName", AnnBearerTokenSecret: "registry-token"}, nil)
+		reconciler := createImportReconciler(pvc)
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pod.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{
+			Name: common.ImporterBearerToken,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "registry-token"},
+					Key:                  common.KeyBearerToken,
+				},
+			},
+		}))
+	})
+
+	It("should not pass a bearer token without the annotation", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName"}, nil)
+		reconciler := createImportReconciler(pvc)
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		for _, env := range pod.Spec.Containers[0].Env {
+			Expect(env.Name).ToNot(Equal(common.ImporterBearerToken))
+		}
+	})
+})
+
+var _ = Describe("Create Importer Pod with a file source", func() {
+	It("should mount the file source PVC read only", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: "images/disk.qcow2", AnnSource: SourceFile, AnnImportPod: "podName", AnnFileSourceClaim: "nfs-images"}, nil)
+		reconciler := createImportReconciler(pvc)
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pod.Spec.Volumes).To(ContainElement(corev1.Volume{
+			Name: FileSourceVolName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "nfs-images", ReadOnly: true},
+			},
+		}))
+		Expect(pod.Spec.Containers[0].VolumeMounts).To(ContainElement(corev1.VolumeMount{
+			Name:      FileSourceVolName,
+			MountPath: common.ImporterFileSourceDir,
+			ReadOnly:  true,
+		}))
+		Expect(pod.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{
+			Name:  common.ImporterFileSourceRoot,
+			Value: common.ImporterFileSourceDir,
+		}))
+	})
+
+	It("should not mount a file source without the annotation", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName"}, nil)
+		reconciler := createImportReconciler(pvc)
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		for _, vol := range pod.Spec.Volumes {
+			Expect(vol.Name).ToNot(Equal(FileSourceVolName))
+		}
+		for _, env := range pod.Spec.Containers[0].Env {
+			Expect(env.Name).ToNot(Equal(common.ImporterFileSourceRoot))
+		}
+	})
+})
+
+var _ = Describe("Create Importer Pod with an smb source", func() {
+	It("should mount the share with the SMB CSI driver and the secret", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: "smb://fileserver/images/linux/disk.qcow2", AnnSource: SourceSMB, AnnImportPod: "podName", AnnSecret: "smb-creds"}, nil)
+		reconciler := createImportReconciler(pvc)
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		readOnly := true
+		Expect(pod.Spec.Volumes).To(ContainElement(corev1.Volume{
+			Name: FileSourceVolName,
+			VolumeSource: corev1.VolumeSource{
+				CSI: &corev1.CSIVolumeSource{
+					Driver:               SMBCSIDriver,
+					ReadOnly:             &readOnly,
+					VolumeAttributes:     map[string]string{"source": "//fileserver/images"},
+					NodePublishSecretRef: &corev1.LocalObjectReference{Name: "smb-creds"},
+				},
+			},
+		}))
+		Expect(pod.Spec.Containers[0].VolumeMounts).To(ContainElement(corev1.VolumeMount{
+			Name:      FileSourceVolName,
+			MountPath: common.ImporterFileSourceDir,
+			ReadOnly:  true,
+		}))
+		Expect(pod.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{
+			Name:  common.ImporterFileSourceRoot,
+			Value: common.ImporterFileSourceDir,
+		}))
+		// The credentials are only read by the SMB CSI driver.
+		for _, env := range pod.Spec.Containers[0].Env {
+			Expect(env.Name).ToNot(Equal(common.ImporterAccessKeyID))
+			Expect(env.Name).ToNot(Equal(common.ImporterSecretKey))
+		}
+	})
+
+	It("should reject endpoints without share", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: "smb://fileserver/", AnnSource: SourceSMB, AnnImportPod: "podName"}, nil)
+		reconciler := createImportReconciler(pvc)
+		_, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should reject a file source PVC", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: "smb://fileserver/images/disk.img", AnnSource: SourceSMB, AnnImportPod: "podName", AnnFileSourceClaim: "nfs-images"}, nil)
+		reconciler := createImportReconciler(pvc)
+		_, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Create Importer Pod with signature verification", func() {
+	It("should mount the signature public keys configmap", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName", AnnSignaturePublicKeys: "release-keys", AnnSignatureURL: testEndPoint + ".sig"}, nil)
+		reconciler := createImportReconciler(pvc)
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pod.Spec.Volumes).To(ContainElement(corev1.Volume{
+			Name: SignaturePublicKeysVolName,
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "release-keys"},
+				},
+			},
+		}))
+		Expect(pod.Spec.Containers[0].VolumeMounts).To(ContainElement(corev1.VolumeMount{
+			Name:      SignaturePublicKeysVolName,
+			MountPath: common.ImporterSignaturePublicKeysDir,
+		}))
+		Expect(pod.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{
+			Name:  common.ImporterSignaturePublicKey,
+			Value: common.ImporterSignaturePublicKeysDir + "/" + common.KeySignaturePublicKeys,
+		}))
+		Expect(pod.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{
+			Name:  common.ImporterSignatureURL,
+			Value: testEndPoint + ".sig",
+		}))
+	})
+
+	It("should not mount signature public keys without the annotation", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName"}, nil)
+		reconciler := createImportReconciler(pvc)
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		for _, vol := range pod.Spec.Volumes {
+			Expect(vol.Name).ToNot(Equal(SignaturePublicKeysVolName))
+		}
+		for _, env := range pod.Spec.Containers[0].Env {
+			Expect(env.Name).ToNot(Equal(common.ImporterSignaturePublicKey))
+		}
+	})
+})
+
+var _ = Describe("Create Importer Pod with the qemu-img configuration", func() {
+	stringPtr := func(s string) *string {
+		return &s
+	}
+	setQemuImgConfig := func(reconciler *ImportReconciler, qemuImgPath *string, flags []string) {
+		cdiConfig := &cdiv1.CDIConfig{}
+		Expect(reconciler.client.Get(context.TODO(), types.NamespacedName{Name: common.ConfigName}, cdiConfig)).To(Succeed())
+		cdiConfig.Spec.QemuImgPath = qemuImgPath
+		cdiConfig.Spec.QemuImgConvertFlags = flags
+		Expect(reconciler.client.Update(context.TODO(), cdiConfig)).To(Succeed())
+	}
+
+	It("should pass the qemu-img path and convert flags of the CDI config", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName"}, nil)
+		reconciler := createImportReconciler(pvc)
+		setQemuImgConfig(reconciler, stringPtr("/usr/local/bin/qemu-img"), []string{"-t", "none", "-W"})
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pod.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{Name: common.ImporterQemuImgPath, Value: "/usr/local/bin/qemu-img"}))
+		Expect(pod.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{Name: common.ImporterQemuImgConvertFlags, Value: "-t none -W"}))
+	})
+
+	It("should ignore the former qemu-img annotations of the PVC", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{
+			AnnEndpoint:  testEndPoint,
+			AnnImportPod: "podName",
+			AnnAPIGroup + "/storage.import.qemuImgPath":         "/tmp/qemu-img",
+			AnnAPIGroup + "/storage.import.qemuImgConvertFlags": "-t none",
+		}, nil)
+		reconciler := createImportReconciler(pvc)
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		for _, env := range pod.Spec.Containers[0].Env {
+			Expect(env.Name).ToNot(Equal(common.ImporterQemuImgPath))
+			Expect(env.Name).ToNot(Equal(common.ImporterQemuImgConvertFlags))
+		}
+	})
+
+	table.DescribeTable("should refuse", func(qemuImgPath *string, flags []string, expectedErr string) {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName"}, nil)
+		reconciler := createImportReconciler(pvc)
+		setQemuImgConfig(reconciler, qemuImgPath, flags)
+		_, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(expectedErr))
+	},
+		table.Entry("a relative qemu-img path", stringPtr("bin/qemu-img"), nil, "is not a clean absolute path"),
+		table.Entry("an unclean qemu-img path", stringPtr("/usr/bin/../../tmp/qemu-img"), nil, "is not a clean absolute path"),
+		table.Entry("a flag changing the target format", nil, []string{"-O", "qcow2"}, "qemu-img convert flag \"-O\" is not allowed"),
+		table.Entry("an invalid cache mode", nil, []string{"-t", "none;reboot"}, "invalid value"),
+	)
+})
+
+var _ = Describe("Create Importer Pod with importer options", func() {
+	table.DescribeTable("should pass the annotation", func(annotation, env, value string) {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName", annotation: value}, nil)
+		reconciler := createImportReconciler(pvc)
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pod.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{Name: env, Value: value}))
+	},
+		table.Entry("of the archive member selection", AnnArchiveMemberSelection, common.ImporterArchiveMemberSelection, "largest"),
+		table.Entry("of the prefetch buffer size", AnnPrefetchBufferSize, common.ImporterPrefetchBufferSize, "64Mi"),
+		table.Entry("of the strict format check", AnnStrictFormatCheck, common.ImporterStrictFormatCheck, "true"),
+		table.Entry("of the image check", AnnCheckImage, common.ImporterCheckImage, "true"),
+		table.Entry("of the manifest file", AnnManifestFile, common.ImporterManifestFile, "/data/manifest.json"),
+		table.Entry("of the flush policy", AnnFlushPolicy, common.ImporterFlushPolicy, "periodic(10s)"),
+		table.Entry("of the clean restart threshold", AnnCleanRestartThreshold, common.ImporterCleanRestartThreshold, "3"),
+		table.Entry("of the qcow2 normalization", AnnNormalizeQcow2, common.ImporterNormalizeQcow2, "true"),
+		table.Entry("of the expected virtual size", AnnExpectedVirtualSize, common.ImporterExpectedVirtualSize, "10Gi"),
+		table.Entry("of the virtual size tolerance", AnnVirtualSizeTolerance, common.ImporterVirtualSizeTolerance, "1Mi"),
+		table.Entry("of the registry tag constraint", AnnRegistryTagConstraint, common.ImporterRegistryTagConstraint, ">=1.2.0 <2.0.0"),
+		table.Entry("of the NBD target", AnnNbdTarget, common.ImporterNbdTarget, "nbd+unix:///disk?socket=/nbd.sock"),
+		table.Entry("of the chunk checksum size", AnnChunkChecksumSize, common.ImporterChunkChecksumSize, "64Mi"),
+		table.Entry("of the expected archive entries", AnnArchiveExpectedEntries, common.ImporterArchiveExpectedEntries, "5000"),
+		table.Entry("of the zero image threshold", AnnZeroImageThreshold, common.ImporterZeroImageThreshold, "0.99"),
+		table.Entry("of the strict zero image check", AnnZeroImageStrict, common.ImporterZeroImageStrict, "true"),
+		table.Entry("of the retry after budget", AnnRetryAfterBudget, common.ImporterRetryAfterBudget, "5m"),
+		table.Entry("of the overlay target", AnnOverlayTarget, common.ImporterOverlayTarget, "true"),
+		table.Entry("of the maximum allocated clusters", AnnMaxAllocatedClusters, common.ImporterMaxAllocatedClusters, "1048576"),
+		table.Entry("of the ranged format detection", AnnRangedFormatDetection, common.ImporterRangedFormatDetection, "true"),
+		table.Entry("of the piped conversion", AnnPipedConversion, common.ImporterPipedConversion, "true"),
+		table.Entry("of the pinned SPKI hashes", AnnPinnedSPKIHashes, common.ImporterPinnedSPKIHashes, "sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="),
+		table.Entry("of the conversion segment size", AnnConversionSegmentSize, common.ImporterConversionSegmentSize, "1Gi"),
+		table.Entry("of the S3 alternate endpoints", AnnS3AlternateEndpoints, common.ImporterS3AlternateEndpoints, "s3.dualstack.us-east-1.amazonaws.com"),
+		table.Entry("of the read retries", AnnReadRetries, common.ImporterReadRetries, "5"),
+		table.Entry("of the read retry backoff", AnnReadRetryBackoff, common.ImporterReadRetryBackoff, "2s"),
+		table.Entry("of the S3 concurrency", AnnS3Concurrency, common.ImporterS3Concurrency, "4"),
+		table.Entry("of the expected checksum", AnnExpectedChecksum, common.ImporterExpectedChecksum, "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"),
+		table.Entry("of the S3 get attempts", AnnS3GetAttempts, common.ImporterS3GetAttempts, "5"),
+		table.Entry("of the S3 get backoff", AnnS3GetBackoff, common.ImporterS3GetBackoff, "2s"),
+		table.Entry("of the S3 version", AnnS3VersionID, common.ImporterS3VersionID, "3HL4kqtJlcpXroDTDmJ+rmSpXd3dIbrHY"),
+		table.Entry("of the phase metrics", AnnPhaseMetrics, common.ImporterPhaseMetrics, "true"),
+		table.Entry("of the tar extraction", AnnTarExtraction, common.ImporterTarExtraction, "true"),
+		table.Entry("of the tar member patterns", AnnTarMemberPatterns, common.ImporterTarMemberPatterns, "*.qcow2,*.img"),
+		table.Entry("of the rate limit", AnnRateLimit, common.ImporterRateLimit, "10Mi"),
+		table.Entry("of the S3 ETag verification", AnnS3VerifyETag, common.ImporterS3VerifyETag, "true"),
+		table.Entry("of the S3 path style", AnnS3ForcePathStyle, common.ImporterS3ForcePathStyle, "true"),
+		table.Entry("of the transfer verification", AnnVerifyTransfer, common.ImporterVerifyTransfer, "true"),
+		table.Entry("of the scratch preallocation", AnnScratchPreallocation, common.ImporterScratchPreallocation, "true"),
+		table.Entry("of the S3 range offset", AnnS3RangeOffset, common.ImporterS3RangeOffset, "1048576"),
+		table.Entry("of the S3 range length", AnnS3RangeLength, common.ImporterS3RangeLength, "1073741824"),
+		table.Entry("of the strict source size", AnnStrictSourceSize, common.ImporterStrictSourceSize, "true"),
+		table.Entry("of the target format", AnnTargetFormat, common.ImporterTargetFormat, "qcow2"),
+		table.Entry("of the S3 requester pays", AnnS3RequesterPays, common.ImporterS3RequesterPays, "true"),
+		table.Entry("of the log level", AnnLogLevel, common.ImporterLogLevel, "debug"),
+		table.Entry("of the transfer resume", AnnTransferResume, common.ImporterTransferResume, "true"),
+		table.Entry("of the user agent", AnnUserAgent, common.ImporterUserAgent, "cdi-importer/1.0"),
+		table.Entry("of the maximum source size", AnnMaxSourceBytes, common.ImporterMaxSourceBytes, "20Gi"),
+		table.Entry("of the S3 region", AnnS3Region, common.ImporterS3Region, "us-east-1"),
+		table.Entry("of the S3 disabled checksums", AnnS3DisableChecksums, common.ImporterS3DisableChecksums, "true"),
+		table.Entry("of the scratch cache maximum size", AnnScratchCacheMaxSize, common.ImporterScratchCacheMaxSize, "50Gi"),
+		table.Entry("of the signature", AnnSignature, common.ImporterSignature, "-----BEGIN PGP SIGNATURE-----"),
+		table.Entry("of the signature URL", AnnSignatureURL, common.ImporterSignatureURL, "https://example.com/disk.img.sig"),
+	)
+
+	It("should not set the options without annotations", func() {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName"}, nil)
+		reconciler := createImportReconciler(pvc)
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		for _, option := range importerOptions {
+			for _, env := range pod.Spec.Containers[0].Env {
+				Expect(env.Name).ToNot(Equal(option.env))
+			}
+		}
+	})
+
+	table.DescribeTable("should refuse the annotation", func(annotation, value string) {
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName", annotation: value}, nil)
+		reconciler := createImportReconciler(pvc)
+		_, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(annotation))
+	},
+		table.Entry("of a boolean that isn't one", AnnPipedConversion, "yes please"),
+		table.Entry("of a negative quantity", AnnRateLimit, "-10Mi"),
+		table.Entry("of a negative count", AnnS3Concurrency, "-1"),
+		table.Entry("of a ratio above 1", AnnZeroImageThreshold, "1.5"),
+		table.Entry("of an invalid duration", AnnReadRetryBackoff, "2 seconds"),
+		table.Entry("of an unknown target format", AnnTargetFormat, "vmdk"),
+		table.Entry("of an unknown flush policy", AnnFlushPolicy, "never"),
+		table.Entry("of a manifest outside the data volume", AnnManifestFile, "/etc/passwd"),
+		table.Entry("of a manifest escaping the data volume", AnnManifestFile, "/data/../etc/passwd"),
+		table.Entry("of an NBD target of another scheme", AnnNbdTarget, "file:///dev/sda"),
+		table.Entry("of a progress address without port", AnnProgressGRPCAddress, "0.0.0.0"),
+		table.Entry("of a signature URL of another scheme", AnnSignatureURL, "file:///etc/shadow"),
+		table.Entry("of an invalid checksum", AnnExpectedChecksum, "sha256:not-hex"),
+		table.Entry("of an invalid SPKI hash", AnnPinnedSPKIHashes, "sha256/short"),
+		table.Entry("of a user agent with a header injection", AnnUserAgent, "cdi\r\nAuthorization: Bearer x"),
+		table.Entry("of a signature that isn't armored", AnnSignature, "c2lnbmF0dXJl"),
+		table.Entry("of an extra header with a line break", AnnExtraHeaders, "X-Tenant: test\rX-Other: value"),
+		table.Entry("of a git path with a control character", AnnGitPath, "disk\x00.img"),
+	)
+
+	It("should have a validation for every option", func() {
+		for _, option := range importerOptions {
+			Expect(option.validate).ToNot(BeNil(), option.annotation)
+		}
+	})
+})
+
+var _ = Describe("Create Importer Pod mounting objects named by annotations", func() {
+	table.DescribeTable("should refuse", func(annotation, value, expectedErr string) {
+		pvc := createPvc("target-pvc", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName", annotation: value}, nil)
+		reconciler := createImportReconciler(pvc)
+		_, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(expectedErr))
+	},
+		table.Entry("a secret of another namespace", AnnBearerTokenSecret, "kube-system/token", "invalid name \"kube-system/token\""),
+		table.Entry("an invalid configmap name", AnnChecksumAllowlist, "../approved", "invalid name"),
+		table.Entry("an invalid secret of the extra headers", AnnSecretExtraHeaders, "headers,Other_Secret", "invalid name \"Other_Secret\""),
+		table.Entry("the PVC as scratch cache", AnnScratchCacheClaim, "target-pvc", "can't name the PVC"),
+		table.Entry("the scratch PVC as file source", AnnFileSourceClaim, "target-pvc-scratch", "can't name the PVC"),
+	)
+
+	It("should look the secret up in the PVC namespace", func() {
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: "other"}}
+		pvc := createPvc("testPvc1", "default", map[string]string{AnnEndpoint: testEndPoint, AnnImportPod: "podName", AnnBearerTokenSecret: "token"}, nil)
+		reconciler := createImportReconciler(pvc, secret)
+		podEnvVar, err := reconciler.createImportEnvVar(pvc)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(podEnvVar.bearerTokenSecret).To(Equal("token"))
+		pod, err := createImporterPod(reconciler.log, reconciler.client, testImage, "5", testPullPolicy, podEnvVar, pvc, nil, nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pod.Namespace).To(Equal("default"))
+	})
+})
+
 var _ = Describe("Import test env", func() {
 	const mockUID = "1111-1111-1111-1111"
 
@@ -753,6 +1357,8 @@ var _ = Describe("Import test env", func() {
 			currentCheckpoint:  "",
 			previousCheckpoint: "",
 			finalCheckpoint:    "",
+			extraHeaders:       []string{"X-Api-Version: 2", "X-Tenant: test"},
+			options:            []corev1.EnvVar{{Name: common.ImporterArchiveMemberSelection, Value: "largest"}},
 			preallocation:      false}
 		Expect(reflect.DeepEqual(makeImportEnv(testEnvVar, mockUID), createImportTestEnv(testEnvVar, mockUID))).To(BeTrue())
 	})
@@ -874,6 +1480,14 @@ var _ = Describe("getSource", func() {
 	pvcRegistryAnno := createPvc("testPVCRegistryAnno", "default", map[string]string{AnnSource: SourceRegistry}, nil)
 	pvcImageIOAnno := createPvc("testPVCImageIOAnno", "default", map[string]string{AnnSource: SourceImageio}, nil)
 	pvcVDDKAnno := createPvc("testPVCVDDKAnno", "default", map[string]string{AnnSource: SourceVDDK}, nil)
+	pvcGitAnno := createPvc("testPVCGitAnno", "default", map[string]string{AnnSource: SourceGit}, nil)
+	pvcNBDAnno := createPvc("testPVCNBDAnno", "default", map[string]string{AnnSource: SourceNBD}, nil)
+	pvcJSONResolverAnno := createPvc("testPVCJSONResolverAnno", "default", map[string]string{AnnSource: SourceJSONResolver}, nil)
+	pvcAzureBlobAnno := createPvc("testPVCAzureBlobAnno", "default", map[string]string{AnnSource: SourceAzureBlob}, nil)
+	pvcFTPAnno := createPvc("testPVCFTPAnno", "default", map[string]string{AnnSource: SourceFTP}, nil)
+	pvcWebDAVAnno := createPvc("testPVCWebDAVAnno", "default", map[string]string{AnnSource: SourceWebDAV}, nil)
+	pvcFileAnno := createPvc("testPVCFileAnno", "default", map[string]string{AnnSource: SourceFile}, nil)
+	pvcSMBAnno := createPvc("testPVCSMBAnno", "default", map[string]string{AnnSource: SourceSMB}, nil)
 
 	table.DescribeTable("should", func(pvc *corev1.PersistentVolumeClaim, expectedResult string) {
 		result := getSource(pvc)
@@ -886,6 +1500,14 @@ var _ = Describe("getSource", func() {
 		table.Entry("return registry if registry annotation provided", pvcRegistryAnno, SourceRegistry),
 		table.Entry("return imageio if imageio annotation provided", pvcImageIOAnno, SourceImageio),
 		table.Entry("return vddk if vddk annotation provided", pvcVDDKAnno, SourceVDDK),
+		table.Entry("return git if git annotation provided", pvcGitAnno, SourceGit),
+		table.Entry("return nbd if nbd annotation provided", pvcNBDAnno, SourceNBD),
+		table.Entry("return json-resolver if json-resolver annotation provided", pvcJSONResolverAnno, SourceJSONResolver),
+		table.Entry("return azure-blob if azure-blob annotation provided", pvcAzureBlobAnno, SourceAzureBlob),
+		table.Entry("return ftp if ftp annotation provided", pvcFTPAnno, SourceFTP),
+		table.Entry("return webdav if webdav annotation provided", pvcWebDAVAnno, SourceWebDAV),
+		table.Entry("return file if file annotation provided", pvcFileAnno, SourceFile),
+		table.Entry("return smb if smb annotation provided", pvcSMBAnno, SourceSMB),
 	)
 })
 
@@ -995,6 +1617,22 @@ func createImportTestEnv(podEnvVar *importPodEnvVar, uid string) []corev1.EnvVar
 			Name:  common.ImporterThumbprint,
 			Value: podEnvVar.thumbprint,
 		},
+		{
+			Name:  common.ImporterGitRef,
+			Value: podEnvVar.gitRef,
+		},
+		{
+			Name:  common.ImporterGitPath,
+			Value: podEnvVar.gitPath,
+		},
+		{
+			Name:  common.ImporterJSONURLPath,
+			Value: podEnvVar.jsonURLPath,
+		},
+		{
+			Name:  common.ImporterJSONChecksumPath,
+			Value: podEnvVar.jsonChecksumPath,
+		},
 		{
 			Name:  common.ImportProxyHTTP,
 			Value: podEnvVar.httpProxy,
@@ -1025,6 +1663,13 @@ func createImportTestEnv(podEnvVar *importPodEnvVar, uid string) []corev1.EnvVar
 		},
 	}
 
+	for index, header := range podEnvVar.extraHeaders {
+		env = append(env, corev1.EnvVar{
+			Name:  fmt.Sprintf("%s%d", common.ImporterExtraHeader, index),
+			Value: header,
+		})
+	}
+
 	if podEnvVar.secretName != "" {
 		env = append(env, corev1.EnvVar{
 			Name: common.ImporterAccessKeyID,
@@ -1048,7 +1693,7 @@ func createImportTestEnv(podEnvVar *importPodEnvVar, uid string) []corev1.EnvVar
 			},
 		})
 	}
-	return env
+	return append(env, podEnvVar.options...)
 }
 
 func createImporterTestPod(pvc *corev1.PersistentVolumeClaim, dvname string, scratchPvc *corev1.PersistentVolumeClaim) *corev1.Pod {
@@ -0,0 +1,252 @@
+package controller
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"kubevirt.io/containerized-data-importer/pkg/common"
+	"kubevirt.io/containerized-data-importer/pkg/util"
+)
+
+const (
+	// maxImporterOptionLength is the maximum length of the free text importer options.
+	maxImporterOptionLength = 4096
+)
+
+var (
+	checksumPattern = regexp.MustCompile(`^(sha256|md5):[0-9a-fA-F]+$`)
+	spkiHashPattern = regexp.MustCompile(`^(sha256/)?[A-Za-z0-9+/]{43}=$`)
+)
+
+// validateBool checks a true or false option.
+func validateBool(value string) error {
+	_, err := strconv.ParseBool(value)
+	return err
+}
+
+// validateQuantity checks a non negative quantity option, for instance 10Mi.
+func validateQuantity(value string) error {
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return err
+	}
+	if quantity.Sign() < 0 {
+		return errors.New("negative quantity")
+	}
+	return nil
+}
+
+// validateCount checks a non negative integer option.
+func validateCount(value string) error {
+	count, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return err
+	}
+	if count < 0 {
+		return errors.New("negative count")
+	}
+	return nil
+}
+
+// validateRatio checks an option between 0 and 1.
+func validateRatio(value string) error {
+	ratio, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+	if ratio < 0 || ratio > 1 {
+		return errors.New("not between 0 and 1")
+	}
+	return nil
+}
+
+// validateDuration checks a non negative duration option, for instance 2s.
+func validateDuration(value string) error {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if duration < 0 {
+		return errors.New("negative duration")
+	}
+	return nil
+}
+
+// validateOneOf returns the check of an option taking one of the values.
+func validateOneOf(values ...string) func(string) error {
+	return func(value string) error {
+		for _, v := range values {
+			if value == v {
+				return nil
+			}
+		}
+		return errors.Errorf("not one of %s", strings.Join(values, ", "))
+	}
+}
+
+// validateFlushPolicy checks a flush policy option.
+func validateFlushPolicy(value string) error {
+	_, err := util.ParseFlushPolicy(value)
+	return err
+}
+
+// validateText checks a free text option, a single line of printable characters.
+func validateText(value string) error {
+	if len(value) > maxImporterOptionLength {
+		return errors.Errorf("longer than %d characters", maxImporterOptionLength)
+	}
+	for _, r := range value {
+		if !unicode.IsPrint(r) {
+			return errors.Errorf("invalid character %q", r)
+		}
+	}
+	return nil
+}
+
+// validateSignature checks an ASCII armored signature option, printable lines.
+func validateSignature(value string) error {
+	if len(value) > maxImporterOptionLength {
+		return errors.Errorf("longer than %d characters", maxImporterOptionLength)
+	}
+	if !strings.Contains(value, "-----BEGIN PGP SIGNATURE-----") {
+		return errors.New("not an ASCII armored signature")
+	}
+	for _, r := range value {
+		if r != '\n' && r != '\r' && !unicode.IsPrint(r) {
+			return errors.Errorf("invalid character %q", r)
+		}
+	}
+	return nil
+}
+
+// validateManifestFile checks a manifest file option, a file of the data volume of the importer.
+func validateManifestFile(value string) error {
+	if filepath.Clean(value) != value || !strings.HasPrefix(value, common.ImporterDataDir+"/") {
+		return errors.Errorf("not a clean path in %s", common.ImporterDataDir)
+	}
+	return nil
+}
+
+// validateNbdTarget checks an NBD URI option.
+func validateNbdTarget(value string) error {
+	target, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	return validateOneOf("nbd", "nbd+tcp", "nbd+unix")(target.Scheme)
+}
+
+// validateAddress checks a listening address option, an optional host and a port.
+func validateAddress(value string) error {
+	_, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return errors.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// validateHTTPURL checks an http or https URL option.
+func validateHTTPURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("not an http or https URL")
+	}
+	return validateText(value)
+}
+
+// validateChecksum checks a checksum option, sha256:<hex> or md5:<hex>.
+func validateChecksum(value string) error {
+	if !checksumPattern.MatchString(value) {
+		return errors.New("not sha256:<hex> or md5:<hex>")
+	}
+	return nil
+}
+
+// validateSPKIHashes checks comma separated base64 SHA256 hashes, optionally prefixed with sha256/.
+func validateSPKIHashes(value string) error {
+	for _, hash := range strings.Split(value, ",") {
+		if hash = strings.TrimSpace(hash); !spkiHashPattern.MatchString(hash) {
+			return errors.Errorf("invalid hash %q", hash)
+		}
+	}
+	return nil
+}
+
+// getImporterOptions returns the env variables of the importer options annotated on the PVC, failing if a value
+// isn't valid.
+func getImporterOptions(pvc *corev1.PersistentVolumeClaim) ([]corev1.EnvVar, error) {
+	var env []corev1.EnvVar
+	for _, option := range importerOptions {
+		value := getValueFromAnnotation(pvc, option.annotation)
+		if value == "" {
+			continue
+		}
+		if err := option.validate(value); err != nil {
+			return nil, errors.Wrapf(err, "invalid value %q of annotation %s", value, option.annotation)
+		}
+		env = append(env, corev1.EnvVar{Name: option.env, Value: value})
+	}
+	return env, nil
+}
+
+// getMountedObjectName returns the name of the object the importer pod mounts named by the annotation of the PVC,
+// empty without the annotation. Like the cert configmap, the object is one of the PVC namespace, the importer pod
+// waiting for it to exist.
+func (r *ImportReconciler) getMountedObjectName(pvc *corev1.PersistentVolumeClaim, annotation string, obj client.Object) (string, error) {
+	name := getValueFromAnnotation(pvc, annotation)
+	if name == "" {
+		return "", nil
+	}
+	if err := r.checkMountedObject(pvc, annotation, name, obj); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// getMountedClaimName is getMountedObjectName for the PVCs, which can't be the PVC or its scratch PVC.
+func (r *ImportReconciler) getMountedClaimName(pvc *corev1.PersistentVolumeClaim, annotation string) (string, error) {
+	name, err := r.getMountedObjectName(pvc, annotation, &corev1.PersistentVolumeClaim{})
+	if err != nil {
+		return "", err
+	}
+	if name != "" && (name == pvc.Name || name == createScratchNameFromPvc(pvc)) {
+		return "", errors.Errorf("annotation %s can't name the PVC %s or its scratch PVC", annotation, pvc.Name)
+	}
+	return name, nil
+}
+
+// checkMountedObject checks that name, named by the annotation of the PVC, is the valid name of an object of the PVC
+// namespace, and logs if it doesn't exist yet.
+func (r *ImportReconciler) checkMountedObject(pvc *corev1.PersistentVolumeClaim, annotation, name string, obj client.Object) error {
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return errors.Errorf("invalid name %q of annotation %s: %s", name, annotation, strings.Join(errs, ", "))
+	}
+	if err := r.uncachedClient.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: pvc.Namespace}, obj); err != nil {
+		if !k8serrors.IsNotFound(err) {
+			return err
+		}
+		r.log.V(1).Info("Object does not exist, pod will not start until it does", "annotation", annotation, "name", name)
+	}
+	return nil
+}
@@ -124,6 +124,20 @@ const (
 
 	// ProxyCertVolName is the name of the volumecontaining certs
 	ProxyCertVolName = "cdi-proxy-cert-vol"
+	// SecretExtraHeadersVolumeName is the format string that specifies where extra HTTP header secrets will be mounted
+	SecretExtraHeadersVolumeName = "cdi-secret-extra-headers-vol-%d"
+	// SSECustomerKeyVolName is the name of the volume containing the S3 SSE-C key secret
+	SSECustomerKeyVolName = "cdi-sse-customer-key-vol"
+	// ChecksumAllowlistVolName is the name of the volume containing the checksum allowlist configmap
+	ChecksumAllowlistVolName = "cdi-checksum-allowlist-vol"
+	// ScratchCacheVolName is the name of the volume of the scratch cache PVC
+	ScratchCacheVolName = "cdi-scratch-cache-vol"
+	// ProgressCertVolName is the name of the volume containing the certificates of the progress service
+	ProgressCertVolName = "cdi-progress-cert-vol"
+	// FileSourceVolName is the name of the volume of the PVC the file source imports from
+	FileSourceVolName = "cdi-file-source-vol"
+	// SignaturePublicKeysVolName is the name of the volume containing the signature public keys configmap
+	SignaturePublicKeysVolName = "cdi-signature-public-keys-vol"
 	// ClusterWideProxyAPIGroup is the APIGroup for OpenShift Cluster Wide Proxy
 	ClusterWideProxyAPIGroup = "config.openshift.io"
 	// ClusterWideProxyAPIKind is the APIKind for OpenShift Cluster Wide Proxy
@@ -46,12 +46,25 @@ var knownHeaders = Headers{
 		SizeOff: 0,
 		SizeLen: 0,
 	},
+	"zst": Header{
+		Format:      "zst",
+		magicNumber: []byte{0x28, 0xB5, 0x2F, 0xFD},
+		// TODO: size not in hdr
+		SizeOff: 0,
+		SizeLen: 0,
+	},
 	"vmdk": Header{
 		Format:      "vmdk",
 		magicNumber: []byte("KDMV"),
 		SizeOff:     0,
 		SizeLen:     0,
 	},
+	"vmdk-descriptor": Header{
+		Format:      "vmdk-descriptor",
+		magicNumber: []byte("# Disk DescriptorFile"),
+		SizeOff:     0,
+		SizeLen:     0,
+	},
 	"vdi": Header{
 		Format:      "vdi",
 		magicNumber: []byte("<<< Oracle VM"),
@@ -41,6 +41,10 @@ var _ = Describe("File format tests", func() {
 			Header{"xz", []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}, 0, 0, 0},
 			[]byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00},
 			true),
+		table.Entry("match zst",
+			Header{"zst", []byte{0x28, 0xB5, 0x2F, 0xFD}, 0, 0, 0},
+			[]byte{0x28, 0xB5, 0x2F, 0xFD, 0x24, 0x00},
+			true),
 		table.Entry("failed match",
 			Header{"gz", []byte{0x1F, 0x8B}, 0, 0, 0},
 			[]byte{'Q', 'F', 'I', 0xfb},
@@ -49,6 +53,10 @@ var _ = Describe("File format tests", func() {
 			Header{"vmdk", []byte("KDMV"), 0, 24, 8},
 			[]byte("KDMV"),
 			true),
+		table.Entry("match vmdk descriptor",
+			Header{"vmdk-descriptor", []byte("# Disk DescriptorFile"), 0, 0, 0},
+			[]byte("# Disk DescriptorFile\nversion=1\n"),
+			true),
 		table.Entry("match vdi",
 			Header{"vdi", []byte("<<< Oracle VM"), 0, 24, 8},
 			[]byte("<<< Oracle VM"),
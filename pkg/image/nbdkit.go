@@ -15,6 +15,7 @@ import (
 	"k8s.io/klog/v2"
 
 	"kubevirt.io/containerized-data-importer/pkg/common"
+	"kubevirt.io/containerized-data-importer/pkg/util"
 )
 
 const (
@@ -65,6 +66,8 @@ type Nbdkit struct {
 	Socket     string
 	Env        []string
 	LogWatcher NbdkitLogWatcher
+	// arguments containing secrets, mapped to the string logged instead
+	redactedArgs map[string]string
 }
 
 // NbdkitOperation defines the interface for executing nbdkit
@@ -83,20 +86,31 @@ func NewNbdkit(plugin NbdkitPlugin, nbdkitPidFile string) *Nbdkit {
 	}
 }
 
-// NewNbdkitCurl creates a new Nbdkit instance with the curl plugin
-func NewNbdkitCurl(nbdkitPidFile, certDir, socket string) NbdkitOperation {
+// NewNbdkitCurl creates a new Nbdkit instance with the curl plugin. The extra headers in the form "Name: value" are
+// sent with every request, the values of the secret extra headers are not logged.
+func NewNbdkitCurl(nbdkitPidFile, certDir, socket string, extraHeaders, secretExtraHeaders []string) NbdkitOperation {
 	var pluginArgs []string
 	args := []string{"-r"}
 	if certDir != "" {
 		pluginArgs = append(pluginArgs, fmt.Sprintf("cainfo=%s/%s", certDir, "tls.crt"))
 	}
+	for _, header := range extraHeaders {
+		pluginArgs = append(pluginArgs, "header="+header)
+	}
+	redactedArgs := make(map[string]string)
+	for _, header := range secretExtraHeaders {
+		arg := "header=" + header
+		pluginArgs = append(pluginArgs, arg)
+		redactedArgs[arg] = "header=" + strings.SplitN(header, ":", 2)[0] + ": *****"
+	}
 
 	return &Nbdkit{
-		NbdPidFile: nbdkitPidFile,
-		plugin:     NbdkitCurlPlugin,
-		nbdkitArgs: args,
-		pluginArgs: pluginArgs,
-		Socket:     socket,
+		NbdPidFile:   nbdkitPidFile,
+		plugin:       NbdkitCurlPlugin,
+		nbdkitArgs:   args,
+		pluginArgs:   pluginArgs,
+		Socket:       socket,
+		redactedArgs: redactedArgs,
 	}
 }
 
@@ -201,15 +215,7 @@ func (n *Nbdkit) StartNbdkit(source string) error {
 	argsNbdkit = append(argsNbdkit, n.pluginArgs...)
 	argsNbdkit = append(argsNbdkit, n.getSourceArg(source))
 
-	quotedArgs := make([]string, len(argsNbdkit))
-	for index, value := range argsNbdkit {
-		if strings.HasPrefix(value, "password=") {
-			quotedArgs[index] = "'password=*****'"
-		} else {
-			quotedArgs[index] = "'" + value + "'"
-		}
-	}
-	klog.V(3).Infof("Start nbdkit with: %v", quotedArgs)
+	klog.V(3).Infof("Start nbdkit with: %v", n.quoteArgs(argsNbdkit))
 
 	n.c = exec.Command("nbdkit", argsNbdkit...)
 	var stdout io.ReadCloser
@@ -240,6 +246,36 @@ func (n *Nbdkit) StartNbdkit(source string) error {
 	return nil
 }
 
+// quoteArgs quotes the arguments for logging, and hides secrets.
+func (n *Nbdkit) quoteArgs(args []string) []string {
+	quotedArgs := make([]string, len(args))
+	for index, value := range args {
+		if strings.HasPrefix(value, "password=") {
+			quotedArgs[index] = "'password=*****'"
+		} else if redacted, ok := redactURLArg(value); ok {
+			quotedArgs[index] = "'" + redacted + "'"
+		} else if redacted, ok := n.redactedArgs[value]; ok {
+			quotedArgs[index] = "'" + redacted + "'"
+		} else {
+			quotedArgs[index] = "'" + value + "'"
+		}
+	}
+	return quotedArgs
+}
+
+// redactURLArg returns the url argument arg with the secrets of the url hidden, and true if arg is such an argument.
+func redactURLArg(arg string) (string, bool) {
+	if !strings.HasPrefix(arg, "url=") {
+		return "", false
+	}
+	value := strings.TrimPrefix(arg, "url=")
+	redacted := util.RedactURL(value)
+	if redacted == value {
+		return "", false
+	}
+	return "url=" + redacted, true
+}
+
 // Default nbdkit log watcher, logs lines as nbdkit prints them,
 // and appends them to the nbdkit log file.
 func watchNbdLog(output *bufio.Reader) {
@@ -359,7 +395,7 @@ func (n *Nbdkit) validatePlugin() error {
 type mockNbdkit struct{}
 
 // NewMockNbdkitCurl creates a mock nbdkit curl plugin for testing
-func NewMockNbdkitCurl(nbdkitPidFile, certDir, socket string) NbdkitOperation {
+func NewMockNbdkitCurl(nbdkitPidFile, certDir, socket string, extraHeaders, secretExtraHeaders []string) NbdkitOperation {
 	return &mockNbdkit{}
 }
 
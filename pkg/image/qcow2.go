@@ -0,0 +1,107 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// qcow2 header fields and table entries, see docs/interop/qcow2.txt of qemu.
+const (
+	qcow2HdrVersionOff      = 4
+	qcow2HdrClusterBitsOff  = 20
+	qcow2HdrL1SizeOff       = 36
+	qcow2HdrL1TableOff      = 40
+	qcow2HdrIncompatOff     = 72
+	qcow2HdrV3Size          = 104
+	qcow2IncompatExtendedL2 = 1 << 4
+	qcow2MinClusterBits     = 9
+	qcow2MaxClusterBits     = 21
+	// qemu refuses L1 tables larger than 32MiB
+	qcow2MaxL1Size           = 32 * 1024 * 1024 / 8
+	qcow2OffsetMask          = 0x00fffffffffffe00
+	qcow2CompressedFlag      = 1 << 62
+	qcow2EntrySize           = 8
+	qcow2ExtendedL2EntrySize = 16
+)
+
+// CountQcow2AllocatedClusters returns the number of data clusters allocated in the L2 tables of the qcow2 image
+// fileName, without reading the data. Counting stops as soon as the count exceeds limit, unless limit is 0. Images
+// of other formats have no clusters.
+func CountQcow2AllocatedClusters(fileName string, limit int64) (int64, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to open %s", fileName)
+	}
+	defer file.Close()
+
+	hdr := make([]byte, qcow2HdrV3Size)
+	if _, err := io.ReadFull(file, hdr); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, nil
+		}
+		return 0, errors.Wrapf(err, "unable to read the header of %s", fileName)
+	}
+	if !bytes.Equal(hdr[:4], knownHeaders["qcow2"].magicNumber) {
+		return 0, nil
+	}
+	clusterBits := binary.BigEndian.Uint32(hdr[qcow2HdrClusterBitsOff:])
+	if clusterBits < qcow2MinClusterBits || clusterBits > qcow2MaxClusterBits {
+		return 0, errors.Errorf("invalid qcow2 cluster bits %d in %s", clusterBits, fileName)
+	}
+	l1Size := binary.BigEndian.Uint32(hdr[qcow2HdrL1SizeOff:])
+	if l1Size > qcow2MaxL1Size {
+		return 0, errors.Errorf("qcow2 L1 table of %s is too large, %d entries", fileName, l1Size)
+	}
+	entrySize := int64(qcow2EntrySize)
+	if binary.BigEndian.Uint32(hdr[qcow2HdrVersionOff:]) >= 3 &&
+		binary.BigEndian.Uint64(hdr[qcow2HdrIncompatOff:])&qcow2IncompatExtendedL2 != 0 {
+		entrySize = qcow2ExtendedL2EntrySize
+	}
+
+	l1Table := make([]byte, int64(l1Size)*qcow2EntrySize)
+	if _, err := file.ReadAt(l1Table, int64(binary.BigEndian.Uint64(hdr[qcow2HdrL1TableOff:]))); err != nil {
+		return 0, errors.Wrapf(err, "unable to read the qcow2 L1 table of %s", fileName)
+	}
+	var count int64
+	l2Table := make([]byte, int64(1)<<clusterBits)
+	for i := 0; i < len(l1Table); i += qcow2EntrySize {
+		l2Offset := int64(binary.BigEndian.Uint64(l1Table[i:]) & qcow2OffsetMask)
+		if l2Offset == 0 {
+			continue
+		}
+		if _, err := file.ReadAt(l2Table, l2Offset); err != nil {
+			return 0, errors.Wrapf(err, "unable to read a qcow2 L2 table of %s", fileName)
+		}
+		for j := int64(0); j < int64(len(l2Table)); j += entrySize {
+			entry := binary.BigEndian.Uint64(l2Table[j:])
+			// Clusters reading as zeroes without host cluster aren't allocated.
+			if entry&qcow2CompressedFlag != 0 || entry&qcow2OffsetMask != 0 {
+				count++
+			}
+		}
+		if limit > 0 && count > limit {
+			break
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,127 @@
+package image
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// craftQcow2 returns a qcow2 v3 image with 512 byte clusters, and the given L2 table entries. The L1 table and the
+// L2 tables follow the header, the data clusters the entries point to don't exist.
+func craftQcow2(extendedL2 bool, l2Tables ...[]uint64) []byte {
+	const clusterSize = 512
+	entrySize := 8
+	if extendedL2 {
+		entrySize = 16
+	}
+	image := make([]byte, clusterSize*(2+len(l2Tables)))
+	copy(image, []byte{'Q', 'F', 'I', 0xfb})
+	binary.BigEndian.PutUint32(image[4:], 3)
+	binary.BigEndian.PutUint32(image[20:], 9)
+	binary.BigEndian.PutUint64(image[24:], uint64(len(l2Tables)*clusterSize/entrySize*clusterSize))
+	binary.BigEndian.PutUint32(image[36:], uint32(len(l2Tables)))
+	binary.BigEndian.PutUint64(image[40:], clusterSize)
+	if extendedL2 {
+		binary.BigEndian.PutUint64(image[72:], 1<<4)
+	}
+	binary.BigEndian.PutUint32(image[100:], 112)
+	for i, entries := range l2Tables {
+		l2Offset := clusterSize * (2 + i)
+		if entries != nil {
+			binary.BigEndian.PutUint64(image[clusterSize+8*i:], uint64(l2Offset)|1<<63)
+		}
+		for j, entry := range entries {
+			binary.BigEndian.PutUint64(image[l2Offset+entrySize*j:], entry)
+		}
+	}
+	return image
+}
+
+// allocatedEntries returns count L2 entries of allocated data clusters.
+func allocatedEntries(count int) []uint64 {
+	entries := make([]uint64, count)
+	for i := range entries {
+		entries[i] = uint64(1024*1024+512*i) | 1<<63
+	}
+	return entries
+}
+
+var _ = Describe("Count qcow2 allocated clusters", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "qcow2")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	writeImage := func(data []byte) string {
+		fileName := filepath.Join(tmpDir, "image.qcow2")
+		Expect(ioutil.WriteFile(fileName, data, 0644)).To(Succeed())
+		return fileName
+	}
+
+	table.DescribeTable("should count", func(data []byte, limit, expected int64) {
+		count, err := CountQcow2AllocatedClusters(writeImage(data), limit)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(expected))
+	},
+		table.Entry("the clusters of all L2 tables", craftQcow2(false, allocatedEntries(64), nil, allocatedEntries(10)), int64(0), int64(74)),
+		table.Entry("compressed clusters", craftQcow2(false, []uint64{1 << 62, 1<<62 | 4096}), int64(0), int64(2)),
+		table.Entry("no zero clusters without host cluster", craftQcow2(false, []uint64{1, 0, 1 << 63}), int64(0), int64(0)),
+		table.Entry("the clusters of extended L2 tables", craftQcow2(true, allocatedEntries(32), allocatedEntries(5)), int64(0), int64(37)),
+		table.Entry("up to the L2 table exceeding the limit", craftQcow2(false, allocatedEntries(64), allocatedEntries(64), allocatedEntries(64)), int64(100), int64(128)),
+		table.Entry("no clusters in raw images", make([]byte, 4096), int64(0), int64(0)),
+		table.Entry("no clusters in tiny files", []byte("tiny"), int64(0), int64(0)),
+	)
+
+	It("should count the clusters implied by a crafted L1 table referencing the same full L2 table", func() {
+		// Every L1 entry points to the same L2 table, so a small file claims a huge number of clusters.
+		data := craftQcow2(false, allocatedEntries(64))
+		l1Entries := 512 / 8
+		binary.BigEndian.PutUint32(data[36:], uint32(l1Entries))
+		for i := 0; i < l1Entries; i++ {
+			binary.BigEndian.PutUint64(data[512+8*i:], 1024|1<<63)
+		}
+		count, err := CountQcow2AllocatedClusters(writeImage(data), 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(int64(64 * l1Entries)))
+	})
+
+	table.DescribeTable("should fail", func(modify func([]byte) []byte, expectedErr string) {
+		_, err := CountQcow2AllocatedClusters(writeImage(modify(craftQcow2(false, allocatedEntries(8)))), 0)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(expectedErr))
+	},
+		table.Entry("with invalid cluster bits", func(data []byte) []byte {
+			binary.BigEndian.PutUint32(data[20:], 30)
+			return data
+		}, "invalid qcow2 cluster bits 30"),
+		table.Entry("with an oversized L1 table", func(data []byte) []byte {
+			binary.BigEndian.PutUint32(data[36:], 1<<30)
+			return data
+		}, "L1 table of"),
+		table.Entry("with a truncated L1 table", func(data []byte) []byte {
+			binary.BigEndian.PutUint32(data[36:], 1024)
+			return data
+		}, "unable to read the qcow2 L1 table"),
+		table.Entry("with an L2 table beyond the end of the file", func(data []byte) []byte {
+			binary.BigEndian.PutUint64(data[512:], 1<<20|1<<63)
+			return data
+		}, "unable to read a qcow2 L2 table"),
+	)
+
+	It("should fail on a missing file", func() {
+		_, err := CountQcow2AllocatedClusters(filepath.Join(tmpDir, "missing"), 0)
+		Expect(err).To(HaveOccurred())
+	})
+})
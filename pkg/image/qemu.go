@@ -22,6 +22,7 @@ import (
 	"io/ioutil"
 	"net/url"
 	"os"
+	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
@@ -44,6 +45,16 @@ const (
 	matcherString      = "\\((\\d?\\d\\.\\d\\d)\\/100%\\)"
 )
 
+// qemu-img check exit codes
+const (
+	checkExitCorrupt     = 2
+	checkExitLeaks       = 3
+	checkExitUnsupported = 63
+)
+
+// canonicalQcow2Options are the qcow2 creation options of normalized images
+const canonicalQcow2Options = "compat=1.1,cluster_size=65536,refcount_bits=16,lazy_refcounts=off,preallocation=off"
+
 // ImgInfo contains the virtual image information.
 type ImgInfo struct {
 	// Format contains the format of the image
@@ -54,18 +65,40 @@ type ImgInfo struct {
 	VirtualSize int64 `json:"virtual-size"`
 	// ActualSize is the size of the qcow2 image
 	ActualSize int64 `json:"actual-size"`
+	// Snapshots are the internal snapshots of the image
+	Snapshots []ImgSnapshot `json:"snapshots,omitempty"`
+}
+
+// ImgSnapshot describes an internal snapshot of an image, as reported by qemu-img info
+type ImgSnapshot struct {
+	// ID is the id of the snapshot
+	ID string `json:"id"`
+	// Name is the name of the snapshot
+	Name string `json:"name"`
 }
 
 // QEMUOperations defines the interface for executing qemu subprocesses
 type QEMUOperations interface {
-	ConvertToRawStream(*url.URL, string, bool) error
+	ConvertToRawStream(*url.URL, string, bool, util.FlushPolicy) error
+	ConvertToFormatStream(*url.URL, string, string, bool, util.FlushPolicy) error
 	Resize(string, resource.Quantity, bool) error
+	ResizeFormat(string, string, resource.Quantity, bool) error
 	Info(url *url.URL) (*ImgInfo, error)
 	Validate(*url.URL, int64, float64) error
 	CreateBlankImage(string, resource.Quantity, bool) error
+	Check(url *url.URL) error
+	Normalize(url *url.URL, dest string) error
+	ConvertToNbd(url *url.URL, target *url.URL) error
+	CreateOverlay(backingFile, backingFormat, dest string, size *resource.Quantity) error
+	ConvertSegmentToRaw(source, format, dest string, offset, length int64, policy util.FlushPolicy) error
 }
 
-type qemuOperations struct{}
+type qemuOperations struct {
+	// binary is the qemu-img binary run
+	binary string
+	// convertFlags are the extra flags of the conversions to raw images
+	convertFlags []string
+}
 
 var (
 	qemuExecFunction = system.ExecWithLimits
@@ -107,22 +140,90 @@ func init() {
 
 // NewQEMUOperations returns the default implementation of QEMUOperations
 func NewQEMUOperations() QEMUOperations {
-	return &qemuOperations{}
+	return &qemuOperations{binary: defaultQemuImgBinary}
+}
+
+// convertCacheMode returns the qemu-img cache mode of the target matching the flush policy. qemu-img flushes the
+// target at the end of the conversion in all modes.
+func convertCacheMode(policy util.FlushPolicy) string {
+	switch policy.Mode {
+	case util.FlushPerWrite:
+		return "directsync"
+	case util.FlushFinalOnly:
+		return "writeback"
+	}
+	return "none"
+}
+
+// nbdTLSCredsID is the id of the qemu-img TLS credentials object of NBD sources served over TLS.
+const nbdTLSCredsID = "nbdtls0"
+
+// isValidSourceScheme returns true if qemu-img can read the image from a url with the passed in scheme. A url
+// without scheme is a file.
+func isValidSourceScheme(scheme string) bool {
+	switch scheme {
+	case "", "nbd", "nbd+tcp", "nbd+unix", "nbds", "nbds+unix":
+		return true
+	}
+	return false
 }
 
-func convertToRaw(src, dest string, preallocate bool) error {
-	args := []string{"convert", "-t", "none", "-p", "-O", "raw", src, dest}
+// imageArgs returns the qemu-img arguments opening the image at url. qemu-img doesn't parse the nbds and
+// nbds+unix URIs of NBD exports served over TLS, they are opened with a json: filename and TLS credentials loaded
+// from the directory in the tls-certificates query parameter.
+func imageArgs(url *url.URL) ([]string, error) {
+	if !isValidSourceScheme(url.Scheme) {
+		return nil, fmt.Errorf("Not valid schema %s", url.Scheme)
+	}
+	if url.Scheme != "nbds" && url.Scheme != "nbds+unix" {
+		return []string{url.String()}, nil
+	}
+	server := map[string]string{}
+	if url.Scheme == "nbds+unix" {
+		server["type"] = "unix"
+		server["path"] = url.Query().Get("socket")
+	} else {
+		server["type"] = "inet"
+		server["host"] = url.Hostname()
+		server["port"] = url.Port()
+		if server["port"] == "" {
+			server["port"] = "10809"
+		}
+	}
+	spec, err := json.Marshal(map[string]interface{}{
+		"file": map[string]interface{}{
+			"driver":    "nbd",
+			"server":    server,
+			"export":    strings.TrimPrefix(url.Path, "/"),
+			"tls-creds": nbdTLSCredsID,
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to marshal NBD source")
+	}
+	creds := "tls-creds-x509,id=" + nbdTLSCredsID + ",endpoint=client"
+	if dir := url.Query().Get("tls-certificates"); dir != "" {
+		// Commas are escaped by doubling them in qemu options.
+		creds += ",dir=" + strings.ReplaceAll(dir, ",", ",,")
+	}
+	return []string{"--object", creds, "json:" + string(spec)}, nil
+}
+
+// convertToFormat converts the image opened with the src arguments to an image of format in dest.
+func (o *qemuOperations) convertToFormat(src []string, dest, format string, preallocate bool, policy util.FlushPolicy) error {
+	args := append(o.withConvertFlags("convert", "-t", convertCacheMode(policy), "-p", "-O", format), src...)
+	args = append(args, dest)
 	var err error
 	if preallocate {
 		err = addPreallocation(args, convertPreallocationMethods, func(args []string) ([]byte, error) {
-			return qemuExecFunction(nil, reportProgress, "qemu-img", args...)
+			return qemuExecFunction(nil, reportProgress, o.binary, args...)
 		})
 	} else {
-		_, err = qemuExecFunction(nil, reportProgress, "qemu-img", args...)
+		_, err = qemuExecFunction(nil, reportProgress, o.binary, args...)
 	}
 	if err != nil {
 		os.Remove(dest)
-		errorMsg := "could not convert image to raw"
+		errorMsg := "could not convert image to " + format
 		if nbdkitLog, err := ioutil.ReadFile(common.NbdkitLogPath); err == nil {
 			errorMsg += " " + string(nbdkitLog)
 		}
@@ -132,11 +233,66 @@ func convertToRaw(src, dest string, preallocate bool) error {
 	return nil
 }
 
-func (o *qemuOperations) ConvertToRawStream(url *url.URL, dest string, preallocate bool) error {
-	if len(url.Scheme) > 0 && url.Scheme != "nbd+unix" {
-		return fmt.Errorf("Not valid schema %s", url.Scheme)
+func (o *qemuOperations) ConvertToRawStream(url *url.URL, dest string, preallocate bool, policy util.FlushPolicy) error {
+	return o.ConvertToFormatStream(url, dest, "raw", preallocate, policy)
+}
+
+func (o *qemuOperations) ConvertToFormatStream(url *url.URL, dest, format string, preallocate bool, policy util.FlushPolicy) error {
+	src, err := imageArgs(url)
+	if err != nil {
+		return err
+	}
+	return o.convertToFormat(src, dest, format, preallocate, policy)
+}
+
+// ConvertToNbd converts the image from the url to raw format into an existing NBD export, for instance one served by
+// qemu-nbd
+func ConvertToNbd(url *url.URL, target *url.URL) error {
+	return qemuIterface.ConvertToNbd(url, target)
+}
+
+func (o *qemuOperations) ConvertToNbd(url *url.URL, target *url.URL) error {
+	src, err := imageArgs(url)
+	if err != nil {
+		return err
+	}
+	// The export already exists, don't create it. qemu-img flushes the export and disconnects before exiting, the
+	// NBD server owns the export and its lifetime.
+	args := append(append(o.withConvertFlags("convert", "-p", "-n", "-O", "raw"), src...), target.String())
+	if _, err := qemuExecFunction(nil, reportProgress, o.binary, args...); err != nil {
+		return errors.Wrapf(err, "could not convert image to NBD target %s", target)
+	}
+	return nil
+}
+
+// ConvertSegmentToRaw converts length bytes at offset of the virtual disk of the local image source of the passed in
+// format into the same range of the existing raw image or block device dest, leaving the rest of dest untouched. The
+// cache mode of dest follows the flush policy.
+func ConvertSegmentToRaw(source, format, dest string, offset, length int64, policy util.FlushPolicy) error {
+	return qemuIterface.ConvertSegmentToRaw(source, format, dest, offset, length, policy)
+}
+
+func (o *qemuOperations) ConvertSegmentToRaw(source, format, dest string, offset, length int64, policy util.FlushPolicy) error {
+	// A raw node on top of the source and of the target restricts both to the segment.
+	sourceOpts := fmt.Sprintf("driver=raw,offset=%d,size=%d,file.driver=file,file.filename=%s", offset, length, escapeQemuOption(source))
+	if format != "raw" {
+		sourceOpts = fmt.Sprintf("driver=raw,offset=%d,size=%d,file.driver=%s,file.file.driver=file,file.file.filename=%s", offset, length, format, escapeQemuOption(source))
+	}
+	destDriver := "file"
+	if info, err := os.Stat(dest); err == nil && info.Mode()&os.ModeDevice != 0 {
+		destDriver = "host_device"
 	}
-	return convertToRaw(url.String(), dest, preallocate)
+	destOpts := fmt.Sprintf("driver=raw,offset=%d,size=%d,file.driver=%s,file.filename=%s", offset, length, destDriver, escapeQemuOption(dest))
+	args := append(o.withConvertFlags("convert", "-t", convertCacheMode(policy), "-n"), "--image-opts", sourceOpts, "--target-image-opts", destOpts)
+	if output, err := qemuExecFunction(nil, nil, o.binary, args...); err != nil {
+		return errors.Wrapf(err, "could not convert segment %d+%d of %s: %s", offset, length, source, output)
+	}
+	return nil
+}
+
+// escapeQemuOption escapes the commas of a qemu option value by doubling them.
+func escapeQemuOption(value string) string {
+	return strings.ReplaceAll(value, ",", ",,")
 }
 
 // convertQuantityToQemuSize translates a quantity string into a Qemu compatible string.
@@ -155,14 +311,23 @@ func Resize(image string, size resource.Quantity, preallocate bool) error {
 }
 
 func (o *qemuOperations) Resize(image string, size resource.Quantity, preallocate bool) error {
+	return o.ResizeFormat(image, "raw", size, preallocate)
+}
+
+// ResizeFormat resizes the given image of format to size
+func ResizeFormat(image, format string, size resource.Quantity, preallocate bool) error {
+	return qemuIterface.ResizeFormat(image, format, size, preallocate)
+}
+
+func (o *qemuOperations) ResizeFormat(image, format string, size resource.Quantity, preallocate bool) error {
 	var err error
-	args := []string{"resize", "-f", "raw", image, convertQuantityToQemuSize(size)}
+	args := []string{"resize", "-f", format, image, convertQuantityToQemuSize(size)}
 	if preallocate {
 		err = addPreallocation(args, resizePreallocationMethods, func(args []string) ([]byte, error) {
-			return qemuExecFunction(nil, nil, "qemu-img", args...)
+			return qemuExecFunction(nil, nil, o.binary, args...)
 		})
 	} else {
-		_, err = qemuExecFunction(nil, nil, "qemu-img", args...)
+		_, err = qemuExecFunction(nil, nil, o.binary, args...)
 	}
 	if err != nil {
 		return errors.Wrapf(err, "Error resizing image %s", image)
@@ -187,10 +352,11 @@ func Info(url *url.URL) (*ImgInfo, error) {
 }
 
 func (o *qemuOperations) Info(url *url.URL) (*ImgInfo, error) {
-	if len(url.Scheme) > 0 && url.Scheme != "nbd+unix" {
-		return nil, fmt.Errorf("Not valid schema %s", url.Scheme)
+	src, err := imageArgs(url)
+	if err != nil {
+		return nil, err
 	}
-	output, err := qemuExecFunction(qemuInfoLimits, nil, "qemu-img", "info", "--output=json", url.String())
+	output, err := qemuExecFunction(qemuInfoLimits, nil, o.binary, append([]string{"info", "--output=json"}, src...)...)
 	if err != nil {
 		errorMsg := fmt.Sprintf("%s, %s", output, err.Error())
 		if nbdkitLog, err := ioutil.ReadFile(common.NbdkitLogPath); err == nil {
@@ -233,9 +399,67 @@ func (o *qemuOperations) Validate(url *url.URL, availableSize int64, filesystemO
 	return checkIfURLIsValid(info, availableSize, filesystemOverhead, url.String())
 }
 
-// ConvertToRawStream converts an http accessible image to raw format without locally caching the image
-func ConvertToRawStream(url *url.URL, dest string, preallocate bool) error {
-	return qemuIterface.ConvertToRawStream(url, dest, preallocate)
+// Check verifies the structural integrity of the image from the url with a read only qemu-img check
+func Check(url *url.URL) error {
+	return qemuIterface.Check(url)
+}
+
+func (o *qemuOperations) Check(url *url.URL) error {
+	src, err := imageArgs(url)
+	if err != nil {
+		return err
+	}
+	output, err := qemuExecFunction(nil, nil, o.binary, append([]string{"check"}, src...)...)
+	if err == nil {
+		return nil
+	}
+	if exitErr, ok := errors.Cause(err).(*exec.ExitError); ok {
+		switch exitErr.ExitCode() {
+		case checkExitLeaks:
+			// Leaked clusters waste space, but don't affect the image data.
+			klog.Warningf("qemu-img check found leaked clusters in %s: %s", url, output)
+			return nil
+		case checkExitUnsupported:
+			klog.V(1).Infof("The format of %s doesn't support qemu-img check", url)
+			return nil
+		case checkExitCorrupt:
+			return errors.Errorf("Image %s is corrupt: %s", url, output)
+		}
+	}
+	return errors.Wrapf(err, "qemu-img check of %s failed: %s", url, output)
+}
+
+// Normalize converts the qcow2 image from the url to a canonical qcow2 image in dest, so images with identical
+// data normalize to identical files
+func Normalize(url *url.URL, dest string) error {
+	return qemuIterface.Normalize(url, dest)
+}
+
+func (o *qemuOperations) Normalize(url *url.URL, dest string) error {
+	// Converting drops internal snapshots and compression, and flattens backing chains. The fixed options make
+	// the layout independent of the options the source was created with.
+	src, err := imageArgs(url)
+	if err != nil {
+		return err
+	}
+	args := append(append([]string{"convert", "-f", "qcow2", "-O", "qcow2", "-o", canonicalQcow2Options}, src...), dest)
+	if output, err := qemuExecFunction(nil, nil, o.binary, args...); err != nil {
+		os.Remove(dest)
+		return errors.Wrapf(err, "could not normalize image: %s", output)
+	}
+	return nil
+}
+
+// ConvertToRawStream converts an http accessible image to raw format without locally caching the image. The cache
+// mode of dest follows the flush policy.
+func ConvertToRawStream(url *url.URL, dest string, preallocate bool, policy util.FlushPolicy) error {
+	return qemuIterface.ConvertToRawStream(url, dest, preallocate, policy)
+}
+
+// ConvertToFormatStream converts an http accessible image to an image of format, one of the formats accepted by
+// ParseTargetFormat, without locally caching the image. The cache mode of dest follows the flush policy.
+func ConvertToFormatStream(url *url.URL, dest, format string, preallocate bool, policy util.FlushPolicy) error {
+	return qemuIterface.ConvertToFormatStream(url, dest, format, preallocate, policy)
 }
 
 // Validate does basic validation of a qemu image
@@ -272,7 +496,7 @@ func (o *qemuOperations) CreateBlankImage(dest string, size resource.Quantity, p
 		klog.V(1).Infof("Added preallocation")
 		args = append(args, []string{"-o", "preallocation=falloc"}...)
 	}
-	_, err := qemuExecFunction(nil, nil, "qemu-img", args...)
+	_, err := qemuExecFunction(nil, nil, o.binary, args...)
 	if err != nil {
 		os.Remove(dest)
 		return errors.Wrap(err, fmt.Sprintf("could not create raw image with size %s in %s", size.String(), dest))
@@ -286,6 +510,25 @@ func (o *qemuOperations) CreateBlankImage(dest string, size resource.Quantity, p
 	return nil
 }
 
+// CreateOverlay creates a qcow2 image in dest backed by the image backingFile of format backingFormat, so the image
+// only stores what is written on top of the backing file. A relative backingFile is resolved from the directory of
+// dest, which keeps the overlay valid wherever the directory is mounted. A nil size keeps the size of the backing file.
+func CreateOverlay(backingFile, backingFormat, dest string, size *resource.Quantity) error {
+	return qemuIterface.CreateOverlay(backingFile, backingFormat, dest, size)
+}
+
+func (o *qemuOperations) CreateOverlay(backingFile, backingFormat, dest string, size *resource.Quantity) error {
+	args := []string{"create", "-f", "qcow2", "-b", backingFile, "-F", backingFormat, dest}
+	if size != nil {
+		args = append(args, convertQuantityToQemuSize(*size))
+	}
+	if output, err := qemuExecFunction(nil, nil, o.binary, args...); err != nil {
+		os.Remove(dest)
+		return errors.Wrapf(err, "could not create overlay %s of %s: %s", dest, backingFile, output)
+	}
+	return nil
+}
+
 // PreallocateBlankBlock writes requested amount of zeros to block device mounted at dest
 func PreallocateBlankBlock(dest string, size resource.Quantity) error {
 	klog.V(3).Infof("block volume size is %s", size.String())
@@ -16,8 +16,13 @@ limitations under the License.
 package image
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
 	"strings"
 
@@ -32,6 +37,7 @@ import (
 	dto "github.com/prometheus/client_model/go"
 
 	"kubevirt.io/containerized-data-importer/pkg/system"
+	"kubevirt.io/containerized-data-importer/pkg/util"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -125,19 +131,42 @@ func init() {
 	ownerUID = "1111-1111-111"
 }
 
+const snapshotsInfoJSON = `
+{
+    "snapshots": [
+        {
+            "icount": 0,
+            "vm-clock-nsec": 0,
+            "name": "base",
+            "date-sec": 1609459200,
+            "date-nsec": 0,
+            "vm-clock-sec": 0,
+            "id": "1",
+            "vm-state-size": 0
+        }
+    ],
+    "virtual-size": 1048576,
+    "filename": "snapshot.qcow2",
+    "cluster-size": 65536,
+    "format": "qcow2",
+    "actual-size": 24576,
+    "dirty-flag": false
+}
+`
+
 var expectedLimits = &system.ProcessLimitValues{AddressSpaceLimit: 1 << 30, CPUTimeLimit: 30}
 
 var _ = Describe("Convert to Raw", func() {
 	It("should return no error if exec function returns no error", func() {
 		replaceExecFunction(mockExecFunction("", "", nil, "convert", "-p", "-O", "raw", "source", "dest"), func() {
-			err := convertToRaw("source", "dest", false)
+			err := NewQEMUOperations().(*qemuOperations).convertToFormat([]string{"source"}, "dest", "raw", false, util.DefaultFlushPolicy)
 			Expect(err).NotTo(HaveOccurred())
 		})
 	})
 
 	It("should return conversion error if exec function returns error", func() {
 		replaceExecFunction(mockExecFunction("", "exit 1", nil, "convert", "-p", "-O", "raw", "source", "dest"), func() {
-			err := convertToRaw("source", "dest", false)
+			err := NewQEMUOperations().(*qemuOperations).convertToFormat([]string{"source"}, "dest", "raw", false, util.DefaultFlushPolicy)
 			Expect(err).To(HaveOccurred())
 			Expect(strings.Contains(err.Error(), "could not convert image to raw")).To(BeTrue())
 		})
@@ -147,7 +176,7 @@ var _ = Describe("Convert to Raw", func() {
 		replaceExecFunction(mockExecFunction("", "", nil, "convert", "-p", "-O", "raw", "/somefile/somewhere", "dest"), func() {
 			ep, err := url.Parse("/somefile/somewhere")
 			Expect(err).NotTo(HaveOccurred())
-			err = ConvertToRawStream(ep, "dest", false)
+			err = ConvertToRawStream(ep, "dest", false, util.DefaultFlushPolicy)
 			Expect(err).NotTo(HaveOccurred())
 		})
 	})
@@ -156,7 +185,7 @@ var _ = Describe("Convert to Raw", func() {
 		replaceExecFunction(mockExecFunctionStrict("", "", nil, "convert", "-o", "preallocation=falloc", "-t", "none", "-p", "-O", "raw", "/somefile/somewhere", "dest"), func() {
 			ep, err := url.Parse("/somefile/somewhere")
 			Expect(err).NotTo(HaveOccurred())
-			err = ConvertToRawStream(ep, "dest", true)
+			err = ConvertToRawStream(ep, "dest", true, util.DefaultFlushPolicy)
 			Expect(err).NotTo(HaveOccurred())
 		})
 	})
@@ -165,10 +194,263 @@ var _ = Describe("Convert to Raw", func() {
 		replaceExecFunction(mockExecFunctionStrict("", "", nil, "convert", "-t", "none", "-p", "-O", "raw", "/somefile/somewhere", "dest"), func() {
 			ep, err := url.Parse("/somefile/somewhere")
 			Expect(err).NotTo(HaveOccurred())
-			err = ConvertToRawStream(ep, "dest", false)
+			err = ConvertToRawStream(ep, "dest", false, util.DefaultFlushPolicy)
 			Expect(err).NotTo(HaveOccurred())
 		})
 	})
+
+	table.DescribeTable("should use the target cache mode of the flush policy", func(policy util.FlushPolicy, cacheMode string) {
+		replaceExecFunction(mockExecFunctionStrict("", "", nil, "convert", "-t", cacheMode, "-p", "-O", "raw", "/somefile/somewhere", "dest"), func() {
+			ep, err := url.Parse("/somefile/somewhere")
+			Expect(err).NotTo(HaveOccurred())
+			err = ConvertToRawStream(ep, "dest", false, policy)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	},
+		table.Entry("per-write", util.FlushPolicy{Mode: util.FlushPerWrite}, "directsync"),
+		table.Entry("periodic", util.DefaultFlushPolicy, "none"),
+		table.Entry("final-only", util.FlushPolicy{Mode: util.FlushFinalOnly}, "writeback"),
+	)
+})
+
+var _ = Describe("Check", func() {
+	// exitError returns the error ExecWithLimits returns for a process exiting with code.
+	exitError := func(code int) error {
+		err := exec.Command("sh", "-c", fmt.Sprintf("exit %d", code)).Run()
+		Expect(err).To(HaveOccurred())
+		return errors.Wrapf(err, "qemu-img execution failed")
+	}
+
+	table.DescribeTable("should", func(exitCode int, output, expectedErr string) {
+		var execErr error
+		if exitCode != 0 {
+			execErr = exitError(exitCode)
+		}
+		mockExec := func(limits *system.ProcessLimitValues, f func(string), cmd string, args ...string) ([]byte, error) {
+			Expect(args).To(Equal([]string{"check", "/scratch/tmpimage"}))
+			return []byte(output), execErr
+		}
+		replaceExecFunction(mockExec, func() {
+			ep, err := url.Parse("/scratch/tmpimage")
+			Expect(err).NotTo(HaveOccurred())
+			err = Check(ep)
+			if expectedErr == "" {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(expectedErr))
+			}
+		})
+	},
+		table.Entry("succeed on an intact image", 0, "No errors were found on the image.", ""),
+		table.Entry("succeed on an image with leaked clusters", checkExitLeaks, "Leaked cluster 5 refcount=1 reference=0", ""),
+		table.Entry("succeed on a format without checks", checkExitUnsupported, "qemu-img: This image format does not support checks", ""),
+		table.Entry("fail on a corrupt image with the check output", checkExitCorrupt, "ERROR cluster 5 refcount=0 reference=1", "is corrupt: ERROR cluster 5 refcount=0 reference=1"),
+		table.Entry("fail if the check couldn't complete", 1, "qemu-img: Could not open image", "Could not open image"),
+	)
+
+	It("should reject a qcow2 image with a corrupt L1 table", func() {
+		if _, err := exec.LookPath("qemu-img"); err != nil {
+			Skip("qemu-img is not available")
+		}
+		tmpDir, err := ioutil.TempDir("", "check")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+		// A 1MiB qcow2 v3 image, with an L1 table offset that is not cluster aligned.
+		header := make([]byte, 64*1024)
+		copy(header, []byte{'Q', 'F', 'I', 0xfb})
+		binary.BigEndian.PutUint32(header[4:], 3)
+		binary.BigEndian.PutUint32(header[20:], 16)
+		binary.BigEndian.PutUint64(header[24:], 1024*1024)
+		binary.BigEndian.PutUint32(header[36:], 1)
+		binary.BigEndian.PutUint64(header[40:], 0x10001)
+		binary.BigEndian.PutUint64(header[48:], 0x20000)
+		binary.BigEndian.PutUint32(header[56:], 1)
+		binary.BigEndian.PutUint32(header[96:], 4)
+		binary.BigEndian.PutUint32(header[100:], 104)
+		fileName := filepath.Join(tmpDir, "corrupt.qcow2")
+		Expect(ioutil.WriteFile(fileName, header, 0644)).To(Succeed())
+		ep, err := url.Parse(fileName)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(Check(ep)).NotTo(Succeed())
+	})
+})
+
+var _ = Describe("Convert segment", func() {
+	It("should restrict a raw source and the target to the segment", func() {
+		replaceExecFunction(mockExecFunctionStrict("", "", nil, "convert", "-t", "none", "-n",
+			"--image-opts", "driver=raw,offset=4096,size=1024,file.driver=file,file.filename=/scratch/tmp,,image",
+			"--target-image-opts", "driver=raw,offset=4096,size=1024,file.driver=file,file.filename=/data/disk.img"), func() {
+			Expect(ConvertSegmentToRaw("/scratch/tmp,image", "raw", "/data/disk.img", 4096, 1024, util.DefaultFlushPolicy)).To(Succeed())
+		})
+	})
+
+	It("should read the virtual disk of a qcow2 source", func() {
+		replaceExecFunction(mockExecFunctionStrict("", "", nil, "convert", "-t", "none", "-n",
+			"--image-opts", "driver=raw,offset=0,size=1024,file.driver=qcow2,file.file.driver=file,file.file.filename=/scratch/tmpimage",
+			"--target-image-opts", "driver=raw,offset=0,size=1024,file.driver=file,file.filename=/data/disk.img"), func() {
+			Expect(ConvertSegmentToRaw("/scratch/tmpimage", "qcow2", "/data/disk.img", 0, 1024, util.DefaultFlushPolicy)).To(Succeed())
+		})
+	})
+
+	It("should fail if qemu-img convert fails", func() {
+		replaceExecFunction(mockExecFunction("", "exit 1", nil), func() {
+			err := ConvertSegmentToRaw("/scratch/tmpimage", "qcow2", "/data/disk.img", 0, 1024, util.DefaultFlushPolicy)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("could not convert segment 0+1024"))
+		})
+	})
+})
+
+var _ = Describe("Convert to NBD", func() {
+	It("should convert into the existing NBD export", func() {
+		replaceExecFunction(mockExecFunctionStrict("", "", nil, "convert", "-p", "-n", "-O", "raw", "/scratch/tmpimage", "nbd+unix:///disk?socket=/nbd.sock"), func() {
+			ep, err := url.Parse("/scratch/tmpimage")
+			Expect(err).NotTo(HaveOccurred())
+			target, err := url.Parse("nbd+unix:///disk?socket=/nbd.sock")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ConvertToNbd(ep, target)).To(Succeed())
+		})
+	})
+
+	It("should fail if qemu-img convert fails", func() {
+		replaceExecFunction(mockExecFunction("", "exit 1", nil), func() {
+			ep, err := url.Parse("/scratch/tmpimage")
+			Expect(err).NotTo(HaveOccurred())
+			target, err := url.Parse("nbd://nbd-server:10809/disk")
+			Expect(err).NotTo(HaveOccurred())
+			err = ConvertToNbd(ep, target)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("could not convert image to NBD target nbd://nbd-server:10809/disk"))
+		})
+	})
+})
+
+var _ = Describe("NBD sources", func() {
+	table.DescribeTable("should open the image", func(source string, expectedArgs []string) {
+		replaceExecFunction(mockExecFunctionStrict(goodValidateJSON, "", expectedLimits, append([]string{"info", "--output=json"}, expectedArgs...)...), func() {
+			ep, err := url.Parse(source)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = Info(ep)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	},
+		table.Entry("from an NBD URI", "nbd://nbd-server:10809/disk", []string{"nbd://nbd-server:10809/disk"}),
+		table.Entry("from an NBD URI of a Unix socket", "nbd+unix:///disk?socket=/nbd.sock", []string{"nbd+unix:///disk?socket=/nbd.sock"}),
+		table.Entry("with TLS credentials over TCP", "nbds://nbd-server/disk?tls-certificates=/certs", []string{
+			"--object", "tls-creds-x509,id=nbdtls0,endpoint=client,dir=/certs",
+			`json:{"file":{"driver":"nbd","export":"disk","server":{"host":"nbd-server","port":"10809","type":"inet"},"tls-creds":"nbdtls0"}}`,
+		}),
+		table.Entry("with TLS credentials over a Unix socket", "nbds+unix:///disk?socket=/nbd.sock&tls-certificates=/certs,1", []string{
+			"--object", "tls-creds-x509,id=nbdtls0,endpoint=client,dir=/certs,,1",
+			`json:{"file":{"driver":"nbd","export":"disk","server":{"path":"/nbd.sock","type":"unix"},"tls-creds":"nbdtls0"}}`,
+		}),
+	)
+
+	It("should reject sources qemu-img doesn't read", func() {
+		ep, err := url.Parse("http://example.com/disk")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = Info(ep)
+		Expect(err).To(MatchError("Not valid schema http"))
+	})
+})
+
+var _ = Describe("Normalize", func() {
+	It("should convert to qcow2 with the canonical options", func() {
+		replaceExecFunction(mockExecFunctionStrict("", "", nil, "convert", "-f", "qcow2", "-O", "qcow2", "-o", canonicalQcow2Options, "/scratch/tmpimage", "/scratch/normalized.qcow2"), func() {
+			ep, err := url.Parse("/scratch/tmpimage")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(Normalize(ep, "/scratch/normalized.qcow2")).To(Succeed())
+		})
+	})
+
+	It("should fail if qemu-img convert fails", func() {
+		replaceExecFunction(mockExecFunction("", "exit 1", nil), func() {
+			ep, err := url.Parse("/scratch/tmpimage")
+			Expect(err).NotTo(HaveOccurred())
+			err = Normalize(ep, "/scratch/normalized.qcow2")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("could not normalize image"))
+		})
+	})
+
+	It("should normalize qcow2 images with identical data to identical files", func() {
+		if _, err := exec.LookPath("qemu-img"); err != nil {
+			Skip("qemu-img is not available")
+		}
+		tmpDir, err := ioutil.TempDir("", "normalize")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+		raw := filepath.Join(tmpDir, "disk.raw")
+		data := make([]byte, 4*1024*1024)
+		for i := range data[:1024*1024] {
+			data[i] = byte(i % 251)
+		}
+		Expect(ioutil.WriteFile(raw, data, 0644)).To(Succeed())
+		// The same data, with different cluster sizes, versions and compression.
+		sources := [][]string{
+			{"-o", "compat=0.10,cluster_size=4096"},
+			{"-c", "-o", "compat=1.1,cluster_size=2097152"},
+		}
+		var normalized [][]byte
+		for i, options := range sources {
+			source := filepath.Join(tmpDir, fmt.Sprintf("source%d.qcow2", i))
+			args := append([]string{"convert", "-f", "raw", "-O", "qcow2"}, options...)
+			output, err := exec.Command("qemu-img", append(args, raw, source)...).CombinedOutput()
+			Expect(err).NotTo(HaveOccurred(), string(output))
+			ep, err := url.Parse(source)
+			Expect(err).NotTo(HaveOccurred())
+			dest := filepath.Join(tmpDir, fmt.Sprintf("normalized%d.qcow2", i))
+			Expect(Normalize(ep, dest)).To(Succeed())
+			content, err := ioutil.ReadFile(dest)
+			Expect(err).NotTo(HaveOccurred())
+			normalized = append(normalized, content)
+		}
+		Expect(normalized[0]).To(Equal(normalized[1]))
+	})
+})
+
+var _ = Describe("Internal snapshots", func() {
+	It("should list the internal snapshots of the image", func() {
+		replaceExecFunction(mockExecFunction(snapshotsInfoJSON, "", expectedLimits, "info", "--output=json"), func() {
+			ep, err := url.Parse("/data/snapshot.qcow2")
+			Expect(err).NotTo(HaveOccurred())
+			info, err := Info(ep)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Snapshots).To(Equal([]ImgSnapshot{{ID: "1", Name: "base"}}))
+		})
+	})
+
+	It("should flatten the internal snapshots when converting", func() {
+		if _, err := exec.LookPath("qemu-img"); err != nil {
+			Skip("qemu-img is not available")
+		}
+		tmpDir, err := ioutil.TempDir("", "snapshots")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+		ep, err := url.Parse(filepath.Join("..", "..", "tests", "images", "snapshot.qcow2"))
+		Expect(err).NotTo(HaveOccurred())
+		info, err := Info(ep)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Snapshots).To(HaveLen(1))
+
+		normalized := filepath.Join(tmpDir, "normalized.qcow2")
+		Expect(Normalize(ep, normalized)).To(Succeed())
+		ep, err = url.Parse(normalized)
+		Expect(err).NotTo(HaveOccurred())
+		info, err = Info(ep)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Snapshots).To(BeEmpty())
+
+		raw := filepath.Join(tmpDir, "disk.img")
+		Expect(ConvertToRawStream(ep, raw, false, util.DefaultFlushPolicy)).To(Succeed())
+		ep, err = url.Parse(raw)
+		Expect(err).NotTo(HaveOccurred())
+		info, err = Info(ep)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Format).To(Equal("raw"))
+		Expect(info.Snapshots).To(BeEmpty())
+	})
 })
 
 var _ = Describe("Resize", func() {
@@ -321,6 +603,54 @@ var _ = Describe("Create blank image", func() {
 	})
 })
 
+var _ = Describe("Create overlay", func() {
+	It("should create a qcow2 image backed by the raw image", func() {
+		replaceExecFunction(mockExecFunctionStrict("", "", nil, "create", "-f", "qcow2", "-b", "base.img", "-F", "raw", "/data/disk.img"), func() {
+			Expect(CreateOverlay("base.img", "raw", "/data/disk.img", nil)).To(Succeed())
+		})
+	})
+
+	It("should create a qcow2 image backed by the qcow2 image", func() {
+		replaceExecFunction(mockExecFunctionStrict("", "", nil, "create", "-f", "qcow2", "-b", "base.img", "-F", "qcow2", "/data/disk.img"), func() {
+			Expect(CreateOverlay("base.img", "qcow2", "/data/disk.img", nil)).To(Succeed())
+		})
+	})
+
+	It("should pass the requested size", func() {
+		quantity := resource.MustParse("10Gi")
+		replaceExecFunction(mockExecFunctionStrict("", "", nil, "create", "-f", "qcow2", "-b", "base.img", "-F", "raw", "/data/disk.img", convertQuantityToQemuSize(quantity)), func() {
+			Expect(CreateOverlay("base.img", "raw", "/data/disk.img", &quantity)).To(Succeed())
+		})
+	})
+
+	It("should fail if qemu-img create fails", func() {
+		replaceExecFunction(mockExecFunction("", "exit 1", nil), func() {
+			err := CreateOverlay("base.img", "raw", "/data/disk.img", nil)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("could not create overlay /data/disk.img of base.img"))
+		})
+	})
+
+	It("should reference the backing file relative to the overlay", func() {
+		if _, err := exec.LookPath("qemu-img"); err != nil {
+			Skip("qemu-img is not available")
+		}
+		tmpDir, err := ioutil.TempDir("", "overlay")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+		Expect(ioutil.WriteFile(filepath.Join(tmpDir, "base.img"), make([]byte, 1024*1024), 0644)).To(Succeed())
+		overlay := filepath.Join(tmpDir, "disk.img")
+		Expect(CreateOverlay("base.img", "raw", overlay, nil)).To(Succeed())
+		ep, err := url.Parse(overlay)
+		Expect(err).NotTo(HaveOccurred())
+		info, err := Info(ep)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Format).To(Equal("qcow2"))
+		Expect(info.BackingFile).To(Equal("base.img"))
+		Expect(info.VirtualSize).To(Equal(int64(1024 * 1024)))
+	})
+})
+
 var _ = Describe("Try different preallocation modes", func() {
 	It("Should try falloc first", func() {
 		calledCount := 0
@@ -0,0 +1,157 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// defaultQemuImgBinary is the qemu-img binary looked up in PATH.
+	defaultQemuImgBinary = "qemu-img"
+	// DefaultTargetFormat is the format of the images converted for the target if none is set.
+	DefaultTargetFormat = "raw"
+)
+
+var (
+	// supportedTargetFormats are the formats the images can be converted to for the target.
+	supportedTargetFormats = []string{"raw", "qcow2"}
+
+	cacheModePattern = regexp.MustCompile(`^(none|writeback|writethrough|directsync|unsafe)$`)
+	// allowedConvertFlags are the qemu-img convert flags accepted as extra flags, with the pattern of their value, nil
+	// for the flags without value. The flags changing the source, the target or their formats aren't accepted.
+	allowedConvertFlags = map[string]*regexp.Regexp{
+		// cache mode of the target
+		"-t": cacheModePattern,
+		// cache mode of the source
+		"-T": cacheModePattern,
+		// number of parallel coroutines
+		"-m": regexp.MustCompile(`^([1-9]|1[0-6])$`),
+		// rate limit in bytes per second
+		"-r": regexp.MustCompile(`^[0-9]+[kKMGT]?$`),
+		// out of order writes
+		"-W": nil,
+		// opens the source without lock
+		"-U": nil,
+		// skips the unreadable parts of the source
+		"--salvage": nil,
+	}
+)
+
+// QEMUOptions are the options of the qemu operations.
+type QEMUOptions struct {
+	// QemuImgPath is the qemu-img binary the qemu operations run, an absolute path to an executable file. qemu-img is
+	// looked up in PATH if empty.
+	QemuImgPath string
+	// ConvertFlags are the extra flags of the qemu-img convert invocations of the conversions to raw images, for
+	// instance "-t", "none". Flags override the flags set by the conversion. Only the flags of allowedConvertFlags are
+	// accepted, with a valid value.
+	ConvertFlags []string
+}
+
+// NewQEMUOperationsWithOptions returns the default implementation of QEMUOperations running qemu-img with the options.
+func NewQEMUOperationsWithOptions(options QEMUOptions) (QEMUOperations, error) {
+	binary, err := qemuImgBinary(options.QemuImgPath)
+	if err != nil {
+		return nil, err
+	}
+	flags, err := qemuImgConvertFlags(options.ConvertFlags)
+	if err != nil {
+		return nil, err
+	}
+	return &qemuOperations{binary: binary, convertFlags: flags}, nil
+}
+
+// qemuImgBinary checks the qemu-img path and returns the binary to run, qemu-img in PATH if the path is empty.
+func qemuImgBinary(path string) (string, error) {
+	if path == "" {
+		return defaultQemuImgBinary, nil
+	}
+	if !filepath.IsAbs(path) {
+		return "", errors.Errorf("qemu-img path %q is not absolute", path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid qemu-img path %q", path)
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+		return "", errors.Errorf("qemu-img path %q is not an executable file", path)
+	}
+	klog.V(1).Infof("Using qemu-img binary %s", path)
+	return path, nil
+}
+
+// ValidateConvertFlags checks that the extra qemu-img convert flags are allowed, with a valid value.
+func ValidateConvertFlags(flags []string) error {
+	_, err := qemuImgConvertFlags(flags)
+	return err
+}
+
+// qemuImgConvertFlags checks the extra qemu-img convert flags and returns them without the empty ones.
+func qemuImgConvertFlags(flags []string) ([]string, error) {
+	var accepted []string
+	for i := 0; i < len(flags); i++ {
+		flag := flags[i]
+		if flag == "" {
+			continue
+		}
+		pattern, ok := allowedConvertFlags[flag]
+		if !ok {
+			return nil, errors.Errorf("qemu-img convert flag %q is not allowed", flag)
+		}
+		accepted = append(accepted, flag)
+		if pattern == nil {
+			continue
+		}
+		if i+1 == len(flags) {
+			return nil, errors.Errorf("qemu-img convert flag %s requires a value", flag)
+		}
+		i++
+		if !pattern.MatchString(flags[i]) {
+			return nil, errors.Errorf("invalid value %q of qemu-img convert flag %s", flags[i], flag)
+		}
+		accepted = append(accepted, flags[i])
+	}
+	if len(accepted) > 0 {
+		klog.V(1).Infof("Using extra qemu-img convert flags %v", accepted)
+	}
+	return accepted, nil
+}
+
+// ParseTargetFormat checks the format the images are converted to for the target, raw or qcow2, the -O value of the
+// qemu-img convert invocations. An empty format returns DefaultTargetFormat.
+func ParseTargetFormat(format string) (string, error) {
+	if format == "" {
+		return DefaultTargetFormat, nil
+	}
+	for _, supported := range supportedTargetFormats {
+		if format == supported {
+			return format, nil
+		}
+	}
+	return "", errors.Errorf("target format %q is not one of %v", format, supportedTargetFormats)
+}
+
+// withConvertFlags returns the qemu-img convert options followed by the extra convert flags.
+func (o *qemuOperations) withConvertFlags(options ...string) []string {
+	return append(options, o.convertFlags...)
+}
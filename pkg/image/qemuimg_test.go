@@ -0,0 +1,141 @@
+package image
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"kubevirt.io/containerized-data-importer/pkg/util"
+)
+
+// fakeQemuImgScript records the arguments it is invoked with, one per line, in the argv file next to it.
+const fakeQemuImgScript = `#!/bin/sh
+for arg in "$@"; do
+	echo "$arg"
+done > "$(dirname "$0")/argv"
+`
+
+var _ = Describe("qemu-img configuration", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "qemu-img")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should run the configured qemu-img binary with the extra convert flags", func() {
+		script := filepath.Join(tmpDir, "qemu-img")
+		Expect(ioutil.WriteFile(script, []byte(fakeQemuImgScript), 0755)).To(Succeed())
+		o, err := NewQEMUOperationsWithOptions(QEMUOptions{
+			QemuImgPath:  script,
+			ConvertFlags: []string{"-t", "writeback", "-W", "-m", "8"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		source, err := url.Parse("/somefile/somewhere")
+		Expect(err).NotTo(HaveOccurred())
+		dest := filepath.Join(tmpDir, "disk.img")
+		Expect(o.ConvertToRawStream(source, dest, false, util.DefaultFlushPolicy)).To(Succeed())
+
+		argv, err := ioutil.ReadFile(filepath.Join(tmpDir, "argv"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(strings.Split(strings.TrimSpace(string(argv)), "\n")).To(Equal([]string{
+			"convert", "-t", "none", "-p", "-O", "raw", "-t", "writeback", "-W", "-m", "8", "/somefile/somewhere", dest,
+		}))
+	})
+
+	It("should add the extra convert flags to the conversions to NBD targets", func() {
+		o, err := NewQEMUOperationsWithOptions(QEMUOptions{ConvertFlags: []string{"-T", "none"}})
+		Expect(err).NotTo(HaveOccurred())
+		source, err := url.Parse("/somefile/somewhere")
+		Expect(err).NotTo(HaveOccurred())
+		target, err := url.Parse("nbd+unix:///disk?socket=/tmp/nbd.sock")
+		Expect(err).NotTo(HaveOccurred())
+		replaceExecFunction(mockExecFunctionStrict("", "", nil, "convert", "-p", "-n", "-O", "raw", "-T", "none", "/somefile/somewhere", target.String()), func() {
+			Expect(o.ConvertToNbd(source, target)).To(Succeed())
+		})
+	})
+
+	It("should look qemu-img up in PATH by default", func() {
+		Expect(NewQEMUOperations().(*qemuOperations).binary).To(Equal("qemu-img"))
+		o, err := NewQEMUOperationsWithOptions(QEMUOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(o.(*qemuOperations).binary).To(Equal("qemu-img"))
+		Expect(o.(*qemuOperations).convertFlags).To(BeEmpty())
+	})
+
+	table.DescribeTable("should reject the qemu-img path", func(path func(dir string) string, message string) {
+		notExecutable := filepath.Join(tmpDir, "not-executable")
+		Expect(ioutil.WriteFile(notExecutable, []byte(fakeQemuImgScript), 0644)).To(Succeed())
+		_, err := NewQEMUOperationsWithOptions(QEMUOptions{QemuImgPath: path(tmpDir)})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(message))
+	},
+		table.Entry("of a relative path", func(dir string) string { return "bin/qemu-img" }, "is not absolute"),
+		table.Entry("of a missing file", func(dir string) string { return filepath.Join(dir, "missing") }, "invalid qemu-img path"),
+		table.Entry("of a directory", func(dir string) string { return dir }, "is not an executable file"),
+		table.Entry("of a file that isn't executable", func(dir string) string { return filepath.Join(dir, "not-executable") }, "is not an executable file"),
+	)
+
+	table.DescribeTable("should reject the convert flags", func(flags []string, message string) {
+		_, err := NewQEMUOperationsWithOptions(QEMUOptions{ConvertFlags: flags})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(message))
+	},
+		table.Entry("with a flag that isn't allowed", []string{"-o", "preallocation=full"}, `flag "-o" is not allowed`),
+		table.Entry("with a positional argument", []string{"/etc/shadow"}, `flag "/etc/shadow" is not allowed`),
+		table.Entry("with a flag missing its value", []string{"-W", "-t"}, "flag -t requires a value"),
+		table.Entry("with an invalid cache mode", []string{"-t", "none;reboot"}, `invalid value "none;reboot"`),
+		table.Entry("with too many coroutines", []string{"-m", "32"}, `invalid value "32"`),
+		table.Entry("with an invalid rate limit", []string{"-r", "fast"}, `invalid value "fast"`),
+	)
+
+	It("should accept the allowed convert flags", func() {
+		o, err := NewQEMUOperationsWithOptions(QEMUOptions{
+			ConvertFlags: []string{"-t", "none", "-T", "writeback", "-m", "16", "-r", "100M", "-W", "-U", "--salvage", ""},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(o.(*qemuOperations).convertFlags).To(Equal([]string{"-t", "none", "-T", "writeback", "-m", "16", "-r", "100M", "-W", "-U", "--salvage"}))
+	})
+
+	table.DescribeTable("should convert to the target format", func(format string, expectedFormat string) {
+		targetFormat, err := ParseTargetFormat(format)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(targetFormat).To(Equal(expectedFormat))
+		source, err := url.Parse("/somefile/somewhere")
+		Expect(err).NotTo(HaveOccurred())
+		replaceExecFunction(mockExecFunctionStrict("", "", nil, "convert", "-t", "none", "-p", "-O", expectedFormat, "/somefile/somewhere", "dest"), func() {
+			Expect(NewQEMUOperations().ConvertToFormatStream(source, "dest", targetFormat, false, util.DefaultFlushPolicy)).To(Succeed())
+		})
+		replaceExecFunction(mockExecFunctionStrict("", "", nil, "resize", "-f", expectedFormat, "dest", "1000000000"), func() {
+			Expect(NewQEMUOperations().ResizeFormat("dest", targetFormat, resource.MustParse("1G"), false)).To(Succeed())
+		})
+	},
+		table.Entry("raw by default", "", "raw"),
+		table.Entry("raw", "raw", "raw"),
+		table.Entry("qcow2", "qcow2", "qcow2"),
+	)
+
+	table.DescribeTable("should reject the target format", func(format string) {
+		_, err := ParseTargetFormat(format)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("is not one of [raw qcow2]"))
+	},
+		table.Entry("of a format qemu-img reads only", "vmdk"),
+		table.Entry("of an unknown format", "ext4"),
+		table.Entry("with different case", "QCOW2"),
+	)
+})
@@ -0,0 +1,107 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ArchiveMemberSelection is the strategy used to pick the disk image when an archive contains several candidate files.
+type ArchiveMemberSelection string
+
+const (
+	// ArchiveMemberSelectionFirst picks the first candidate in lexical order.
+	ArchiveMemberSelectionFirst ArchiveMemberSelection = "first"
+	// ArchiveMemberSelectionLargest picks the largest candidate, ties are broken by lexical order.
+	ArchiveMemberSelectionLargest ArchiveMemberSelection = "largest"
+	// ArchiveMemberSelectionExtensionPriority picks the candidate with the highest priority extension (qcow2 > raw > img).
+	ArchiveMemberSelectionExtensionPriority ArchiveMemberSelection = "by-extension-priority"
+	// ArchiveMemberSelectionFailIfAmbiguous fails if there is more than one candidate.
+	ArchiveMemberSelectionFailIfAmbiguous ArchiveMemberSelection = "fail-if-ambiguous"
+)
+
+// ErrAmbiguousArchiveMember indicates that more than one archive member could be the disk image.
+var ErrAmbiguousArchiveMember = errors.New("archive contains more than one candidate disk image")
+
+// archiveMemberExtensionPriority lists the extensions in decreasing order of preference.
+var archiveMemberExtensionPriority = []string{".qcow2", ".raw", ".img"}
+
+// ParseArchiveMemberSelection converts the passed in string into an ArchiveMemberSelection, an empty string
+// returns the default selection.
+func ParseArchiveMemberSelection(selection string) (ArchiveMemberSelection, error) {
+	switch s := ArchiveMemberSelection(selection); s {
+	case "":
+		return ArchiveMemberSelectionFailIfAmbiguous, nil
+	case ArchiveMemberSelectionFirst, ArchiveMemberSelectionLargest, ArchiveMemberSelectionExtensionPriority, ArchiveMemberSelectionFailIfAmbiguous:
+		return s, nil
+	}
+	return "", errors.Errorf("unknown archive member selection %q", selection)
+}
+
+// selectArchiveMember picks one of the candidate files using the passed in selection strategy.
+func selectArchiveMember(candidates []os.FileInfo, selection ArchiveMemberSelection) (os.FileInfo, error) {
+	if len(candidates) == 0 {
+		return nil, errors.New("archive does not contain any candidate disk image")
+	}
+	sorted := make([]os.FileInfo, len(candidates))
+	copy(sorted, candidates)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Name() < sorted[j].Name()
+	})
+	if len(sorted) == 1 {
+		return sorted[0], nil
+	}
+	switch selection {
+	case ArchiveMemberSelectionFirst:
+		return sorted[0], nil
+	case ArchiveMemberSelectionLargest:
+		largest := sorted[0]
+		for _, candidate := range sorted[1:] {
+			if candidate.Size() > largest.Size() {
+				largest = candidate
+			}
+		}
+		return largest, nil
+	case ArchiveMemberSelectionExtensionPriority:
+		best := sorted[0]
+		for _, candidate := range sorted[1:] {
+			if extensionPriority(candidate.Name()) < extensionPriority(best.Name()) {
+				best = candidate
+			}
+		}
+		return best, nil
+	case ArchiveMemberSelectionFailIfAmbiguous, "":
+		return nil, ErrAmbiguousArchiveMember
+	}
+	return nil, errors.Errorf("unknown archive member selection %q", selection)
+}
+
+// extensionPriority returns the index of the file extension in archiveMemberExtensionPriority, lower is better.
+func extensionPriority(name string) int {
+	ext := strings.ToLower(filepath.Ext(name))
+	for i, e := range archiveMemberExtensionPriority {
+		if ext == e {
+			return i
+		}
+	}
+	return len(archiveMemberExtensionPriority)
+}
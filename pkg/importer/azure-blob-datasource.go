@@ -0,0 +1,428 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+
+	"kubevirt.io/containerized-data-importer/pkg/util"
+)
+
+const (
+	// azureBlobScheme is the scheme of az://container/blob endpoints.
+	azureBlobScheme = "az"
+	// azureBlobHostSuffix is the suffix of the blob service hosts of the storage accounts.
+	azureBlobHostSuffix = ".blob.core.windows.net"
+	// azureStorageVersion is the version of the blob service REST API.
+	azureStorageVersion = "2019-12-12"
+
+	// AzureBlockBlob is the type of block blobs.
+	AzureBlockBlob = "BlockBlob"
+	// AzurePageBlob is the type of page blobs, like the VHDs of Azure disks.
+	AzurePageBlob = "PageBlob"
+)
+
+// AzureBlobClient is the interface to the used Azure Blob Storage client.
+type AzureBlobClient interface {
+	// GetBlob gets the content of the blob from offset, of the version etag if not empty.
+	GetBlob(container, blob string, offset int64, etag string) (*AzureBlob, error)
+}
+
+// AzureBlob is the content of a blob.
+type AzureBlob struct {
+	Body io.ReadCloser
+	// BlobType is the type of the blob, BlockBlob or PageBlob.
+	BlobType string
+	// ContentLength is the length of the content from the requested offset, -1 if unknown.
+	ContentLength int64
+	ETag          string
+}
+
+// may be overridden in tests
+var newAzureBlobClientFunc = getAzureBlobClient
+
+// AzureBlobDataSource is the struct containing the information needed to import from an Azure Blob Storage blob.
+// Sequence of phases:
+// 1a. Info -> TransferScratch, if the image needs to be converted.
+// 1b. Info -> TransferDataFile, if the image is raw.
+// 2a. TransferScratch -> Convert
+// 2b. TransferDataFile -> Resize
+type AzureBlobDataSource struct {
+	sourceSizeLimits
+	sourceVerification
+	sourceStreamOptions
+	// the blob endpoint
+	ep        *url.URL
+	client    AzureBlobClient
+	container string
+	blob      string
+	// the type of the blob
+	blobType string
+	// the ETag of the blob
+	etag string
+	// contentLength is the size of the blob, -1 if unknown.
+	contentLength int64
+	// Reader
+	blobReader io.ReadCloser
+	// limits the bytes read from the blob per second, nil if unlimited.
+	rateLimit *tokenBucket
+	// readRetries are the settings of resuming the failed reads of the blob.
+	readRetries readRetries
+	// stack of readers
+	readers *FormatReaders
+	// The image file in scratch space.
+	url *url.URL
+}
+
+// AzureBlobOptions are the options of the AzureBlobDataSource.
+type AzureBlobOptions struct {
+	// PinnedSPKIHashes fail the TLS handshake unless a certificate of the chain presented by the storage service has
+	// one of the pinned subject public key infos, on top of the CA validation. No pins disable pinning.
+	PinnedSPKIHashes []string
+	// RetryAfterBudget is the total time a request waits for the delays asked by the Retry-After headers of 503 and
+	// 429 responses before it is sent again, 0 disables retrying.
+	RetryAfterBudget time.Duration
+	// RateLimit limits the bytes read from the blob per second, 0 disables the limit.
+	RateLimit int64
+	// ReadRetries is the number of times a failed or truncated read of the blob is resumed with a ranged request of
+	// the same version from the offset reached, 0 disables resuming.
+	ReadRetries int
+	// ReadRetryBackoff is the delay before resuming the first time, doubled on each further attempt, 1s if 0.
+	ReadRetryBackoff time.Duration
+	SourceOptions
+}
+
+// NewAzureBlobDataSource creates a new instance of the AzureBlobDataSource. The endpoint is either
+// az://container/blob in the storage account accountName, or the https URL of the blob. The credential is either a
+// SAS token or the shared key of the storage account, a SAS token in the query of the https URL is used if there is
+// no credential. Without any, the blob is read anonymously from a public container.
+func NewAzureBlobDataSource(endpoint, accountName, credential, certDir string, options AzureBlobOptions) (*AzureBlobDataSource, error) {
+	ep, err := ParseEndpoint(endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, fmt.Sprintf("unable to parse endpoint %q", endpoint))
+	}
+	serviceURL, container, blob, err := parseAzureBlobEndpoint(ep, accountName)
+	if err != nil {
+		return nil, err
+	}
+	if credential == "" {
+		credential = ep.RawQuery
+	}
+	if accountName == "" {
+		accountName = strings.TrimSuffix(serviceURL.Hostname(), azureBlobHostSuffix)
+	}
+	pins, err := parseSPKIPins(options.PinnedSPKIHashes)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newAzureBlobClientFunc(serviceURL, accountName, credential, certDir, pins, options.RetryAfterBudget)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not build azure blob client for %q", serviceURL.Host)
+	}
+	klog.V(1).Infof("container %s", container)
+	klog.V(1).Infof("blob %s", blob)
+	content, err := client.GetBlob(container, blob, 0, "")
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not get azure blob: \"%s/%s\"", container, blob)
+	}
+	switch content.BlobType {
+	case AzureBlockBlob, AzurePageBlob:
+	default:
+		content.Body.Close()
+		return nil, errors.Errorf("unsupported azure blob type %q of \"%s/%s\"", content.BlobType, container, blob)
+	}
+	klog.V(1).Infof("%s of %d bytes", content.BlobType, content.ContentLength)
+	return &AzureBlobDataSource{
+		sourceSizeLimits:    options.sizeLimits(),
+		sourceStreamOptions: options.streamOptions(),
+		ep:                  ep,
+		client:              client,
+		container:           container,
+		blob:                blob,
+		blobType:            content.BlobType,
+		etag:                content.ETag,
+		contentLength:       content.ContentLength,
+		blobReader:          content.Body,
+		rateLimit:           newRateLimit(options.RateLimit),
+		readRetries:         newReadRetries(options.ReadRetries, options.ReadRetryBackoff),
+	}, nil
+}
+
+// Info is called to get initial information about the data.
+func (ad *AzureBlobDataSource) Info() (ProcessingPhase, error) {
+	var err error
+	if ad.readRetries.enabled() {
+		// The rest of the same version of the blob is requested from the offset reached.
+		ad.blobReader = newResumableReader(context.Background(), ad.blobReader, ad.contentLength, ad.readRetries, func(offset int64) (io.ReadCloser, error) {
+			rest, err := ad.client.GetBlob(ad.container, ad.blob, offset, ad.etag)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not get azure blob: \"%s/%s\" from offset %d", ad.container, ad.blob, offset)
+			}
+			return rest.Body, nil
+		})
+	}
+	ad.readers, err = newSourceFormatReaders(withRateLimit(context.Background(), ad.blobReader, ad.rateLimit), ad.contentLength, ad.sourceSizeLimits, ad.sourceVerification)
+	if err != nil {
+		klog.Errorf("Error creating readers: %v", err)
+		return ProcessingPhaseError, err
+	}
+	if err = checkBackingFile(ad.readers); err != nil {
+		return ProcessingPhaseError, err
+	}
+	if !ad.readers.Convert {
+		// Downloading a raw file, we can write that directly to the target.
+		return ProcessingPhaseTransferDataFile, nil
+	}
+	return ProcessingPhaseTransferScratch, nil
+}
+
+// Transfer is called to transfer the data from the source to a temporary location.
+func (ad *AzureBlobDataSource) Transfer(path string) (ProcessingPhase, error) {
+	size, _ := util.GetAvailableSpace(path)
+	if size <= int64(0) {
+		//Path provided is invalid.
+		return ProcessingPhaseError, ErrInvalidPath
+	}
+	file := filepath.Join(path, tempFile)
+	ad.readers.StartProgressUpdate()
+	err := util.StreamDataToFileWithSize(ad.readers.TopReader(), file, ad.readers.topReaderSize(ad.contentLength), ad.streamOptions())
+	if err != nil {
+		return ProcessingPhaseError, err
+	}
+	// If streaming succeeded, then parsing the file into URL will also succeed, no need to check error status
+	ad.url, _ = url.Parse(file)
+	return ProcessingPhaseConvert, nil
+}
+
+// TransferFile is called to transfer the data from the source to the passed in file.
+func (ad *AzureBlobDataSource) TransferFile(fileName string) (ProcessingPhase, error) {
+	ad.readers.StartProgressUpdate()
+	err := util.StreamDataToFileWithSize(ad.readers.TopReader(), fileName, -1, ad.streamOptions())
+	if err != nil {
+		return ProcessingPhaseError, err
+	}
+	return ProcessingPhaseResize, nil
+}
+
+// TransferToWriter is called to stream the raw image from the source to w, without scratch space.
+func (ad *AzureBlobDataSource) TransferToWriter(w io.Writer) (ProcessingPhase, error) {
+	return transferToWriter(ad.readers, w)
+}
+
+// TransferToWriterAt is called to write the raw image from the source at its offsets in w, without scratch space.
+func (ad *AzureBlobDataSource) TransferToWriterAt(w io.WriterAt) (ProcessingPhase, error) {
+	return transferToWriterAt(ad.readers, w)
+}
+
+// GetURL returns the url that the data processor can use when converting the data.
+func (ad *AzureBlobDataSource) GetURL() *url.URL {
+	return ad.url
+}
+
+func (ad *AzureBlobDataSource) sourceDigest() (string, error) {
+	return ad.readers.sourceDigest()
+}
+
+func (ad *AzureBlobDataSource) verifySourceSignature() error {
+	return ad.readers.verifySourceSignature()
+}
+
+func (ad *AzureBlobDataSource) probe() (*FormatReaders, int64) {
+	return ad.readers, ad.contentLength
+}
+
+func (ad *AzureBlobDataSource) addToManifest(manifest *ImportManifest) {
+	// The query may hold a SAS token.
+	ep := *ad.ep
+	ep.RawQuery = ""
+	manifest.Source.URL = manifestURL(&ep)
+	manifest.Source.ETag = ad.etag
+	if ad.contentLength > 0 {
+		manifest.SourceSize = ad.contentLength
+	}
+	manifest.addDecompress(compressionFormat(ad.readers))
+}
+
+func (ad *AzureBlobDataSource) formatReaders() *FormatReaders {
+	return ad.readers
+}
+
+// Close closes any readers or other open resources.
+func (ad *AzureBlobDataSource) Close() error {
+	var err error
+	if ad.readers != nil {
+		err = ad.readers.Close()
+	} else if ad.blobReader != nil {
+		err = ad.blobReader.Close()
+	}
+	return err
+}
+
+// parseAzureBlobEndpoint returns the blob service URL, the container and the blob of the endpoint.
+func parseAzureBlobEndpoint(ep *url.URL, accountName string) (*url.URL, string, string, error) {
+	var serviceURL *url.URL
+	var path string
+	switch ep.Scheme {
+	case azureBlobScheme:
+		if accountName == "" {
+			return nil, "", "", errors.Errorf("no storage account for %q", manifestURL(ep))
+		}
+		serviceURL = &url.URL{Scheme: "https", Host: accountName + azureBlobHostSuffix}
+		path = ep.Host + ep.Path
+	case "http", "https":
+		serviceURL = &url.URL{Scheme: ep.Scheme, Host: ep.Host}
+		path = strings.TrimPrefix(ep.Path, "/")
+	default:
+		return nil, "", "", errors.Errorf("unsupported azure blob endpoint scheme %q", ep.Scheme)
+	}
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, "", "", errors.Errorf("no container and blob in %q", manifestURL(ep))
+	}
+	return serviceURL, parts[0], parts[1], nil
+}
+
+// azureBlobClient gets blobs with the blob service REST API.
+type azureBlobClient struct {
+	serviceURL  *url.URL
+	httpClient  *http.Client
+	accountName string
+	// accountKey is the decoded shared key, nil if not used.
+	accountKey []byte
+	// sasToken is the query of the SAS token, empty if not used.
+	sasToken string
+}
+
+func getAzureBlobClient(serviceURL *url.URL, accountName, credential, certDir string, pins spkiPins, retryAfterBudget time.Duration) (AzureBlobClient, error) {
+	httpClient, err := createHTTPClient(certDir, pins)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating http client for azure blob storage")
+	}
+	httpClient.Transport = newRetryAfterTransport(httpClient.Transport, retryAfterBudget)
+	client := &azureBlobClient{
+		serviceURL:  serviceURL,
+		httpClient:  httpClient,
+		accountName: accountName,
+	}
+	credential = strings.TrimSpace(credential)
+	switch {
+	case credential == "":
+		klog.V(1).Infof("No credential, reading the blob anonymously")
+	case strings.Contains(credential, "sig="):
+		client.sasToken = strings.TrimPrefix(credential, "?")
+	default:
+		if client.accountKey, err = base64.StdEncoding.DecodeString(credential); err != nil {
+			return nil, errors.New("the credential is neither a SAS token nor a base64 encoded shared key")
+		}
+		if accountName == "" {
+			return nil, errors.New("no storage account for the shared key")
+		}
+	}
+	return client, nil
+}
+
+// GetBlob gets the content of the blob from offset, of the version etag if not empty.
+func (c *azureBlobClient) GetBlob(container, blob string, offset int64, etag string) (*AzureBlob, error) {
+	blobURL := *c.serviceURL
+	blobURL.Path = "/" + container + "/" + blob
+	blobURL.RawQuery = c.sasToken
+	req, err := http.NewRequest(http.MethodGet, blobURL.String(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not create HTTP request")
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+	c.sign(req, time.Now())
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "HTTP request errored")
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, errors.Errorf("expected status code 200, got %d. Status: %s, error code: %s", resp.StatusCode, resp.Status, resp.Header.Get("x-ms-error-code"))
+	}
+	return &AzureBlob{
+		Body:          resp.Body,
+		BlobType:      resp.Header.Get("x-ms-blob-type"),
+		ContentLength: resp.ContentLength,
+		ETag:          resp.Header.Get("ETag"),
+	}, nil
+}
+
+// sign sets the version and date headers of the request, and authorizes it with the shared key, if used.
+func (c *azureBlobClient) sign(req *http.Request, now time.Time) {
+	req.Header.Set("x-ms-date", now.UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureStorageVersion)
+	if c.accountKey == nil {
+		return
+	}
+	mac := hmac.New(sha256.New, c.accountKey)
+	mac.Write([]byte(azureStringToSign(req, c.accountName)))
+	req.Header.Set("Authorization", "SharedKey "+c.accountName+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// azureStringToSign returns the string the shared key signs for the request, the standard headers followed by the
+// canonicalized x-ms- headers and the canonicalized resource.
+func azureStringToSign(req *http.Request, accountName string) string {
+	var b strings.Builder
+	b.WriteString(req.Method + "\n")
+	for _, name := range []string{"Content-Encoding", "Content-Language", "Content-Length", "Content-MD5", "Content-Type",
+		"Date", "If-Modified-Since", "If-Match", "If-None-Match", "If-Unmodified-Since", "Range"} {
+		b.WriteString(req.Header.Get(name) + "\n")
+	}
+	var headers []string
+	for name := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+			headers = append(headers, name)
+		}
+	}
+	sort.Strings(headers)
+	for _, name := range headers {
+		b.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	b.WriteString("/" + accountName + req.URL.EscapedPath())
+	query := req.URL.Query()
+	var params []string
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := query[name]
+		sort.Strings(values)
+		b.WriteString("\n" + strings.ToLower(name) + ":" + strings.Join(values, ","))
+	}
+	return b.String()
+}
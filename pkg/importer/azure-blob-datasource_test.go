@@ -0,0 +1,219 @@
+package importer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/pkg/errors"
+)
+
+// mockAzureBlobClient serves data as a blob of blobType, or fails with err.
+type mockAzureBlobClient struct {
+	serviceURL *url.URL
+	data       []byte
+	blobType   string
+	err        error
+	// the container and blob of the last GetBlob call
+	container string
+	blob      string
+}
+
+func (mc *mockAzureBlobClient) GetBlob(container, blob string, offset int64, etag string) (*AzureBlob, error) {
+	mc.container = container
+	mc.blob = blob
+	if mc.err != nil {
+		return nil, mc.err
+	}
+	return &AzureBlob{
+		Body:          ioutil.NopCloser(bytes.NewReader(mc.data[offset:])),
+		BlobType:      mc.blobType,
+		ContentLength: int64(len(mc.data)) - offset,
+		ETag:          "\"0x8D9\"",
+	}, nil
+}
+
+var _ = Describe("Azure blob data source", func() {
+	var (
+		ad     *AzureBlobDataSource
+		client *mockAzureBlobClient
+		tmpDir string
+		err    error
+	)
+
+	BeforeEach(func() {
+		client = &mockAzureBlobClient{data: cirrosData, blobType: AzureBlockBlob}
+		newAzureBlobClientFunc = func(serviceURL *url.URL, accountName, credential, certDir string, pins spkiPins, retryAfterBudget time.Duration) (AzureBlobClient, error) {
+			client.serviceURL = serviceURL
+			return client, nil
+		}
+		tmpDir, err = ioutil.TempDir("", "scratch")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		newAzureBlobClientFunc = getAzureBlobClient
+		if ad != nil {
+			ad.Close()
+			ad = nil
+		}
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should transfer a qcow2 block blob to scratch space", func() {
+		ad, err = NewAzureBlobDataSource("az://images/cirros/cirros.qcow2", "goldenimages", "", "", AzureBlobOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.serviceURL.String()).To(Equal("https://goldenimages.blob.core.windows.net"))
+		Expect(client.container).To(Equal("images"))
+		Expect(client.blob).To(Equal("cirros/cirros.qcow2"))
+		result, err := ad.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseTransferScratch))
+		result, err = ad.Transfer(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseConvert))
+		data, err := ioutil.ReadFile(filepath.Join(tmpDir, tempFile))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(Equal(cirrosData))
+		Expect(ad.GetURL().String()).To(Equal(filepath.Join(tmpDir, tempFile)))
+	})
+
+	It("should transfer a raw page blob to the target", func() {
+		tinyCoreData, err := readFile(tinyCoreFilePath)
+		Expect(err).NotTo(HaveOccurred())
+		client.data = tinyCoreData
+		client.blobType = AzurePageBlob
+		ad, err = NewAzureBlobDataSource("https://goldenimages.blob.core.windows.net/disks/tinycore.vhd?sv=2019-12-12&sig=abc", "", "", "", AzureBlobOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.container).To(Equal("disks"))
+		Expect(client.blob).To(Equal("tinycore.vhd"))
+		result, err := ad.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseTransferDataFile))
+		target := filepath.Join(tmpDir, "disk.img")
+		result, err = ad.TransferFile(target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseResize))
+		data, err := ioutil.ReadFile(target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(Equal(tinyCoreData))
+
+		manifest := newImportManifest()
+		ad.addToManifest(manifest)
+		Expect(manifest.Source.URL).To(Equal("https://goldenimages.blob.core.windows.net/disks/tinycore.vhd"))
+		Expect(manifest.Source.ETag).To(Equal("\"0x8D9\""))
+		Expect(manifest.SourceSize).To(Equal(int64(len(tinyCoreData))))
+	})
+
+	It("should reject append blobs", func() {
+		client.blobType = "AppendBlob"
+		ad, err = NewAzureBlobDataSource("az://logs/import.log", "goldenimages", "", "", AzureBlobOptions{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("unsupported azure blob type"))
+	})
+
+	It("should fail when failing to get the blob", func() {
+		client.err = errors.New("expected status code 200, got 404")
+		ad, err = NewAzureBlobDataSource("az://images/missing.qcow2", "goldenimages", "", "", AzureBlobOptions{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("could not get azure blob: \"images/missing.qcow2\""))
+	})
+
+	table.DescribeTable("should fail to parse", func(endpoint, accountName, expected string) {
+		ad, err = NewAzureBlobDataSource(endpoint, accountName, "", "", AzureBlobOptions{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(expected))
+	},
+		table.Entry("an az endpoint without account", "az://images/cirros.qcow2", "", "no storage account"),
+		table.Entry("an endpoint without blob", "az://images", "goldenimages", "no container and blob"),
+		table.Entry("an https endpoint without blob", "https://goldenimages.blob.core.windows.net/images", "", "no container and blob"),
+		table.Entry("an unsupported scheme", "s3://images/cirros.qcow2", "goldenimages", "unsupported azure blob endpoint scheme"),
+	)
+})
+
+var _ = Describe("Azure blob client", func() {
+	var ts *httptest.Server
+	var requests []*http.Request
+
+	BeforeEach(func() {
+		requests = nil
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r)
+			if r.URL.Path != "/images/cirros.qcow2" {
+				w.Header().Set("x-ms-error-code", "BlobNotFound")
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("x-ms-blob-type", AzureBlockBlob)
+			w.Header().Set("ETag", "\"0x8D9\"")
+			w.Write(cirrosData)
+		}))
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	getClient := func(accountName, credential string) AzureBlobClient {
+		serviceURL, err := url.Parse(ts.URL)
+		Expect(err).NotTo(HaveOccurred())
+		client, err := getAzureBlobClient(serviceURL, accountName, credential, "", nil, 0)
+		Expect(err).NotTo(HaveOccurred())
+		return client
+	}
+
+	It("should get the blob with a SAS token", func() {
+		blob, err := getClient("", "?sv=2019-12-12&sr=b&sig=abc").GetBlob("images", "cirros.qcow2", 0, "")
+		Expect(err).NotTo(HaveOccurred())
+		data, err := ioutil.ReadAll(blob.Body)
+		Expect(err).NotTo(HaveOccurred())
+		blob.Body.Close()
+		Expect(data).To(Equal(cirrosData))
+		Expect(blob.BlobType).To(Equal(AzureBlockBlob))
+		Expect(blob.ETag).To(Equal("\"0x8D9\""))
+		Expect(requests[0].URL.Query().Get("sig")).To(Equal("abc"))
+		Expect(requests[0].Header.Get("Authorization")).To(BeEmpty())
+		Expect(requests[0].Header.Get("x-ms-version")).To(Equal(azureStorageVersion))
+	})
+
+	It("should sign the request with the shared key", func() {
+		blob, err := getClient("goldenimages", "c2hhcmVkIGtleQ==").GetBlob("images", "cirros.qcow2", 1024, "\"0x8D9\"")
+		Expect(err).NotTo(HaveOccurred())
+		blob.Body.Close()
+		Expect(requests[0].Header.Get("Authorization")).To(HavePrefix("SharedKey goldenimages:"))
+		Expect(requests[0].Header.Get("Range")).To(Equal("bytes=1024-"))
+		Expect(requests[0].Header.Get("If-Match")).To(Equal("\"0x8D9\""))
+	})
+
+	It("should report the error code of a missing blob", func() {
+		_, err := getClient("", "").GetBlob("images", "missing.qcow2", 0, "")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("BlobNotFound"))
+	})
+
+	It("should reject an invalid credential", func() {
+		serviceURL, _ := url.Parse(ts.URL)
+		_, err := getAzureBlobClient(serviceURL, "goldenimages", "not a key!", "", nil, 0)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should canonicalize the request", func() {
+		req, err := http.NewRequest(http.MethodGet, "https://goldenimages.blob.core.windows.net/images/cirros%20disk.qcow2?timeout=30&comp=metadata", nil)
+		Expect(err).NotTo(HaveOccurred())
+		req.Header.Set("Range", "bytes=0-")
+		client := &azureBlobClient{accountName: "goldenimages", accountKey: []byte("key")}
+		client.sign(req, time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC))
+		Expect(azureStringToSign(req, "goldenimages")).To(Equal("GET\n\n\n\n\n\n\n\n\n\n\nbytes=0-\n" +
+			"x-ms-date:Mon, 01 Mar 2021 10:00:00 GMT\nx-ms-version:2019-12-12\n" +
+			"/goldenimages/images/cirros%20disk.qcow2\ncomp:metadata\ntimeout:30"))
+	})
+})
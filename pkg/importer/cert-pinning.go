@@ -0,0 +1,81 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+)
+
+// spkiPinPrefix is the optional prefix of the pins, as used by HTTP public key pinning.
+const spkiPinPrefix = "sha256/"
+
+// spkiPins is a set of pinned subject public key info hashes, empty if certificates aren't pinned.
+type spkiPins map[string]bool
+
+// parseSPKIPins returns the set of pins. A pin is the base64 encoded SHA256 hash of the DER encoded subject public
+// key info, optionally prefixed with sha256/. Blank pins are ignored.
+func parseSPKIPins(pins []string) (spkiPins, error) {
+	hashes := spkiPins{}
+	for _, pin := range pins {
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), spkiPinPrefix)
+		if pin == "" {
+			continue
+		}
+		if hash, err := base64.StdEncoding.DecodeString(pin); err != nil || len(hash) != sha256.Size {
+			return nil, errors.Errorf("invalid SPKI pin %q, expected the base64 encoded SHA256 hash", pin)
+		}
+		hashes[pin] = true
+	}
+	return hashes, nil
+}
+
+// spkiHash returns the pin of the certificate.
+func spkiHash(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// verify is the tls.Config VerifyPeerCertificate callback checking the pins. It runs after the CA validation, against
+// the verified chains, or the presented certificates if the validation was skipped.
+func (pins spkiPins) verify(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if pins[spkiHash(cert)] {
+				return nil
+			}
+		}
+	}
+	if len(verifiedChains) == 0 {
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return errors.Wrap(err, "unable to parse the server certificate")
+			}
+			if pins[spkiHash(cert)] {
+				return nil
+			}
+		}
+	}
+	klog.Errorf("None of the %d certificates presented by the server matches a pinned SPKI hash", len(rawCerts))
+	return errors.New("server certificate doesn't match any pinned SPKI hash")
+}
@@ -0,0 +1,106 @@
+package importer
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	cdiv1 "kubevirt.io/containerized-data-importer/pkg/apis/core/v1beta1"
+	"kubevirt.io/containerized-data-importer/pkg/image"
+	"kubevirt.io/containerized-data-importer/pkg/util/cert"
+)
+
+var _ = Describe("Certificate pinning", func() {
+	var (
+		ts      *httptest.Server
+		certDir string
+		pin     string
+	)
+
+	BeforeEach(func() {
+		var err error
+		ts = httptest.NewTLSServer(http.FileServer(http.Dir(imageDir)))
+		certDir, err = ioutil.TempDir("", "pinning")
+		Expect(err).NotTo(HaveOccurred())
+		// The CA validation passes, only the pins decide.
+		err = ioutil.WriteFile(filepath.Join(certDir, "tls.crt"), cert.EncodeCertPEM(ts.Certificate()), 0644)
+		Expect(err).NotTo(HaveOccurred())
+		pin = spkiHash(ts.Certificate())
+	})
+
+	AfterEach(func() {
+		ts.Close()
+		os.RemoveAll(certDir)
+	})
+
+	// get fetches an image from the server with a client checking pins.
+	get := func(pins ...string) error {
+		parsed, err := parseSPKIPins(pins)
+		Expect(err).NotTo(HaveOccurred())
+		client, err := createHTTPClient(certDir, parsed)
+		Expect(err).NotTo(HaveOccurred())
+		resp, err := client.Get(ts.URL + "/" + cirrosFileName)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	It("should connect to a server presenting a pinned certificate", func() {
+		Expect(get("sha256/" + pin)).To(Succeed())
+	})
+
+	It("should fail the handshake with a server not presenting a pinned certificate", func() {
+		other := sha256.Sum256([]byte("another key"))
+		err := get(base64.StdEncoding.EncodeToString(other[:]))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("doesn't match any pinned SPKI hash"))
+	})
+
+	It("should check the pins against the system CAs without custom CA", func() {
+		pins, err := parseSPKIPins([]string{pin})
+		Expect(err).NotTo(HaveOccurred())
+		client, err := createHTTPClient("", pins)
+		Expect(err).NotTo(HaveOccurred())
+		transport := client.Transport.(*http.Transport)
+		Expect(transport.TLSClientConfig.RootCAs).To(BeNil())
+		Expect(transport.TLSClientConfig.VerifyPeerCertificate).NotTo(BeNil())
+	})
+
+	It("should reject invalid pins", func() {
+		_, err := parseSPKIPins([]string{"c2hvcnQ="})
+		Expect(err).To(HaveOccurred())
+		_, err = parseSPKIPins([]string{"not base64!"})
+		Expect(err).To(HaveOccurred())
+		pins, err := parseSPKIPins([]string{"", " "})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pins).To(BeEmpty())
+	})
+
+	It("should make the http data source go through scratch space", func() {
+		createNbdkitCurl = image.NewMockNbdkitCurl
+		hs, err := NewHTTPDataSourceWithOptions(ts.URL+"/"+cirrosFileName, "", "", certDir, cdiv1.DataVolumeKubeVirt, HTTPOptions{
+			PinnedSPKIHashes: []string{pin},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		defer hs.Close()
+		// Only the pins require scratch space.
+		hs.customCA = ""
+		phase, err := hs.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(phase).To(Equal(ProcessingPhaseTransferScratch))
+	})
+
+	It("should fail to create a data source with invalid pins", func() {
+		_, err := NewWebDAVDataSource("davs://example.com/disk.img", "", "", certDir, WebDAVOptions{PinnedSPKIHashes: []string{"not base64!"}})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("invalid SPKI pin"))
+	})
+})
@@ -0,0 +1,165 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+)
+
+// ChecksumAllowlist is the set of approved source checksums in the form sha256:<hex>.
+type ChecksumAllowlist map[string]bool
+
+// digestSource is implemented by the data sources computing the digest of the source data while it is transferred.
+type digestSource interface {
+	// sourceDigest returns the digest of the source data in the form sha256:<hex>, reading the rest of the source
+	// data if the transfer didn't.
+	sourceDigest() (string, error)
+}
+
+// ReadChecksumAllowlist reads the allowlist at path, for DataProcessor.SetChecksumAllowlist. The allowlist is a file,
+// or a directory like a mounted ConfigMap whose files are all read. Every line lists a checksum, either sha256:<hex>
+// or the output of sha256sum, blank lines and lines starting with # are ignored. An empty path returns a nil
+// allowlist.
+func ReadChecksumAllowlist(path string) (ChecksumAllowlist, error) {
+	if path == "" {
+		return nil, nil
+	}
+	files := []string{path}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read the checksum allowlist %s", path)
+	}
+	if info.IsDir() {
+		if files, err = allowlistFiles(path); err != nil {
+			return nil, err
+		}
+	}
+	allowlist := ChecksumAllowlist{}
+	for _, file := range files {
+		if err := readChecksumAllowlist(file, allowlist); err != nil {
+			return nil, err
+		}
+	}
+	if len(allowlist) == 0 {
+		return nil, errors.Errorf("the checksum allowlist %s lists no checksum", path)
+	}
+	klog.V(1).Infof("Accepting the %d checksums of the allowlist %s", len(allowlist), path)
+	return allowlist, nil
+}
+
+// allowlistFiles returns the files of the allowlist directory, skipping the hidden entries of mounted ConfigMaps.
+func allowlistFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read the checksum allowlist %s", dir)
+	}
+	var files []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		file := filepath.Join(dir, entry.Name())
+		// The keys of a mounted ConfigMap are symbolic links.
+		if info, err := os.Stat(file); err == nil && info.Mode().IsRegular() {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// readChecksumAllowlist adds the checksums listed in fileName to allowlist.
+func readChecksumAllowlist(fileName string, allowlist ChecksumAllowlist) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return errors.Wrapf(err, "unable to read the checksum allowlist %s", fileName)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		checksum, err := parseSHA256Checksum(fields[0])
+		if err != nil {
+			return errors.Wrapf(err, "invalid checksum at %s:%d", fileName, line)
+		}
+		allowlist[checksum] = true
+	}
+	return errors.Wrapf(scanner.Err(), "unable to read the checksum allowlist %s", fileName)
+}
+
+// verifyChecksumAllowlist returns an error unless the digest of the source is in the allowlist.
+func verifyChecksumAllowlist(source DataSourceInterface, allowlist ChecksumAllowlist) error {
+	ds, ok := source.(digestSource)
+	if !ok {
+		return errors.New("the data source doesn't compute the digest the checksum allowlist requires")
+	}
+	digest, err := ds.sourceDigest()
+	if err != nil {
+		return errors.Wrap(err, "unable to compute the digest of the source")
+	}
+	if !allowlist[digest] {
+		return errors.Errorf("the source digest %s isn't in the checksum allowlist", digest)
+	}
+	klog.V(1).Infof("The source digest %s is in the checksum allowlist", digest)
+	return nil
+}
+
+// digestReader computes the sha256 digest of the data read from reader.
+type digestReader struct {
+	reader io.ReadCloser
+	hash   hash.Hash
+}
+
+func newDigestReader(reader io.ReadCloser) *digestReader {
+	return &digestReader{
+		reader: reader,
+		hash:   sha256.New(),
+	}
+}
+
+// Read reads from the reader, hashing the data read.
+func (r *digestReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.hash.Write(p[:n])
+	return n, err
+}
+
+// Close closes the reader.
+func (r *digestReader) Close() error {
+	return r.reader.Close()
+}
+
+// digest reads the rest of the data, and returns its digest in the form sha256:<hex>.
+func (r *digestReader) digest() (string, error) {
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(r.hash.Sum(nil)), nil
+}
@@ -0,0 +1,142 @@
+package importer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Checksum allowlist", func() {
+	var (
+		tmpDir   string
+		data     []byte
+		checksum string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "allowlist")
+		Expect(err).NotTo(HaveOccurred())
+		data = bytes.Repeat([]byte{0x55}, 64*1024)
+		checksum = "sha256:" + sha256Hex(data)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	writeAllowlist := func(content string) string {
+		fileName := filepath.Join(tmpDir, "allowlist")
+		Expect(ioutil.WriteFile(fileName, []byte(content), 0644)).To(Succeed())
+		return fileName
+	}
+
+	readAllowlist := func(content string) ChecksumAllowlist {
+		allowlist, err := ReadChecksumAllowlist(writeAllowlist(content))
+		Expect(err).NotTo(HaveOccurred())
+		return allowlist
+	}
+
+	process := func(allowlist ChecksumAllowlist) error {
+		Expect(os.Mkdir(filepath.Join(tmpDir, "data"), 0755)).To(Succeed())
+		source := NewUploadDataSource(ioutil.NopCloser(bytes.NewReader(data)))
+		dp := NewDataProcessor(source, filepath.Join(tmpDir, "data", "disk.img"), filepath.Join(tmpDir, "data"), "", "", 0.055, false)
+		dp.SetChecksumAllowlist(allowlist)
+		var err error
+		replaceQEMUOperations(NewFakeQEMUOperations(nil, nil, fakeInfoRet, nil, nil, nil), func() {
+			err = dp.ProcessData()
+		})
+		return err
+	}
+
+	It("should import a source whose digest is in the allowlist", func() {
+		other := "sha256:" + sha256Hex([]byte("other image"))
+		Expect(process(readAllowlist("# approved images\n" + other + "\n\n" + checksum + "\n"))).To(Succeed())
+		imported, err := ioutil.ReadFile(filepath.Join(tmpDir, "data", "disk.img"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(imported).To(Equal(data))
+	})
+
+	It("should refuse a source whose digest isn't in the allowlist", func() {
+		err := process(readAllowlist(sha256Hex([]byte("other image")) + "  other.img\n"))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("the source digest " + checksum + " isn't in the checksum allowlist"))
+		Expect(filepath.Join(tmpDir, "data", "disk.img")).NotTo(BeAnExistingFile())
+	})
+
+	It("should zero a block device holding a refused source", func() {
+		device := filepath.Join(tmpDir, "device")
+		size := int64(2*len(data) + 512)
+		Expect(ioutil.WriteFile(device, bytes.Repeat([]byte{0xff}, int(size)), 0644)).To(Succeed())
+		replaceAvailableSpaceBlockFunc(func(path string) (int64, error) {
+			if path != device {
+				return -1, nil
+			}
+			return size, nil
+		}, func() {
+			dp := NewDataProcessor(NewUploadDataSource(ioutil.NopCloser(bytes.NewReader(data))), device, tmpDir, "", "", 0, false)
+			dp.discardTarget(ProcessingPhaseTransferDataFile)
+		})
+		wiped, err := ioutil.ReadFile(device)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Equal(wiped, make([]byte, size))).To(BeTrue())
+	})
+
+	It("should make the source compute the digest only with an allowlist", func() {
+		source := NewUploadDataSource(ioutil.NopCloser(bytes.NewReader(data)))
+		dp := NewDataProcessor(source, filepath.Join(tmpDir, "disk.img"), tmpDir, "", "", 0.055, false)
+		Expect(source.digest).To(BeFalse())
+		dp.SetChecksumAllowlist(readAllowlist(checksum))
+		Expect(source.digest).To(BeTrue())
+		dp.SetChecksumAllowlist(nil)
+		Expect(source.digest).To(BeFalse())
+	})
+
+	It("should read the allowlist from a mounted ConfigMap", func() {
+		// A mounted ConfigMap links its keys to the files of a hidden timestamped directory.
+		dataDir := filepath.Join(tmpDir, "..2021_06_01_00_00_00.123")
+		Expect(os.Mkdir(dataDir, 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dataDir, "approved"), []byte(checksum+"\n"), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dataDir, "legacy"), []byte(sha256Hex(cirrosData)+"  cirros.img\n"), 0644)).To(Succeed())
+		Expect(os.Symlink(filepath.Base(dataDir), filepath.Join(tmpDir, "..data"))).To(Succeed())
+		Expect(os.Symlink(filepath.Join("..data", "approved"), filepath.Join(tmpDir, "approved"))).To(Succeed())
+		Expect(os.Symlink(filepath.Join("..data", "legacy"), filepath.Join(tmpDir, "legacy"))).To(Succeed())
+		allowlist, err := ReadChecksumAllowlist(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(allowlist).To(HaveLen(2))
+		Expect(allowlist).To(HaveKey(checksum))
+		Expect(allowlist).To(HaveKey("sha256:" + sha256Hex(cirrosData)))
+	})
+
+	It("should reject invalid allowlists", func() {
+		_, err := ReadChecksumAllowlist(writeAllowlist(checksum + "\nmd5:abc\n"))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("invalid checksum at " + filepath.Join(tmpDir, "allowlist") + ":2"))
+		_, err = ReadChecksumAllowlist(writeAllowlist("# nothing approved yet\n"))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("lists no checksum"))
+		_, err = ReadChecksumAllowlist(filepath.Join(tmpDir, "missing"))
+		Expect(err).To(HaveOccurred())
+		allowlist, err := ReadChecksumAllowlist("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(allowlist).To(BeNil())
+	})
+
+	It("should compute the digest of the whole source even if the transfer stopped early", func() {
+		readers, err := newFormatReaders(ioutil.NopCloser(bytes.NewReader(data)), 0, sourceSizeLimits{}, sourceVerification{digest: true})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = readers.TopReader().Read(make([]byte, 100))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(readers.sourceDigest()).To(Equal(checksum))
+	})
+
+	It("should refuse data sources not computing the digest", func() {
+		err := verifyChecksumAllowlist(&MockDataProvider{}, readAllowlist(checksum))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("doesn't compute the digest"))
+	})
+})
@@ -0,0 +1,106 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// checksumAlgorithms are the hashes of the expected checksums, by the prefix of the checksums.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"md5":    md5.New,
+}
+
+// checksumVerifyingReader hashes the data read from reader, and fails at the end of the data if the hash doesn't
+// match the expected checksum.
+type checksumVerifyingReader struct {
+	reader    io.ReadCloser
+	hash      hash.Hash
+	algorithm string
+	expected  string
+	// verified is true once the end of the data was reached, and the checksum matched.
+	verified bool
+}
+
+// newChecksumVerifyingReader returns a reader verifying the data of reader matches the checksum, in the form
+// <algorithm>:<hex>, sha256:<hex> or md5:<hex> for instance.
+func newChecksumVerifyingReader(reader io.ReadCloser, checksum string) (*checksumVerifyingReader, error) {
+	algorithm, expected, err := parseChecksum(checksum)
+	if err != nil {
+		return nil, err
+	}
+	return &checksumVerifyingReader{
+		reader:    reader,
+		hash:      checksumAlgorithms[algorithm](),
+		algorithm: algorithm,
+		expected:  expected,
+	}, nil
+}
+
+// parseChecksum returns the algorithm and the lower case hex value of the checksum in the form <algorithm>:<hex>.
+func parseChecksum(checksum string) (string, string, error) {
+	parts := strings.SplitN(strings.TrimSpace(checksum), ":", 2)
+	if len(parts) != 2 {
+		return "", "", errors.Errorf("checksum %q has no algorithm prefix", checksum)
+	}
+	algorithm := strings.ToLower(parts[0])
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		return "", "", errors.Errorf("unsupported checksum algorithm %q", parts[0])
+	}
+	expected := strings.ToLower(parts[1])
+	if decoded, err := hex.DecodeString(expected); err != nil || len(decoded) != newHash().Size() {
+		return "", "", errors.Errorf("invalid %s checksum %q", algorithm, parts[1])
+	}
+	return algorithm, expected, nil
+}
+
+// Read reads from the reader, verifying the checksum at EOF.
+func (r *checksumVerifyingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && !r.verified {
+		if actual := hex.EncodeToString(r.hash.Sum(nil)); actual != r.expected {
+			return n, errors.Errorf("checksum mismatch, expected %s:%s, got %s:%s", r.algorithm, r.expected, r.algorithm, actual)
+		}
+		r.verified = true
+	}
+	return n, err
+}
+
+// verify reads the rest of the data, and fails if the checksum doesn't match.
+func (r *checksumVerifyingReader) verify() error {
+	if r.verified {
+		return nil
+	}
+	_, err := io.Copy(ioutil.Discard, r)
+	return err
+}
+
+// Close closes the reader.
+func (r *checksumVerifyingReader) Close() error {
+	return r.reader.Close()
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"k8s.io/klog/v2"
+)
+
+// chunkChecksumsSuffix is appended to the name of the imported image to name its chunk checksums sidecar.
+const chunkChecksumsSuffix = ".chunks"
+
+// ChunkChecksums lists the checksum of every chunk of an imported image, so consumers can verify the image chunk by
+// chunk. The last chunk may be shorter than the chunk size.
+type ChunkChecksums struct {
+	// Algorithm is the hash algorithm of the checksums.
+	Algorithm string `json:"algorithm"`
+	// ChunkSize is the size of the chunks in bytes.
+	ChunkSize int64 `json:"chunkSize"`
+	// Size is the size of the image in bytes.
+	Size int64 `json:"size"`
+	// Chunks lists the chunk checksums in offset order.
+	Chunks []ChunkChecksum `json:"chunks"`
+}
+
+// ChunkChecksum is the checksum of the chunk at Offset.
+type ChunkChecksum struct {
+	Offset int64  `json:"offset"`
+	Hash   string `json:"hash"`
+}
+
+// chunkHasher is a writer computing the checksum of every chunkSize bytes written.
+type chunkHasher struct {
+	checksums ChunkChecksums
+	hash      hash.Hash
+	// bytes of the current chunk written to hash
+	chunkWritten int64
+}
+
+func newChunkHasher(chunkSize int64) *chunkHasher {
+	return &chunkHasher{
+		checksums: ChunkChecksums{
+			Algorithm: "sha256",
+			ChunkSize: chunkSize,
+			Chunks:    []ChunkChecksum{},
+		},
+		hash: sha256.New(),
+	}
+}
+
+func (h *chunkHasher) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := h.checksums.ChunkSize - h.chunkWritten
+		if n > int64(len(p)) {
+			n = int64(len(p))
+		}
+		h.hash.Write(p[:n])
+		h.chunkWritten += n
+		h.checksums.Size += n
+		p = p[n:]
+		if h.chunkWritten == h.checksums.ChunkSize {
+			h.endChunk()
+		}
+	}
+	return written, nil
+}
+
+// endChunk records the checksum of the current chunk and starts the next one.
+func (h *chunkHasher) endChunk() {
+	h.checksums.Chunks = append(h.checksums.Chunks, ChunkChecksum{
+		Offset: h.checksums.Size - h.chunkWritten,
+		Hash:   hex.EncodeToString(h.hash.Sum(nil)),
+	})
+	h.hash.Reset()
+	h.chunkWritten = 0
+}
+
+// finish records the checksum of the last partial chunk, and returns the checksums of all chunks.
+func (h *chunkHasher) finish() *ChunkChecksums {
+	if h.chunkWritten > 0 {
+		h.endChunk()
+	}
+	return &h.checksums
+}
+
+// writeChunkChecksums computes the checksums of the chunkSize chunks of fileName, and writes them as JSON to
+// fileName with the chunk checksums suffix.
+func writeChunkChecksums(fileName string, chunkSize int64) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open %s", fileName)
+	}
+	defer file.Close()
+	hasher := newChunkHasher(chunkSize)
+	if _, err := io.Copy(hasher, file); err != nil {
+		return errors.Wrapf(err, "unable to read %s", fileName)
+	}
+	data, err := json.Marshal(hasher.finish())
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal chunk checksums")
+	}
+	sidecar := fileName + chunkChecksumsSuffix
+	if err := ioutil.WriteFile(sidecar, data, 0644); err != nil {
+		return errors.Wrapf(err, "unable to write chunk checksums %s", sidecar)
+	}
+	klog.V(1).Infof("Wrote checksums of %d chunks to %s", len(hasher.checksums.Chunks), sidecar)
+	return nil
+}
@@ -0,0 +1,106 @@
+package importer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Chunk checksums", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "chunks")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	// testData returns size bytes of non repeating data, so every chunk has a different checksum.
+	testData := func(size int) []byte {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i % 251)
+		}
+		return data
+	}
+
+	// expectChunks recomputes the checksums of the chunks of data and compares them with checksums.
+	expectChunks := func(checksums *ChunkChecksums, data []byte, chunkSize int) {
+		Expect(checksums.Algorithm).To(Equal("sha256"))
+		Expect(checksums.ChunkSize).To(Equal(int64(chunkSize)))
+		Expect(checksums.Size).To(Equal(int64(len(data))))
+		Expect(checksums.Chunks).To(HaveLen((len(data) + chunkSize - 1) / chunkSize))
+		for i, chunk := range checksums.Chunks {
+			end := (i + 1) * chunkSize
+			if end > len(data) {
+				end = len(data)
+			}
+			sum := sha256.Sum256(data[i*chunkSize : end])
+			Expect(chunk.Offset).To(Equal(int64(i * chunkSize)))
+			Expect(chunk.Hash).To(Equal(hex.EncodeToString(sum[:])))
+		}
+	}
+
+	table.DescribeTable("chunkHasher should checksum every chunk", func(size, chunkSize, writeSize int) {
+		data := testData(size)
+		hasher := newChunkHasher(int64(chunkSize))
+		for offset := 0; offset < len(data); offset += writeSize {
+			end := offset + writeSize
+			if end > len(data) {
+				end = len(data)
+			}
+			n, err := hasher.Write(data[offset:end])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(end - offset))
+		}
+		expectChunks(hasher.finish(), data, chunkSize)
+	},
+		table.Entry("with writes aligned to the chunks", 4096, 1024, 1024),
+		table.Entry("with writes spanning chunks", 4096, 1024, 3000),
+		table.Entry("with writes smaller than the chunks", 4096, 1024, 100),
+		table.Entry("with a last partial chunk", 4000, 1024, 512),
+		table.Entry("without data", 0, 1024, 512),
+	)
+
+	It("should write the chunk checksums next to the data file at completion", func() {
+		data := testData(10000)
+		dataFile := filepath.Join(tmpDir, "disk.img")
+		Expect(ioutil.WriteFile(dataFile, data, 0644)).To(Succeed())
+		mdp := &MockDataProvider{
+			infoResponse:     ProcessingPhaseTransferDataFile,
+			transferResponse: ProcessingPhaseComplete,
+		}
+		dp := NewDataProcessor(mdp, dataFile, tmpDir, tmpDir, "", 0.055, false)
+		dp.SetChunkChecksums(4096)
+		Expect(dp.ProcessDataWithPause()).To(Succeed())
+
+		sidecar, err := ioutil.ReadFile(dataFile + chunkChecksumsSuffix)
+		Expect(err).NotTo(HaveOccurred())
+		checksums := &ChunkChecksums{}
+		Expect(json.Unmarshal(sidecar, checksums)).To(Succeed())
+		expectChunks(checksums, data, 4096)
+	})
+
+	It("should not write chunk checksums by default", func() {
+		dataFile := filepath.Join(tmpDir, "disk.img")
+		Expect(ioutil.WriteFile(dataFile, testData(10000), 0644)).To(Succeed())
+		mdp := &MockDataProvider{
+			infoResponse:     ProcessingPhaseTransferDataFile,
+			transferResponse: ProcessingPhaseComplete,
+		}
+		dp := NewDataProcessor(mdp, dataFile, tmpDir, tmpDir, "", 0.055, false)
+		Expect(dp.ProcessDataWithPause()).To(Succeed())
+		Expect(dataFile + chunkChecksumsSuffix).NotTo(BeAnExistingFile())
+	})
+})
@@ -0,0 +1,131 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrReadInactivity indicates that the source stopped sending data in the middle of a response.
+var ErrReadInactivity = errors.New("no data received from the source")
+
+// ClientTimeouts are the timeouts of the connections of a storage client. Zero durations take the durations of
+// DefaultClientTimeouts.
+type ClientTimeouts struct {
+	// Dial bounds establishing a TCP connection.
+	Dial time.Duration
+	// TLSHandshake bounds the TLS handshake of a connection.
+	TLSHandshake time.Duration
+	// ResponseHeader bounds the wait for the headers of a response once the request is sent.
+	ResponseHeader time.Duration
+	// IdleConn is how long an idle connection is kept for reuse.
+	IdleConn time.Duration
+	// ReadInactivity aborts the read of a response body that doesn't return any data for that long.
+	ReadInactivity time.Duration
+}
+
+// DefaultClientTimeouts are the timeouts of the storage clients unless overridden. They are long enough for slow
+// gateways, the point is that a hung connection eventually fails the import.
+var DefaultClientTimeouts = ClientTimeouts{
+	Dial:           30 * time.Second,
+	TLSHandshake:   30 * time.Second,
+	ResponseHeader: 2 * time.Minute,
+	IdleConn:       90 * time.Second,
+	ReadInactivity: 5 * time.Minute,
+}
+
+// withDefaults returns the timeouts, with the durations of DefaultClientTimeouts instead of zero durations.
+func (t ClientTimeouts) withDefaults() ClientTimeouts {
+	if t.Dial == 0 {
+		t.Dial = DefaultClientTimeouts.Dial
+	}
+	if t.TLSHandshake == 0 {
+		t.TLSHandshake = DefaultClientTimeouts.TLSHandshake
+	}
+	if t.ResponseHeader == 0 {
+		t.ResponseHeader = DefaultClientTimeouts.ResponseHeader
+	}
+	if t.IdleConn == 0 {
+		t.IdleConn = DefaultClientTimeouts.IdleConn
+	}
+	if t.ReadInactivity == 0 {
+		t.ReadInactivity = DefaultClientTimeouts.ReadInactivity
+	}
+	return t
+}
+
+// applyTo sets the connection timeouts of transport.
+func (t ClientTimeouts) applyTo(transport *http.Transport) {
+	t = t.withDefaults()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   t.Dial,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = t.TLSHandshake
+	transport.ResponseHeaderTimeout = t.ResponseHeader
+	transport.IdleConnTimeout = t.IdleConn
+}
+
+// inactivityReader fails a read that doesn't return for timeout, closing the reader to interrupt it.
+type inactivityReader struct {
+	reader  io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	// timedOut is set to 1 once the timer fired.
+	timedOut int32
+}
+
+// newInactivityReader returns reader failing the reads that don't return for timeout, reader if timeout isn't
+// positive or reader is nil.
+func newInactivityReader(reader io.ReadCloser, timeout time.Duration) io.ReadCloser {
+	if timeout <= 0 || reader == nil {
+		return reader
+	}
+	r := &inactivityReader{reader: reader, timeout: timeout}
+	r.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&r.timedOut, 1)
+		r.reader.Close()
+	})
+	// The timer only runs during reads, the consumer may take its time between reads.
+	r.timer.Stop()
+	return r
+}
+
+// Read reads from the reader, failing with ErrReadInactivity if no data arrives for the timeout.
+func (r *inactivityReader) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&r.timedOut) == 1 {
+		return 0, errors.Wrapf(ErrReadInactivity, "stalled for %s", r.timeout)
+	}
+	r.timer.Reset(r.timeout)
+	n, err := r.reader.Read(p)
+	if !r.timer.Stop() && atomic.LoadInt32(&r.timedOut) == 1 {
+		return n, errors.Wrapf(ErrReadInactivity, "stalled for %s", r.timeout)
+	}
+	return n, err
+}
+
+// Close stops the timer and closes the reader.
+func (r *inactivityReader) Close() error {
+	r.timer.Stop()
+	return r.reader.Close()
+}
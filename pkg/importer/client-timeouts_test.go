@@ -0,0 +1,93 @@
+package importer
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+
+	"kubevirt.io/containerized-data-importer/pkg/util/cert"
+)
+
+var _ = Describe("Client timeouts", func() {
+	It("should fill in the default timeouts", func() {
+		timeouts := ClientTimeouts{ReadInactivity: time.Second}.withDefaults()
+		Expect(timeouts.ReadInactivity).To(Equal(time.Second))
+		Expect(timeouts.Dial).To(Equal(DefaultClientTimeouts.Dial))
+		Expect(timeouts.ResponseHeader).To(Equal(DefaultClientTimeouts.ResponseHeader))
+	})
+
+	It("should set the timeouts of the s3 client transport", func() {
+		client, err := getS3Client("s3.us-east-2.amazonaws.com", "", "", "", s3ClientOptions{timeouts: ClientTimeouts{ResponseHeader: 5 * time.Second}})
+		Expect(err).NotTo(HaveOccurred())
+		transport := client.(*s3.S3).Client.Config.HTTPClient.Transport.(*retryAfterTransport).base.(*http.Transport)
+		Expect(transport.ResponseHeaderTimeout).To(Equal(5 * time.Second))
+		Expect(transport.TLSHandshakeTimeout).To(Equal(DefaultClientTimeouts.TLSHandshake))
+		Expect(transport.IdleConnTimeout).To(Equal(DefaultClientTimeouts.IdleConn))
+	})
+
+	It("should fail a read that stalls", func() {
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		reader := newInactivityReader(pr, 100*time.Millisecond)
+		_, err := reader.Read(make([]byte, 10))
+		Expect(errors.Cause(err)).To(Equal(ErrReadInactivity))
+		_, err = reader.Read(make([]byte, 10))
+		Expect(errors.Cause(err)).To(Equal(ErrReadInactivity))
+	})
+
+	It("should not time out between the reads of a slow consumer", func() {
+		reader := newInactivityReader(ioutil.NopCloser(&chunkedReader{data: make([]byte, 8192)}), 50*time.Millisecond)
+		defer reader.Close()
+		buf := make([]byte, 4096)
+		_, err := reader.Read(buf)
+		Expect(err).NotTo(HaveOccurred())
+		time.Sleep(100 * time.Millisecond)
+		_, err = reader.Read(buf)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should abort an s3 object whose body never arrives", func() {
+		stop := make(chan struct{})
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "1048576")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			select {
+			case <-stop:
+			case <-r.Context().Done():
+			}
+		}))
+		defer ts.Close()
+		defer close(stop)
+		certDir, err := ioutil.TempDir("", "timeouts")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(certDir)
+		Expect(ioutil.WriteFile(filepath.Join(certDir, "tls.crt"), cert.EncodeCertPEM(ts.Certificate()), 0644)).To(Succeed())
+		// A CA bundle of the AWS environment would replace the CAs of the client.
+		if awsBundle, ok := os.LookupEnv("AWS_CA_BUNDLE"); ok {
+			os.Unsetenv("AWS_CA_BUNDLE")
+			defer os.Setenv("AWS_CA_BUNDLE", awsBundle)
+		}
+
+		sd, err := NewS3DataSourceWithOptions(ts.URL+"/bucket/disk.raw", "", "", certDir, S3Options{
+			Timeouts: ClientTimeouts{ReadInactivity: 200 * time.Millisecond},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		start := time.Now()
+		_, err = sd.Info()
+		Expect(err).To(HaveOccurred())
+		Expect(errors.Cause(err)).To(Equal(ErrReadInactivity))
+		Expect(time.Since(start)).To(BeNumerically("<", 10*time.Second))
+	})
+})
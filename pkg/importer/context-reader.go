@@ -0,0 +1,66 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// contextReader reads from a reader until the context of the current processing phase is done, so a cancelled phase
+// stops reading the source at the next read.
+type contextReader struct {
+	mutex  sync.Mutex
+	ctx    context.Context
+	reader io.ReadCloser
+}
+
+// newContextReader returns a reader of reader, never cancelled until a context is set.
+func newContextReader(reader io.ReadCloser) *contextReader {
+	return &contextReader{ctx: context.Background(), reader: reader}
+}
+
+// setContext makes the reads fail with the error of ctx once it is done.
+func (r *contextReader) setContext(ctx context.Context) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.ctx = ctx
+}
+
+func (r *contextReader) context() context.Context {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.ctx
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	ctx := r.context()
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF && ctx.Err() != nil {
+		// The read failed because the phase was cancelled.
+		return n, ctx.Err()
+	}
+	return n, err
+}
+
+func (r *contextReader) Close() error {
+	return r.reader.Close()
+}
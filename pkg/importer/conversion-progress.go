@@ -0,0 +1,136 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"k8s.io/klog/v2"
+)
+
+// conversionProgressFile is the name of the progress marker of a segmented conversion, in scratch space.
+const conversionProgressFile = "conversion-progress.json"
+
+// conversionProgress is the progress marker of a segmented conversion. It identifies the source image in scratch
+// space and the target, so a restarted importer only resumes the conversion it interrupted.
+type conversionProgress struct {
+	// Source is the path of the source image.
+	Source string `json:"source"`
+	// SourceSize and SourceModTime identify the content of the source image.
+	SourceSize    int64     `json:"sourceSize"`
+	SourceModTime time.Time `json:"sourceModTime"`
+	// Format is the format of the source image.
+	Format string `json:"format"`
+	// VirtualSize is the virtual size of the source image.
+	VirtualSize int64 `json:"virtualSize"`
+	// Target is the path of the raw image or block device the image is converted into.
+	Target string `json:"target"`
+	// SegmentSize is the size of the segments converted at once.
+	SegmentSize int64 `json:"segmentSize"`
+	// Converted is the number of bytes converted so far, from the start of the virtual disk.
+	Converted int64 `json:"converted"`
+	// ResumeFailures is the number of consecutive resumes that didn't convert a segment, the importers killed while
+	// resuming included.
+	ResumeFailures int `json:"resumeFailures,omitempty"`
+	// CleanRestarted is true if the conversion belongs to an import restarted from a clean slate after failed resumes.
+	CleanRestarted bool `json:"cleanRestarted,omitempty"`
+}
+
+// newConversionProgress returns the progress marker of a conversion of source starting at the beginning.
+func newConversionProgress(source, format string, virtualSize int64, target string, segmentSize int64) (*conversionProgress, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to stat %s", source)
+	}
+	return &conversionProgress{
+		Source:        source,
+		SourceSize:    info.Size(),
+		SourceModTime: info.ModTime().UTC(),
+		Format:        format,
+		VirtualSize:   virtualSize,
+		Target:        target,
+		SegmentSize:   segmentSize,
+	}, nil
+}
+
+// readConversionProgress returns the progress marker in dir, nil if there is none or it doesn't match its source
+// image anymore.
+func readConversionProgress(dir string) *conversionProgress {
+	data, err := ioutil.ReadFile(filepath.Join(dir, conversionProgressFile))
+	if err != nil {
+		return nil
+	}
+	progress := &conversionProgress{}
+	if err := json.Unmarshal(data, progress); err != nil {
+		klog.Warningf("Ignoring invalid conversion progress marker: %v", err)
+		return nil
+	}
+	info, err := os.Stat(progress.Source)
+	if err != nil || info.Size() != progress.SourceSize || !info.ModTime().UTC().Equal(progress.SourceModTime) {
+		klog.Warningf("Ignoring the conversion progress marker of %s, the image changed", progress.Source)
+		return nil
+	}
+	return progress
+}
+
+// write persists the progress marker in dir, replacing the previous marker atomically.
+func (p *conversionProgress) write(dir string) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal the conversion progress")
+	}
+	tmp := filepath.Join(dir, conversionProgressFile+".tmp")
+	file, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrap(err, "unable to create the conversion progress marker")
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "unable to write the conversion progress marker")
+	}
+	return errors.Wrap(os.Rename(tmp, filepath.Join(dir, conversionProgressFile)), "unable to write the conversion progress marker")
+}
+
+// removeConversionProgress removes the progress marker in dir, if any.
+func removeConversionProgress(dir string) error {
+	if err := os.Remove(filepath.Join(dir, conversionProgressFile)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "unable to remove the conversion progress marker")
+	}
+	return nil
+}
+
+// createSparseFile creates the sparse file path of the given size, the segments of a conversion are written into.
+func createSparseFile(path string, size int64) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create %s", path)
+	}
+	defer file.Close()
+	return errors.Wrapf(file.Truncate(size), "unable to resize %s", path)
+}
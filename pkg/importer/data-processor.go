@@ -17,13 +17,18 @@ limitations under the License.
 package importer
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"os"
+	"path/filepath"
 
 	"github.com/pkg/errors"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 
 	"kubevirt.io/containerized-data-importer/pkg/image"
@@ -69,6 +74,34 @@ func (e ValidationSizeError) Error() string { return e.err.Error() }
 // ErrRequiresScratchSpace indicates that we require scratch space.
 var ErrRequiresScratchSpace = fmt.Errorf("scratch space required and none found")
 
+// normalizedFile is the name of the normalized qcow2 image in scratch space.
+const normalizedFile = "normalized.qcow2"
+
+const (
+	// PhaseTransitionEventReason is the reason of the events recorded at processing phase transitions.
+	PhaseTransitionEventReason = "ImportPhaseTransition"
+	// RetryEventReason is the reason of the events recorded when the processing is retried after a failure.
+	RetryEventReason = "ImportRetry"
+)
+
+// overlayBaseFile is the name of the imported image backing the overlay target, next to the data file.
+const overlayBaseFile = "base.img"
+
+// ErrZeroImage indicates that the imported image is blank, which usually means the source was published broken.
+var ErrZeroImage = fmt.Errorf("imported image is all zeroes")
+
+// ErrTooManyAllocatedClusters indicates that the qcow2 image allocates more clusters than allowed, which makes the
+// conversion slow and memory hungry.
+var ErrTooManyAllocatedClusters = fmt.Errorf("qcow2 image has too many allocated clusters")
+
+// ErrSnapshotsNotFlattened indicates that the image converted from a source with internal snapshots still has
+// internal snapshots, which the target can't handle.
+var ErrSnapshotsNotFlattened = fmt.Errorf("internal snapshots of the image were not flattened")
+
+// ErrResumeFailed indicates that the interrupted conversion kept failing to resume, even after the import restarted
+// from a clean slate.
+var ErrResumeFailed = fmt.Errorf("the interrupted conversion failed to resume")
+
 // ErrInvalidPath indicates that the path is invalid.
 var ErrInvalidPath = fmt.Errorf("invalid transfer path")
 
@@ -90,6 +123,18 @@ type DataSourceInterface interface {
 	Close() error
 }
 
+// ContextDataSource is implemented by the data sources whose phases can be cancelled with a context. A cancelled
+// context stops the transfer at the next read of the source, the phase fails with the context error and
+// ProcessingPhaseError.
+type ContextDataSource interface {
+	// InfoContext is Info, cancelled with ctx.
+	InfoContext(ctx context.Context) (ProcessingPhase, error)
+	// TransferContext is Transfer, cancelled with ctx.
+	TransferContext(ctx context.Context, path string) (ProcessingPhase, error)
+	// TransferFileContext is TransferFile, cancelled with ctx.
+	TransferFileContext(ctx context.Context, fileName string) (ProcessingPhase, error)
+}
+
 //ResumableDataSource is the interface all resumeable data sources should implement
 type ResumableDataSource interface {
 	DataSourceInterface
@@ -120,6 +165,69 @@ type DataProcessor struct {
 	preallocation bool
 	// preallocationApplied is used to pass information whether preallocation has been performed, or not
 	preallocationApplied bool
+	// checkImage runs a read only integrity check of the image before converting it
+	checkImage bool
+	// verifyTransfer checks the format and the structure of the image transferred to scratch space before converting it
+	verifyTransfer bool
+	// manifestFile is the file the import manifest is written to at completion, empty if no manifest is requested
+	manifestFile string
+	// detectedFormat is the format of the converted image, recorded for the import manifest
+	detectedFormat string
+	// normalizeQcow2 converts qcow2 sources to a canonical qcow2 image before converting them
+	normalizeQcow2 bool
+	// chunkChecksumSize is the chunk size of the chunk checksums sidecar written next to the data file at
+	// completion, 0 if no sidecar is requested
+	chunkChecksumSize int64
+	// nbdTarget is the NBD export the conversion writes to instead of the data file, nil if not used
+	nbdTarget *url.URL
+	// zeroImageThreshold is the fraction of zeroes from which the imported image is reported as blank, 0 disables
+	// the check
+	zeroImageThreshold float64
+	// failOnZeroImage fails the import of a blank image instead of warning
+	failOnZeroImage bool
+	// zeroImageWarning describes the blank imported image, empty if the image isn't blank
+	zeroImageWarning string
+	// overlayTarget makes the data file a qcow2 overlay backed by the imported image, instead of the imported image
+	overlayTarget bool
+	// maxAllocatedClusters is the number of allocated clusters from which qcow2 images are rejected, 0 is unlimited
+	maxAllocatedClusters int64
+	// eventRecorder records the phase transitions and the retries as events of eventObject, nil if not used
+	eventRecorder record.EventRecorder
+	eventObject   runtime.Object
+	// conversionSegmentSize is the size of the segments of resumable conversions, 0 converts the image at once
+	conversionSegmentSize int64
+	// cleanRestartThreshold is the number of consecutive failed resumes of a conversion after which the import
+	// restarts from a clean slate, 0 resumes indefinitely
+	cleanRestartThreshold int
+	// cleanRestarted is true once the import restarted from a clean slate
+	cleanRestarted bool
+	// pipedConversion writes the images of the sources implementing WriterAtDataSource to the target while they are
+	// downloaded, instead of transferring them to scratch space first
+	pipedConversion bool
+	// checksumAllowlist are the approved source checksums, nil if the source isn't checked against an allowlist
+	checksumAllowlist ChecksumAllowlist
+	// sourceChecksumVerified is true once the source digest was found in the checksum allowlist
+	sourceChecksumVerified bool
+	// signatureVerification verifies the signature of the source data, nil if the signature isn't verified
+	signatureVerification *SignatureVerification
+	// sourceSignatureVerified is true once the signature of the source data was verified
+	sourceSignatureVerified bool
+	// targetPiped is true once the image was written to the target by the piped conversion
+	targetPiped bool
+	// ctx cancels the phases of the sources implementing ContextDataSource, nil if not cancellable
+	ctx context.Context
+	// transferStatsBase is the work of the resumable readers before the processor was created.
+	transferStatsBase TransferStats
+	// progressFunc is called during the transfers of the source, nil if not set
+	progressFunc ProgressFunc
+	// progressService streams the phase and the progress of the import, nil if not used
+	progressService *ProgressService
+	// flushPolicy controls when the files written by the source and the conversion are synced
+	flushPolicy util.FlushPolicy
+	// targetFormat is the format the images are converted to for the target
+	targetFormat string
+	// qemu runs the qemu-img operations, qemuOperations if not set
+	qemu image.QEMUOperations
 }
 
 // NewDataProcessor create a new instance of a data processor using the passed in data provider.
@@ -139,21 +247,228 @@ func NewDataProcessor(dataSource DataSourceInterface, dataFile, dataDir, scratch
 		filesystemOverhead: filesystemOverhead,
 		needsDataCleanup:   needsDataCleanup,
 		preallocation:      preallocation,
+		transferStatsBase:  currentTransferStats(),
+		targetFormat:       image.DefaultTargetFormat,
 	}
 	// Calculate available space before doing anything.
 	dp.availableSpace = dp.calculateTargetSize()
 	return dp
 }
 
+// SetTargetFormat makes the conversion write images of format, as returned by image.ParseTargetFormat, instead of raw
+// images.
+func (dp *DataProcessor) SetTargetFormat(format string) {
+	dp.targetFormat = format
+}
+
+// SetQEMUOperations makes the processor run the qemu-img operations with qemu, for instance the operations returned
+// by image.NewQEMUOperationsWithOptions, instead of the default ones.
+func (dp *DataProcessor) SetQEMUOperations(qemu image.QEMUOperations) {
+	dp.qemu = qemu
+}
+
+// getQEMUOperations returns the qemu-img operations of the processor.
+func (dp *DataProcessor) getQEMUOperations() image.QEMUOperations {
+	if dp.qemu != nil {
+		return dp.qemu
+	}
+	return qemuOperations
+}
+
+// SetImageCheck makes the conversion fail early if a read only qemu-img check finds the source image corrupt.
+func (dp *DataProcessor) SetImageCheck(check bool) {
+	dp.checkImage = check
+}
+
+// SetTransferVerification makes the conversion fail early if the image transferred to scratch space doesn't have the
+// format detected by Info, or if it is a qcow2 image truncated by an incomplete transfer. The check reads the qcow2
+// metadata tables of the image, which takes time on huge images.
+func (dp *DataProcessor) SetTransferVerification(verify bool) {
+	dp.verifyTransfer = verify
+}
+
+// SetManifestFile makes the processor write a manifest of what was imported to fileName at completion.
+func (dp *DataProcessor) SetManifestFile(fileName string) {
+	dp.manifestFile = fileName
+}
+
+// SetQcow2Normalization makes the conversion normalize qcow2 sources to a canonical qcow2 image in scratch space
+// first, so identical logical disks convert from identical images.
+func (dp *DataProcessor) SetQcow2Normalization(normalize bool) {
+	dp.normalizeQcow2 = normalize
+}
+
+// SetChunkChecksums makes the processor write the checksums of every chunkSize bytes of the imported image to a
+// sidecar file next to the data file at completion. A chunkSize of 0 disables the sidecar.
+func (dp *DataProcessor) SetChunkChecksums(chunkSize int64) {
+	dp.chunkChecksumSize = chunkSize
+}
+
+// SetZeroImageCheck makes the processor report an imported image with at least the threshold fraction of zeroes,
+// for instance 1 for entirely zero images, as a likely blank source. The import fails in strict mode, and warns
+// otherwise. A threshold of 0 disables the check.
+func (dp *DataProcessor) SetZeroImageCheck(threshold float64, strict bool) {
+	dp.zeroImageThreshold = threshold
+	dp.failOnZeroImage = strict
+}
+
+// SetNbdTarget makes the conversion write to the NBD export at uri, for instance nbd+unix:///disk?socket=/nbd.sock,
+// instead of the data file. The NBD server manages the size of the export, so the image isn't resized.
+func (dp *DataProcessor) SetNbdTarget(uri string) error {
+	if uri == "" {
+		dp.nbdTarget = nil
+		return nil
+	}
+	target, err := url.Parse(uri)
+	if err != nil {
+		return errors.Wrapf(err, "invalid NBD target %q", uri)
+	}
+	switch target.Scheme {
+	case "nbd", "nbd+tcp", "nbd+unix":
+	default:
+		return errors.Errorf("invalid NBD target %q, unsupported scheme %q", uri, target.Scheme)
+	}
+	dp.nbdTarget = target
+	return nil
+}
+
+// SetOverlayTarget makes the processor import the image into a read only file of the target format next to the data
+// file, and create the data file as a thin qcow2 overlay backed by it, so clones of the target share the imported
+// data. The data file must be on a file system.
+func (dp *DataProcessor) SetOverlayTarget(overlay bool) {
+	dp.overlayTarget = overlay
+}
+
+// SetMaxAllocatedClusters makes the conversion reject local qcow2 images allocating more than max clusters, before
+// qemu-img processes them. A max of 0 is unlimited.
+func (dp *DataProcessor) SetMaxAllocatedClusters(max int64) {
+	dp.maxAllocatedClusters = max
+}
+
+// SetEventRecorder makes the processor record an event of object at every processing phase transition and retry, so
+// describing the object shows the progress of the import. The recorder is expected to rate limit the events.
+func (dp *DataProcessor) SetEventRecorder(recorder record.EventRecorder, object runtime.Object) {
+	dp.eventRecorder = recorder
+	dp.eventObject = object
+}
+
+// SetResumableConversion makes the processor convert images in scratch space in segments of segmentSize bytes,
+// recording the progress in scratch space after every segment. If the importer restarts, it resumes the conversion
+// after the last converted segment instead of starting over. Preallocated targets are converted at once. A
+// segmentSize of 0 converts images at once.
+func (dp *DataProcessor) SetResumableConversion(segmentSize int64) {
+	dp.conversionSegmentSize = segmentSize
+}
+
+// SetCleanRestartThreshold makes the processor discard scratch space and restart the import from the beginning once
+// threshold consecutive resumes of a resumable conversion failed, so a corrupted partial state doesn't fail the
+// resumes forever. The import restarts from a clean slate once, it fails with ErrResumeFailed if the resumes of the
+// restarted import fail threshold times as well. A threshold of 0 resumes indefinitely.
+func (dp *DataProcessor) SetCleanRestartThreshold(threshold int) {
+	dp.cleanRestartThreshold = threshold
+}
+
+// SetPipedConversion makes the processor write the images of the sources implementing WriterAtDataSource to the
+// target while they are downloaded, instead of transferring them to scratch space and converting them afterwards.
+// Raw images, compressed or not, are written as they are read. The images qemu-img converts, and the imports
+// checking, preallocating or overlaying the image, keep going through scratch space.
+func (dp *DataProcessor) SetPipedConversion(piped bool) {
+	dp.pipedConversion = piped
+}
+
+// SetContext makes a cancelled ctx stop the Info and transfer phases of the data sources implementing
+// ContextDataSource.
+func (dp *DataProcessor) SetContext(ctx context.Context) {
+	dp.ctx = ctx
+}
+
+// SetProgressFunc makes the source call fn every second while it transfers, in the Transfer and the TransferFile
+// phases, and once more when the source is read completely. Closing the data source stops the calls, none happens
+// once Close returned. nil disables the calls.
+func (dp *DataProcessor) SetProgressFunc(fn ProgressFunc) {
+	dp.progressFunc = fn
+}
+
+// SetProgressService makes the processor report the phase transitions, the progress of the source and the failure of
+// the import to service.
+func (dp *DataProcessor) SetProgressService(service *ProgressService) {
+	dp.progressService = service
+}
+
+// SetFlushPolicy makes the conversion, and the transfers of the sources implementing flushingDataSource, sync the
+// files they write according to policy. The default policy is used if it has no mode.
+func (dp *DataProcessor) SetFlushPolicy(policy util.FlushPolicy) {
+	dp.flushPolicy = policy
+	if source, ok := dp.source.(flushingDataSource); ok {
+		source.setFlushPolicy(policy)
+	}
+}
+
+// SetChecksumAllowlist makes the processor refuse the source data unless its sha256 digest is in allowlist, as
+// returned by ReadChecksumAllowlist. The sources implementing verifyingDataSource compute the digest while the data is
+// transferred. A nil allowlist disables the check.
+func (dp *DataProcessor) SetChecksumAllowlist(allowlist ChecksumAllowlist) {
+	dp.checksumAllowlist = allowlist
+	if source, ok := dp.source.(verifyingDataSource); ok {
+		source.setSourceDigest(allowlist != nil)
+	}
+}
+
+// SetSignatureVerification makes the processor refuse the source data unless its signature passes verification, as
+// returned by NewSignatureVerification. The sources implementing verifyingDataSource verify the signature while the data
+// is transferred. A nil verification disables the check.
+func (dp *DataProcessor) SetSignatureVerification(verification *SignatureVerification) {
+	dp.signatureVerification = verification
+	if source, ok := dp.source.(verifyingDataSource); ok {
+		source.setSignatureVerification(verification)
+	}
+}
+
 // ProcessData is the main synchronous processing loop
 func (dp *DataProcessor) ProcessData() error {
+	err := dp.processData()
+	stats := dp.GetTransferStats()
+	if err == nil {
+		klog.Infof("Transfer stats: %s", stats)
+	} else if err != ErrRequiresScratchSpace {
+		if stats.Retries > 0 {
+			err = errors.Wrapf(err, "import failed after %s", stats)
+		}
+		dp.progressService.fail(err)
+	}
+	return err
+}
+
+// GetTransferStats returns the retries resuming the reads of the source since the processor was created, the bytes
+// read again and the time spent in backoff.
+func (dp *DataProcessor) GetTransferStats() TransferStats {
+	return currentTransferStats().sub(dp.transferStatsBase)
+}
+
+func (dp *DataProcessor) processData() error {
+	if progress := dp.interruptedConversion(); progress != nil {
+		if dp.cleanRestartThreshold <= 0 || progress.ResumeFailures < dp.cleanRestartThreshold {
+			return dp.resumeConversion(progress)
+		}
+		if progress.CleanRestarted {
+			return errors.Wrapf(ErrResumeFailed, "%d resumes failed in a row after restarting from a clean slate", progress.ResumeFailures)
+		}
+		if err := dp.discardInterruptedConversion(progress); err != nil {
+			return err
+		}
+	}
 	if size, _ := util.GetAvailableSpace(dp.scratchDataDir); size > int64(0) {
 		// Clean up before trying to write, in case a previous attempt left a mess. Note the deferred cleanup is intentional.
-		if err := CleanDir(dp.scratchDataDir); err != nil {
+		if progress := readTransferProgress(dp.scratchDataDir); progress != nil {
+			klog.Infof("Keeping the interrupted transfer of %s in scratch space", progress.Source)
+			if err := cleanDirExcept(dp.scratchDataDir, transferProgressFile, filepath.Base(progress.File)); err != nil {
+				return errors.Wrap(err, "Failure cleaning up temporary scratch space")
+			}
+		} else if err := CleanDir(dp.scratchDataDir); err != nil {
 			return errors.Wrap(err, "Failure cleaning up temporary scratch space")
 		}
 		// Attempt to be a good citizen and clean up my mess at the end.
-		defer CleanDir(dp.scratchDataDir)
+		defer dp.cleanScratchSpace()
 	}
 
 	if size, _ := util.GetAvailableSpace(dp.dataDir); size > int64(0) && dp.needsDataCleanup {
@@ -176,18 +491,71 @@ func (dp *DataProcessor) ProcessDataResume() error {
 	return dp.ProcessDataWithPause()
 }
 
+// sourceInfo calls Info of the source, cancellable with the context of the processor if the source supports it.
+func (dp *DataProcessor) sourceInfo() (ProcessingPhase, error) {
+	var phase ProcessingPhase
+	var err error
+	if source, ok := dp.source.(ContextDataSource); ok && dp.ctx != nil {
+		phase, err = source.InfoContext(dp.ctx)
+	} else {
+		phase, err = dp.source.Info()
+	}
+	if err == nil {
+		dp.trackProgress()
+	}
+	return phase, err
+}
+
+// trackProgress reports the progress of the format readers created by Info to the progress service and the progress
+// func.
+func (dp *DataProcessor) trackProgress() {
+	source, ok := dp.source.(readersSource)
+	if !ok {
+		return
+	}
+	readers := source.formatReaders()
+	if readers == nil || readers.progressReader == nil {
+		return
+	}
+	dp.progressService.trackProgress(readers.progressReader)
+	readers.progressFunc = dp.progressFunc
+}
+
+// sourceTransfer calls Transfer of the source, cancellable with the context of the processor if the source supports
+// it.
+func (dp *DataProcessor) sourceTransfer(path string) (ProcessingPhase, error) {
+	if source, ok := dp.source.(ContextDataSource); ok && dp.ctx != nil {
+		return source.TransferContext(dp.ctx, path)
+	}
+	return dp.source.Transfer(path)
+}
+
+// sourceTransferFile calls TransferFile of the source, cancellable with the context of the processor if the source
+// supports it.
+func (dp *DataProcessor) sourceTransferFile(fileName string) (ProcessingPhase, error) {
+	if source, ok := dp.source.(ContextDataSource); ok && dp.ctx != nil {
+		return source.TransferFileContext(dp.ctx, fileName)
+	}
+	return dp.source.TransferFile(fileName)
+}
+
 // ProcessDataWithPause is the main processing loop.
 func (dp *DataProcessor) ProcessDataWithPause() error {
 	var err error
 	for dp.currentPhase != ProcessingPhaseComplete && dp.currentPhase != ProcessingPhasePause {
+		previousPhase := dp.currentPhase
+		timer := startPhaseTimer()
 		switch dp.currentPhase {
 		case ProcessingPhaseInfo:
-			dp.currentPhase, err = dp.source.Info()
+			dp.currentPhase, err = dp.sourceInfo()
 			if err != nil {
 				err = errors.Wrap(err, "Unable to obtain information about data source")
+			} else if dp.currentPhase == ProcessingPhaseTransferDataFile && dp.targetFormat != "raw" {
+				// Raw images are converted to the target format from scratch space.
+				dp.currentPhase = ProcessingPhaseTransferScratch
 			}
 		case ProcessingPhaseTransferScratch:
-			dp.currentPhase, err = dp.source.Transfer(dp.scratchDataDir)
+			dp.currentPhase, err = dp.transferScratch()
 			if err == ErrInvalidPath {
 				// Passed in invalid scratch space path, return scratch space needed error.
 				err = ErrRequiresScratchSpace
@@ -195,12 +563,12 @@ func (dp *DataProcessor) ProcessDataWithPause() error {
 				err = errors.Wrap(err, "Unable to transfer source data to scratch space")
 			}
 		case ProcessingPhaseTransferDataDir:
-			dp.currentPhase, err = dp.source.Transfer(dp.dataDir)
+			dp.currentPhase, err = dp.sourceTransfer(dp.dataDir)
 			if err != nil {
 				err = errors.Wrap(err, "Unable to transfer source data to target directory")
 			}
 		case ProcessingPhaseTransferDataFile:
-			dp.currentPhase, err = dp.source.TransferFile(dp.dataFile)
+			dp.currentPhase, err = dp.sourceTransferFile(dp.dataFile)
 			if err != nil {
 				err = errors.Wrap(err, "Unable to transfer source data to target file")
 			}
@@ -213,10 +581,15 @@ func (dp *DataProcessor) ProcessDataWithPause() error {
 			dp.currentPhase = ProcessingPhasePause
 		case ProcessingPhaseConvert:
 			dp.currentPhase, err = dp.convert(dp.source.GetURL())
-			if err != nil {
+			if err != nil && err != ErrRequiresScratchSpace {
 				err = errors.Wrap(err, "Unable to convert source data to target format")
 			}
 		case ProcessingPhaseResize:
+			if dp.zeroImageThreshold > 0 {
+				if err = dp.checkZeroImage(); err != nil {
+					break
+				}
+			}
 			dp.currentPhase, err = dp.resize()
 			if err != nil {
 				err = errors.Wrap(err, "Unable to resize disk image to requested size")
@@ -224,48 +597,489 @@ func (dp *DataProcessor) ProcessDataWithPause() error {
 		default:
 			return errors.Errorf("Unknown processing phase %s", dp.currentPhase)
 		}
+		if err == nil {
+			if err = dp.checkSourceChecksum(); err == nil {
+				err = dp.checkSourceSignature()
+			}
+			if err != nil {
+				dp.discardTarget(previousPhase)
+			}
+		}
 		if err != nil {
 			klog.Errorf("%+v", err)
 			return err
 		}
+		timer.record(previousPhase)
 		klog.V(1).Infof("New phase: %s\n", dp.currentPhase)
+		dp.recordEvent(corev1.EventTypeNormal, PhaseTransitionEventReason, "Import phase %s -> %s", previousPhase, dp.currentPhase)
+		dp.progressService.setPhase(dp.currentPhase)
+	}
+	if dp.currentPhase == ProcessingPhaseComplete && dp.manifestFile != "" {
+		if err = dp.writeManifest(); err != nil {
+			klog.Errorf("%+v", err)
+			return err
+		}
+	}
+	if dp.currentPhase == ProcessingPhaseComplete && dp.chunkChecksumSize > 0 {
+		if err = dp.writeChunkChecksums(); err != nil {
+			klog.Errorf("%+v", err)
+			return err
+		}
 	}
 	return err
 }
 
 func (dp *DataProcessor) validate(url *url.URL) error {
 	klog.V(1).Infoln("Validating image")
-	err := qemuOperations.Validate(url, dp.availableSpace, dp.filesystemOverhead)
+	err := dp.getQEMUOperations().Validate(url, dp.availableSpace, dp.filesystemOverhead)
 	if err != nil {
 		return ValidationSizeError{err: err}
 	}
 	return nil
 }
 
-// convert is called when convert the image from the url to a RAW disk image. Source formats include RAW/QCOW2 (Raw to raw conversion is a copy)
+// convert is called when convert the image from the url to a disk image of the target format. Source formats include RAW/QCOW2 (Raw to raw conversion is a copy)
 func (dp *DataProcessor) convert(url *url.URL) (ProcessingPhase, error) {
+	if dp.verifyTransfer {
+		klog.V(1).Infoln("Verifying the transferred image")
+		if err := verifyTransferredImage(url, dp.sourceFormat()); err != nil {
+			return ProcessingPhaseError, err
+		}
+	}
 	err := dp.validate(url)
 	if err != nil {
 		return ProcessingPhaseError, err
 	}
-	klog.V(3).Infoln("Converting to Raw")
-	err = qemuOperations.ConvertToRawStream(url, dp.dataFile, dp.preallocation)
+	if dp.maxAllocatedClusters > 0 {
+		if err = dp.checkAllocatedClusters(url); err != nil {
+			return ProcessingPhaseError, err
+		}
+	}
+	if dp.checkImage {
+		klog.V(1).Infoln("Checking image integrity")
+		if err = dp.getQEMUOperations().Check(url); err != nil {
+			return ProcessingPhaseError, errors.Wrap(err, "Image integrity check failed")
+		}
+	}
+	if dp.manifestFile != "" {
+		info, err := dp.getQEMUOperations().Info(url)
+		if err != nil {
+			return ProcessingPhaseError, errors.Wrap(err, "Unable to detect image format")
+		}
+		dp.detectedFormat = info.Format
+	}
+	if dp.nbdTarget != nil && dp.targetFormat != "raw" {
+		return ProcessingPhaseError, errors.Errorf("A %s target format can't be written to an NBD target", dp.targetFormat)
+	}
+	if dp.overlayTarget {
+		if dp.nbdTarget != nil {
+			return ProcessingPhaseError, errors.New("An overlay target can't be written to an NBD target")
+		}
+		if size, _ := getAvailableSpaceBlockFunc(dp.dataFile); size >= int64(0) {
+			return ProcessingPhaseError, errors.Errorf("An overlay target requires a file system, %s is a block device", dp.dataFile)
+		}
+	}
+	if dp.nbdTarget == nil && dp.targetFormat != "raw" {
+		if size, _ := getAvailableSpaceBlockFunc(dp.dataFile); size >= int64(0) {
+			return ProcessingPhaseError, errors.Errorf("A %s target format requires a file system, %s is a block device", dp.targetFormat, dp.dataFile)
+		}
+	}
+	snapshots := dp.sourceSnapshots()
+	if snapshots > 0 {
+		// qemu-img converts the active state of the image only.
+		klog.Infof("Flattening %d internal snapshots of the image", snapshots)
+	}
+	if dp.normalizeQcow2 {
+		if url, err = dp.normalize(url); err != nil {
+			return ProcessingPhaseError, err
+		}
+	}
+	if dp.nbdTarget != nil {
+		klog.V(3).Infof("Converting to Raw NBD target %s", dp.nbdTarget)
+		if err = dp.getQEMUOperations().ConvertToNbd(url, dp.nbdTarget); err != nil {
+			return ProcessingPhaseError, errors.Wrap(err, "Conversion to Raw NBD target failed")
+		}
+		return ProcessingPhaseComplete, nil
+	}
+	if dp.segmentedConversion(url) {
+		return dp.startSegmentedConversion(url)
+	}
+	formatName := dp.targetFormat
+	if formatName == "raw" {
+		formatName = "Raw"
+	}
+	klog.V(3).Infof("Converting to %s", formatName)
+	err = dp.getQEMUOperations().ConvertToFormatStream(url, dp.imageFile(), dp.targetFormat, dp.preallocation, dp.flushPolicy)
 	if err != nil {
-		return ProcessingPhaseError, errors.Wrap(err, "Conversion to Raw failed")
+		return ProcessingPhaseError, errors.Wrapf(err, "Conversion to %s failed", formatName)
+	}
+	if err = dp.verifyFlattened(snapshots); err != nil {
+		return ProcessingPhaseError, err
 	}
 	dp.preallocationApplied = dp.preallocation
 
 	return ProcessingPhaseResize, nil
 }
 
+// verifyFlattened fails with ErrSnapshotsNotFlattened if the image converted from a source with snapshots internal
+// snapshots has internal snapshots. Only a qcow2 target format can keep them, raw images have none.
+func (dp *DataProcessor) verifyFlattened(snapshots int) error {
+	if snapshots == 0 || dp.targetFormat == "raw" {
+		return nil
+	}
+	imageURL, err := url.Parse(dp.imageFile())
+	if err != nil {
+		return err
+	}
+	info, err := dp.getQEMUOperations().Info(imageURL)
+	if err != nil {
+		return errors.Wrap(err, "Unable to check the snapshots of the converted image")
+	}
+	if len(info.Snapshots) > 0 {
+		return errors.Wrapf(ErrSnapshotsNotFlattened, "%d of the %d internal snapshots of the source are left", len(info.Snapshots), snapshots)
+	}
+	return nil
+}
+
+// sourceFormat returns the image format Info detected in the source data, empty if unknown or raw.
+func (dp *DataProcessor) sourceFormat() string {
+	source, ok := dp.source.(probedSource)
+	if !ok {
+		return ""
+	}
+	if readers, _ := source.probe(); readers != nil {
+		return readers.Format
+	}
+	return ""
+}
+
+// sourceSnapshots returns the number of internal snapshots of the qcow2 image Info found in the source data, 0 if none
+// or unknown.
+func (dp *DataProcessor) sourceSnapshots() int {
+	source, ok := dp.source.(probedSource)
+	if !ok {
+		return 0
+	}
+	if readers, _ := source.probe(); readers != nil {
+		return readers.Snapshots
+	}
+	return 0
+}
+
+// GetRawLayout returns the layout of the raw disk Info found in the source data, RawLayoutMBR, RawLayoutGPT or
+// RawLayoutFilesystem. Empty if the image isn't raw, the layout isn't recognized or the source can't tell.
+func (dp *DataProcessor) GetRawLayout() string {
+	source, ok := dp.source.(probedSource)
+	if !ok {
+		return ""
+	}
+	if readers, _ := source.probe(); readers != nil {
+		return readers.RawLayout
+	}
+	return ""
+}
+
+// checkSourceChecksum verifies the source digest against the checksum allowlist once the source data was transferred,
+// before the data is processed any further.
+func (dp *DataProcessor) checkSourceChecksum() error {
+	if dp.checksumAllowlist == nil || dp.sourceChecksumVerified {
+		return nil
+	}
+	switch dp.currentPhase {
+	case ProcessingPhaseValidatePause, ProcessingPhasePause, ProcessingPhaseConvert, ProcessingPhaseResize, ProcessingPhaseComplete:
+	default:
+		return nil
+	}
+	if err := verifyChecksumAllowlist(dp.source, dp.checksumAllowlist); err != nil {
+		dp.currentPhase = ProcessingPhaseError
+		return err
+	}
+	dp.sourceChecksumVerified = true
+	return nil
+}
+
+// checkSourceSignature verifies the signature of the source data once it was transferred, before the data is
+// processed any further.
+func (dp *DataProcessor) checkSourceSignature() error {
+	if dp.signatureVerification == nil || dp.sourceSignatureVerified {
+		return nil
+	}
+	switch dp.currentPhase {
+	case ProcessingPhaseValidatePause, ProcessingPhasePause, ProcessingPhaseConvert, ProcessingPhaseResize, ProcessingPhaseComplete:
+	default:
+		return nil
+	}
+	if err := verifySourceSignature(dp.source); err != nil {
+		dp.currentPhase = ProcessingPhaseError
+		return err
+	}
+	dp.sourceSignatureVerified = true
+	return nil
+}
+
+// discardTarget wipes the data written to the target in phase by a source failing the verification, which is only
+// complete once the transfer is. The files and the contents of the target directory are removed, block devices are
+// zeroed.
+func (dp *DataProcessor) discardTarget(phase ProcessingPhase) {
+	var err error
+	switch {
+	case phase == ProcessingPhaseTransferDataDir:
+		klog.Warningf("Removing the unverified data written to %s", dp.dataDir)
+		err = CleanDir(dp.dataDir)
+	case phase == ProcessingPhaseTransferDataFile || (phase == ProcessingPhaseTransferScratch && dp.targetPiped):
+		target := dp.dataFile
+		if dp.targetPiped {
+			target = dp.imageFile()
+		}
+		klog.Warningf("Wiping the unverified data written to %s", target)
+		if size, _ := getAvailableSpaceBlockFunc(target); size >= int64(0) {
+			err = zeroTarget(target, size)
+		} else if err = os.Remove(target); os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		klog.Errorf("Unable to wipe the unverified data written to the target: %v", err)
+	}
+}
+
+// zeroTarget writes size bytes of zeroes to the block device target.
+func zeroTarget(target string, size int64) error {
+	file, err := os.OpenFile(target, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	zeroes := make([]byte, 1024*1024)
+	for offset := int64(0); offset < size; offset += int64(len(zeroes)) {
+		if remaining := size - offset; remaining < int64(len(zeroes)) {
+			zeroes = zeroes[:remaining]
+		}
+		if _, err = file.WriteAt(zeroes, offset); err != nil {
+			return err
+		}
+	}
+	return file.Sync()
+}
+
+// segmentedConversion returns true if the image at url is converted in resumable segments. Only the images in scratch
+// space outlive the importer.
+func (dp *DataProcessor) segmentedConversion(url *url.URL) bool {
+	return dp.conversionSegmentSize > 0 && !dp.preallocation && dp.targetFormat == "raw" && url.Scheme == "" &&
+		filepath.Dir(url.Path) == filepath.Clean(dp.scratchDataDir)
+}
+
+// startSegmentedConversion prepares the target and the progress marker of the conversion of the image at url, and
+// converts it segment by segment.
+func (dp *DataProcessor) startSegmentedConversion(url *url.URL) (ProcessingPhase, error) {
+	info, err := dp.getQEMUOperations().Info(url)
+	if err != nil {
+		return ProcessingPhaseError, errors.Wrap(err, "Unable to detect image format")
+	}
+	progress, err := newConversionProgress(url.Path, info.Format, info.VirtualSize, dp.imageFile(), dp.conversionSegmentSize)
+	if err != nil {
+		return ProcessingPhaseError, err
+	}
+	progress.CleanRestarted = dp.cleanRestarted
+	if size, _ := getAvailableSpaceBlockFunc(progress.Target); size < int64(0) {
+		// The segments are written into a sparse file of the size of the image.
+		if err = createSparseFile(progress.Target, progress.VirtualSize); err != nil {
+			return ProcessingPhaseError, err
+		}
+	}
+	if err = progress.write(dp.scratchDataDir); err != nil {
+		return ProcessingPhaseError, err
+	}
+	return dp.convertSegments(progress)
+}
+
+// convertSegments converts the segments of the image following the last converted segment, and records the progress
+// after every segment.
+func (dp *DataProcessor) convertSegments(progress *conversionProgress) (ProcessingPhase, error) {
+	for progress.Converted < progress.VirtualSize {
+		length := progress.VirtualSize - progress.Converted
+		if length > progress.SegmentSize {
+			length = progress.SegmentSize
+		}
+		klog.V(1).Infof("Converting segment %d+%d of %d", progress.Converted, length, progress.VirtualSize)
+		if err := dp.getQEMUOperations().ConvertSegmentToRaw(progress.Source, progress.Format, progress.Target, progress.Converted, length,
+			dp.flushPolicy); err != nil {
+			return ProcessingPhaseError, errors.Wrap(err, "Conversion to Raw failed")
+		}
+		progress.Converted += length
+		progress.ResumeFailures = 0
+		if err := progress.write(dp.scratchDataDir); err != nil {
+			return ProcessingPhaseError, err
+		}
+	}
+	if err := removeConversionProgress(dp.scratchDataDir); err != nil {
+		return ProcessingPhaseError, err
+	}
+	return ProcessingPhaseResize, nil
+}
+
+// interruptedConversion returns the progress of the segmented conversion to the target interrupted by a previous
+// importer, nil if there is none.
+func (dp *DataProcessor) interruptedConversion() *conversionProgress {
+	if dp.conversionSegmentSize <= 0 {
+		return nil
+	}
+	progress := readConversionProgress(dp.scratchDataDir)
+	if progress == nil || progress.Target != dp.imageFile() || progress.SegmentSize != dp.conversionSegmentSize {
+		return nil
+	}
+	return progress
+}
+
+// resumeConversion resumes the segmented conversion interrupted by a previous importer, and processes the converted
+// image. The image was transferred and checked by the previous importer, neither scratch space nor the target are
+// cleaned up first.
+func (dp *DataProcessor) resumeConversion(progress *conversionProgress) error {
+	klog.Infof("Resuming the conversion of %s at offset %d of %d", progress.Source, progress.Converted, progress.VirtualSize)
+	dp.recordEvent(corev1.EventTypeWarning, RetryEventReason, "Resuming the conversion at offset %d of %d", progress.Converted, progress.VirtualSize)
+	defer dp.cleanScratchSpace()
+	// The resume counts as failed until a segment is converted, so importers killed while resuming count as well.
+	progress.ResumeFailures++
+	if err := progress.write(dp.scratchDataDir); err != nil {
+		klog.Errorf("%+v", err)
+		return err
+	}
+	dp.cleanRestarted = progress.CleanRestarted
+	dp.detectedFormat = progress.Format
+	// The conversion only starts once the source data passed the checks.
+	dp.sourceChecksumVerified = true
+	dp.sourceSignatureVerified = true
+	var err error
+	dp.currentPhase, err = dp.convertSegments(progress)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to convert source data to target format")
+		klog.Errorf("%+v", err)
+		return err
+	}
+	return dp.ProcessDataWithPause()
+}
+
+// discardInterruptedConversion discards scratch space and the partially converted target of the conversion whose
+// resumes kept failing, so the import restarts from the beginning.
+func (dp *DataProcessor) discardInterruptedConversion(progress *conversionProgress) error {
+	klog.Warningf("Resuming the conversion failed %d times in a row, restarting the import from a clean slate", progress.ResumeFailures)
+	dp.recordEvent(corev1.EventTypeWarning, RetryEventReason, "Resuming the conversion failed %d times in a row, restarting the import from a clean slate", progress.ResumeFailures)
+	if err := CleanDir(dp.scratchDataDir); err != nil {
+		return errors.Wrap(err, "Failure cleaning up temporary scratch space")
+	}
+	if size, _ := getAvailableSpaceBlockFunc(progress.Target); size < int64(0) {
+		if err := os.Remove(progress.Target); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "Failure removing the partially converted image")
+		}
+	}
+	dp.cleanRestarted = true
+	return nil
+}
+
+// cleanScratchSpace removes the content of scratch space, unless it holds an interrupted conversion or transfer the
+// restarted importer resumes.
+func (dp *DataProcessor) cleanScratchSpace() {
+	if dp.interruptedConversion() != nil {
+		klog.Infof("Keeping scratch space to resume the conversion")
+		return
+	}
+	if readTransferProgress(dp.scratchDataDir) != nil {
+		klog.Infof("Keeping scratch space to resume the transfer")
+		return
+	}
+	CleanDir(dp.scratchDataDir)
+}
+
+// checkAllocatedClusters counts the clusters allocated by the qcow2 metadata of a local image. Images qemu-img reads
+// remotely are skipped.
+func (dp *DataProcessor) checkAllocatedClusters(source *url.URL) error {
+	if source.Scheme != "" {
+		klog.V(1).Infof("Not counting the allocated clusters of remote image %s", source.Host)
+		return nil
+	}
+	count, err := image.CountQcow2AllocatedClusters(source.Path, dp.maxAllocatedClusters)
+	if err != nil {
+		return errors.Wrap(err, "Unable to count the allocated clusters of the image")
+	}
+	if count > dp.maxAllocatedClusters {
+		return errors.Wrapf(ErrTooManyAllocatedClusters, "more than %d clusters are allocated", dp.maxAllocatedClusters)
+	}
+	return nil
+}
+
+// normalize converts a qcow2 source to a canonical qcow2 image in scratch space, and returns the url of the
+// normalized image. Other formats are returned as is.
+func (dp *DataProcessor) normalize(source *url.URL) (*url.URL, error) {
+	info, err := dp.getQEMUOperations().Info(source)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to detect image format")
+	}
+	if info.Format != "qcow2" {
+		return source, nil
+	}
+	if size, _ := util.GetAvailableSpace(dp.scratchDataDir); size <= int64(0) {
+		return nil, ErrRequiresScratchSpace
+	}
+	dest := filepath.Join(dp.scratchDataDir, normalizedFile)
+	klog.V(1).Infof("Normalizing qcow2 image to %s", dest)
+	if err := dp.getQEMUOperations().Normalize(source, dest); err != nil {
+		return nil, errors.Wrap(err, "Normalization of qcow2 image failed")
+	}
+	return url.Parse(dest)
+}
+
+// imageFile returns the file the image is converted to, the backing file of the overlay target if requested.
+func (dp *DataProcessor) imageFile() string {
+	if dp.overlayTarget {
+		return filepath.Join(filepath.Dir(dp.dataFile), overlayBaseFile)
+	}
+	return dp.dataFile
+}
+
+// createOverlay makes the converted image read only, and creates the data file as a qcow2 overlay backed by it. The
+// overlay has the requested size if it is larger than the image.
+func (dp *DataProcessor) createOverlay() (ProcessingPhase, error) {
+	baseFile := dp.imageFile()
+	if err := os.Chmod(baseFile, 0440); err != nil {
+		return ProcessingPhaseError, errors.Wrap(err, "Unable to make the overlay backing file read only")
+	}
+	var size *resource.Quantity
+	if dp.requestImageSize != "" {
+		baseFileURL, err := url.Parse(baseFile)
+		if err != nil {
+			return ProcessingPhaseError, err
+		}
+		info, err := dp.getQEMUOperations().Info(baseFileURL)
+		if err != nil {
+			return ProcessingPhaseError, errors.Wrap(err, "Unable to get the size of the overlay backing file")
+		}
+		requestedSize := resource.MustParse(dp.requestImageSize)
+		if requestedSize.CmpInt64(info.VirtualSize) > 0 {
+			size = &requestedSize
+		}
+	}
+	klog.V(1).Infof("Creating overlay %s backed by %s", dp.dataFile, baseFile)
+	// The backing file is referenced relative to the overlay, the volume is mounted at other paths by its consumers.
+	if err := dp.getQEMUOperations().CreateOverlay(overlayBaseFile, dp.targetFormat, dp.dataFile, size); err != nil {
+		return ProcessingPhaseError, errors.Wrap(err, "Creation of overlay failed")
+	}
+	if err := os.Chmod(dp.dataFile, 0660); err != nil {
+		return ProcessingPhaseError, errors.Wrap(err, "Unable to change permissions of target file")
+	}
+	return ProcessingPhaseComplete, nil
+}
+
 func (dp *DataProcessor) resize() (ProcessingPhase, error) {
+	if dp.overlayTarget {
+		return dp.createOverlay()
+	}
 	size, _ := getAvailableSpaceBlockFunc(dp.dataFile)
 	klog.V(3).Infof("Available space in dataFile: %d", size)
 	isBlockDev := size >= int64(0)
 	if !isBlockDev {
 		if dp.requestImageSize != "" {
 			klog.V(3).Infoln("Resizing image")
-			err := ResizeImage(dp.dataFile, dp.requestImageSize, dp.getUsableSpace(), dp.preallocation)
+			err := resizeImage(dp.getQEMUOperations(), dp.dataFile, dp.targetFormat, dp.requestImageSize, dp.getUsableSpace(), dp.preallocation)
 			if err != nil {
 				return ProcessingPhaseError, errors.Wrap(err, "Resize of image failed")
 			}
@@ -294,10 +1108,14 @@ func (dp *DataProcessor) resize() (ProcessingPhase, error) {
 
 // ResizeImage resizes the images to match the requested size. Sometimes provisioners misbehave and the available space
 // is not the same as the requested space. For those situations we compare the available space to the requested space and
-// use the smallest of the two values.
-func ResizeImage(dataFile, imageSize string, totalTargetSpace int64, preallocation bool) error {
+// use the smallest of the two values. The image has the given format.
+func ResizeImage(dataFile, format, imageSize string, totalTargetSpace int64, preallocation bool) error {
+	return resizeImage(qemuOperations, dataFile, format, imageSize, totalTargetSpace, preallocation)
+}
+
+func resizeImage(qemu image.QEMUOperations, dataFile, format, imageSize string, totalTargetSpace int64, preallocation bool) error {
 	dataFileURL, _ := url.Parse(dataFile)
-	info, err := qemuOperations.Info(dataFileURL)
+	info, err := qemu.Info(dataFileURL)
 	if err != nil {
 		return err
 	}
@@ -314,7 +1132,7 @@ func ResizeImage(dataFile, imageSize string, totalTargetSpace int64, preallocati
 			return nil
 		}
 		klog.V(1).Infof("Expanding image size to: %s\n", minSizeQuantity.String())
-		return qemuOperations.Resize(dataFile, minSizeQuantity, preallocation)
+		return qemu.ResizeFormat(dataFile, format, minSizeQuantity, preallocation)
 	}
 	return errors.New("Image resize called with blank resize")
 }
@@ -350,6 +1168,87 @@ func (dp *DataProcessor) calculateTargetSize() int64 {
 	return targetSize
 }
 
+// writeManifest writes the manifest of the completed import, describing the source, the transforms, the formats
+// and the checksum of the target.
+func (dp *DataProcessor) writeManifest() error {
+	manifest := newImportManifest()
+	if source, ok := dp.source.(manifestSource); ok {
+		source.addToManifest(manifest)
+	}
+	if metadata := GetSourceMetadata(dp.source); len(metadata) > 0 {
+		manifest.Source.Metadata = metadata
+	}
+	manifest.DetectedFormat = dp.detectedFormat
+	if dp.nbdTarget != nil {
+		// The NBD export isn't read back, it may be large or only writable.
+		manifest.TargetFormat = formatRaw
+	} else if dp.dataFile != "" {
+		manifest.TargetFormat = dp.targetFormat
+		checksum, size, err := checksumFile(dp.imageFile())
+		if err != nil {
+			return errors.Wrap(err, "Unable to checksum target file")
+		}
+		manifest.Checksum = checksum
+		manifest.TargetSize = size
+	}
+	return writeImportManifest(manifest, dp.manifestFile)
+}
+
+// writeChunkChecksums writes the chunk checksums sidecar of the imported image. Block devices have no place for a sidecar
+// and are skipped.
+func (dp *DataProcessor) writeChunkChecksums() error {
+	if dp.dataFile == "" || dp.nbdTarget != nil {
+		klog.Warningf("No data file to write chunk checksums of")
+		return nil
+	}
+	if size, _ := getAvailableSpaceBlockFunc(dp.dataFile); size >= int64(0) {
+		klog.Warningf("Not writing chunk checksums of block device %s", dp.dataFile)
+		return nil
+	}
+	if err := writeChunkChecksums(dp.imageFile(), dp.chunkChecksumSize); err != nil {
+		return errors.Wrap(err, "Unable to write chunk checksums")
+	}
+	return nil
+}
+
+// checkZeroImage scans the data file for zeroes before it is resized, so the zeroes only come from the source.
+// Sparse data files are scanned quickly, holes aren't read. Block devices may be larger than the image and are
+// skipped.
+func (dp *DataProcessor) checkZeroImage() error {
+	if dp.dataFile == "" {
+		return nil
+	}
+	if size, _ := getAvailableSpaceBlockFunc(dp.dataFile); size >= int64(0) {
+		klog.V(1).Infof("Not checking block device %s for zeroes", dp.dataFile)
+		return nil
+	}
+	zeroes, size, err := util.CountZeroBytes(dp.imageFile())
+	if err != nil {
+		return errors.Wrap(err, "Unable to check the image for zeroes")
+	}
+	if size == 0 || float64(zeroes)/float64(size) < dp.zeroImageThreshold {
+		return nil
+	}
+	if dp.failOnZeroImage {
+		return errors.Wrapf(ErrZeroImage, "%d of %d bytes are zero", zeroes, size)
+	}
+	dp.zeroImageWarning = fmt.Sprintf("Warning: %d of %d bytes of the imported image are zero, the source is likely blank", zeroes, size)
+	klog.Warning(dp.zeroImageWarning)
+	return nil
+}
+
+// ZeroImageWarning returns the warning about a blank imported image, empty if the image isn't blank.
+func (dp *DataProcessor) ZeroImageWarning() string {
+	return dp.zeroImageWarning
+}
+
+// recordEvent records an event of the event object, if an event recorder is set.
+func (dp *DataProcessor) recordEvent(eventType, reason, messageFmt string, args ...interface{}) {
+	if dp.eventRecorder != nil {
+		dp.eventRecorder.Eventf(dp.eventObject, eventType, reason, messageFmt, args...)
+	}
+}
+
 // PreallocationApplied returns true if data processing path included preallocation step
 func (dp *DataProcessor) PreallocationApplied() bool {
 	return dp.preallocationApplied
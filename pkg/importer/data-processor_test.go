@@ -1,19 +1,28 @@
 package importer
 
 import (
+	"bytes"
+	"encoding/binary"
+	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	"github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/pkg/errors"
 
 	"kubevirt.io/containerized-data-importer/pkg/image"
+	"kubevirt.io/containerized-data-importer/pkg/util"
 )
 
 type fakeInfoOpRetVal struct {
@@ -272,6 +281,21 @@ var _ = Describe("Convert", func() {
 		})
 	})
 
+	It("Should run the qemu operations of the processor", func() {
+		url, err := url.Parse("http://fakeurl-notreal.fake")
+		Expect(err).ToNot(HaveOccurred())
+		mdp := &MockDataProvider{
+			url: url,
+		}
+		dp := NewDataProcessor(mdp, "dest", "dataDir", "scratchDataDir", "1G", 0.055, false)
+		dp.SetQEMUOperations(NewFakeQEMUOperations(nil, nil, fakeInfoOpRetVal{&fakeZeroImageInfo, errors.New("Scratch space required, and none found ")}, nil, nil, nil))
+		replaceQEMUOperations(NewQEMUAllErrors(), func() {
+			nextPhase, err := dp.convert(mdp.GetURL())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ProcessingPhaseResize).To(Equal(nextPhase))
+		})
+	})
+
 	It("Should fail when validation fails and return Error", func() {
 		url, err := url.Parse("http://fakeurl-notreal.fake")
 		Expect(err).ToNot(HaveOccurred())
@@ -301,6 +325,582 @@ var _ = Describe("Convert", func() {
 			Expect(ProcessingPhaseError).To(Equal(nextPhase))
 		})
 	})
+
+	It("Should fail before conversion when the image check finds a corrupt image", func() {
+		url, err := url.Parse("http://fakeurl-notreal.fake")
+		Expect(err).ToNot(HaveOccurred())
+		mdp := &MockDataProvider{
+			url: url,
+		}
+		dp := NewDataProcessor(mdp, "dest", "dataDir", "scratchDataDir", "1G", 0.055, false)
+		dp.SetImageCheck(true)
+		qemuOperations := &fakeCorruptQEMUOperations{QEMUOperations: NewFakeQEMUOperations(errors.New("corrupt image should not be converted"), nil, fakeInfoOpRetVal{&fakeZeroImageInfo, nil}, nil, nil, nil)}
+		replaceQEMUOperations(qemuOperations, func() {
+			nextPhase, err := dp.convert(mdp.GetURL())
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("L2 table is not cluster aligned"))
+			Expect(ProcessingPhaseError).To(Equal(nextPhase))
+		})
+	})
+
+	It("Should not check the image by default", func() {
+		url, err := url.Parse("http://fakeurl-notreal.fake")
+		Expect(err).ToNot(HaveOccurred())
+		mdp := &MockDataProvider{
+			url: url,
+		}
+		dp := NewDataProcessor(mdp, "dest", "dataDir", "scratchDataDir", "1G", 0.055, false)
+		qemuOperations := &fakeCorruptQEMUOperations{QEMUOperations: NewFakeQEMUOperations(nil, nil, fakeInfoOpRetVal{&fakeZeroImageInfo, nil}, nil, nil, nil)}
+		replaceQEMUOperations(qemuOperations, func() {
+			nextPhase, err := dp.convert(mdp.GetURL())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ProcessingPhaseResize).To(Equal(nextPhase))
+			Expect(qemuOperations.checked).To(BeFalse())
+		})
+	})
+})
+
+var _ = Describe("Normalize", func() {
+	var scratchDir string
+
+	BeforeEach(func() {
+		var err error
+		scratchDir, err = ioutil.TempDir("", "scratch")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(scratchDir)
+	})
+
+	table.DescribeTable("Should convert", func(format string, normalize, wantNormalized bool) {
+		url, err := url.Parse(filepath.Join(scratchDir, tempFile))
+		Expect(err).ToNot(HaveOccurred())
+		mdp := &MockDataProvider{
+			url: url,
+		}
+		dp := NewDataProcessor(mdp, "dest", "dataDir", scratchDir, "1G", 0.055, false)
+		dp.SetQcow2Normalization(normalize)
+		qemuOperations := &fakeNormalizeQEMUOperations{QEMUOperations: NewFakeQEMUOperations(nil, nil, fakeInfoRet, nil, nil, nil), format: format}
+		replaceQEMUOperations(qemuOperations, func() {
+			nextPhase, err := dp.convert(mdp.GetURL())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ProcessingPhaseResize).To(Equal(nextPhase))
+		})
+		if wantNormalized {
+			Expect(qemuOperations.normalized).To(Equal(url.String()))
+			Expect(qemuOperations.converted).To(Equal(filepath.Join(scratchDir, normalizedFile)))
+		} else {
+			Expect(qemuOperations.normalized).To(BeEmpty())
+			Expect(qemuOperations.converted).To(Equal(url.String()))
+		}
+	},
+		table.Entry("the normalized image of a qcow2 source", "qcow2", true, true),
+		table.Entry("a raw source as is", "raw", true, false),
+		table.Entry("a qcow2 source as is by default", "qcow2", false, false),
+	)
+
+	It("Should require scratch space to normalize", func() {
+		url, err := url.Parse("http://fakeurl-notreal.fake")
+		Expect(err).ToNot(HaveOccurred())
+		mdp := &MockDataProvider{
+			infoResponse: ProcessingPhaseConvert,
+			url:          url,
+		}
+		dp := NewDataProcessor(mdp, "dest", "dataDir", "/invalid", "1G", 0.055, false)
+		dp.SetQcow2Normalization(true)
+		qemuOperations := &fakeNormalizeQEMUOperations{QEMUOperations: NewFakeQEMUOperations(nil, nil, fakeInfoRet, nil, nil, nil), format: "qcow2"}
+		replaceQEMUOperations(qemuOperations, func() {
+			err := dp.ProcessDataWithPause()
+			Expect(err).To(Equal(ErrRequiresScratchSpace))
+		})
+		Expect(qemuOperations.converted).To(BeEmpty())
+	})
+})
+
+// flushingDataProvider is a MockDataProvider implementing flushingDataSource.
+type flushingDataProvider struct {
+	MockDataProvider
+	sourceStreamOptions
+}
+
+var _ = Describe("Flush policy", func() {
+	It("Should pass the flush policy to the source and the conversion", func() {
+		url, err := url.Parse("http://fakeurl-notreal.fake")
+		Expect(err).ToNot(HaveOccurred())
+		source := &flushingDataProvider{MockDataProvider: MockDataProvider{url: url}}
+		policy := util.FlushPolicy{Mode: util.FlushPeriodic, Interval: time.Minute}
+		dp := NewDataProcessor(source, "dest", "dataDir", "scratchDataDir", "1G", 0.055, false)
+		dp.SetFlushPolicy(policy)
+		Expect(source.streamOptions()).To(Equal(util.StreamOptions{FlushPolicy: policy}))
+		qemuOperations := &fakeNormalizeQEMUOperations{QEMUOperations: NewFakeQEMUOperations(nil, nil, fakeInfoRet, nil, nil, nil), format: "raw"}
+		replaceQEMUOperations(qemuOperations, func() {
+			_, err := dp.convert(source.GetURL())
+			Expect(err).ToNot(HaveOccurred())
+		})
+		Expect(qemuOperations.policy).To(Equal(policy))
+	})
+})
+
+var _ = Describe("NBD target", func() {
+	It("Should convert to the configured NBD target and complete without resize", func() {
+		url, err := url.Parse("http://fakeurl-notreal.fake")
+		Expect(err).ToNot(HaveOccurred())
+		mdp := &MockDataProvider{
+			url: url,
+		}
+		dp := NewDataProcessor(mdp, "dest", "dataDir", "scratchDataDir", "1G", 0.055, false)
+		Expect(dp.SetNbdTarget("nbd+unix:///disk?socket=/var/run/nbd.sock")).To(Succeed())
+		qemuOperations := &fakeNbdQEMUOperations{QEMUOperations: NewQEMUAllErrors()}
+		replaceQEMUOperations(qemuOperations, func() {
+			nextPhase, err := dp.convert(mdp.GetURL())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(nextPhase).To(Equal(ProcessingPhaseComplete))
+		})
+		Expect(qemuOperations.target).To(Equal("nbd+unix:///disk?socket=/var/run/nbd.sock"))
+	})
+
+	table.DescribeTable("SetNbdTarget should", func(uri string, wantErr bool) {
+		dp := NewDataProcessor(&MockDataProvider{}, "dest", "dataDir", "scratchDataDir", "1G", 0.055, false)
+		err := dp.SetNbdTarget(uri)
+		if wantErr {
+			Expect(err).To(HaveOccurred())
+		} else {
+			Expect(err).ToNot(HaveOccurred())
+		}
+	},
+		table.Entry("accept a tcp export", "nbd://nbd-server:10809/disk", false),
+		table.Entry("accept a unix socket export", "nbd+unix:///disk?socket=/nbd.sock", false),
+		table.Entry("accept no target", "", false),
+		table.Entry("reject other schemes", "http://nbd-server/disk", true),
+		table.Entry("reject a file", "/dev/nbd0", true),
+	)
+})
+
+var _ = Describe("Target format", func() {
+	It("Should convert raw images from scratch space", func() {
+		mdp := &MockDataProvider{
+			infoResponse:     ProcessingPhaseTransferDataFile,
+			transferResponse: ProcessingPhaseComplete,
+		}
+		dp := NewDataProcessor(mdp, "dest", "dataDir", "scratchDataDir", "1G", 0.055, false)
+		dp.SetTargetFormat("qcow2")
+		err := dp.ProcessData()
+		Expect(err).ToNot(HaveOccurred())
+		Expect("scratchDataDir").To(Equal(mdp.transferPath))
+		Expect(mdp.transferFile).To(BeEmpty())
+	})
+
+	It("Should fail with an NBD target", func() {
+		url, err := url.Parse("http://fakeurl-notreal.fake")
+		Expect(err).ToNot(HaveOccurred())
+		mdp := &MockDataProvider{
+			url: url,
+		}
+		dp := NewDataProcessor(mdp, "dest", "dataDir", "scratchDataDir", "1G", 0.055, false)
+		dp.SetTargetFormat("qcow2")
+		Expect(dp.SetNbdTarget("nbd+unix:///disk?socket=/var/run/nbd.sock")).To(Succeed())
+		qemuOperations := &fakeNbdQEMUOperations{QEMUOperations: NewQEMUAllErrors()}
+		replaceQEMUOperations(qemuOperations, func() {
+			nextPhase, err := dp.convert(mdp.GetURL())
+			Expect(err).To(MatchError("A qcow2 target format can't be written to an NBD target"))
+			Expect(nextPhase).To(Equal(ProcessingPhaseError))
+		})
+		Expect(qemuOperations.target).To(BeEmpty())
+	})
+
+	It("Should fail on a block device", func() {
+		url, err := url.Parse("http://fakeurl-notreal.fake")
+		Expect(err).ToNot(HaveOccurred())
+		mdp := &MockDataProvider{
+			url: url,
+		}
+		dp := NewDataProcessor(mdp, "/dev/blockdev", "", "scratchDataDir", "", 0.055, false)
+		dp.SetTargetFormat("qcow2")
+		replaceAvailableSpaceBlockFunc(func(string) (int64, error) { return int64(1024 * 1024), nil }, func() {
+			replaceQEMUOperations(NewFakeQEMUOperations(errors.New("should not convert"), nil, fakeInfoRet, nil, nil, nil), func() {
+				nextPhase, err := dp.convert(mdp.GetURL())
+				Expect(err).To(MatchError("A qcow2 target format requires a file system, /dev/blockdev is a block device"))
+				Expect(nextPhase).To(Equal(ProcessingPhaseError))
+			})
+		})
+	})
+
+	table.DescribeTable("Should check the snapshots of an image converted from a source with snapshots", func(converted []image.ImgSnapshot, wantErr bool) {
+		url, err := url.Parse("http://fakeurl-notreal.fake")
+		Expect(err).ToNot(HaveOccurred())
+		source := &snapshotDataProvider{MockDataProvider: MockDataProvider{url: url}, snapshots: 2}
+		dp := NewDataProcessor(source, "dest", "dataDir", "scratchDataDir", "1G", 0.055, false)
+		dp.SetTargetFormat("qcow2")
+		info := fakeInfoOpRetVal{imgInfo: &image.ImgInfo{Format: "qcow2", Snapshots: converted}}
+		replaceQEMUOperations(NewFakeQEMUOperations(nil, nil, info, nil, nil, nil), func() {
+			nextPhase, err := dp.convert(source.GetURL())
+			if wantErr {
+				Expect(errors.Cause(err)).To(Equal(ErrSnapshotsNotFlattened))
+				Expect(err.Error()).To(ContainSubstring("1 of the 2 internal snapshots"))
+				Expect(nextPhase).To(Equal(ProcessingPhaseError))
+			} else {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nextPhase).To(Equal(ProcessingPhaseResize))
+			}
+		})
+	},
+		table.Entry("and accept the flattened image", nil, false),
+		table.Entry("and fail if snapshots are left", []image.ImgSnapshot{{ID: "1", Name: "before-update"}}, true),
+	)
+})
+
+// snapshotDataProvider is a MockDataProvider whose Info found a qcow2 image with internal snapshots.
+type snapshotDataProvider struct {
+	MockDataProvider
+	snapshots int
+}
+
+func (s *snapshotDataProvider) probe() (*FormatReaders, int64) {
+	return &FormatReaders{Format: "qcow2", Snapshots: s.snapshots}, 0
+}
+
+var _ = Describe("Overlay target", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "overlay")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("Should create the data file as an overlay backed by the imported image", func() {
+		url, err := url.Parse("http://fakeurl-notreal.fake")
+		Expect(err).ToNot(HaveOccurred())
+		mdp := &MockDataProvider{
+			url: url,
+		}
+		dataFile := filepath.Join(tmpDir, "disk.img")
+		dp := NewDataProcessor(mdp, dataFile, tmpDir, "scratchDataDir", "", 0.055, false)
+		dp.SetOverlayTarget(true)
+		qemuOperations := &fakeOverlayQEMUOperations{QEMUOperations: NewQEMUAllErrors()}
+		replaceAvailableSpaceBlockFunc(func(string) (int64, error) { return int64(-1), nil }, func() {
+			replaceQEMUOperations(qemuOperations, func() {
+				nextPhase, err := dp.convert(mdp.GetURL())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nextPhase).To(Equal(ProcessingPhaseResize))
+				nextPhase, err = dp.resize()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nextPhase).To(Equal(ProcessingPhaseComplete))
+			})
+		})
+		Expect(qemuOperations.converted).To(Equal(filepath.Join(tmpDir, overlayBaseFile)))
+		Expect(qemuOperations.overlay).To(Equal(dataFile))
+		Expect(filepath.IsAbs(qemuOperations.backingFile)).To(BeFalse())
+		Expect(filepath.Join(filepath.Dir(qemuOperations.overlay), qemuOperations.backingFile)).To(Equal(qemuOperations.converted))
+		Expect(qemuOperations.backingFormat).To(Equal("raw"))
+		Expect(qemuOperations.size).To(BeNil())
+		info, err := os.Stat(qemuOperations.converted)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0440)))
+		info, err = os.Stat(dataFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0660)))
+	})
+
+	table.DescribeTable("Should size the overlay", func(requestImageSize string, expectedSize *resource.Quantity) {
+		dataFile := filepath.Join(tmpDir, "disk.img")
+		dp := NewDataProcessor(&MockDataProvider{}, dataFile, tmpDir, "scratchDataDir", requestImageSize, 0.055, false)
+		dp.SetOverlayTarget(true)
+		Expect(ioutil.WriteFile(dp.imageFile(), []byte("image"), 0644)).To(Succeed())
+		qemuOperations := &fakeOverlayQEMUOperations{QEMUOperations: NewQEMUAllErrors()}
+		replaceQEMUOperations(qemuOperations, func() {
+			_, err := dp.resize()
+			Expect(err).ToNot(HaveOccurred())
+		})
+		if expectedSize == nil {
+			Expect(qemuOperations.size).To(BeNil())
+		} else {
+			Expect(qemuOperations.size.Cmp(*expectedSize)).To(Equal(0))
+		}
+	},
+		table.Entry("with the requested size if larger than the image", "1Gi", resource.NewScaledQuantity(1024*1024*1024, 0)),
+		table.Entry("with the size of the image if the requested size is smaller", "1Ki", nil),
+	)
+
+	It("Should back the overlay with the image in the target format", func() {
+		url, err := url.Parse("http://fakeurl-notreal.fake")
+		Expect(err).ToNot(HaveOccurred())
+		mdp := &MockDataProvider{
+			url: url,
+		}
+		dataFile := filepath.Join(tmpDir, "disk.img")
+		dp := NewDataProcessor(mdp, dataFile, tmpDir, "scratchDataDir", "", 0.055, false)
+		dp.SetTargetFormat("qcow2")
+		dp.SetOverlayTarget(true)
+		qemuOperations := &fakeOverlayQEMUOperations{QEMUOperations: NewQEMUAllErrors()}
+		replaceAvailableSpaceBlockFunc(func(string) (int64, error) { return int64(-1), nil }, func() {
+			replaceQEMUOperations(qemuOperations, func() {
+				nextPhase, err := dp.convert(mdp.GetURL())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nextPhase).To(Equal(ProcessingPhaseResize))
+				nextPhase, err = dp.resize()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nextPhase).To(Equal(ProcessingPhaseComplete))
+			})
+		})
+		Expect(qemuOperations.converted).To(Equal(filepath.Join(tmpDir, overlayBaseFile)))
+		Expect(qemuOperations.format).To(Equal("qcow2"))
+		Expect(qemuOperations.backingFormat).To(Equal("qcow2"))
+	})
+
+	It("Should fail on a block device", func() {
+		dp := NewDataProcessor(&MockDataProvider{}, "/dev/blockdev", "", "scratchDataDir", "", 0.055, false)
+		dp.SetOverlayTarget(true)
+		replaceAvailableSpaceBlockFunc(func(string) (int64, error) { return int64(1024 * 1024), nil }, func() {
+			replaceQEMUOperations(&fakeOverlayQEMUOperations{QEMUOperations: NewQEMUAllErrors()}, func() {
+				nextPhase, err := dp.convert(&url.URL{})
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("requires a file system"))
+				Expect(nextPhase).To(Equal(ProcessingPhaseError))
+			})
+		})
+	})
+})
+
+var _ = Describe("Resumable conversion", func() {
+	const segmentSize = 8192
+	var (
+		tmpDir                string
+		dataFile              string
+		scratchDir            string
+		source                *mockStreamingDataProvider
+		cleanRestartThreshold int
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "resumable")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.Mkdir(filepath.Join(tmpDir, "data"), 0755)).To(Succeed())
+		scratchDir = filepath.Join(tmpDir, "scratch")
+		Expect(os.Mkdir(scratchDir, 0755)).To(Succeed())
+		dataFile = filepath.Join(tmpDir, "data", "disk.img")
+		data := make([]byte, 5*segmentSize-100)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		source = &mockStreamingDataProvider{data: data}
+		cleanRestartThreshold = 0
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	process := func(provider DataSourceInterface, qemu *fakeSegmentQEMUOperations) error {
+		dp := NewDataProcessor(provider, dataFile, filepath.Join(tmpDir, "data"), scratchDir, "", 0.055, false)
+		dp.SetResumableConversion(segmentSize)
+		dp.SetCleanRestartThreshold(cleanRestartThreshold)
+		var err error
+		replaceQEMUOperations(qemu, func() {
+			err = dp.ProcessData()
+		})
+		return err
+	}
+
+	It("Should resume the conversion after the last converted segment when the importer restarts", func() {
+		qemu := newFakeSegmentQEMUOperations(int64(len(source.data)), 2*segmentSize)
+		err := process(source, qemu)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("importer killed"))
+		Expect(qemu.offsets).To(Equal([]int64{0, segmentSize, 2 * segmentSize}))
+		progress := readConversionProgress(scratchDir)
+		Expect(progress).NotTo(BeNil())
+		Expect(progress.Converted).To(BeEquivalentTo(2 * segmentSize))
+
+		// The restarted importer neither transfers the image again nor converts the converted segments.
+		restarted := &MockDataProvider{infoResponse: ProcessingPhaseError}
+		qemu = newFakeSegmentQEMUOperations(int64(len(source.data)), -1)
+		Expect(process(restarted, qemu)).To(Succeed())
+		Expect(restarted.calledPhases).To(BeEmpty())
+		Expect(qemu.offsets).To(Equal([]int64{2 * segmentSize, 3 * segmentSize, 4 * segmentSize}))
+		data, err := ioutil.ReadFile(dataFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(Equal(source.data))
+		_, err = os.Stat(filepath.Join(scratchDir, tempFile))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		Expect(readConversionProgress(scratchDir)).To(BeNil())
+	})
+
+	It("Should start over if the image in scratch space changed", func() {
+		qemu := newFakeSegmentQEMUOperations(int64(len(source.data)), segmentSize)
+		Expect(process(source, qemu)).NotTo(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(scratchDir, tempFile), []byte("truncated"), 0644)).To(Succeed())
+
+		qemu = newFakeSegmentQEMUOperations(int64(len(source.data)), -1)
+		Expect(process(source, qemu)).To(Succeed())
+		Expect(source.transfers).To(Equal(1))
+		Expect(qemu.offsets).To(HaveLen(5))
+		Expect(qemu.offsets[0]).To(BeZero())
+		data, err := ioutil.ReadFile(dataFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(Equal(source.data))
+	})
+
+	It("Should restart from a clean slate after repeated failed resumes", func() {
+		cleanRestartThreshold = 2
+		Expect(process(source, newFakeSegmentQEMUOperations(int64(len(source.data)), segmentSize))).NotTo(Succeed())
+
+		// The partial state is corrupted, resuming keeps failing at the same segment.
+		for failures := 1; failures <= cleanRestartThreshold; failures++ {
+			restarted := &MockDataProvider{infoResponse: ProcessingPhaseError}
+			Expect(process(restarted, newFakeSegmentQEMUOperations(int64(len(source.data)), segmentSize))).NotTo(Succeed())
+			Expect(restarted.calledPhases).To(BeEmpty())
+			progress := readConversionProgress(scratchDir)
+			Expect(progress).NotTo(BeNil())
+			Expect(progress.Converted).To(BeEquivalentTo(segmentSize))
+			Expect(progress.ResumeFailures).To(Equal(failures))
+		}
+
+		// The import restarts from the beginning, transferring and converting the image again.
+		qemu := newFakeSegmentQEMUOperations(int64(len(source.data)), -1)
+		source.transfers = 0
+		Expect(process(source, qemu)).To(Succeed())
+		Expect(source.transfers).To(Equal(1))
+		Expect(qemu.offsets).To(Equal([]int64{0, segmentSize, 2 * segmentSize, 3 * segmentSize, 4 * segmentSize}))
+		data, err := ioutil.ReadFile(dataFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(Equal(source.data))
+		Expect(readConversionProgress(scratchDir)).To(BeNil())
+	})
+
+	It("Should reset the failed resumes once a segment is converted", func() {
+		cleanRestartThreshold = 2
+		Expect(process(source, newFakeSegmentQEMUOperations(int64(len(source.data)), segmentSize))).NotTo(Succeed())
+		restarted := &MockDataProvider{infoResponse: ProcessingPhaseError}
+		Expect(process(restarted, newFakeSegmentQEMUOperations(int64(len(source.data)), segmentSize))).NotTo(Succeed())
+		Expect(process(restarted, newFakeSegmentQEMUOperations(int64(len(source.data)), 3*segmentSize))).NotTo(Succeed())
+		progress := readConversionProgress(scratchDir)
+		Expect(progress).NotTo(BeNil())
+		Expect(progress.Converted).To(BeEquivalentTo(3 * segmentSize))
+		Expect(progress.ResumeFailures).To(BeZero())
+		Expect(restarted.calledPhases).To(BeEmpty())
+	})
+
+	It("Should give up if the resumes keep failing after the clean restart", func() {
+		cleanRestartThreshold = 1
+		Expect(process(source, newFakeSegmentQEMUOperations(int64(len(source.data)), segmentSize))).NotTo(Succeed())
+		restarted := &MockDataProvider{infoResponse: ProcessingPhaseError}
+		Expect(process(restarted, newFakeSegmentQEMUOperations(int64(len(source.data)), segmentSize))).NotTo(Succeed())
+		// The clean restart transfers the image again, and fails at the same segment.
+		source.transfers = 0
+		Expect(process(source, newFakeSegmentQEMUOperations(int64(len(source.data)), segmentSize))).NotTo(Succeed())
+		Expect(source.transfers).To(Equal(1))
+		Expect(process(restarted, newFakeSegmentQEMUOperations(int64(len(source.data)), segmentSize))).NotTo(Succeed())
+
+		source.transfers = 0
+		qemu := newFakeSegmentQEMUOperations(int64(len(source.data)), -1)
+		err := process(source, qemu)
+		Expect(errors.Cause(err)).To(Equal(ErrResumeFailed))
+		Expect(source.transfers).To(BeZero())
+		Expect(qemu.offsets).To(BeEmpty())
+		Expect(restarted.calledPhases).To(BeEmpty())
+	})
+
+	It("Should resume indefinitely without a threshold", func() {
+		Expect(process(source, newFakeSegmentQEMUOperations(int64(len(source.data)), segmentSize))).NotTo(Succeed())
+		restarted := &MockDataProvider{infoResponse: ProcessingPhaseError}
+		for i := 0; i < 3; i++ {
+			Expect(process(restarted, newFakeSegmentQEMUOperations(int64(len(source.data)), segmentSize))).NotTo(Succeed())
+		}
+		qemu := newFakeSegmentQEMUOperations(int64(len(source.data)), -1)
+		Expect(process(restarted, qemu)).To(Succeed())
+		Expect(restarted.calledPhases).To(BeEmpty())
+		Expect(qemu.offsets[0]).To(BeEquivalentTo(segmentSize))
+		Expect(source.transfers).To(Equal(1))
+	})
+
+	It("Should convert preallocated targets at once", func() {
+		dp := NewDataProcessor(source, dataFile, filepath.Join(tmpDir, "data"), scratchDir, "", 0.055, true)
+		dp.SetResumableConversion(segmentSize)
+		url, _ := url.Parse(filepath.Join(scratchDir, tempFile))
+		Expect(dp.segmentedConversion(url)).To(BeFalse())
+		dp.preallocation = false
+		Expect(dp.segmentedConversion(url)).To(BeTrue())
+		url, _ = url.Parse("http://example.com/" + tempFile)
+		Expect(dp.segmentedConversion(url)).To(BeFalse())
+	})
+})
+
+var _ = Describe("Allocated clusters limit", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "clusters")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	// writeQcow2 writes a qcow2 image with 512 byte clusters, whose l1Entries L1 entries all point to the same L2
+	// table allocating 64 clusters.
+	writeQcow2 := func(l1Entries int) *url.URL {
+		data := make([]byte, 512*3)
+		copy(data, []byte{'Q', 'F', 'I', 0xfb})
+		binary.BigEndian.PutUint32(data[4:], 3)
+		binary.BigEndian.PutUint32(data[20:], 9)
+		binary.BigEndian.PutUint64(data[24:], uint64(l1Entries*64*512))
+		binary.BigEndian.PutUint32(data[36:], uint32(l1Entries))
+		binary.BigEndian.PutUint64(data[40:], 512)
+		binary.BigEndian.PutUint32(data[100:], 112)
+		for i := 0; i < l1Entries; i++ {
+			binary.BigEndian.PutUint64(data[512+8*i:], 1024|1<<63)
+		}
+		for i := 0; i < 64; i++ {
+			binary.BigEndian.PutUint64(data[1024+8*i:], uint64(1024*1024+512*i)|1<<63)
+		}
+		fileName := filepath.Join(tmpDir, "image.qcow2")
+		Expect(ioutil.WriteFile(fileName, data, 0644)).To(Succeed())
+		source, err := url.Parse(fileName)
+		Expect(err).NotTo(HaveOccurred())
+		return source
+	}
+
+	table.DescribeTable("Should convert", func(l1Entries int, maxAllocatedClusters int64, expectErr bool) {
+		source := writeQcow2(l1Entries)
+		dp := NewDataProcessor(&MockDataProvider{url: source}, "dest", "dataDir", "scratchDataDir", "", 0.055, false)
+		dp.SetMaxAllocatedClusters(maxAllocatedClusters)
+		replaceQEMUOperations(NewFakeQEMUOperations(nil, nil, fakeInfoOpRetVal{&fakeZeroImageInfo, nil}, nil, nil, nil), func() {
+			nextPhase, err := dp.convert(source)
+			if expectErr {
+				Expect(err).To(HaveOccurred())
+				Expect(errors.Cause(err)).To(Equal(ErrTooManyAllocatedClusters))
+				Expect(nextPhase).To(Equal(ProcessingPhaseError))
+			} else {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nextPhase).To(Equal(ProcessingPhaseResize))
+			}
+		})
+	},
+		table.Entry("an image within the limit", 2, int64(128), false),
+		table.Entry("no image exceeding the limit", 3, int64(128), true),
+		table.Entry("an image whose L1 table implies an excessive cluster count without limit", 64, int64(0), false),
+		table.Entry("no image whose L1 table implies an excessive cluster count", 64, int64(1000), true),
+	)
+
+	It("Should skip remote images", func() {
+		source, err := url.Parse("http://fakeurl-notreal.fake/image.qcow2")
+		Expect(err).ToNot(HaveOccurred())
+		dp := NewDataProcessor(&MockDataProvider{url: source}, "dest", "dataDir", "scratchDataDir", "", 0.055, false)
+		dp.SetMaxAllocatedClusters(1)
+		replaceQEMUOperations(NewFakeQEMUOperations(nil, nil, fakeInfoOpRetVal{&fakeZeroImageInfo, nil}, nil, nil, nil), func() {
+			_, err := dp.convert(source)
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
 })
 
 var _ = Describe("Resize", func() {
@@ -400,7 +1000,7 @@ var _ = Describe("ResizeImage", func() {
 	//fakeInfoRet has info.VirtualSize=1024
 	table.DescribeTable("calling ResizeImage", func(qemuOperations image.QEMUOperations, imageSize string, totalSpace int64, wantErr bool) {
 		replaceQEMUOperations(qemuOperations, func() {
-			err := ResizeImage("dest", imageSize, totalSpace, false)
+			err := ResizeImage("dest", "raw", imageSize, totalSpace, false)
 			if !wantErr {
 				Expect(err).ToNot(HaveOccurred())
 			} else {
@@ -434,6 +1034,212 @@ var _ = Describe("DataProcessorResume", func() {
 	})
 })
 
+var _ = Describe("DataProcessor events", func() {
+	// recordedEvents returns the events recorded so far.
+	recordedEvents := func(recorder *record.FakeRecorder) []string {
+		var events []string
+		for {
+			select {
+			case event := <-recorder.Events:
+				events = append(events, event)
+			default:
+				return events
+			}
+		}
+	}
+
+	It("Should record an event per phase transition", func() {
+		mdp := &MockDataProvider{
+			infoResponse:     ProcessingPhaseTransferScratch,
+			transferResponse: ProcessingPhaseComplete,
+		}
+		recorder := record.NewFakeRecorder(10)
+		dp := NewDataProcessor(mdp, "dest", "dataDir", "scratchDataDir", "1G", 0.055, false)
+		dp.SetEventRecorder(recorder, &v1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "importer"})
+		Expect(dp.ProcessData()).To(Succeed())
+		Expect(recordedEvents(recorder)).To(Equal([]string{
+			"Normal ImportPhaseTransition Import phase Info -> TransferScratch",
+			"Normal ImportPhaseTransition Import phase TransferScratch -> Complete",
+		}))
+	})
+
+	It("Should record the retries", func() {
+		const segmentSize = 8192
+		tmpDir, err := ioutil.TempDir("", "events")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+		Expect(os.Mkdir(filepath.Join(tmpDir, "data"), 0755)).To(Succeed())
+		Expect(os.Mkdir(filepath.Join(tmpDir, "scratch"), 0755)).To(Succeed())
+		source := &mockStreamingDataProvider{data: make([]byte, 3*segmentSize)}
+		process := func(provider DataSourceInterface, qemu *fakeSegmentQEMUOperations, recorder record.EventRecorder) error {
+			dp := NewDataProcessor(provider, filepath.Join(tmpDir, "data", "disk.img"), filepath.Join(tmpDir, "data"), filepath.Join(tmpDir, "scratch"), "", 0.055, false)
+			dp.SetResumableConversion(segmentSize)
+			dp.SetEventRecorder(recorder, &v1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "importer"})
+			var err error
+			replaceQEMUOperations(qemu, func() {
+				err = dp.ProcessData()
+			})
+			return err
+		}
+		Expect(process(source, newFakeSegmentQEMUOperations(int64(len(source.data)), segmentSize), record.NewFakeRecorder(20))).NotTo(Succeed())
+		recorder := record.NewFakeRecorder(20)
+		Expect(process(&MockDataProvider{}, newFakeSegmentQEMUOperations(int64(len(source.data)), -1), recorder)).To(Succeed())
+		var retries []string
+		for _, event := range recordedEvents(recorder) {
+			if strings.HasPrefix(event, "Warning "+RetryEventReason) {
+				retries = append(retries, event)
+			}
+		}
+		Expect(retries).To(HaveLen(1))
+		Expect(retries[0]).To(ContainSubstring("Resuming the conversion at offset 8192 of 24576"))
+	})
+})
+
+var _ = Describe("DataProcessor zero image check", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "data")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dataDir)
+	})
+
+	// blockOf returns a block of data of the zero check granularity.
+	blockOf := func(value byte) []byte {
+		return bytes.Repeat([]byte{value}, util.ZeroBlockSize)
+	}
+
+	table.DescribeTable("Should check the transferred image for zeroes", func(data []byte, threshold float64, strict, expectWarning bool, expectedErr error) {
+		source := &mockWritingDataProvider{data: data}
+		dp := NewDataProcessor(source, filepath.Join(dataDir, "disk.img"), dataDir, "", "", 0.055, false)
+		dp.SetZeroImageCheck(threshold, strict)
+		replaceQEMUOperations(NewFakeQEMUOperations(nil, nil, fakeInfoRet, nil, nil, nil), func() {
+			err := dp.ProcessDataWithPause()
+			if expectedErr != nil {
+				Expect(errors.Cause(err)).To(Equal(expectedErr))
+			} else {
+				Expect(err).NotTo(HaveOccurred())
+			}
+		})
+		if expectWarning {
+			Expect(dp.ZeroImageWarning()).To(ContainSubstring("the source is likely blank"))
+		} else {
+			Expect(dp.ZeroImageWarning()).To(BeEmpty())
+		}
+	},
+		table.Entry("warn on an all-zero source", bytes.Repeat(blockOf(0), 16), 1.0, false, true, nil),
+		table.Entry("fail on an all-zero source in strict mode", bytes.Repeat(blockOf(0), 16), 1.0, true, false, ErrZeroImage),
+		table.Entry("warn on a mostly zero source beyond the threshold", append(bytes.Repeat(blockOf(0), 15), blockOf(1)...), 0.9, false, true, nil),
+		table.Entry("not warn on a mostly zero source below the threshold", append(bytes.Repeat(blockOf(0), 15), blockOf(1)...), 1.0, false, false, nil),
+		table.Entry("not warn without threshold", bytes.Repeat(blockOf(0), 16), 0.0, false, false, nil),
+	)
+})
+
+// mockWritingDataProvider writes data to the target file, and moves on to resizing it.
+type mockWritingDataProvider struct {
+	MockDataProvider
+	data []byte
+}
+
+func (m *mockWritingDataProvider) Info() (ProcessingPhase, error) {
+	return ProcessingPhaseTransferDataFile, nil
+}
+
+func (m *mockWritingDataProvider) TransferFile(fileName string) (ProcessingPhase, error) {
+	if err := ioutil.WriteFile(fileName, m.data, 0644); err != nil {
+		return ProcessingPhaseError, err
+	}
+	return ProcessingPhaseResize, nil
+}
+
+// mockStreamingDataProvider transfers data through scratch space.
+type mockStreamingDataProvider struct {
+	MockDataProvider
+	data      []byte
+	transfers int
+}
+
+func (m *mockStreamingDataProvider) Info() (ProcessingPhase, error) {
+	m.transfers = 0
+	return ProcessingPhaseTransferScratch, nil
+}
+
+func (m *mockStreamingDataProvider) Transfer(path string) (ProcessingPhase, error) {
+	m.transfers++
+	file := filepath.Join(path, tempFile)
+	if err := util.StreamDataToFile(bytes.NewReader(m.data), file); err != nil {
+		return ProcessingPhaseError, err
+	}
+	m.url, _ = url.Parse(file)
+	return ProcessingPhaseConvert, nil
+}
+
+// slowReader sleeps before every read of at most 4KiB.
+type slowReader struct {
+	reader io.Reader
+	delay  time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(p) > 4096 {
+		p = p[:4096]
+	}
+	time.Sleep(r.delay)
+	return r.reader.Read(p)
+}
+
+// fakeSegmentQEMUOperations converts raw images segment by segment, and records the offsets of the segments. It fails
+// like a killed importer once it reaches failAt.
+type fakeSegmentQEMUOperations struct {
+	image.QEMUOperations
+	virtualSize int64
+	failAt      int64
+	offsets     []int64
+}
+
+func newFakeSegmentQEMUOperations(virtualSize, failAt int64) *fakeSegmentQEMUOperations {
+	return &fakeSegmentQEMUOperations{
+		QEMUOperations: NewFakeQEMUOperations(nil, nil, fakeInfoRet, nil, nil, nil),
+		virtualSize:    virtualSize,
+		failAt:         failAt,
+	}
+}
+
+func (o *fakeSegmentQEMUOperations) Info(url *url.URL) (*image.ImgInfo, error) {
+	return &image.ImgInfo{Format: "raw", VirtualSize: o.virtualSize}, nil
+}
+
+func (o *fakeSegmentQEMUOperations) ConvertToFormatStream(url *url.URL, dest, format string, preallocate bool, policy util.FlushPolicy) error {
+	return errors.New("the image should be converted in segments")
+}
+
+func (o *fakeSegmentQEMUOperations) ConvertSegmentToRaw(source, format, dest string, offset, length int64, policy util.FlushPolicy) error {
+	o.offsets = append(o.offsets, offset)
+	if offset == o.failAt {
+		return errors.New("importer killed")
+	}
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	buf := make([]byte, length)
+	if _, err := src.ReadAt(buf, offset); err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(dest, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	_, err = dst.WriteAt(buf, offset)
+	return err
+}
+
 func replaceQEMUOperations(replacement image.QEMUOperations, f func()) {
 	orig := qemuOperations
 	if replacement != nil {
@@ -447,7 +1253,11 @@ func NewFakeQEMUOperations(e2, e3 error, ret4 fakeInfoOpRetVal, e5 error, e6 err
 	return &fakeQEMUOperations{e2, e3, ret4, e5, e6, targetResize}
 }
 
-func (o *fakeQEMUOperations) ConvertToRawStream(*url.URL, string, bool) error {
+func (o *fakeQEMUOperations) ConvertToRawStream(*url.URL, string, bool, util.FlushPolicy) error {
+	return o.e2
+}
+
+func (o *fakeQEMUOperations) ConvertToFormatStream(*url.URL, string, string, bool, util.FlushPolicy) error {
 	return o.e2
 }
 
@@ -455,6 +1265,10 @@ func (o *fakeQEMUOperations) Validate(*url.URL, int64, float64) error {
 	return o.e5
 }
 
+func (o *fakeQEMUOperations) ResizeFormat(dest, format string, size resource.Quantity, preallocate bool) error {
+	return o.Resize(dest, size, preallocate)
+}
+
 func (o *fakeQEMUOperations) Resize(dest string, size resource.Quantity, preallocate bool) error {
 	if o.resizeQuantity != nil {
 		Expect(o.resizeQuantity.Cmp(size)).To(Equal(0))
@@ -470,6 +1284,110 @@ func (o *fakeQEMUOperations) CreateBlankImage(dest string, size resource.Quantit
 	return o.e6
 }
 
+func (o *fakeQEMUOperations) Check(url *url.URL) error {
+	return nil
+}
+
+func (o *fakeQEMUOperations) Normalize(url *url.URL, dest string) error {
+	return nil
+}
+
+func (o *fakeQEMUOperations) ConvertSegmentToRaw(string, string, string, int64, int64, util.FlushPolicy) error {
+	return o.e2
+}
+
+func (o *fakeQEMUOperations) ConvertToNbd(url *url.URL, target *url.URL) error {
+	return o.e2
+}
+
+func (o *fakeQEMUOperations) CreateOverlay(backingFile, backingFormat, dest string, size *resource.Quantity) error {
+	return o.e6
+}
+
+// fakeCorruptQEMUOperations fails the image check.
+type fakeCorruptQEMUOperations struct {
+	image.QEMUOperations
+	checked bool
+}
+
+func (o *fakeCorruptQEMUOperations) Check(url *url.URL) error {
+	o.checked = true
+	return errors.Errorf("Image %s is corrupt: ERROR l2_offset=1fffffe00: L2 table is not cluster aligned", url)
+}
+
+// fakeNormalizeQEMUOperations reports the passed in format, and records the normalized and converted images, and the
+// flush policy of the conversion.
+type fakeNormalizeQEMUOperations struct {
+	image.QEMUOperations
+	format     string
+	normalized string
+	converted  string
+	policy     util.FlushPolicy
+}
+
+func (o *fakeNormalizeQEMUOperations) Info(url *url.URL) (*image.ImgInfo, error) {
+	return &image.ImgInfo{Format: o.format, VirtualSize: SmallVirtualSize, ActualSize: SmallActualSize}, nil
+}
+
+func (o *fakeNormalizeQEMUOperations) Normalize(url *url.URL, dest string) error {
+	o.normalized = url.String()
+	return nil
+}
+
+func (o *fakeNormalizeQEMUOperations) ConvertToFormatStream(url *url.URL, dest, format string, preallocate bool, policy util.FlushPolicy) error {
+	o.converted = url.String()
+	o.policy = policy
+	return nil
+}
+
+// fakeNbdQEMUOperations validates any image, and records the NBD target of the conversion.
+type fakeNbdQEMUOperations struct {
+	image.QEMUOperations
+	target string
+}
+
+func (o *fakeNbdQEMUOperations) Validate(*url.URL, int64, float64) error {
+	return nil
+}
+
+func (o *fakeNbdQEMUOperations) ConvertToNbd(url *url.URL, target *url.URL) error {
+	o.target = target.String()
+	return nil
+}
+
+// fakeOverlayQEMUOperations validates any image, writes the converted image and the overlay, and records them.
+type fakeOverlayQEMUOperations struct {
+	image.QEMUOperations
+	converted     string
+	format        string
+	backingFile   string
+	backingFormat string
+	overlay       string
+	size          *resource.Quantity
+}
+
+func (o *fakeOverlayQEMUOperations) Validate(*url.URL, int64, float64) error {
+	return nil
+}
+
+func (o *fakeOverlayQEMUOperations) ConvertToFormatStream(url *url.URL, dest, format string, preallocate bool, policy util.FlushPolicy) error {
+	o.converted = dest
+	o.format = format
+	return ioutil.WriteFile(dest, []byte("image"), 0644)
+}
+
+func (o *fakeOverlayQEMUOperations) Info(url *url.URL) (*image.ImgInfo, error) {
+	return &image.ImgInfo{Format: "raw", VirtualSize: SmallVirtualSize, ActualSize: SmallActualSize}, nil
+}
+
+func (o *fakeOverlayQEMUOperations) CreateOverlay(backingFile, backingFormat, dest string, size *resource.Quantity) error {
+	o.backingFile = backingFile
+	o.backingFormat = backingFormat
+	o.overlay = dest
+	o.size = size
+	return ioutil.WriteFile(dest, []byte("overlay"), 0644)
+}
+
 func NewQEMUAllErrors() image.QEMUOperations {
 	err := errors.New("qemu should not be called from this test override with replaceQEMUOperations")
 	return NewFakeQEMUOperations(err, err, fakeInfoOpRetVal{nil, err}, err, err, nil)
@@ -0,0 +1,159 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	cdiv1 "kubevirt.io/containerized-data-importer/pkg/apis/core/v1beta1"
+)
+
+// s3Scheme is the scheme of s3://bucket/object endpoints, read from the global endpoint of AWS S3.
+const s3Scheme = "s3"
+
+// s3GlobalEndpoint is the host s3:// endpoints are read from.
+const s3GlobalEndpoint = "s3.amazonaws.com"
+
+// DataSourceOptions are the options of the data sources created by NewDataSource. Each data source uses the options
+// it supports.
+type DataSourceOptions struct {
+	// AccessKey is the user name, the access key or the storage account of the source, empty for anonymous access.
+	AccessKey string
+	// SecretKey is the password, the secret key or the credential of the source, empty for anonymous access.
+	SecretKey string
+	// CertDir is the directory of the CA certificates trusted by the source, empty for the system CAs.
+	CertDir string
+	// PinnedSPKIHashes are the pinned certificates of the source, checked on top of the CAs, empty if not pinned.
+	PinnedSPKIHashes []string
+	// RetryAfterBudget is the total time a request of the source waits for Retry-After delays, 0 disables retrying.
+	RetryAfterBudget time.Duration
+	// ContentType is the content type of HTTP sources, kubevirt if empty.
+	ContentType cdiv1.DataVolumeContentType
+}
+
+// dataSourceFactory creates the data source of an endpoint.
+type dataSourceFactory func(ep *url.URL, options DataSourceOptions) (DataSourceInterface, error)
+
+// dataSourceFactories are the factories of the data sources by the scheme of their endpoints.
+var dataSourceFactories = map[string]dataSourceFactory{
+	"http":          newHTTPSchemeDataSource,
+	"https":         newHTTPSchemeDataSource,
+	s3Scheme:        newS3SchemeDataSource,
+	azureBlobScheme: newAzureBlobSchemeDataSource,
+	ftpScheme:       newFTPSchemeDataSource,
+	ftpsScheme:      newFTPSchemeDataSource,
+	webDAVScheme:    newWebDAVSchemeDataSource,
+	webDAVSScheme:   newWebDAVSchemeDataSource,
+}
+
+// NewDataSource creates the data source of endpoint, picked by the scheme of the endpoint: http and https endpoints
+// are read with HTTP, s3://bucket/object endpoints from AWS S3, az://container/blob endpoints from Azure Blob Storage
+// ftp and ftps endpoints with FTP, and dav and davs endpoints with WebDAV.
+func NewDataSource(endpoint string, options DataSourceOptions) (DataSourceInterface, error) {
+	ep, err := ParseEndpoint(endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, fmt.Sprintf("unable to parse endpoint %q", endpoint))
+	}
+	factory, ok := dataSourceFactories[strings.ToLower(ep.Scheme)]
+	if !ok {
+		return nil, errors.Errorf("unsupported endpoint scheme %q, supported schemes are %s", ep.Scheme, strings.Join(supportedSchemes(), ", "))
+	}
+	return factory(ep, options)
+}
+
+// supportedSchemes returns the sorted schemes NewDataSource supports.
+func supportedSchemes() []string {
+	var schemes []string
+	for scheme := range dataSourceFactories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+func newHTTPSchemeDataSource(ep *url.URL, options DataSourceOptions) (DataSourceInterface, error) {
+	contentType := options.ContentType
+	if contentType == "" {
+		contentType = cdiv1.DataVolumeKubeVirt
+	}
+	source, err := NewHTTPDataSourceWithOptions(ep.String(), options.AccessKey, options.SecretKey, options.CertDir, contentType, HTTPOptions{
+		PinnedSPKIHashes: options.PinnedSPKIHashes,
+		RetryAfterBudget: options.RetryAfterBudget,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+// newS3SchemeDataSource creates the S3 data source of an s3://bucket/object endpoint, from the global endpoint.
+func newS3SchemeDataSource(ep *url.URL, options DataSourceOptions) (DataSourceInterface, error) {
+	if ep.Host == "" || strings.Trim(ep.Path, "/") == "" {
+		return nil, errors.Errorf("no bucket and object in %q", manifestURL(ep))
+	}
+	s3Ep := *ep
+	s3Ep.Scheme = "https"
+	s3Ep.Host = s3GlobalEndpoint
+	s3Ep.Path = "/" + ep.Host + ep.Path
+	s3Ep.RawPath = ""
+	source, err := NewS3DataSourceWithOptions(s3Ep.String(), options.AccessKey, options.SecretKey, options.CertDir, S3Options{
+		PinnedSPKIHashes: options.PinnedSPKIHashes,
+		RetryAfterBudget: options.RetryAfterBudget,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+func newAzureBlobSchemeDataSource(ep *url.URL, options DataSourceOptions) (DataSourceInterface, error) {
+	source, err := NewAzureBlobDataSource(ep.String(), options.AccessKey, options.SecretKey, options.CertDir, AzureBlobOptions{
+		PinnedSPKIHashes: options.PinnedSPKIHashes,
+		RetryAfterBudget: options.RetryAfterBudget,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+func newFTPSchemeDataSource(ep *url.URL, options DataSourceOptions) (DataSourceInterface, error) {
+	source, err := NewFTPDataSource(ep.String(), options.AccessKey, options.SecretKey, options.CertDir, FTPOptions{
+		PinnedSPKIHashes: options.PinnedSPKIHashes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+func newWebDAVSchemeDataSource(ep *url.URL, options DataSourceOptions) (DataSourceInterface, error) {
+	source, err := NewWebDAVDataSource(ep.String(), options.AccessKey, options.SecretKey, options.CertDir, WebDAVOptions{
+		PinnedSPKIHashes: options.PinnedSPKIHashes,
+		RetryAfterBudget: options.RetryAfterBudget,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return source, nil
+}
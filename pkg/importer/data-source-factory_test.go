@@ -0,0 +1,100 @@
+package importer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	cdiv1 "kubevirt.io/containerized-data-importer/pkg/apis/core/v1beta1"
+)
+
+var _ = Describe("Data source factory", func() {
+	var (
+		source   DataSourceInterface
+		s3Client *MockS3Client
+	)
+
+	BeforeEach(func() {
+		s3Client = &MockS3Client{}
+		newClientFunc = func(endpoint, accKey, secKey string, certDir string, options s3ClientOptions) (S3Client, error) {
+			s3Client.endpoint = endpoint
+			return s3Client, nil
+		}
+		newAzureBlobClientFunc = func(serviceURL *url.URL, accountName, credential, certDir string, pins spkiPins, retryAfterBudget time.Duration) (AzureBlobClient, error) {
+			return &mockAzureBlobClient{data: cirrosData, blobType: AzureBlockBlob}, nil
+		}
+		newFTPClientFunc = func(ep *url.URL, user, password, certDir string, pins spkiPins) (FTPClient, error) {
+			return &mockFTPClient{data: cirrosData}, nil
+		}
+	})
+
+	AfterEach(func() {
+		newClientFunc = getS3Client
+		newAzureBlobClientFunc = getAzureBlobClient
+		newFTPClientFunc = getFTPClient
+		if source != nil {
+			source.Close()
+			source = nil
+		}
+	})
+
+	table.DescribeTable("should pick the data source of", func(endpoint string, expected DataSourceInterface) {
+		var err error
+		source, err = NewDataSource(endpoint, DataSourceOptions{AccessKey: "goldenimages"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reflect.TypeOf(source)).To(Equal(reflect.TypeOf(expected)))
+	},
+		table.Entry("an s3 endpoint", "s3://bucket/cirros.qcow2", &S3DataSource{}),
+		table.Entry("an az endpoint", "az://images/cirros.qcow2", &AzureBlobDataSource{}),
+		table.Entry("an ftp endpoint", "ftp://images.example.com/cirros.qcow2", &FTPDataSource{}),
+		table.Entry("an ftps endpoint", "ftps://images.example.com/cirros.qcow2", &FTPDataSource{}),
+		table.Entry("a dav endpoint", "dav://cloud.example.com/remote.php/dav/files/user/cirros.qcow2", &WebDAVDataSource{}),
+		table.Entry("a davs endpoint", "davs://cloud.example.com/remote.php/dav/files/user/cirros.qcow2", &WebDAVDataSource{}),
+		table.Entry("an upper case scheme", "S3://bucket/cirros.qcow2", &S3DataSource{}),
+	)
+
+	It("should pick the HTTP data source of an http endpoint", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(cirrosData)
+		}))
+		defer server.Close()
+		var err error
+		source, err = NewDataSource(server.URL+"/cirros.qcow2", DataSourceOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(source).To(BeAssignableToTypeOf(&HTTPDataSource{}))
+		Expect(source.(*HTTPDataSource).contentType).To(Equal(cdiv1.DataVolumeKubeVirt))
+		Expect(source.Close()).To(Succeed())
+		source = nil
+	})
+
+	It("should read s3 endpoints from the global endpoint", func() {
+		var err error
+		source, err = NewDataSource("s3://bucket/images/cirros.qcow2?versionId=v1", DataSourceOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s3Client.endpoint).To(Equal(s3GlobalEndpoint))
+		Expect(s3Client.input.Bucket).To(Equal(aws.String("bucket")))
+		Expect(s3Client.input.Key).To(Equal(aws.String("images/cirros.qcow2")))
+		Expect(s3Client.input.VersionId).To(Equal(aws.String("v1")))
+	})
+
+	table.DescribeTable("should fail with", func(endpoint, expected string) {
+		var err error
+		source, err = NewDataSource(endpoint, DataSourceOptions{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(expected))
+		Expect(source).To(BeNil())
+	},
+		table.Entry("an unsupported scheme", "gs://bucket/cirros.qcow2", "unsupported endpoint scheme \"gs\", supported schemes are az, dav, davs, ftp, ftps, http, https, s3"),
+		table.Entry("an endpoint without scheme", "bucket/cirros.qcow2", "unsupported endpoint scheme \"\""),
+		table.Entry("an s3 endpoint without object", "s3://bucket/", "no bucket and object"),
+		table.Entry("a failing data source", "ftp://images.example.com/", "no file"),
+	)
+})
@@ -0,0 +1,109 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrInvalidEndpoint is the cause of the errors of endpoints that can't be parsed.
+	ErrInvalidEndpoint = errors.New("invalid endpoint")
+	// ErrUnsupportedEndpointScheme is the cause of the errors of endpoints with a scheme the data source doesn't
+	// support.
+	ErrUnsupportedEndpointScheme = errors.New("unsupported endpoint scheme")
+	// ErrEndpointMissingHost is the cause of the errors of endpoints without host.
+	ErrEndpointMissingHost = errors.New("endpoint has no host")
+	// ErrEndpointMissingBucket is the cause of the errors of s3 endpoints without bucket.
+	ErrEndpointMissingBucket = errors.New("endpoint has no bucket")
+	// ErrInvalidBucketName is the cause of the errors of s3 endpoints with a bucket name breaking the naming rules.
+	ErrInvalidBucketName = errors.New("invalid bucket name")
+)
+
+// s3BucketPattern matches the bucket names following the naming rules of S3: 3 to 63 lowercase letters, digits, dots
+// and hyphens, beginning and ending with a letter or a digit.
+var s3BucketPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// endpointError is an invalid endpoint error, the cause is one of the endpoint errors, like
+// ErrUnsupportedEndpointScheme, and the message is specific to the data source.
+type endpointError struct {
+	message string
+	cause   error
+}
+
+func (e *endpointError) Error() string {
+	return e.message
+}
+
+// Cause returns the endpoint error, for errors.Cause.
+func (e *endpointError) Cause() error {
+	return e.cause
+}
+
+func newEndpointError(cause error, format string, args ...interface{}) error {
+	return &endpointError{message: fmt.Sprintf(format, args...), cause: cause}
+}
+
+// parseValidEndpoint parses endpoint, the endpoint of the environment if empty, and checks its scheme is one of
+// schemes, and it has a host. The scheme of the endpoint is lower case. source names the data source in the errors.
+func parseValidEndpoint(endpoint, source string, schemes ...string) (*url.URL, error) {
+	ep, err := ParseEndpoint(endpoint)
+	if err != nil {
+		if _, ok := err.(*url.Error); ok {
+			return nil, newEndpointError(ErrInvalidEndpoint, "unable to parse endpoint: %v", err)
+		}
+		return nil, err
+	}
+	if err := validateEndpoint(ep, source, schemes...); err != nil {
+		return nil, err
+	}
+	return ep, nil
+}
+
+// validateEndpoint checks the scheme of ep is one of schemes, and ep has a host. source names the data source in the
+// errors.
+func validateEndpoint(ep *url.URL, source string, schemes ...string) error {
+	supported := false
+	for _, scheme := range schemes {
+		supported = supported || ep.Scheme == scheme
+	}
+	if !supported {
+		return newEndpointError(ErrUnsupportedEndpointScheme, "unsupported %s endpoint scheme %q, supported schemes are %s", source, ep.Scheme, strings.Join(schemes, ", "))
+	}
+	if ep.Hostname() == "" {
+		return newEndpointError(ErrEndpointMissingHost, "no host in %q", manifestURL(ep))
+	}
+	return nil
+}
+
+// validateS3Bucket checks the bucket of the path-style s3 endpoint ep follows the naming rules of S3.
+func validateS3Bucket(ep *url.URL) error {
+	bucket, _ := extractBucketAndObject(strings.Trim(ep.Path, s3FolderSep))
+	if bucket == "" {
+		return newEndpointError(ErrEndpointMissingBucket, "no bucket in %q", manifestURL(ep))
+	}
+	if !s3BucketPattern.MatchString(bucket) || strings.Contains(bucket, "..") || net.ParseIP(bucket) != nil {
+		return newEndpointError(ErrInvalidBucketName, "invalid bucket name %q, expected 3 to 63 lowercase letters, digits, dots and hyphens, beginning and ending with a letter or a digit", bucket)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package importer
+
+import (
+	"net/url"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/pkg/errors"
+)
+
+var _ = Describe("Endpoint validation", func() {
+	table.DescribeTable("should reject", func(endpoint string, expected error, message string) {
+		_, err := parseValidEndpoint(endpoint, "ftp", ftpScheme, ftpsScheme)
+		Expect(err).To(HaveOccurred())
+		Expect(errors.Cause(err)).To(Equal(expected))
+		Expect(err.Error()).To(ContainSubstring(message))
+	},
+		table.Entry("an endpoint that can't be parsed", "*&%^@$#?!.invalid/endpoint", ErrInvalidEndpoint, "unable to parse endpoint"),
+		table.Entry("an endpoint without scheme", "images.example.com/cirros.qcow2", ErrUnsupportedEndpointScheme, `unsupported ftp endpoint scheme ""`),
+		table.Entry("an unsupported scheme", "sftp://images.example.com/cirros.qcow2", ErrUnsupportedEndpointScheme, "supported schemes are ftp, ftps"),
+		table.Entry("a malformed scheme", "ftp+tls://images.example.com/cirros.qcow2", ErrUnsupportedEndpointScheme, `unsupported ftp endpoint scheme "ftp+tls"`),
+		table.Entry("an endpoint without host", "ftp:///cirros.qcow2", ErrEndpointMissingHost, "no host"),
+		table.Entry("an endpoint with only a port", "ftp://:21/cirros.qcow2", ErrEndpointMissingHost, "no host"),
+	)
+
+	It("should accept a supported scheme regardless of its case", func() {
+		ep, err := parseValidEndpoint("FTPS://images.example.com/cirros.qcow2", "ftp", ftpScheme, ftpsScheme)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ep.Scheme).To(Equal(ftpsScheme))
+	})
+
+	table.DescribeTable("should validate the s3 bucket", func(endpoint string, expected error) {
+		ep, err := url.Parse(endpoint)
+		Expect(err).NotTo(HaveOccurred())
+		err = validateS3Bucket(ep)
+		if expected == nil {
+			Expect(err).NotTo(HaveOccurred())
+		} else {
+			Expect(errors.Cause(err)).To(Equal(expected))
+		}
+	},
+		table.Entry("accepting a valid bucket", "https://s3.example.com/images-1.backup/cirros.qcow2", nil),
+		table.Entry("accepting a bucket without object", "https://s3.example.com/images", nil),
+		table.Entry("rejecting an empty bucket", "https://s3.example.com/", ErrEndpointMissingBucket),
+		table.Entry("rejecting an endpoint without path", "https://s3.example.com", ErrEndpointMissingBucket),
+		table.Entry("rejecting upper case letters", "https://s3.example.com/Images/cirros.qcow2", ErrInvalidBucketName),
+		table.Entry("rejecting underscores", "https://s3.example.com/my_images/cirros.qcow2", ErrInvalidBucketName),
+		table.Entry("rejecting a name too short", "https://s3.example.com/ab/cirros.qcow2", ErrInvalidBucketName),
+		table.Entry("rejecting a name too long", "https://s3.example.com/"+strings.Repeat("a", 64)+"/cirros.qcow2", ErrInvalidBucketName),
+		table.Entry("rejecting a leading hyphen", "https://s3.example.com/-images/cirros.qcow2", ErrInvalidBucketName),
+		table.Entry("rejecting a trailing dot", "https://s3.example.com/images./cirros.qcow2", ErrInvalidBucketName),
+		table.Entry("rejecting consecutive dots", "https://s3.example.com/my..images/cirros.qcow2", ErrInvalidBucketName),
+		table.Entry("rejecting an IP address", "https://s3.example.com/192.168.1.1/cirros.qcow2", ErrInvalidBucketName),
+	)
+
+	table.DescribeTable("NewS3DataSource should reject", func(endpoint string, expected error) {
+		_, err := NewS3DataSource(endpoint, "", "", "")
+		Expect(err).To(HaveOccurred())
+		Expect(errors.Cause(err)).To(Equal(expected))
+	},
+		table.Entry("an endpoint that can't be parsed", "*&%^@$#?!.invalid/endpoint", ErrInvalidEndpoint),
+		table.Entry("an unsupported scheme", "gs://bucket/cirros.qcow2", ErrUnsupportedEndpointScheme),
+		table.Entry("an endpoint without host", "https:///bucket/cirros.qcow2", ErrEndpointMissingHost),
+		table.Entry("an empty bucket", "https://s3.example.com/", ErrEndpointMissingBucket),
+		table.Entry("illegal bucket characters", "https://s3.example.com/bucket$1/cirros.qcow2", ErrInvalidBucketName),
+		table.Entry("an illegal virtual-hosted-style bucket", "https://my_bucket.s3.us-east-1.amazonaws.com/cirros.qcow2", ErrInvalidBucketName),
+	)
+})
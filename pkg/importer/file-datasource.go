@@ -0,0 +1,224 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+
+	"kubevirt.io/containerized-data-importer/pkg/common"
+	"kubevirt.io/containerized-data-importer/pkg/util"
+)
+
+// ErrFileOutsideRoot is returned for files of the file data source that resolve outside of the mounted root.
+var ErrFileOutsideRoot = errors.New("file is outside of the mounted root")
+
+// FileDataSource is the struct containing the information needed to import a file of a share mounted in the pod,
+// like an NFS share in air-gapped environments.
+// Sequence of phases:
+// 1a. Info -> TransferScratch, if the image needs to be converted.
+// 1b. Info -> TransferDataFile, if the image is raw.
+// 2a. TransferScratch -> Convert
+// 2b. TransferDataFile -> Resize
+type FileDataSource struct {
+	sourceSizeLimits
+	sourceVerification
+	sourceStreamOptions
+	// the resolved path of the file
+	path string
+	// size is the size of the file.
+	size int64
+	// Reader
+	file *os.File
+	// stack of readers
+	readers *FormatReaders
+	// fail if the virtual size of the image exceeds the capacity of the target, 0 if unknown.
+	targetCapacity int64
+	// The image file in scratch space.
+	url *url.URL
+}
+
+// FileOptions are the options of the FileDataSource.
+type FileOptions struct {
+	// TargetCapacity makes Info fail if the virtual size of the image exceeds it, before transferring any data, 0
+	// disables the check.
+	TargetCapacity int64
+	SourceOptions
+}
+
+// NewFileDataSource creates a new instance of the FileDataSource importing the file at path, relative to the mounted
+// root unless absolute. The root is the directory the share is mounted in, common.ImporterFileSourceDir if empty.
+// Files resolving outside of the mounted root, through symbolic links or otherwise, are rejected with
+// ErrFileOutsideRoot.
+func NewFileDataSource(root, path string, options FileOptions) (*FileDataSource, error) {
+	if root == "" {
+		root = common.ImporterFileSourceDir
+	}
+	resolved, err := resolveFileSourcePath(root, path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(resolved)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open %q", path)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "could not stat %q", path)
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, errors.Errorf("%q is not a regular file", path)
+	}
+	klog.V(1).Infof("file %s of %d bytes", resolved, info.Size())
+	return &FileDataSource{
+		sourceSizeLimits:    options.sizeLimits(),
+		sourceStreamOptions: options.streamOptions(),
+		path:                resolved,
+		size:                info.Size(),
+		file:                file,
+		targetCapacity:      options.TargetCapacity,
+	}, nil
+}
+
+// resolveFileSourcePath returns path, relative to root unless absolute, with its symbolic links resolved. Paths
+// resolving outside of root fail with ErrFileOutsideRoot.
+func resolveFileSourcePath(root, path string) (string, error) {
+	if path == "" {
+		return "", errors.New("no file path")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not resolve the mounted root %q", root)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not resolve %q", path)
+	}
+	rel, err := filepath.Rel(resolvedRoot, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.Wrapf(ErrFileOutsideRoot, "%q resolves to %q, outside of %q", path, resolved, root)
+	}
+	return resolved, nil
+}
+
+// Info is called to get initial information about the data.
+func (fs *FileDataSource) Info() (ProcessingPhase, error) {
+	var err error
+	fs.readers, err = newSourceFormatReaders(fs.file, fs.size, fs.sourceSizeLimits, fs.sourceVerification)
+	if err != nil {
+		klog.Errorf("Error creating readers: %v", err)
+		return ProcessingPhaseError, err
+	}
+	if err = checkBackingFile(fs.readers); err != nil {
+		return ProcessingPhaseError, err
+	}
+	if err = checkTargetCapacity(fs.path, fs.readers, uint64(fs.size), fs.targetCapacity); err != nil {
+		return ProcessingPhaseError, err
+	}
+	if !fs.readers.Convert {
+		// Importing a raw file, we can write that directly to the target.
+		return ProcessingPhaseTransferDataFile, nil
+	}
+	return ProcessingPhaseTransferScratch, nil
+}
+
+// Transfer is called to transfer the data from the source to a temporary location.
+func (fs *FileDataSource) Transfer(path string) (ProcessingPhase, error) {
+	size, _ := util.GetAvailableSpace(path)
+	if size <= int64(0) {
+		//Path provided is invalid.
+		return ProcessingPhaseError, ErrInvalidPath
+	}
+	file := filepath.Join(path, tempFile)
+	fs.readers.StartProgressUpdate()
+	err := util.StreamDataToFileWithSize(fs.readers.TopReader(), file, fs.readers.topReaderSize(fs.size), fs.streamOptions())
+	if err != nil {
+		return ProcessingPhaseError, err
+	}
+	// If streaming succeeded, then parsing the file into URL will also succeed, no need to check error status
+	fs.url, _ = url.Parse(file)
+	return ProcessingPhaseConvert, nil
+}
+
+// TransferFile is called to transfer the data from the source to the passed in file.
+func (fs *FileDataSource) TransferFile(fileName string) (ProcessingPhase, error) {
+	fs.readers.StartProgressUpdate()
+	err := util.StreamDataToFileWithSize(fs.readers.TopReader(), fileName, -1, fs.streamOptions())
+	if err != nil {
+		return ProcessingPhaseError, err
+	}
+	return ProcessingPhaseResize, nil
+}
+
+// TransferToWriter is called to stream the raw image from the source to w, without scratch space.
+func (fs *FileDataSource) TransferToWriter(w io.Writer) (ProcessingPhase, error) {
+	return transferToWriter(fs.readers, w)
+}
+
+// TransferToWriterAt is called to write the raw image from the source at its offsets in w, without scratch space.
+func (fs *FileDataSource) TransferToWriterAt(w io.WriterAt) (ProcessingPhase, error) {
+	return transferToWriterAt(fs.readers, w)
+}
+
+// GetURL returns the url that the data processor can use when converting the data.
+func (fs *FileDataSource) GetURL() *url.URL {
+	return fs.url
+}
+
+func (fs *FileDataSource) sourceDigest() (string, error) {
+	return fs.readers.sourceDigest()
+}
+
+func (fs *FileDataSource) verifySourceSignature() error {
+	return fs.readers.verifySourceSignature()
+}
+
+func (fs *FileDataSource) probe() (*FormatReaders, int64) {
+	return fs.readers, fs.size
+}
+
+func (fs *FileDataSource) addToManifest(manifest *ImportManifest) {
+	manifest.Source.URL = (&url.URL{Scheme: "file", Path: fs.path}).String()
+	manifest.SourceSize = fs.size
+	manifest.addDecompress(compressionFormat(fs.readers))
+}
+
+func (fs *FileDataSource) formatReaders() *FormatReaders {
+	return fs.readers
+}
+
+// Close closes any readers or other open resources.
+func (fs *FileDataSource) Close() error {
+	if fs.readers != nil {
+		return fs.readers.Close()
+	}
+	if fs.file != nil {
+		return fs.file.Close()
+	}
+	return nil
+}
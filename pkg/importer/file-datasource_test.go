@@ -0,0 +1,151 @@
+package importer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/pkg/errors"
+)
+
+var _ = Describe("File data source", func() {
+	var (
+		root    string
+		outside string
+		tmpDir  string
+		fs      *FileDataSource
+	)
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "share")
+		Expect(err).NotTo(HaveOccurred())
+		outside, err = ioutil.TempDir("", "outside")
+		Expect(err).NotTo(HaveOccurred())
+		tmpDir, err = ioutil.TempDir("", "scratch")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.MkdirAll(filepath.Join(root, "images"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(root, "images", "cirros.qcow2"), cirrosData, 0644)).To(Succeed())
+		gz, err := ioutil.ReadFile(tinyCoreGzFilePath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(root, "images", "tinyCore.iso.gz"), gz, 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(outside, "secret.img"), []byte("secret"), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		if fs != nil {
+			fs.Close()
+			fs = nil
+		}
+		os.RemoveAll(root)
+		os.RemoveAll(outside)
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should transfer a qcow2 image to scratch space", func() {
+		var err error
+		fs, err = NewFileDataSource(root, "images/cirros.qcow2", FileOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := fs.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseTransferScratch))
+		result, err = fs.Transfer(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseConvert))
+		data, err := ioutil.ReadFile(filepath.Join(tmpDir, tempFile))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Equal(data, cirrosData)).To(BeTrue())
+		Expect(fs.GetURL().String()).To(Equal(filepath.Join(tmpDir, tempFile)))
+
+		manifest := newImportManifest()
+		fs.addToManifest(manifest)
+		resolvedRoot, err := filepath.EvalSymlinks(root)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(manifest.Source.URL).To(Equal("file://" + filepath.Join(resolvedRoot, "images", "cirros.qcow2")))
+		Expect(manifest.SourceSize).To(BeEquivalentTo(len(cirrosData)))
+	})
+
+	It("should decompress a raw image to the target", func() {
+		var err error
+		fs, err = NewFileDataSource(root, filepath.Join(root, "images", "tinyCore.iso.gz"), FileOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := fs.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseTransferDataFile))
+		target := filepath.Join(tmpDir, "disk.img")
+		result, err = fs.TransferFile(target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseResize))
+		data, err := ioutil.ReadFile(target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Equal(data, tinyCoreData())).To(BeTrue())
+	})
+
+	It("should leave the zeroes of a raw image as holes of the temp file", func() {
+		data, err := ioutil.ReadFile(ext4FilePath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(root, "images", "ext4.img"), data, 0644)).To(Succeed())
+		fs, err = NewFileDataSource(root, "images/ext4.img", FileOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = fs.Info()
+		Expect(err).NotTo(HaveOccurred())
+		result, err := fs.Transfer(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseConvert))
+		info, err := os.Stat(filepath.Join(tmpDir, tempFile))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Size()).To(BeEquivalentTo(len(data)))
+		Expect(info.Sys().(*syscall.Stat_t).Blocks * 512).To(BeNumerically("<", info.Size()/4))
+		written, err := ioutil.ReadFile(filepath.Join(tmpDir, tempFile))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Equal(written, data)).To(BeTrue())
+	})
+
+	It("should follow symbolic links within the mounted root", func() {
+		Expect(os.Symlink(filepath.Join(root, "images", "cirros.qcow2"), filepath.Join(root, "latest.qcow2"))).To(Succeed())
+		var err error
+		fs, err = NewFileDataSource(root, "latest.qcow2", FileOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := fs.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseTransferScratch))
+	})
+
+	table.DescribeTable("should reject a file outside of the mounted root", func(setup func() string) {
+		_, err := NewFileDataSource(root, setup(), FileOptions{})
+		Expect(errors.Cause(err)).To(Equal(ErrFileOutsideRoot))
+	},
+		table.Entry("through a symbolic link", func() string {
+			Expect(os.Symlink(filepath.Join(outside, "secret.img"), filepath.Join(root, "images", "link.img"))).To(Succeed())
+			return "images/link.img"
+		}),
+		table.Entry("through a symbolic link to a directory", func() string {
+			Expect(os.Symlink(outside, filepath.Join(root, "escape"))).To(Succeed())
+			return "escape/secret.img"
+		}),
+		table.Entry("through a relative path", func() string {
+			return filepath.Join("..", filepath.Base(outside), "secret.img")
+		}),
+		table.Entry("at an absolute path", func() string {
+			return filepath.Join(outside, "secret.img")
+		}),
+	)
+
+	It("should reject a directory", func() {
+		_, err := NewFileDataSource(root, "images", FileOptions{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("is not a regular file"))
+	})
+
+	It("should fail for a missing file", func() {
+		_, err := NewFileDataSource(root, "images/missing.qcow2", FileOptions{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("could not resolve"))
+	})
+})
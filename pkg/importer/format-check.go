@@ -0,0 +1,170 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"io"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"k8s.io/klog/v2"
+)
+
+// formatRaw is the format reported for images without a recognized image format header.
+const formatRaw = "raw"
+
+// declaredFormats maps file extensions to the image format they declare.
+var declaredFormats = map[string]string{
+	".raw":   formatRaw,
+	".img":   formatRaw,
+	".iso":   formatRaw,
+	".qcow2": "qcow2",
+	".vmdk":  "vmdk",
+	".vdi":   "vdi",
+	".vhd":   "vhd",
+	".vhdx":  "vhdx",
+}
+
+// ErrEmptySource indicates the source has no data to import.
+var ErrEmptySource = errors.New("source object is empty (0 bytes)")
+
+// ErrFormatMismatch indicates the detected image format is riskier than the format declared by the source.
+var ErrFormatMismatch = errors.New("detected image format does not match the declared format")
+
+// ErrExternalBackingFile indicates the image references a backing file, whose data isn't part of the source.
+var ErrExternalBackingFile = errors.New("external backing files are not supported")
+
+// ErrVirtualSizeMismatch indicates the virtual size of the source differs from the expected virtual size.
+var ErrVirtualSizeMismatch = errors.New("virtual size does not match the expected virtual size")
+
+// ErrVirtualSizeExceedsCapacity indicates the virtual size of the source doesn't fit in the target.
+var ErrVirtualSizeExceedsCapacity = errors.New("image does not fit in the target")
+
+// declaredFormat returns the image format declared by the extension of the passed in name, ignoring compression
+// extensions. Returns an empty string if the extension doesn't declare a format.
+func declaredFormat(name string) string {
+	name = strings.ToLower(path.Base(name))
+	for _, ext := range []string{".gz", ".xz", ".zst"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return declaredFormats[path.Ext(name)]
+}
+
+// detectedFormat returns the image format found by the format readers.
+func detectedFormat(readers *FormatReaders) string {
+	if readers.Format == "" {
+		return formatRaw
+	}
+	return readers.Format
+}
+
+// checkDeclaredFormat compares the format declared by the name of the source with the format detected from the
+// image header, and logs a warning if they disagree. In strict mode it fails if the disagreement is security
+// relevant, that is if an image declared as raw will be interpreted by qemu-img, or if the image references a
+// backing file.
+func checkDeclaredFormat(name string, readers *FormatReaders, strict bool) error {
+	declared := declaredFormat(name)
+	if declared == "" {
+		return nil
+	}
+	detected := detectedFormat(readers)
+	if declared == detected {
+		return nil
+	}
+	klog.Warningf("Source %q declares format %s, but the image header indicates %s", name, declared, detected)
+	if strict && (declared == formatRaw || readers.BackingFile) {
+		return errors.Wrapf(ErrFormatMismatch, "%q declares format %s, detected %s (backing file: %t)", name, declared, detected, readers.BackingFile)
+	}
+	return nil
+}
+
+// checkBackingFile fails if the image references a backing file, which would be missing from the imported image.
+func checkBackingFile(readers *FormatReaders) error {
+	if !readers.BackingFile {
+		return nil
+	}
+	if readers.BackingFileName == "" {
+		return errors.Wrapf(ErrExternalBackingFile, "%s image references an external backing file which is not supported", detectedFormat(readers))
+	}
+	return errors.Wrapf(ErrExternalBackingFile, "%s image references external backing file %s which is not supported", detectedFormat(readers), readers.BackingFileName)
+}
+
+// sourceVirtualSize returns the virtual size of the source found by the format readers, 0 if unknown. The virtual
+// size of an uncompressed raw source is the content length.
+func sourceVirtualSize(readers *FormatReaders, contentLength uint64) int64 {
+	if readers.VirtualSize > 0 {
+		return readers.VirtualSize
+	}
+	if readers.Format == "" && !readers.Archived {
+		return int64(contentLength)
+	}
+	return 0
+}
+
+// checkExpectedVirtualSize fails if the virtual size of the source differs from the expected virtual size by more
+// than tolerance bytes. An expected size of 0 disables the check. Sources of unknown virtual size are not checked.
+func checkExpectedVirtualSize(name string, readers *FormatReaders, contentLength uint64, expected, tolerance int64) error {
+	if expected <= 0 {
+		return nil
+	}
+	actual := sourceVirtualSize(readers, contentLength)
+	if actual == 0 {
+		klog.Warningf("Unable to determine the virtual size of %q, not comparing with the expected virtual size", name)
+		return nil
+	}
+	diff := actual - expected
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > tolerance {
+		return errors.Wrapf(ErrVirtualSizeMismatch, "%q has virtual size %d, expected %d (tolerance %d)", name, actual, expected, tolerance)
+	}
+	return nil
+}
+
+// checkTargetCapacity fails if the virtual size of the source exceeds the capacity of the target in bytes. A capacity
+// of 0 disables the check. Sources of unknown virtual size are not checked.
+func checkTargetCapacity(name string, readers *FormatReaders, contentLength uint64, capacity int64) error {
+	if capacity <= 0 {
+		return nil
+	}
+	actual := sourceVirtualSize(readers, contentLength)
+	if actual == 0 {
+		klog.Warningf("Unable to determine the virtual size of %q, not comparing with the target capacity", name)
+		return nil
+	}
+	if actual > capacity {
+		return errors.Wrapf(ErrVirtualSizeExceedsCapacity, "image virtual size %d exceeds available space %d", actual, capacity)
+	}
+	return nil
+}
+
+// newSourceFormatReaders creates the format readers of a source of the reported size, -1 if unknown, checking its
+// size against limits and making the verifications. A source reported empty fails with ErrEmptySource without being read, like a source found
+// empty by NewFormatReaders.
+func newSourceFormatReaders(stream io.ReadCloser, size int64, limits sourceSizeLimits, verification sourceVerification) (*FormatReaders, error) {
+	if size == 0 {
+		return nil, ErrEmptySource
+	}
+	var total uint64
+	if size > 0 {
+		total = uint64(size)
+	}
+	return newFormatReaders(stream, total, limits, verification)
+}
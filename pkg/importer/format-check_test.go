@@ -0,0 +1,307 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/pkg/errors"
+)
+
+// createQcow2Header returns a minimal qcow2 image header, referencing the backing file if not empty.
+func createQcow2Header(backingFile string) []byte {
+	data := make([]byte, 1024)
+	copy(data, []byte{'Q', 'F', 'I', 0xfb})
+	binary.BigEndian.PutUint32(data[4:], 3)
+	if backingFile != "" {
+		binary.BigEndian.PutUint64(data[8:], 512)
+		binary.BigEndian.PutUint32(data[16:], uint32(len(backingFile)))
+		copy(data[512:], backingFile)
+	}
+	binary.BigEndian.PutUint32(data[20:], 16)
+	binary.BigEndian.PutUint64(data[24:], 1024*1024)
+	return data
+}
+
+// qcow2HeaderWithBackingFileAt returns a minimal qcow2 image header, referencing the backing file stored at offset.
+func qcow2HeaderWithBackingFileAt(backingFile string, offset uint64) []byte {
+	data := createQcow2Header("")
+	binary.BigEndian.PutUint64(data[8:], offset)
+	binary.BigEndian.PutUint32(data[16:], uint32(len(backingFile)))
+	if offset+uint64(len(backingFile)) <= uint64(len(data)) {
+		copy(data[offset:], backingFile)
+	}
+	return data
+}
+
+var _ = Describe("Declared format check", func() {
+	table.DescribeTable("declaredFormat should return", func(name, expected string) {
+		Expect(declaredFormat(name)).To(Equal(expected))
+	},
+		table.Entry("raw for .raw", "/images/disk.raw", formatRaw),
+		table.Entry("raw for .img", "/images/disk.IMG", formatRaw),
+		table.Entry("raw for compressed .iso", "/images/disk.iso.gz", formatRaw),
+		table.Entry("qcow2 for compressed .qcow2", "/images/disk.qcow2.xz", "qcow2"),
+		table.Entry("vmdk for .vmdk", "disk.vmdk", "vmdk"),
+		table.Entry("nothing for unknown extensions", "/images/disk.bin", ""),
+		table.Entry("nothing without extension", "/images/disk", ""),
+	)
+
+	table.DescribeTable("checkDeclaredFormat should", func(name string, data []byte, strict, wantErr bool) {
+		readers, err := NewFormatReaders(ioutil.NopCloser(bytes.NewReader(data)), 0)
+		Expect(err).NotTo(HaveOccurred())
+		err = checkDeclaredFormat(name, readers, strict)
+		if wantErr {
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Cause(err)).To(Equal(ErrFormatMismatch))
+		} else {
+			Expect(err).NotTo(HaveOccurred())
+		}
+	},
+		table.Entry("accept a matching raw image", "disk.raw", make([]byte, 1024), true, false),
+		table.Entry("accept a matching qcow2 image", "disk.qcow2", createQcow2Header(""), true, false),
+		table.Entry("accept a qcow2 image declared as raw when not strict", "disk.raw", createQcow2Header("base.img"), false, false),
+		table.Entry("reject a qcow2 image declared as raw", "disk.raw", createQcow2Header(""), true, true),
+		table.Entry("reject a qcow2 image with a backing file declared as raw", "disk.raw", createQcow2Header("base.img"), true, true),
+		table.Entry("reject a qcow2 image with a backing file declared as vmdk", "disk.vmdk", createQcow2Header("base.img"), true, true),
+		table.Entry("accept a raw image declared as qcow2", "disk.qcow2", make([]byte, 1024), true, false),
+		table.Entry("accept any image without declared format", "disk", createQcow2Header("base.img"), true, false),
+	)
+
+	It("FormatReaders should detect the qcow2 backing file", func() {
+		readers, err := NewFormatReaders(ioutil.NopCloser(bytes.NewReader(createQcow2Header("base.img"))), 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(readers.Format).To(Equal("qcow2"))
+		Expect(readers.BackingFile).To(BeTrue())
+		readers, err = NewFormatReaders(ioutil.NopCloser(bytes.NewReader(createQcow2Header(""))), 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(readers.BackingFile).To(BeFalse())
+	})
+
+	table.DescribeTable("FormatReaders should read the qcow2 backing file name", func(data []byte, expected string) {
+		readers, err := NewFormatReaders(ioutil.NopCloser(bytes.NewReader(data)), 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(readers.BackingFileName).To(Equal(expected))
+		// The name read ahead of the header is still part of the stream.
+		read, err := ioutil.ReadAll(readers.TopReader())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(read).To(Equal(data))
+	},
+		table.Entry("after the header", createQcow2Header("base.img"), "base.img"),
+		table.Entry("in the header", qcow2HeaderWithBackingFileAt("/var/lib/images/base.qcow2", 112), "/var/lib/images/base.qcow2"),
+		table.Entry("beyond the end of the image", qcow2HeaderWithBackingFileAt("base.img", 1020), ""),
+		table.Entry("beyond the first cluster", qcow2HeaderWithBackingFileAt("base.img", 4*1024*1024), ""),
+	)
+
+	table.DescribeTable("checkBackingFile should", func(data []byte, expected string) {
+		readers, err := NewFormatReaders(ioutil.NopCloser(bytes.NewReader(data)), 0)
+		Expect(err).NotTo(HaveOccurred())
+		err = checkBackingFile(readers)
+		if expected == "" {
+			Expect(err).NotTo(HaveOccurred())
+		} else {
+			Expect(errors.Cause(err)).To(Equal(ErrExternalBackingFile))
+			Expect(err.Error()).To(ContainSubstring(expected))
+		}
+	},
+		table.Entry("accept a qcow2 image without backing file", createQcow2Header(""), ""),
+		table.Entry("accept a raw image", make([]byte, 1024), ""),
+		table.Entry("reject a qcow2 image with a backing file", createQcow2Header("base.img"), "qcow2 image references external backing file base.img which is not supported"),
+		table.Entry("reject a qcow2 image with an unreadable backing file name", qcow2HeaderWithBackingFileAt("base.img", 1020), "qcow2 image references an external backing file which is not supported"),
+	)
+
+	Context("with an S3 source", func() {
+		var (
+			sd     *S3DataSource
+			tmpDir string
+		)
+
+		BeforeEach(func() {
+			var err error
+			newClientFunc = createMockS3Client
+			tmpDir, err = ioutil.TempDir("", "format-check")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			newClientFunc = getS3Client
+			if sd != nil {
+				sd.Close()
+			}
+			os.RemoveAll(tmpDir)
+		})
+
+		table.DescribeTable("Info should", func(strict bool, expectedPhase ProcessingPhase, expectedErr string) {
+			fileName := filepath.Join(tmpDir, "disk.raw")
+			Expect(ioutil.WriteFile(fileName, createQcow2Header("base.img"), 0644)).To(Succeed())
+			file, err := os.Open(fileName)
+			Expect(err).NotTo(HaveOccurred())
+			sd, err = NewS3DataSourceWithOptions("http://region.amazon.com/bucket-1/disk.raw", "", "", "", S3Options{StrictFormatCheck: strict})
+			Expect(err).NotTo(HaveOccurred())
+			sd.s3Reader = file
+			result, err := sd.Info()
+			if expectedPhase == ProcessingPhaseError {
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(expectedErr))
+			} else {
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(result).To(Equal(expectedPhase))
+		},
+			table.Entry("fail on a raw named qcow2 image with a backing file in strict mode", true, ProcessingPhaseError, "backing file: true"),
+			table.Entry("fail on the backing file of a raw named qcow2 image by default", false, ProcessingPhaseError, "references external backing file base.img"),
+		)
+
+		It("Info should fail on a backing file before transferring", func() {
+			client := &s3DataClient{data: append(createQcow2Header("base.img"), make([]byte, 64*1024)...)}
+			newClientFunc = func(endpoint, accKey, secKey string, certDir string, options s3ClientOptions) (S3Client, error) {
+				return client, nil
+			}
+			var err error
+			sd, err = NewS3DataSource("http://region.amazon.com/bucket-1/disk.qcow2", "", "", "")
+			Expect(err).NotTo(HaveOccurred())
+			result, err := sd.Info()
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Cause(err)).To(Equal(ErrExternalBackingFile))
+			Expect(result).To(Equal(ProcessingPhaseError))
+			Expect(sd.readers.progressReader.Current).To(BeNumerically("<", len(client.data)))
+		})
+	})
+})
+
+var _ = Describe("Expected virtual size check", func() {
+	const MiB = 1024 * 1024
+
+	table.DescribeTable("checkExpectedVirtualSize should", func(data []byte, contentLength uint64, expected, tolerance int64, wantErr bool) {
+		readers, err := NewFormatReaders(ioutil.NopCloser(bytes.NewReader(data)), 0)
+		Expect(err).NotTo(HaveOccurred())
+		err = checkExpectedVirtualSize("disk", readers, contentLength, expected, tolerance)
+		if wantErr {
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Cause(err)).To(Equal(ErrVirtualSizeMismatch))
+		} else {
+			Expect(err).NotTo(HaveOccurred())
+		}
+	},
+		table.Entry("accept an exact match", createQcow2Header(""), uint64(0), int64(MiB), int64(0), false),
+		table.Entry("accept a smaller size within tolerance", createQcow2Header(""), uint64(0), int64(MiB+4096), int64(4096), false),
+		table.Entry("accept a larger size within tolerance", createQcow2Header(""), uint64(0), int64(MiB-4096), int64(4096), false),
+		table.Entry("reject a size out of tolerance", createQcow2Header(""), uint64(0), int64(MiB+4097), int64(4096), true),
+		table.Entry("reject a mismatch without tolerance", createQcow2Header(""), uint64(0), int64(2*MiB), int64(0), true),
+		table.Entry("compare the content length of raw images", make([]byte, 1024), uint64(MiB), int64(2*MiB), int64(0), true),
+		table.Entry("accept a size mismatch when not checking", createQcow2Header(""), uint64(0), int64(0), int64(0), false),
+		table.Entry("accept images of unknown virtual size", make([]byte, 1024), uint64(0), int64(2*MiB), int64(0), false),
+	)
+
+	table.DescribeTable("checkTargetCapacity should", func(data []byte, contentLength uint64, capacity int64, wantErr bool) {
+		readers, err := NewFormatReaders(ioutil.NopCloser(bytes.NewReader(data)), 0)
+		Expect(err).NotTo(HaveOccurred())
+		err = checkTargetCapacity("disk", readers, contentLength, capacity)
+		if wantErr {
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Cause(err)).To(Equal(ErrVirtualSizeExceedsCapacity))
+		} else {
+			Expect(err).NotTo(HaveOccurred())
+		}
+	},
+		table.Entry("accept a qcow2 image filling the target", createQcow2Header(""), uint64(0), int64(MiB), false),
+		table.Entry("reject a qcow2 image larger than the target", createQcow2Header(""), uint64(0), int64(MiB-512), true),
+		table.Entry("accept a raw image smaller than the target", make([]byte, 1024), uint64(MiB), int64(2*MiB), false),
+		table.Entry("reject a raw image larger than the target", make([]byte, 1024), uint64(2*MiB), int64(MiB), true),
+		table.Entry("accept any image when not checking", createQcow2Header(""), uint64(0), int64(0), false),
+		table.Entry("accept images of unknown virtual size", make([]byte, 1024), uint64(0), int64(MiB), false),
+	)
+
+	It("FormatReaders should record the qcow2 virtual size", func() {
+		readers, err := NewFormatReaders(ioutil.NopCloser(bytes.NewReader(createQcow2Header(""))), 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(readers.VirtualSize).To(Equal(int64(MiB)))
+	})
+
+	It("S3 Info should fail before transfer on a virtual size mismatch", func() {
+		newClientFunc = createMockS3Client
+		defer func() { newClientFunc = getS3Client }()
+		sd, err := NewS3DataSourceWithOptions("http://region.amazon.com/bucket-1/disk.qcow2", "", "", "", S3Options{ExpectedVirtualSize: 2 * MiB})
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		sd.s3Reader = ioutil.NopCloser(bytes.NewReader(createQcow2Header("")))
+		result, err := sd.Info()
+		Expect(err).To(HaveOccurred())
+		Expect(errors.Cause(err)).To(Equal(ErrVirtualSizeMismatch))
+		Expect(result).To(Equal(ProcessingPhaseError))
+	})
+
+	It("S3 Info should fail before transfer when the image exceeds the target capacity", func() {
+		newClientFunc = createMockS3Client
+		defer func() { newClientFunc = getS3Client }()
+		sd, err := NewS3DataSourceWithOptions("http://region.amazon.com/bucket-1/disk.qcow2", "", "", "", S3Options{TargetCapacity: MiB / 2})
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		sd.s3Reader = ioutil.NopCloser(bytes.NewReader(createQcow2Header("")))
+		result, err := sd.Info()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(fmt.Sprintf("image virtual size %d exceeds available space %d", MiB, MiB/2)))
+		Expect(result).To(Equal(ProcessingPhaseError))
+	})
+
+	table.DescribeTable("Info should fail on an empty", func(newSource func() (DataSourceInterface, error)) {
+		source, err := newSource()
+		Expect(err).NotTo(HaveOccurred())
+		defer source.Close()
+		result, err := source.Info()
+		Expect(err).To(HaveOccurred())
+		Expect(errors.Cause(err)).To(Equal(ErrEmptySource))
+		Expect(err.Error()).To(Equal("source object is empty (0 bytes)"))
+		Expect(result).To(Equal(ProcessingPhaseError))
+	},
+		table.Entry("S3 object of reported size 0", func() (DataSourceInterface, error) {
+			newClientFunc = func(endpoint, accKey, secKey string, certDir string, options s3ClientOptions) (S3Client, error) {
+				return &rangedMockS3Client{data: []byte{}}, nil
+			}
+			defer func() { newClientFunc = getS3Client }()
+			return NewS3DataSource("http://region.amazon.com/bucket-1/disk.img", "", "", "")
+		}),
+		table.Entry("S3 object of unknown size", func() (DataSourceInterface, error) {
+			newClientFunc = createMockS3Client
+			defer func() { newClientFunc = getS3Client }()
+			sd, err := NewS3DataSource("http://region.amazon.com/bucket-1/disk.img", "", "", "")
+			if err == nil {
+				sd.s3Reader = ioutil.NopCloser(bytes.NewReader(nil))
+			}
+			return sd, err
+		}),
+		table.Entry("Azure blob", func() (DataSourceInterface, error) {
+			newAzureBlobClientFunc = func(serviceURL *url.URL, accountName, credential, certDir string, pins spkiPins, retryAfterBudget time.Duration) (AzureBlobClient, error) {
+				return &mockAzureBlobClient{data: []byte{}, blobType: AzureBlockBlob}, nil
+			}
+			defer func() { newAzureBlobClientFunc = getAzureBlobClient }()
+			return NewAzureBlobDataSource("az://images/disk.img", "goldenimages", "", "", AzureBlobOptions{})
+		}),
+		table.Entry("FTP file", func() (DataSourceInterface, error) {
+			newFTPClientFunc = func(ep *url.URL, user, password, certDir string, pins spkiPins) (FTPClient, error) {
+				return &mockFTPClient{data: []byte{}}, nil
+			}
+			defer func() { newFTPClientFunc = getFTPClient }()
+			return NewFTPDataSource("ftp://images.example.com/disk.img", "", "", "", FTPOptions{})
+		}),
+		table.Entry("FTP file of unknown size", func() (DataSourceInterface, error) {
+			newFTPClientFunc = func(ep *url.URL, user, password, certDir string, pins spkiPins) (FTPClient, error) {
+				return &mockFTPClient{data: []byte{}, noSize: true}, nil
+			}
+			defer func() { newFTPClientFunc = getFTPClient }()
+			return NewFTPDataSource("ftp://images.example.com/disk.img", "", "", "", FTPOptions{})
+		}),
+		table.Entry("upload", func() (DataSourceInterface, error) {
+			return NewUploadDataSource(ioutil.NopCloser(bytes.NewReader(nil))), nil
+		}),
+	)
+})
@@ -0,0 +1,145 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"sync"
+
+	"k8s.io/klog/v2"
+
+	"kubevirt.io/containerized-data-importer/pkg/image"
+)
+
+const (
+	// FormatConfidenceNone is the confidence of a detector not recognizing the header.
+	FormatConfidenceNone = 0
+	// FormatConfidenceFallback is the confidence of the raw detector, matching any header.
+	FormatConfidenceFallback = 1
+	// FormatConfidenceMagic is the confidence of the built-in detectors matching the magic number of their format. A
+	// detector returning a higher confidence overrides them.
+	FormatConfidenceMagic = 100
+)
+
+// FormatDetection is the result of a FormatDetector given the header of the source.
+type FormatDetection struct {
+	// Format is the detected format, like qcow2 or gz.
+	Format string
+	// Confidence ranks the detections of the header, the most confident one is used. FormatConfidenceNone if the
+	// header isn't recognized.
+	Confidence int
+	// Phase is the phase following Info for the detected format: ProcessingPhaseTransferScratch if the image is
+	// converted, ProcessingPhaseTransferDataFile if it is written as is, ProcessingPhaseInfo if the format readers
+	// unwrap the format, like a compression, and detect the header again, or ProcessingPhaseError if the format
+	// can't be imported.
+	Phase ProcessingPhase
+}
+
+// FormatDetector detects the format of the source from its header, image.MaxExpectedHdrSize bytes.
+type FormatDetector func(header []byte) FormatDetection
+
+// namedFormatDetector is a registered detector.
+type namedFormatDetector struct {
+	name     string
+	detector FormatDetector
+}
+
+var (
+	formatDetectorsMutex sync.RWMutex
+	// formatDetectors are the registered detectors in registration order, the order breaks confidence ties.
+	formatDetectors []namedFormatDetector
+)
+
+func init() {
+	for _, format := range []string{"qcow2", "vmdk", "vmdk-descriptor", "vdi", "vhd", "vhdx", "gz", "xz", "zst", "tar"} {
+		RegisterFormatDetector(format, magicFormatDetector(format))
+	}
+	RegisterFormatDetector(formatRaw, func(header []byte) FormatDetection {
+		return FormatDetection{Format: formatRaw, Confidence: FormatConfidenceFallback, Phase: ProcessingPhaseTransferDataFile}
+	})
+}
+
+// RegisterFormatDetector registers detector under name, replacing the detector already registered under that name
+// in its place. The format readers created afterwards use the detection of the highest confidence, the detector
+// registered first among equally confident ones. The formats unknown to the format readers are converted, written
+// as is or refused according to the phase of their detection, they can't be unwrapped. A nil detector unregisters
+// name.
+func RegisterFormatDetector(name string, detector FormatDetector) {
+	formatDetectorsMutex.Lock()
+	defer formatDetectorsMutex.Unlock()
+	for i, registered := range formatDetectors {
+		if registered.name != name {
+			continue
+		}
+		if detector == nil {
+			formatDetectors = append(formatDetectors[:i:i], formatDetectors[i+1:]...)
+		} else {
+			formatDetectors[i].detector = detector
+		}
+		return
+	}
+	if detector != nil {
+		formatDetectors = append(formatDetectors, namedFormatDetector{name: name, detector: detector})
+	}
+}
+
+// RegisteredFormatDetectors returns the names of the registered detectors in registration order.
+func RegisteredFormatDetectors() []string {
+	formatDetectorsMutex.RLock()
+	defer formatDetectorsMutex.RUnlock()
+	names := make([]string, 0, len(formatDetectors))
+	for _, registered := range formatDetectors {
+		names = append(names, registered.name)
+	}
+	return names
+}
+
+// magicFormatDetector returns the detector of a built-in format, matching its magic number.
+func magicFormatDetector(format string) FormatDetector {
+	hdr := image.CopyKnownHdrs()[format]
+	phase := ProcessingPhaseTransferScratch
+	switch format {
+	case "gz", "xz", "zst", "tar":
+		phase = ProcessingPhaseInfo
+	case "vmdk-descriptor":
+		phase = ProcessingPhaseError
+	}
+	return func(header []byte) FormatDetection {
+		if !hdr.Match(header) {
+			return FormatDetection{}
+		}
+		return FormatDetection{Format: format, Confidence: FormatConfidenceMagic, Phase: phase}
+	}
+}
+
+// detectFormat returns the most confident detection of header among the formats not excluded, nil if no detector
+// recognizes it.
+func detectFormat(header []byte, excluded map[string]bool) *FormatDetection {
+	formatDetectorsMutex.RLock()
+	defer formatDetectorsMutex.RUnlock()
+	var best *FormatDetection
+	for _, registered := range formatDetectors {
+		detection := registered.detector(header)
+		if detection.Confidence <= FormatConfidenceNone || excluded[detection.Format] {
+			continue
+		}
+		klog.V(3).Infof("detector %q found %q with confidence %d", registered.name, detection.Format, detection.Confidence)
+		if best == nil || detection.Confidence > best.Confidence {
+			best = &detection
+		}
+	}
+	return best
+}
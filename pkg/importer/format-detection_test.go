@@ -0,0 +1,125 @@
+package importer
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// qedMagic starts the header of a QED image, a format unknown to the format readers.
+var qedMagic = []byte{'Q', 'E', 'D', 0}
+
+// prefixDetector returns a detector of format, recognizing the headers starting with prefix.
+func prefixDetector(prefix []byte, format string, confidence int, phase ProcessingPhase) FormatDetector {
+	return func(header []byte) FormatDetection {
+		if !bytes.HasPrefix(header, prefix) {
+			return FormatDetection{}
+		}
+		return FormatDetection{Format: format, Confidence: confidence, Phase: phase}
+	}
+}
+
+var _ = Describe("Format detection", func() {
+	builtins := []string{"qcow2", "vmdk", "vmdk-descriptor", "vdi", "vhd", "vhdx", "gz", "xz", "zst", "tar", "raw"}
+
+	AfterEach(func() {
+		for _, name := range []string{"custom-1", "custom-2", "qed"} {
+			RegisterFormatDetector(name, nil)
+		}
+		RegisterFormatDetector("qcow2", magicFormatDetector("qcow2"))
+		Expect(RegisteredFormatDetectors()).To(Equal(builtins))
+	})
+
+	newReaders := func(data []byte) (*FormatReaders, error) {
+		return NewFormatReaders(ioutil.NopCloser(bytes.NewReader(data)), uint64(len(data)))
+	}
+
+	qedImage := func() []byte {
+		return append(append([]byte{}, qedMagic...), make([]byte, 4096)...)
+	}
+
+	It("should register the built-in detectors at init", func() {
+		Expect(RegisteredFormatDetectors()).To(Equal(builtins))
+	})
+
+	It("should keep the registration order", func() {
+		RegisterFormatDetector("custom-1", prefixDetector(qedMagic, "custom-1", FormatConfidenceMagic, ProcessingPhaseTransferScratch))
+		RegisterFormatDetector("custom-2", prefixDetector(qedMagic, "custom-2", FormatConfidenceMagic, ProcessingPhaseTransferScratch))
+		Expect(RegisteredFormatDetectors()).To(Equal(append(append([]string{}, builtins...), "custom-1", "custom-2")))
+
+		// Registering a name again replaces its detector in place.
+		RegisterFormatDetector("custom-1", prefixDetector(qedMagic, "custom-1", FormatConfidenceNone, ProcessingPhaseTransferScratch))
+		Expect(RegisteredFormatDetectors()).To(Equal(append(append([]string{}, builtins...), "custom-1", "custom-2")))
+		Expect(detectFormat(qedImage(), nil).Format).To(Equal("custom-2"))
+
+		RegisterFormatDetector("custom-1", nil)
+		Expect(RegisteredFormatDetectors()).To(Equal(append(append([]string{}, builtins...), "custom-2")))
+	})
+
+	It("should prefer the detector registered first among equally confident ones", func() {
+		RegisterFormatDetector("custom-1", prefixDetector(qedMagic, "custom-1", FormatConfidenceMagic, ProcessingPhaseTransferScratch))
+		RegisterFormatDetector("custom-2", prefixDetector(qedMagic, "custom-2", FormatConfidenceMagic, ProcessingPhaseTransferScratch))
+		Expect(detectFormat(qedImage(), nil).Format).To(Equal("custom-1"))
+	})
+
+	It("should prefer the most confident detection", func() {
+		RegisterFormatDetector("custom-1", prefixDetector(qedMagic, "custom-1", FormatConfidenceMagic, ProcessingPhaseTransferScratch))
+		RegisterFormatDetector("custom-2", prefixDetector(qedMagic, "custom-2", FormatConfidenceMagic+1, ProcessingPhaseTransferScratch))
+		Expect(detectFormat(qedImage(), nil).Format).To(Equal("custom-2"))
+	})
+
+	It("should let a custom detector override a built-in one", func() {
+		RegisterFormatDetector("custom-1", prefixDetector(cirrosData[:4], "raw", FormatConfidenceMagic+1, ProcessingPhaseTransferDataFile))
+		readers, err := newReaders(cirrosData)
+		Expect(err).NotTo(HaveOccurred())
+		defer readers.Close()
+		Expect(readers.Convert).To(BeFalse())
+		Expect(readers.Format).To(BeEmpty())
+	})
+
+	It("should let a detector registered under the name of a built-in one replace it", func() {
+		RegisterFormatDetector("qcow2", func(header []byte) FormatDetection {
+			return FormatDetection{}
+		})
+		readers, err := newReaders(cirrosData)
+		Expect(err).NotTo(HaveOccurred())
+		defer readers.Close()
+		Expect(readers.Convert).To(BeFalse())
+	})
+
+	table.DescribeTable("should handle a custom format", func(phase ProcessingPhase, convert bool, expectedErr string) {
+		RegisterFormatDetector("qed", prefixDetector(qedMagic, "qed", FormatConfidenceMagic, phase))
+		readers, err := newReaders(qedImage())
+		if expectedErr != "" {
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(expectedErr))
+			return
+		}
+		Expect(err).NotTo(HaveOccurred())
+		defer readers.Close()
+		Expect(readers.Convert).To(Equal(convert))
+		if convert {
+			Expect(readers.Format).To(Equal("qed"))
+		} else {
+			Expect(readers.Format).To(BeEmpty())
+		}
+	},
+		table.Entry("converted", ProcessingPhaseTransferScratch, true, ""),
+		table.Entry("written as is", ProcessingPhaseTransferDataFile, false, ""),
+		table.Entry("refused", ProcessingPhaseError, false, "qed images are not supported"),
+		table.Entry("which can't be unwrapped", ProcessingPhaseInfo, false, "qed images can't be unwrapped"),
+	)
+
+	It("should detect the image under a compression", func() {
+		zst, err := ioutil.ReadFile(cirrosZstFilePath)
+		Expect(err).NotTo(HaveOccurred())
+		readers, err := newReaders(zst)
+		Expect(err).NotTo(HaveOccurred())
+		defer readers.Close()
+		Expect(readers.ArchiveZstd).To(BeTrue())
+		Expect(readers.Format).To(Equal("qcow2"))
+	})
+})
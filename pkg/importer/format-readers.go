@@ -19,11 +19,15 @@ package importer
 import (
 	"bytes"
 	"compress/gzip"
+	"encoding/binary"
 	"encoding/hex"
 	"io"
 	"io/ioutil"
+	"regexp"
 	"strconv"
+	"strings"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/errors"
 	"github.com/ulikunitz/xz"
 
@@ -74,14 +78,67 @@ type FormatReaders struct {
 	Archived       bool
 	ArchiveXz      bool
 	ArchiveGz      bool
+	ArchiveZstd    bool
 	progressReader *prometheusutil.ProgressReader
+	// total is the size of the stream, 0 if unknown.
+	total uint64
+	// progressFunc is called by the progress reporter, nil if not set.
+	progressFunc ProgressFunc
+	// progressReporter calls the progress func, nil unless started.
+	progressReporter *progressReporter
+	// digest computes the digest of the source data, nil unless the checksum allowlist requires it.
+	digest *digestReader
+	// signature verifies the signature of the source data, nil unless the signatures are verified.
+	signature *signatureReader
+	// Format is the detected image format, after decompression. Empty if no image format header was found (raw).
+	Format string
+	// BackingFile is true if the detected image references a backing file.
+	BackingFile bool
+	// BackingFileName is the name of the backing file referenced by the detected image, empty if unknown.
+	BackingFileName string
+	// VirtualSize is the virtual size recorded in the image header, 0 if the header doesn't record it.
+	VirtualSize int64
+	// Snapshots is the number of internal snapshots of a qcow2 image, recorded at offset 60 in the header.
+	Snapshots int
+	// InternalCompression is the compression of the clusters of a qcow2 image, zlib or zstd, empty if its clusters
+	// aren't compressed or it's unknown.
+	InternalCompression string
+	// TarArchive is true if the data, after decompression, is a tar archive.
+	TarArchive bool
+	// RawLayout is the layout of a raw disk, RawLayoutMBR, RawLayoutGPT or RawLayoutFilesystem. Empty if the image
+	// isn't raw or the layout isn't recognized.
+	RawLayout string
+	// lookAhead is the furthest the qcow2 L1 and L2 tables are read ahead to find compressed clusters.
+	lookAhead uint64
 }
 
+const (
+	// qcow2MaxBackingFileName is the longest backing file name qemu accepts.
+	qcow2MaxBackingFileName = 1023
+	// qcow2MaxClusterSize is the largest qcow2 cluster, the backing file name is stored in the first cluster.
+	qcow2MaxClusterSize = 2 * 1024 * 1024
+	// qcow2MaxLookAhead is the furthest the qcow2 L1 and L2 tables are read ahead to find compressed clusters by
+	// default. With ranged format detection, they are only looked for in the head of the object.
+	qcow2MaxLookAhead = 4 * 1024 * 1024
+	// vmdkSectorSize is the size of the sectors vmdk sizes are counted in.
+	vmdkSectorSize = 512
+	// vmdkCompressedFlag is the flag of the vmdk header of the compressed grains of a stream-optimized extent.
+	vmdkCompressedFlag = 1 << 16
+)
+
+// vmdkDescriptorMagic starts a vmdk descriptor file.
+var vmdkDescriptorMagic = []byte("# Disk DescriptorFile")
+
+// vmdkExtentRegexp matches the extent lines of a vmdk descriptor, for instance RW 4192256 SPARSE "disk-s001.vmdk",
+// capturing the file name.
+var vmdkExtentRegexp = regexp.MustCompile(`(?m)^\s*(?:RW|RDONLY|NOACCESS)\s+\d+\s+\w+\s+"([^"]+)"`)
+
 const (
 	rdrGz = iota
 	rdrMulti
 	rdrXz
 	rdrStream
+	rdrZstd
 )
 
 // map scheme and format to rdrType
@@ -89,42 +146,90 @@ var rdrTypM = map[string]int{
 	"gz":     rdrGz,
 	"xz":     rdrXz,
 	"stream": rdrStream,
+	"zst":    rdrZstd,
 }
 
 // NewFormatReaders creates a new instance of FormatReaders using the input stream and content type passed in.
 func NewFormatReaders(stream io.ReadCloser, total uint64) (*FormatReaders, error) {
+	return newFormatReaders(stream, total, sourceSizeLimits{}, sourceVerification{})
+}
+
+// newFormatReaders creates the format readers of a stream of total bytes, 0 if unknown, checking its size against
+// limits and making the verifications.
+func newFormatReaders(stream io.ReadCloser, total uint64, limits sourceSizeLimits, verification sourceVerification) (*FormatReaders, error) {
+	return newFormatReadersWithLookAhead(stream, total, limits, verification, qcow2MaxLookAhead)
+}
+
+// newFormatReadersWithLookAhead creates the format readers of a stream like newFormatReaders, reading at most
+// lookAhead bytes ahead to inspect the image.
+func newFormatReadersWithLookAhead(stream io.ReadCloser, total uint64, limits sourceSizeLimits, verification sourceVerification, lookAhead uint64) (*FormatReaders, error) {
 	var err error
 	readers := &FormatReaders{
-		buf: make([]byte, image.MaxExpectedHdrSize),
+		buf:       make([]byte, image.MaxExpectedHdrSize),
+		total:     total,
+		lookAhead: lookAhead,
 	}
-	if total > uint64(0) {
-		readers.progressReader = prometheusutil.NewProgressReader(stream, total, progress, ownerUID)
-		err = readers.constructReaders(readers.progressReader)
-	} else {
-		err = readers.constructReaders(stream)
+	if limits.maxSourceBytes > 0 {
+		if err := limits.checkMaxSourceSize(total); err != nil {
+			return nil, err
+		}
+		stream = &maxSourceSizeReader{reader: stream, max: limits.maxSourceBytes}
 	}
+	if total > 0 {
+		stream = newSourceSizeReader(stream, total, limits.strictSourceSize, func(read uint64) {
+			if readers.progressReader != nil {
+				readers.progressReader.SetTotal(read)
+			}
+		})
+	}
+	if verification.digest {
+		readers.digest = newDigestReader(stream)
+		stream = readers.digest
+	}
+	if verification.signature != nil {
+		readers.signature = newSignatureReader(stream, verification.signature)
+		stream = readers.signature
+	}
+	// The progress service, the progress func and the phase metrics count the bytes transferred even if the total is
+	// unknown.
+	readers.progressReader = prometheusutil.NewProgressReader(stream, total, progress, ownerUID)
+	if phaseMetricsRecorder != nil {
+		trackPhaseBytes(readers.progressReader)
+	}
+	err = readers.constructReaders(readers.progressReader)
 	return readers, err
 }
 
 func (fr *FormatReaders) constructReaders(r io.ReadCloser) error {
 	fr.appendReader(rdrTypM["stream"], r)
-	knownHdrs := image.CopyKnownHdrs() // need local copy since keys are removed
+	unwrapped := map[string]bool{} // the formats already unwrapped aren't detected again
 	klog.V(3).Infof("constructReaders: checking compression and archive formats\n")
 	for {
-		hdr, err := fr.matchHeader(&knownHdrs)
+		detection, err := fr.matchHeader(unwrapped)
+		if err == io.EOF && len(fr.readers) == 1 {
+			// Nothing at all could be read.
+			return ErrEmptySource
+		}
 		if err != nil {
 			return errors.WithMessage(err, "could not process image header")
 		}
-		if hdr == nil {
+		if detection == nil || detection.Format == formatRaw {
 			break // done processing headers, we have the orig source file
 		}
-		klog.V(2).Infof("found header of type %q\n", hdr.Format)
+		klog.V(2).Infof("found header of type %q\n", detection.Format)
 		// create format-specific reader and append it to dataStream readers stack
-		fr.fileFormatSelector(hdr)
-		// exit loop if hdr is qcow2
-		if hdr.Format == "qcow2" {
+		if err := fr.fileFormatSelector(detection); err != nil {
+			return errors.WithMessagef(err, "could not process %s stream", detection.Format)
+		}
+		// exit loop unless the format was unwrapped
+		if detection.Phase != ProcessingPhaseInfo {
 			break
 		}
+		unwrapped[detection.Format] = true
+	}
+	if fr.Format == "" && !fr.TarArchive {
+		fr.RawLayout = detectRawLayout(fr.peek(rawLayoutPeekSize))
+		klog.V(2).Infof("raw disk layout %q\n", fr.RawLayout)
 	}
 
 	return nil
@@ -156,12 +261,23 @@ func (fr *FormatReaders) TopReader() io.ReadCloser {
 	return fr.readers[len(fr.readers)-1].rdr
 }
 
-// Based on the passed in header, append the format-specific reader to the readers stack,
+// topReaderSize returns the size of the top reader for a source of size bytes, -1 if the source is decompressed and
+// the size of the top reader is unknown.
+func (fr *FormatReaders) topReaderSize(size int64) int64 {
+	if fr.Archived {
+		return -1
+	}
+	return size
+}
+
+// Based on the passed in detection, append the format-specific reader to the readers stack,
 // and update the receiver Size field. Note: a bool is set in the receiver for qcow2 files.
-func (fr *FormatReaders) fileFormatSelector(hdr *image.Header) {
+// Fails if the decompressor of a compressed stream can't be created, rather than reading the
+// compressed data as the image. The formats unknown to the readers follow the phase of their detection.
+func (fr *FormatReaders) fileFormatSelector(detection *FormatDetection) error {
 	var r io.Reader
 	var err error
-	fFmt := hdr.Format
+	fFmt := detection.Format
 	switch fFmt {
 	case "gz":
 		r, err = fr.gzReader()
@@ -170,17 +286,35 @@ func (fr *FormatReaders) fileFormatSelector(hdr *image.Header) {
 			fr.ArchiveGz = true
 		}
 	case "qcow2":
-		r, err = fr.qcow2NopReader(hdr)
+		r, err = fr.qcow2NopReader(image.CopyKnownHdrs()[fFmt])
 		fr.Convert = true
+		fr.BackingFile = qcow2HasBackingFile(fr.buf)
+		if err == nil && fr.BackingFile {
+			fr.BackingFileName = fr.qcow2BackingFileName()
+		}
+		fr.Snapshots = int(binary.BigEndian.Uint32(fr.buf[60:64]))
+		if err == nil {
+			fr.InternalCompression = fr.qcow2InternalCompression()
+		}
 	case "xz":
 		r, err = fr.xzReader()
 		if err == nil {
 			fr.Archived = true
 			fr.ArchiveXz = true
 		}
+	case "zst":
+		r, err = fr.zstdReader()
+		if err == nil {
+			fr.Archived = true
+			fr.ArchiveZstd = true
+		}
 	case "vmdk":
-		r = nil
+		r, err = fr.vmdkNopReader()
 		fr.Convert = true
+	case "vmdk-descriptor":
+		err = vmdkDescriptorError(fr.buf)
+	case "tar":
+		fr.TarArchive = true
 	case "vdi":
 		r = nil
 		fr.Convert = true
@@ -190,10 +324,28 @@ func (fr *FormatReaders) fileFormatSelector(hdr *image.Header) {
 	case "vhdx":
 		r = nil
 		fr.Convert = true
+	default:
+		switch detection.Phase {
+		case ProcessingPhaseTransferScratch:
+			fr.Convert = true
+		case ProcessingPhaseTransferDataFile:
+			klog.V(2).Infof("%s image is written as is", fFmt)
+		case ProcessingPhaseError:
+			err = errors.Errorf("%s images are not supported", fFmt)
+		default:
+			err = errors.Errorf("%s images can't be unwrapped, unexpected phase %s", fFmt, detection.Phase)
+		}
+	}
+	if err != nil {
+		return err
 	}
-	if err == nil && r != nil {
+	if fr.Convert {
+		fr.Format = fFmt
+	}
+	if r != nil {
 		fr.appendReader(rdrTypM[fFmt], r)
 	}
+	return nil
 }
 
 // Return the gz reader and the size of the endpoint "through the eye" of the previous reader.
@@ -213,15 +365,125 @@ func (fr *FormatReaders) gzReader() (io.ReadCloser, error) {
 // Return the size of the endpoint "through the eye" of the previous reader. Note: there is no
 // qcow2 reader so nil is returned so that nothing is appended to the reader stack.
 // Note: size is stored at offset 24 in the qcow2 header.
-func (fr *FormatReaders) qcow2NopReader(h *image.Header) (io.Reader, error) {
+func (fr *FormatReaders) qcow2NopReader(h image.Header) (io.Reader, error) {
 	s := hex.EncodeToString(fr.buf[h.SizeOff : h.SizeOff+h.SizeLen])
-	_, err := strconv.ParseInt(s, 16, 64)
+	size, err := strconv.ParseInt(s, 16, 64)
 	if err != nil {
 		return nil, errors.Wrapf(err, "unable to determine original qcow2 file size from %+v", s)
 	}
+	fr.VirtualSize = size
 	return nil, nil
 }
 
+// qcow2HasBackingFile returns true if the backing file offset, stored at offset 8 in the qcow2 header, is set.
+func qcow2HasBackingFile(buf []byte) bool {
+	return binary.BigEndian.Uint64(buf[8:16]) != 0
+}
+
+// qcow2BackingFileName returns the name of the backing file of the qcow2 image, whose offset is stored at offset 8 in
+// the header and its length at offset 16. A name beyond the header is read ahead, and the data read put back in front
+// of the stream. Returns an empty string if the name can't be read.
+func (fr *FormatReaders) qcow2BackingFileName() string {
+	offset := binary.BigEndian.Uint64(fr.buf[8:16])
+	size := uint64(binary.BigEndian.Uint32(fr.buf[16:20]))
+	if size == 0 || size > qcow2MaxBackingFileName || offset > qcow2MaxClusterSize {
+		return ""
+	}
+	end := offset + size
+	if end <= uint64(len(fr.buf)) {
+		return string(fr.buf[offset:end])
+	}
+	ahead := make([]byte, end)
+	n, err := io.ReadFull(fr.TopReader(), ahead)
+	fr.appendReader(rdrMulti, bytes.NewReader(ahead[:n]))
+	if err != nil {
+		return ""
+	}
+	return string(ahead[offset:end])
+}
+
+// qcow2InternalCompression returns the compression of the clusters of the qcow2 image, zlib, or zstd if the
+// compression type incompatible feature bit is set at offset 72 and the compression type at offset 104 is zstd. The
+// clusters are deemed compressed if the first L2 table has compressed entries, like the images written by qemu-img
+// convert -c. The L1 table, whose size is stored at offset 36 and offset at offset 40, and the first L2 table are
+// peeked at. Returns an empty string if the clusters aren't compressed, or the tables are beyond the look-ahead.
+func (fr *FormatReaders) qcow2InternalCompression() string {
+	lookAhead := fr.lookAhead
+	clusterBits := binary.BigEndian.Uint32(fr.buf[20:24])
+	l1Size := uint64(binary.BigEndian.Uint32(fr.buf[36:40]))
+	l1Offset := binary.BigEndian.Uint64(fr.buf[40:48])
+	if clusterBits < 9 || clusterBits > 21 || l1Size == 0 || l1Offset > lookAhead || l1Size*8 > lookAhead-l1Offset {
+		return ""
+	}
+	compression := "zlib"
+	entrySize := uint64(8)
+	if binary.BigEndian.Uint32(fr.buf[4:8]) >= 3 {
+		incompatible := binary.BigEndian.Uint64(fr.buf[72:80])
+		if incompatible&qcow2CompressionTypeBit != 0 && binary.BigEndian.Uint32(fr.buf[100:104]) > 104 &&
+			fr.buf[104] == qcow2CompressionZstd {
+			compression = "zstd"
+		}
+		if incompatible&qcow2ExtendedL2Bit != 0 {
+			entrySize = 16
+		}
+	}
+	ahead := fr.peek(int(l1Offset + l1Size*8))
+	if uint64(len(ahead)) < l1Offset+l1Size*8 {
+		return ""
+	}
+	var l2Offset uint64
+	for i := l1Offset; i < l1Offset+l1Size*8 && l2Offset == 0; i += 8 {
+		l2Offset = binary.BigEndian.Uint64(ahead[i:]) & qcow2OffsetMask
+	}
+	clusterSize := uint64(1) << clusterBits
+	if l2Offset == 0 || l2Offset+clusterSize > lookAhead {
+		return ""
+	}
+	if ahead = fr.peek(int(l2Offset + clusterSize)); uint64(len(ahead)) < l2Offset+clusterSize {
+		return ""
+	}
+	for i := l2Offset; i < l2Offset+clusterSize; i += entrySize {
+		if binary.BigEndian.Uint64(ahead[i:])&qcow2CompressedFlag != 0 {
+			klog.V(1).Infof("qcow2 image has %s compressed clusters", compression)
+			return compression
+		}
+	}
+	return ""
+}
+
+// vmdkNopReader records the virtual size of a hosted sparse vmdk extent, monolithic sparse or stream-optimized, and
+// fails on an extent without embedded descriptor, which is one of the extents of a multi-extent disk. Note: there is
+// no vmdk reader so nil is returned so that nothing is appended to the reader stack.
+// Note: the header is little endian, the capacity in sectors is stored at offset 12, the descriptor offset at 28.
+func (fr *FormatReaders) vmdkNopReader() (io.Reader, error) {
+	flags := binary.LittleEndian.Uint32(fr.buf[8:12])
+	capacity := binary.LittleEndian.Uint64(fr.buf[12:20])
+	descriptorOffset := binary.LittleEndian.Uint64(fr.buf[28:36])
+	if descriptorOffset == 0 {
+		return nil, errors.New("vmdk extent has no embedded descriptor, it is one extent of a multi-extent disk whose other files can't be imported with it")
+	}
+	if flags&vmdkCompressedFlag != 0 {
+		klog.V(2).Infof("vmdk: stream-optimized extent of %d sectors", capacity)
+	} else {
+		klog.V(2).Infof("vmdk: monolithic sparse extent of %d sectors", capacity)
+	}
+	fr.VirtualSize = int64(capacity) * vmdkSectorSize
+	return nil, nil
+}
+
+// vmdkDescriptorError returns the error importing a vmdk descriptor file, whose extents are separate files that can't
+// be imported with it.
+func vmdkDescriptorError(descriptor []byte) error {
+	var extents []string
+	for _, match := range vmdkExtentRegexp.FindAllSubmatch(descriptor, -1) {
+		extents = append(extents, string(match[1]))
+	}
+	if len(extents) == 0 {
+		return errors.New("vmdk descriptor file references its extents as separate files, import a monolithic sparse or stream-optimized vmdk instead")
+	}
+	return errors.Errorf("vmdk descriptor file references %d extent files (%s), import a monolithic sparse or stream-optimized vmdk instead", len(extents), strings.Join(extents, ", "))
+}
+
 // Return the xz reader and size of the endpoint "through the eye" of the previous reader.
 // Assumes a single file was compressed. Note: the xz reader is not a closer so we wrap a
 // nop Closer around it.
@@ -236,27 +498,54 @@ func (fr *FormatReaders) xzReader() (io.Reader, error) {
 	return xz, nil
 }
 
-// Return the matching header, if one is found, from the passed-in map of known headers. After a
-// successful read append a multi-reader to the receiver's reader stack.
+// Return the zstd reader of the single stream of the previous reader, without dictionary. The decoder is closed with
+// the readers.
+func (fr *FormatReaders) zstdReader() (io.ReadCloser, error) {
+	// The frames of a stream are decoded in sequence, more decoders would only hold more memory.
+	decoder, err := zstd.NewReader(fr.TopReader(), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create zstd reader")
+	}
+	return &zstdReader{decoder: decoder}, nil
+}
+
+// zstdReader reads a zstd stream, reporting a truncated frame as such rather than as an unexpected EOF.
+type zstdReader struct {
+	decoder *zstd.Decoder
+}
+
+func (r *zstdReader) Read(p []byte) (int, error) {
+	n, err := r.decoder.Read(p)
+	if err == io.ErrUnexpectedEOF {
+		return n, errors.Wrap(err, "truncated zstd frame")
+	}
+	return n, err
+}
+
+// Close stops the goroutines of the decoder.
+func (r *zstdReader) Close() error {
+	r.decoder.Close()
+	return nil
+}
+
+// Return the most confident detection of the header by the registered format detectors, if one
+// recognizes it, among the formats not excluded. After a successful read append a multi-reader to
+// the receiver's reader stack.
 // Note: .iso files are not detected here but rather in the Size() function.
-// Note: knownHdrs is passed by reference and modified.
-func (fr *FormatReaders) matchHeader(knownHdrs *image.Headers) (*image.Header, error) {
-	_, err := fr.read(fr.buf) // read current header
+func (fr *FormatReaders) matchHeader(excluded map[string]bool) (*FormatDetection, error) {
+	n, err := fr.read(fr.buf) // read current header
+	if err == io.ErrUnexpectedEOF && bytes.HasPrefix(fr.buf[:n], vmdkDescriptorMagic) {
+		// A vmdk descriptor file is often shorter than a header.
+		return nil, vmdkDescriptorError(fr.buf[:n])
+	}
 	if err != nil {
 		return nil, err
 	}
-	// append multi-reader so that the header data can be re-read by subsequent readers
-	fr.appendReader(rdrMulti, bytes.NewReader(fr.buf))
+	// append multi-reader so that the header data can be re-read by subsequent readers. The header is copied since
+	// the next header is read into fr.buf, while the zstd decoder may not have read this one yet.
+	fr.appendReader(rdrMulti, bytes.NewReader(append([]byte(nil), fr.buf...)))
 
-	// loop through known headers until a match
-	for format, kh := range *knownHdrs {
-		if kh.Match(fr.buf) {
-			// delete this header format key so that it's not processed again
-			delete(*knownHdrs, format)
-			return &kh, nil
-		}
-	}
-	return nil, nil // no match
+	return detectFormat(fr.buf, excluded), nil
 }
 
 // Read from top-most reader. Note: ReadFull is needed since there may be intermediate,
@@ -268,6 +557,7 @@ func (fr *FormatReaders) read(buf []byte) (int, error) {
 // Close Readers in reverse order.
 func (fr *FormatReaders) Close() (rtnerr error) {
 	var err error
+	fr.stopProgressUpdate()
 	for i := len(fr.readers) - 1; i >= 0; i-- {
 		err = fr.readers[i].rdr.Close()
 		if err != nil {
@@ -277,9 +567,35 @@ func (fr *FormatReaders) Close() (rtnerr error) {
 	return rtnerr
 }
 
+// sourceDigest returns the digest of the source data, reading the rest of the data if needed. It fails unless the
+// readers were created with the checksum allowlist enabled.
+func (fr *FormatReaders) sourceDigest() (string, error) {
+	if fr == nil || fr.digest == nil {
+		return "", errors.New("the digest of the source data wasn't computed")
+	}
+	return fr.digest.digest()
+}
+
+// verifySourceSignature verifies the signature of the source data, reading the rest of the data if needed. It fails
+// unless the readers were created with the signature verification enabled.
+func (fr *FormatReaders) verifySourceSignature() error {
+	if fr == nil || fr.signature == nil {
+		return errors.New("the signature of the source data wasn't verified")
+	}
+	return fr.signature.verify()
+}
+
 // StartProgressUpdate starts the go routine to automatically update the progress on a set interval.
 func (fr *FormatReaders) StartProgressUpdate() {
 	if fr.progressReader != nil {
 		fr.progressReader.StartTimedUpdate()
+		if fr.progressFunc != nil && fr.progressReporter == nil {
+			fr.progressReporter = startProgressReporter(fr.progressFunc, fr.progressReader)
+		}
 	}
 }
+
+// stopProgressUpdate stops the calls of the progress func, if started.
+func (fr *FormatReaders) stopProgressUpdate() {
+	fr.progressReporter.Stop()
+}
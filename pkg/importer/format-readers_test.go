@@ -1,6 +1,8 @@
 package importer
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -27,6 +29,9 @@ var (
 	archiveFilePath, _        = utils.ArchiveFiles(archiveFileNameWithoutExt, os.TempDir(), tinyCoreFilePath, cirrosFilePath)
 	archiveFileNameWithoutExt = strings.TrimSuffix(archiveFileName, filepath.Ext(archiveFileName))
 	cirrosFilePath            = filepath.Join(imageDir, cirrosFileName)
+	cirrosZstFilePath         = filepath.Join(imageDir, cirrosZstFileName)
+	mbrDiskFilePath           = filepath.Join(imageDir, "mbr-disk.img")
+	ext4FilePath              = filepath.Join(imageDir, "ext4.img")
 	stringRdr                 = strings.NewReader("test data for reader 1")
 )
 
@@ -62,6 +67,7 @@ var _ = Describe("Format Readers", func() {
 	},
 		table.Entry("successfully construct a xz reader", tinyCoreXzFilePath, 4, false, true, false),              // [stream, multi-r, xz, multi-r] convert = false
 		table.Entry("successfully construct a gz reader", tinyCoreGzFilePath, 4, false, true, false),              // [stream, multi-r, gz, multi-r] convert = false
+		table.Entry("successfully construct a zstd reader", cirrosZstFilePath, 4, false, true, true),              // [stream, multi-r, zstd, multi-r] convert = true
 		table.Entry("successfully return the base reader when archived", archiveFilePath, 3, false, false, false), // [stream, multi-r, multi-r] convert = false
 		table.Entry("successfully construct qcow2 reader", cirrosFilePath, 2, false, false, true),                 // [stream, multi-r] convert = true
 		table.Entry("successfully construct .iso reader", tinyCoreFilePath, 2, false, false, false),               // [stream, multi-r] convert = false
@@ -91,13 +97,191 @@ var _ = Describe("Format Readers", func() {
 		table.Entry("should append io.Multireader", rdrMulti, stringRdr, 3, false),
 	)
 
-	It("should not crash on no progress reader", func() {
+	table.DescribeTable("should fail reading a corrupted", func(filename string, corrupt func([]byte) []byte) {
+		data, err := ioutil.ReadFile(filename)
+		Expect(err).ToNot(HaveOccurred())
+		fr, err = NewFormatReaders(ioutil.NopCloser(bytes.NewReader(corrupt(data))), uint64(0))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fr.Archived).To(BeTrue())
+		_, err = io.Copy(ioutil.Discard, fr.TopReader())
+		Expect(err).To(HaveOccurred())
+	},
+		table.Entry("truncated gz stream", tinyCoreGzFilePath, truncateHalf),
+		table.Entry("gz stream with flipped bytes", tinyCoreGzFilePath, flipMiddleBytes),
+		table.Entry("truncated xz stream", tinyCoreXzFilePath, truncateHalf),
+		table.Entry("xz stream with flipped bytes", tinyCoreXzFilePath, flipMiddleBytes),
+		table.Entry("truncated zstd stream", cirrosZstFilePath, truncateHalf),
+		table.Entry("zstd stream with flipped bytes", cirrosZstFilePath, flipMiddleBytes),
+	)
+
+	It("should fail on an invalid gz header instead of reading the compressed data", func() {
+		data := make([]byte, 64*1024)
+		// gzip magic, followed by an unknown compression method
+		copy(data, []byte{0x1f, 0x8b, 0x09})
+		_, err := NewFormatReaders(ioutil.NopCloser(bytes.NewReader(data)), uint64(0))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("could not process gz stream"))
+	})
+
+	table.DescribeTable("should detect a vmdk", func(flags uint32) {
+		var err error
+		fr, err = NewFormatReaders(ioutil.NopCloser(bytes.NewReader(vmdkHeader(flags, 2097152, 1))), uint64(0))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fr.Convert).To(BeTrue())
+		Expect(fr.Format).To(Equal("vmdk"))
+		Expect(fr.VirtualSize).To(Equal(int64(1024 * 1024 * 1024)))
+	},
+		table.Entry("monolithic sparse extent", uint32(0x3)),
+		table.Entry("stream-optimized extent", uint32(0x30003)),
+	)
+
+	It("should route a vmdk through scratch space", func() {
+		ud := NewUploadDataSource(ioutil.NopCloser(bytes.NewReader(vmdkHeader(0x30003, 2048, 1))))
+		defer ud.Close()
+		result, err := ud.Info()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseTransferScratch))
+	})
+
+	table.DescribeTable("should fail on a vmdk of several files", func(data []byte, expected string) {
+		_, err := NewFormatReaders(ioutil.NopCloser(bytes.NewReader(data)), uint64(0))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(expected))
+	},
+		table.Entry("an extent without descriptor", vmdkHeader(0x3, 2048, 0), "one extent of a multi-extent disk"),
+		table.Entry("a descriptor file", vmdkDescriptor(3), "references 3 extent files (disk-s001.vmdk, disk-s002.vmdk, disk-s003.vmdk)"),
+		table.Entry("a descriptor file shorter than a header", vmdkDescriptor(1)[:300], "references 1 extent files (disk-s001.vmdk)"),
+	)
+
+	It("should report a truncated zstd frame", func() {
+		data, err := ioutil.ReadFile(cirrosZstFilePath)
+		Expect(err).ToNot(HaveOccurred())
+		fr, err = NewFormatReaders(ioutil.NopCloser(bytes.NewReader(truncateHalf(data))), uint64(0))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fr.ArchiveZstd).To(BeTrue())
+		Expect(fr.Format).To(Equal("qcow2"))
+		_, err = io.Copy(ioutil.Discard, fr.TopReader())
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("truncated zstd frame"))
+	})
+
+	table.DescribeTable("should detect the layout of", func(filename, layout string) {
+		data, err := ioutil.ReadFile(filename)
+		Expect(err).ToNot(HaveOccurred())
+		fr, err = NewFormatReaders(ioutil.NopCloser(bytes.NewReader(data)), uint64(len(data)))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fr.RawLayout).To(Equal(layout))
+		// Detecting the layout doesn't consume the data.
+		read, err := ioutil.ReadAll(fr.TopReader())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bytes.Equal(read, data)).To(BeTrue())
+	},
+		table.Entry("a disk partitioned with an MBR", mbrDiskFilePath, RawLayoutMBR),
+		table.Entry("a disk partitioned with a GPT", filepath.Join(imageDir, "cirros.raw"), RawLayoutGPT),
+		table.Entry("a bare ext4 filesystem", ext4FilePath, RawLayoutFilesystem),
+		table.Entry("a hybrid iso", tinyCoreFilePath, RawLayoutMBR),
+		table.Entry("no raw disk", cirrosFilePath, ""),
+	)
+
+	It("should detect the layout of a compressed disk", func() {
+		f, err := os.Open(tinyCoreXzFilePath)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		fr, err = NewFormatReaders(f, uint64(0))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fr.RawLayout).To(Equal(RawLayoutMBR))
+	})
+
+	It("should not take the boot sector of a FAT filesystem for an MBR", func() {
+		data := make([]byte, 64*1024)
+		copy(data, []byte{0xeb, 0x3c, 0x90, 'm', 'k', 'f', 's', '.', 'f', 'a', 't'})
+		copy(data[54:], "FAT16   ")
+		data[510], data[511] = 0x55, 0xaa
+		Expect(detectRawLayout(data)).To(Equal(RawLayoutFilesystem))
+	})
+
+	It("should not detect the layout of unrecognized or short data", func() {
+		Expect(detectRawLayout(make([]byte, rawLayoutPeekSize))).To(BeEmpty())
+		Expect(detectRawLayout([]byte{0x55, 0xaa})).To(BeEmpty())
+	})
+
+	table.DescribeTable("should detect the internal compression of", func(filename string, header func([]byte), compression string) {
+		data, err := ioutil.ReadFile(filename)
+		Expect(err).ToNot(HaveOccurred())
+		header(data)
+		fr, err = NewFormatReaders(ioutil.NopCloser(bytes.NewReader(data)), uint64(len(data)))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fr.Format).To(Equal("qcow2"))
+		Expect(fr.InternalCompression).To(Equal(compression))
+		// Reading the tables ahead doesn't consume the data.
+		read, err := ioutil.ReadAll(fr.TopReader())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bytes.Equal(read, data)).To(BeTrue())
+	},
+		table.Entry("a qcow2 image with compressed clusters", filepath.Join(imageDir, "compressed.qcow2"), func([]byte) {}, "zlib"),
+		table.Entry("a qcow2 image with zstd compressed clusters", filepath.Join(imageDir, "compressed.qcow2"), func(data []byte) {
+			data[79] |= qcow2CompressionTypeBit
+			binary.BigEndian.PutUint32(data[100:], 112)
+			data[104] = qcow2CompressionZstd
+		}, "zstd"),
+		table.Entry("a plain qcow2 image", filepath.Join(imageDir, "uncompressed.qcow2"), func([]byte) {}, ""),
+		table.Entry("a qcow2 image whose L1 table is beyond the look-ahead", filepath.Join(imageDir, "compressed.qcow2"), func(data []byte) {
+			binary.BigEndian.PutUint64(data[40:], qcow2MaxLookAhead)
+		}, ""),
+		table.Entry("cirros, distributed with compressed clusters", cirrosFilePath, func([]byte) {}, "zlib"),
+	)
+
+	It("should count the bytes of a source of unknown size", func() {
 		stringReader := ioutil.NopCloser(strings.NewReader("This is a test string"))
 		testReader, err := NewFormatReaders(stringReader, uint64(0))
 		// Not passing a real string, so the header checking will fail.
 		Expect(err).To(HaveOccurred())
-		Expect(testReader.progressReader).To(BeNil())
+		Expect(testReader.progressReader).NotTo(BeNil())
+		// This should not crash
+		testReader.StartProgressUpdate()
+	})
+
+	It("should not crash on no progress reader", func() {
+		testReader := &FormatReaders{}
 		// This should not crash
 		testReader.StartProgressUpdate()
 	})
 })
+
+// vmdkHeader returns a hosted sparse vmdk extent of capacity sectors, with the header flags and descriptor offset.
+func vmdkHeader(flags uint32, capacity, descriptorOffset uint64) []byte {
+	data := make([]byte, 64*1024)
+	copy(data, "KDMV")
+	binary.LittleEndian.PutUint32(data[4:], 3)
+	binary.LittleEndian.PutUint32(data[8:], flags)
+	binary.LittleEndian.PutUint64(data[12:], capacity)
+	binary.LittleEndian.PutUint64(data[20:], 128)
+	binary.LittleEndian.PutUint64(data[28:], descriptorOffset)
+	return data
+}
+
+// vmdkDescriptor returns a descriptor file of a twoGbMaxExtentSparse disk of extents files, longer than a header from
+// 3 extents on.
+func vmdkDescriptor(extents int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# Disk DescriptorFile\nversion=1\nCID=fffffffe\nparentCID=ffffffff\ncreateType=\"twoGbMaxExtentSparse\"\n\n# Extent description\n")
+	for i := 1; i <= extents; i++ {
+		fmt.Fprintf(&buf, "RW 4192256 SPARSE \"disk-s%03d.vmdk\"\n", i)
+	}
+	buf.WriteString("\n# The Disk Data Base\n#DDB\n\nddb.virtualHWVersion = \"4\"\nddb.geometry.cylinders = \"8322\"\nddb.geometry.heads = \"16\"\nddb.geometry.sectors = \"63\"\nddb.adapterType = \"ide\"\nddb.uuid = \"60 00 C2 9b 69 2f c9 76-74 c4 07 9e 10 c1 52 9c\"\nddb.longContentID = \"8f15b3d0009d9a3f456ff7b28d324d2a\"\nddb.toolsVersion = \"0\"\n")
+	return buf.Bytes()
+}
+
+// truncateHalf returns the first half of data.
+func truncateHalf(data []byte) []byte {
+	return data[:len(data)/2]
+}
+
+// flipMiddleBytes returns a copy of data with the bits of 16 bytes in the middle flipped.
+func flipMiddleBytes(data []byte) []byte {
+	corrupted := append([]byte(nil), data...)
+	for i := len(data) / 2; i < len(data)/2+16; i++ {
+		corrupted[i] ^= 0xff
+	}
+	return corrupted
+}
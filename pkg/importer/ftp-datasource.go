@@ -0,0 +1,433 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+
+	"kubevirt.io/containerized-data-importer/pkg/util"
+)
+
+const (
+	ftpScheme  = "ftp"
+	ftpsScheme = "ftps"
+	// ftpPort is the default port of FTP, and of FTPS with explicit TLS.
+	ftpPort = "21"
+	// ftpsImplicitPort is the default port of FTPS with implicit TLS.
+	ftpsImplicitPort = "990"
+	// ftpDialTimeout is the timeout of the control and data connections.
+	ftpDialTimeout = 30 * time.Second
+	// ftpAnonymousUser logs in when the endpoint has no credentials.
+	ftpAnonymousUser = "anonymous"
+)
+
+// FTPClient is the interface to the used FTP client.
+type FTPClient interface {
+	// Size returns the size of the file in bytes.
+	Size(path string) (int64, error)
+	// Retrieve retrieves the content of the file from offset. Only one retrieval is in progress at a time, a new one
+	// aborts the previous.
+	Retrieve(path string, offset int64) (io.ReadCloser, error)
+	// Close logs out and closes the connection.
+	Close() error
+}
+
+// may be overridden in tests
+var newFTPClientFunc = getFTPClient
+
+// FTPDataSource is the struct containing the information needed to import from an FTP or FTPS server.
+// Sequence of phases:
+// 1a. Info -> TransferScratch, if the image needs to be converted.
+// 1b. Info -> TransferDataFile, if the image is raw.
+// 2a. TransferScratch -> Convert
+// 2b. TransferDataFile -> Resize
+type FTPDataSource struct {
+	sourceSizeLimits
+	sourceVerification
+	sourceStreamOptions
+	// the file endpoint
+	ep     *url.URL
+	client FTPClient
+	// path is the path of the file relative to the login directory.
+	path string
+	// size is the size of the file, -1 if unknown.
+	size int64
+	// Reader
+	ftpReader io.ReadCloser
+	// limits the bytes read from the file per second, nil if unlimited.
+	rateLimit *tokenBucket
+	// readRetries are the settings of resuming the failed reads of the file.
+	readRetries readRetries
+	// stack of readers
+	readers *FormatReaders
+	// fail if the virtual size of the image exceeds the capacity of the target, 0 if unknown.
+	targetCapacity int64
+	// The image file in scratch space.
+	url *url.URL
+}
+
+// FTPOptions are the options of the FTPDataSource.
+type FTPOptions struct {
+	// PinnedSPKIHashes fail the TLS handshake of ftps servers unless a certificate of the chain presented by the server
+	// has one of the pinned subject public key infos, on top of the CA validation. No pins disable pinning.
+	PinnedSPKIHashes []string
+	// TargetCapacity makes Info fail if the virtual size of the image exceeds it, before transferring any data, 0
+	// disables the check.
+	TargetCapacity int64
+	// RateLimit limits the bytes read from the file per second, 0 disables the limit.
+	RateLimit int64
+	// ReadRetries is the number of times a failed or truncated retrieval of the file is resumed from the offset
+	// reached, 0 disables resuming.
+	ReadRetries int
+	// ReadRetryBackoff is the delay before resuming the first time, doubled on each further attempt, 1s if 0.
+	ReadRetryBackoff time.Duration
+	SourceOptions
+}
+
+// NewFTPDataSource creates a new instance of the FTPDataSource. The endpoint is ftp://host/path or ftps://host/path,
+// ftps with implicit TLS on port 990, the default, and explicit TLS on any other port. The user and the password log
+// in, the user info of the endpoint is used if there is no user, and anonymous if neither.
+func NewFTPDataSource(endpoint, user, password, certDir string, options FTPOptions) (*FTPDataSource, error) {
+	ep, err := parseValidEndpoint(endpoint, "ftp", ftpScheme, ftpsScheme)
+	if err != nil {
+		return nil, err
+	}
+	// The path is relative to the login directory, a leading %2F makes it absolute.
+	path := strings.TrimPrefix(ep.Path, "/")
+	if path == "" || strings.HasSuffix(path, "/") {
+		return nil, errors.Errorf("no file in %q", manifestURL(ep))
+	}
+	if user == "" && ep.User != nil {
+		user = ep.User.Username()
+		password, _ = ep.User.Password()
+	}
+	if user == "" {
+		user = ftpAnonymousUser
+	}
+	pins, err := parseSPKIPins(options.PinnedSPKIHashes)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newFTPClientFunc(ep, user, password, certDir, pins)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not connect to ftp server %q", ep.Host)
+	}
+	size, err := client.Size(path)
+	if err != nil {
+		klog.Warningf("Unable to get the size of %q: %v", path, err)
+		size = -1
+	}
+	klog.V(1).Infof("file %s of %d bytes", path, size)
+	reader, err := client.Retrieve(path, 0)
+	if err != nil {
+		client.Close()
+		return nil, errors.Wrapf(err, "could not retrieve %q", path)
+	}
+	return &FTPDataSource{
+		sourceSizeLimits:    options.sizeLimits(),
+		sourceStreamOptions: options.streamOptions(),
+		ep:                  ep,
+		client:              client,
+		path:                path,
+		size:                size,
+		ftpReader:           reader,
+		rateLimit:           newRateLimit(options.RateLimit),
+		readRetries:         newReadRetries(options.ReadRetries, options.ReadRetryBackoff),
+		targetCapacity:      options.TargetCapacity,
+	}, nil
+}
+
+// Info is called to get initial information about the data.
+func (fd *FTPDataSource) Info() (ProcessingPhase, error) {
+	if fd.readRetries.enabled() {
+		// The rest of the file is retrieved from the offset reached.
+		fd.ftpReader = newResumableReader(context.Background(), fd.ftpReader, fd.size, fd.readRetries, func(offset int64) (io.ReadCloser, error) {
+			rest, err := fd.client.Retrieve(fd.path, offset)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not retrieve %q from offset %d", fd.path, offset)
+			}
+			return rest, nil
+		})
+	}
+	var total uint64
+	if fd.size > 0 {
+		total = uint64(fd.size)
+	}
+	var err error
+	fd.readers, err = newSourceFormatReaders(withRateLimit(context.Background(), fd.ftpReader, fd.rateLimit), fd.size, fd.sourceSizeLimits, fd.sourceVerification)
+	if err != nil {
+		klog.Errorf("Error creating readers: %v", err)
+		return ProcessingPhaseError, err
+	}
+	if err = checkBackingFile(fd.readers); err != nil {
+		return ProcessingPhaseError, err
+	}
+	if err = checkTargetCapacity(fd.ep.Path, fd.readers, total, fd.targetCapacity); err != nil {
+		return ProcessingPhaseError, err
+	}
+	if !fd.readers.Convert {
+		// Downloading a raw file, we can write that directly to the target.
+		return ProcessingPhaseTransferDataFile, nil
+	}
+	return ProcessingPhaseTransferScratch, nil
+}
+
+// Transfer is called to transfer the data from the source to a temporary location.
+func (fd *FTPDataSource) Transfer(path string) (ProcessingPhase, error) {
+	size, _ := util.GetAvailableSpace(path)
+	if size <= int64(0) {
+		//Path provided is invalid.
+		return ProcessingPhaseError, ErrInvalidPath
+	}
+	file := filepath.Join(path, tempFile)
+	fd.readers.StartProgressUpdate()
+	err := util.StreamDataToFileWithSize(fd.readers.TopReader(), file, fd.readers.topReaderSize(fd.size), fd.streamOptions())
+	if err != nil {
+		return ProcessingPhaseError, err
+	}
+	// If streaming succeeded, then parsing the file into URL will also succeed, no need to check error status
+	fd.url, _ = url.Parse(file)
+	return ProcessingPhaseConvert, nil
+}
+
+// TransferFile is called to transfer the data from the source to the passed in file.
+func (fd *FTPDataSource) TransferFile(fileName string) (ProcessingPhase, error) {
+	fd.readers.StartProgressUpdate()
+	err := util.StreamDataToFileWithSize(fd.readers.TopReader(), fileName, -1, fd.streamOptions())
+	if err != nil {
+		return ProcessingPhaseError, err
+	}
+	return ProcessingPhaseResize, nil
+}
+
+// TransferToWriter is called to stream the raw image from the source to w, without scratch space.
+func (fd *FTPDataSource) TransferToWriter(w io.Writer) (ProcessingPhase, error) {
+	return transferToWriter(fd.readers, w)
+}
+
+// TransferToWriterAt is called to write the raw image from the source at its offsets in w, without scratch space.
+func (fd *FTPDataSource) TransferToWriterAt(w io.WriterAt) (ProcessingPhase, error) {
+	return transferToWriterAt(fd.readers, w)
+}
+
+// GetURL returns the url that the data processor can use when converting the data.
+func (fd *FTPDataSource) GetURL() *url.URL {
+	return fd.url
+}
+
+func (fd *FTPDataSource) sourceDigest() (string, error) {
+	return fd.readers.sourceDigest()
+}
+
+func (fd *FTPDataSource) verifySourceSignature() error {
+	return fd.readers.verifySourceSignature()
+}
+
+func (fd *FTPDataSource) probe() (*FormatReaders, int64) {
+	return fd.readers, fd.size
+}
+
+func (fd *FTPDataSource) addToManifest(manifest *ImportManifest) {
+	manifest.Source.URL = manifestURL(fd.ep)
+	if fd.size > 0 {
+		manifest.SourceSize = fd.size
+	}
+	manifest.addDecompress(compressionFormat(fd.readers))
+}
+
+func (fd *FTPDataSource) formatReaders() *FormatReaders {
+	return fd.readers
+}
+
+// Close closes any readers or other open resources.
+func (fd *FTPDataSource) Close() error {
+	var err error
+	if fd.readers != nil {
+		err = fd.readers.Close()
+	} else if fd.ftpReader != nil {
+		err = fd.ftpReader.Close()
+	}
+	if fd.client != nil {
+		if closeErr := fd.client.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// ftpClient retrieves files with a github.com/jlaffaye/ftp connection.
+type ftpClient struct {
+	// ctrl is the control connection of conn.
+	ctrl net.Conn
+	conn *ftp.ServerConn
+	// response is the retrieval in progress, nil if none.
+	response *ftpResponse
+}
+
+func getFTPClient(ep *url.URL, user, password, certDir string, pins spkiPins) (FTPClient, error) {
+	var tlsConfig *tls.Config
+	implicitTLS := false
+	port := ep.Port()
+	if ep.Scheme == ftpsScheme {
+		certPool, err := createCertPool(certDir)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error creating the certificate pool for ftps")
+		}
+		tlsConfig = createTLSConfig(certPool, pins)
+		tlsConfig.ServerName = ep.Hostname()
+		// Servers may require the data connections to resume the TLS session of the control connection.
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+		if port == "" {
+			port = ftpsImplicitPort
+		}
+		implicitTLS = port == ftpsImplicitPort
+	}
+	if port == "" {
+		port = ftpPort
+	}
+	address := net.JoinHostPort(ep.Hostname(), port)
+	dialer := &net.Dialer{Timeout: ftpDialTimeout}
+	var ctrl net.Conn
+	var err error
+	if implicitTLS {
+		ctrl, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		ctrl, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to connect to %s", address)
+	}
+	options := []ftp.DialOption{ftp.DialWithNetConn(ctrl), ftp.DialWithDialFunc(ftpDataDialFunc(ep.Hostname(), dialer, tlsConfig))}
+	if implicitTLS {
+		options = append(options, ftp.DialWithTLS(tlsConfig))
+	} else if tlsConfig != nil {
+		options = append(options, ftp.DialWithExplicitTLS(tlsConfig))
+	}
+	conn, err := ftp.Dial(address, options...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unexpected ftp greeting from %s", address)
+	}
+	if err := conn.Login(user, password); err != nil {
+		conn.Quit()
+		return nil, errors.Wrapf(err, "unable to log in as %q", user)
+	}
+	return &ftpClient{ctrl: ctrl, conn: conn}, nil
+}
+
+// ftpDataDialFunc returns the function opening the passive data connections to host, over TLS if tlsConfig isn't nil.
+// The address in PASV responses is ignored, it's often a private address behind NAT.
+func ftpDataDialFunc(host string, dialer *net.Dialer, tlsConfig *tls.Config) func(network, address string) (net.Conn, error) {
+	return func(network, address string) (net.Conn, error) {
+		_, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid ftp data connection address %s", address)
+		}
+		address = net.JoinHostPort(host, port)
+		data, err := dialer.Dial(network, address)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to open the ftp data connection to %s", address)
+		}
+		if tlsConfig != nil {
+			data = tls.Client(data, tlsConfig)
+		}
+		return data, nil
+	}
+}
+
+// Size returns the size of the file in bytes.
+func (c *ftpClient) Size(path string) (int64, error) {
+	size, err := c.conn.FileSize(path)
+	if err != nil {
+		return 0, errors.Wrap(err, "ftp command SIZE failed")
+	}
+	return size, nil
+}
+
+// Retrieve retrieves the content of the file from offset over a passive data connection.
+func (c *ftpClient) Retrieve(path string, offset int64) (io.ReadCloser, error) {
+	if c.response != nil {
+		// The previous retrieval failed or was abandoned, its completion reply must be read first.
+		c.response.Close()
+	}
+	response, err := c.conn.RetrFrom(path, uint64(offset))
+	if err != nil {
+		return nil, errors.Wrap(err, "ftp command RETR failed")
+	}
+	c.response = &ftpResponse{client: c, response: response}
+	return c.response, nil
+}
+
+// Close logs out and closes the connection.
+func (c *ftpClient) Close() error {
+	// Don't wait for an unresponsive server.
+	c.ctrl.SetDeadline(time.Now().Add(ftpDialTimeout))
+	if c.response != nil {
+		c.response.Close()
+	}
+	return c.conn.Quit()
+}
+
+// ftpResponse reads a retrieval from its data connection.
+type ftpResponse struct {
+	client   *ftpClient
+	response *ftp.Response
+	// done is true once the completion reply was read.
+	done bool
+}
+
+// Read reads from the data connection. At the end of the data, the completion reply is checked so that transfers
+// aborted by the server fail rather than appear complete.
+func (r *ftpResponse) Read(p []byte) (int, error) {
+	n, err := r.response.Read(p)
+	if err == io.EOF && !r.done {
+		if replyErr := r.finish(); replyErr != nil {
+			return n, replyErr
+		}
+	}
+	return n, err
+}
+
+// Close closes the data connection, and reads the completion reply.
+func (r *ftpResponse) Close() error {
+	if !r.done {
+		// An incomplete transfer is reported as aborted, that's expected when closing early.
+		r.finish()
+	}
+	return nil
+}
+
+func (r *ftpResponse) finish() error {
+	r.done = true
+	if r.client.response == r {
+		r.client.response = nil
+	}
+	if err := r.response.Close(); err != nil {
+		return errors.Wrap(err, "ftp transfer failed")
+	}
+	return nil
+}
@@ -0,0 +1,506 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	gitconfig "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+
+	"k8s.io/klog/v2"
+
+	"kubevirt.io/containerized-data-importer/pkg/util"
+)
+
+const (
+	// gitRepoDir is the directory in scratch space the repository is fetched into.
+	gitRepoDir = "git"
+	// lfsPointerMaxSize is the maximum size of a git LFS pointer file.
+	lfsPointerMaxSize = 1024
+	// lfsPointerVersion is the first line of a git LFS pointer file.
+	lfsPointerVersion = "version https://git-lfs.github.com/spec/v1"
+	// lfsMediaType is the media type of the git LFS batch API.
+	lfsMediaType = "application/vnd.git-lfs+json"
+	// lfsConfigFile is the file in the repository that can override the LFS endpoint.
+	lfsConfigFile = ".lfsconfig"
+)
+
+// GitDataSource is the data provider for files stored in a git repository. The repository is fetched into
+// scratch space, shallow if the ref is a branch or tag, and the blob at the passed in path is extracted. Files
+// tracked by git LFS are downloaded from the LFS server.
+// Sequence of phases:
+// 1. Info -> TransferScratch
+// 2. TransferScratch -> Convert
+type GitDataSource struct {
+	sourceSizeLimits
+	sourceStreamOptions
+	// endpoint the git repository url, either a url or a scp like ssh address.
+	endpoint *transport.Endpoint
+	// ref is the branch, tag or commit to fetch, HEAD if empty.
+	ref string
+	// path is the path of the file in the repository.
+	path string
+	// auth is used to authenticate with the repository, nil if no credentials were provided.
+	auth transport.AuthMethod
+	// httpClient is used to talk to the LFS server.
+	httpClient *http.Client
+	// stack of readers
+	readers *FormatReaders
+	// url the url to report to the caller of getURL, a file in scratch space.
+	url *url.URL
+}
+
+// lfsPointer is the content of a git LFS pointer file.
+type lfsPointer struct {
+	oid  string
+	size int64
+}
+
+type lfsBatchRequest struct {
+	Operation string           `json:"operation"`
+	Transfers []string         `json:"transfers,omitempty"`
+	Objects   []lfsBatchObject `json:"objects"`
+}
+
+type lfsBatchObject struct {
+	Oid     string               `json:"oid"`
+	Size    int64                `json:"size"`
+	Actions map[string]lfsAction `json:"actions,omitempty"`
+	Error   *lfsObjectError      `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type lfsObjectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lfsBatchResponse struct {
+	Objects []lfsBatchObject `json:"objects"`
+}
+
+// GitOptions are the options of the git data provider.
+type GitOptions struct {
+	// Ref is the branch, tag or commit to fetch, HEAD if empty.
+	Ref string
+	// PinnedSPKIHashes fail the TLS handshake with the git and the LFS servers reached over https unless a certificate
+	// of the chain they present has one of the pinned subject public key infos. No pins disable pinning.
+	PinnedSPKIHashes []string
+	// InsecureTLS skips the verification of the host key of ssh repositories.
+	InsecureTLS bool
+	SourceOptions
+}
+
+// NewGitDataSource creates a new instance of the git data provider importing the file at path in the repository. For
+// http(s) repositories the secret key is used as token, with the access key as user name. For ssh repositories the
+// secret key is the private key.
+func NewGitDataSource(repo, path, accessKey, secKey, certDir string, options GitOptions) (*GitDataSource, error) {
+	if repo == "" {
+		return nil, errors.New("git repository is missing or blank")
+	}
+	if strings.Trim(path, "/") == "" {
+		return nil, errors.New("path of the file in the git repository is missing or blank")
+	}
+	ep, err := transport.NewEndpoint(repo)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse git repository %q", repo)
+	}
+	auth, err := createGitAuth(ep, accessKey, secKey, options.InsecureTLS)
+	if err != nil {
+		return nil, err
+	}
+	pins, err := parseSPKIPins(options.PinnedSPKIHashes)
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := createHTTPClient(certDir, pins)
+	if err != nil {
+		return nil, err
+	}
+	if certDir != "" || len(pins) > 0 {
+		// The custom CA and the pins apply to the git transport as well.
+		client.InstallProtocol("https", githttp.NewClient(httpClient))
+	}
+	return &GitDataSource{
+		sourceSizeLimits:    options.sizeLimits(),
+		sourceStreamOptions: options.streamOptions(),
+		endpoint:            ep,
+		ref:                 options.Ref,
+		path:                strings.Trim(path, "/"),
+		auth:                auth,
+		httpClient:          httpClient,
+	}, nil
+}
+
+// Info is called to get initial information about the data. The repository is only fetched when there is scratch space.
+func (gd *GitDataSource) Info() (ProcessingPhase, error) {
+	return ProcessingPhaseTransferScratch, nil
+}
+
+// Transfer is called to transfer the data from the source to a scratch location.
+func (gd *GitDataSource) Transfer(path string) (ProcessingPhase, error) {
+	size, _ := util.GetAvailableSpace(path)
+	if size <= int64(0) {
+		//Path provided is invalid.
+		return ProcessingPhaseError, ErrInvalidPath
+	}
+	repoDir := filepath.Join(path, gitRepoDir)
+	defer os.RemoveAll(repoDir)
+	commit, err := gd.fetch(repoDir)
+	if err != nil {
+		return ProcessingPhaseError, err
+	}
+	fileReader, err := gd.openFile(commit)
+	if err != nil {
+		return ProcessingPhaseError, err
+	}
+	gd.readers, err = newFormatReaders(fileReader, uint64(0), gd.sourceSizeLimits, sourceVerification{})
+	if err != nil {
+		fileReader.Close()
+		return ProcessingPhaseError, errors.Wrap(err, "unable to create format readers")
+	}
+	file := filepath.Join(path, tempFile)
+	gd.readers.StartProgressUpdate()
+	if err = util.StreamDataToFileWithSize(gd.readers.TopReader(), file, -1, gd.streamOptions()); err != nil {
+		return ProcessingPhaseError, err
+	}
+	// If streaming succeeded, then parsing the file into URL will also succeed, no need to check error status
+	gd.url, _ = url.Parse(file)
+	return ProcessingPhaseConvert, nil
+}
+
+// TransferFile is called to transfer the data from the source to the passed in file.
+func (gd *GitDataSource) TransferFile(fileName string) (ProcessingPhase, error) {
+	return ProcessingPhaseError, errors.New("git data source requires scratch space")
+}
+
+// GetURL returns the url that the data processor can use when converting the data.
+func (gd *GitDataSource) GetURL() *url.URL {
+	return gd.url
+}
+
+func (gd *GitDataSource) formatReaders() *FormatReaders {
+	return gd.readers
+}
+
+// Close closes any readers or other open resources.
+func (gd *GitDataSource) Close() error {
+	var err error
+	if gd.readers != nil {
+		err = gd.readers.Close()
+	}
+	return err
+}
+
+// fetch fetches the repository into the passed in directory and returns the commit the ref points to. Branches and
+// tags are fetched shallow, if that fails, for instance because the ref is a commit, the whole repository is fetched.
+func (gd *GitDataSource) fetch(repoDir string) (*object.Commit, error) {
+	var candidates []plumbing.ReferenceName
+	switch {
+	case gd.ref == "":
+		candidates = []plumbing.ReferenceName{plumbing.HEAD}
+	case strings.HasPrefix(gd.ref, "refs/"):
+		candidates = []plumbing.ReferenceName{plumbing.ReferenceName(gd.ref)}
+	default:
+		candidates = []plumbing.ReferenceName{plumbing.NewTagReferenceName(gd.ref), plumbing.NewBranchReferenceName(gd.ref)}
+	}
+	for _, refName := range candidates {
+		repo, err := gd.clone(repoDir, &git.CloneOptions{
+			ReferenceName: refName,
+			SingleBranch:  true,
+			Depth:         1,
+			Tags:          git.NoTags,
+		})
+		if err != nil {
+			klog.V(1).Infof("Unable to fetch %s shallow: %v", refName, err)
+			continue
+		}
+		commit, err := resolveGitCommit(repo, refName)
+		if err == nil {
+			return commit, nil
+		}
+		klog.V(1).Infof("Unable to resolve %s: %v", refName, err)
+	}
+	klog.V(1).Infof("Fetching the whole repository to resolve %q", gd.ref)
+	repo, err := gd.clone(repoDir, &git.CloneOptions{Tags: git.AllTags})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to fetch git repository %q", gd.endpoint.String())
+	}
+	rev := gd.ref
+	if rev == "" {
+		rev = string(plumbing.HEAD)
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to resolve git ref %q", gd.ref)
+	}
+	return repo.CommitObject(*hash)
+}
+
+// clone clones the repository into a clean directory, without a work tree.
+func (gd *GitDataSource) clone(repoDir string, options *git.CloneOptions) (*git.Repository, error) {
+	if err := os.RemoveAll(repoDir); err != nil {
+		return nil, errors.Wrap(err, "unable to clean git repository directory")
+	}
+	options.URL = gd.endpoint.String()
+	options.Auth = gd.auth
+	options.NoCheckout = true
+	storage := filesystem.NewStorage(osfs.New(repoDir), cache.NewObjectLRUDefault())
+	return git.Clone(storage, nil, options)
+}
+
+func resolveGitCommit(repo *git.Repository, refName plumbing.ReferenceName) (*object.Commit, error) {
+	hash, err := repo.ResolveRevision(plumbing.Revision(refName))
+	if err != nil {
+		return nil, err
+	}
+	return repo.CommitObject(*hash)
+}
+
+// openFile opens the file at the configured path in the commit, resolving git LFS pointers.
+func (gd *GitDataSource) openFile(commit *object.Commit) (io.ReadCloser, error) {
+	file, err := commit.File(gd.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to find %q in commit %s", gd.path, commit.Hash)
+	}
+	klog.V(1).Infof("Found %q (%d bytes) in commit %s", gd.path, file.Size, commit.Hash)
+	blobReader, err := file.Reader()
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read %q", gd.path)
+	}
+	if file.Size > lfsPointerMaxSize {
+		return blobReader, nil
+	}
+	content, err := ioutil.ReadAll(blobReader)
+	blobReader.Close()
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read %q", gd.path)
+	}
+	pointer := parseLFSPointer(content)
+	if pointer == nil {
+		return ioutil.NopCloser(bytes.NewReader(content)), nil
+	}
+	klog.V(1).Infof("%q is tracked by git LFS, object %s", gd.path, pointer.oid)
+	lfsURL, err := gd.lfsEndpoint(commit)
+	if err != nil {
+		return nil, err
+	}
+	return gd.downloadLFSObject(lfsURL, pointer)
+}
+
+// parseLFSPointer parses the passed in content as a git LFS pointer file, returns nil if it isn't one.
+func parseLFSPointer(content []byte) *lfsPointer {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	if !scanner.Scan() || scanner.Text() != lfsPointerVersion {
+		return nil
+	}
+	pointer := &lfsPointer{size: -1}
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 {
+			return nil
+		}
+		switch fields[0] {
+		case "oid":
+			pointer.oid = strings.TrimPrefix(fields[1], "sha256:")
+		case "size":
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return nil
+			}
+			pointer.size = size
+		}
+	}
+	if pointer.oid == "" || pointer.size < 0 {
+		return nil
+	}
+	return pointer
+}
+
+// lfsEndpoint returns the LFS server url, either from the .lfsconfig file in the commit or derived from the
+// repository url as described in the git LFS server discovery documentation.
+func (gd *GitDataSource) lfsEndpoint(commit *object.Commit) (string, error) {
+	if file, err := commit.File(lfsConfigFile); err == nil {
+		content, err := file.Contents()
+		if err != nil {
+			return "", errors.Wrapf(err, "unable to read %s", lfsConfigFile)
+		}
+		config := gitconfig.New()
+		if err := gitconfig.NewDecoder(strings.NewReader(content)).Decode(config); err != nil {
+			return "", errors.Wrapf(err, "unable to parse %s", lfsConfigFile)
+		}
+		if lfsURL := config.Section("lfs").Option("url"); lfsURL != "" {
+			return lfsURL, nil
+		}
+	}
+	if gd.endpoint.Protocol != "http" && gd.endpoint.Protocol != "https" {
+		return "", errors.Errorf("unable to determine the git LFS server of %q", gd.endpoint.String())
+	}
+	repoURL := strings.TrimSuffix(gd.endpoint.String(), "/")
+	if !strings.HasSuffix(repoURL, ".git") {
+		repoURL += ".git"
+	}
+	return repoURL + "/info/lfs", nil
+}
+
+// downloadLFSObject asks the LFS server where to download the object from using the batch API, and returns a
+// reader of the object that verifies its checksum.
+func (gd *GitDataSource) downloadLFSObject(lfsURL string, pointer *lfsPointer) (io.ReadCloser, error) {
+	body, _ := json.Marshal(&lfsBatchRequest{
+		Operation: "download",
+		Transfers: []string{"basic"},
+		Objects:   []lfsBatchObject{{Oid: pointer.oid, Size: pointer.size}},
+	})
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(lfsURL, "/")+"/objects/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create git LFS batch request")
+	}
+	req.Header.Set("Accept", lfsMediaType)
+	req.Header.Set("Content-Type", lfsMediaType)
+	if auth, ok := gd.auth.(*githttp.BasicAuth); ok {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	resp, err := gd.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "git LFS batch request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("git LFS batch request failed with status %d", resp.StatusCode)
+	}
+	batch := &lfsBatchResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(batch); err != nil {
+		return nil, errors.Wrap(err, "unable to decode git LFS batch response")
+	}
+	if len(batch.Objects) != 1 {
+		return nil, errors.Errorf("git LFS batch response contains %d objects", len(batch.Objects))
+	}
+	lfsObject := batch.Objects[0]
+	if lfsObject.Error != nil {
+		return nil, errors.Errorf("git LFS object %s error %d: %s", pointer.oid, lfsObject.Error.Code, lfsObject.Error.Message)
+	}
+	download, ok := lfsObject.Actions["download"]
+	if !ok {
+		return nil, errors.Errorf("git LFS server returned no download action for object %s", pointer.oid)
+	}
+	req, err = http.NewRequest(http.MethodGet, download.Href, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create git LFS download request")
+	}
+	for key, value := range download.Header {
+		req.Header.Set(key, value)
+	}
+	resp, err = gd.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "git LFS download failed")
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Errorf("git LFS download failed with status %d", resp.StatusCode)
+	}
+	return &lfsObjectReader{
+		ReadCloser: resp.Body,
+		pointer:    pointer,
+		hash:       sha256.New(),
+	}, nil
+}
+
+// lfsObjectReader verifies the size and checksum of the LFS object once it has been read completely.
+type lfsObjectReader struct {
+	io.ReadCloser
+	pointer *lfsPointer
+	hash    hash.Hash
+	read    int64
+}
+
+func (r *lfsObjectReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	r.read += int64(n)
+	if err == io.EOF {
+		if r.read != r.pointer.size {
+			return n, errors.Errorf("git LFS object size mismatch, expected %d, got %d", r.pointer.size, r.read)
+		}
+		if actual := hex.EncodeToString(r.hash.Sum(nil)); actual != r.pointer.oid {
+			return n, errors.Errorf("git LFS object checksum mismatch, expected %s, got %s", r.pointer.oid, actual)
+		}
+	}
+	return n, err
+}
+
+// createGitAuth returns the auth method for the repository, a token for http(s) repositories and a private key
+// for ssh repositories.
+func createGitAuth(ep *transport.Endpoint, accessKey, secKey string, insecureTLS bool) (transport.AuthMethod, error) {
+	if secKey == "" {
+		return nil, nil
+	}
+	switch ep.Protocol {
+	case "http", "https":
+		user := accessKey
+		if user == "" {
+			// Most git servers ignore the user name when passed a token, but require one to be set.
+			user = "git"
+		}
+		return &githttp.BasicAuth{Username: user, Password: secKey}, nil
+	case "ssh":
+		user := ep.User
+		if user == "" {
+			user = accessKey
+		}
+		if user == "" {
+			user = "git"
+		}
+		auth, err := gitssh.NewPublicKeys(user, []byte(secKey), "")
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to parse ssh private key")
+		}
+		if insecureTLS {
+			auth.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		}
+		return auth, nil
+	}
+	return nil, errors.Errorf("credentials are not supported for git protocol %q", ep.Protocol)
+}
@@ -0,0 +1,248 @@
+package importer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+const gitTestImagePath = "images/disk.img"
+
+// gitTestRepo is a local repository with a file committed twice, the first commit is tagged v1.
+type gitTestRepo struct {
+	dir    string
+	repo   *git.Repository
+	tagged plumbing.Hash
+	v1Data []byte
+	v2Data []byte
+	sig    *object.Signature
+}
+
+func createGitTestRepo(dir string) *gitTestRepo {
+	r := &gitTestRepo{
+		dir:    dir,
+		v1Data: make([]byte, 128*1024),
+		v2Data: make([]byte, 64*1024),
+		sig:    &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	}
+	rand.New(rand.NewSource(1)).Read(r.v1Data)
+	rand.New(rand.NewSource(2)).Read(r.v2Data)
+	var err error
+	r.repo, err = git.PlainInit(dir, false)
+	Expect(err).NotTo(HaveOccurred())
+	r.tagged = r.commit(gitTestImagePath, r.v1Data)
+	_, err = r.repo.CreateTag("v1", r.tagged, &git.CreateTagOptions{Tagger: r.sig, Message: "v1"})
+	Expect(err).NotTo(HaveOccurred())
+	r.commit(gitTestImagePath, r.v2Data)
+	return r
+}
+
+func (r *gitTestRepo) commit(path string, data []byte) plumbing.Hash {
+	worktree, err := r.repo.Worktree()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(os.MkdirAll(filepath.Dir(filepath.Join(r.dir, path)), 0755)).To(Succeed())
+	Expect(ioutil.WriteFile(filepath.Join(r.dir, path), data, 0644)).To(Succeed())
+	_, err = worktree.Add(path)
+	Expect(err).NotTo(HaveOccurred())
+	hash, err := worktree.Commit("update "+path, &git.CommitOptions{Author: r.sig})
+	Expect(err).NotTo(HaveOccurred())
+	return hash
+}
+
+// lfsTestServer implements the git LFS batch API, any object is downloaded with the passed in data.
+func lfsTestServer(data []byte) *httptest.Server {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/lfs/objects/batch":
+			batch := &lfsBatchRequest{}
+			if r.Method != http.MethodPost || r.Header.Get("Accept") != lfsMediaType || json.NewDecoder(r.Body).Decode(batch) != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			response := &lfsBatchResponse{}
+			for _, o := range batch.Objects {
+				o.Actions = map[string]lfsAction{
+					"download": {Href: ts.URL + "/objects/" + o.Oid, Header: map[string]string{"X-Test": "lfs"}},
+				}
+				response.Objects = append(response.Objects, o)
+			}
+			w.Header().Set("Content-Type", lfsMediaType)
+			json.NewEncoder(w).Encode(response)
+		case strings.HasPrefix(r.URL.Path, "/objects/"):
+			if r.Header.Get("X-Test") != "lfs" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write(data)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return ts
+}
+
+var _ = Describe("Git data source", func() {
+	var (
+		repo    *gitTestRepo
+		repoDir string
+		tmpDir  string
+		gd      *GitDataSource
+		err     error
+	)
+
+	BeforeEach(func() {
+		repoDir, err = ioutil.TempDir("", "git-repo")
+		Expect(err).NotTo(HaveOccurred())
+		tmpDir, err = ioutil.TempDir("", "scratch")
+		Expect(err).NotTo(HaveOccurred())
+		repo = createGitTestRepo(repoDir)
+	})
+
+	AfterEach(func() {
+		if gd != nil {
+			gd.Close()
+			gd = nil
+		}
+		os.RemoveAll(repoDir)
+		os.RemoveAll(tmpDir)
+	})
+
+	It("NewGitDataSource should fail without a path", func() {
+		gd, err = NewGitDataSource("file://"+repoDir, "", "", "", "", GitOptions{Ref: "v1"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("NewGitDataSource should fail with credentials for the file protocol", func() {
+		gd, err = NewGitDataSource("file://"+repoDir, gitTestImagePath, "", "token", "", GitOptions{Ref: "v1"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	table.DescribeTable("Transfer should fetch the file", func(ref func() string, expected func() []byte) {
+		gd, err = NewGitDataSource("file://"+repoDir, gitTestImagePath, "", "", "", GitOptions{Ref: ref()})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := gd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ProcessingPhaseTransferScratch).To(Equal(result))
+		result, err = gd.Transfer(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ProcessingPhaseConvert).To(Equal(result))
+		Expect(filepath.Join(tmpDir, tempFile)).To(Equal(gd.GetURL().String()))
+		resultBuffer, err := ioutil.ReadFile(filepath.Join(tmpDir, tempFile))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reflect.DeepEqual(resultBuffer, expected())).To(BeTrue())
+		_, err = os.Stat(filepath.Join(tmpDir, gitRepoDir))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	},
+		table.Entry("at a tag", func() string { return "v1" }, func() []byte { return repo.v1Data }),
+		table.Entry("at a full tag ref", func() string { return "refs/tags/v1" }, func() []byte { return repo.v1Data }),
+		table.Entry("at a branch", func() string { return "master" }, func() []byte { return repo.v2Data }),
+		table.Entry("at HEAD", func() string { return "" }, func() []byte { return repo.v2Data }),
+		table.Entry("at a commit", func() string { return repo.tagged.String() }, func() []byte { return repo.v1Data }),
+	)
+
+	It("Transfer should fail if the ref doesn't exist", func() {
+		gd, err = NewGitDataSource("file://"+repoDir, gitTestImagePath, "", "", "", GitOptions{Ref: "v2"})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := gd.Transfer(tmpDir)
+		Expect(err).To(HaveOccurred())
+		Expect(ProcessingPhaseError).To(Equal(result))
+	})
+
+	It("Transfer should fail if the file doesn't exist", func() {
+		gd, err = NewGitDataSource("file://"+repoDir, "images/missing.img", "", "", "", GitOptions{Ref: "v1"})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := gd.Transfer(tmpDir)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("unable to find"))
+		Expect(ProcessingPhaseError).To(Equal(result))
+	})
+
+	Context("with a file tracked by git LFS", func() {
+		var (
+			ts      *httptest.Server
+			lfsData []byte
+		)
+
+		BeforeEach(func() {
+			lfsData = make([]byte, 256*1024)
+			rand.New(rand.NewSource(3)).Read(lfsData)
+			sum := sha256.Sum256(lfsData)
+			oid := hex.EncodeToString(sum[:])
+			ts = lfsTestServer(lfsData)
+			pointer := fmt.Sprintf("%s\noid sha256:%s\nsize %d\n", lfsPointerVersion, oid, len(lfsData))
+			repo.commit(lfsConfigFile, []byte(fmt.Sprintf("[lfs]\n\turl = %s/lfs\n", ts.URL)))
+			repo.commit("images/lfs.img", []byte(pointer))
+		})
+
+		AfterEach(func() {
+			ts.Close()
+		})
+
+		It("Transfer should download the LFS object", func() {
+			gd, err = NewGitDataSource("file://"+repoDir, "images/lfs.img", "", "", "", GitOptions{Ref: "master"})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := gd.Transfer(tmpDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ProcessingPhaseConvert).To(Equal(result))
+			resultBuffer, err := ioutil.ReadFile(filepath.Join(tmpDir, tempFile))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reflect.DeepEqual(resultBuffer, lfsData)).To(BeTrue())
+		})
+
+		It("Transfer should fail if the LFS object doesn't match the pointer", func() {
+			pointer := fmt.Sprintf("%s\noid sha256:%s\nsize %d\n", lfsPointerVersion, "00"+hex.EncodeToString(make([]byte, 31)), len(lfsData))
+			repo.commit("images/lfs.img", []byte(pointer))
+			gd, err = NewGitDataSource("file://"+repoDir, "images/lfs.img", "", "", "", GitOptions{Ref: "master"})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := gd.Transfer(tmpDir)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("checksum mismatch"))
+			Expect(ProcessingPhaseError).To(Equal(result))
+		})
+	})
+
+	table.DescribeTable("parseLFSPointer should", func(content string, expected *lfsPointer) {
+		Expect(parseLFSPointer([]byte(content))).To(Equal(expected))
+	},
+		table.Entry("parse a pointer", lfsPointerVersion+"\noid sha256:abcd\nsize 12\n", &lfsPointer{oid: "abcd", size: 12}),
+		table.Entry("ignore regular content", "some content\n", nil),
+		table.Entry("ignore a pointer without size", lfsPointerVersion+"\noid sha256:abcd\n", nil),
+		table.Entry("ignore a pointer with an invalid size", lfsPointerVersion+"\noid sha256:abcd\nsize large\n", nil),
+	)
+
+	It("createGitAuth should use the secret key as token for https repositories", func() {
+		ep, err := transport.NewEndpoint("https://git.example.com/images.git")
+		Expect(err).NotTo(HaveOccurred())
+		auth, err := createGitAuth(ep, "", "token", false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(auth).To(Equal(&githttp.BasicAuth{Username: "git", Password: "token"}))
+	})
+
+	It("createGitAuth should fail with an invalid ssh key", func() {
+		ep, err := transport.NewEndpoint("git@git.example.com:images.git")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = createGitAuth(ep, "", "not a key", false)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -25,13 +25,17 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/net/http/httpproxy"
 
 	"k8s.io/klog/v2"
 
@@ -47,6 +51,27 @@ const (
 	nbdkitSocket = "/var/run/nbdkit.sock"
 )
 
+// httpMaxRedirects is the number of redirects the requests of the http data source follow.
+const httpMaxRedirects = 10
+
+// httpErrorBodySize is the number of bytes of the body of error responses inspected for the reason of the error.
+const httpErrorBodySize = 4096
+
+// ErrPresignedURLExpired indicates that the presigned URL of the source expired, a fresh URL is required.
+var ErrPresignedURLExpired = errors.New("presigned URL expired")
+
+// presignedURLExpiryMessages are found in the error responses of storage services to expired presigned URLs.
+var presignedURLExpiryMessages = []string{"Request has expired", "ExpiredToken"}
+
+// ErrHTTPAuthenticationRequired indicates that the server requires credentials, none were sent.
+var ErrHTTPAuthenticationRequired = errors.New("authentication required")
+
+// ErrHTTPAuthenticationFailed indicates that the server rejected the credentials sent.
+var ErrHTTPAuthenticationFailed = errors.New("authentication failed")
+
+// ErrUnexpectedPartialContent indicates that the server answered a GET without Range with a part of the object.
+var ErrUnexpectedPartialContent = errors.New("unexpected partial content")
+
 // HTTPDataSource is the data provider for http(s) endpoints.
 // Sequence of phases:
 // 1a. Info -> Convert (In Info phase the format readers are configured), if the source Reader image is not archived, and no custom CA is used, and can be converted by QEMU-IMG (RAW/QCOW2)
@@ -55,6 +80,9 @@ const (
 // 2a. Transfer -> Convert if content type is kube virt
 // 2b. Transfer -> Complete if content type is archive (Transfer is called with the target instead of the scratch space). Non block PVCs only.
 type HTTPDataSource struct {
+	sourceSizeLimits
+	sourceVerification
+	sourceStreamOptions
 	httpReader io.ReadCloser
 	ctx        context.Context
 	cancel     context.CancelFunc
@@ -69,24 +97,135 @@ type HTTPDataSource struct {
 	url *url.URL
 	// path to the custom CA. Empty if not used
 	customCA string
+	// the pinned certificates, empty if not used.
+	pins spkiPins
 	// true if we know `qemu-img` will fail to download this
 	brokenForQemuImg bool
 	// the content length reported by the http server.
 	contentLength uint64
+	// number of bytes to read ahead of the consumer, 0 disables read-ahead.
+	prefetchBufferSize int64
+	// limits the bytes read from the endpoint per second, nil if unlimited.
+	rateLimit *tokenBucket
+	// fail if the detected image format is riskier than the format declared by the endpoint.
+	strictFormatCheck bool
+	// fail if the virtual size of the image differs from the expected virtual size by more than the tolerance.
+	expectedVirtualSize  int64
+	virtualSizeTolerance int64
+	// fail if the virtual size of the image exceeds the capacity of the target, 0 if unknown.
+	targetCapacity int64
+	// the ETag reported by the http server, identifies the version of the content for the scratch cache.
+	etag string
+	// cache of scratch files shared between imports, nil if not used.
+	scratchCache *ScratchCache
+	// number of entries expected in an archive, checked against the free inodes before extracting, 0 if unknown.
+	expectedArchiveEntries int64
+	// the head of the object is read with a ranged GET, the format is detected from the head only.
+	rangedFormatDetection bool
 
 	n image.NbdkitOperation
 }
 
 var createNbdkitCurl = image.NewNbdkitCurl
 
-// NewHTTPDataSource creates a new instance of the http data provider.
+// may be overridden in tests
+var secretExtraHeadersDir = common.ImporterSecretExtraHeadersDir
+
+// HTTPOptions are the options of the http data provider.
+type HTTPOptions struct {
+	// BearerToken is sent in an "Authorization: Bearer" header, empty if not used. It can't be combined with basic
+	// auth credentials.
+	BearerToken string
+	// UserAgent replaces the User-Agent of the requests, DefaultUserAgent if empty.
+	UserAgent string
+	// ExtraHeaders are sent in every request after the extra headers of the environment, in the form "Name: value".
+	// The Authorization, Proxy-Authorization and Cookie headers are handled as secret extra headers.
+	ExtraHeaders []string
+	// PinnedSPKIHashes fail the TLS handshake unless a certificate of the chain presented by the server has one of
+	// the pinned subject public key infos, on top of the CA validation. A pin is the base64 encoded SHA256 hash of the
+	// DER encoded subject public key info, optionally prefixed with sha256/. No pins disable pinning.
+	PinnedSPKIHashes []string
+	// RetryAfterBudget is the total time a request waits for the delays asked by the Retry-After headers of 503 and
+	// 429 responses before it is sent again, 0 disables retrying.
+	RetryAfterBudget time.Duration
+	// RangedFormatDetection detects the format of endpoints accepting byte ranges from a small ranged GET of the head
+	// of the object. The rest of the object is only requested once the head has been consumed, for instance when
+	// Transfer begins, so flows converting straight from the endpoint never open a full object reader. Endpoints
+	// without byte ranges are opened in full.
+	RangedFormatDetection bool
+	// PrefetchBufferSize is the number of bytes to read ahead of the consumer, 0 disables read-ahead. nbdkit doesn't
+	// read ahead, read-ahead data is transferred into scratch space.
+	PrefetchBufferSize int64
+	// RateLimit limits the bytes read from the endpoint per second, 0 disables the limit. The limited data is
+	// transferred into scratch space.
+	RateLimit int64
+	// StrictFormatCheck makes Info fail if the image format declared by the endpoint extension doesn't match the
+	// detected format in a security relevant way.
+	StrictFormatCheck bool
+	// ExpectedVirtualSize makes Info fail if the virtual size of the image differs from it by more than
+	// VirtualSizeTolerance bytes, 0 disables the check.
+	ExpectedVirtualSize  int64
+	VirtualSizeTolerance int64
+	// TargetCapacity makes Info fail if the virtual size of the image exceeds it, before transferring any data, 0
+	// disables the check.
+	TargetCapacity int64
+	// ScratchCache makes Transfer reuse the cached scratch file of an unchanged endpoint, and add downloaded scratch
+	// files to the cache, nil if not used.
+	ScratchCache *ScratchCache
+	// ExpectedArchiveEntries is the number of entries expected in an archive. The extraction fails early if the target
+	// filesystem has less free inodes, 0 disables the check.
+	ExpectedArchiveEntries int64
+	SourceOptions
+}
+
+// httpReaderOptions are the options of the readers of http endpoints.
+type httpReaderOptions struct {
+	// retryAfterBudget is the total time a request waits for Retry-After delays, 0 disables retrying.
+	retryAfterBudget time.Duration
+	// rangedHead reads the head of range capable endpoints with a ranged GET, and the rest once the head is consumed.
+	rangedHead bool
+}
+
+// NewHTTPDataSource creates a new instance of the http data provider. The access key and the secret key, if set, are
+// sent as basic auth credentials.
 func NewHTTPDataSource(endpoint, accessKey, secKey, certDir string, contentType cdiv1.DataVolumeContentType) (*HTTPDataSource, error) {
+	return NewHTTPDataSourceWithOptions(endpoint, accessKey, secKey, certDir, contentType, HTTPOptions{})
+}
+
+// NewHTTPDataSourceWithOptions creates a new instance of the http data provider with options.
+func NewHTTPDataSourceWithOptions(endpoint, accessKey, secKey, certDir string, contentType cdiv1.DataVolumeContentType, options HTTPOptions) (*HTTPDataSource, error) {
 	ep, err := ParseEndpoint(endpoint)
 	if err != nil {
 		return nil, errors.Wrapf(err, fmt.Sprintf("unable to parse endpoint %q", endpoint))
 	}
+	extraHeaders, secretExtraHeaders, err := requestHeaders(options.UserAgent, options.ExtraHeaders)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get extra headers")
+	}
+	if options.BearerToken != "" {
+		if accessKey != "" || secKey != "" {
+			return nil, errors.New("either basic auth credentials or a bearer token can be used, not both")
+		}
+		// The token is handled as a secret extra header: redacted from the logs, and not sent to other hosts.
+		secretExtraHeaders = append(secretExtraHeaders, "Authorization: Bearer "+options.BearerToken)
+	}
+	pins, err := parseSPKIPins(options.PinnedSPKIHashes)
+	if err != nil {
+		return nil, err
+	}
 	ctx, cancel := context.WithCancel(context.Background())
-	httpReader, contentLength, brokenForQemuImg, err := createHTTPReader(ctx, ep, accessKey, secKey, certDir)
+	var httpReader io.ReadCloser
+	var contentLength uint64
+	var brokenForQemuImg bool
+	var etag string
+	ep, err = connectEndpoint(ep, func(target *url.URL) error {
+		var err error
+		httpReader, contentLength, brokenForQemuImg, etag, err = createHTTPReader(ctx, target, accessKey, secKey, certDir, pins, extraHeaders, secretExtraHeaders, httpReaderOptions{
+			retryAfterBudget: options.RetryAfterBudget,
+			rangedHead:       options.RangedFormatDetection,
+		})
+		return err
+	})
 	if err != nil {
 		cancel()
 		return nil, err
@@ -96,16 +235,29 @@ func NewHTTPDataSource(endpoint, accessKey, secKey, certDir string, contentType
 		ep.User = url.UserPassword(accessKey, secKey)
 	}
 	httpSource := &HTTPDataSource{
-		ctx:              ctx,
-		cancel:           cancel,
-		httpReader:       httpReader,
-		contentType:      contentType,
-		endpoint:         ep,
-		customCA:         certDir,
-		brokenForQemuImg: brokenForQemuImg,
-		contentLength:    contentLength,
-	}
-	httpSource.n = createNbdkitCurl(nbdkitPid, certDir, nbdkitSocket)
+		sourceSizeLimits:       options.sizeLimits(),
+		sourceStreamOptions:    options.streamOptions(),
+		ctx:                    ctx,
+		cancel:                 cancel,
+		httpReader:             httpReader,
+		contentType:            contentType,
+		endpoint:               ep,
+		customCA:               certDir,
+		pins:                   pins,
+		brokenForQemuImg:       brokenForQemuImg,
+		contentLength:          contentLength,
+		prefetchBufferSize:     options.PrefetchBufferSize,
+		rateLimit:              newRateLimit(options.RateLimit),
+		strictFormatCheck:      options.StrictFormatCheck,
+		expectedVirtualSize:    options.ExpectedVirtualSize,
+		virtualSizeTolerance:   options.VirtualSizeTolerance,
+		targetCapacity:         options.TargetCapacity,
+		etag:                   etag,
+		scratchCache:           options.ScratchCache,
+		expectedArchiveEntries: options.ExpectedArchiveEntries,
+		rangedFormatDetection:  options.RangedFormatDetection,
+	}
+	httpSource.n = createNbdkitCurl(nbdkitPid, certDir, nbdkitSocket, extraHeaders, secretExtraHeaders)
 	// We know this is a counting reader, so no need to check.
 	countingReader := httpReader.(*util.CountingReader)
 	go httpSource.pollProgress(countingReader, 10*time.Minute, time.Second)
@@ -115,11 +267,28 @@ func NewHTTPDataSource(endpoint, accessKey, secKey, certDir string, contentType
 // Info is called to get initial information about the data.
 func (hs *HTTPDataSource) Info() (ProcessingPhase, error) {
 	var err error
-	hs.readers, err = NewFormatReaders(hs.httpReader, hs.contentLength)
+	reader := withRateLimit(hs.ctx, hs.httpReader, hs.rateLimit)
+	lookAhead := uint64(qcow2MaxLookAhead)
+	if hs.rangedFormatDetection {
+		lookAhead = rangedHeadSize
+	}
+	hs.readers, err = newFormatReadersWithLookAhead(withPrefetch(hs.ctx, reader, hs.prefetchBufferSize), hs.contentLength, hs.sourceSizeLimits, hs.sourceVerification, lookAhead)
 	if err != nil {
 		klog.Errorf("Error creating readers: %v", err)
 		return ProcessingPhaseError, err
 	}
+	if err = checkDeclaredFormat(hs.endpoint.Path, hs.readers, hs.strictFormatCheck); err != nil {
+		return ProcessingPhaseError, err
+	}
+	if err = checkBackingFile(hs.readers); err != nil {
+		return ProcessingPhaseError, err
+	}
+	if err = checkExpectedVirtualSize(hs.endpoint.Path, hs.readers, hs.contentLength, hs.expectedVirtualSize, hs.virtualSizeTolerance); err != nil {
+		return ProcessingPhaseError, err
+	}
+	if err = checkTargetCapacity(hs.endpoint.Path, hs.readers, hs.contentLength, hs.targetCapacity); err != nil {
+		return ProcessingPhaseError, err
+	}
 	hs.url, _ = url.Parse(fmt.Sprintf("nbd+unix:///?socket=%s", nbdkitSocket))
 	if hs.readers.ArchiveGz {
 		hs.n.AddFilter(image.NbdkitGzipFilter)
@@ -138,10 +307,49 @@ func (hs *HTTPDataSource) Info() (ProcessingPhase, error) {
 	if hs.brokenForQemuImg {
 		return ProcessingPhaseTransferScratch, nil
 	}
+	if hs.scratchCache != nil && scratchCacheKey(hs.endpoint, hs.etag) != "" {
+		klog.V(1).Infof("Scratch cache requested, using scratch space")
+		return ProcessingPhaseTransferScratch, nil
+	}
 	if hs.customCA != "" {
 		klog.V(1).Infof("Custom CA requested, using scratch space")
 		return ProcessingPhaseTransferScratch, nil
 	}
+	if len(hs.pins) > 0 {
+		// nbdkit doesn't check the pins, all the data has to go through our client.
+		klog.V(1).Infof("Certificate pinning requested, using scratch space")
+		return ProcessingPhaseTransferScratch, nil
+	}
+	if hs.prefetchBufferSize > 0 {
+		// nbdkit doesn't read ahead, all the data has to go through our client.
+		klog.V(1).Infof("Read-ahead requested, using scratch space")
+		return ProcessingPhaseTransferScratch, nil
+	}
+	if hs.rateLimit != nil {
+		// nbdkit doesn't limit the rate, all the data has to go through our client.
+		klog.V(1).Infof("Rate limit requested, using scratch space")
+		return ProcessingPhaseTransferScratch, nil
+	}
+	if hs.sourceSizeLimits.enabled() {
+		// nbdkit doesn't check the size of the source, all the data has to go through our client.
+		klog.V(1).Infof("Source size check requested, using scratch space")
+		return ProcessingPhaseTransferScratch, nil
+	}
+	if hs.digest {
+		// The digest is computed while our client transfers the data.
+		klog.V(1).Infof("Checksum allowlist requested, using scratch space")
+		return ProcessingPhaseTransferScratch, nil
+	}
+	if hs.signature != nil {
+		// The signature is verified while our client transfers the data.
+		klog.V(1).Infof("Signature verification requested, using scratch space")
+		return ProcessingPhaseTransferScratch, nil
+	}
+	if hs.readers.ArchiveZstd {
+		// nbdkit can't decompress zstd, our client does.
+		klog.V(1).Infof("zstd compressed image, using scratch space")
+		return ProcessingPhaseTransferScratch, nil
+	}
 	if !hs.readers.Archived && hs.readers.Convert {
 		// We can pass straight to conversion from the endpoint
 		return ProcessingPhaseConvert, nil
@@ -158,7 +366,8 @@ func (hs *HTTPDataSource) Transfer(path string) (ProcessingPhase, error) {
 			return ProcessingPhaseError, ErrInvalidPath
 		}
 		file := filepath.Join(path, tempFile)
-		err = util.StreamDataToFile(hs.readers.TopReader(), file)
+		err = hs.scratchCache.transfer(scratchCacheKey(hs.endpoint, hs.etag), hs.readers.TopReader(),
+			hs.readers.topReaderSize(int64(hs.contentLength)), file, hs.streamOptions())
 		if err != nil {
 			return ProcessingPhaseError, err
 		}
@@ -166,6 +375,9 @@ func (hs *HTTPDataSource) Transfer(path string) (ProcessingPhase, error) {
 		hs.url, _ = url.Parse(file)
 		return ProcessingPhaseConvert, nil
 	} else if hs.contentType == cdiv1.DataVolumeArchive {
+		if err := checkFreeInodes(path, hs.expectedArchiveEntries); err != nil {
+			return ProcessingPhaseError, err
+		}
 		if err := util.UnArchiveTar(hs.readers.TopReader(), path); err != nil {
 			return ProcessingPhaseError, errors.Wrap(err, "unable to untar files from endpoint")
 		}
@@ -178,18 +390,60 @@ func (hs *HTTPDataSource) Transfer(path string) (ProcessingPhase, error) {
 // TransferFile is called to transfer the data from the source to the passed in file.
 func (hs *HTTPDataSource) TransferFile(fileName string) (ProcessingPhase, error) {
 	hs.readers.StartProgressUpdate()
-	err := util.StreamDataToFile(hs.readers.TopReader(), fileName)
+	err := util.StreamDataToFileWithSize(hs.readers.TopReader(), fileName, -1, hs.streamOptions())
 	if err != nil {
 		return ProcessingPhaseError, err
 	}
 	return ProcessingPhaseResize, nil
 }
 
+// TransferToWriter is called to stream the raw image from the source to w, without scratch space.
+func (hs *HTTPDataSource) TransferToWriter(w io.Writer) (ProcessingPhase, error) {
+	if hs.contentType != cdiv1.DataVolumeKubeVirt {
+		return ProcessingPhaseError, errors.Errorf("content type %s can't be streamed to a writer", hs.contentType)
+	}
+	return transferToWriter(hs.readers, w)
+}
+
+// TransferToWriterAt is called to write the raw image from the source at its offsets in w, without scratch space.
+func (hs *HTTPDataSource) TransferToWriterAt(w io.WriterAt) (ProcessingPhase, error) {
+	if hs.contentType != cdiv1.DataVolumeKubeVirt {
+		return ProcessingPhaseError, errors.Errorf("content type %s can't be written to a writer", hs.contentType)
+	}
+	return transferToWriterAt(hs.readers, w)
+}
+
 // GetURL returns the URI that the data processor can use when converting the data.
 func (hs *HTTPDataSource) GetURL() *url.URL {
 	return hs.url
 }
 
+func (hs *HTTPDataSource) sourceDigest() (string, error) {
+	return hs.readers.sourceDigest()
+}
+
+func (hs *HTTPDataSource) verifySourceSignature() error {
+	return hs.readers.verifySourceSignature()
+}
+
+func (hs *HTTPDataSource) probe() (*FormatReaders, int64) {
+	return hs.readers, int64(hs.contentLength)
+}
+
+func (hs *HTTPDataSource) addToManifest(manifest *ImportManifest) {
+	manifest.Source.URL = manifestURL(hs.endpoint)
+	manifest.Source.ETag = hs.etag
+	manifest.SourceSize = int64(hs.contentLength)
+	manifest.addDecompress(compressionFormat(hs.readers))
+	if hs.contentType == cdiv1.DataVolumeArchive {
+		manifest.Transforms = append(manifest.Transforms, ImportManifestTransform{Type: ManifestTransformExtract, Format: "tar"})
+	}
+}
+
+func (hs *HTTPDataSource) formatReaders() *FormatReaders {
+	return hs.readers
+}
+
 // Close all readers.
 func (hs *HTTPDataSource) Close() error {
 	var err error
@@ -205,13 +459,27 @@ func (hs *HTTPDataSource) Close() error {
 	return err
 }
 
-func createHTTPClient(certDir string) (*http.Client, error) {
+// createHTTPClient returns a client trusting the system CAs, the CAs of the proxy, and the CAs in certDir, a directory
+// of certificate files or a single PEM bundle file, if not empty, and checking the pins if any.
+func createHTTPClient(certDir string, pins spkiPins) (*http.Client, error) {
 	client := &http.Client{
 		// Don't set timeout here, since that will be an absolute timeout, we need a relative to last progress timeout.
 	}
 
+	certPool, err := createCertPool(certDir)
+	if err != nil {
+		return nil, err
+	}
+	client.Transport = createTLSTransport(certPool, pins)
+
+	return client, nil
+}
+
+// createCertPool returns a pool of the system CAs, the CAs of the proxy, and the CAs in certDir, a directory of
+// certificate files or a single PEM bundle file. Returns nil if certDir is empty, to use the system CAs only.
+func createCertPool(certDir string) (*x509.CertPool, error) {
 	if certDir == "" {
-		return client, nil
+		return nil, nil
 	}
 
 	// let's get system certs as well
@@ -234,18 +502,12 @@ func createHTTPClient(certDir string) (*http.Client, error) {
 	}
 
 	// append server CA certificates
-	files, err := ioutil.ReadDir(certDir)
+	certFiles, err := listCertFiles(certDir)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Error listing files in %s", certDir)
+		return nil, err
 	}
 
-	for _, file := range files {
-		if file.IsDir() || file.Name()[0] == '.' {
-			continue
-		}
-
-		fp := path.Join(certDir, file.Name())
-
+	for _, fp := range certFiles {
 		klog.Infof("Attempting to get certs from %s", fp)
 
 		certs, err := ioutil.ReadFile(fp)
@@ -258,49 +520,133 @@ func createHTTPClient(certDir string) (*http.Client, error) {
 		}
 	}
 
-	// the default transport contains Proxy configurations to use environment variables and default timeouts
+	return certPool, nil
+}
+
+// listCertFiles returns the files of the CA certificates in certDir, either a directory of certificate files, or a
+// single PEM bundle file.
+func listCertFiles(certDir string) ([]string, error) {
+	info, err := os.Stat(certDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error reading %s", certDir)
+	}
+	if !info.IsDir() {
+		return []string{certDir}, nil
+	}
+	files, err := ioutil.ReadDir(certDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error listing files in %s", certDir)
+	}
+	var certFiles []string
+	for _, file := range files {
+		if file.IsDir() || file.Name()[0] == '.' {
+			continue
+		}
+		certFiles = append(certFiles, path.Join(certDir, file.Name()))
+	}
+	return certFiles, nil
+}
+
+// createTLSTransport returns a transport trusting the CAs of certPool, the system CAs if nil, and checking the pins if
+// any. The transport goes through the proxy of the environment.
+func createTLSTransport(certPool *x509.CertPool, pins spkiPins) *http.Transport {
+	// the default transport contains default timeouts
 	transport := http.DefaultTransport.(*http.Transport).Clone()
-	transport.TLSClientConfig = &tls.Config{
+	transport.Proxy = proxyFromEnvironment
+	transport.TLSClientConfig = createTLSConfig(certPool, pins)
+	return transport
+}
+
+// createTLSConfig returns a TLS configuration trusting the CAs of certPool, the system CAs if nil, and checking the
+// pins if any.
+func createTLSConfig(certPool *x509.CertPool, pins spkiPins) *tls.Config {
+	config := &tls.Config{
 		RootCAs: certPool,
 	}
-	client.Transport = transport
+	if len(pins) > 0 {
+		config.VerifyPeerCertificate = pins.verify
+	}
+	return config
+}
 
-	return client, nil
+// proxyFromEnvironment returns the proxy of req from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables,
+// nil if req doesn't go through a proxy. The credentials in the proxy URL authenticate to the proxy. Unlike
+// http.ProxyFromEnvironment, the variables are read on each call.
+func proxyFromEnvironment(req *http.Request) (*url.URL, error) {
+	return httpproxy.FromEnvironment().ProxyFunc()(req.URL)
 }
 
-func createHTTPReader(ctx context.Context, ep *url.URL, accessKey, secKey, certDir string) (io.ReadCloser, uint64, bool, error) {
+func createHTTPReader(ctx context.Context, ep *url.URL, accessKey, secKey, certDir string, pins spkiPins, extraHeaders, secretExtraHeaders []string, options httpReaderOptions) (io.ReadCloser, uint64, bool, string, error) {
 	var brokenForQemuImg bool
-	client, err := createHTTPClient(certDir)
+	client, err := createHTTPClient(certDir, pins)
 	if err != nil {
-		return nil, uint64(0), false, errors.Wrap(err, "Error creating http client")
+		return nil, uint64(0), false, "", errors.Wrap(err, "Error creating http client")
 	}
+	client.Transport = newRetryAfterTransport(client.Transport, options.retryAfterBudget)
 
-	client.CheckRedirect = func(r *http.Request, via []*http.Request) error {
-		if len(accessKey) > 0 && len(secKey) > 0 {
-			r.SetBasicAuth(accessKey, secKey) // Redirects will lose basic auth, so reset them manually
-		}
-		return nil
+	header, err := parseExtraHeaders(extraHeaders, secretExtraHeaders)
+	if err != nil {
+		return nil, uint64(0), false, "", err
 	}
+	client.CheckRedirect = checkHTTPRedirect(ep, accessKey, secKey, secretHeaderNames(secretExtraHeaders))
 
-	total, err := getContentLength(client, ep, accessKey, secKey)
+	total, headHeader, err := getContentLength(client, ep, accessKey, secKey, header)
 	if err != nil {
 		brokenForQemuImg = true
 	}
-	// http.NewRequest can only return error on invalid METHOD, or invalid url. Here the METHOD is always GET, and the url is always valid, thus error cannot happen.
-	req, _ := http.NewRequest("GET", ep.String(), nil)
+	get := func(byteRange string) (*http.Response, error) {
+		// http.NewRequest can only return error on invalid METHOD, or invalid url. Here the METHOD is always GET, and the url is always valid, thus error cannot happen.
+		req, _ := http.NewRequest("GET", ep.String(), nil)
 
-	req = req.WithContext(ctx)
-	if len(accessKey) > 0 && len(secKey) > 0 {
-		req.SetBasicAuth(accessKey, secKey)
+		req = req.WithContext(ctx)
+		addExtraHeaders(req, header)
+		if len(accessKey) > 0 && len(secKey) > 0 {
+			req.SetBasicAuth(accessKey, secKey)
+		}
+		if byteRange != "" {
+			req.Header.Set("Range", byteRange)
+		}
+		klog.V(2).Infof("Attempting to get object %q via http client\n", util.RedactURL(ep.String()))
+		return client.Do(req)
+	}
+	if options.rangedHead && headHeader.Get("Accept-Ranges") == "bytes" {
+		// The object is requested on the first read.
+		countingReader := &util.CountingReader{
+			Reader:  newHTTPRangeReader(get),
+			Current: 0,
+		}
+		return countingReader, total, brokenForQemuImg, headHeader.Get("ETag"), nil
 	}
-	klog.V(2).Infof("Attempting to get object %q via http client\n", ep.String())
-	resp, err := client.Do(req)
+	resp, err := get("")
 	if err != nil {
-		return nil, uint64(0), true, errors.Wrap(err, "HTTP request errored")
+		return nil, uint64(0), true, "", errors.Wrap(err, "HTTP request errored")
 	}
-	if resp.StatusCode != 200 {
+	ranged := header.Get("Range") != ""
+	if resp.StatusCode == http.StatusPartialContent {
+		// nbdkit doesn't check the responses, our client does.
+		brokenForQemuImg = true
+		if resp, err = checkPartialContent(resp, ranged, func() (*http.Response, error) { return get("") }); err != nil {
+			return nil, uint64(0), true, "", err
+		}
+	}
+	if resp.StatusCode == http.StatusPartialContent && ranged {
+		// The part requested with the extra headers is the source, nbdkit would read the whole object.
+		klog.V(1).Infof("Importing the byte range %s, avoiding qemu-img", resp.Header.Get("Content-Range"))
+		countingReader := &util.CountingReader{
+			Reader:  resp.Body,
+			Current: 0,
+		}
+		return countingReader, parseHTTPHeader(resp), true, resp.Header.Get("ETag"), nil
+	}
+	if resp.StatusCode != 200 && resp.StatusCode != http.StatusPartialContent {
 		klog.Errorf("http: expected status code 200, got %d", resp.StatusCode)
-		return nil, uint64(0), true, errors.Errorf("expected status code 200, got %d. Status: %s", resp.StatusCode, resp.Status)
+		if err := checkHTTPUnauthorized(resp); err != nil {
+			return nil, uint64(0), true, "", err
+		}
+		if err := checkPresignedURLExpiry(resp); err != nil {
+			return nil, uint64(0), true, "", err
+		}
+		return nil, uint64(0), true, "", errors.Errorf("expected status code 200, got %d. Status: %s", resp.StatusCode, resp.Status)
 	}
 
 	acceptRanges, ok := resp.Header["Accept-Ranges"]
@@ -317,7 +663,7 @@ func createHTTPReader(ctx context.Context, ep *url.URL, accessKey, secKey, certD
 		Reader:  resp.Body,
 		Current: 0,
 	}
-	return countingReader, total, brokenForQemuImg, nil
+	return countingReader, total, brokenForQemuImg, resp.Header.Get("ETag"), nil
 }
 
 func (hs *HTTPDataSource) pollProgress(reader *util.CountingReader, idleTime, pollInterval time.Duration) {
@@ -347,24 +693,132 @@ func (hs *HTTPDataSource) pollProgress(reader *util.CountingReader, idleTime, po
 	}
 }
 
-func getContentLength(client *http.Client, ep *url.URL, accessKey, secKey string) (uint64, error) {
+// checkHTTPRedirect returns the redirect policy of the requests of ep, following up to httpMaxRedirects redirects.
+// The basic auth credentials and the secret extra headers are only sent to the host of ep.
+func checkHTTPRedirect(ep *url.URL, accessKey, secKey string, secretHeaders []string) func(r *http.Request, via []*http.Request) error {
+	return func(r *http.Request, via []*http.Request) error {
+		if len(via) >= httpMaxRedirects {
+			return errors.Errorf("stopped after %d redirects", httpMaxRedirects)
+		}
+		if r.URL.Hostname() != ep.Hostname() {
+			klog.V(1).Infof("Redirected to %s, not sending the credentials of %s", r.URL.Hostname(), ep.Hostname())
+			r.Header.Del("Authorization")
+			for _, name := range secretHeaders {
+				r.Header.Del(name)
+			}
+			return nil
+		}
+		if len(accessKey) > 0 && len(secKey) > 0 {
+			r.SetBasicAuth(accessKey, secKey) // Redirects will lose basic auth, so reset them manually
+		}
+		return nil
+	}
+}
+
+// checkHTTPUnauthorized returns an error wrapping ErrHTTPAuthenticationRequired or ErrHTTPAuthenticationFailed if
+// resp is a 401 response, depending on whether its request sent credentials, nil otherwise. It closes the body of 401
+// responses.
+func checkHTTPUnauthorized(resp *http.Response) error {
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil
+	}
+	resp.Body.Close()
+	u := *resp.Request.URL
+	u.User = nil
+	u.RawQuery = ""
+	err := ErrHTTPAuthenticationRequired
+	if resp.Request.Header.Get("Authorization") != "" {
+		err = ErrHTTPAuthenticationFailed
+	}
+	// The scheme of the challenge tells the kind of credentials the server expects, the parameters aren't needed.
+	if challenge := strings.Fields(resp.Header.Get("WWW-Authenticate")); len(challenge) > 0 {
+		return errors.Wrapf(err, "%s answered %s, it expects %s credentials", u.String(), resp.Status, challenge[0])
+	}
+	return errors.Wrapf(err, "%s answered %s", u.String(), resp.Status)
+}
+
+// checkPresignedURLExpiry returns an error wrapping ErrPresignedURLExpired if the error response resp reports the
+// expiry of a presigned URL, nil otherwise. It reads and closes the body of resp.
+func checkPresignedURLExpiry(resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusBadRequest {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, httpErrorBodySize))
+	if err != nil {
+		return nil
+	}
+	for _, message := range presignedURLExpiryMessages {
+		if strings.Contains(string(body), message) {
+			// The query of a presigned URL holds its signature.
+			u := *resp.Request.URL
+			u.User = nil
+			u.RawQuery = ""
+			return errors.Wrapf(ErrPresignedURLExpired, "%s answered %s (%s)", u.String(), resp.Status, message)
+		}
+	}
+	return nil
+}
+
+// checkPartialContent checks the 206 response resp to a GET. Partial content is expected if the Range header was
+// requested. Otherwise the object is requested again with get unless resp holds the whole object, since an
+// intermediate may have added a Range header, and the second response is returned. A part of the object fails with
+// ErrUnexpectedPartialContent, it would be imported as the whole object.
+func checkPartialContent(resp *http.Response, ranged bool, get func() (*http.Response, error)) (*http.Response, error) {
+	if ranged || wholeContentRange(resp) {
+		return resp, nil
+	}
+	u := *resp.Request.URL
+	u.User = nil
+	u.RawQuery = ""
+	klog.Warningf("%s answered %s with Content-Range %q to a GET without Range, requesting the object again", u.String(), resp.Status, resp.Header.Get("Content-Range"))
+	resp.Body.Close()
+	resp, err := get()
+	if err != nil {
+		return nil, errors.Wrap(err, "HTTP request errored")
+	}
+	if resp.StatusCode == http.StatusPartialContent && !wholeContentRange(resp) {
+		resp.Body.Close()
+		return nil, errors.Wrapf(ErrUnexpectedPartialContent, "%s answered %s with Content-Range %q to a GET without Range", u.String(), resp.Status, resp.Header.Get("Content-Range"))
+	}
+	return resp, nil
+}
+
+// wholeContentRange returns true if the Content-Range of the 206 response resp covers the whole object.
+func wholeContentRange(resp *http.Response) bool {
+	var start, end, size int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); err != nil {
+		return false
+	}
+	return start == 0 && end+1 == size
+}
+
+// getContentLength returns the content length reported by a HEAD request, and the headers of the response.
+func getContentLength(client *http.Client, ep *url.URL, accessKey, secKey string, header http.Header) (uint64, http.Header, error) {
 	req, err := http.NewRequest("HEAD", ep.String(), nil)
 	if err != nil {
-		return uint64(0), errors.Wrap(err, "could not create HTTP request")
+		return uint64(0), nil, errors.Wrap(err, "could not create HTTP request")
 	}
+	addExtraHeaders(req, header)
 	if len(accessKey) > 0 && len(secKey) > 0 {
 		req.SetBasicAuth(accessKey, secKey)
 	}
 
-	klog.V(2).Infof("Attempting to HEAD %q via http client\n", ep.String())
+	klog.V(2).Infof("Attempting to HEAD %q via http client\n", util.RedactURL(ep.String()))
 	resp, err := client.Do(req)
 	if err != nil {
-		return uint64(0), errors.Wrap(err, "HTTP request errored")
+		return uint64(0), nil, errors.Wrap(err, "HTTP request errored")
 	}
 
 	if resp.StatusCode != 200 {
 		klog.Errorf("http: expected status code 200, got %d", resp.StatusCode)
-		return uint64(0), errors.Errorf("expected status code 200, got %d. Status: %s", resp.StatusCode, resp.Status)
+		if err := checkHTTPUnauthorized(resp); err != nil {
+			return uint64(0), nil, err
+		}
+		if err := checkPresignedURLExpiry(resp); err != nil {
+			return uint64(0), nil, err
+		}
+		return uint64(0), nil, errors.Errorf("expected status code 200, got %d. Status: %s", resp.StatusCode, resp.Status)
 	}
 
 	for k, v := range resp.Header {
@@ -375,9 +829,9 @@ func getContentLength(client *http.Client, ep *url.URL, accessKey, secKey string
 
 	err = resp.Body.Close()
 	if err != nil {
-		return uint64(0), errors.Wrap(err, "could not close head read")
+		return uint64(0), nil, errors.Wrap(err, "could not close head read")
 	}
-	return total, nil
+	return total, resp.Header, nil
 }
 
 func parseHTTPHeader(resp *http.Response) uint64 {
@@ -393,3 +847,115 @@ func parseHTTPHeader(resp *http.Response) uint64 {
 
 	return total
 }
+
+// getExtraHeaders returns the extra headers from the environment, and the secret extra headers from the secrets
+// mounted in the secret extra headers directory. Headers have the form "Name: value".
+func getExtraHeaders() ([]string, []string, error) {
+	var names []string
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, common.ImporterExtraHeader) {
+			names = append(names, strings.SplitN(env, "=", 2)[0])
+		}
+	}
+	sort.Strings(names)
+	extraHeaders := make([]string, 0, len(names))
+	for _, name := range names {
+		extraHeaders = append(extraHeaders, os.Getenv(name))
+	}
+
+	secretExtraHeaders, err := getSecretExtraHeaders(secretExtraHeadersDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	return extraHeaders, secretExtraHeaders, nil
+}
+
+// getSecretExtraHeaders reads the headers from the secrets mounted in sub directories of dir, each key of a secret
+// holds one header.
+func getSecretExtraHeaders(dir string) ([]string, error) {
+	secrets, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Error listing files in %s", dir)
+	}
+	var headers []string
+	for _, secret := range secrets {
+		if !secret.IsDir() || secret.Name()[0] == '.' {
+			continue
+		}
+		secretDir := filepath.Join(dir, secret.Name())
+		files, err := ioutil.ReadDir(secretDir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error listing files in %s", secretDir)
+		}
+		for _, file := range files {
+			// Secret volumes contain hidden data directories, the keys are symlinks into them.
+			if file.IsDir() || file.Name()[0] == '.' {
+				continue
+			}
+			fp := filepath.Join(secretDir, file.Name())
+			header, err := ioutil.ReadFile(fp)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Error reading file %s", fp)
+			}
+			headers = append(headers, strings.TrimSpace(string(header)))
+		}
+	}
+	return headers, nil
+}
+
+// parseExtraHeaders parses the headers in the form "Name: value", and logs them with the secret values redacted.
+func parseExtraHeaders(extraHeaders, secretExtraHeaders []string) (http.Header, error) {
+	header := http.Header{}
+	var logged []string
+	for _, h := range extraHeaders {
+		name, value, err := splitHeader(h)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid extra header %q", h)
+		}
+		header.Add(name, value)
+		logged = append(logged, h)
+	}
+	for _, h := range secretExtraHeaders {
+		name, value, err := splitHeader(h)
+		if err != nil {
+			// Don't leak the secret in the error.
+			return nil, errors.Wrap(err, "invalid secret extra header")
+		}
+		header.Add(name, value)
+		logged = append(logged, name+": *****")
+	}
+	if len(logged) > 0 {
+		klog.V(1).Infof("Using extra headers: %v", logged)
+	}
+	return header, nil
+}
+
+// secretHeaderNames returns the names of the secret extra headers.
+func secretHeaderNames(secretExtraHeaders []string) []string {
+	var names []string
+	for _, h := range secretExtraHeaders {
+		if name, _, err := splitHeader(h); err == nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func splitHeader(h string) (string, string, error) {
+	parts := strings.SplitN(h, ":", 2)
+	name := strings.TrimSpace(parts[0])
+	if len(parts) != 2 || name == "" {
+		return "", "", errors.New("expected the form \"Name: value\"")
+	}
+	return name, strings.TrimSpace(parts[1]), nil
+}
+
+func addExtraHeaders(req *http.Request, header http.Header) {
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+}
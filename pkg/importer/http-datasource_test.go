@@ -1,8 +1,10 @@
 package importer
 
 import (
+	"bytes"
 	"context"
 	"crypto/x509"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -12,14 +14,20 @@ import (
 	"path"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	"github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+
+	"k8s.io/klog/v2"
 
 	cdiv1 "kubevirt.io/containerized-data-importer/pkg/apis/core/v1beta1"
+	"kubevirt.io/containerized-data-importer/pkg/common"
 	"kubevirt.io/containerized-data-importer/pkg/image"
 	"kubevirt.io/containerized-data-importer/pkg/util"
 	"kubevirt.io/containerized-data-importer/pkg/util/cert"
@@ -32,6 +40,7 @@ var (
 	cirrosQCow2TarFileName  = "cirros.qcow2.tar"
 	tinyCoreGz              = "tinyCore.iso.gz"
 	tinyCoreXz              = "tinyCore.iso.xz"
+	cirrosZstFileName       = "cirros-qcow2.img.zst"
 	cirrosData, _           = readFile(cirrosFilePath)
 	diskimageArchiveData, _ = readFile(diskimageTarFileName)
 )
@@ -117,6 +126,22 @@ var _ = Describe("Http data source", func() {
 		table.Entry("return Convert phase ", cirrosFileName, cdiv1.DataVolumeKubeVirt, ProcessingPhaseConvert, cirrosData, false),
 		table.Entry("return TransferTarget with archive content type but not archive endpoint ", cirrosFileName, cdiv1.DataVolumeArchive, ProcessingPhaseTransferDataDir, cirrosData, false),
 		table.Entry("return TransferTarget with archive content type and archive endpoint ", diskimageTarFileName, cdiv1.DataVolumeArchive, ProcessingPhaseTransferDataDir, diskimageArchiveData, false),
+		table.Entry("return TransferScratch for a zstd compressed image", cirrosZstFileName, cdiv1.DataVolumeKubeVirt, ProcessingPhaseTransferScratch, cirrosData, false),
+	)
+
+	table.DescribeTable("calling info with source size checks should", func(strict bool, maxBytes int64, expectedPhase ProcessingPhase) {
+		flushRead = cirrosData
+		dp, err = NewHTTPDataSourceWithOptions(ts.URL+"/"+cirrosFileName, "", "", "", cdiv1.DataVolumeKubeVirt, HTTPOptions{
+			SourceOptions: SourceOptions{StrictSourceSize: strict, MaxSourceBytes: maxBytes},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		newPhase, err := dp.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(newPhase).To(Equal(expectedPhase))
+	},
+		table.Entry("return TransferScratch with strict source size checks", true, int64(0), ProcessingPhaseTransferScratch),
+		table.Entry("return TransferScratch with a maximum source size", false, int64(1<<30), ProcessingPhaseTransferScratch),
+		table.Entry("return Convert without source size checks", false, int64(0), ProcessingPhaseConvert),
 	)
 
 	It("calling info with raw image should return TransferDataFile", func() {
@@ -165,6 +190,24 @@ var _ = Describe("Http data source", func() {
 		table.Entry("return Convert with scratch space and valid qcow file", cirrosFileName, cdiv1.DataVolumeKubeVirt, ProcessingPhaseConvert, "", cirrosData, false),
 	)
 
+	It("Transfer should fail before extracting an archive if there are not enough free inodes", func() {
+		origFunc := getAvailableInodesFunc
+		defer func() { getAvailableInodesFunc = origFunc }()
+		getAvailableInodesFunc = func(path string) (int64, error) {
+			return 10, nil
+		}
+		dp, err = NewHTTPDataSourceWithOptions(ts.URL+"/"+diskimageTarFileName, "", "", "", cdiv1.DataVolumeArchive, HTTPOptions{ExpectedArchiveEntries: 1000})
+		Expect(err).NotTo(HaveOccurred())
+		_, err := dp.Info()
+		Expect(err).NotTo(HaveOccurred())
+		newPhase, err := dp.Transfer(tmpDir)
+		Expect(errors.Cause(err)).To(Equal(ErrInsufficientInodes))
+		Expect(newPhase).To(Equal(ProcessingPhaseError))
+		files, err := ioutil.ReadDir(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(BeEmpty())
+	})
+
 	It("TransferFile should succeed when writing to valid file, and reading raw gz", func() {
 		dp, err = NewHTTPDataSource(ts.URL+"/"+tinyCoreGz, "", "", "", cdiv1.DataVolumeKubeVirt)
 		Expect(err).NotTo(HaveOccurred())
@@ -207,7 +250,7 @@ var _ = Describe("Http client", func() {
 	})
 
 	It("should load the cert", func() {
-		client, err := createHTTPClient(tempDir)
+		client, err := createHTTPClient(tempDir, nil)
 		Expect(err).ToNot(HaveOccurred())
 
 		transport := client.Transport.(*http.Transport)
@@ -222,11 +265,26 @@ var _ = Describe("Http client", func() {
 		Expect(len(activeCAs.Subjects())).Should(Equal(len(systemCAs.Subjects()) + 1))
 	})
 
+	It("should load a single bundle file", func() {
+		client, err := createHTTPClient(path.Join(tempDir, "tls.crt"), nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		transport := client.Transport.(*http.Transport)
+		systemCAs, err := x509.SystemCertPool()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(len(transport.TLSClientConfig.RootCAs.Subjects())).Should(Equal(len(systemCAs.Subjects()) + 1))
+	})
+
+	It("should fail with a missing cert path", func() {
+		_, err := createHTTPClient(path.Join(tempDir, "missing.crt"), nil)
+		Expect(err).To(HaveOccurred())
+	})
+
 })
 
 var _ = Describe("Http reader", func() {
 	It("should fail when passed an invalid cert directory", func() {
-		_, total, _, err := createHTTPReader(context.Background(), nil, "", "", "/invalid")
+		_, total, _, _, err := createHTTPReader(context.Background(), nil, "", "", "/invalid", nil, nil, nil, httpReaderOptions{})
 		Expect(err).To(HaveOccurred())
 		Expect(uint64(0)).To(Equal(total))
 	})
@@ -243,7 +301,7 @@ var _ = Describe("Http reader", func() {
 		defer ts.Close()
 		ep, err := url.Parse(ts.URL)
 		Expect(err).ToNot(HaveOccurred())
-		r, total, _, err := createHTTPReader(context.Background(), ep, "user", "password", "")
+		r, total, _, _, err := createHTTPReader(context.Background(), ep, "user", "password", "", nil, nil, nil, httpReaderOptions{})
 		Expect(err).ToNot(HaveOccurred())
 		Expect(uint64(25)).To(Equal(total))
 		err = r.Close()
@@ -266,13 +324,70 @@ var _ = Describe("Http reader", func() {
 		defer ts.Close()
 		ep, err := url.Parse(ts.URL)
 		Expect(err).ToNot(HaveOccurred())
-		r, total, _, err := createHTTPReader(context.Background(), ep, "user", "password", "")
+		r, total, _, _, err := createHTTPReader(context.Background(), ep, "user", "password", "", nil, nil, nil, httpReaderOptions{})
 		Expect(err).ToNot(HaveOccurred())
 		Expect(uint64(25)).To(Equal(total))
 		err = r.Close()
 		Expect(err).ToNot(HaveOccurred())
 	})
 
+	It("should not pass auth info to other hosts when redirected", func() {
+		var requested bool
+		redirTs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requested = true
+			_, _, ok := r.BasicAuth()
+			Expect(ok).To(BeFalse())
+			Expect(r.Header.Get("X-Tenant-Token")).To(BeEmpty())
+			Expect(r.Header.Get("X-Api-Version")).To(Equal("2"))
+			w.Header().Add("Content-Length", "25")
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer redirTs.Close()
+		redirURL, err := url.Parse(redirTs.URL)
+		Expect(err).ToNot(HaveOccurred())
+		redirURL.Host = "localhost:" + redirURL.Port()
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, redirURL.String(), http.StatusFound)
+		}))
+		defer ts.Close()
+		ep, err := url.Parse(ts.URL)
+		Expect(err).ToNot(HaveOccurred())
+		r, total, _, _, err := createHTTPReader(context.Background(), ep, "user", "password", "", nil, []string{"X-Api-Version: 2"}, []string{"X-Tenant-Token: secret-value"}, httpReaderOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(uint64(25)).To(Equal(total))
+		Expect(requested).To(BeTrue())
+		Expect(r.Close()).To(Succeed())
+	})
+
+	It("should stop following redirects after the limit", func() {
+		var redirects int
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			redirects++
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		}))
+		defer ts.Close()
+		ep, err := url.Parse(ts.URL)
+		Expect(err).ToNot(HaveOccurred())
+		_, _, _, _, err = createHTTPReader(context.Background(), ep, "", "", "", nil, nil, nil, httpReaderOptions{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("stopped after 10 redirects"))
+		// The HEAD and the GET request are both redirected up to the limit.
+		Expect(redirects).To(Equal(2 * httpMaxRedirects))
+	})
+
+	It("should report expired presigned URLs", func() {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("<Error><Code>AccessDenied</Code><Message>Request has expired</Message></Error>"))
+		}))
+		defer ts.Close()
+		ep, err := url.Parse(ts.URL + "/disk.img?X-Amz-Signature=secret")
+		Expect(err).ToNot(HaveOccurred())
+		_, _, _, _, err = createHTTPReader(context.Background(), ep, "", "", "", nil, nil, nil, httpReaderOptions{})
+		Expect(errors.Cause(err)).To(Equal(ErrPresignedURLExpired))
+		Expect(err.Error()).NotTo(ContainSubstring("secret"))
+	})
+
 	It("should redirect properly without auth if not set", func() {
 		redirTs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			_, _, ok := r.BasicAuth()
@@ -288,7 +403,7 @@ var _ = Describe("Http reader", func() {
 		defer ts.Close()
 		ep, err := url.Parse(ts.URL)
 		Expect(err).ToNot(HaveOccurred())
-		r, total, brokenForQemuImg, err := createHTTPReader(context.Background(), ep, "", "", "")
+		r, total, brokenForQemuImg, _, err := createHTTPReader(context.Background(), ep, "", "", "", nil, nil, nil, httpReaderOptions{})
 		Expect(brokenForQemuImg).To(BeFalse())
 		Expect(err).ToNot(HaveOccurred())
 		Expect(uint64(25)).To(Equal(total))
@@ -309,7 +424,7 @@ var _ = Describe("Http reader", func() {
 		defer ts.Close()
 		ep, err := url.Parse(ts.URL)
 		Expect(err).ToNot(HaveOccurred())
-		r, total, _, err := createHTTPReader(context.Background(), ep, "", "", "")
+		r, total, _, _, err := createHTTPReader(context.Background(), ep, "", "", "", nil, nil, nil, httpReaderOptions{})
 		Expect(err).ToNot(HaveOccurred())
 		Expect(uint64(0)).To(Equal(total))
 		err = r.Close()
@@ -333,7 +448,7 @@ var _ = Describe("Http reader", func() {
 		defer ts.Close()
 		ep, err := url.Parse(ts.URL)
 		Expect(err).ToNot(HaveOccurred())
-		r, total, brokenForQemuImg, err := createHTTPReader(context.Background(), ep, "", "", "")
+		r, total, brokenForQemuImg, _, err := createHTTPReader(context.Background(), ep, "", "", "", nil, nil, nil, httpReaderOptions{})
 		Expect(brokenForQemuImg).To(BeTrue())
 		Expect(err).ToNot(HaveOccurred())
 		Expect(uint64(25)).To(Equal(total))
@@ -353,7 +468,7 @@ var _ = Describe("Http reader", func() {
 		defer ts.Close()
 		ep, err := url.Parse(ts.URL)
 		Expect(err).ToNot(HaveOccurred())
-		r, total, brokenForQemuImg, err := createHTTPReader(context.Background(), ep, "", "", "")
+		r, total, brokenForQemuImg, _, err := createHTTPReader(context.Background(), ep, "", "", "", nil, nil, nil, httpReaderOptions{})
 		Expect(brokenForQemuImg).To(BeTrue())
 		Expect(err).ToNot(HaveOccurred())
 		Expect(uint64(25)).To(Equal(total))
@@ -368,11 +483,99 @@ var _ = Describe("Http reader", func() {
 		defer ts.Close()
 		ep, err := url.Parse(ts.URL)
 		Expect(err).ToNot(HaveOccurred())
-		_, total, _, err := createHTTPReader(context.Background(), ep, "", "", "")
+		_, total, _, _, err := createHTTPReader(context.Background(), ep, "", "", "", nil, nil, nil, httpReaderOptions{})
 		Expect(err).To(HaveOccurred())
 		Expect(uint64(0)).To(Equal(total))
 		Expect("expected status code 200, got 500. Status: 500 Internal Server Error").To(Equal(err.Error()))
 	})
+
+	Context("with 206 Partial Content responses", func() {
+		const content = "0123456789abcdefghijklmnopqrstuvwxyz"
+		var gets int
+
+		// partialServer answers the first partial GETs without Range with a part of content, and the next ones with
+		// the whole content. Range headers are honored.
+		partialServer := func(partial int) *httptest.Server {
+			gets = 0
+			return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Accept-Ranges", "bytes")
+				if r.Method == http.MethodHead {
+					w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+					return
+				}
+				gets++
+				if r.Header.Get("Range") != "" || gets <= partial {
+					var start, end int
+					if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil {
+						start, end = 0, 9
+					}
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+					w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+					w.WriteHeader(http.StatusPartialContent)
+					w.Write([]byte(content[start : end+1]))
+					return
+				}
+				w.Write([]byte(content))
+			}))
+		}
+
+		read := func(r io.ReadCloser) string {
+			data, err := ioutil.ReadAll(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Close()).To(Succeed())
+			return string(data)
+		}
+
+		It("should request the object again after partial content to a GET without Range", func() {
+			ts := partialServer(1)
+			defer ts.Close()
+			ep, err := url.Parse(ts.URL)
+			Expect(err).NotTo(HaveOccurred())
+			r, total, brokenForQemuImg, _, err := createHTTPReader(context.Background(), ep, "", "", "", nil, nil, nil, httpReaderOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(total).To(Equal(uint64(len(content))))
+			Expect(brokenForQemuImg).To(BeTrue())
+			Expect(read(r)).To(Equal(content))
+			Expect(gets).To(Equal(2))
+		})
+
+		It("should fail if the server keeps answering a GET without Range with partial content", func() {
+			ts := partialServer(2)
+			defer ts.Close()
+			ep, err := url.Parse(ts.URL)
+			Expect(err).NotTo(HaveOccurred())
+			_, _, _, _, err = createHTTPReader(context.Background(), ep, "", "", "", nil, nil, nil, httpReaderOptions{})
+			Expect(errors.Cause(err)).To(Equal(ErrUnexpectedPartialContent))
+			Expect(err.Error()).To(ContainSubstring(`Content-Range "bytes 0-9/36"`))
+		})
+
+		It("should accept partial content holding the whole object", func() {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content)))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte(content))
+			}))
+			defer ts.Close()
+			ep, err := url.Parse(ts.URL)
+			Expect(err).NotTo(HaveOccurred())
+			r, _, _, _, err := createHTTPReader(context.Background(), ep, "", "", "", nil, nil, nil, httpReaderOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(read(r)).To(Equal(content))
+		})
+
+		It("should import the byte range requested with the extra headers", func() {
+			ts := partialServer(0)
+			defer ts.Close()
+			ep, err := url.Parse(ts.URL)
+			Expect(err).NotTo(HaveOccurred())
+			r, total, brokenForQemuImg, _, err := createHTTPReader(context.Background(), ep, "", "", "", nil, []string{"Range: bytes=10-19"}, nil, httpReaderOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(total).To(Equal(uint64(10)))
+			Expect(brokenForQemuImg).To(BeTrue())
+			Expect(read(r)).To(Equal(content[10:20]))
+			Expect(gets).To(Equal(1))
+		})
+	})
 })
 
 var _ = Describe("http pollprogress", func() {
@@ -406,6 +609,237 @@ var _ = Describe("http pollprogress", func() {
 	})
 })
 
+var _ = Describe("Http extra headers", func() {
+	var (
+		ts         *httptest.Server
+		headersDir string
+		requests   []*http.Request
+		lock       sync.Mutex
+		logs       *bytes.Buffer
+	)
+
+	BeforeEach(func() {
+		var err error
+		createNbdkitCurl = image.NewMockNbdkitCurl
+		requests = nil
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			requests = append(requests, r)
+			lock.Unlock()
+			w.Header().Set("Accept-Ranges", "bytes")
+			http.ServeContent(w, r, "disk.img", time.Time{}, strings.NewReader(strings.Repeat("\x00", 4096)))
+		}))
+		headersDir, err = ioutil.TempDir("", "extraheaders")
+		Expect(err).NotTo(HaveOccurred())
+		secretDir := filepath.Join(headersDir, "0")
+		// Mimic the layout of a secret volume, the key is a symlink into a hidden data directory.
+		Expect(os.MkdirAll(filepath.Join(secretDir, "..data"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(secretDir, "..data", "token"), []byte("X-Tenant-Token: secret-value\n"), 0644)).To(Succeed())
+		Expect(os.Symlink(filepath.Join("..data", "token"), filepath.Join(secretDir, "token"))).To(Succeed())
+		secretExtraHeadersDir = headersDir
+		os.Setenv(common.ImporterExtraHeader+"0", "X-Api-Version: 2")
+		os.Setenv(common.ImporterExtraHeader+"1", "X-Tenant: tenant1")
+
+		logs = &bytes.Buffer{}
+		klog.LogToStderr(false)
+		klog.SetOutput(logs)
+		var level klog.Level
+		level.Set("1")
+	})
+
+	AfterEach(func() {
+		var level klog.Level
+		level.Set("0")
+		klog.SetOutput(os.Stderr)
+		klog.LogToStderr(true)
+		os.Unsetenv(common.ImporterExtraHeader + "0")
+		os.Unsetenv(common.ImporterExtraHeader + "1")
+		secretExtraHeadersDir = common.ImporterSecretExtraHeadersDir
+		os.RemoveAll(headersDir)
+		ts.Close()
+	})
+
+	It("should be sent with every request, and secret values should be redacted in the logs", func() {
+		dp, err := NewHTTPDataSource(ts.URL+"/disk.img", "", "", "", cdiv1.DataVolumeKubeVirt)
+		Expect(err).NotTo(HaveOccurred())
+		defer dp.Close()
+		lock.Lock()
+		defer lock.Unlock()
+		Expect(requests).To(HaveLen(2))
+		Expect(requests[0].Method).To(Equal(http.MethodHead))
+		Expect(requests[1].Method).To(Equal(http.MethodGet))
+		for _, r := range requests {
+			Expect(r.Header.Get("X-Api-Version")).To(Equal("2"))
+			Expect(r.Header.Get("X-Tenant")).To(Equal("tenant1"))
+			Expect(r.Header.Get("X-Tenant-Token")).To(Equal("secret-value"))
+		}
+		klog.Flush()
+		Expect(logs.String()).To(ContainSubstring("X-Api-Version: 2"))
+		Expect(logs.String()).To(ContainSubstring("X-Tenant-Token: *****"))
+		Expect(logs.String()).NotTo(ContainSubstring("secret-value"))
+	})
+
+	It("should send the default User-Agent", func() {
+		dp, err := NewHTTPDataSource(ts.URL+"/disk.img", "", "", "", cdiv1.DataVolumeKubeVirt)
+		Expect(err).NotTo(HaveOccurred())
+		defer dp.Close()
+		lock.Lock()
+		defer lock.Unlock()
+		for _, r := range requests {
+			Expect(r.Header.Get("User-Agent")).To(Equal(DefaultUserAgent()))
+		}
+		Expect(DefaultUserAgent()).To(HavePrefix("containerized-data-importer/"))
+	})
+
+	It("should send the User-Agent and the extra headers of the options, and redact credentials in the logs", func() {
+		dp, err := NewHTTPDataSourceWithOptions(ts.URL+"/disk.img", "", "", "", cdiv1.DataVolumeKubeVirt, HTTPOptions{
+			UserAgent:    "custom-agent/1.0",
+			ExtraHeaders: []string{"X-Request-Source: test", "Authorization: Basic c2VjcmV0", "Cookie: session=s3ss10n"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		defer dp.Close()
+		lock.Lock()
+		defer lock.Unlock()
+		Expect(requests).To(HaveLen(2))
+		for _, r := range requests {
+			Expect(r.Header.Get("User-Agent")).To(Equal("custom-agent/1.0"))
+			Expect(r.Header.Get("X-Request-Source")).To(Equal("test"))
+			Expect(r.Header.Get("X-Api-Version")).To(Equal("2"))
+			Expect(r.Header.Get("Authorization")).To(Equal("Basic c2VjcmV0"))
+			Expect(r.Header.Get("Cookie")).To(Equal("session=s3ss10n"))
+		}
+		klog.Flush()
+		Expect(logs.String()).To(ContainSubstring("X-Request-Source: test"))
+		Expect(logs.String()).To(ContainSubstring("Authorization: *****"))
+		Expect(logs.String()).To(ContainSubstring("Cookie: *****"))
+		Expect(logs.String()).NotTo(ContainSubstring("c2VjcmV0"))
+		Expect(logs.String()).NotTo(ContainSubstring("s3ss10n"))
+	})
+
+	It("should let a User-Agent extra header replace the default User-Agent", func() {
+		os.Setenv(common.ImporterExtraHeader+"2", "User-Agent: env-agent")
+		defer os.Unsetenv(common.ImporterExtraHeader + "2")
+		dp, err := NewHTTPDataSource(ts.URL+"/disk.img", "", "", "", cdiv1.DataVolumeKubeVirt)
+		Expect(err).NotTo(HaveOccurred())
+		defer dp.Close()
+		lock.Lock()
+		defer lock.Unlock()
+		for _, r := range requests {
+			Expect(r.Header.Values("User-Agent")).To(Equal([]string{"env-agent"}))
+		}
+	})
+
+	It("should fail on an invalid header without leaking secrets", func() {
+		Expect(ioutil.WriteFile(filepath.Join(headersDir, "0", "..data", "token"), []byte("secret-value"), 0644)).To(Succeed())
+		_, err := NewHTTPDataSource(ts.URL+"/disk.img", "", "", "", cdiv1.DataVolumeKubeVirt)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).NotTo(ContainSubstring("secret-value"))
+	})
+})
+
+var _ = Describe("Http authentication", func() {
+	var (
+		ts   *httptest.Server
+		logs *bytes.Buffer
+	)
+
+	// authServer returns a server answering 401 with the challenge to the requests that authorized isn't true for.
+	authServer := func(challenge string, authorized func(r *http.Request) bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !authorized(r) {
+				w.Header().Set("WWW-Authenticate", challenge)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			http.ServeContent(w, r, "disk.img", time.Time{}, strings.NewReader(strings.Repeat("\x00", 4096)))
+		}))
+	}
+	basicAuthServer := func() *httptest.Server {
+		return authServer(`Basic realm="images"`, func(r *http.Request) bool {
+			user, pass, ok := r.BasicAuth()
+			return ok && user == "user" && pass == "s3cr3t"
+		})
+	}
+	bearerAuthServer := func() *httptest.Server {
+		return authServer(`Bearer realm="images"`, func(r *http.Request) bool {
+			return r.Header.Get("Authorization") == "Bearer t0ken"
+		})
+	}
+
+	BeforeEach(func() {
+		createNbdkitCurl = image.NewMockNbdkitCurl
+		logs = &bytes.Buffer{}
+		klog.LogToStderr(false)
+		klog.SetOutput(logs)
+		var level klog.Level
+		level.Set("3")
+	})
+
+	AfterEach(func() {
+		var level klog.Level
+		level.Set("0")
+		klog.SetOutput(os.Stderr)
+		klog.LogToStderr(true)
+		createNbdkitCurl = image.NewNbdkitCurl
+		if ts != nil {
+			ts.Close()
+		}
+	})
+
+	It("should send basic auth credentials", func() {
+		ts = basicAuthServer()
+		dp, err := NewHTTPDataSource(ts.URL+"/disk.img", "user", "s3cr3t", "", cdiv1.DataVolumeKubeVirt)
+		Expect(err).NotTo(HaveOccurred())
+		defer dp.Close()
+		Expect(dp.contentLength).To(Equal(uint64(4096)))
+	})
+
+	It("should redact the basic auth credentials of the endpoint in the logs", func() {
+		ts = basicAuthServer()
+		ep, err := url.Parse(ts.URL + "/disk.img")
+		Expect(err).NotTo(HaveOccurred())
+		ep.User = url.UserPassword("user", "s3cr3t")
+		dp, err := NewHTTPDataSource(ep.String(), "", "", "", cdiv1.DataVolumeKubeVirt)
+		Expect(err).NotTo(HaveOccurred())
+		defer dp.Close()
+		klog.Flush()
+		Expect(logs.String()).To(ContainSubstring("user:REDACTED@"))
+		Expect(logs.String()).NotTo(ContainSubstring("s3cr3t"))
+	})
+
+	It("should send a bearer token, and redact it in the logs", func() {
+		ts = bearerAuthServer()
+		dp, err := NewHTTPDataSourceWithOptions(ts.URL+"/disk.img", "", "", "", cdiv1.DataVolumeKubeVirt, HTTPOptions{BearerToken: "t0ken"})
+		Expect(err).NotTo(HaveOccurred())
+		defer dp.Close()
+		Expect(dp.contentLength).To(Equal(uint64(4096)))
+		klog.Flush()
+		Expect(logs.String()).To(ContainSubstring("Authorization: *****"))
+		Expect(logs.String()).NotTo(ContainSubstring("t0ken"))
+	})
+
+	It("should not combine basic auth credentials and a bearer token", func() {
+		ts = bearerAuthServer()
+		_, err := NewHTTPDataSourceWithOptions(ts.URL+"/disk.img", "user", "s3cr3t", "", cdiv1.DataVolumeKubeVirt, HTTPOptions{BearerToken: "t0ken"})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("not both"))
+	})
+
+	table.DescribeTable("should fail with", func(server func() *httptest.Server, accessKey, secKey, token string, expected error, message string) {
+		ts = server()
+		_, err := NewHTTPDataSourceWithOptions(ts.URL+"/disk.img?sig=abc", accessKey, secKey, "", cdiv1.DataVolumeKubeVirt, HTTPOptions{BearerToken: token})
+		Expect(err).To(HaveOccurred())
+		Expect(errors.Cause(err)).To(Equal(expected))
+		Expect(err.Error()).To(ContainSubstring(message))
+		Expect(err.Error()).NotTo(ContainSubstring("sig=abc"))
+	},
+		table.Entry("authentication required without basic auth credentials", basicAuthServer, "", "", "", ErrHTTPAuthenticationRequired, "it expects Basic credentials"),
+		table.Entry("authentication failed with wrong basic auth credentials", basicAuthServer, "user", "wrong", "", ErrHTTPAuthenticationFailed, "401 Unauthorized"),
+		table.Entry("authentication required without bearer token", bearerAuthServer, "", "", "", ErrHTTPAuthenticationRequired, "it expects Bearer credentials"),
+		table.Entry("authentication failed with a wrong bearer token", bearerAuthServer, "", "", "wrong", ErrHTTPAuthenticationFailed, "401 Unauthorized"),
+	)
+})
+
 func createTestServer(imageDir string) *httptest.Server {
 	return httptest.NewServer(http.FileServer(http.Dir(imageDir)))
 }
@@ -0,0 +1,123 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+)
+
+// rangedHeadSize is the number of bytes of the ranged GET reading the head of the object, enough to detect the
+// format and read the image headers.
+const rangedHeadSize = 64 * 1024
+
+// httpRangeReader reads the head of an object with a ranged GET, and the rest of the object with a second ranged GET
+// once the head is consumed.
+type httpRangeReader struct {
+	// get sends a GET request with the Range header, if not empty
+	get  func(byteRange string) (*http.Response, error)
+	body io.ReadCloser
+	// offset is the number of bytes read
+	offset int64
+	// complete is true once body reads until the end of the object
+	complete bool
+}
+
+func newHTTPRangeReader(get func(byteRange string) (*http.Response, error)) *httpRangeReader {
+	return &httpRangeReader{get: get}
+}
+
+// Read reads from the head of the object, opening the rest of the object when the head is consumed.
+func (r *httpRangeReader) Read(p []byte) (int, error) {
+	if r.body == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && !r.complete {
+		r.body.Close()
+		r.body = nil
+		err = nil
+		if n == 0 {
+			return r.Read(p)
+		}
+	}
+	return n, err
+}
+
+// open requests the head of the object first, and the rest of the object from the current offset afterwards.
+func (r *httpRangeReader) open() error {
+	byteRange := fmt.Sprintf("bytes=%d-", r.offset)
+	if r.offset == 0 {
+		byteRange = fmt.Sprintf("bytes=0-%d", rangedHeadSize-1)
+	}
+	klog.V(2).Infof("Requesting %s of the object", byteRange)
+	resp, err := r.get(byteRange)
+	if err != nil {
+		return errors.Wrap(err, "HTTP request errored")
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// The head may reach the end of the object already.
+		var start, end, size int64
+		_, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size)
+		if err == nil && start != r.offset {
+			resp.Body.Close()
+			return errors.Errorf("requested %s, got the byte range %s", byteRange, resp.Header.Get("Content-Range"))
+		}
+		r.complete = r.offset > 0 || (err == nil && end+1 >= size)
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The head was the whole object.
+		resp.Body.Close()
+		r.body = http.NoBody
+		r.complete = true
+		return nil
+	case http.StatusOK:
+		// The server ignored the range and sends the whole object, skip what was already read.
+		klog.V(2).Infof("Byte range ignored, skipping %d bytes", r.offset)
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, r.offset); err != nil {
+			resp.Body.Close()
+			return errors.Wrap(err, "unable to skip the head of the object")
+		}
+		r.complete = true
+	default:
+		if err := checkHTTPUnauthorized(resp); err != nil {
+			return err
+		}
+		if err := checkPresignedURLExpiry(resp); err != nil {
+			return err
+		}
+		return errors.Errorf("expected status code 206, got %d. Status: %s", resp.StatusCode, resp.Status)
+	}
+	r.body = resp.Body
+	return nil
+}
+
+// Close closes the open response body.
+func (r *httpRangeReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
@@ -0,0 +1,229 @@
+package importer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+
+	cdiv1 "kubevirt.io/containerized-data-importer/pkg/apis/core/v1beta1"
+	"kubevirt.io/containerized-data-importer/pkg/image"
+)
+
+// recordedRequest is the method and the Range header of a request.
+type recordedRequest struct {
+	method    string
+	byteRange string
+}
+
+// requestRecorder records the requests passed to its handler.
+type requestRecorder struct {
+	mutex    sync.Mutex
+	requests []recordedRequest
+	handler  http.Handler
+}
+
+func (r *requestRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	r.requests = append(r.requests, recordedRequest{req.Method, req.Header.Get("Range")})
+	r.mutex.Unlock()
+	r.handler.ServeHTTP(w, req)
+}
+
+func (r *requestRecorder) recorded() []recordedRequest {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]recordedRequest(nil), r.requests...)
+}
+
+// ignoreRanges serves whole files, without Accept-Ranges header.
+func ignoreRanges(w http.ResponseWriter, req *http.Request) {
+	data, err := ioutil.ReadFile(filepath.Join(imageDir, req.URL.Path))
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	w.Write(data)
+}
+
+var _ = Describe("Ranged format detection", func() {
+	var (
+		ts       *httptest.Server
+		recorder *requestRecorder
+		hs       *HTTPDataSource
+		tmpDir   string
+	)
+	ranged := HTTPOptions{RangedFormatDetection: true}
+
+	BeforeEach(func() {
+		var err error
+		createNbdkitCurl = image.NewMockNbdkitCurl
+		recorder = &requestRecorder{handler: http.FileServer(http.Dir(imageDir))}
+		ts = httptest.NewServer(recorder)
+		tmpDir, err = ioutil.TempDir("", "ranged")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		if hs != nil {
+			Expect(hs.Close()).To(Succeed())
+			hs = nil
+		}
+		ts.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should only request the head of the object during Info", func() {
+		var err error
+		hs, err = NewHTTPDataSourceWithOptions(ts.URL+"/"+cirrosFileName, "", "", "", cdiv1.DataVolumeKubeVirt, ranged)
+		Expect(err).NotTo(HaveOccurred())
+		phase, err := hs.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(phase).To(Equal(ProcessingPhaseConvert))
+		Expect(recorder.recorded()).To(Equal([]recordedRequest{
+			{http.MethodHead, ""},
+			{http.MethodGet, "bytes=0-65535"},
+		}))
+		Expect(hs.readers.Convert).To(BeTrue())
+	})
+
+	It("should request the rest of the object when Transfer begins", func() {
+		var err error
+		hs, err = NewHTTPDataSourceWithOptions(ts.URL+"/"+cirrosFileName, "", "", "", cdiv1.DataVolumeKubeVirt, ranged)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = hs.Info()
+		Expect(err).NotTo(HaveOccurred())
+		phase, err := hs.Transfer(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(phase).To(Equal(ProcessingPhaseConvert))
+		Expect(recorder.recorded()).To(Equal([]recordedRequest{
+			{http.MethodHead, ""},
+			{http.MethodGet, "bytes=0-65535"},
+			{http.MethodGet, "bytes=65536-"},
+		}))
+		data, err := ioutil.ReadFile(filepath.Join(tmpDir, tempFile))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(Equal(cirrosData))
+	})
+
+	It("should report a presigned URL expiring after the head of the object", func() {
+		var err error
+		recorder.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet && r.Header.Get("Range") != "bytes=0-65535" {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("<Error><Code>AccessDenied</Code><Message>Request has expired</Message></Error>"))
+				return
+			}
+			http.FileServer(http.Dir(imageDir)).ServeHTTP(w, r)
+		})
+		hs, err = NewHTTPDataSourceWithOptions(ts.URL+"/"+cirrosFileName, "", "", "", cdiv1.DataVolumeKubeVirt, ranged)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = hs.Info()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = hs.Transfer(tmpDir)
+		Expect(err).To(HaveOccurred())
+		Expect(errors.Cause(err)).To(Equal(ErrPresignedURLExpired))
+	})
+
+	It("should open the full object of endpoints without byte ranges", func() {
+		var err error
+		recorder.handler = http.HandlerFunc(ignoreRanges)
+		hs, err = NewHTTPDataSourceWithOptions(ts.URL+"/"+cirrosFileName, "", "", "", cdiv1.DataVolumeKubeVirt, ranged)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = hs.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(recorder.recorded()).To(Equal([]recordedRequest{
+			{http.MethodHead, ""},
+			{http.MethodGet, ""},
+		}))
+	})
+
+	It("should open the full object without ranged format detection", func() {
+		var err error
+		hs, err = NewHTTPDataSource(ts.URL+"/"+cirrosFileName, "", "", "", cdiv1.DataVolumeKubeVirt)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = hs.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(recorder.recorded()).To(Equal([]recordedRequest{
+			{http.MethodHead, ""},
+			{http.MethodGet, ""},
+		}))
+	})
+})
+
+var _ = Describe("Http range reader", func() {
+	var (
+		ts       *httptest.Server
+		recorder *requestRecorder
+	)
+
+	BeforeEach(func() {
+		recorder = &requestRecorder{handler: http.FileServer(http.Dir(imageDir))}
+		ts = httptest.NewServer(recorder)
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	get := func(path string) func(string) (*http.Response, error) {
+		return func(byteRange string) (*http.Response, error) {
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/"+path, nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Range", byteRange)
+			return http.DefaultClient.Do(req)
+		}
+	}
+
+	It("should read an object smaller than the head with a single request", func() {
+		reader := newHTTPRangeReader(get("content.tar"))
+		data, err := ioutil.ReadAll(reader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reader.Close()).To(Succeed())
+		expected, err := ioutil.ReadFile(filepath.Join(imageDir, "content.tar"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(Equal(expected))
+		Expect(recorder.recorded()).To(Equal([]recordedRequest{{http.MethodGet, "bytes=0-65535"}}))
+	})
+
+	It("should skip the head if the server ignores the range of the rest of the object", func() {
+		reader := newHTTPRangeReader(get(cirrosFileName))
+		head := make([]byte, 1024)
+		n, err := reader.Read(head)
+		Expect(err).NotTo(HaveOccurred())
+		head = head[:n]
+		recorder.handler = http.HandlerFunc(ignoreRanges)
+		data, err := ioutil.ReadAll(reader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reader.Close()).To(Succeed())
+		Expect(append(head, data...)).To(Equal(cirrosData))
+	})
+
+	It("should fail on an error status", func() {
+		reader := newHTTPRangeReader(get("missing"))
+		_, err := ioutil.ReadAll(reader)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("expected status code 206, got 404"))
+	})
+
+	It("should fail if the server answers with another byte range", func() {
+		reader := newHTTPRangeReader(get(cirrosFileName))
+		_, err := reader.Read(make([]byte, 1024))
+		Expect(err).NotTo(HaveOccurred())
+		recorder.handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-99/%d", len(cirrosData)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(cirrosData[:100])
+		})
+		_, err = ioutil.ReadAll(reader)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("requested bytes=65536-, got the byte range bytes 0-99/"))
+	})
+})
@@ -0,0 +1,181 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"encoding/binary"
+	"io"
+	"net/url"
+	"os"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+
+	"kubevirt.io/containerized-data-importer/pkg/image"
+)
+
+const (
+	// qcow2HeaderV2Size is the size of the header of version 2 qcow2 images, version 3 headers are longer.
+	qcow2HeaderV2Size = 72
+	// qcow2HeaderV3Size is the size of the header of version 3 qcow2 images, up to the header length field.
+	qcow2HeaderV3Size = 104
+	// qcow2MaxL1Size is the largest L1 table qemu opens, in bytes.
+	qcow2MaxL1Size = 32 * 1024 * 1024
+	// qcow2OffsetMask masks the host offset of the L1 and uncompressed L2 table entries.
+	qcow2OffsetMask = 0x00fffffffffffe00
+	// qcow2CompressedFlag is the flag of the L2 table entries of compressed clusters.
+	qcow2CompressedFlag = 1 << 62
+	// qcow2CorruptBit is the incompatible feature bit of the images qemu found corrupt.
+	qcow2CorruptBit = 1 << 1
+	// qcow2ExternalDataBit is the incompatible feature bit of the images whose data clusters are in another file.
+	qcow2ExternalDataBit = 1 << 2
+	// qcow2CompressionTypeBit is the incompatible feature bit of the images with a compression type other than zlib.
+	qcow2CompressionTypeBit = 1 << 3
+	// qcow2ExtendedL2Bit is the incompatible feature bit of the images with 16 byte L2 table entries.
+	qcow2ExtendedL2Bit = 1 << 4
+	// qcow2CompressionZstd is the zstd compression type of the header, zlib is 0.
+	qcow2CompressionZstd = 1
+)
+
+// verifyTransferredImage fails if the image file of url, transferred to scratch space, doesn't have the format
+// expectedFormat detected by Info, or if it is a qcow2 image whose tables point beyond the end of the file. An empty
+// expectedFormat accepts any format. Images that aren't local files aren't verified.
+func verifyTransferredImage(url *url.URL, expectedFormat string) error {
+	if url.Scheme != "" && url.Scheme != "file" {
+		klog.V(1).Infof("Not verifying %s, it isn't a local file", url)
+		return nil
+	}
+	f, err := os.Open(url.Path)
+	if err != nil {
+		return errors.Wrapf(err, "could not open transferred image %s", url.Path)
+	}
+	defer f.Close()
+	format, err := detectFileFormat(f)
+	if err != nil {
+		return errors.Wrapf(err, "could not read the header of transferred image %s", url.Path)
+	}
+	if expectedFormat != "" && format != expectedFormat {
+		if format == "" {
+			format = "raw"
+		}
+		return errors.Errorf("transferred image %s is %s, %s was detected in the source", url.Path, format, expectedFormat)
+	}
+	if format == "qcow2" {
+		if err := validateQcow2Structure(f); err != nil {
+			return errors.Wrapf(err, "transferred image %s is corrupt or incomplete", url.Path)
+		}
+	}
+	return nil
+}
+
+// detectFileFormat returns the format of the image header at the start of f, empty if no known header was found.
+func detectFileFormat(f *os.File) (string, error) {
+	buf := make([]byte, image.MaxExpectedHdrSize)
+	if _, err := f.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return "", err
+	}
+	if detection := detectFormat(buf, nil); detection != nil && detection.Format != formatRaw {
+		return detection.Format, nil
+	}
+	return "", nil
+}
+
+// validateQcow2Structure checks that the header, the L1, L2 and refcount tables of the qcow2 image f are within the
+// file, and that the clusters the L2 tables map start within the file. It reads the metadata of the image only, an
+// image truncated by an incomplete transfer loses the tables or the clusters at its end.
+func validateQcow2Structure(f *os.File) error {
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+	header := make([]byte, qcow2HeaderV3Size)
+	n, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n < qcow2HeaderV2Size {
+		return errors.Errorf("the header is truncated at %d bytes", n)
+	}
+	version := binary.BigEndian.Uint32(header[4:])
+	var incompatible uint64
+	if version >= 3 {
+		if n < qcow2HeaderV3Size {
+			return errors.Errorf("the version %d header is truncated at %d bytes", version, n)
+		}
+		incompatible = binary.BigEndian.Uint64(header[72:])
+	}
+	if incompatible&qcow2CorruptBit != 0 {
+		return errors.New("the image is marked corrupt")
+	}
+	clusterBits := binary.BigEndian.Uint32(header[20:])
+	if clusterBits < 9 || clusterBits > 21 {
+		return errors.Errorf("invalid cluster bits %d", clusterBits)
+	}
+	clusterSize := int64(1) << clusterBits
+	l1Entries := int64(binary.BigEndian.Uint32(header[36:]))
+	l1Offset := int64(binary.BigEndian.Uint64(header[40:]))
+	refcountOffset := int64(binary.BigEndian.Uint64(header[48:]))
+	refcountClusters := int64(binary.BigEndian.Uint32(header[56:]))
+	if l1Entries*8 > qcow2MaxL1Size {
+		return errors.Errorf("the L1 table of %d entries is too large", l1Entries)
+	}
+	if refcountOffset+refcountClusters*clusterSize > size {
+		return errors.Errorf("the refcount table at offset %d is beyond the end of the file at %d", refcountOffset, size)
+	}
+	if l1Offset+l1Entries*8 > size {
+		return errors.Errorf("the L1 table at offset %d is beyond the end of the file at %d", l1Offset, size)
+	}
+	l1 := make([]byte, l1Entries*8)
+	if _, err := f.ReadAt(l1, l1Offset); err != nil {
+		return errors.Wrap(err, "could not read the L1 table")
+	}
+	l2EntrySize := int64(8)
+	if incompatible&qcow2ExtendedL2Bit != 0 {
+		l2EntrySize = 16
+	}
+	// The data clusters of images with an external data file aren't in f.
+	checkData := incompatible&qcow2ExternalDataBit == 0
+	compressedOffsetMask := uint64(1)<<(62-(clusterBits-8)) - 1
+	l2 := make([]byte, clusterSize)
+	for i := int64(0); i < l1Entries; i++ {
+		l2Offset := int64(binary.BigEndian.Uint64(l1[i*8:]) & qcow2OffsetMask)
+		if l2Offset == 0 {
+			continue
+		}
+		if l2Offset+clusterSize > size {
+			return errors.Errorf("the L2 table at offset %d is beyond the end of the file at %d", l2Offset, size)
+		}
+		if !checkData {
+			continue
+		}
+		if _, err := f.ReadAt(l2, l2Offset); err != nil {
+			return errors.Wrapf(err, "could not read the L2 table at offset %d", l2Offset)
+		}
+		for j := int64(0); j < clusterSize; j += l2EntrySize {
+			entry := binary.BigEndian.Uint64(l2[j:])
+			offset := int64(entry & qcow2OffsetMask)
+			if entry&qcow2CompressedFlag != 0 {
+				offset = int64(entry & compressedOffsetMask)
+			}
+			if offset >= size {
+				return errors.Errorf("the cluster at offset %d is beyond the end of the file at %d", offset, size)
+			}
+		}
+	}
+	return nil
+}
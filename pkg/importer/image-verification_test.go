@@ -0,0 +1,114 @@
+package importer
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+)
+
+// probedMockDataProvider is a MockDataProvider whose Info detected format.
+type probedMockDataProvider struct {
+	MockDataProvider
+	format string
+}
+
+func (m *probedMockDataProvider) probe() (*FormatReaders, int64) {
+	return &FormatReaders{Format: m.format}, 0
+}
+
+var _ = Describe("Transferred image verification", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "verification")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	// writeImage writes data to a file of tmpDir and returns its url.
+	writeImage := func(data []byte) *url.URL {
+		fileName := filepath.Join(tmpDir, "disk.img")
+		Expect(ioutil.WriteFile(fileName, data, 0644)).To(Succeed())
+		u, err := url.Parse(fileName)
+		Expect(err).NotTo(HaveOccurred())
+		return u
+	}
+
+	It("should accept a complete qcow2 image", func() {
+		Expect(verifyTransferredImage(writeImage(cirrosData), "qcow2")).To(Succeed())
+	})
+
+	It("should accept a raw image of an unknown format", func() {
+		Expect(verifyTransferredImage(writeImage(make([]byte, 4096)), "")).To(Succeed())
+	})
+
+	table.DescribeTable("should reject", func(data func() []byte, expectedFormat, message string) {
+		err := verifyTransferredImage(writeImage(data()), expectedFormat)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(message))
+	},
+		table.Entry("a truncated qcow2 image", func() []byte {
+			return cirrosData[:len(cirrosData)/2]
+		}, "qcow2", "is beyond the end of the file"),
+		table.Entry("a truncated qcow2 header", func() []byte {
+			return cirrosData[:64]
+		}, "qcow2", "the header is truncated"),
+		table.Entry("a qcow2 image marked corrupt", func() []byte {
+			data := append([]byte{}, cirrosData...)
+			binary.BigEndian.PutUint64(data[72:], qcow2CorruptBit)
+			return data
+		}, "qcow2", "the image is marked corrupt"),
+		table.Entry("a raw image when a qcow2 image was detected", func() []byte {
+			return make([]byte, 4096)
+		}, "qcow2", "is raw, qcow2 was detected in the source"),
+		table.Entry("a qcow2 image when a vmdk image was detected", func() []byte {
+			return cirrosData
+		}, "vmdk", "is qcow2, vmdk was detected in the source"),
+	)
+
+	It("should not verify images that aren't local files", func() {
+		u, err := url.Parse("nbd+unix:///?socket=/tmp/nbdkit.sock")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(verifyTransferredImage(u, "qcow2")).To(Succeed())
+	})
+
+	It("should fail the conversion of a truncated qcow2 image before qemu-img reads it", func() {
+		mdp := &probedMockDataProvider{
+			MockDataProvider: MockDataProvider{url: writeImage(cirrosData[:len(cirrosData)/2])},
+			format:           "qcow2",
+		}
+		dp := NewDataProcessor(mdp, "dest", "dataDir", tmpDir, "1G", 0.055, false)
+		dp.SetTransferVerification(true)
+		replaceQEMUOperations(NewQEMUAllErrors(), func() {
+			nextPhase, err := dp.convert(mdp.GetURL())
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("is corrupt or incomplete"))
+			Expect(nextPhase).To(Equal(ProcessingPhaseError))
+		})
+	})
+
+	It("should not verify the transferred image by default", func() {
+		mdp := &probedMockDataProvider{
+			MockDataProvider: MockDataProvider{url: writeImage(cirrosData[:len(cirrosData)/2])},
+			format:           "qcow2",
+		}
+		dp := NewDataProcessor(mdp, "dest", "dataDir", tmpDir, "1G", 0.055, false)
+		qemuOperations := NewFakeQEMUOperations(errors.New("qemu-img convert failed"), nil, fakeInfoOpRetVal{&fakeZeroImageInfo, nil}, nil, nil, nil)
+		replaceQEMUOperations(qemuOperations, func() {
+			_, err := dp.convert(mdp.GetURL())
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("qemu-img convert failed"))
+		})
+	})
+})
@@ -38,6 +38,8 @@ import (
 
 // ImageioDataSource is the data provider for ovirt-imageio.
 type ImageioDataSource struct {
+	sourceSizeLimits
+	sourceStreamOptions
 	imageioReader io.ReadCloser
 	ctx           context.Context
 	cancel        context.CancelFunc
@@ -54,21 +56,40 @@ type ImageioDataSource struct {
 	connection ConnectionInterface
 }
 
+// ImageioOptions are the options of the ovirt-imageio data provider.
+type ImageioOptions struct {
+	// PinnedSPKIHashes fail the TLS handshake unless a certificate of the chain presented by the imageio daemon has
+	// one of the pinned subject public key infos, on top of the CA validation. No pins disable pinning.
+	PinnedSPKIHashes []string
+	SourceOptions
+}
+
 // NewImageioDataSource creates a new instance of the ovirt-imageio data provider.
 func NewImageioDataSource(endpoint string, accessKey string, secKey string, certDir string, diskID string) (*ImageioDataSource, error) {
+	return NewImageioDataSourceWithOptions(endpoint, accessKey, secKey, certDir, diskID, ImageioOptions{})
+}
+
+// NewImageioDataSourceWithOptions creates a new instance of the ovirt-imageio data provider with options.
+func NewImageioDataSourceWithOptions(endpoint, accessKey, secKey, certDir, diskID string, options ImageioOptions) (*ImageioDataSource, error) {
+	pins, err := parseSPKIPins(options.PinnedSPKIHashes)
+	if err != nil {
+		return nil, err
+	}
 	ctx, cancel := context.WithCancel(context.Background())
-	imageioReader, contentLength, it, conn, err := createImageioReader(ctx, endpoint, accessKey, secKey, certDir, diskID)
+	imageioReader, contentLength, it, conn, err := createImageioReader(ctx, endpoint, accessKey, secKey, certDir, pins, diskID)
 	if err != nil {
 		cancel()
 		return nil, err
 	}
 	imageioSource := &ImageioDataSource{
-		ctx:           ctx,
-		cancel:        cancel,
-		imageioReader: imageioReader,
-		contentLength: contentLength,
-		imageTransfer: it,
-		connection:    conn,
+		sourceSizeLimits:    options.sizeLimits(),
+		sourceStreamOptions: options.streamOptions(),
+		ctx:                 ctx,
+		cancel:              cancel,
+		imageioReader:       imageioReader,
+		contentLength:       contentLength,
+		imageTransfer:       it,
+		connection:          conn,
 	}
 	// We know this is a counting reader, so no need to check.
 	countingReader := imageioReader.(*util.CountingReader)
@@ -94,7 +115,7 @@ func NewImageioDataSource(endpoint string, accessKey string, secKey string, cert
 // Info is called to get initial information about the data.
 func (is *ImageioDataSource) Info() (ProcessingPhase, error) {
 	var err error
-	is.readers, err = NewFormatReaders(is.imageioReader, is.contentLength)
+	is.readers, err = newFormatReaders(is.imageioReader, is.contentLength, is.sourceSizeLimits, sourceVerification{})
 	if err != nil {
 		klog.Errorf("Error creating readers: %v", err)
 		return ProcessingPhaseError, err
@@ -115,7 +136,7 @@ func (is *ImageioDataSource) Transfer(path string) (ProcessingPhase, error) {
 		return ProcessingPhaseError, ErrInvalidPath
 	}
 	file := filepath.Join(path, tempFile)
-	err := util.StreamDataToFile(is.readers.TopReader(), file)
+	err := util.StreamDataToFileWithSize(is.readers.TopReader(), file, -1, is.streamOptions())
 	if err != nil {
 		return ProcessingPhaseError, err
 	}
@@ -127,7 +148,7 @@ func (is *ImageioDataSource) Transfer(path string) (ProcessingPhase, error) {
 // TransferFile is called to transfer the data from the source to the passed in file.
 func (is *ImageioDataSource) TransferFile(fileName string) (ProcessingPhase, error) {
 	is.readers.StartProgressUpdate()
-	err := util.StreamDataToFile(is.readers.TopReader(), fileName)
+	err := util.StreamDataToFileWithSize(is.readers.TopReader(), fileName, -1, is.streamOptions())
 	if err != nil {
 		return ProcessingPhaseError, err
 	}
@@ -139,6 +160,10 @@ func (is *ImageioDataSource) GetURL() *url.URL {
 	return is.url
 }
 
+func (is *ImageioDataSource) formatReaders() *FormatReaders {
+	return is.readers
+}
+
 // Close all readers.
 func (is *ImageioDataSource) Close() error {
 	var err error
@@ -196,7 +221,7 @@ func (is *ImageioDataSource) pollProgress(reader *util.CountingReader, idleTime,
 	}
 }
 
-func createImageioReader(ctx context.Context, ep string, accessKey string, secKey string, certDir string, diskID string) (io.ReadCloser, uint64, *ovirtsdk4.ImageTransfer, ConnectionInterface, error) {
+func createImageioReader(ctx context.Context, ep string, accessKey string, secKey string, certDir string, pins spkiPins, diskID string) (io.ReadCloser, uint64, *ovirtsdk4.ImageTransfer, ConnectionInterface, error) {
 	conn, err := newOvirtClientFunc(ep, accessKey, secKey)
 	if err != nil {
 		return nil, uint64(0), nil, conn, errors.Wrap(err, "Error creating connection")
@@ -208,7 +233,7 @@ func createImageioReader(ctx context.Context, ep string, accessKey string, secKe
 	}
 
 	// Use the create client from http source.
-	client, err := createHTTPClient(certDir)
+	client, err := createHTTPClient(certDir, pins)
 	if err != nil {
 		cancelTransfer(conn, it)
 		return nil, uint64(0), it, conn, err
@@ -56,13 +56,13 @@ var _ = Describe("Imageio reader", func() {
 
 	It("should fail creating client", func() {
 		newOvirtClientFunc = failMockOvirtClient
-		_, total, _, _, err := createImageioReader(context.Background(), "invalid/", "", "", "", "")
+		_, total, _, _, err := createImageioReader(context.Background(), "invalid/", "", "", "", nil, "")
 		Expect(err).To(HaveOccurred())
 		Expect(uint64(0)).To(Equal(total))
 	})
 
 	It("should create reader", func() {
-		reader, total, _, _, err := createImageioReader(context.Background(), "", "", "", tempDir, "")
+		reader, total, _, _, err := createImageioReader(context.Background(), "", "", "", tempDir, nil, "")
 		Expect(err).ToNot(HaveOccurred())
 		Expect(uint64(1024)).To(Equal(total))
 		err = reader.Close()
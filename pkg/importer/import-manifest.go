@@ -0,0 +1,161 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"k8s.io/klog/v2"
+
+	"kubevirt.io/containerized-data-importer/pkg/util"
+)
+
+// ImportManifestVersion is the version of the import manifest schema. Fields are only added within a version.
+const ImportManifestVersion = "v1"
+
+const (
+	// ManifestTransformDecompress is the transform recording the decompression of the source.
+	ManifestTransformDecompress = "decompress"
+	// ManifestTransformExtract is the transform recording the extraction of the image from an archive.
+	ManifestTransformExtract = "extract"
+)
+
+// ImportManifest describes what was imported: the source, the transforms applied to it, and the resulting image.
+type ImportManifest struct {
+	// Version is the version of the manifest schema.
+	Version string `json:"version"`
+	// Source identifies the imported data.
+	Source ImportManifestSource `json:"source"`
+	// Transforms lists the transforms applied to the source, in order.
+	Transforms []ImportManifestTransform `json:"transforms"`
+	// DetectedFormat is the image format found after the transforms, empty if the image wasn't converted.
+	DetectedFormat string `json:"detectedFormat,omitempty"`
+	// TargetFormat is the format of the imported image.
+	TargetFormat string `json:"targetFormat"`
+	// SourceSize is the number of bytes fetched from the source, 0 if unknown.
+	SourceSize int64 `json:"sourceSize,omitempty"`
+	// TargetSize is the size of the imported image.
+	TargetSize int64 `json:"targetSize"`
+	// Checksum is the checksum of the imported image, as <algorithm>:<hex>.
+	Checksum string `json:"checksum"`
+}
+
+// ImportManifestSource identifies the imported data.
+type ImportManifestSource struct {
+	// URL is the source endpoint, without credentials.
+	URL string `json:"url"`
+	// Digest is the resolved content digest, for sources addressed by digest.
+	Digest string `json:"digest,omitempty"`
+	// ETag is the version of the content reported by the source.
+	ETag string `json:"etag,omitempty"`
+	// Range is the byte range of the source imported, in the form bytes=<first>-<last>, empty for the whole source.
+	Range string `json:"range,omitempty"`
+	// Metadata is the metadata of the source object, like its content type, for the sources exposing it.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// ImportManifestTransform is a transform applied to the source data.
+type ImportManifestTransform struct {
+	// Type is the transform type, decompress or extract.
+	Type string `json:"type"`
+	// Format is the compression or archive format.
+	Format string `json:"format,omitempty"`
+	// Member is the name of the extracted archive member.
+	Member string `json:"member,omitempty"`
+}
+
+// manifestSource is implemented by the data sources describing their source and transforms in the import manifest.
+type manifestSource interface {
+	addToManifest(manifest *ImportManifest)
+}
+
+// newImportManifest returns an empty manifest of the current version.
+func newImportManifest() *ImportManifest {
+	return &ImportManifest{
+		Version:    ImportManifestVersion,
+		Transforms: []ImportManifestTransform{},
+	}
+}
+
+// compressionFormat returns the compression removed by the passed in format readers, empty if none.
+func compressionFormat(readers *FormatReaders) string {
+	switch {
+	case readers == nil:
+		return ""
+	case readers.ArchiveGz:
+		return "gz"
+	case readers.ArchiveXz:
+		return "xz"
+	case readers.ArchiveZstd:
+		return "zst"
+	}
+	return ""
+}
+
+// addDecompress records the decompression of the source, if compressed.
+func (m *ImportManifest) addDecompress(format string) {
+	if format != "" {
+		m.Transforms = append(m.Transforms, ImportManifestTransform{Type: ManifestTransformDecompress, Format: format})
+	}
+}
+
+// manifestURL returns the passed in endpoint without credentials, and with the values of its sensitive query
+// parameters redacted.
+func manifestURL(ep *url.URL) string {
+	if ep == nil {
+		return ""
+	}
+	u := *ep
+	u.User = nil
+	return util.RedactURL(u.String())
+}
+
+// checksumFile returns the sha256 checksum and the size of the content of fileName.
+func checksumFile(fileName string) (string, int64, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "unable to open %s", fileName)
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "unable to read %s", fileName)
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// writeImportManifest writes the manifest as JSON to fileName.
+func writeImportManifest(manifest *ImportManifest, fileName string) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal import manifest")
+	}
+	if err := ioutil.WriteFile(fileName, data, 0644); err != nil {
+		return errors.Wrapf(err, "unable to write import manifest %s", fileName)
+	}
+	klog.V(1).Infof("Wrote import manifest %s", fileName)
+	return nil
+}
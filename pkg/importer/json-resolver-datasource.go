@@ -0,0 +1,297 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/util/jsonpath"
+	"k8s.io/klog/v2"
+
+	"kubevirt.io/containerized-data-importer/pkg/util"
+)
+
+// jsonMetadataMaxSize is the maximum size of the metadata document returned by the metadata endpoint.
+const jsonMetadataMaxSize = 1024 * 1024
+
+// JSONResolverDataSource is the data provider for APIs returning the download URL of the image in a JSON metadata
+// document. The metadata endpoint is queried with the token, the download URL and the optional checksum are picked
+// from the document with JSONPath expressions, for instance {.asset.download.url}. The download URL is expected to be
+// signed, it is fetched without credentials and never reported. The data is always streamed to the scratch space or
+// the target, so the checksum covers the whole download.
+// Sequence of phases:
+// 1a. Info -> TransferScratch, if the image needs to be converted.
+// 1b. Info -> TransferDataFile, if the image is raw.
+// 2a. TransferScratch -> Convert
+// 2b. TransferDataFile -> Resize
+type JSONResolverDataSource struct {
+	sourceSizeLimits
+	sourceVerification
+	sourceStreamOptions
+	// endpoint is the metadata endpoint.
+	endpoint *url.URL
+	// checksum is the expected checksum of the download in the form sha256:<hex>, empty if not verified.
+	checksum string
+	// httpReader reads the download.
+	httpReader io.ReadCloser
+	cancel     context.CancelFunc
+	// contentLength is the content length reported by the download server.
+	contentLength uint64
+	// stack of readers
+	readers *FormatReaders
+	// url the url to report to the caller of getURL, a file in scratch space.
+	url *url.URL
+}
+
+// JSONResolverOptions are the options of the JSON resolver data provider.
+type JSONResolverOptions struct {
+	// ChecksumPath is the JSONPath expression of the sha256 checksum of the download in the metadata document, blank
+	// if the download isn't verified.
+	ChecksumPath string
+	// PinnedSPKIHashes fail the TLS handshake with the metadata endpoint and the download server unless a certificate
+	// of the chain they present has one of the pinned subject public key infos. No pins disable pinning.
+	PinnedSPKIHashes []string
+	// RetryAfterBudget is the total time the download waits for the delays asked by the Retry-After headers of 503 and
+	// 429 responses before it is requested again, 0 disables retrying.
+	RetryAfterBudget time.Duration
+	SourceOptions
+}
+
+// NewJSONResolverDataSource creates a new instance of the JSON resolver data provider reading the download URL at
+// urlPath in the metadata document. The token, if not blank, is passed as a bearer token to the metadata endpoint.
+func NewJSONResolverDataSource(endpoint, urlPath, token, certDir string, options JSONResolverOptions) (*JSONResolverDataSource, error) {
+	ep, err := ParseEndpoint(endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, fmt.Sprintf("unable to parse endpoint %q", endpoint))
+	}
+	if urlPath == "" {
+		return nil, errors.New("no JSONPath of the download URL")
+	}
+	pins, err := parseSPKIPins(options.PinnedSPKIHashes)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := getJSONMetadata(ep, token, certDir, pins)
+	if err != nil {
+		return nil, err
+	}
+	downloadURL, err := evaluateJSONPath(metadata, urlPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to resolve the download URL")
+	}
+	var checksum string
+	if options.ChecksumPath != "" {
+		value, err := evaluateJSONPath(metadata, options.ChecksumPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to resolve the checksum")
+		}
+		if checksum, err = parseSHA256Checksum(value); err != nil {
+			return nil, err
+		}
+	}
+	downloadEp, err := ParseEndpoint(downloadURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse the download URL")
+	}
+	if downloadEp.Scheme != "http" && downloadEp.Scheme != "https" {
+		return nil, errors.Errorf("unsupported download URL scheme %q", downloadEp.Scheme)
+	}
+	klog.V(1).Infof("Resolved the download URL of %s, expected checksum %q", manifestURL(ep), checksum)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	httpReader, contentLength, _, _, err := createHTTPReader(ctx, downloadEp, "", "", certDir, pins, withUserAgent(nil, ""), nil, httpReaderOptions{retryAfterBudget: options.RetryAfterBudget})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if checksum != "" {
+		verifyingReader, err := newChecksumVerifyingReader(httpReader, checksum)
+		if err != nil {
+			httpReader.Close()
+			cancel()
+			return nil, err
+		}
+		httpReader = verifyingReader
+	}
+	return &JSONResolverDataSource{
+		sourceSizeLimits:    options.sizeLimits(),
+		sourceStreamOptions: options.streamOptions(),
+		endpoint:            ep,
+		checksum:            checksum,
+		httpReader:          httpReader,
+		cancel:              cancel,
+		contentLength:       contentLength,
+	}, nil
+}
+
+// Info is called to get initial information about the data.
+func (js *JSONResolverDataSource) Info() (ProcessingPhase, error) {
+	var err error
+	js.readers, err = newFormatReaders(js.httpReader, js.contentLength, js.sourceSizeLimits, js.sourceVerification)
+	if err != nil {
+		klog.Errorf("Error creating readers: %v", err)
+		return ProcessingPhaseError, err
+	}
+	if !js.readers.Convert {
+		// Downloading a raw file, we can write that directly to the target.
+		return ProcessingPhaseTransferDataFile, nil
+	}
+	return ProcessingPhaseTransferScratch, nil
+}
+
+// Transfer is called to transfer the data from the source to a scratch location.
+func (js *JSONResolverDataSource) Transfer(path string) (ProcessingPhase, error) {
+	size, _ := util.GetAvailableSpace(path)
+	if size <= int64(0) {
+		//Path provided is invalid.
+		return ProcessingPhaseError, ErrInvalidPath
+	}
+	file := filepath.Join(path, tempFile)
+	js.readers.StartProgressUpdate()
+	err := util.StreamDataToFileWithSize(js.readers.TopReader(), file, -1, js.streamOptions())
+	if err != nil {
+		return ProcessingPhaseError, err
+	}
+	// If streaming succeeded, then parsing the file into URL will also succeed, no need to check error status
+	js.url, _ = url.Parse(file)
+	return ProcessingPhaseConvert, nil
+}
+
+// TransferFile is called to transfer the data from the source to the passed in file.
+func (js *JSONResolverDataSource) TransferFile(fileName string) (ProcessingPhase, error) {
+	js.readers.StartProgressUpdate()
+	err := util.StreamDataToFileWithSize(js.readers.TopReader(), fileName, -1, js.streamOptions())
+	if err != nil {
+		return ProcessingPhaseError, err
+	}
+	return ProcessingPhaseResize, nil
+}
+
+// GetURL returns the url that the data processor can use when converting the data.
+func (js *JSONResolverDataSource) GetURL() *url.URL {
+	return js.url
+}
+
+func (js *JSONResolverDataSource) sourceDigest() (string, error) {
+	return js.readers.sourceDigest()
+}
+
+func (js *JSONResolverDataSource) verifySourceSignature() error {
+	return js.readers.verifySourceSignature()
+}
+
+func (js *JSONResolverDataSource) addToManifest(manifest *ImportManifest) {
+	// The signed download URL is short lived and carries the signature, record the metadata endpoint instead.
+	manifest.Source.URL = manifestURL(js.endpoint)
+	manifest.Source.Digest = js.checksum
+	manifest.SourceSize = int64(js.contentLength)
+	manifest.addDecompress(compressionFormat(js.readers))
+}
+
+func (js *JSONResolverDataSource) formatReaders() *FormatReaders {
+	return js.readers
+}
+
+// Close closes any readers or other open resources.
+func (js *JSONResolverDataSource) Close() error {
+	var err error
+	if js.readers != nil {
+		err = js.readers.Close()
+	}
+	if js.cancel != nil {
+		js.cancel()
+		js.cancel = nil
+	}
+	return err
+}
+
+// getJSONMetadata returns the decoded JSON document of the metadata endpoint.
+func getJSONMetadata(ep *url.URL, token, certDir string, pins spkiPins) (interface{}, error) {
+	client, err := createHTTPClient(certDir, pins)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating http client")
+	}
+	req, err := http.NewRequest(http.MethodGet, ep.String(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not create HTTP request")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", DefaultUserAgent())
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	klog.V(2).Infof("Attempting to get metadata from %q", manifestURL(ep))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "HTTP request errored")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("expected status code 200 from the metadata endpoint, got %d. Status: %s", resp.StatusCode, resp.Status)
+	}
+	var metadata interface{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, jsonMetadataMaxSize)).Decode(&metadata); err != nil {
+		return nil, errors.Wrap(err, "unable to decode the metadata")
+	}
+	return metadata, nil
+}
+
+// evaluateJSONPath returns the single string value the JSONPath expression selects in the document. The braces
+// around the expression are optional.
+func evaluateJSONPath(document interface{}, expression string) (string, error) {
+	if !strings.HasPrefix(expression, "{") {
+		expression = "{" + expression + "}"
+	}
+	parser := jsonpath.New("metadata")
+	if err := parser.Parse(expression); err != nil {
+		return "", errors.Wrapf(err, "invalid JSONPath %q", expression)
+	}
+	results, err := parser.FindResults(document)
+	if err != nil {
+		return "", errors.Wrapf(err, "JSONPath %q doesn't match the metadata", expression)
+	}
+	var values []string
+	for _, result := range results {
+		for _, value := range result {
+			values = append(values, fmt.Sprintf("%v", value.Interface()))
+		}
+	}
+	if len(values) != 1 {
+		return "", errors.Errorf("JSONPath %q selects %d values, expected one", expression, len(values))
+	}
+	return values[0], nil
+}
+
+// parseSHA256Checksum returns the checksum in the form sha256:<hex>, a bare hex value is a sha256 checksum.
+func parseSHA256Checksum(value string) (string, error) {
+	checksum := strings.ToLower(strings.TrimPrefix(value, "sha256:"))
+	if decoded, err := hex.DecodeString(checksum); err != nil || len(decoded) != sha256.Size {
+		return "", errors.Errorf("unsupported checksum %q", value)
+	}
+	return "sha256:" + checksum, nil
+}
@@ -0,0 +1,154 @@
+package importer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	jsonTestToken        = "test-token"
+	jsonTestURLPath      = "{.assets[0].links.download.href}"
+	jsonTestChecksumPath = ".assets[0].checksum"
+)
+
+// jsonResolverTestAPI serves asset metadata on /metadata, and the image on a signed download URL.
+type jsonResolverTestAPI struct {
+	ts       *httptest.Server
+	data     []byte
+	checksum string
+}
+
+func (a *jsonResolverTestAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/metadata":
+		if r.Header.Get("Authorization") != "Bearer "+jsonTestToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"assets": []interface{}{
+				map[string]interface{}{
+					"name":     "cirros",
+					"checksum": a.checksum,
+					"links": map[string]interface{}{
+						"download": map[string]interface{}{
+							"href": a.ts.URL + "/download/cirros?signature=abc",
+						},
+					},
+				},
+			},
+			"next": a.ts.URL + "/metadata?page=2",
+		})
+	case "/download/cirros":
+		if r.URL.Query().Get("signature") != "abc" || r.Header.Get("Authorization") != "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write(a.data)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+var _ = Describe("JSON resolver data source", func() {
+	var (
+		api    *jsonResolverTestAPI
+		js     *JSONResolverDataSource
+		tmpDir string
+		err    error
+	)
+
+	BeforeEach(func() {
+		api = &jsonResolverTestAPI{data: cirrosData, checksum: "sha256:" + sha256Hex(cirrosData)}
+		api.ts = httptest.NewServer(api)
+		tmpDir, err = ioutil.TempDir("", "scratch")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		if js != nil {
+			js.Close()
+			js = nil
+		}
+		api.ts.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should resolve the nested download URL and transfer the verified image", func() {
+		js, err = NewJSONResolverDataSource(api.ts.URL+"/metadata", jsonTestURLPath, jsonTestToken, "", JSONResolverOptions{ChecksumPath: jsonTestChecksumPath})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := js.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseTransferScratch))
+		result, err = js.Transfer(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseConvert))
+		data, err := ioutil.ReadFile(filepath.Join(tmpDir, tempFile))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(Equal(cirrosData))
+		Expect(js.GetURL().String()).To(Equal(filepath.Join(tmpDir, tempFile)))
+
+		manifest := newImportManifest()
+		js.addToManifest(manifest)
+		Expect(manifest.Source.URL).To(Equal(api.ts.URL + "/metadata"))
+		Expect(manifest.Source.Digest).To(Equal(api.checksum))
+	})
+
+	It("should accept a bare hex checksum", func() {
+		api.checksum = sha256Hex(cirrosData)
+		js, err = NewJSONResolverDataSource(api.ts.URL+"/metadata", jsonTestURLPath, jsonTestToken, "", JSONResolverOptions{ChecksumPath: jsonTestChecksumPath})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(js.checksum).To(Equal("sha256:" + api.checksum))
+	})
+
+	It("should transfer without verification if no checksum path is set", func() {
+		api.checksum = ""
+		js, err = NewJSONResolverDataSource(api.ts.URL+"/metadata", jsonTestURLPath, jsonTestToken, "", JSONResolverOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = js.Info()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = js.Transfer(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should fail the transfer on a checksum mismatch", func() {
+		api.checksum = "sha256:" + sha256Hex([]byte("something else"))
+		js, err = NewJSONResolverDataSource(api.ts.URL+"/metadata", jsonTestURLPath, jsonTestToken, "", JSONResolverOptions{ChecksumPath: jsonTestChecksumPath})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = js.Info()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = js.Transfer(tmpDir)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("checksum mismatch"))
+	})
+
+	table.DescribeTable("should fail to resolve", func(endpoint, urlPath, checksumPath, token, expected string) {
+		js, err = NewJSONResolverDataSource(api.ts.URL+endpoint, urlPath, token, "", JSONResolverOptions{ChecksumPath: checksumPath})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(expected))
+	},
+		table.Entry("without the token", "/metadata", jsonTestURLPath, jsonTestChecksumPath, "", "got 401"),
+		table.Entry("without a download URL path", "/metadata", "", jsonTestChecksumPath, jsonTestToken, "no JSONPath of the download URL"),
+		table.Entry("with a missing download URL", "/metadata", "{.assets[0].links.mirror.href}", "", jsonTestToken, "unable to resolve the download URL"),
+		table.Entry("with a path selecting several values", "/metadata", "{.assets[*].name}{.next}", "", jsonTestToken, "selects 2 values"),
+		table.Entry("with an invalid path", "/metadata", "{.assets[", "", jsonTestToken, "invalid JSONPath"),
+		table.Entry("with a non http download URL", "/metadata", "{.assets[0].name}", "", jsonTestToken, "unsupported download URL scheme"),
+		table.Entry("with an unsupported checksum", "/metadata", jsonTestURLPath, "{.assets[0].name}", jsonTestToken, "unsupported checksum"),
+		table.Entry("with a missing metadata endpoint", "/missing", jsonTestURLPath, "", jsonTestToken, "got 404"),
+	)
+})
@@ -0,0 +1,166 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"fmt"
+	"net/url"
+
+	libnbd "github.com/mrnold/go-libnbd"
+	"github.com/pkg/errors"
+
+	"k8s.io/klog/v2"
+)
+
+// nbdHandle provides a mockable interface for the things needed from libnbd to query the size of an export.
+type nbdHandle interface {
+	SetTlsCertificates(dir string) error
+	ConnectUri(uri string) error
+	GetSize() (uint64, error)
+	Close() *libnbd.LibnbdError
+}
+
+// newNbdHandle creates the libnbd handle connecting to the NBD server, may be overridden in tests.
+var newNbdHandle = createNbdHandle
+
+// createNbdHandle creates a libnbd handle.
+func createNbdHandle() (nbdHandle, error) {
+	handle, err := libnbd.Create()
+	if err != nil {
+		return nil, err
+	}
+	return handle, nil
+}
+
+// NBDDataSource is the data provider for exports of a running NBD server, like qemu-nbd. The endpoint is an NBD URI,
+// nbd://host:port/export or nbd+unix:///export?socket=/path, the nbds and nbds+unix schemes connect over TLS using
+// the CA certificate, and optionally the client certificate, of the certificate directory. qemu-img reads and
+// converts the export directly, nothing is downloaded.
+// Sequence of phases:
+// 1. Info -> Convert
+// 2. Convert -> Resize
+type NBDDataSource struct {
+	// endpoint is the NBD URI of the export.
+	endpoint *url.URL
+	// certDir holds the TLS certificates of nbds endpoints.
+	certDir string
+	// size is the size of the export reported by the server.
+	size uint64
+}
+
+// NewNBDDataSource creates a new instance of the NBD data provider.
+func NewNBDDataSource(endpoint, certDir string) (*NBDDataSource, error) {
+	ep, err := ParseEndpoint(endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, fmt.Sprintf("unable to parse endpoint %q", endpoint))
+	}
+	switch ep.Scheme {
+	case "nbd", "nbd+tcp", "nbds":
+		if ep.Hostname() == "" {
+			return nil, errors.Errorf("NBD endpoint %q has no host", ep)
+		}
+	case "nbd+unix", "nbds+unix":
+		if ep.Query().Get("socket") == "" {
+			return nil, errors.Errorf("NBD endpoint %q has no socket", ep)
+		}
+	default:
+		return nil, errors.Errorf("unsupported NBD scheme %q", ep.Scheme)
+	}
+	if isNbdTLS(ep) && certDir == "" {
+		return nil, errors.Errorf("NBD endpoint %q requires a certificate directory", ep)
+	}
+	return &NBDDataSource{
+		endpoint: ep,
+		certDir:  certDir,
+	}, nil
+}
+
+// Info is called to get initial information about the data.
+func (ns *NBDDataSource) Info() (ProcessingPhase, error) {
+	size, err := queryNbdExportSize(ns.endpoint, ns.certDir)
+	if err != nil {
+		return ProcessingPhaseError, err
+	}
+	ns.size = size
+	klog.V(1).Infof("NBD export %s has size %d", ns.endpoint, size)
+	return ProcessingPhaseConvert, nil
+}
+
+// Transfer is not used, qemu-img converts the export directly.
+func (ns *NBDDataSource) Transfer(path string) (ProcessingPhase, error) {
+	return ProcessingPhaseError, errors.New("transfer is not supported by the NBD data source")
+}
+
+// TransferFile is not used, qemu-img converts the export directly.
+func (ns *NBDDataSource) TransferFile(fileName string) (ProcessingPhase, error) {
+	return ProcessingPhaseError, errors.New("transfer is not supported by the NBD data source")
+}
+
+// GetURL returns the NBD URI of the export. The certificate directory of TLS exports is passed to qemu-img in
+// the tls-certificates query parameter.
+func (ns *NBDDataSource) GetURL() *url.URL {
+	if !isNbdTLS(ns.endpoint) {
+		return ns.endpoint
+	}
+	u := *ns.endpoint
+	query := u.Query()
+	query.Set("tls-certificates", ns.certDir)
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+func (ns *NBDDataSource) addToManifest(manifest *ImportManifest) {
+	manifest.Source.URL = manifestURL(ns.endpoint)
+	manifest.SourceSize = int64(ns.size)
+}
+
+// Close closes any readers or other open resources.
+func (ns *NBDDataSource) Close() error {
+	return nil
+}
+
+// isNbdTLS returns true if the NBD endpoint is served over TLS.
+func isNbdTLS(ep *url.URL) bool {
+	return ep.Scheme == "nbds" || ep.Scheme == "nbds+unix"
+}
+
+// queryNbdExportSize connects to the NBD server of the endpoint with libnbd, and returns the size of its export.
+func queryNbdExportSize(ep *url.URL, certDir string) (uint64, error) {
+	handle, err := newNbdHandle()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to create libnbd handle")
+	}
+	defer handle.Close()
+	if isNbdTLS(ep) {
+		if err := handle.SetTlsCertificates(certDir); err != nil {
+			return 0, errors.Wrapf(err, "unable to use the NBD certificates of %s", certDir)
+		}
+	}
+	uri := *ep
+	if uri.Scheme == "nbd+tcp" {
+		// libnbd only knows the short form of the scheme.
+		uri.Scheme = "nbd"
+	}
+	if err := handle.ConnectUri(uri.String()); err != nil {
+		return 0, errors.Wrapf(err, "unable to connect to NBD export %s", ep)
+	}
+	size, err := handle.GetSize()
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to get the size of NBD export %s", ep)
+	}
+	return size, nil
+}
@@ -0,0 +1,166 @@
+package importer
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	libnbd "github.com/mrnold/go-libnbd"
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+
+	"kubevirt.io/containerized-data-importer/pkg/image"
+	"kubevirt.io/containerized-data-importer/pkg/util"
+)
+
+// fakeNbdHandle records the calls of the NBD data source, and reports the size of a single export.
+type fakeNbdHandle struct {
+	// the URI of the export
+	uri        string
+	exportSize uint64
+	// the URI and the certificate directory the data source connected with
+	connected       string
+	tlsCertificates string
+	closed          bool
+}
+
+func (h *fakeNbdHandle) SetTlsCertificates(dir string) error {
+	h.tlsCertificates = dir
+	return nil
+}
+
+func (h *fakeNbdHandle) ConnectUri(uri string) error {
+	h.connected = uri
+	if uri != h.uri {
+		return errors.New("server has no export named \"other\"")
+	}
+	return nil
+}
+
+func (h *fakeNbdHandle) GetSize() (uint64, error) {
+	return h.exportSize, nil
+}
+
+func (h *fakeNbdHandle) Close() *libnbd.LibnbdError {
+	h.closed = true
+	return nil
+}
+
+var _ = Describe("NBD data source", func() {
+	var (
+		tmpDir string
+		handle *fakeNbdHandle
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "nbd")
+		Expect(err).NotTo(HaveOccurred())
+		handle = &fakeNbdHandle{exportSize: 12345}
+		newNbdHandle = func() (nbdHandle, error) {
+			return handle, nil
+		}
+	})
+
+	AfterEach(func() {
+		newNbdHandle = createNbdHandle
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should query the size of a named export on a Unix socket, and convert from the NBD URI", func() {
+		endpoint := "nbd+unix:///disk?socket=/var/run/nbd.sock"
+		handle.uri = endpoint
+		ds, err := NewNBDDataSource(endpoint, "")
+		Expect(err).NotTo(HaveOccurred())
+		phase, err := ds.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(phase).To(Equal(ProcessingPhaseConvert))
+		Expect(ds.size).To(Equal(handle.exportSize))
+		Expect(ds.GetURL().String()).To(Equal(endpoint))
+		Expect(handle.tlsCertificates).To(BeEmpty())
+		Expect(handle.closed).To(BeTrue())
+	})
+
+	It("should connect with the short form of the tcp scheme", func() {
+		handle.uri = "nbd://example.com:10809/disk"
+		ds, err := NewNBDDataSource("nbd+tcp://example.com:10809/disk", "")
+		Expect(err).NotTo(HaveOccurred())
+		phase, err := ds.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(phase).To(Equal(ProcessingPhaseConvert))
+		Expect(handle.connected).To(Equal(handle.uri))
+		Expect(ds.size).To(Equal(handle.exportSize))
+	})
+
+	It("should fail on an unknown export", func() {
+		handle.uri = "nbd://example.com/disk"
+		ds, err := NewNBDDataSource("nbd://example.com/other", "")
+		Expect(err).NotTo(HaveOccurred())
+		phase, err := ds.Info()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("unable to connect to NBD export nbd://example.com/other"))
+		Expect(phase).To(Equal(ProcessingPhaseError))
+		Expect(handle.closed).To(BeTrue())
+	})
+
+	It("should fail if libnbd is not available", func() {
+		newNbdHandle = func() (nbdHandle, error) {
+			return nil, errors.New("no libnbd")
+		}
+		ds, err := NewNBDDataSource("nbd://example.com/disk", "")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = ds.Info()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("unable to create libnbd handle"))
+	})
+
+	It("should connect over TLS, and pass the certificates to qemu-img", func() {
+		handle.uri = "nbds://localhost:10809/disk"
+		ds, err := NewNBDDataSource(handle.uri, tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		phase, err := ds.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(phase).To(Equal(ProcessingPhaseConvert))
+		Expect(handle.tlsCertificates).To(Equal(tmpDir))
+		Expect(ds.size).To(Equal(handle.exportSize))
+		Expect(ds.GetURL().Query().Get("tls-certificates")).To(Equal(tmpDir))
+	})
+
+	It("should convert the export through qemu-img", func() {
+		handle.uri = "nbd+unix:///disk?socket=/var/run/nbd.sock"
+		ds, err := NewNBDDataSource(handle.uri, "")
+		Expect(err).NotTo(HaveOccurred())
+		dataFile := filepath.Join(tmpDir, "disk.img")
+		dp := NewDataProcessor(ds, dataFile, tmpDir, tmpDir, "", 0.055, false)
+		qemuOperations := &fakeNbdSourceQEMUOperations{QEMUOperations: NewFakeQEMUOperations(nil, nil, fakeInfoOpRetVal{&fakeZeroImageInfo, nil}, nil, nil, nil)}
+		replaceQEMUOperations(qemuOperations, func() {
+			Expect(dp.ProcessDataWithPause()).To(Succeed())
+		})
+		Expect(qemuOperations.converted).To(Equal(ds.GetURL()))
+	})
+
+	table.DescribeTable("should reject invalid endpoints", func(endpoint, certDir, expectedErr string) {
+		_, err := NewNBDDataSource(endpoint, certDir)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(expectedErr))
+	},
+		table.Entry("with an unsupported scheme", "http://example.com/disk", "", "unsupported NBD scheme"),
+		table.Entry("without host", "nbd:///disk", "", "has no host"),
+		table.Entry("without socket", "nbd+unix:///disk", "", "has no socket"),
+		table.Entry("with TLS without certificates", "nbds://example.com/disk", "", "requires a certificate directory"),
+	)
+})
+
+// fakeNbdSourceQEMUOperations records the url converted from.
+type fakeNbdSourceQEMUOperations struct {
+	image.QEMUOperations
+	converted *url.URL
+}
+
+func (o *fakeNbdSourceQEMUOperations) ConvertToFormatStream(url *url.URL, dest, format string, preallocate bool, policy util.FlushPolicy) error {
+	o.converted = url
+	return nil
+}
@@ -0,0 +1,280 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"context"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// parallelDownloadMinPartSize is the minimum size of the byte ranges downloaded concurrently.
+	parallelDownloadMinPartSize = 8 * 1024 * 1024
+	// parallelDownloadBufferSize is the size of the buffer of each range download.
+	parallelDownloadBufferSize = 1024 * 1024
+	// parallelDownloadThrottleDelay is the delay before sending again a throttled request without Retry-After.
+	parallelDownloadThrottleDelay = time.Second
+	// parallelDownloadMaxThrottles is the number of times the request of a range is throttled before the download fails.
+	parallelDownloadMaxThrottles = 10
+)
+
+// may be overridden in tests
+var throttleSleep = sleepWithContext
+
+// adaptiveConcurrency limits the concurrent range requests of a download with additive increase and multiplicative
+// decrease: the limit starts at max, is halved when a request is throttled, down to one request, and grows by one
+// for every range downloaded since, up to max. The requests following a throttled request wait for the delay asked
+// by the store.
+type adaptiveConcurrency struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	max   int
+	limit int
+	// lowest is the lowest limit reached.
+	lowest int
+	active int
+	// decreases counts the times the limit was halved, a burst of requests throttled together halves it once.
+	decreases int
+	// resumeAt is the time the requests resume after a throttled request.
+	resumeAt time.Time
+	// throttled returns the delay asked by the store and true if the request failing with err was throttled.
+	throttled func(err error) (time.Duration, bool)
+}
+
+// newAdaptiveConcurrency returns the limit of max concurrent requests, backing off from the requests throttled
+// according to throttled.
+func newAdaptiveConcurrency(max int, throttled func(err error) (time.Duration, bool)) *adaptiveConcurrency {
+	if max < 1 {
+		max = 1
+	}
+	c := &adaptiveConcurrency{max: max, limit: max, lowest: max, throttled: throttled}
+	c.cond = sync.NewCond(&c.mutex)
+	return c
+}
+
+// acquire waits for a request slot and the end of the delay asked by a throttled request, and returns the number of
+// times the limit was halved, to pass to release.
+func (c *adaptiveConcurrency) acquire(ctx context.Context) (int, error) {
+	c.mutex.Lock()
+	for c.active >= c.limit && ctx.Err() == nil {
+		c.cond.Wait()
+	}
+	if err := ctx.Err(); err != nil {
+		c.mutex.Unlock()
+		return 0, err
+	}
+	c.active++
+	decreases := c.decreases
+	delay := time.Until(c.resumeAt)
+	c.mutex.Unlock()
+	if delay > 0 {
+		if err := throttleSleep(ctx, delay); err != nil {
+			c.mutex.Lock()
+			c.active--
+			c.cond.Broadcast()
+			c.mutex.Unlock()
+			return 0, err
+		}
+	}
+	return decreases, nil
+}
+
+// release frees the slot of a request acquired after decreases halvings that failed with err, adapting the limit. It
+// returns true if the request was throttled and has to be sent again.
+func (c *adaptiveConcurrency) release(decreases int, err error) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	defer c.cond.Broadcast()
+	c.active--
+	if err == nil {
+		if c.limit < c.max {
+			c.limit++
+		}
+		return false
+	}
+	delay, throttled := c.throttled(err)
+	if !throttled {
+		return false
+	}
+	if delay <= 0 {
+		delay = parallelDownloadThrottleDelay
+	}
+	if resumeAt := time.Now().Add(delay); resumeAt.After(c.resumeAt) {
+		c.resumeAt = resumeAt
+	}
+	if decreases == c.decreases && c.limit > 1 {
+		c.limit /= 2
+		c.decreases++
+		if c.limit < c.lowest {
+			c.lowest = c.limit
+		}
+		klog.Warningf("The requests are throttled, lowering the concurrency to %d and resuming in %s: %v", c.limit, delay, err)
+	}
+	return true
+}
+
+// wake wakes up the requests waiting for a slot, for instance once the download is cancelled.
+func (c *adaptiveConcurrency) wake() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cond.Broadcast()
+}
+
+// downloadToFile creates fileName, a file of size bytes, has download write to it, and syncs it.
+func downloadToFile(fileName string, size int64, download func(w io.WriterAt) error) error {
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create %s", fileName)
+	}
+	defer file.Close()
+	if err := file.Truncate(size); err != nil {
+		return errors.Wrapf(err, "unable to resize %s", fileName)
+	}
+	if err := download(file); err != nil {
+		return err
+	}
+	return errors.Wrapf(file.Sync(), "unable to sync %s", fileName)
+}
+
+// downloadRanges downloads the size bytes of an object into w with concurrent requests of byte ranges, as many as
+// concurrency allows, each range written at its offset and resumed as set by retries. open opens the byte range from
+// start to end inclusive. The download stops once ctx is done.
+func downloadRanges(ctx context.Context, w io.WriterAt, size int64, concurrency *adaptiveConcurrency, retries readRetries, open func(start, end int64) (io.ReadCloser, error)) error {
+	partSize := (size + int64(concurrency.max) - 1) / int64(concurrency.max)
+	if partSize < parallelDownloadMinPartSize {
+		partSize = parallelDownloadMinPartSize
+	}
+	_, err := downloadParts(ctx, w, size, partSize, concurrency, retries, open, nil)
+	return err
+}
+
+// downloadParts downloads the size bytes of an object into w in byte ranges of partSize bytes, the last one possibly
+// shorter, with as many concurrent requests as concurrency allows. The throttled ranges are downloaded again, up to
+// parallelDownloadMaxThrottles times. If newHash isn't nil, every range is hashed while it is written, and the
+// digests of the ranges are returned in order.
+func downloadParts(ctx context.Context, w io.WriterAt, size, partSize int64, concurrency *adaptiveConcurrency, retries readRetries, open func(start, end int64) (io.ReadCloser, error), newHash func() hash.Hash) ([][]byte, error) {
+	parts := int((size + partSize - 1) / partSize)
+	klog.V(1).Infof("Downloading %d bytes in %d ranges of %d bytes", size, parts, partSize)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, parts)
+	digests := make([][]byte, parts)
+	var wg sync.WaitGroup
+	for i := 0; i < parts; i++ {
+		start := int64(i) * partSize
+		end := start + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		wg.Add(1)
+		go func(i int, start, end int64) {
+			defer wg.Done()
+			digest, err := downloadThrottledRange(ctx, w, start, end, concurrency, retries, open, newHash)
+			if err != nil {
+				errs <- err
+				// The other ranges are useless now.
+				cancel()
+				concurrency.wake()
+				return
+			}
+			digests[i] = digest
+		}(i, start, end)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	if newHash == nil {
+		return nil, nil
+	}
+	return digests, nil
+}
+
+// downloadThrottledRange downloads the byte range from start to end inclusive into w once concurrency allows it,
+// again if the request is throttled. It returns the digest of the range if newHash isn't nil.
+func downloadThrottledRange(ctx context.Context, w io.WriterAt, start, end int64, concurrency *adaptiveConcurrency, retries readRetries, open func(start, end int64) (io.ReadCloser, error), newHash func() hash.Hash) ([]byte, error) {
+	for throttles := 0; ; throttles++ {
+		decreases, err := concurrency.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var h hash.Hash
+		if newHash != nil {
+			h = newHash()
+		}
+		err = downloadRange(ctx, w, start, end, retries, open, h)
+		if !concurrency.release(decreases, err) || throttles >= parallelDownloadMaxThrottles {
+			if err != nil || h == nil {
+				return nil, err
+			}
+			return h.Sum(nil), nil
+		}
+	}
+}
+
+// downloadRange writes the byte range from start to end inclusive at its offset in w, and to h if not nil.
+func downloadRange(ctx context.Context, w io.WriterAt, start, end int64, retries readRetries, open func(start, end int64) (io.ReadCloser, error), h hash.Hash) error {
+	reader, err := open(start, end)
+	if err != nil {
+		return errors.Wrapf(err, "unable to get the byte range %d-%d", start, end)
+	}
+	if retries.enabled() {
+		reader = newResumableReader(ctx, reader, end-start+1, retries, func(offset int64) (io.ReadCloser, error) {
+			return open(start+offset, end)
+		})
+	}
+	defer reader.Close()
+	buf := make([]byte, parallelDownloadBufferSize)
+	offset := start
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := reader.Read(buf)
+		if offset+int64(n) > end+1 {
+			return errors.Errorf("the byte range %d-%d returned more than %d bytes", start, end, end-start+1)
+		}
+		if n > 0 {
+			if _, err := w.WriteAt(buf[:n], offset); err != nil {
+				return errors.Wrapf(err, "unable to write the byte range %d-%d", start, end)
+			}
+			if h != nil {
+				h.Write(buf[:n])
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "unable to read the byte range %d-%d", start, end)
+		}
+	}
+	if offset != end+1 {
+		return errors.Errorf("the byte range %d-%d is truncated at %d", start, end, offset)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	prometheusutil "kubevirt.io/containerized-data-importer/pkg/util/prometheus"
+)
+
+// PhaseMetrics are the measures of a completed processing phase.
+type PhaseMetrics struct {
+	Phase    ProcessingPhase
+	Duration time.Duration
+	// Bytes is the number of bytes read from the source during the phase.
+	Bytes int64
+	// Throughput is the number of bytes read from the source per second of the phase.
+	Throughput float64
+}
+
+// PhaseMetricsRecorder records the measures of the processing phases.
+type PhaseMetricsRecorder interface {
+	RecordPhase(metrics PhaseMetrics)
+}
+
+// phaseMetricsRecorder records the processing phases, nil if not set.
+var phaseMetricsRecorder PhaseMetricsRecorder
+
+// SetPhaseMetricsRecorder makes the data processors record the duration of every completed processing phase, and the
+// bytes read from the source during the phase, with recorder. Bytes are counted for the sources detecting the format
+// of the data, if the recorder is set before the Info phase. nil disables the recording.
+func SetPhaseMetricsRecorder(recorder PhaseMetricsRecorder) {
+	phaseMetricsRecorder = recorder
+}
+
+// phaseSource counts the bytes read from the source of the import, for the phase metrics.
+var phaseSource struct {
+	sync.Mutex
+	reader *prometheusutil.ProgressReader
+}
+
+// trackPhaseBytes makes the phase metrics count the bytes read by reader.
+func trackPhaseBytes(reader *prometheusutil.ProgressReader) {
+	phaseSource.Lock()
+	defer phaseSource.Unlock()
+	phaseSource.reader = reader
+}
+
+// phaseBytes returns the reader of the source data and the bytes it read so far, nil if not tracked.
+func phaseBytes() (*prometheusutil.ProgressReader, int64) {
+	phaseSource.Lock()
+	defer phaseSource.Unlock()
+	if phaseSource.reader == nil {
+		return nil, 0
+	}
+	return phaseSource.reader, int64(phaseSource.reader.Current)
+}
+
+// phaseTimer measures a processing phase.
+type phaseTimer struct {
+	start  time.Time
+	reader *prometheusutil.ProgressReader
+	bytes  int64
+}
+
+// startPhaseTimer starts measuring a processing phase, nil if no recorder is set.
+func startPhaseTimer() *phaseTimer {
+	if phaseMetricsRecorder == nil {
+		return nil
+	}
+	reader, bytes := phaseBytes()
+	return &phaseTimer{start: time.Now(), reader: reader, bytes: bytes}
+}
+
+// record records the measures of phase, since the timer started.
+func (t *phaseTimer) record(phase ProcessingPhase) {
+	if t == nil {
+		return
+	}
+	metrics := PhaseMetrics{Phase: phase, Duration: time.Since(t.start)}
+	reader, bytes := phaseBytes()
+	if reader != t.reader {
+		// The source data was opened during the phase.
+		t.bytes = 0
+	}
+	metrics.Bytes = bytes - t.bytes
+	if seconds := metrics.Duration.Seconds(); seconds > 0 {
+		metrics.Throughput = float64(metrics.Bytes) / seconds
+	}
+	phaseMetricsRecorder.RecordPhase(metrics)
+}
+
+// prometheusPhaseMetricsRecorder exposes the measures of the last run of every phase as prometheus gauges.
+type prometheusPhaseMetricsRecorder struct {
+	duration   *prometheus.GaugeVec
+	bytes      *prometheus.GaugeVec
+	throughput *prometheus.GaugeVec
+}
+
+// NewPrometheusPhaseMetricsRecorder returns a recorder exposing the duration, the bytes read from the source and the
+// throughput of the last run of every processing phase, registered with registerer.
+func NewPrometheusPhaseMetricsRecorder(registerer prometheus.Registerer) (PhaseMetricsRecorder, error) {
+	r := &prometheusPhaseMetricsRecorder{
+		duration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "import_phase_duration_seconds",
+			Help: "The duration of the import phase in seconds",
+		}, []string{"ownerUID", "phase"}),
+		bytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "import_phase_bytes",
+			Help: "The number of bytes read from the source during the import phase",
+		}, []string{"ownerUID", "phase"}),
+		throughput: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "import_phase_throughput_bytes_per_second",
+			Help: "The number of bytes read from the source per second of the import phase",
+		}, []string{"ownerUID", "phase"}),
+	}
+	for _, collector := range []**prometheus.GaugeVec{&r.duration, &r.bytes, &r.throughput} {
+		if err := registerer.Register(*collector); err != nil {
+			are, ok := err.(prometheus.AlreadyRegisteredError)
+			if !ok {
+				return nil, errors.Wrap(err, "unable to register the import phase metrics")
+			}
+			// Use the collector registered before from now on.
+			*collector = are.ExistingCollector.(*prometheus.GaugeVec)
+		}
+	}
+	return r, nil
+}
+
+func (r *prometheusPhaseMetricsRecorder) RecordPhase(metrics PhaseMetrics) {
+	phase := string(metrics.Phase)
+	r.duration.WithLabelValues(ownerUID, phase).Set(metrics.Duration.Seconds())
+	r.bytes.WithLabelValues(ownerUID, phase).Set(float64(metrics.Bytes))
+	r.throughput.WithLabelValues(ownerUID, phase).Set(metrics.Throughput)
+}
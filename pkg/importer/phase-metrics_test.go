@@ -0,0 +1,140 @@
+package importer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// mockPhaseMetricsRecorder records the phase metrics.
+type mockPhaseMetricsRecorder struct {
+	phases []PhaseMetrics
+}
+
+func (r *mockPhaseMetricsRecorder) RecordPhase(metrics PhaseMetrics) {
+	r.phases = append(r.phases, metrics)
+}
+
+// byPhase returns the metrics of phase, nil if not recorded.
+func (r *mockPhaseMetricsRecorder) byPhase(phase ProcessingPhase) *PhaseMetrics {
+	for i := range r.phases {
+		if r.phases[i].Phase == phase {
+			return &r.phases[i]
+		}
+	}
+	return nil
+}
+
+// s3DataClient serves data as every object.
+type s3DataClient struct {
+	data []byte
+}
+
+func (c *s3DataClient) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(c.data)),
+		ContentLength: aws.Int64(int64(len(c.data))),
+	}, nil
+}
+
+var _ = Describe("Phase metrics", func() {
+	var (
+		recorder *mockPhaseMetricsRecorder
+		tmpDir   string
+	)
+
+	BeforeEach(func() {
+		recorder = &mockPhaseMetricsRecorder{}
+		SetPhaseMetricsRecorder(recorder)
+		var err error
+		tmpDir, err = ioutil.TempDir("", "metrics")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.Mkdir(filepath.Join(tmpDir, "scratch"), 0755)).To(Succeed())
+		Expect(os.Mkdir(filepath.Join(tmpDir, "data"), 0755)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		SetPhaseMetricsRecorder(nil)
+		newClientFunc = getS3Client
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should record the phases of an S3 import", func() {
+		newClientFunc = func(endpoint, accKey, secKey string, certDir string, options s3ClientOptions) (S3Client, error) {
+			return &s3DataClient{data: cirrosData}, nil
+		}
+		sd, err := NewS3DataSource("http://amazon.com/bucket/cirros.qcow2", "", "", "")
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		dp := NewDataProcessor(sd, filepath.Join(tmpDir, "data", "disk.img"), filepath.Join(tmpDir, "data"), filepath.Join(tmpDir, "scratch"), "", 0.055, false)
+		replaceQEMUOperations(NewFakeQEMUOperations(nil, nil, fakeInfoRet, nil, nil, nil), func() {
+			err = dp.ProcessData()
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		transfer := recorder.byPhase(ProcessingPhaseTransferScratch)
+		Expect(transfer).NotTo(BeNil())
+		Expect(transfer.Bytes).To(BeNumerically(">", 0))
+		Expect(transfer.Bytes).To(BeNumerically("<=", len(cirrosData)))
+		Expect(transfer.Throughput).To(BeNumerically(">", 0))
+		convert := recorder.byPhase(ProcessingPhaseConvert)
+		Expect(convert).NotTo(BeNil())
+		Expect(convert.Duration).To(BeNumerically(">", 0))
+		Expect(convert.Bytes).To(BeZero())
+		var total int64
+		for _, phase := range recorder.phases {
+			total += phase.Bytes
+		}
+		Expect(total).To(Equal(int64(len(cirrosData))))
+	})
+
+	It("should not record without recorder", func() {
+		SetPhaseMetricsRecorder(nil)
+		mdp := &MockDataProvider{
+			infoResponse:     ProcessingPhaseTransferScratch,
+			transferResponse: ProcessingPhaseComplete,
+		}
+		dp := NewDataProcessor(mdp, "dest", "dataDir", "scratchDataDir", "1G", 0.055, false)
+		Expect(dp.ProcessData()).To(Succeed())
+		Expect(recorder.phases).To(BeEmpty())
+		Expect(startPhaseTimer()).To(BeNil())
+	})
+
+	It("should expose the phases as prometheus gauges", func() {
+		registry := prometheus.NewRegistry()
+		promRecorder, err := NewPrometheusPhaseMetricsRecorder(registry)
+		Expect(err).NotTo(HaveOccurred())
+		promRecorder.RecordPhase(PhaseMetrics{Phase: ProcessingPhaseTransferScratch, Duration: 2e9, Bytes: 1000, Throughput: 500})
+		families, err := registry.Gather()
+		Expect(err).NotTo(HaveOccurred())
+		values := map[string]float64{}
+		for _, family := range families {
+			for _, metric := range family.GetMetric() {
+				for _, label := range metric.GetLabel() {
+					if label.GetName() == "phase" {
+						Expect(label.GetValue()).To(Equal(string(ProcessingPhaseTransferScratch)))
+					}
+				}
+				values[family.GetName()] = metric.GetGauge().GetValue()
+			}
+		}
+		Expect(values).To(Equal(map[string]float64{
+			"import_phase_duration_seconds":            2,
+			"import_phase_bytes":                       1000,
+			"import_phase_throughput_bytes_per_second": 500,
+		}))
+
+		// A second recorder shares the registered gauges.
+		_, err = NewPrometheusPhaseMetricsRecorder(registry)
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,223 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+
+	"kubevirt.io/containerized-data-importer/pkg/util"
+)
+
+// pipedWriteQueueLength is the number of writes a pipedWriterAt queues before blocking the source.
+const pipedWriteQueueLength = 64
+
+// pipedWrite is a write queued by a pipedWriterAt.
+type pipedWrite struct {
+	data   []byte
+	offset int64
+}
+
+// pipedWriterAt queues the writes to the target and performs them in the background, so the source downloads and
+// decompresses the next data while the previous data is written. The source blocks once pipedWriteQueueLength writes
+// are queued. WriteAt is safe for concurrent use, Close must be called once the source is done and returns the first
+// write error.
+type pipedWriterAt struct {
+	writes chan pipedWrite
+	// done is closed once the writes stopped, err is the first write error.
+	done chan struct{}
+	err  error
+	// sparse skips the writes of zeroes, which must read back as zeroes from the target.
+	sparse bool
+	// limit fails the writes past it with limitErr if positive.
+	limit    int64
+	limitErr error
+	// started is set by the first write, once the source started reading the image.
+	started bool
+	// end is the end of the furthest write, including the skipped ones.
+	end      int64
+	endMutex sync.Mutex
+	closed   sync.Once
+}
+
+// newPipedWriterAt starts writing the queued writes to target, syncing it according to policy.
+func newPipedWriterAt(target util.SyncWriterAt, sparse bool, policy util.FlushPolicy) *pipedWriterAt {
+	w := &pipedWriterAt{
+		writes: make(chan pipedWrite, pipedWriteQueueLength),
+		done:   make(chan struct{}),
+		sparse: sparse,
+	}
+	go w.write(util.NewFlushWriterAt(target, policy))
+	return w
+}
+
+// write performs the queued writes until the queue is closed or a write fails, and syncs the target.
+func (w *pipedWriterAt) write(target *util.FlushWriterAt) {
+	defer close(w.done)
+	for write := range w.writes {
+		if _, err := target.WriteAt(write.data, write.offset); err != nil {
+			w.err = errors.Wrap(err, "unable to write to the target")
+			return
+		}
+	}
+	if err := target.Flush(); err != nil {
+		w.err = errors.Wrap(err, "unable to sync the target")
+	}
+}
+
+// setLimit fails the writes ending past limit with err.
+func (w *pipedWriterAt) setLimit(limit int64, err error) {
+	w.limit = limit
+	w.limitErr = err
+}
+
+// WriteAt queues a copy of p to be written at off. It fails with the error of a previous write, or if it ends past
+// the limit.
+func (w *pipedWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	w.endMutex.Lock()
+	w.started = true
+	if end > w.end {
+		w.end = end
+	}
+	w.endMutex.Unlock()
+	if w.limit > 0 && end > w.limit {
+		return 0, w.limitErr
+	}
+	if w.sparse && isZero(p) {
+		return len(p), nil
+	}
+	select {
+	case <-w.done:
+		return 0, w.err
+	default:
+	}
+	data := make([]byte, len(p))
+	copy(data, p)
+	select {
+	case w.writes <- pipedWrite{data: data, offset: off}:
+		return len(p), nil
+	case <-w.done:
+		return 0, w.err
+	}
+}
+
+// Close waits for the queued writes and returns the first write error.
+func (w *pipedWriterAt) Close() error {
+	w.closed.Do(func() {
+		close(w.writes)
+	})
+	<-w.done
+	return w.err
+}
+
+// isZero returns true if p only contains zeroes.
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// pipedSource returns the source if the image can be written to the target while it is downloaded. The conversion
+// writes raw images only, to a file or a block device, and the checks of the image in scratch space, the
+// preallocation, the overlay and the segmented conversion need qemu-img.
+func (dp *DataProcessor) pipedSource() (WriterAtDataSource, bool) {
+	if !dp.pipedConversion || dp.nbdTarget != nil || dp.targetFormat != "raw" || dp.preallocation ||
+		dp.checkImage || dp.verifyTransfer || dp.normalizeQcow2 || dp.maxAllocatedClusters > 0 ||
+		dp.overlayTarget || dp.conversionSegmentSize > 0 {
+		return nil, false
+	}
+	source, ok := dp.source.(WriterAtDataSource)
+	return source, ok
+}
+
+// pipeConversion writes the image of source to the target while it is downloaded. Raw images, decompressed if
+// needed, are written as they are read, the writes past the available space fail the validation. qemu-img needs
+// random access to the images it converts, so they fail with ErrRequiresConversion before anything is read from the
+// source, and are transferred to scratch space instead. ErrRequiresConversion is only returned if the target was not
+// written, a partly read image can't be transferred again.
+func (dp *DataProcessor) pipeConversion(source WriterAtDataSource) (ProcessingPhase, error) {
+	target := dp.imageFile()
+	isBlock := false
+	if size, _ := getAvailableSpaceBlockFunc(target); size >= int64(0) {
+		isBlock = true
+	}
+	flags := os.O_WRONLY
+	if !isBlock {
+		flags |= os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(target, flags, os.ModePerm)
+	if err != nil {
+		return ProcessingPhaseError, errors.Wrapf(err, "unable to open %s", target)
+	}
+	defer file.Close()
+	writer := newPipedWriterAt(file, !isBlock, dp.flushPolicy)
+	available := int64(float64(dp.availableSpace) * (1 - dp.filesystemOverhead))
+	writer.setLimit(available, ValidationSizeError{err: errors.Errorf("Image size is larger than available size %d (PVC size %d, reserved overhead %f%%). A larger PVC is required.", available, dp.availableSpace, dp.filesystemOverhead)})
+	_, err = source.TransferToWriterAt(writer)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if errors.Cause(err) == ErrRequiresConversion && writer.started {
+		err = errors.Errorf("unable to write the image to the target: %v", err)
+	}
+	if err == nil && !isBlock && writer.end > 0 {
+		// Extend the file over the trailing zeroes.
+		if info, statErr := file.Stat(); statErr != nil || info.Size() < writer.end {
+			err = file.Truncate(writer.end)
+		}
+	}
+	if err == nil {
+		var targetURL *url.URL
+		if targetURL, err = url.Parse(target); err == nil {
+			err = dp.validate(targetURL)
+		}
+	}
+	if err != nil {
+		if !isBlock {
+			os.Remove(target)
+		}
+		return ProcessingPhaseError, err
+	}
+	dp.targetPiped = true
+	dp.detectedFormat = dp.sourceFormat()
+	if dp.detectedFormat == "" {
+		dp.detectedFormat = "raw"
+	}
+	return ProcessingPhaseResize, nil
+}
+
+// transferScratch transfers the image of the source to scratch space to be converted, or writes it to the target
+// while it is downloaded if the conversion is piped and the image can be.
+func (dp *DataProcessor) transferScratch() (ProcessingPhase, error) {
+	if source, ok := dp.pipedSource(); ok {
+		klog.V(1).Infoln("Writing the image to the target while it is downloaded")
+		phase, err := dp.pipeConversion(source)
+		if errors.Cause(err) != ErrRequiresConversion {
+			return phase, err
+		}
+		klog.V(1).Infof("Transferring the image to scratch space: %v", err)
+	}
+	return dp.sourceTransfer(dp.scratchDataDir)
+}
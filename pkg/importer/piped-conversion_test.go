@@ -0,0 +1,290 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/pkg/errors"
+
+	"kubevirt.io/containerized-data-importer/pkg/image"
+	"kubevirt.io/containerized-data-importer/pkg/util"
+)
+
+// slowWriterAt writes in memory, sleeping before every write. It fails the writes from failAt if positive.
+type slowWriterAt struct {
+	mutex  sync.Mutex
+	data   []byte
+	delay  time.Duration
+	failAt int64
+}
+
+func (w *slowWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	time.Sleep(w.delay)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.failAt > 0 && off+int64(len(p)) > w.failAt {
+		return 0, errors.New("no space left on device")
+	}
+	if end := int(off) + len(p); end > len(w.data) {
+		w.data = append(w.data, make([]byte, end-len(w.data))...)
+	}
+	return copy(w.data[off:], p), nil
+}
+
+func (w *slowWriterAt) Sync() error {
+	return nil
+}
+
+// mockPipedDataProvider writes data at its offsets through TransferToWriterAt, slowly, or requires conversion. It
+// requires conversion after writing data if requiresConversionLate is set.
+type mockPipedDataProvider struct {
+	mockStreamingDataProvider
+	requiresConversion     bool
+	requiresConversionLate bool
+	pipes                  int
+}
+
+func (m *mockPipedDataProvider) TransferToWriterAt(w io.WriterAt) (ProcessingPhase, error) {
+	m.pipes++
+	if m.requiresConversion {
+		return ProcessingPhaseError, errors.Wrap(ErrRequiresConversion, "vmdk image")
+	}
+	if _, err := io.Copy(&offsetWriter{w: w}, &slowReader{reader: bytes.NewReader(m.data), delay: time.Millisecond}); err != nil {
+		return ProcessingPhaseError, err
+	}
+	if m.requiresConversionLate {
+		return ProcessingPhaseError, errors.Wrap(ErrRequiresConversion, "unsupported feature")
+	}
+	return ProcessingPhaseComplete, nil
+}
+
+// fakeScratchQEMUOperations records the image converted from scratch space.
+type fakeScratchQEMUOperations struct {
+	image.QEMUOperations
+	converted string
+	data      []byte
+}
+
+func (o *fakeScratchQEMUOperations) ConvertToFormatStream(url *url.URL, dest, format string, preallocate bool, policy util.FlushPolicy) error {
+	o.converted = url.Path
+	var err error
+	o.data, err = ioutil.ReadFile(url.Path)
+	return err
+}
+
+var _ = Describe("Piped writer", func() {
+	data := func() []byte {
+		data := make([]byte, 32*4096)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		return data
+	}
+
+	It("should overlap the reads of the source and the writes to the target", func() {
+		const delay = 5 * time.Millisecond
+		source := data()
+		start := time.Now()
+		target := &slowWriterAt{delay: delay}
+		_, err := io.Copy(&offsetWriter{w: target}, &slowReader{reader: bytes.NewReader(source), delay: delay})
+		Expect(err).NotTo(HaveOccurred())
+		sequential := time.Since(start)
+
+		start = time.Now()
+		target = &slowWriterAt{delay: delay}
+		writer := newPipedWriterAt(target, false, util.FlushPolicy{Mode: util.FlushFinalOnly})
+		_, err = io.Copy(&offsetWriter{w: writer}, &slowReader{reader: bytes.NewReader(source), delay: delay})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(writer.Close()).To(Succeed())
+		piped := time.Since(start)
+
+		Expect(target.data).To(Equal(source))
+		// Sequentially every chunk is read then written, piped the writes happen during the next reads.
+		Expect(piped).To(BeNumerically("<", sequential*3/4))
+	})
+
+	It("should skip the zeroes of sparse targets and record the end of the image", func() {
+		source := data()
+		copy(source[4096:], make([]byte, 2*4096))
+		source = append(source, make([]byte, 3*4096)...)
+		target := &slowWriterAt{}
+		writer := newPipedWriterAt(target, true, util.FlushPolicy{Mode: util.FlushFinalOnly})
+		_, err := io.Copy(&offsetWriter{w: writer}, &slowReader{reader: bytes.NewReader(source)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(writer.Close()).To(Succeed())
+		Expect(writer.end).To(BeEquivalentTo(len(source)))
+		Expect(len(target.data)).To(BeNumerically("<", len(source)))
+		Expect(target.data).To(Equal(source[:len(target.data)]))
+	})
+
+	It("should fail the writes following a failed write", func() {
+		target := &slowWriterAt{failAt: 4096}
+		writer := newPipedWriterAt(target, false, util.FlushPolicy{Mode: util.FlushFinalOnly})
+		chunk := data()[:4096]
+		_, err := writer.WriteAt(chunk, 4096)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(func() error {
+			_, err = writer.WriteAt(chunk, 0)
+			return err
+		}).Should(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("no space left on device"))
+		Expect(writer.Close()).To(MatchError(err))
+	})
+})
+
+var _ = Describe("Piped conversion", func() {
+	var (
+		tmpDir     string
+		dataDir    string
+		dataFile   string
+		scratchDir string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "piped")
+		Expect(err).NotTo(HaveOccurred())
+		dataDir = filepath.Join(tmpDir, "data")
+		Expect(os.Mkdir(dataDir, 0755)).To(Succeed())
+		scratchDir = filepath.Join(tmpDir, "scratch")
+		Expect(os.Mkdir(scratchDir, 0755)).To(Succeed())
+		dataFile = filepath.Join(dataDir, "disk.img")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	processWith := func(source DataSourceInterface, piped bool, availableSpace int64, operations image.QEMUOperations) error {
+		dp := NewDataProcessor(source, dataFile, dataDir, scratchDir, "", 0.055, false)
+		dp.SetPipedConversion(piped)
+		if availableSpace > 0 {
+			dp.availableSpace = availableSpace
+		}
+		var err error
+		replaceQEMUOperations(operations, func() {
+			err = dp.ProcessData()
+		})
+		return err
+	}
+
+	process := func(source DataSourceInterface, piped bool) error {
+		return processWith(source, piped, 0, NewFakeQEMUOperations(nil, nil, fakeInfoRet, nil, nil, nil))
+	}
+
+	It("should write the image to the target while it is downloaded", func() {
+		data := make([]byte, 16*4096)
+		copy(data[4096:], bytes.Repeat([]byte{1}, 4096))
+		source := &mockPipedDataProvider{mockStreamingDataProvider: mockStreamingDataProvider{data: data}}
+		Expect(process(source, true)).To(Succeed())
+		Expect(source.pipes).To(Equal(1))
+		Expect(source.transfers).To(BeZero())
+		Expect(ioutil.ReadFile(dataFile)).To(Equal(data))
+	})
+
+	table.DescribeTable("should transfer qcow2 streams to scratch space before reading them", func(fileName string, header func([]byte)) {
+		data, err := ioutil.ReadFile(fileName)
+		Expect(err).NotTo(HaveOccurred())
+		header(data)
+		operations := &fakeScratchQEMUOperations{QEMUOperations: NewFakeQEMUOperations(nil, nil, fakeInfoRet, nil, nil, nil)}
+		Expect(processWith(NewStreamDataSource(pipeReader(data), int64(len(data))), true, 0, operations)).To(Succeed())
+		Expect(operations.converted).To(HavePrefix(scratchDir))
+		Expect(bytes.Equal(operations.data, data)).To(BeTrue())
+		Expect(dataFile).NotTo(BeAnExistingFile())
+	},
+		table.Entry("cirros", filepath.Join(imageDir, "cirros-qcow2.img"), func([]byte) {}),
+		table.Entry("with zlib compressed clusters", filepath.Join(imageDir, "compressed.qcow2"), func([]byte) {}),
+		table.Entry("with zstd compressed clusters", filepath.Join(imageDir, "compressed.qcow2"), func(data []byte) {
+			data[79] |= qcow2CompressionTypeBit
+			binary.BigEndian.PutUint32(data[100:], 112)
+			data[104] = qcow2CompressionZstd
+		}),
+	)
+
+	It("should fail instead of transferring to scratch space once the target was written", func() {
+		source := &mockPipedDataProvider{mockStreamingDataProvider: mockStreamingDataProvider{data: bytes.Repeat([]byte{1}, 4096)}, requiresConversionLate: true}
+		err := process(source, true)
+		Expect(err).To(HaveOccurred())
+		Expect(errors.Cause(err)).NotTo(Equal(ErrRequiresConversion))
+		Expect(err.Error()).To(ContainSubstring("unsupported feature"))
+		Expect(source.pipes).To(Equal(1))
+		Expect(source.transfers).To(BeZero())
+		Expect(dataFile).NotTo(BeAnExistingFile())
+	})
+
+	It("should fail the validation of images larger than the available space", func() {
+		source := &mockPipedDataProvider{mockStreamingDataProvider: mockStreamingDataProvider{data: bytes.Repeat([]byte{1}, 16*4096)}}
+		err := processWith(source, true, 8*4096, NewFakeQEMUOperations(nil, nil, fakeInfoRet, nil, nil, nil))
+		Expect(err).To(HaveOccurred())
+		Expect(errors.As(err, &ValidationSizeError{})).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("A larger PVC is required"))
+		Expect(source.transfers).To(BeZero())
+		Expect(dataFile).NotTo(BeAnExistingFile())
+	})
+
+	It("should remove the target holding a refused source", func() {
+		data := bytes.Repeat([]byte{1}, 4096)
+		dp := NewDataProcessor(NewStreamDataSource(pipeReader(data), int64(len(data))), dataFile, dataDir, scratchDir, "", 0.055, false)
+		dp.SetPipedConversion(true)
+		dp.SetChecksumAllowlist(ChecksumAllowlist{"sha256:" + sha256Hex([]byte("other image")): true})
+		var err error
+		replaceQEMUOperations(NewFakeQEMUOperations(errors.New("the refused source was converted"), nil, fakeInfoRet, nil, nil, nil), func() {
+			err = dp.ProcessData()
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("isn't in the checksum allowlist"))
+		Expect(dataFile).NotTo(BeAnExistingFile())
+	})
+
+	It("should validate the written image", func() {
+		source := &mockPipedDataProvider{mockStreamingDataProvider: mockStreamingDataProvider{data: bytes.Repeat([]byte{1}, 4096)}}
+		err := processWith(source, true, 0, NewFakeQEMUOperations(nil, nil, fakeInfoRet, errors.New("Virtual image size is larger than available size"), nil, nil))
+		Expect(err).To(HaveOccurred())
+		Expect(errors.As(err, &ValidationSizeError{})).To(BeTrue())
+		Expect(dataFile).NotTo(BeAnExistingFile())
+	})
+
+	It("should transfer the images requiring conversion to scratch space", func() {
+		source := &mockPipedDataProvider{mockStreamingDataProvider: mockStreamingDataProvider{data: []byte("vmdk")}, requiresConversion: true}
+		Expect(process(source, true)).To(Succeed())
+		Expect(source.pipes).To(Equal(1))
+		Expect(source.transfers).To(Equal(1))
+	})
+
+	It("should transfer the images to scratch space if not enabled", func() {
+		source := &mockPipedDataProvider{mockStreamingDataProvider: mockStreamingDataProvider{data: []byte("data")}}
+		Expect(process(source, false)).To(Succeed())
+		Expect(source.pipes).To(BeZero())
+		Expect(source.transfers).To(Equal(1))
+	})
+
+	It("should not pipe the conversion when qemu-img has to write the target", func() {
+		source := &mockPipedDataProvider{}
+		dp := NewDataProcessor(source, dataFile, dataDir, scratchDir, "", 0.055, false)
+		dp.SetPipedConversion(true)
+		_, ok := dp.pipedSource()
+		Expect(ok).To(BeTrue())
+		dp.SetImageCheck(true)
+		_, ok = dp.pipedSource()
+		Expect(ok).To(BeFalse())
+		dp.SetImageCheck(false)
+		dp.SetOverlayTarget(true)
+		_, ok = dp.pipedSource()
+		Expect(ok).To(BeFalse())
+		dp.SetOverlayTarget(false)
+		Expect(dp.SetNbdTarget("nbd+unix:///?socket=/tmp/nbd.sock")).To(Succeed())
+		_, ok = dp.pipedSource()
+		Expect(ok).To(BeFalse())
+	})
+})
@@ -0,0 +1,144 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// prefetchChunkSize is the size of a single slot in the prefetch ring buffer.
+const prefetchChunkSize = 64 * 1024
+
+// prefetchReader reads ahead of the consumer into a bounded ring of buffers using a separate goroutine.
+// The goroutine blocks once all the buffers are filled, and resumes as soon as the consumer frees one,
+// so at most bufferSize bytes are held in memory. Cancelling the context or closing the reader stops
+// the goroutine.
+type prefetchReader struct {
+	source io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelFunc
+	// free holds the empty buffers, filled the buffers waiting to be consumed, in order.
+	free   chan []byte
+	filled chan []byte
+	// chunk is the buffer currently being consumed, and remaining the unread part of it.
+	chunk     []byte
+	remaining []byte
+	// err is the error that stopped the goroutine, only valid once filled is closed.
+	err       error
+	closeOnce sync.Once
+}
+
+// newPrefetchReader creates a prefetchReader holding up to bufferSize bytes read ahead of the consumer and
+// starts reading from the source.
+func newPrefetchReader(ctx context.Context, source io.ReadCloser, bufferSize int64) *prefetchReader {
+	chunkSize := int64(prefetchChunkSize)
+	if bufferSize < chunkSize {
+		chunkSize = bufferSize
+	}
+	slots := int(bufferSize / chunkSize)
+	ctx, cancel := context.WithCancel(ctx)
+	r := &prefetchReader{
+		source: source,
+		ctx:    ctx,
+		cancel: cancel,
+		free:   make(chan []byte, slots),
+		filled: make(chan []byte, slots),
+	}
+	for i := 0; i < slots; i++ {
+		r.free <- make([]byte, chunkSize)
+	}
+	go r.fill()
+	return r
+}
+
+// withPrefetch wraps the passed in reader in a prefetchReader, if bufferSize is positive.
+func withPrefetch(ctx context.Context, source io.ReadCloser, bufferSize int64) io.ReadCloser {
+	if bufferSize <= 0 {
+		return source
+	}
+	return newPrefetchReader(ctx, source, bufferSize)
+}
+
+func (r *prefetchReader) fill() {
+	defer close(r.filled)
+	for {
+		var buf []byte
+		select {
+		case buf = <-r.free:
+		case <-r.ctx.Done():
+			r.err = r.ctx.Err()
+			return
+		}
+		if err := r.ctx.Err(); err != nil {
+			r.err = err
+			return
+		}
+		n, err := r.source.Read(buf)
+		if n > 0 {
+			select {
+			case r.filled <- buf[:n]:
+			case <-r.ctx.Done():
+				r.err = r.ctx.Err()
+				return
+			}
+		} else {
+			r.free <- buf
+		}
+		if err != nil {
+			r.err = err
+			return
+		}
+	}
+}
+
+// Read copies the prefetched data into p, blocking until data is available.
+func (r *prefetchReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(r.remaining) == 0 {
+		if r.chunk != nil {
+			// Never blocks, there are only as many buffers as slots in the channel.
+			r.free <- r.chunk[:cap(r.chunk)]
+			r.chunk = nil
+		}
+		select {
+		case chunk, ok := <-r.filled:
+			if !ok {
+				return 0, r.err
+			}
+			r.chunk, r.remaining = chunk, chunk
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+	n := copy(p, r.remaining)
+	r.remaining = r.remaining[n:]
+	return n, nil
+}
+
+// Close stops the prefetch goroutine and closes the source, it is safe to call Close more than once.
+func (r *prefetchReader) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		r.cancel()
+		err = r.source.Close()
+	})
+	return err
+}
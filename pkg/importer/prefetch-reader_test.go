@@ -0,0 +1,199 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pkg/errors"
+
+	cdiv1 "kubevirt.io/containerized-data-importer/pkg/apis/core/v1beta1"
+	"kubevirt.io/containerized-data-importer/pkg/image"
+)
+
+// jitteryReader returns at most chunkSize bytes per read, sleeping a random duration up to maxDelay before each read.
+type jitteryReader struct {
+	source    io.Reader
+	chunkSize int
+	maxDelay  time.Duration
+	random    *rand.Rand
+	bytesRead int64
+	closed    int32
+}
+
+func newJitteryReader(data []byte, chunkSize int, maxDelay time.Duration) *jitteryReader {
+	return &jitteryReader{
+		source:    bytes.NewReader(data),
+		chunkSize: chunkSize,
+		maxDelay:  maxDelay,
+		random:    rand.New(rand.NewSource(1)),
+	}
+}
+
+func (r *jitteryReader) Read(p []byte) (int, error) {
+	if r.maxDelay > 0 {
+		time.Sleep(time.Duration(r.random.Int63n(int64(r.maxDelay))))
+	}
+	if len(p) > r.chunkSize {
+		p = p[:r.chunkSize]
+	}
+	n, err := r.source.Read(p)
+	atomic.AddInt64(&r.bytesRead, int64(n))
+	return n, err
+}
+
+func (r *jitteryReader) Close() error {
+	atomic.StoreInt32(&r.closed, 1)
+	return nil
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func (r *errorReader) Close() error {
+	return nil
+}
+
+var _ = Describe("Prefetch reader", func() {
+	var data []byte
+
+	BeforeEach(func() {
+		data = make([]byte, 10*prefetchChunkSize+123)
+		rand.New(rand.NewSource(2)).Read(data)
+	})
+
+	It("should return the source data unchanged", func() {
+		source := newJitteryReader(data, 1000, 0)
+		r := newPrefetchReader(context.Background(), source, 4*prefetchChunkSize)
+		result, err := ioutil.ReadAll(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Equal(result, data)).To(BeTrue())
+		Expect(r.Close()).To(Succeed())
+		Expect(atomic.LoadInt32(&source.closed)).To(Equal(int32(1)))
+	})
+
+	It("should handle a buffer smaller than a chunk", func() {
+		r := newPrefetchReader(context.Background(), newJitteryReader(data, prefetchChunkSize, 0), 100)
+		defer r.Close()
+		result, err := ioutil.ReadAll(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Equal(result, data)).To(BeTrue())
+	})
+
+	It("should not read more than the buffer size ahead of the consumer", func() {
+		source := newJitteryReader(data, prefetchChunkSize, 0)
+		r := newPrefetchReader(context.Background(), source, 4*prefetchChunkSize)
+		defer r.Close()
+		Eventually(func() int64 {
+			return atomic.LoadInt64(&source.bytesRead)
+		}).Should(Equal(int64(4 * prefetchChunkSize)))
+		Consistently(func() int64 {
+			return atomic.LoadInt64(&source.bytesRead)
+		}, 200*time.Millisecond).Should(Equal(int64(4 * prefetchChunkSize)))
+
+		By("Consuming a chunk, the reader should fetch one more chunk")
+		_, err := io.ReadFull(r, make([]byte, prefetchChunkSize))
+		Expect(err).NotTo(HaveOccurred())
+		// The consumed buffer is only freed on the next read.
+		_, err = io.ReadFull(r, make([]byte, 1))
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(func() int64 {
+			return atomic.LoadInt64(&source.bytesRead)
+		}).Should(Equal(int64(5 * prefetchChunkSize)))
+	})
+
+	It("should return the source error", func() {
+		r := newPrefetchReader(context.Background(), &errorReader{err: errors.New("source failed")}, prefetchChunkSize)
+		defer r.Close()
+		_, err := ioutil.ReadAll(r)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(Equal("source failed"))
+	})
+
+	It("should stop reading when the context is cancelled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		source := newJitteryReader(data, prefetchChunkSize, 0)
+		r := newPrefetchReader(ctx, source, prefetchChunkSize)
+		defer r.Close()
+		cancel()
+		_, err := ioutil.ReadAll(r)
+		Expect(err).To(Equal(context.Canceled))
+		Expect(atomic.LoadInt64(&source.bytesRead)).To(BeNumerically("<=", 2*prefetchChunkSize))
+	})
+
+	It("should fail reads after Close", func() {
+		r := newPrefetchReader(context.Background(), newJitteryReader(data, prefetchChunkSize, 0), prefetchChunkSize)
+		Expect(r.Close()).To(Succeed())
+		Expect(r.Close()).To(Succeed())
+		_, err := ioutil.ReadAll(r)
+		Expect(err).To(Equal(context.Canceled))
+	})
+
+	It("withPrefetch should not wrap the reader if the buffer size is 0", func() {
+		source := newJitteryReader(data, prefetchChunkSize, 0)
+		Expect(withPrefetch(context.Background(), source, 0)).To(BeIdenticalTo(source))
+		r := withPrefetch(context.Background(), source, prefetchChunkSize)
+		defer r.Close()
+		Expect(r).To(BeAssignableToTypeOf(&prefetchReader{}))
+	})
+
+	It("should make the http data source go through scratch space", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(cirrosData)
+		}))
+		defer server.Close()
+		createNbdkitCurl = image.NewMockNbdkitCurl
+		defer func() { createNbdkitCurl = image.NewNbdkitCurl }()
+		hs, err := NewHTTPDataSourceWithOptions(server.URL+"/cirros.qcow2", "", "", "", cdiv1.DataVolumeKubeVirt, HTTPOptions{PrefetchBufferSize: prefetchChunkSize})
+		Expect(err).NotTo(HaveOccurred())
+		defer hs.Close()
+		// nbdkit would read from the endpoint without read-ahead.
+		Expect(hs.Info()).To(Equal(ProcessingPhaseTransferScratch))
+	})
+})
+
+// benchmarkJitteryReader copies from a jittery source to a consumer that takes a fixed time per chunk, like a
+// disk write would. Without read-ahead the source and consumer delays add up, with read-ahead they overlap.
+func benchmarkJitteryReader(b *testing.B, bufferSize int64) {
+	data := make([]byte, 64*prefetchChunkSize)
+	buf := make([]byte, prefetchChunkSize)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := withPrefetch(context.Background(), newJitteryReader(data, prefetchChunkSize, 2*time.Millisecond), bufferSize)
+		for {
+			_, err := io.ReadFull(r, buf)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		r.Close()
+	}
+}
+
+func BenchmarkJitteryReaderWithoutPrefetch(b *testing.B) {
+	benchmarkJitteryReader(b, 0)
+}
+
+func BenchmarkJitteryReaderWithPrefetch(b *testing.B) {
+	benchmarkJitteryReader(b, 16*prefetchChunkSize)
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ProbeResult describes the image of a data source, found from the headers of the source data without transferring
+// it.
+type ProbeResult struct {
+	// Format is the detected image format, raw if no image header was found.
+	Format string `json:"format"`
+	// Compression is the compression of the source data, gz, xz or zst, empty if not compressed.
+	Compression string `json:"compression,omitempty"`
+	// Archive is the archive format of the source data, tar, empty if not an archive.
+	Archive string `json:"archive,omitempty"`
+	// RawLayout is the layout of a raw disk, mbr, gpt or filesystem, empty if not raw or not recognized.
+	RawLayout string `json:"rawLayout,omitempty"`
+	// Snapshots is the number of internal snapshots of a qcow2 image, flattened by the conversion.
+	Snapshots int `json:"snapshots,omitempty"`
+	// InternalCompression is the compression of the clusters of a qcow2 image, zlib or zstd, empty if not compressed.
+	// The conversion decompresses the clusters, which takes more time and CPU than converting a plain image.
+	InternalCompression string `json:"internalCompression,omitempty"`
+	// VirtualSize is the size of the disk, 0 if unknown.
+	VirtualSize int64 `json:"virtualSize,omitempty"`
+	// ActualSize is the number of bytes of the source data, 0 if unknown.
+	ActualSize int64 `json:"actualSize,omitempty"`
+	// NextPhase is the phase the import would continue with.
+	NextPhase ProcessingPhase `json:"nextPhase"`
+	// RequiresScratch is true if the import would transfer the source data to scratch space.
+	RequiresScratch bool `json:"requiresScratch"`
+}
+
+// IsInternallyCompressed returns true if the source is a qcow2 image with compressed clusters, like the images written
+// by qemu-img convert -c.
+func (r *ProbeResult) IsInternallyCompressed() bool {
+	return r.InternalCompression != ""
+}
+
+// probedSource is implemented by the data sources able to describe the source data read by Info.
+type probedSource interface {
+	// probe returns the format readers created by Info, and the size of the source data, 0 or less if unknown.
+	probe() (*FormatReaders, int64)
+}
+
+// Probe runs the Info phase of source and describes the image it found, reading only the headers of the source data.
+// The source isn't meant to be transferred afterwards, it should be closed.
+func Probe(source DataSourceInterface) (*ProbeResult, error) {
+	ps, ok := source.(probedSource)
+	if !ok {
+		return nil, errors.Errorf("the data source %T can't be probed", source)
+	}
+	phase, err := source.Info()
+	if err != nil {
+		return nil, err
+	}
+	readers, size := ps.probe()
+	if readers == nil {
+		return nil, errors.New("the data source wasn't read by Info")
+	}
+	result := &ProbeResult{
+		Format:              detectedFormat(readers),
+		Compression:         compressionFormat(readers),
+		RawLayout:           readers.RawLayout,
+		Snapshots:           readers.Snapshots,
+		InternalCompression: readers.InternalCompression,
+		NextPhase:           phase,
+		RequiresScratch:     phase == ProcessingPhaseTransferScratch,
+	}
+	var contentLength uint64
+	if size > 0 {
+		result.ActualSize = size
+		contentLength = uint64(size)
+	}
+	if readers.TarArchive {
+		// The disk is only known once extracted.
+		result.Archive = "tar"
+	} else {
+		result.VirtualSize = sourceVirtualSize(readers, contentLength)
+	}
+	return result, nil
+}
@@ -0,0 +1,156 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Probe", func() {
+	var client *chunkedS3Client
+
+	BeforeEach(func() {
+		client = &chunkedS3Client{}
+		newClientFunc = func(endpoint, accKey, secKey string, certDir string, options s3ClientOptions) (S3Client, error) {
+			return client, nil
+		}
+	})
+
+	AfterEach(func() {
+		newClientFunc = getS3Client
+		newFTPClientFunc = getFTPClient
+	})
+
+	It("should describe a qcow2 image", func() {
+		client.data = cirrosData
+		sd, err := NewS3DataSource("http://amazon.com/bucket/cirros.qcow2", "", "", "")
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		result, err := Probe(sd)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(&ProbeResult{
+			Format:              "qcow2",
+			InternalCompression: "zlib",
+			VirtualSize:         46137344,
+			ActualSize:          int64(len(cirrosData)),
+			NextPhase:           ProcessingPhaseTransferScratch,
+			RequiresScratch:     true,
+		}))
+	})
+
+	It("should count the internal snapshots of a qcow2 image", func() {
+		var err error
+		client.data, err = ioutil.ReadFile(filepath.Join(imageDir, "snapshot.qcow2"))
+		Expect(err).NotTo(HaveOccurred())
+		sd, err := NewS3DataSource("http://amazon.com/bucket/snapshot.qcow2", "", "", "")
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		result, err := Probe(sd)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Format).To(Equal("qcow2"))
+		Expect(result.Snapshots).To(Equal(1))
+		Expect(result.NextPhase).To(Equal(ProcessingPhaseTransferScratch))
+	})
+
+	It("should report the internal compression of a qcow2 image", func() {
+		var err error
+		client.data, err = ioutil.ReadFile(filepath.Join(imageDir, "compressed.qcow2"))
+		Expect(err).NotTo(HaveOccurred())
+		sd, err := NewS3DataSource("http://amazon.com/bucket/compressed.qcow2", "", "", "")
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		result, err := Probe(sd)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Format).To(Equal("qcow2"))
+		Expect(result.InternalCompression).To(Equal("zlib"))
+		Expect(result.IsInternallyCompressed()).To(BeTrue())
+	})
+
+	It("should not report the internal compression of a plain qcow2 image", func() {
+		var err error
+		client.data, err = ioutil.ReadFile(filepath.Join(imageDir, "uncompressed.qcow2"))
+		Expect(err).NotTo(HaveOccurred())
+		sd, err := NewS3DataSource("http://amazon.com/bucket/uncompressed.qcow2", "", "", "")
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		result, err := Probe(sd)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Format).To(Equal("qcow2"))
+		Expect(result.VirtualSize).To(Equal(int64(64 * 1024)))
+		Expect(result.IsInternallyCompressed()).To(BeFalse())
+	})
+
+	It("should only read the headers of a raw image", func() {
+		client.data = bytes.Repeat([]byte{0x55}, 4*1024*1024)
+		sd, err := NewS3DataSource("http://amazon.com/bucket/disk.raw", "", "", "")
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		result, err := Probe(sd)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(&ProbeResult{
+			Format:      "raw",
+			VirtualSize: int64(len(client.data)),
+			ActualSize:  int64(len(client.data)),
+			NextPhase:   ProcessingPhaseTransferDataFile,
+		}))
+		Expect(client.body.offset).To(BeNumerically("<", len(client.data)/4))
+	})
+
+	It("should describe the layout of a raw disk", func() {
+		var err error
+		client.data, err = ioutil.ReadFile(ext4FilePath)
+		Expect(err).NotTo(HaveOccurred())
+		sd, err := NewS3DataSource("http://amazon.com/bucket/ext4.img", "", "", "")
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		dp := NewDataProcessor(sd, "dest", "dataDir", "scratchDataDir", "1G", 0.055, false)
+		result, err := Probe(sd)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.RawLayout).To(Equal(RawLayoutFilesystem))
+		Expect(result.NextPhase).To(Equal(ProcessingPhaseTransferDataFile))
+		Expect(dp.GetRawLayout()).To(Equal(RawLayoutFilesystem))
+	})
+
+	It("should describe a compressed tar archive", func() {
+		client.data = gzipData(tarArchive(tarEntry{name: "cirros.qcow2", data: cirrosData}))
+		sd, err := NewS3DataSource("http://amazon.com/bucket/cirros.tar.gz", "", "", "")
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		result, err := Probe(sd)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Format).To(Equal("raw"))
+		Expect(result.Compression).To(Equal("gz"))
+		Expect(result.Archive).To(Equal("tar"))
+		Expect(result.VirtualSize).To(BeZero())
+	})
+
+	It("should describe an image of unknown size", func() {
+		newFTPClientFunc = func(ep *url.URL, user, password, certDir string, pins spkiPins) (FTPClient, error) {
+			return &mockFTPClient{data: tinyCoreData(), noSize: true}, nil
+		}
+		fd, err := NewFTPDataSource("ftp://images.example.com/tinycore.iso", "", "", "", FTPOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		defer fd.Close()
+		result, err := Probe(fd)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Format).To(Equal("raw"))
+		Expect(result.ActualSize).To(BeZero())
+		Expect(result.VirtualSize).To(BeZero())
+	})
+
+	It("should serialize to JSON", func() {
+		data, err := json.Marshal(&ProbeResult{Format: "qcow2", VirtualSize: 1024, NextPhase: ProcessingPhaseTransferScratch, RequiresScratch: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(MatchJSON(`{"format":"qcow2","virtualSize":1024,"nextPhase":"TransferScratch","requiresScratch":true}`))
+	})
+
+	It("should fail for sources that can't be probed", func() {
+		_, err := Probe(&MockDataProvider{infoResponse: ProcessingPhaseTransferScratch})
+		Expect(err).To(MatchError("the data source *importer.MockDataProvider can't be probed"))
+	})
+})
@@ -0,0 +1,98 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"sync"
+	"time"
+
+	prometheusutil "kubevirt.io/containerized-data-importer/pkg/util/prometheus"
+)
+
+// ProgressFunc receives the progress of a transfer: the number of bytes read from the source so far, the total
+// number of bytes of the source, -1 if unknown, and the time elapsed since the transfer started.
+type ProgressFunc func(current, total int64, elapsed time.Duration)
+
+// may be overridden in tests
+var progressFuncInterval = time.Second
+
+// readersSource is implemented by the data sources reading the source data through format readers.
+type readersSource interface {
+	// formatReaders returns the format readers created by Info, nil before.
+	formatReaders() *FormatReaders
+}
+
+// progressReporter calls a ProgressFunc with the progress of a progress reader on an interval.
+type progressReporter struct {
+	reader *prometheusutil.ProgressReader
+	stop   chan struct{}
+	// done is closed once the reporter doesn't call the ProgressFunc anymore, after reporting the completion.
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// startProgressReporter starts calling fn with the progress of reader.
+func startProgressReporter(fn ProgressFunc, reader *prometheusutil.ProgressReader) *progressReporter {
+	r := &progressReporter{
+		reader: reader,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go r.run(fn)
+	return r
+}
+
+func (r *progressReporter) run(fn ProgressFunc) {
+	defer close(r.done)
+	start := time.Now()
+	ticker := time.NewTicker(progressFuncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			// Report the completion unless the ticker came first.
+			if r.reader.Done {
+				fn(int64(r.reader.Current), r.total(), time.Since(start))
+			}
+			return
+		case <-ticker.C:
+			fn(int64(r.reader.Current), r.total(), time.Since(start))
+			if r.reader.Done {
+				return
+			}
+		}
+	}
+}
+
+// Stop stops the calls, and waits for a call in progress to return.
+func (r *progressReporter) Stop() {
+	if r == nil {
+		return
+	}
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+	<-r.done
+}
+
+// total returns the total number of bytes of the reader, -1 if unknown.
+func (r *progressReporter) total() int64 {
+	if total := r.reader.Total(); total > 0 {
+		return int64(total)
+	}
+	return -1
+}
@@ -0,0 +1,121 @@
+package importer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// progressCall records the arguments of a ProgressFunc call.
+type progressCall struct {
+	current, total int64
+	elapsed        time.Duration
+}
+
+var _ = Describe("Progress callback", func() {
+	var (
+		mutex  sync.Mutex
+		calls  []progressCall
+		tmpDir string
+		err    error
+	)
+
+	recorded := func() []progressCall {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]progressCall(nil), calls...)
+	}
+
+	// info runs the Info phase of source through a data processor recording the calls of its progress func.
+	info := func(source DataSourceInterface) {
+		dp := NewDataProcessor(source, "", tmpDir, "", "", 0.055, false)
+		dp.SetProgressFunc(func(current, total int64, elapsed time.Duration) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			calls = append(calls, progressCall{current, total, elapsed})
+		})
+		_, err := dp.sourceInfo()
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		calls = nil
+		progressFuncInterval = 10 * time.Millisecond
+		tmpDir, err = ioutil.TempDir("", "progress")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		progressFuncInterval = time.Second
+		newAzureBlobClientFunc = getAzureBlobClient
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should report the transfer to scratch space of a source of known size", func() {
+		newAzureBlobClientFunc = func(serviceURL *url.URL, accountName, credential, certDir string, pins spkiPins, retryAfterBudget time.Duration) (AzureBlobClient, error) {
+			return &mockAzureBlobClient{data: cirrosData, blobType: AzureBlockBlob}, nil
+		}
+		ad, err := NewAzureBlobDataSource("az://images/cirros.qcow2", "goldenimages", "", "", AzureBlobOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		info(ad)
+		_, err = ad.Transfer(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ad.Close()).To(Succeed())
+		result := recorded()
+		Expect(result).NotTo(BeEmpty())
+		last := result[len(result)-1]
+		Expect(last.current).To(Equal(int64(len(cirrosData))))
+		Expect(last.total).To(Equal(int64(len(cirrosData))))
+		for i := 1; i < len(result); i++ {
+			Expect(result[i].current).To(BeNumerically(">=", result[i-1].current))
+			Expect(result[i].elapsed).To(BeNumerically(">=", result[i-1].elapsed))
+		}
+	})
+
+	It("should report the transfer to the target of a source of unknown size", func() {
+		ud := NewUploadDataSource(ioutil.NopCloser(bytes.NewReader(tinyCoreData())))
+		info(ud)
+		_, err = ud.TransferFile(filepath.Join(tmpDir, "disk.img"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ud.Close()).To(Succeed())
+		result := recorded()
+		Expect(result).NotTo(BeEmpty())
+		Expect(result[len(result)-1].current).To(Equal(int64(len(tinyCoreData()))))
+		Expect(result[len(result)-1].total).To(Equal(int64(-1)))
+	})
+
+	It("should stop reporting when the source is closed during the transfer", func() {
+		reader, writer := io.Pipe()
+		go func() {
+			writer.Write(cirrosData[:1024*1024])
+		}()
+		ud := NewUploadDataSource(reader)
+		info(ud)
+		done := make(chan error)
+		go func() {
+			_, err := ud.Transfer(tmpDir)
+			done <- err
+		}()
+		Eventually(func() int { return len(recorded()) }).Should(BeNumerically(">", 2))
+		Expect(ud.Close()).To(Succeed())
+		Eventually(done).Should(Receive(HaveOccurred()))
+		count := len(recorded())
+		Consistently(func() int { return len(recorded()) }, 100*time.Millisecond).Should(Equal(count))
+		Expect(recorded()[count-1].current).To(BeNumerically("<", len(cirrosData)))
+	})
+})
+
+// tinyCoreData returns the content of the raw tinyCore image.
+func tinyCoreData() []byte {
+	data, err := readFile(tinyCoreFilePath)
+	Expect(err).NotTo(HaveOccurred())
+	return data
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"k8s.io/klog/v2"
+
+	progresspb "kubevirt.io/containerized-data-importer/pkg/importer/progress"
+	prometheusutil "kubevirt.io/containerized-data-importer/pkg/util/prometheus"
+)
+
+const (
+	// progressServiceStopTimeout is how long stopping the service waits for the subscribers to receive the last status.
+	progressServiceStopTimeout = 5 * time.Second
+)
+
+// progressUpdateInterval is the interval of the status updates between phase transitions, may be overridden in tests.
+var progressUpdateInterval = time.Second
+
+// ProgressService is the gRPC service streaming the phase, the progress and the throughput of the import to its
+// subscribers. The progress is sampled from the counting reader of the source data, the data processor notifies the
+// phase transitions. Clients authenticate with a certificate signed by the client CA.
+type ProgressService struct {
+	server   *grpc.Server
+	listener net.Listener
+
+	mutex   sync.Mutex
+	phase   ProcessingPhase
+	message string
+	done    bool
+	reader  *prometheusutil.ProgressReader
+	// changed is closed and replaced on every phase transition, to wake up the subscribers.
+	changed chan struct{}
+}
+
+// StartProgressService starts the progress service on address, the data processors it is passed to report to it.
+// certDir holds the server certificate tls.crt, its key tls.key, and the CA ca.crt the client certificates have to be
+// signed by.
+func StartProgressService(address, certDir string) (*ProgressService, error) {
+	tlsConfig, err := progressServiceTLSConfig(certDir)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to listen on %s", address)
+	}
+	s := &ProgressService{
+		server:   grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig))),
+		listener: listener,
+		phase:    ProcessingPhaseInfo,
+		changed:  make(chan struct{}),
+	}
+	progresspb.RegisterImportProgressServer(s.server, s)
+	go func() {
+		if err := s.server.Serve(listener); err != nil {
+			klog.Errorf("Progress service stopped: %v", err)
+		}
+	}()
+	klog.V(1).Infof("Serving the import progress on %s", listener.Addr())
+	return s, nil
+}
+
+// progressServiceTLSConfig returns the TLS configuration of the service, requiring client certificates.
+func progressServiceTLSConfig(certDir string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(filepath.Join(certDir, "tls.crt"), filepath.Join(certDir, "tls.key"))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load the progress service certificate")
+	}
+	caPEM, err := ioutil.ReadFile(filepath.Join(certDir, "ca.crt"))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read the progress service client CA")
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no certificate found in the progress service client CA")
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Address returns the address the service listens on.
+func (s *ProgressService) Address() string {
+	return s.listener.Addr().String()
+}
+
+// Stop stops the service once the subscribers received the last status, or after a timeout.
+func (s *ProgressService) Stop() {
+	if s == nil {
+		return
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(progressServiceStopTimeout):
+		s.server.Stop()
+	}
+}
+
+// Watch implements the ImportProgress service, it streams the status of the import until the import is done.
+func (s *ProgressService) Watch(req *progresspb.WatchRequest, stream progresspb.ImportProgress_WatchServer) error {
+	ticker := time.NewTicker(progressUpdateInterval)
+	defer ticker.Stop()
+	var previous *progresspb.ImportStatus
+	var previousTime time.Time
+	for {
+		status, changed := s.status()
+		now := time.Now()
+		if previous != nil {
+			if elapsed := now.Sub(previousTime).Seconds(); elapsed > 0 {
+				status.Throughput = float64(status.BytesTransferred-previous.BytesTransferred) / elapsed
+			}
+		}
+		previous, previousTime = status, now
+		if err := stream.Send(status); err != nil {
+			return err
+		}
+		if status.Done {
+			return nil
+		}
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// status returns the current status, without throughput, and the channel closed on the next phase transition.
+func (s *ProgressService) status() (*progresspb.ImportStatus, chan struct{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status := &progresspb.ImportStatus{
+		Phase:   string(s.phase),
+		Message: s.message,
+		Done:    s.done,
+	}
+	if s.reader != nil {
+		status.Progress = s.reader.Progress()
+		status.BytesTransferred = int64(s.reader.Current)
+	}
+	return status, s.changed
+}
+
+// trackProgress makes the service report the progress of the passed in reader of the source data.
+func (s *ProgressService) trackProgress(reader *prometheusutil.ProgressReader) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reader = reader
+}
+
+// setPhase records a phase transition of the import, the complete phase ends the import.
+func (s *ProgressService) setPhase(phase ProcessingPhase) {
+	s.update(phase, "", phase == ProcessingPhaseComplete)
+}
+
+// fail records the failure of the import, which ends it.
+func (s *ProgressService) fail(err error) {
+	s.update(ProcessingPhaseError, err.Error(), true)
+}
+
+func (s *ProgressService) update(phase ProcessingPhase, message string, done bool) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.phase, s.message, s.done = phase, message, done
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
@@ -0,0 +1,169 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	progresspb "kubevirt.io/containerized-data-importer/pkg/importer/progress"
+	"kubevirt.io/containerized-data-importer/pkg/util/cert"
+	"kubevirt.io/containerized-data-importer/pkg/util/cert/triple"
+)
+
+var _ = Describe("Progress service", func() {
+	var (
+		tmpDir       string
+		service      *ProgressService
+		ca           *triple.KeyPair
+		origInterval time.Duration
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "progress")
+		Expect(err).NotTo(HaveOccurred())
+		certDir := filepath.Join(tmpDir, "certs")
+		Expect(os.Mkdir(certDir, 0755)).To(Succeed())
+		ca, err = triple.NewCA("progress-ca")
+		Expect(err).NotTo(HaveOccurred())
+		server, err := triple.NewServerKeyPair(ca, "importer", "importer", "default", "cluster.local", []string{"127.0.0.1"}, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(certDir, "tls.crt"), cert.EncodeCertPEM(server.Cert), 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(certDir, "tls.key"), cert.EncodePrivateKeyPEM(server.Key), 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(certDir, "ca.crt"), cert.EncodeCertPEM(ca.Cert), 0600)).To(Succeed())
+		origInterval = progressUpdateInterval
+		progressUpdateInterval = 20 * time.Millisecond
+		service, err = StartProgressService("127.0.0.1:0", certDir)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		service.Stop()
+		progressUpdateInterval = origInterval
+		os.RemoveAll(tmpDir)
+	})
+
+	// watch subscribes to the status updates, authenticating with a client certificate signed by the CA if
+	// authenticated is true.
+	watch := func(authenticated bool) (progresspb.ImportProgress_WatchClient, func(), error) {
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.Cert)
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if authenticated {
+			client, err := triple.NewClientKeyPair(ca, "control-plane", nil)
+			Expect(err).NotTo(HaveOccurred())
+			tlsConfig.Certificates = []tls.Certificate{{
+				Certificate: [][]byte{client.Cert.Raw},
+				PrivateKey:  client.Key,
+			}}
+		}
+		conn, err := grpc.Dial(service.Address(), grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+		Expect(err).NotTo(HaveOccurred())
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		stream, err := progresspb.NewImportProgressClient(conn).Watch(ctx, &progresspb.WatchRequest{})
+		return stream, func() {
+			cancel()
+			conn.Close()
+		}, err
+	}
+
+	It("should stream the progress of a running transfer", func() {
+		stream, closeStream, err := watch(true)
+		defer closeStream()
+		Expect(err).NotTo(HaveOccurred())
+		first, err := stream.Recv()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(first.Phase).To(Equal(string(ProcessingPhaseInfo)))
+
+		received := make(chan []*progresspb.ImportStatus)
+		go func() {
+			defer GinkgoRecover()
+			var statuses []*progresspb.ImportStatus
+			for {
+				status, err := stream.Recv()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).NotTo(HaveOccurred())
+				statuses = append(statuses, status)
+			}
+			received <- statuses
+		}()
+
+		data := bytes.Repeat([]byte{0x55}, 40*4096)
+		source := NewUploadDataSource(ioutil.NopCloser(&slowReader{reader: bytes.NewReader(data), delay: 10 * time.Millisecond}))
+		Expect(os.Mkdir(filepath.Join(tmpDir, "data"), 0755)).To(Succeed())
+		dp := NewDataProcessor(source, filepath.Join(tmpDir, "data", "disk.img"), filepath.Join(tmpDir, "data"), "", "", 0.055, false)
+		dp.SetProgressService(service)
+		replaceQEMUOperations(NewFakeQEMUOperations(nil, nil, fakeInfoRet, nil, nil, nil), func() {
+			Expect(dp.ProcessData()).To(Succeed())
+		})
+
+		var statuses []*progresspb.ImportStatus
+		Eventually(received, 10*time.Second).Should(Receive(&statuses))
+		last := statuses[len(statuses)-1]
+		Expect(last.Phase).To(Equal(string(ProcessingPhaseComplete)))
+		Expect(last.Done).To(BeTrue())
+		Expect(last.BytesTransferred).To(BeEquivalentTo(len(data)))
+
+		var phases []string
+		var transferring []*progresspb.ImportStatus
+		for _, status := range statuses {
+			if len(phases) == 0 && status.Phase == string(ProcessingPhaseInfo) {
+				// Periodic updates of the Info phase may follow the first one before the transfer starts.
+				continue
+			}
+			if len(phases) == 0 || phases[len(phases)-1] != status.Phase {
+				phases = append(phases, status.Phase)
+			}
+			if status.Phase == string(ProcessingPhaseTransferDataFile) {
+				transferring = append(transferring, status)
+			}
+		}
+		Expect(phases).To(Equal([]string{
+			string(ProcessingPhaseTransferDataFile),
+			string(ProcessingPhaseResize),
+			string(ProcessingPhaseComplete),
+		}))
+		// The updates during the transfer report the growing byte count and the throughput.
+		Expect(len(transferring)).To(BeNumerically(">", 2))
+		Expect(transferring[len(transferring)-1].BytesTransferred).To(BeNumerically(">", transferring[0].BytesTransferred))
+		Expect(transferring[len(transferring)-1].Throughput).To(BeNumerically(">", 0))
+	})
+
+	It("should report the failure of the import", func() {
+		stream, closeStream, err := watch(true)
+		defer closeStream()
+		Expect(err).NotTo(HaveOccurred())
+		dp := NewDataProcessor(&MockDataProvider{infoResponse: ProcessingPhaseError}, "", tmpDir, "", "", 0.055, false)
+		dp.SetProgressService(service)
+		Expect(dp.ProcessData()).NotTo(Succeed())
+		var status *progresspb.ImportStatus
+		for status == nil || !status.Done {
+			status, err = stream.Recv()
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(status.Phase).To(Equal(string(ProcessingPhaseError)))
+		Expect(status.Message).To(ContainSubstring("Info errored"))
+	})
+
+	It("should refuse clients without certificate", func() {
+		stream, closeStream, err := watch(false)
+		defer closeStream()
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		Expect(err).To(HaveOccurred())
+	})
+})
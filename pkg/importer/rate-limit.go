@@ -0,0 +1,104 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a token bucket of bytes filled at a constant rate, up to one second worth of bytes. Readers take the
+// bytes they read from the bucket, and wait for the bucket to refill if it is in debt.
+type tokenBucket struct {
+	sync.Mutex
+	// rate is the number of bytes added per second.
+	rate int64
+	// tokens is the number of bytes available, negative if taken in advance.
+	tokens float64
+	// last is the time the bucket was last refilled.
+	last time.Time
+}
+
+// newTokenBucket returns an empty bucket filled with rate bytes per second.
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: rate, last: time.Now()}
+}
+
+// newRateLimit returns the bucket limiting the readers of a data source to bytesPerSec bytes per second, shared among
+// all of them, nil if bytesPerSec is 0 or less.
+func newRateLimit(bytesPerSec int64) *tokenBucket {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return newTokenBucket(bytesPerSec)
+}
+
+// take takes n bytes from the bucket, waiting until the bucket isn't in debt anymore or ctx is done.
+func (b *tokenBucket) take(ctx context.Context, n int) error {
+	b.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if b.tokens > float64(b.rate) {
+		b.tokens = float64(b.rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+	}
+	b.Unlock()
+	if delay == 0 {
+		return nil
+	}
+	return sleepWithContext(ctx, delay)
+}
+
+// rateLimitedReader reads from a reader no faster than the rate of the bucket.
+type rateLimitedReader struct {
+	ctx    context.Context
+	reader io.ReadCloser
+	bucket *tokenBucket
+}
+
+// withRateLimit returns reader limited by the rate of bucket, reader if bucket is nil.
+func withRateLimit(ctx context.Context, reader io.ReadCloser, bucket *tokenBucket) io.ReadCloser {
+	if bucket == nil {
+		return reader
+	}
+	return &rateLimitedReader{ctx: ctx, reader: reader, bucket: bucket}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	// Reading at most one second worth of bytes keeps the transfer smooth.
+	if int64(len(p)) > r.bucket.rate {
+		p = p[:r.bucket.rate]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if waitErr := r.bucket.take(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (r *rateLimitedReader) Close() error {
+	return r.reader.Close()
+}
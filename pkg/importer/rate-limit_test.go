@@ -0,0 +1,90 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	cdiv1 "kubevirt.io/containerized-data-importer/pkg/apis/core/v1beta1"
+	"kubevirt.io/containerized-data-importer/pkg/image"
+)
+
+var _ = Describe("Rate limit", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "ratelimit")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		newClientFunc = getS3Client
+		createNbdkitCurl = image.NewNbdkitCurl
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should not limit readers without rate limit", func() {
+		reader := ioutil.NopCloser(bytes.NewReader(cirrosData))
+		Expect(withRateLimit(context.Background(), reader, newRateLimit(0))).To(BeIdenticalTo(reader))
+	})
+
+	It("should transfer no faster than the rate limit", func() {
+		const rate = 64 * 1024
+		data := bytes.Repeat([]byte{0x55}, 80*1024)
+		newClientFunc = func(endpoint, accKey, secKey string, certDir string, options s3ClientOptions) (S3Client, error) {
+			return &s3DataClient{data: data}, nil
+		}
+		start := time.Now()
+		sd, err := NewS3DataSourceWithOptions("http://amazon.com/bucket/disk.raw", "", "", "", S3Options{RateLimit: rate})
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		result, err := sd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseTransferDataFile))
+		target := filepath.Join(tmpDir, "disk.img")
+		result, err = sd.TransferFile(target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseResize))
+		Expect(time.Since(start)).To(BeNumerically(">=", time.Duration(len(data))*time.Second/rate))
+		written, err := ioutil.ReadFile(target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(written).To(Equal(data))
+	})
+
+	It("should make the http data source go through scratch space", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(cirrosData)
+		}))
+		defer server.Close()
+		createNbdkitCurl = image.NewMockNbdkitCurl
+		hs, err := NewHTTPDataSourceWithOptions(server.URL+"/cirros.qcow2", "", "", "", cdiv1.DataVolumeKubeVirt, HTTPOptions{RateLimit: 1024 * 1024})
+		Expect(err).NotTo(HaveOccurred())
+		defer hs.Close()
+		// nbdkit would read from the endpoint without the limit.
+		Expect(hs.Info()).To(Equal(ProcessingPhaseTransferScratch))
+	})
+
+	It("should make readers wait for the bytes taken beyond the rate", func() {
+		bucket := newTokenBucket(1000)
+		start := time.Now()
+		Expect(bucket.take(context.Background(), 250)).To(Succeed())
+		Expect(bucket.take(context.Background(), 250)).To(Succeed())
+		Expect(time.Since(start)).To(BeNumerically(">=", 500*time.Millisecond))
+	})
+
+	It("should stop waiting when the context is done", func() {
+		bucket := newTokenBucket(1)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		Expect(bucket.take(ctx, 10)).To(MatchError(context.Canceled))
+	})
+})
@@ -0,0 +1,89 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	// RawLayoutMBR is the layout of a raw disk partitioned with a master boot record.
+	RawLayoutMBR = "mbr"
+	// RawLayoutGPT is the layout of a raw disk partitioned with a GUID partition table.
+	RawLayoutGPT = "gpt"
+	// RawLayoutFilesystem is the layout of a raw image of a bare filesystem, without partition table.
+	RawLayoutFilesystem = "filesystem"
+
+	// rawLayoutPeekSize covers the GPT header at LBA 1 and the ext superblock at offset 1024.
+	rawLayoutPeekSize = 2048
+	// mbrSignatureOffset is the offset of the 0x55 0xAA boot signature of the MBR, and of FAT and NTFS boot sectors.
+	mbrSignatureOffset = 510
+	// gptHeaderOffset is the offset of the GPT header of a disk of 512 byte sectors.
+	gptHeaderOffset = 512
+	// extMagicOffset is the offset of the magic of the ext2, ext3 and ext4 superblock.
+	extMagicOffset = 1024 + 56
+	extMagic       = 0xEF53
+)
+
+var (
+	gptSignature = []byte("EFI PART")
+	xfsMagic     = []byte("XFSB")
+	ntfsOEMID    = []byte("NTFS    ")
+)
+
+// detectRawLayout returns the layout of the raw disk starting with data: partitioned with an MBR or a GPT, or a bare
+// filesystem. Returns an empty string if the layout isn't recognized.
+func detectRawLayout(data []byte) string {
+	switch {
+	case len(data) >= gptHeaderOffset+len(gptSignature) && bytes.Equal(data[gptHeaderOffset:gptHeaderOffset+len(gptSignature)], gptSignature):
+		// The GPT follows a protective MBR, the GPT header tells them apart.
+		return RawLayoutGPT
+	case len(data) >= mbrSignatureOffset+2 && data[mbrSignatureOffset] == 0x55 && data[mbrSignatureOffset+1] == 0xAA:
+		if isFATOrNTFSBootSector(data) {
+			return RawLayoutFilesystem
+		}
+		return RawLayoutMBR
+	case len(data) >= extMagicOffset+2 && binary.LittleEndian.Uint16(data[extMagicOffset:]) == extMagic:
+		return RawLayoutFilesystem
+	case bytes.HasPrefix(data, xfsMagic):
+		return RawLayoutFilesystem
+	}
+	return ""
+}
+
+// isFATOrNTFSBootSector returns true if data starts with the boot sector of a FAT or NTFS filesystem, which ends with
+// the same signature as an MBR.
+func isFATOrNTFSBootSector(data []byte) bool {
+	return bytes.HasPrefix(data[3:], ntfsOEMID) ||
+		bytes.HasPrefix(data[54:], []byte("FAT")) ||
+		bytes.HasPrefix(data[82:], []byte("FAT32"))
+}
+
+// peek returns up to size bytes of the data of the top reader, which are read again by the next reads.
+func (fr *FormatReaders) peek(size int) []byte {
+	top := fr.TopReader()
+	ahead := make([]byte, size)
+	n, _ := io.ReadFull(top, ahead)
+	// The top reader is replaced rather than stacked, the number of readers depends only on the formats found.
+	fr.readers[len(fr.readers)-1].rdr = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(ahead[:n]), top), top}
+	return ahead[:n]
+}
@@ -23,6 +23,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/blang/semver"
 	"github.com/pkg/errors"
 
 	"k8s.io/klog/v2"
@@ -47,19 +48,55 @@ type RegistryDataSource struct {
 	certDir     string
 	insecureTLS bool
 	imageDir    string
+	// strategy used to pick the image file if the image directory contains several files.
+	archiveMemberSelection ArchiveMemberSelection
 	//The discovered image file in scratch space.
 	url *url.URL
+	// describes the copied image for the import manifest
+	imageInfo *registryImageInfo
+	// if set, the image is the highest semver tag of the endpoint repository in the range.
+	tagConstraint semver.Range
+	// the endpoint including the selected tag.
+	resolvedEndpoint string
+}
+
+// RegistryOptions are the options of the Registry Data Source.
+type RegistryOptions struct {
+	// InsecureTLS skips the verification of the certificate of the registry.
+	InsecureTLS bool
+	// ArchiveMemberSelection is the strategy picking the image file when the image directory contains several files.
+	ArchiveMemberSelection ArchiveMemberSelection
+	// TagConstraint makes Transfer import the highest semver tag of the endpoint repository satisfying it, for
+	// instance ">=1.2.0 <2.0.0". The endpoint must not include a tag. Empty imports the endpoint as is.
+	TagConstraint string
 }
 
 // NewRegistryDataSource creates a new instance of the Registry Data Source.
 func NewRegistryDataSource(endpoint, accessKey, secKey, certDir string, insecureTLS bool) *RegistryDataSource {
 	return &RegistryDataSource{
-		endpoint:    endpoint,
-		accessKey:   accessKey,
-		secKey:      secKey,
-		certDir:     certDir,
-		insecureTLS: insecureTLS,
+		endpoint:               endpoint,
+		accessKey:              accessKey,
+		secKey:                 secKey,
+		certDir:                certDir,
+		insecureTLS:            insecureTLS,
+		archiveMemberSelection: ArchiveMemberSelectionFailIfAmbiguous,
+	}
+}
+
+// NewRegistryDataSourceWithOptions creates a new instance of the Registry Data Source with options.
+func NewRegistryDataSourceWithOptions(endpoint, accessKey, secKey, certDir string, options RegistryOptions) (*RegistryDataSource, error) {
+	rd := NewRegistryDataSource(endpoint, accessKey, secKey, certDir, options.InsecureTLS)
+	if options.ArchiveMemberSelection != "" {
+		rd.archiveMemberSelection = options.ArchiveMemberSelection
 	}
+	if options.TagConstraint != "" {
+		versionRange, err := semver.ParseRange(options.TagConstraint)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid tag constraint %q", options.TagConstraint)
+		}
+		rd.tagConstraint = versionRange
+	}
+	return rd, nil
 }
 
 // Info is called to get initial information about the data. No information available for registry currently.
@@ -79,13 +116,22 @@ func (rd *RegistryDataSource) Transfer(path string) (ProcessingPhase, error) {
 	}
 	rd.imageDir = filepath.Join(path, containerDiskImageDir)
 
+	rd.resolvedEndpoint = rd.endpoint
+	if rd.tagConstraint != nil {
+		tag, err := latestRegistryTag(rd.endpoint, rd.tagConstraint, rd.accessKey, rd.secKey, rd.certDir, rd.insecureTLS)
+		if err != nil {
+			return ProcessingPhaseError, errors.Wrapf(err, "Failed to select registry image tag")
+		}
+		rd.resolvedEndpoint = rd.endpoint + ":" + tag
+	}
+
 	klog.V(1).Infof("Copying registry image to scratch space.")
-	err = CopyRegistryImage(rd.endpoint, path, containerDiskImageDir, rd.accessKey, rd.secKey, rd.certDir, rd.insecureTLS)
+	rd.imageInfo, err = copyRegistryImage(rd.resolvedEndpoint, path, containerDiskImageDir, rd.accessKey, rd.secKey, rd.certDir, rd.insecureTLS, true)
 	if err != nil {
 		return ProcessingPhaseError, errors.Wrapf(err, "Failed to read registry image")
 	}
 
-	imageFile, err := getImageFileName(rd.imageDir)
+	imageFile, err := getImageFileName(rd.imageDir, rd.archiveMemberSelection)
 	if err != nil {
 		return ProcessingPhaseError, errors.Wrapf(err, "Cannot locate image file")
 	}
@@ -112,7 +158,21 @@ func (rd *RegistryDataSource) Close() error {
 	return nil
 }
 
-func getImageFileName(dir string) (string, error) {
+func (rd *RegistryDataSource) addToManifest(manifest *ImportManifest) {
+	manifest.Source.URL = rd.resolvedEndpoint
+	if rd.imageInfo == nil {
+		return
+	}
+	manifest.Source.Digest = rd.imageInfo.digest
+	manifest.SourceSize = rd.imageInfo.layerSize
+	manifest.addDecompress(rd.imageInfo.layerCompression)
+	if rd.imageInfo.diskLayer {
+		return
+	}
+	manifest.Transforms = append(manifest.Transforms, ImportManifestTransform{Type: ManifestTransformExtract, Format: "tar", Member: rd.imageInfo.member})
+}
+
+func getImageFileName(dir string, selection ArchiveMemberSelection) (string, error) {
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		klog.Errorf("image directory does not exist")
 		return "", errors.Errorf("image directory does not exist")
@@ -129,17 +189,29 @@ func getImageFileName(dir string) (string, error) {
 		return "", errors.New("image file does not exist in image directory - directory is empty")
 	}
 
-	if len(entries) > 1 {
-		klog.Errorf("image directory contains more than one file")
-		return "", errors.New("image directory contains more than one file")
+	var candidates []os.FileInfo
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			candidates = append(candidates, entry)
+		}
 	}
 
-	fileinfo := entries[0]
-	if fileinfo.IsDir() {
+	if len(candidates) == 0 {
 		klog.Errorf("image file does not exist in image directory contains another directory ")
 		return "", errors.New("image directory contains another directory")
 	}
 
+	fileinfo, err := selectArchiveMember(candidates, selection)
+	if err == ErrAmbiguousArchiveMember {
+		klog.Errorf("image directory contains more than one file")
+		return "", errors.New("image directory contains more than one file")
+	} else if err != nil {
+		return "", err
+	}
+	if len(candidates) > 1 {
+		klog.V(1).Infof("Selected %s out of %d files using %q selection", fileinfo.Name(), len(candidates), selection)
+	}
+
 	filename := fileinfo.Name()
 
 	if len(strings.TrimSpace(filename)) == 0 {
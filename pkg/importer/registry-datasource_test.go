@@ -73,7 +73,7 @@ var _ = Describe("Registry data source", func() {
 	})
 
 	It("getImageFileName should return an error with non-existing image directory", func() {
-		_, err := getImageFileName("/invalid")
+		_, err := getImageFileName("/invalid", ArchiveMemberSelectionFailIfAmbiguous)
 		Expect(err).To(HaveOccurred())
 		Expect("image directory does not exist").To(Equal(err.Error()))
 	})
@@ -81,7 +81,7 @@ var _ = Describe("Registry data source", func() {
 	It("getImageFileName should return an error with invalid image directory", func() {
 		file, err := os.Create(filepath.Join(tmpDir, "test"))
 		Expect(err).NotTo(HaveOccurred())
-		_, err = getImageFileName(file.Name())
+		_, err = getImageFileName(file.Name(), ArchiveMemberSelectionFailIfAmbiguous)
 		Expect(err).To(HaveOccurred())
 		Expect(strings.Contains(err.Error(), "image file does not exist in image directory")).To(BeTrue())
 	})
@@ -89,7 +89,7 @@ var _ = Describe("Registry data source", func() {
 	It("getImageFileName should return an error with empty image directory", func() {
 		err := os.Mkdir(filepath.Join(tmpDir, containerDiskImageDir), os.ModeDir)
 		Expect(err).NotTo(HaveOccurred())
-		_, err = getImageFileName(filepath.Join(tmpDir, containerDiskImageDir))
+		_, err = getImageFileName(filepath.Join(tmpDir, containerDiskImageDir), ArchiveMemberSelectionFailIfAmbiguous)
 		Expect(err).To(HaveOccurred())
 		Expect("image file does not exist in image directory - directory is empty").To(Equal(err.Error()))
 	})
@@ -99,7 +99,7 @@ var _ = Describe("Registry data source", func() {
 		Expect(err).NotTo(HaveOccurred())
 		err = os.Mkdir(filepath.Join(tmpDir, containerDiskImageDir, "anotherdir"), os.ModeDir)
 		Expect(err).NotTo(HaveOccurred())
-		_, err = getImageFileName(filepath.Join(tmpDir, containerDiskImageDir))
+		_, err = getImageFileName(filepath.Join(tmpDir, containerDiskImageDir), ArchiveMemberSelectionFailIfAmbiguous)
 		Expect(err).To(HaveOccurred())
 		Expect("image directory contains another directory").To(Equal(err.Error()))
 	})
@@ -109,7 +109,7 @@ var _ = Describe("Registry data source", func() {
 		Expect(err).NotTo(HaveOccurred())
 		_, err = os.Create(filepath.Join(tmpDir, containerDiskImageDir, " "))
 		Expect(err).NotTo(HaveOccurred())
-		_, err = getImageFileName(filepath.Join(tmpDir, containerDiskImageDir))
+		_, err = getImageFileName(filepath.Join(tmpDir, containerDiskImageDir), ArchiveMemberSelectionFailIfAmbiguous)
 		Expect(err).To(HaveOccurred())
 		Expect("image file does has no name").To(Equal(err.Error()))
 	})
@@ -121,8 +121,45 @@ var _ = Describe("Registry data source", func() {
 		Expect(err).NotTo(HaveOccurred())
 		_, err = os.Create(filepath.Join(tmpDir, containerDiskImageDir, "disk.img"))
 		Expect(err).NotTo(HaveOccurred())
-		_, err = getImageFileName(filepath.Join(tmpDir, containerDiskImageDir))
+		_, err = getImageFileName(filepath.Join(tmpDir, containerDiskImageDir), ArchiveMemberSelectionFailIfAmbiguous)
 		Expect(err).To(HaveOccurred())
 		Expect("image directory contains more than one file").To(Equal(err.Error()))
 	})
+
+	table.DescribeTable("getImageFileName should select from multiple files", func(selection ArchiveMemberSelection, want string, wantErr bool) {
+		dir := filepath.Join(tmpDir, containerDiskImageDir)
+		err := os.Mkdir(dir, os.ModeDir|0755)
+		Expect(err).NotTo(HaveOccurred())
+		for name, size := range map[string]int{"a-disk.img": 30, "b-disk.raw": 20, "c-disk.qcow2": 10, "d-disk.iso": 40} {
+			err = ioutil.WriteFile(filepath.Join(dir, name), make([]byte, size), 0644)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		filename, err := getImageFileName(dir, selection)
+		if wantErr {
+			Expect(err).To(HaveOccurred())
+			Expect("image directory contains more than one file").To(Equal(err.Error()))
+		} else {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filename).To(Equal(want))
+		}
+	},
+		table.Entry("first in lexical order", ArchiveMemberSelectionFirst, "a-disk.img", false),
+		table.Entry("largest file", ArchiveMemberSelectionLargest, "d-disk.iso", false),
+		table.Entry("highest priority extension", ArchiveMemberSelectionExtensionPriority, "c-disk.qcow2", false),
+		table.Entry("fail if ambiguous", ArchiveMemberSelectionFailIfAmbiguous, "", true),
+	)
+
+	table.DescribeTable("ParseArchiveMemberSelection should", func(value string, want ArchiveMemberSelection, wantErr bool) {
+		selection, err := ParseArchiveMemberSelection(value)
+		if wantErr {
+			Expect(err).To(HaveOccurred())
+		} else {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(selection).To(Equal(want))
+		}
+	},
+		table.Entry("default to fail-if-ambiguous", "", ArchiveMemberSelectionFailIfAmbiguous, false),
+		table.Entry("accept largest", "largest", ArchiveMemberSelectionLargest, false),
+		table.Entry("reject unknown values", "smallest", ArchiveMemberSelection(""), true),
+	)
 })
@@ -0,0 +1,94 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"net/http"
+	"strings"
+
+	"kubevirt.io/containerized-data-importer/pkg/version"
+)
+
+// userAgentProduct identifies CDI in the User-Agent of the requests.
+const userAgentProduct = "containerized-data-importer"
+
+// sensitiveHeaders are the headers whose values are redacted from the logs and not sent to other hosts, like the
+// secret extra headers.
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// DefaultUserAgent returns the User-Agent of the requests of the http based data sources, CDI and its version.
+func DefaultUserAgent() string {
+	return userAgentProduct + "/" + version.Get().GitVersion
+}
+
+// withUserAgent returns the extra headers with a User-Agent header of userAgent replacing the User-Agent of the extra
+// headers. An empty userAgent keeps the User-Agent of the extra headers, or adds the default User-Agent.
+func withUserAgent(extraHeaders []string, userAgent string) []string {
+	headers := make([]string, 0, len(extraHeaders)+1)
+	found := false
+	for _, h := range extraHeaders {
+		if name, _, err := splitHeader(h); err == nil && http.CanonicalHeaderKey(name) == "User-Agent" {
+			if userAgent != "" {
+				continue
+			}
+			found = true
+		}
+		headers = append(headers, h)
+	}
+	if userAgent == "" && !found {
+		userAgent = DefaultUserAgent()
+	}
+	if userAgent != "" {
+		headers = append(headers, "User-Agent: "+userAgent)
+	}
+	return headers
+}
+
+// splitSensitiveHeaders returns the extra headers which aren't sensitive, and the sensitive ones, handled as secret
+// extra headers.
+func splitSensitiveHeaders(extraHeaders []string) ([]string, []string) {
+	var headers, sensitive []string
+	for _, h := range extraHeaders {
+		if name, _, err := splitHeader(h); err == nil && isSensitiveHeader(name) {
+			sensitive = append(sensitive, h)
+		} else {
+			headers = append(headers, h)
+		}
+	}
+	return headers, sensitive
+}
+
+// isSensitiveHeader returns true if the value of the header name holds credentials.
+func isSensitiveHeader(name string) bool {
+	for _, sensitive := range sensitiveHeaders {
+		if strings.EqualFold(name, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestHeaders returns the extra headers of the environment and the secrets followed by extraHeaders, with the
+// User-Agent userAgent, and the sensitive headers among the secret extra headers.
+func requestHeaders(userAgent string, extraHeaders []string) ([]string, []string, error) {
+	envHeaders, secretExtraHeaders, err := getExtraHeaders()
+	if err != nil {
+		return nil, nil, err
+	}
+	headers, sensitive := splitSensitiveHeaders(withUserAgent(append(envHeaders, extraHeaders...), userAgent))
+	return headers, append(secretExtraHeaders, sensitive...), nil
+}
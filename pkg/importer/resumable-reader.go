@@ -0,0 +1,202 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+)
+
+// may be overridden in tests
+var readRetrySleep = sleepWithContext
+
+// readRetries are the settings of resuming the failed reads of an object, the zero value disables resuming.
+type readRetries struct {
+	// retries is the number of times a failed read is resumed.
+	retries int
+	// backoff is the delay before resuming the first time, doubled on each further attempt.
+	backoff time.Duration
+}
+
+// newReadRetries returns the settings resuming a failed or truncated read of an object with a ranged request from the
+// offset reached, up to retries times. The first attempt waits backoff, 1s if 0, each further attempt twice as long as
+// the previous one. 0 retries disable resuming.
+func newReadRetries(retries int, backoff time.Duration) readRetries {
+	if backoff == 0 {
+		backoff = time.Second
+	}
+	return readRetries{retries: retries, backoff: backoff}
+}
+
+// enabled returns true if failed reads of the object are resumed.
+func (r readRetries) enabled() bool {
+	return r.retries > 0
+}
+
+// TransferStats counts the work of resuming failed reads of objects.
+type TransferStats struct {
+	// Retries is the number of times a read was resumed.
+	Retries int
+	// ResumedBytes is the number of bytes read after resuming, downloaded again by the requests of the retries.
+	ResumedBytes int64
+	// LastResumeOffset is the offset the last retry resumed the object from.
+	LastResumeOffset int64
+	// BackoffTime is the wall-clock time spent waiting before the retries.
+	BackoffTime time.Duration
+}
+
+func (s TransferStats) String() string {
+	return fmt.Sprintf("%d read retries, %d bytes read after resuming, last from offset %d, %s in backoff", s.Retries, s.ResumedBytes, s.LastResumeOffset, s.BackoffTime)
+}
+
+// sub returns the stats counted since base.
+func (s TransferStats) sub(base TransferStats) TransferStats {
+	stats := TransferStats{
+		Retries:      s.Retries - base.Retries,
+		ResumedBytes: s.ResumedBytes - base.ResumedBytes,
+		BackoffTime:  s.BackoffTime - base.BackoffTime,
+	}
+	if stats.Retries > 0 {
+		stats.LastResumeOffset = s.LastResumeOffset
+	}
+	return stats
+}
+
+// readTransferStats counts the work of all the resumable readers of the process.
+var readTransferStats struct {
+	sync.Mutex
+	stats TransferStats
+}
+
+// currentTransferStats returns the work of the resumable readers so far.
+func currentTransferStats() TransferStats {
+	readTransferStats.Lock()
+	defer readTransferStats.Unlock()
+	return readTransferStats.stats
+}
+
+// resumableReader reads an object, reopening it from the offset reached when a read fails or the object ends before
+// its size.
+type resumableReader struct {
+	ctx context.Context
+	// open opens the object from offset to its end.
+	open func(offset int64) (io.ReadCloser, error)
+	body io.ReadCloser
+	// retries are the settings of resuming the object.
+	retries readRetries
+	// offset is the number of bytes read.
+	offset int64
+	// size is the size of the object, -1 if unknown.
+	size int64
+	// attempts is the number of times the object was reopened.
+	attempts int
+	// resumed is true once the object was reopened.
+	resumed bool
+}
+
+// newResumableReader returns a reader of the object of the given size, body reading it from the start, resumed as
+// set by retries.
+func newResumableReader(ctx context.Context, body io.ReadCloser, size int64, retries readRetries, open func(offset int64) (io.ReadCloser, error)) *resumableReader {
+	return &resumableReader{
+		ctx:     ctx,
+		open:    open,
+		body:    body,
+		retries: retries,
+		size:    size,
+	}
+}
+
+// Read reads from the object, resuming it after a failure.
+func (r *resumableReader) Read(p []byte) (int, error) {
+	for {
+		if r.body == nil {
+			body, err := r.open(r.offset)
+			if err != nil {
+				if err = r.backoff(err); err != nil {
+					return 0, err
+				}
+				continue
+			}
+			r.body = body
+			r.resumed = true
+			readTransferStats.Lock()
+			readTransferStats.stats.LastResumeOffset = r.offset
+			readTransferStats.Unlock()
+		}
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if r.resumed && n > 0 {
+			readTransferStats.Lock()
+			readTransferStats.stats.ResumedBytes += int64(n)
+			readTransferStats.Unlock()
+		}
+		if err == nil {
+			return n, nil
+		}
+		if err == io.EOF {
+			if r.size < 0 || r.offset == r.size {
+				return n, io.EOF
+			}
+			if r.offset > r.size {
+				// The source is read to its end, the readers above fail or warn that it is larger than reported.
+				return n, io.EOF
+			}
+			err = errors.Errorf("object truncated at %d of %d bytes", r.offset, r.size)
+		}
+		r.body.Close()
+		r.body = nil
+		if err = r.backoff(err); err != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// backoff waits before the next attempt to open the object, or returns err once the retries are exhausted.
+func (r *resumableReader) backoff(err error) error {
+	if r.attempts >= r.retries.retries {
+		return errors.Wrapf(err, "unable to read the object after %d retries", r.attempts)
+	}
+	delay := r.retries.backoff << uint(r.attempts)
+	r.attempts++
+	klog.Warningf("Reading the object failed at offset %d, resuming in %s (attempt %d of %d): %v", r.offset, delay, r.attempts, r.retries.retries, err)
+	start := time.Now()
+	err = readRetrySleep(r.ctx, delay)
+	readTransferStats.Lock()
+	readTransferStats.stats.Retries++
+	readTransferStats.stats.BackoffTime += time.Since(start)
+	readTransferStats.Unlock()
+	return err
+}
+
+// Close closes the current body of the object.
+func (r *resumableReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
@@ -0,0 +1,250 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pkg/errors"
+)
+
+// failingReader reads at most limit bytes of data, and fails afterwards unless it read all of data.
+type failingReader struct {
+	reader io.Reader
+	err    error
+}
+
+func newFailingReader(data []byte, limit int, err error) io.ReadCloser {
+	if limit >= len(data) {
+		limit = len(data)
+		err = io.EOF
+	}
+	return &failingReader{reader: bytes.NewReader(data[:limit]), err: err}
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err == io.EOF {
+		err = r.err
+	}
+	return n, err
+}
+
+func (r *failingReader) Close() error {
+	return nil
+}
+
+// rangedMockS3Client serves data honoring byte ranges, each body failing after limit bytes.
+type rangedMockS3Client struct {
+	data  []byte
+	limit int
+	// noRanges makes the client not advertise byte ranges.
+	noRanges bool
+	// reportedLength is the length reported for the whole object instead of its actual length, if not 0.
+	reportedLength int
+	// etag is the ETag of the object, "etag-1" if empty.
+	etag   string
+	mutex  sync.Mutex
+	inputs []*s3.GetObjectInput
+}
+
+func (mc *rangedMockS3Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	mc.mutex.Lock()
+	mc.inputs = append(mc.inputs, input)
+	mc.mutex.Unlock()
+	start, end := 0, len(mc.data)-1
+	if input.Range != nil {
+		bounds := strings.Split(strings.TrimPrefix(*input.Range, "bytes="), "-")
+		if _, err := fmt.Sscan(bounds[0], &start); err != nil {
+			return nil, err
+		}
+		if bounds[1] != "" {
+			if _, err := fmt.Sscan(bounds[1], &end); err != nil {
+				return nil, err
+			}
+		}
+	}
+	acceptRanges := "bytes"
+	if mc.noRanges {
+		acceptRanges = "none"
+	}
+	etag := mc.etag
+	if etag == "" {
+		etag = "\"etag-1\""
+	}
+	length := end + 1 - start
+	if mc.reportedLength != 0 && input.Range == nil {
+		length = mc.reportedLength
+	}
+	return &s3.GetObjectOutput{
+		Body:          newFailingReader(mc.data[start:end+1], mc.limit, errors.New("connection reset by peer")),
+		ContentLength: aws.Int64(int64(length)),
+		AcceptRanges:  aws.String(acceptRanges),
+		ETag:          aws.String(etag),
+	}, nil
+}
+
+var _ = Describe("Resumable reader", func() {
+	var (
+		data    []byte
+		offsets []int64
+		delays  []time.Duration
+	)
+
+	BeforeEach(func() {
+		data = bytes.Repeat([]byte("0123456789"), 1000)
+		offsets = nil
+		delays = nil
+		readRetrySleep = func(ctx context.Context, delay time.Duration) error {
+			delays = append(delays, delay)
+			return nil
+		}
+	})
+
+	AfterEach(func() {
+		readRetrySleep = sleepWithContext
+	})
+
+	// openFailingAfter opens data from offset, each body failing after limit bytes.
+	openFailingAfter := func(limit int) func(int64) (io.ReadCloser, error) {
+		return func(offset int64) (io.ReadCloser, error) {
+			offsets = append(offsets, offset)
+			return newFailingReader(data[offset:], limit, errors.New("connection reset by peer")), nil
+		}
+	}
+
+	It("should resume the object from the offset reached", func() {
+		retries := newReadRetries(5, time.Second)
+		reader := newResumableReader(context.Background(), newFailingReader(data, 4000, errors.New("unexpected EOF")), int64(len(data)), retries, openFailingAfter(4000))
+		result, err := ioutil.ReadAll(reader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(data))
+		Expect(offsets).To(Equal([]int64{4000, 8000}))
+		Expect(delays).To(Equal([]time.Duration{time.Second, 2 * time.Second}))
+	})
+
+	It("should resume an object ending before its size", func() {
+		retries := newReadRetries(1, time.Second)
+		reader := newResumableReader(context.Background(), newFailingReader(data, 6000, io.EOF), int64(len(data)), retries, openFailingAfter(len(data)))
+		result, err := ioutil.ReadAll(reader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(data))
+		Expect(offsets).To(Equal([]int64{6000}))
+	})
+
+	It("should fail once the retries are exhausted", func() {
+		retries := newReadRetries(2, time.Second)
+		reader := newResumableReader(context.Background(), newFailingReader(data, 1000, errors.New("unexpected EOF")), int64(len(data)), retries, openFailingAfter(1000))
+		_, err := ioutil.ReadAll(reader)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("after 2 retries"))
+		Expect(offsets).To(Equal([]int64{1000, 2000}))
+	})
+
+	It("should report a truncated object", func() {
+		retries := newReadRetries(1, time.Second)
+		reader := newResumableReader(context.Background(), newFailingReader(data, 6000, io.EOF), int64(len(data)), retries, func(offset int64) (io.ReadCloser, error) {
+			return newFailingReader(nil, 0, io.EOF), nil
+		})
+		_, err := ioutil.ReadAll(reader)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("object truncated at 6000 of 10000 bytes"))
+	})
+
+	It("should retry failing to reopen the object", func() {
+		retries := newReadRetries(3, time.Second)
+		failures := 2
+		reader := newResumableReader(context.Background(), newFailingReader(data, 5000, errors.New("unexpected EOF")), int64(len(data)), retries, func(offset int64) (io.ReadCloser, error) {
+			if failures > 0 {
+				failures--
+				return nil, errors.New("connection refused")
+			}
+			return openFailingAfter(len(data))(offset)
+		})
+		result, err := ioutil.ReadAll(reader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(data))
+		Expect(delays).To(HaveLen(3))
+	})
+
+	It("should resume an S3 object with ranged requests of the same version", func() {
+		retries := newReadRetries(5, time.Second)
+		client := &rangedMockS3Client{data: data, limit: 3000}
+		newClientFunc = func(endpoint, accessKey, secKey string, certDir string, options s3ClientOptions) (S3Client, error) {
+			return client, nil
+		}
+		defer func() { newClientFunc = getS3Client }()
+		object, err := createS3Reader(&url.URL{Scheme: "http", Host: "region.amazon.com", Path: "/bucket-1/object-1"}, "", "", "", nil, false, s3ClientOptions{timeouts: DefaultClientTimeouts, readRetries: retries})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := ioutil.ReadAll(object.reader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(data))
+		Expect(client.inputs).To(HaveLen(4))
+		Expect(client.inputs[0].Range).To(BeNil())
+		Expect(aws.StringValue(client.inputs[1].Range)).To(Equal("bytes=3000-"))
+		Expect(aws.StringValue(client.inputs[3].Range)).To(Equal("bytes=9000-"))
+		Expect(aws.StringValue(client.inputs[3].IfMatch)).To(Equal("\"etag-1\""))
+		Expect(aws.StringValue(client.inputs[3].Key)).To(Equal("object-1"))
+	})
+})
+
+var _ = Describe("Transfer stats", func() {
+	retries := newReadRetries(1, time.Second)
+	var data []byte
+
+	BeforeEach(func() {
+		data = bytes.Repeat([]byte("0123456789"), 1000)
+		readRetrySleep = func(ctx context.Context, delay time.Duration) error {
+			return nil
+		}
+	})
+
+	AfterEach(func() {
+		readRetrySleep = sleepWithContext
+	})
+
+	It("should count the retry resuming an object failing partway", func() {
+		client := &rangedMockS3Client{data: data, limit: 6000}
+		newClientFunc = func(endpoint, accessKey, secKey string, certDir string, options s3ClientOptions) (S3Client, error) {
+			return client, nil
+		}
+		defer func() { newClientFunc = getS3Client }()
+		dp := NewDataProcessor(&MockDataProvider{}, "dest", "dataDir", "scratchDataDir", "1G", 0.055, false)
+		Expect(dp.GetTransferStats()).To(Equal(TransferStats{}))
+		object, err := createS3Reader(&url.URL{Scheme: "http", Host: "region.amazon.com", Path: "/bucket-1/object-1"}, "", "", "", nil, false, s3ClientOptions{timeouts: DefaultClientTimeouts, readRetries: retries})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := ioutil.ReadAll(object.reader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(data))
+		stats := dp.GetTransferStats()
+		Expect(stats.Retries).To(Equal(1))
+		Expect(stats.LastResumeOffset).To(Equal(int64(6000)))
+		Expect(stats.ResumedBytes).To(Equal(int64(4000)))
+	})
+
+	It("should add the stats to the error of a failed import", func() {
+		mdp := &MockDataProvider{infoResponse: ProcessingPhaseError}
+		dp := NewDataProcessor(mdp, "dest", "dataDir", "scratchDataDir", "1G", 0.055, false)
+		reader := newResumableReader(context.Background(), newFailingReader(data, 3000, errors.New("unexpected EOF")), int64(len(data)), retries, func(offset int64) (io.ReadCloser, error) {
+			return newFailingReader(data[offset:], len(data), nil), nil
+		})
+		_, err := ioutil.ReadAll(reader)
+		Expect(err).NotTo(HaveOccurred())
+		err = dp.ProcessData()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("import failed after 1 read retries, 7000 bytes read after resuming, last from offset 3000"))
+		Expect(err.Error()).To(ContainSubstring("Info errored"))
+	})
+})
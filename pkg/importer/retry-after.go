@@ -0,0 +1,109 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// may be overridden in tests
+var retryAfterNow = time.Now
+var retryAfterSleep = sleepWithContext
+
+// retryAfterDelay returns the delay asked by the Retry-After header of a 503 or 429 response, in either the
+// delta-seconds or the HTTP-date form. Dates in the past ask for no delay.
+func retryAfterDelay(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusServiceUnavailable && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		klog.V(1).Infof("Ignoring invalid Retry-After %q", value)
+		return 0, false
+	}
+	if delay := date.Sub(now); delay > 0 {
+		return delay, true
+	}
+	return 0, true
+}
+
+// sleepWithContext waits for delay, or until ctx is done.
+func sleepWithContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryAfterTransport retries requests without body answered with 503 or 429 and a Retry-After header after the
+// requested delay, as long as the delays of a request add up to at most the budget. The response asking for a delay
+// beyond the budget is returned as is.
+type retryAfterTransport struct {
+	base http.RoundTripper
+	// budget is the total time a request waits for the delays asked by Retry-After headers, 0 disables retrying.
+	budget time.Duration
+}
+
+// newRetryAfterTransport wraps base, nil is the default transport, retrying within budget.
+func newRetryAfterTransport(base http.RoundTripper, budget time.Duration) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &retryAfterTransport{base: base, budget: budget}
+}
+
+// RoundTrip executes a single HTTP transaction, retrying it after the delays asked by the server.
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var waited time.Duration
+	for {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil || t.budget <= 0 || (req.Body != nil && req.Body != http.NoBody) {
+			return resp, err
+		}
+		delay, ok := retryAfterDelay(resp, retryAfterNow())
+		if !ok {
+			return resp, nil
+		}
+		if waited+delay > t.budget {
+			klog.Warningf("%s %s asked to retry after %s, beyond the remaining retry budget of %s", req.Method, manifestURL(req.URL), delay, t.budget-waited)
+			return resp, nil
+		}
+		resp.Body.Close()
+		klog.Infof("%s %s returned %d, retrying after %s", req.Method, manifestURL(req.URL), resp.StatusCode, delay)
+		if err := retryAfterSleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+		waited += delay
+	}
+}
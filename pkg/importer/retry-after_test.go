@@ -0,0 +1,106 @@
+package importer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Retry-After", func() {
+	now := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	table.DescribeTable("retryAfterDelay should", func(status int, retryAfter string, expectedDelay time.Duration, expectedOk bool) {
+		resp := &http.Response{StatusCode: status, Header: http.Header{}}
+		if retryAfter != "" {
+			resp.Header.Set("Retry-After", retryAfter)
+		}
+		delay, ok := retryAfterDelay(resp, now)
+		Expect(ok).To(Equal(expectedOk))
+		Expect(delay).To(Equal(expectedDelay))
+	},
+		table.Entry("parse delta-seconds", http.StatusServiceUnavailable, "120", 2*time.Minute, true),
+		table.Entry("parse an HTTP-date", http.StatusServiceUnavailable, "Mon, 01 Mar 2021 12:00:30 GMT", 30*time.Second, true),
+		table.Entry("parse delta-seconds of a 429", http.StatusTooManyRequests, "5", 5*time.Second, true),
+		table.Entry("not delay for an HTTP-date in the past", http.StatusServiceUnavailable, "Mon, 01 Mar 2021 11:00:00 GMT", time.Duration(0), true),
+		table.Entry("ignore an invalid value", http.StatusServiceUnavailable, "soon", time.Duration(0), false),
+		table.Entry("ignore a missing header", http.StatusServiceUnavailable, "", time.Duration(0), false),
+		table.Entry("ignore other status codes", http.StatusInternalServerError, "5", time.Duration(0), false),
+	)
+
+	Context("transport", func() {
+		var (
+			responses []func(w http.ResponseWriter)
+			requests  int
+			delays    []time.Duration
+			ts        *httptest.Server
+			budget    time.Duration
+		)
+
+		BeforeEach(func() {
+			requests = 0
+			delays = nil
+			budget = 0
+			ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				responses[requests](w)
+				requests++
+			}))
+			retryAfterNow = func() time.Time { return now }
+			retryAfterSleep = func(ctx context.Context, delay time.Duration) error {
+				delays = append(delays, delay)
+				return nil
+			}
+		})
+
+		AfterEach(func() {
+			ts.Close()
+			retryAfterNow = time.Now
+			retryAfterSleep = sleepWithContext
+		})
+
+		unavailable := func(retryAfter string) func(w http.ResponseWriter) {
+			return func(w http.ResponseWriter) {
+				w.Header().Set("Retry-After", retryAfter)
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}
+		ok := func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusOK)
+		}
+
+		get := func() *http.Response {
+			client := &http.Client{Transport: newRetryAfterTransport(nil, budget)}
+			resp, err := client.Get(ts.URL)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			return resp
+		}
+
+		It("should wait the delays of both Retry-After forms", func() {
+			budget = time.Minute
+			responses = []func(w http.ResponseWriter){unavailable("10"), unavailable("Mon, 01 Mar 2021 12:00:20 GMT"), ok}
+			Expect(get().StatusCode).To(Equal(http.StatusOK))
+			Expect(requests).To(Equal(3))
+			Expect(delays).To(Equal([]time.Duration{10 * time.Second, 20 * time.Second}))
+		})
+
+		It("should give up once the delays exceed the budget", func() {
+			budget = 25 * time.Second
+			responses = []func(w http.ResponseWriter){unavailable("10"), unavailable("20"), ok}
+			Expect(get().StatusCode).To(Equal(http.StatusServiceUnavailable))
+			Expect(requests).To(Equal(2))
+			Expect(delays).To(Equal([]time.Duration{10 * time.Second}))
+		})
+
+		It("should not retry without a budget", func() {
+			responses = []func(w http.ResponseWriter){unavailable("10"), ok}
+			Expect(get().StatusCode).To(Equal(http.StatusServiceUnavailable))
+			Expect(requests).To(Equal(1))
+			Expect(delays).To(BeEmpty())
+		})
+	})
+})
@@ -1,15 +1,26 @@
 package importer
 
 import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 
@@ -22,19 +33,69 @@ import (
 
 const s3FolderSep = "/"
 
+// s3PartNumberParam is the endpoint query parameter selecting a single part of a multipart uploaded object.
+const s3PartNumberParam = "partNumber"
+
+// s3MetadataPrefix is the prefix of the headers of the user defined metadata of S3 objects.
+const s3MetadataPrefix = "x-amz-meta-"
+
+// s3VersionIDParam is the endpoint query parameter selecting a version of an object of a versioned bucket.
+const s3VersionIDParam = "versionId"
+
 // S3Client is the interface to the used S3 client.
 type S3Client interface {
 	GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error)
 }
 
+// s3ContextClient is implemented by the S3 clients able to cancel their requests with a context, like the AWS client.
+type s3ContextClient interface {
+	GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error)
+}
+
 // may be overridden in tests
 var newClientFunc = getS3Client
 
+// parseS3AlternateEndpoints returns the hosts of the alternate endpoints, hosts or URLs whose host is used, skipping
+// the empty ones.
+func parseS3AlternateEndpoints(endpoints []string) ([]string, error) {
+	var hosts []string
+	for _, endpoint := range endpoints {
+		endpoint = strings.TrimSpace(endpoint)
+		if endpoint == "" {
+			continue
+		}
+		host := endpoint
+		if strings.Contains(endpoint, "://") {
+			ep, err := url.Parse(endpoint)
+			if err != nil || ep.Host == "" {
+				return nil, errors.Errorf("invalid alternate s3 endpoint %q", endpoint)
+			}
+			host = ep.Host
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// s3DefaultGetBackoff is the delay before the second attempt of a request of an object if none is set.
+const s3DefaultGetBackoff = time.Second
+
+// s3VirtualHostPattern matches the virtual-hosted-style hosts of AWS S3, bucket.s3.region.amazonaws.com and the legacy
+// bucket.s3-region.amazonaws.com, capturing the bucket and the host of the endpoint. Bucket names may contain dots.
+var s3VirtualHostPattern = regexp.MustCompile(`^(.+)\.(s3(?:[.-][a-z0-9-]+)*\.amazonaws\.com)$`)
+
+// s3RegionPattern matches the regional hosts of AWS S3, s3.region.amazonaws.com, the dual-stack
+// s3.dualstack.region.amazonaws.com and the legacy s3-region.amazonaws.com, capturing the region.
+var s3RegionPattern = regexp.MustCompile(`(?:^|\.)s3[.-](?:dualstack\.)?([a-z0-9-]+)\.amazonaws\.com$`)
+
 // S3DataSource is the struct containing the information needed to import from an S3 data source.
 // Sequence of phases:
 // 1. Info -> Transfer
 // 2. Transfer -> Convert
 type S3DataSource struct {
+	sourceSizeLimits
+	sourceVerification
+	sourceStreamOptions
 	// S3 end point
 	ep *url.URL
 	// User name
@@ -43,38 +104,480 @@ type S3DataSource struct {
 	secKey string
 	// Reader
 	s3Reader io.ReadCloser
+	// the object opened with the S3 client, nil if not opened yet.
+	object *s3Object
+	// number of concurrent requests of byte ranges of Transfer, 1 or less downloads in a single stream.
+	concurrency int
+	// number of bytes to read ahead of the consumer, 0 disables read-ahead.
+	prefetchBufferSize int64
+	// limits the bytes read from the object per second, nil if unlimited.
+	rateLimit *tokenBucket
+	// fail if the detected image format is riskier than the format declared by the object name.
+	strictFormatCheck bool
+	// fail if the virtual size of the image differs from the expected virtual size by more than the tolerance.
+	expectedVirtualSize  int64
+	virtualSizeTolerance int64
+	// fail if the virtual size of the image exceeds the capacity of the target, 0 if unknown.
+	targetCapacity int64
+	// the ETag of the object, identifies the version of the content for the scratch cache.
+	etag string
+	// record the progress of the transfers to scratch space, so a restarted importer resumes them.
+	transferResume bool
+	// cache of scratch files shared between imports, nil if not used.
+	scratchCache *ScratchCache
+	// the name of the file Transfer writes in scratch space, tempFile if empty.
+	tempFileName string
+	// the file Transfer writes in scratch space, empty before Transfer.
+	tempPath string
+	// the expected checksum of the object in the form <algorithm>:<hex>, empty if not verified.
+	expectedChecksum string
+	// checksumReader verifies the object, nil if not verified.
+	checksumReader *checksumVerifyingReader
+	// verify the object against its ETag, which S3 computes from the content of the object.
+	verifyETag bool
+	// etagReader verifies the ETag of the object read in a single stream, nil if not verified.
+	etagReader *s3ETagVerifyingReader
+	// the size of the parts of a multipart uploaded object whose ETag is verified, 0 for single part uploads.
+	etagPartSize int64
+	// the ETag computed from the transferred object, empty before.
+	computedChecksum string
+	// the names of the tar archive members extracted as the disk image, nil if tar archives aren't extracted.
+	tarMemberPatterns []string
+	// the strategy picking the tar archive member extracted when several match the patterns.
+	tarMemberSelection ArchiveMemberSelection
+	// the tar archive member extracted by Transfer, empty if none.
+	tarMember string
+	// the byte range of the object imported from rangeOffset, the whole object if rangeLength is 0.
+	rangeOffset int64
+	rangeLength int64
+	// the metadata of the object, nil before Info.
+	metadata map[string]string
+	// ctxReader stops reading the object when the context of the current phase is done, nil before Info.
+	ctxReader *contextReader
 	// stack of readers
 	readers *FormatReaders
 	// The image file in scratch space.
 	url *url.URL
 }
 
-// NewS3DataSource creates a new instance of the S3DataSource
+// NewS3DataSource creates a new instance of the S3DataSource. A partNumber query parameter in the endpoint fetches
+// only that part of a multipart uploaded object. A versionId query parameter fetches that version of the object
+// instead of the latest one. A tagSelector query parameter imports the most recently modified object matching the
+// selector, among the objects starting with the object name of the endpoint, at most s3TagSelectorMaxObjects. Empty
+// access and secret keys read public buckets with anonymous requests.
 func NewS3DataSource(endpoint, accessKey, secKey string, certDir string) (*S3DataSource, error) {
-	ep, err := ParseEndpoint(endpoint)
+	return NewS3DataSourceWithVersion(endpoint, accessKey, secKey, certDir, "")
+}
+
+// NewS3DataSourceWithVersion creates a new instance of the S3DataSource fetching the version versionID of the
+// object, like a versionId query parameter in the endpoint. An empty versionID leaves the endpoint as is.
+func NewS3DataSourceWithVersion(endpoint, accessKey, secKey, certDir, versionID string) (*S3DataSource, error) {
+	return NewS3DataSourceWithOptions(endpoint, accessKey, secKey, certDir, S3Options{VersionID: versionID})
+}
+
+// S3Options are the optional settings of the object read by the S3DataSource.
+type S3Options struct {
+	// VersionID is the version of the object to fetch, like a versionId query parameter in the endpoint. Empty
+	// leaves the endpoint as is.
+	VersionID string
+	// SSECustomerKey is the base64 encoded key the object is encrypted with on the server (SSE-C), empty if the
+	// object isn't encrypted with a customer provided key.
+	SSECustomerKey string
+	// SSECustomerAlgorithm is the algorithm of SSECustomerKey, AES256 if empty.
+	SSECustomerAlgorithm string
+	// Timeouts are the timeouts of the connections to the endpoint and of the reads of the object.
+	Timeouts ClientTimeouts
+	// ForcePathStyle reads the bucket from the first segment of the path of the endpoint, endpoint/bucket/key, even if
+	// the host of the endpoint looks like a virtual-hosted-style host of AWS S3, bucket.endpoint/key.
+	ForcePathStyle bool
+	// RequesterPays accepts the charges of the requests to a requester pays bucket, billed to the account of the
+	// credentials instead of the owner of the bucket.
+	RequesterPays bool
+	// Region is the region the requests are signed for, read from the host of the endpoint if empty. S3-compatible
+	// stores like Ceph RGW and MinIO expect the name of their zone group or a placeholder like us-east-1.
+	Region string
+	// DisableChecksums stops the client from adding the MD5 checksums of the AWS S3 API to the requests and from
+	// validating them in the responses, which some S3-compatible stores reject.
+	DisableChecksums bool
+	// SessionToken is the session token of temporary credentials issued by STS, empty for long-term access keys.
+	SessionToken string
+	// RefreshCredentials returns fresh credentials once the credentials of the requests of the object expired, like
+	// the STS credentials of a web identity (IRSA). The failed request is then sent again with them, and the download
+	// resumes from the offset reached if read retries are enabled. Nil fails the import once the credentials expire.
+	RefreshCredentials func() (S3Credentials, error)
+	// GetAttempts is the number of times a request of the object is made when it fails with a transient error, a
+	// server error, throttling or a temporary network error. Other errors, like a missing object or a denied access,
+	// fail on the first attempt. 1 or less makes it once.
+	GetAttempts int
+	// GetBackoff is the delay before the second attempt, doubled on each further attempt, 1s if 0.
+	GetBackoff time.Duration
+	// ReadRetries is the number of times a failed or truncated read of the object is resumed with a ranged request
+	// of the same version from the offset reached, 0 disables resuming.
+	ReadRetries int
+	// ReadRetryBackoff is the delay before resuming the first time, doubled on each further attempt, 1s if 0.
+	ReadRetryBackoff time.Duration
+	// PinnedSPKIHashes fail the TLS handshake unless a certificate of the chain presented by the endpoint has one of
+	// the pinned subject public key infos, on top of the CA validation. A pin is the base64 encoded SHA256 hash of the
+	// DER encoded subject public key info, optionally prefixed with sha256/. No pins disable pinning.
+	PinnedSPKIHashes []string
+	// RetryAfterBudget is the total time a request waits for the delays asked by the Retry-After headers of 503 and
+	// 429 responses before it is sent again, 0 disables retrying.
+	RetryAfterBudget time.Duration
+	// AlternateEndpoints are tried in order when the request to the endpoint of the object fails to connect or
+	// authenticate. An alternate endpoint serves the same bucket and object, like the global or the dual-stack
+	// endpoint of a regional endpoint, and is either a host or a URL whose host is used.
+	AlternateEndpoints []string
+	// TransferResume makes the transfers to scratch space record their progress next to the temp file, so an importer
+	// restarted after a failure resumes the transfer of the same version of the object where the previous importer
+	// stopped, instead of downloading it again.
+	TransferResume bool
+	// TempFileName is the name of the file Transfer writes in scratch space, for imports sharing a scratch volume not
+	// to collide, tempFile if empty.
+	TempFileName string
+	// ExpectedChecksum makes Transfer and TransferFile fail if the checksum of the object doesn't match it, in the form
+	// sha256:<hex> or md5:<hex>. The object is hashed while it is transferred. Empty disables the verification.
+	ExpectedChecksum string
+	// VerifyETag makes Transfer and TransferFile fail if the object doesn't match its ETag. The ETag is the MD5 of
+	// objects uploaded in a single part, and combines the MD5 of the parts of multipart uploads, the object is hashed
+	// while it is transferred, concurrently by part when Transfer downloads byte ranges. Objects encrypted with SSE-KMS
+	// or SSE-C, whose ETag isn't computed from their content, single parts and byte ranges of objects are rejected.
+	VerifyETag bool
+	// RangeOffset and RangeLength import only RangeLength bytes of the object from RangeOffset, for sharded images.
+	// Only that range of the object is requested, and the image format is detected at RangeOffset. The range must be
+	// within the object. A RangeLength of 0 imports the whole object.
+	RangeOffset int64
+	RangeLength int64
+	// TarExtraction makes Transfer extract the disk image from objects that are tar archives, optionally compressed.
+	// The only regular file of the archive whose base name matches one of TarMemberPatterns is extracted, the default
+	// patterns *.img, *.qcow2 and *.raw are used if it has no non-empty pattern. Archives with more than one matching
+	// file are rejected, unless another ArchiveMemberSelection is set.
+	TarExtraction     bool
+	TarMemberPatterns []string
+	// ArchiveMemberSelection is the strategy picking the tar archive member extracted when several regular files match
+	// TarMemberPatterns.
+	ArchiveMemberSelection ArchiveMemberSelection
+	// Concurrency is the number of concurrent requests of byte ranges Transfer downloads the object into scratch
+	// space with, 1 or less downloads the object in a single stream. Objects are downloaded in a single stream anyway
+	// if the server doesn't advertise byte ranges, or if they are compressed.
+	Concurrency int
+	// PrefetchBufferSize is the number of bytes to read ahead of the consumer, 0 disables read-ahead.
+	PrefetchBufferSize int64
+	// RateLimit limits the bytes read from the object per second, 0 disables the limit.
+	RateLimit int64
+	// StrictFormatCheck makes Info fail if the image format declared by the object name extension doesn't match the
+	// detected format in a security relevant way.
+	StrictFormatCheck bool
+	// ExpectedVirtualSize makes Info fail if the virtual size of the image differs from it by more than
+	// VirtualSizeTolerance bytes, 0 disables the check.
+	ExpectedVirtualSize  int64
+	VirtualSizeTolerance int64
+	// TargetCapacity makes Info fail if the virtual size of the image exceeds it, before transferring any data, 0
+	// disables the check.
+	TargetCapacity int64
+	// ScratchCache makes Transfer reuse the cached scratch file of an unchanged object, and add downloaded scratch
+	// files to the cache, nil if not used.
+	ScratchCache *ScratchCache
+	SourceOptions
+}
+
+// S3Credentials are the credentials of the requests of an object.
+type S3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is the session token of temporary credentials, empty for long-term access keys.
+	SessionToken string
+}
+
+// s3ClientOptions are the settings of the s3 clients of an endpoint.
+type s3ClientOptions struct {
+	timeouts ClientTimeouts
+	// region overrides the region read from the host of the endpoint, if not empty.
+	region           string
+	disableChecksums bool
+	// sessionToken is the session token of the temporary credentials of the client, empty if none.
+	sessionToken string
+	// refreshCredentials returns fresh credentials once the credentials expired, nil if they can't be refreshed.
+	refreshCredentials func() (S3Credentials, error)
+	// getAttempts is the number of times a request failing with a transient error is made, getBackoff the delay
+	// before the second attempt.
+	getAttempts int
+	getBackoff  time.Duration
+	// readRetries are the settings of resuming the failed reads of the object.
+	readRetries readRetries
+	// pins are the pinned certificates of the endpoint, empty if not used.
+	pins spkiPins
+	// retryAfterBudget is the total time a request waits for Retry-After delays, 0 disables retrying.
+	retryAfterBudget time.Duration
+}
+
+// NewS3DataSourceWithOptions creates a new instance of the S3DataSource reading the object with options.
+func NewS3DataSourceWithOptions(endpoint, accessKey, secKey, certDir string, options S3Options) (*S3DataSource, error) {
+	ep, err := parseValidEndpoint(endpoint, "s3", "http", "https", srvSchemePrefix+"http", srvSchemePrefix+"https")
 	if err != nil {
-		return nil, errors.Wrapf(err, fmt.Sprintf("unable to parse endpoint %q", endpoint))
+		return nil, err
 	}
-	s3Reader, err := createS3Reader(ep, accessKey, secKey, certDir)
+	ep = s3PathStyleEndpoint(ep, options.ForcePathStyle)
+	if err := validateS3Bucket(ep); err != nil {
+		return nil, err
+	}
+	if ep, err = withS3VersionID(ep, options.VersionID); err != nil {
+		return nil, err
+	}
+	customerKey, err := parseS3CustomerKey(options.SSECustomerKey, options.SSECustomerAlgorithm)
 	if err != nil {
 		return nil, err
 	}
-	return &S3DataSource{
-		ep:        ep,
-		accessKey: accessKey,
-		secKey:    secKey,
-		s3Reader:  s3Reader,
-	}, nil
+	pins, err := parseSPKIPins(options.PinnedSPKIHashes)
+	if err != nil {
+		return nil, err
+	}
+	clientOptions := s3ClientOptions{
+		timeouts:           options.Timeouts.withDefaults(),
+		region:             options.Region,
+		disableChecksums:   options.DisableChecksums,
+		sessionToken:       options.SessionToken,
+		refreshCredentials: options.RefreshCredentials,
+		getAttempts:        options.GetAttempts,
+		getBackoff:         options.GetBackoff,
+		readRetries:        newReadRetries(options.ReadRetries, options.ReadRetryBackoff),
+		pins:               pins,
+		retryAfterBudget:   options.RetryAfterBudget,
+	}
+	if clientOptions.getBackoff == 0 {
+		clientOptions.getBackoff = s3DefaultGetBackoff
+	}
+	var object *s3Object
+	var selected *url.URL
+	alternateHosts, err := parseS3AlternateEndpoints(options.AlternateEndpoints)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := withS3AlternateEndpoints(ep, alternateHosts)
+	for i, candidate := range endpoints {
+		_, err = connectEndpoint(candidate, func(target *url.URL) error {
+			var err error
+			if selected, err = selectS3Object(target, accessKey, secKey, certDir, options.RequesterPays, clientOptions); err != nil {
+				return err
+			}
+			object, err = createS3Reader(selected, accessKey, secKey, certDir, customerKey, options.RequesterPays, clientOptions)
+			return err
+		})
+		if err == nil || i == len(endpoints)-1 || !isS3EndpointFailure(err) {
+			break
+		}
+		klog.Warningf("Unable to get the object from %s, trying the alternate endpoint %s: %v", candidate.Host, endpoints[i+1].Host, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ep = selected
+	sd := &S3DataSource{
+		sourceSizeLimits:     options.sizeLimits(),
+		sourceStreamOptions:  options.streamOptions(),
+		ep:                   ep,
+		accessKey:            accessKey,
+		secKey:               secKey,
+		s3Reader:             object.reader,
+		object:               object,
+		concurrency:          options.Concurrency,
+		prefetchBufferSize:   options.PrefetchBufferSize,
+		rateLimit:            newRateLimit(options.RateLimit),
+		strictFormatCheck:    options.StrictFormatCheck,
+		expectedVirtualSize:  options.ExpectedVirtualSize,
+		virtualSizeTolerance: options.VirtualSizeTolerance,
+		targetCapacity:       options.TargetCapacity,
+		etag:                 object.etag,
+		transferResume:       options.TransferResume,
+		scratchCache:         options.ScratchCache,
+		tarMemberSelection:   options.ArchiveMemberSelection,
+	}
+	if err := sd.applyObjectOptions(options); err != nil {
+		sd.Close()
+		return nil, err
+	}
+	return sd, nil
+}
+
+// applyObjectOptions validates and sets the options of the opened object, the scratch file name, the verifications,
+// the byte range and the tar extraction.
+func (sd *S3DataSource) applyObjectOptions(options S3Options) error {
+	if name := options.TempFileName; name != "" && (name != filepath.Base(name) || name == "." || name == "..") {
+		return errors.Errorf("invalid scratch file name %q", name)
+	}
+	sd.tempFileName = options.TempFileName
+	if options.ExpectedChecksum != "" {
+		if _, _, err := parseChecksum(options.ExpectedChecksum); err != nil {
+			return err
+		}
+	}
+	sd.expectedChecksum = options.ExpectedChecksum
+	if err := sd.setByteRange(options.RangeOffset, options.RangeLength); err != nil {
+		return err
+	}
+	if options.VerifyETag {
+		if err := sd.enableETagVerification(); err != nil {
+			return err
+		}
+	}
+	if options.TarExtraction {
+		patterns, err := parseTarMemberPatterns(options.TarMemberPatterns)
+		if err != nil {
+			return err
+		}
+		sd.tarMemberPatterns = patterns
+	}
+	return nil
+}
+
+// GetTempPath returns the file Transfer writes in scratch space, empty before Transfer.
+func (sd *S3DataSource) GetTempPath() string {
+	return sd.tempPath
+}
+
+// enableETagVerification verifies the object against its ETag, failing for the objects whose ETag can't be verified.
+func (sd *S3DataSource) enableETagVerification() error {
+	if sd.rangeLength > 0 {
+		return errors.New("the ETag of a byte range of an s3 object can't be verified")
+	}
+	if sd.object != nil {
+		if sd.object.input.PartNumber != nil {
+			return errors.New("the ETag of a single part of an s3 object can't be verified")
+		}
+		if sd.object.input.SSECustomerKey != nil || sd.object.serverSideEncryption == s3.ServerSideEncryptionAwsKms {
+			return errors.New("the ETag of s3 objects encrypted with SSE-KMS or SSE-C isn't computed from their content")
+		}
+	}
+	if _, _, err := parseS3ETag(sd.etag); err != nil {
+		return err
+	}
+	sd.verifyETag = true
+	return nil
+}
+
+// GetComputedChecksum returns the ETag computed from the object once Transfer or TransferFile verified it, empty
+// before or if the ETag isn't verified.
+func (sd *S3DataSource) GetComputedChecksum() string {
+	return sd.computedChecksum
+}
+
+// setByteRange replaces the reader of the object with a reader of length bytes from offset, none if length is 0.
+func (sd *S3DataSource) setByteRange(offset, length int64) error {
+	if offset == 0 && length == 0 {
+		return nil
+	}
+	if offset < 0 || length <= 0 {
+		return errors.Errorf("invalid byte range of %d bytes at offset %d", length, offset)
+	}
+	if sd.object == nil {
+		return errors.New("a byte range requires an opened s3 object")
+	}
+	bucket, key := aws.StringValue(sd.object.input.Bucket), aws.StringValue(sd.object.input.Key)
+	if sd.object.input.PartNumber != nil {
+		return errors.Errorf("a byte range of a single part of s3 object \"%s/%s\" can't be requested", bucket, key)
+	}
+	if sd.object.size < 0 {
+		return errors.Errorf("the size of s3 object \"%s/%s\" is unknown, a byte range can't be validated", bucket, key)
+	}
+	if offset+length > sd.object.size {
+		return errors.Errorf("byte range of %d bytes at offset %d exceeds the %d bytes of s3 object \"%s/%s\"", length, offset, sd.object.size, bucket, key)
+	}
+	end := offset + length - 1
+	reader, err := sd.object.getRange(offset, end)
+	if err != nil {
+		return err
+	}
+	if sd.object.readRetries.enabled() {
+		reader = newResumableReader(context.Background(), reader, length, sd.object.readRetries, func(resumeOffset int64) (io.ReadCloser, error) {
+			return sd.object.getRange(offset+resumeOffset, end)
+		})
+	}
+	klog.V(1).Infof("Importing %d bytes of s3 object \"%s/%s\" at offset %d", length, bucket, key, offset)
+	// The object was opened from the start, only the range is read.
+	sd.s3Reader.Close()
+	sd.s3Reader = reader
+	sd.rangeOffset = offset
+	sd.rangeLength = length
+	return nil
 }
 
 // Info is called to get initial information about the data.
 func (sd *S3DataSource) Info() (ProcessingPhase, error) {
+	return sd.InfoContext(context.Background())
+}
+
+// objectSize returns the size of the object, or of its imported byte range, -1 if unknown.
+func (sd *S3DataSource) objectSize() int64 {
+	if sd.rangeLength > 0 {
+		return sd.rangeLength
+	}
+	if sd.object == nil {
+		return -1
+	}
+	return sd.object.size
+}
+
+// InfoContext is Info, reading the object until ctx is done.
+func (sd *S3DataSource) InfoContext(ctx context.Context) (ProcessingPhase, error) {
+	size := sd.objectSize()
+	var total uint64
+	if size > 0 {
+		total = uint64(size)
+	}
 	var err error
-	sd.readers, err = NewFormatReaders(sd.s3Reader, uint64(0))
+	if sd.object != nil {
+		sd.metadata = sd.object.metadata
+	}
+	sd.ctxReader = newContextReader(sd.s3Reader)
+	sd.ctxReader.setContext(ctx)
+	var reader io.ReadCloser = sd.ctxReader
+	if sd.expectedChecksum != "" {
+		if sd.checksumReader, err = newChecksumVerifyingReader(reader, sd.expectedChecksum); err != nil {
+			return ProcessingPhaseError, err
+		}
+		reader = sd.checksumReader
+	}
+	if sd.verifyETag {
+		expected, parts, err := parseS3ETag(sd.etag)
+		if err != nil {
+			return ProcessingPhaseError, err
+		}
+		if parts > 0 {
+			if sd.etagPartSize, err = sd.object.partSizeContext(ctx, parts); err != nil {
+				return ProcessingPhaseError, err
+			}
+		}
+		sd.etagReader = newS3ETagVerifyingReader(reader, expected, sd.etagPartSize)
+		reader = sd.etagReader
+	}
+	reader = withRateLimit(ctx, reader, sd.rateLimit)
+	sd.readers, err = newSourceFormatReaders(withPrefetch(context.Background(), reader, sd.prefetchBufferSize), size, sd.sourceSizeLimits, sd.sourceVerification)
 	if err != nil {
 		klog.Errorf("Error creating readers: %v", err)
 		return ProcessingPhaseError, err
 	}
+	if err = checkDeclaredFormat(sd.ep.Path, sd.readers, sd.strictFormatCheck); err != nil {
+		return ProcessingPhaseError, err
+	}
+	if err = checkBackingFile(sd.readers); err != nil {
+		return ProcessingPhaseError, err
+	}
+	if sd.extractTar() {
+		// The disk image is only known once extracted, the sizes of the archive don't tell its virtual size.
+		klog.V(1).Infof("Tar archive found, extracting the disk image in scratch space")
+		return ProcessingPhaseTransferScratch, nil
+	}
+	// The object size isn't known, only the virtual size recorded in image headers is checked.
+	if err = checkExpectedVirtualSize(sd.ep.Path, sd.readers, 0, sd.expectedVirtualSize, sd.virtualSizeTolerance); err != nil {
+		return ProcessingPhaseError, err
+	}
+	// The size of the object is the virtual size of raw objects.
+	if err = checkTargetCapacity(sd.ep.Path, sd.readers, total, sd.targetCapacity); err != nil {
+		return ProcessingPhaseError, err
+	}
+	if sd.scratchCache != nil && sd.cacheKey() != "" {
+		klog.V(1).Infof("Scratch cache requested, using scratch space")
+		return ProcessingPhaseTransferScratch, nil
+	}
 	if !sd.readers.Convert {
 		// Downloading a raw file, we can write that directly to the target.
 		return ProcessingPhaseTransferDataFile, nil
@@ -85,13 +588,54 @@ func (sd *S3DataSource) Info() (ProcessingPhase, error) {
 
 // Transfer is called to transfer the data from the source to a temporary location.
 func (sd *S3DataSource) Transfer(path string) (ProcessingPhase, error) {
+	return sd.TransferContext(context.Background(), path)
+}
+
+// TransferContext is Transfer, stopped with the context error once ctx is done.
+func (sd *S3DataSource) TransferContext(ctx context.Context, path string) (ProcessingPhase, error) {
+	sd.setContext(ctx)
 	size, _ := util.GetAvailableSpace(path)
 	if size <= int64(0) {
 		//Path provided is invalid.
 		return ProcessingPhaseError, ErrInvalidPath
 	}
-	file := filepath.Join(path, tempFile)
-	err := util.StreamDataToFile(sd.readers.TopReader(), file)
+	name := sd.tempFileName
+	if name == "" {
+		name = tempFile
+	}
+	file := filepath.Join(path, name)
+	sd.tempPath = file
+	var err error
+	if sd.extractTar() {
+		sd.readers.StartProgressUpdate()
+		sd.tarMember, err = extractTarMember(sd.readers.TopReader(), sd.tarMemberPatterns, sd.tarMemberSelection, file)
+	} else if sd.parallelDownload() {
+		err = sd.scratchCache.download(sd.cacheKey(), file, func(fileName string) error {
+			return downloadToFile(fileName, sd.objectSize(), func(w io.WriterAt) error {
+				return sd.downloadParallel(ctx, w)
+			})
+		})
+	} else if sd.resumableTransfer() {
+		sd.readers.StartProgressUpdate()
+		err = resumableTransfer(path, file, manifestURL(sd.ep), sd.etag, sd.objectSize(), sd.readers.TopReader(), sd.streamOptions().FlushPolicy, func(offset int64) (io.ReadCloser, error) {
+			// The rest of the same version of the object is requested from the offset reached.
+			sd.s3Reader.Close()
+			reader, err := sd.object.getRangeContext(ctx, offset, -1)
+			if err != nil {
+				return nil, err
+			}
+			ctxReader := newContextReader(reader)
+			ctxReader.setContext(ctx)
+			return ctxReader, nil
+		})
+	} else {
+		sd.readers.StartProgressUpdate()
+		err = sd.scratchCache.transfer(sd.cacheKey(), sd.readers.TopReader(), sd.readers.topReaderSize(sd.objectSize()), file,
+			sd.streamOptions())
+	}
+	if err == nil {
+		err = sd.verifyChecksum()
+	}
 	if err != nil {
 		return ProcessingPhaseError, err
 	}
@@ -100,30 +644,602 @@ func (sd *S3DataSource) Transfer(path string) (ProcessingPhase, error) {
 	return ProcessingPhaseConvert, nil
 }
 
+// downloadParallel downloads the object into w with concurrent requests of byte ranges. The ETag of multipart
+// uploaded objects is verified against the digests of their parts.
+func (sd *S3DataSource) downloadParallel(ctx context.Context, w io.WriterAt) error {
+	// The object is downloaded again from the start.
+	sd.s3Reader.Close()
+	open := func(start, end int64) (io.ReadCloser, error) {
+		reader, err := sd.object.getAdaptiveRange(ctx, sd.rangeOffset+start, sd.rangeOffset+end)
+		if err != nil {
+			return nil, err
+		}
+		return withRateLimit(ctx, reader, sd.rateLimit), nil
+	}
+	// The concurrency backs off when the store throttles the requests.
+	concurrency := newAdaptiveConcurrency(sd.concurrency, s3ThrottleDelay)
+	if sd.etagReader == nil {
+		return downloadRanges(ctx, w, sd.objectSize(), concurrency, sd.object.readRetries, open)
+	}
+	// The parts are hashed while downloaded, and their digests combined.
+	digests, err := downloadParts(ctx, w, sd.object.size, sd.etagPartSize, concurrency, sd.object.readRetries, open, md5.New)
+	if err != nil {
+		return err
+	}
+	computed := s3MultipartETag(digests)
+	if err := checkS3ETag(sd.etagReader.expected, computed); err != nil {
+		return err
+	}
+	sd.computedChecksum = computed
+	return nil
+}
+
 // TransferFile is called to transfer the data from the source to the passed in file.
 func (sd *S3DataSource) TransferFile(fileName string) (ProcessingPhase, error) {
-	err := util.StreamDataToFile(sd.readers.TopReader(), fileName)
+	return sd.TransferFileContext(context.Background(), fileName)
+}
+
+// TransferFileContext is TransferFile, stopped with the context error once ctx is done.
+func (sd *S3DataSource) TransferFileContext(ctx context.Context, fileName string) (ProcessingPhase, error) {
+	sd.setContext(ctx)
+	sd.readers.StartProgressUpdate()
+	err := util.StreamDataToFileWithSize(sd.readers.TopReader(), fileName, -1, sd.streamOptions())
+	if err == nil {
+		err = sd.verifyChecksum()
+	}
 	if err != nil {
 		return ProcessingPhaseError, err
 	}
 	return ProcessingPhaseResize, nil
 }
 
+// TransferToWriter is called to stream the raw image from the source to w, without scratch space.
+func (sd *S3DataSource) TransferToWriter(w io.Writer) (ProcessingPhase, error) {
+	if sd.extractTar() {
+		return ProcessingPhaseError, errors.Wrap(ErrRequiresConversion, "the disk image has to be extracted from the tar archive in scratch space")
+	}
+	phase, err := transferToWriter(sd.readers, w)
+	if err == nil {
+		err = sd.verifyChecksum()
+	}
+	if err != nil {
+		return ProcessingPhaseError, err
+	}
+	return phase, nil
+}
+
+// TransferToWriterAt is called to write the raw image from the source at its offsets in w, without scratch space.
+// Plain raw objects are downloaded in concurrent byte ranges if enabled.
+func (sd *S3DataSource) TransferToWriterAt(w io.WriterAt) (ProcessingPhase, error) {
+	if sd.extractTar() {
+		return ProcessingPhaseError, errors.Wrap(ErrRequiresConversion, "the disk image has to be extracted from the tar archive in scratch space")
+	}
+	var phase ProcessingPhase
+	var err error
+	if sd.readers != nil && !sd.readers.Convert && sd.parallelDownload() {
+		if err = sd.downloadParallel(context.Background(), w); err == nil {
+			phase = ProcessingPhaseComplete
+		}
+	} else {
+		phase, err = transferToWriterAt(sd.readers, w)
+	}
+	if err == nil {
+		err = sd.verifyChecksum()
+	}
+	if err != nil {
+		return ProcessingPhaseError, err
+	}
+	return phase, nil
+}
+
 // GetURL returns the url that the data processor can use when converting the data.
 func (sd *S3DataSource) GetURL() *url.URL {
 	return sd.url
 }
 
+// GetSourceMetadata returns the content type and the user defined metadata of the object, as content-type and
+// x-amz-meta-<name> keys. The metadata is captured by Info, it is empty before.
+func (sd *S3DataSource) GetSourceMetadata() map[string]string {
+	metadata := map[string]string{}
+	for name, value := range sd.metadata {
+		metadata[name] = value
+	}
+	return metadata
+}
+
+func (sd *S3DataSource) sourceDigest() (string, error) {
+	return sd.readers.sourceDigest()
+}
+
+func (sd *S3DataSource) verifySourceSignature() error {
+	return sd.readers.verifySourceSignature()
+}
+
+func (sd *S3DataSource) probe() (*FormatReaders, int64) {
+	return sd.readers, sd.objectSize()
+}
+
+func (sd *S3DataSource) addToManifest(manifest *ImportManifest) {
+	manifest.Source.URL = manifestURL(sd.ep)
+	manifest.Source.ETag = sd.etag
+	if sd.rangeLength > 0 {
+		manifest.Source.Range = fmt.Sprintf("bytes=%d-%d", sd.rangeOffset, sd.rangeOffset+sd.rangeLength-1)
+	}
+	manifest.addDecompress(compressionFormat(sd.readers))
+	if sd.tarMember != "" {
+		manifest.Transforms = append(manifest.Transforms, ImportManifestTransform{Type: ManifestTransformExtract, Format: "tar", Member: sd.tarMember})
+	}
+}
+
+func (sd *S3DataSource) formatReaders() *FormatReaders {
+	return sd.readers
+}
+
 // Close closes any readers or other open resources.
 func (sd *S3DataSource) Close() error {
 	var err error
 	if sd.readers != nil {
 		err = sd.readers.Close()
+	} else if sd.s3Reader != nil {
+		err = sd.s3Reader.Close()
+	}
+	if sd.tempPath != "" && isInterruptedTransfer(sd.tempPath) {
+		klog.Infof("Keeping %s to resume the transfer", sd.tempPath)
+	} else if sd.tempPath != "" {
+		if removeErr := os.Remove(sd.tempPath); removeErr != nil && !os.IsNotExist(removeErr) && err == nil {
+			err = errors.Wrapf(removeErr, "unable to remove %s", sd.tempPath)
+		}
+		sd.tempPath = ""
 	}
 	return err
 }
 
-func createS3Reader(ep *url.URL, accessKey, secKey string, certDir string) (io.ReadCloser, error) {
+// verifyChecksum fails if the checksum or the ETag of the object doesn't match, reading the rest of the object the
+// transfer didn't need.
+func (sd *S3DataSource) verifyChecksum() error {
+	if sd.checksumReader != nil {
+		if err := sd.checksumReader.verify(); err != nil {
+			return err
+		}
+	}
+	if sd.etagReader != nil && sd.computedChecksum == "" {
+		if err := sd.etagReader.verify(); err != nil {
+			return err
+		}
+		sd.computedChecksum = sd.etagReader.computed
+	}
+	return nil
+}
+
+// cacheKey returns the key of the object in the scratch cache, empty if it can't be cached. The cached scratch files
+// are decompressed, so they can't be verified against the expected checksum or the ETag of the object. Disk images
+// extracted from tar archives and byte ranges of objects aren't cached.
+func (sd *S3DataSource) cacheKey() string {
+	if sd.expectedChecksum != "" || sd.verifyETag || sd.extractTar() || sd.rangeLength > 0 {
+		return ""
+	}
+	return scratchCacheKey(sd.ep, sd.etag)
+}
+
+// setContext makes the reads of the object stop once ctx is done.
+func (sd *S3DataSource) setContext(ctx context.Context) {
+	if sd.ctxReader != nil {
+		sd.ctxReader.setContext(ctx)
+	}
+}
+
+// extractTar returns true if Transfer extracts the disk image from the tar archive of the object.
+func (sd *S3DataSource) extractTar() bool {
+	return sd.tarMemberPatterns != nil && sd.readers != nil && sd.readers.TarArchive
+}
+
+// resumableTransfer returns true if Transfer records its progress, so a restarted importer resumes it. The resumed
+// transfer requests the rest of the same version of the object by range, so only plain objects of a known ETag whose
+// data doesn't need to be verified from the start qualify.
+func (sd *S3DataSource) resumableTransfer() bool {
+	if !sd.transferResume || sd.object == nil || sd.etag == "" || sd.object.input.PartNumber != nil {
+		return false
+	}
+	return !sd.readers.Archived && !sd.digest && sd.signature == nil && sd.checksumReader == nil &&
+		sd.etagReader == nil && sd.rangeOffset == 0 && sd.rangeLength == 0 && (sd.scratchCache == nil || sd.cacheKey() == "")
+}
+
+// parallelDownload returns true if Transfer downloads byte ranges of the object concurrently. The data read through
+// the readers isn't used then, so only plain objects whose digest or checksum isn't required qualify. Multipart
+// uploaded objects whose ETag is verified qualify, their parts are hashed concurrently.
+func (sd *S3DataSource) parallelDownload() bool {
+	if sd.concurrency <= 1 || sd.object == nil || sd.objectSize() <= 0 || sd.object.input.PartNumber != nil {
+		return false
+	}
+	if !sd.object.acceptRanges {
+		klog.V(1).Infof("The object doesn't advertise byte ranges, downloading in a single stream")
+		return false
+	}
+	if sd.etagReader != nil && sd.etagPartSize == 0 {
+		klog.V(1).Infof("The ETag of single part objects is verified in a single stream")
+		return false
+	}
+	return !sd.readers.Archived && !sd.digest && sd.signature == nil && sd.checksumReader == nil
+}
+
+// s3PathStyleEndpoint returns ep in path-style, endpoint/bucket/key. The virtual-hosted-style endpoints of AWS S3,
+// bucket.endpoint/key, are rewritten unless forcePathStyle is set. The bucket can't be told from the host of other
+// providers, their endpoints are always path-style.
+func s3PathStyleEndpoint(ep *url.URL, forcePathStyle bool) *url.URL {
+	if forcePathStyle {
+		return ep
+	}
+	matches := s3VirtualHostPattern.FindStringSubmatch(strings.ToLower(ep.Hostname()))
+	if matches == nil {
+		return ep
+	}
+	bucket := matches[1]
+	pathStyle := *ep
+	pathStyle.Host = matches[2]
+	if port := ep.Port(); port != "" {
+		pathStyle.Host += ":" + port
+	}
+	pathStyle.Path = s3FolderSep + bucket + ep.Path
+	if ep.RawPath != "" {
+		// Keeps the escaping of the key, a bucket name has nothing to escape.
+		pathStyle.RawPath = s3FolderSep + bucket + ep.RawPath
+	}
+	klog.V(1).Infof("Reading bucket %s from %s", bucket, pathStyle.Host)
+	return &pathStyle
+}
+
+// withS3VersionID returns ep with the version versionID of the object, ep if versionID is empty. The version can't
+// differ from a version of ep, nor be combined with a tag selector, which selects the latest version of an object.
+func withS3VersionID(ep *url.URL, versionID string) (*url.URL, error) {
+	query := ep.Query()
+	if versionID == "" {
+		versionID = query.Get(s3VersionIDParam)
+		if versionID == "" {
+			return ep, nil
+		}
+	} else if value := query.Get(s3VersionIDParam); value != "" && value != versionID {
+		return nil, errors.Errorf("s3 version id %q conflicts with version id %q of the endpoint", versionID, value)
+	}
+	if query.Get(s3TagSelectorParam) != "" {
+		return nil, errors.New("an s3 version id can't be combined with a tag selector")
+	}
+	query.Set(s3VersionIDParam, versionID)
+	versioned := *ep
+	versioned.RawQuery = query.Encode()
+	return &versioned, nil
+}
+
+// isS3AnonymousDenied returns true if err denies an anonymous request, sent without credentials.
+func isS3AnonymousDenied(err error, accessKey, secKey string) bool {
+	var requestFailure awserr.RequestFailure
+	return accessKey == "" && secKey == "" && errors.As(err, &requestFailure) && requestFailure.StatusCode() == http.StatusForbidden
+}
+
+// isS3AccessDenied returns true if err denies access to an object, like a request to a requester pays bucket which
+// doesn't accept the charges.
+func isS3AccessDenied(err error) bool {
+	var requestFailure awserr.RequestFailure
+	return errors.As(err, &requestFailure) && requestFailure.StatusCode() == http.StatusForbidden && requestFailure.Code() == "AccessDenied"
+}
+
+// isS3ExpiredCredentials returns true if err reports that the temporary credentials of the request expired. Once the
+// object was read, a denied access means the credentials expired as well, since S3 doesn't always report them as such.
+func isS3ExpiredCredentials(err error, opened bool) bool {
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case "ExpiredToken", "ExpiredTokenException", "TokenRefreshRequired":
+			return true
+		}
+	}
+	return opened && isS3AccessDenied(err)
+}
+
+// isS3MissingVersion returns true if err reports that the requested version of an object doesn't exist.
+func isS3MissingVersion(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == "NoSuchVersion"
+}
+
+// isS3WrongCustomerKey returns true if err reports that the customer key sent doesn't match the key the object is
+// encrypted with.
+func isS3WrongCustomerKey(err error) bool {
+	var requestFailure awserr.RequestFailure
+	return errors.As(err, &requestFailure) && requestFailure.StatusCode() == http.StatusForbidden
+}
+
+// isS3MissingCustomerKey returns true if err reports that the object is encrypted with a customer key which wasn't
+// sent.
+func isS3MissingCustomerKey(err error) bool {
+	var requestFailure awserr.RequestFailure
+	return errors.As(err, &requestFailure) && requestFailure.StatusCode() == http.StatusBadRequest &&
+		requestFailure.Code() == "InvalidRequest" && strings.Contains(requestFailure.Message(), "Server Side Encryption")
+}
+
+// withS3AlternateEndpoints returns the endpoint of the object followed by the same object at the alternate hosts.
+func withS3AlternateEndpoints(ep *url.URL, hosts []string) []*url.URL {
+	endpoints := []*url.URL{ep}
+	for _, host := range hosts {
+		alternate := *ep
+		alternate.Host = host
+		endpoints = append(endpoints, &alternate)
+	}
+	return endpoints
+}
+
+// isS3EndpointFailure returns true unless err reports a missing bucket or object, which the alternate endpoints
+// would report as well.
+func isS3EndpointFailure(err error) bool {
+	var requestFailure awserr.RequestFailure
+	if errors.As(err, &requestFailure) {
+		return requestFailure.StatusCode() != http.StatusNotFound
+	}
+	return true
+}
+
+// isS3Retryable returns true if err is transient: a server error, throttling or a temporary network error.
+func isS3Retryable(err error) bool {
+	var requestFailure awserr.RequestFailure
+	if errors.As(err, &requestFailure) {
+		if status := requestFailure.StatusCode(); status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+			return true
+		}
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		// S3 throttles with SlowDown, unknown to the SDK.
+		if awsErr.Code() == "SlowDown" || request.IsErrorRetryable(awsErr) || request.IsErrorThrottle(awsErr) {
+			return true
+		}
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && (netErr.Temporary() || netErr.Timeout())
+}
+
+// isS3Throttled returns true if err reports a request throttled by the store, with a 429 response or SlowDown.
+func isS3Throttled(err error) bool {
+	var requestFailure awserr.RequestFailure
+	if errors.As(err, &requestFailure) && requestFailure.StatusCode() == http.StatusTooManyRequests {
+		return true
+	}
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && (awsErr.Code() == "SlowDown" || request.IsErrorThrottle(awsErr))
+}
+
+// s3ThrottledError is a request of an object throttled by the store, with the delay asked by the Retry-After header
+// of the response, 0 if none.
+type s3ThrottledError struct {
+	error
+	retryAfter time.Duration
+}
+
+// Cause returns the error of the request.
+func (e *s3ThrottledError) Cause() error {
+	return e.error
+}
+
+// Unwrap returns the error of the request.
+func (e *s3ThrottledError) Unwrap() error {
+	return e.error
+}
+
+// s3ThrottleDelay returns the delay asked by the store before sending again a request failing with err, and true if
+// the request was throttled.
+func s3ThrottleDelay(err error) (time.Duration, bool) {
+	var throttled *s3ThrottledError
+	if errors.As(err, &throttled) {
+		return throttled.retryAfter, true
+	}
+	return 0, false
+}
+
+// getS3ObjectWithRetry gets the object, retrying transient errors up to attempts times, with an exponential backoff
+// starting at backoff. The throttled requests are retried after the delay asked by the store if longer, or fail right
+// away unless retryThrottled.
+func getS3ObjectWithRetry(ctx context.Context, client S3Client, input *s3.GetObjectInput, attempts int, backoff time.Duration, retryThrottled bool) (*s3.GetObjectOutput, error) {
+	for attempt := 1; ; attempt++ {
+		objOutput, err := getS3Object(ctx, client, input)
+		if err == nil || attempt >= attempts || !isS3Retryable(err) {
+			return objOutput, err
+		}
+		delay := backoff
+		if retryAfter, throttled := s3ThrottleDelay(err); throttled {
+			if !retryThrottled {
+				return objOutput, err
+			}
+			if retryAfter > delay {
+				delay = retryAfter
+			}
+		}
+		klog.Warningf("Unable to get s3 object \"%s/%s\", retrying in %v (attempt %d of %d): %v", aws.StringValue(input.Bucket), aws.StringValue(input.Key), delay, attempt, attempts, err)
+		if err := readRetrySleep(ctx, delay); err != nil {
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// getS3Object gets the object with client, cancelled with ctx if the client supports it. Throttled requests fail
+// with an s3ThrottledError.
+func getS3Object(ctx context.Context, client S3Client, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var objOutput *s3.GetObjectOutput
+	var err error
+	var retryAfter time.Duration
+	if contextClient, ok := client.(s3ContextClient); ok {
+		objOutput, err = contextClient.GetObjectWithContext(ctx, input, func(r *request.Request) {
+			r.Handlers.Complete.PushBack(func(r *request.Request) {
+				if r.HTTPResponse != nil {
+					retryAfter, _ = retryAfterDelay(r.HTTPResponse, retryAfterNow())
+				}
+			})
+		})
+	} else {
+		objOutput, err = client.GetObject(input)
+	}
+	if err != nil && isS3Throttled(err) {
+		return nil, &s3ThrottledError{error: err, retryAfter: retryAfter}
+	}
+	return objOutput, err
+}
+
+// s3SSECustomerAlgorithm is the default algorithm of the customer keys of server-side encryption.
+const s3SSECustomerAlgorithm = "AES256"
+
+// s3CustomerKey is the key an object is encrypted with on the server (SSE-C), sent with every request of the object.
+type s3CustomerKey struct {
+	algorithm string
+	// key is the raw key, the client encodes it and adds its digest to the requests.
+	key string
+}
+
+// parseS3CustomerKey decodes the base64 encoded customer key of algorithm, AES256 if empty. It returns nil if key is
+// empty.
+func parseS3CustomerKey(key, algorithm string) (*s3CustomerKey, error) {
+	if key == "" {
+		if algorithm != "" {
+			return nil, errors.Errorf("s3 encryption algorithm %s requires a customer key", algorithm)
+		}
+		return nil, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid s3 customer key, expected base64")
+	}
+	if algorithm == "" {
+		algorithm = s3SSECustomerAlgorithm
+	}
+	if algorithm == s3SSECustomerAlgorithm && len(raw) != 32 {
+		return nil, errors.Errorf("s3 customer key of algorithm %s must be 32 bytes, got %d", algorithm, len(raw))
+	}
+	return &s3CustomerKey{algorithm: algorithm, key: string(raw)}, nil
+}
+
+// s3Object is an object opened with the S3 client.
+type s3Object struct {
+	// mutex guards client and clientGeneration, the client is replaced when its credentials are refreshed.
+	mutex  sync.Mutex
+	client S3Client
+	// clientGeneration counts the refreshes of the client.
+	clientGeneration int
+	// newClient returns a client with fresh credentials, nil if the credentials can't be refreshed.
+	newClient func() (S3Client, error)
+	// opened is true once the object was read successfully.
+	opened bool
+	input  *s3.GetObjectInput
+	// reader reads the object from the start.
+	reader io.ReadCloser
+	etag   string
+	// size is the size of the object, -1 if unknown.
+	size int64
+	// acceptRanges is true if the server advertises byte ranges of the object.
+	acceptRanges bool
+	// metadata is the content type and the user defined metadata of the object.
+	metadata map[string]string
+	// serverSideEncryption is the server-side encryption algorithm of the object, empty if not reported.
+	serverSideEncryption string
+	// readInactivity fails the reads of the object that return no data for that long.
+	readInactivity time.Duration
+	// getAttempts is the number of times a request failing with a transient error is made, getBackoff the delay
+	// before the second attempt.
+	getAttempts int
+	getBackoff  time.Duration
+	// readRetries are the settings of resuming the failed reads of the object.
+	readRetries readRetries
+}
+
+// partSizeContext returns the size of the first part of the same version of the multipart uploaded object of parts
+// parts, the size of every part but the last. Objects whose parts differ in size are rejected.
+func (o *s3Object) partSizeContext(ctx context.Context, parts int) (int64, error) {
+	partInput := *o.input
+	partInput.PartNumber = aws.Int64(1)
+	if o.etag != "" {
+		partInput.IfMatch = aws.String(o.etag)
+	}
+	objOutput, err := o.getObject(ctx, &partInput, true)
+	if err != nil {
+		return 0, errors.Wrapf(err, "could not get the first part of s3 object: \"%s/%s\"", aws.StringValue(o.input.Bucket), aws.StringValue(o.input.Key))
+	}
+	objOutput.Body.Close()
+	partSize := aws.Int64Value(objOutput.ContentLength)
+	if partSize <= 0 || o.size < 0 || (o.size+partSize-1)/partSize != int64(parts) {
+		return 0, errors.Errorf("the parts of s3 object \"%s/%s\" differ in size, its ETag can't be verified", aws.StringValue(o.input.Bucket), aws.StringValue(o.input.Key))
+	}
+	return partSize, nil
+}
+
+// getRange gets the byte range of the same version of the object from start to end inclusive, to the end of the
+// object if end is negative.
+func (o *s3Object) getRange(start, end int64) (io.ReadCloser, error) {
+	return o.getRangeContext(context.Background(), start, end)
+}
+
+// getRangeContext is getRange, cancelled with ctx.
+func (o *s3Object) getRangeContext(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+	return o.openRange(ctx, start, end, true)
+}
+
+// getAdaptiveRange is getRangeContext for the concurrent range downloads. The throttled requests fail right away with
+// an s3ThrottledError, the download lowers its concurrency before sending them again.
+func (o *s3Object) getAdaptiveRange(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+	return o.openRange(ctx, start, end, false)
+}
+
+// openRange gets the byte range from start to end inclusive, retrying the throttled requests if retryThrottled.
+func (o *s3Object) openRange(ctx context.Context, start, end int64, retryThrottled bool) (io.ReadCloser, error) {
+	rangeInput := *o.input
+	if end < 0 {
+		rangeInput.Range = aws.String(fmt.Sprintf("bytes=%d-", start))
+	} else {
+		rangeInput.Range = aws.String(fmt.Sprintf("bytes=%d-%d", start, end))
+	}
+	if o.etag != "" {
+		rangeInput.IfMatch = aws.String(o.etag)
+	}
+	objOutput, err := o.getObject(ctx, &rangeInput, retryThrottled)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not get s3 object: \"%s/%s\" %s", aws.StringValue(o.input.Bucket), aws.StringValue(o.input.Key), *rangeInput.Range)
+	}
+	return newInactivityReader(objOutput.Body, o.readInactivity), nil
+}
+
+// getObject gets the object with input, refreshing the credentials of the client once if they expired. The throttled
+// requests are retried like the other transient errors if retryThrottled.
+func (o *s3Object) getObject(ctx context.Context, input *s3.GetObjectInput, retryThrottled bool) (*s3.GetObjectOutput, error) {
+	o.mutex.Lock()
+	client, generation, opened := o.client, o.clientGeneration, o.opened
+	o.mutex.Unlock()
+	objOutput, err := getS3ObjectWithRetry(ctx, client, input, o.getAttempts, o.getBackoff, retryThrottled)
+	if err == nil || o.newClient == nil || !isS3ExpiredCredentials(err, opened) {
+		return objOutput, err
+	}
+	klog.Warningf("The credentials of s3 object \"%s/%s\" expired, refreshing them: %v", aws.StringValue(input.Bucket), aws.StringValue(input.Key), err)
+	if client, err = o.refreshClient(generation); err != nil {
+		return nil, err
+	}
+	return getS3ObjectWithRetry(ctx, client, input, o.getAttempts, o.getBackoff, retryThrottled)
+}
+
+// refreshClient replaces the client of the given generation with a client with fresh credentials. The concurrent
+// requests failing with the same client share a single refresh.
+func (o *s3Object) refreshClient(generation int) (S3Client, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.clientGeneration != generation {
+		return o.client, nil
+	}
+	client, err := o.newClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to refresh the expired s3 credentials")
+	}
+	o.client = client
+	o.clientGeneration++
+	return client, nil
+}
+
+func createS3Reader(ep *url.URL, accessKey, secKey string, certDir string, customerKey *s3CustomerKey, requesterPays bool, clientOptions s3ClientOptions) (*s3Object, error) {
 	klog.V(3).Infoln("Using S3 client to get data")
 
 	endpoint := ep.Host
@@ -133,7 +1249,7 @@ func createS3Reader(ep *url.URL, accessKey, secKey string, certDir string) (io.R
 
 	klog.V(1).Infof("bucket %s", bucket)
 	klog.V(1).Infof("object %s", object)
-	svc, err := newClientFunc(endpoint, accessKey, secKey, certDir)
+	svc, err := newClientFunc(endpoint, accessKey, secKey, certDir, clientOptions)
 	if err != nil {
 		return nil, errors.Wrapf(err, "could not build s3 client for %q", ep.Host)
 	}
@@ -142,45 +1258,159 @@ func createS3Reader(ep *url.URL, accessKey, secKey string, certDir string) (io.R
 		Bucket: aws.String(bucket),
 		Key:    aws.String(object),
 	}
-	objOutput, err := svc.GetObject(objInput)
+	if value := ep.Query().Get(s3PartNumberParam); value != "" {
+		partNumber, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || partNumber < 1 {
+			return nil, errors.Errorf("invalid s3 part number %q", value)
+		}
+		klog.V(1).Infof("part number %d", partNumber)
+		objInput.PartNumber = aws.Int64(partNumber)
+	}
+	if versionID := ep.Query().Get(s3VersionIDParam); versionID != "" {
+		klog.V(1).Infof("version %s", versionID)
+		objInput.VersionId = aws.String(versionID)
+	}
+	if customerKey != nil {
+		klog.V(1).Infof("customer encryption key %s", customerKey.algorithm)
+		objInput.SSECustomerAlgorithm = aws.String(customerKey.algorithm)
+		objInput.SSECustomerKey = aws.String(customerKey.key)
+	}
+	if requesterPays {
+		klog.V(1).Infof("requester pays")
+		objInput.RequestPayer = aws.String(s3.RequestPayerRequester)
+	}
+	obj := &s3Object{
+		client:         svc,
+		input:          objInput,
+		size:           -1,
+		readInactivity: clientOptions.timeouts.ReadInactivity,
+		getAttempts:    clientOptions.getAttempts,
+		getBackoff:     clientOptions.getBackoff,
+		readRetries:    clientOptions.readRetries,
+	}
+	if refresh := clientOptions.refreshCredentials; refresh != nil {
+		obj.newClient = func() (S3Client, error) {
+			creds, err := refresh()
+			if err != nil {
+				return nil, err
+			}
+			options := clientOptions
+			options.sessionToken = creds.SessionToken
+			return newClientFunc(endpoint, creds.AccessKeyID, creds.SecretAccessKey, certDir, options)
+		}
+	}
+	objOutput, err := obj.getObject(context.Background(), objInput, true)
 	if err != nil {
+		if customerKey != nil && isS3WrongCustomerKey(err) {
+			return nil, errors.Wrapf(err, "wrong encryption key for s3 object \"%s/%s\"", bucket, object)
+		}
+		if customerKey == nil && isS3MissingCustomerKey(err) {
+			return nil, errors.Wrapf(err, "s3 object \"%s/%s\" is encrypted with a customer key, no encryption key was provided", bucket, object)
+		}
+		if isS3AnonymousDenied(err, accessKey, secKey) {
+			return nil, errors.Wrapf(err, "bucket %q requires authentication, no s3 credentials were provided", bucket)
+		}
+		if !requesterPays && isS3AccessDenied(err) {
+			return nil, errors.Wrapf(err, "access to s3 object \"%s/%s\" denied, if bucket %q is a requester pays bucket, enable requester pays to accept the charges of the requests", bucket, object, bucket)
+		}
+		if objInput.VersionId != nil && isS3MissingVersion(err) {
+			return nil, errors.Wrapf(err, "version %q of s3 object \"%s/%s\" does not exist", *objInput.VersionId, bucket, object)
+		}
 		return nil, errors.Wrapf(err, "could not get s3 object: \"%s/%s\"", bucket, object)
 	}
-	objectReader := objOutput.Body
-	return objectReader, nil
+	obj.opened = true
+	obj.reader = newInactivityReader(objOutput.Body, clientOptions.timeouts.ReadInactivity)
+	obj.etag = aws.StringValue(objOutput.ETag)
+	obj.acceptRanges = aws.StringValue(objOutput.AcceptRanges) == "bytes"
+	obj.metadata = s3ObjectMetadata(objOutput)
+	obj.serverSideEncryption = aws.StringValue(objOutput.ServerSideEncryption)
+	if objOutput.ContentLength != nil {
+		obj.size = *objOutput.ContentLength
+	}
+	if obj.readRetries.enabled() && objInput.PartNumber == nil {
+		// The rest of the same version of the object is requested from the offset reached, a single part can't be
+		// requested by range.
+		obj.reader = newResumableReader(context.Background(), obj.reader, obj.size, obj.readRetries, func(offset int64) (io.ReadCloser, error) {
+			return obj.getRange(offset, -1)
+		})
+	}
+	return obj, nil
 }
 
-func getS3Client(endpoint, accessKey, secKey string, certDir string) (S3Client, error) {
+// s3ObjectMetadata returns the content type and the user defined metadata of the object, keyed by lower case header
+// name.
+func s3ObjectMetadata(output *s3.GetObjectOutput) map[string]string {
+	metadata := map[string]string{}
+	if output.ContentType != nil {
+		metadata["content-type"] = *output.ContentType
+	}
+	for name, value := range output.Metadata {
+		if value != nil {
+			metadata[s3MetadataPrefix+strings.ToLower(name)] = *value
+		}
+	}
+	return metadata
+}
+
+func getS3Client(endpoint, accessKey, secKey string, certDir string, options s3ClientOptions) (S3Client, error) {
 	// Adding certs using CustomCABundle will overwrite the SystemCerts, so we opt by creating a custom HTTPClient
-	httpClient, err := createHTTPClient(certDir)
+	httpClient, err := createHTTPClient(certDir, options.pins)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "Error creating http client for s3")
 	}
+	if transport, ok := httpClient.Transport.(*http.Transport); ok {
+		options.timeouts.applyTo(transport)
+	}
 
-	creds := credentials.NewStaticCredentials(accessKey, secKey, "")
-	region := extractRegion(endpoint)
-	sess, err := session.NewSession(&aws.Config{
+	creds := credentials.NewStaticCredentials(accessKey, secKey, options.sessionToken)
+	if accessKey == "" && secKey == "" {
+		// Public buckets are read with unsigned requests.
+		klog.V(1).Infof("No s3 credentials, sending anonymous requests")
+		creds = credentials.AnonymousCredentials
+	}
+	region := options.region
+	if region == "" {
+		region = extractRegion(endpoint)
+	}
+	config := &aws.Config{
 		Region:           aws.String(region),
 		Endpoint:         aws.String(endpoint),
 		Credentials:      creds,
 		S3ForcePathStyle: aws.Bool(true),
 		HTTPClient:       httpClient,
-	},
-	)
+	}
+	if options.disableChecksums {
+		config.DisableComputeChecksums = aws.Bool(true)
+		config.S3DisableContentMD5Validation = aws.Bool(true)
+	}
+	sess, err := session.NewSession(config)
 	if err != nil {
 		return nil, err
 	}
+	// The session may load a custom CA bundle into the transport, wrap the transport once it did.
+	httpClient.Transport = newRetryAfterTransport(httpClient.Transport, options.retryAfterBudget)
 
 	svc := s3.New(sess)
 	return svc, nil
 }
 
+// extractRegion returns the region of the endpoint s, read from its host.
 func extractRegion(s string) string {
 	var region string
-	r, _ := regexp.Compile("s3\\.(.+)\\.amazonaws\\.com")
-	if matches := r.FindStringSubmatch(s); matches != nil {
+	host := strings.ToLower(s)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if matches := s3RegionPattern.FindStringSubmatch(host); matches != nil {
 		region = matches[1]
+		if region == "external-1" {
+			// The legacy name of the endpoint of us-east-1
+			region = "us-east-1"
+		}
+	} else if host == s3GlobalEndpoint || strings.HasSuffix(host, "."+s3GlobalEndpoint) {
+		// The global endpoint
+		region = "us-east-1"
 	} else {
 		region = strings.Split(s, ".")[0]
 	}
@@ -0,0 +1,167 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// s3ETagPattern matches the ETags S3 computes from the content of objects: the MD5 of objects uploaded in a single
+// part, the MD5 of the concatenated MD5 of the parts followed by -<number of parts> for multipart uploads.
+var s3ETagPattern = regexp.MustCompile(`^([0-9a-f]{32})(?:-([0-9]+))?$`)
+
+// parseS3ETag returns the ETag of an object without quotes, and its number of parts, 0 for single part uploads.
+func parseS3ETag(etag string) (string, int, error) {
+	etag = strings.ToLower(strings.Trim(etag, `"`))
+	match := s3ETagPattern.FindStringSubmatch(etag)
+	if match == nil {
+		return "", 0, errors.Errorf("ETag %q isn't computed from the content of the object", etag)
+	}
+	if match[2] == "" {
+		return etag, 0, nil
+	}
+	parts, err := strconv.Atoi(match[2])
+	if err != nil || parts < 1 {
+		return "", 0, errors.Errorf("invalid number of parts in ETag %q", etag)
+	}
+	return etag, parts, nil
+}
+
+// s3MultipartETag returns the ETag of a multipart upload of the parts whose MD5 digests are passed in.
+func s3MultipartETag(digests [][]byte) string {
+	h := md5.New()
+	for _, digest := range digests {
+		h.Write(digest)
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(h.Sum(nil)), len(digests))
+}
+
+// s3ETagHash computes the ETag of an object as S3 does, while the object is written to it. Multipart uploads are
+// hashed in parts of partSize bytes, the last part possibly shorter.
+type s3ETagHash struct {
+	// partSize is the size of the parts, 0 for single part uploads.
+	partSize int64
+	// part hashes the current part.
+	part hash.Hash
+	// written is the number of bytes of the current part written.
+	written int64
+	// digests are the digests of the complete parts.
+	digests [][]byte
+}
+
+// newS3ETagHash returns a hash of the ETag of an object uploaded in parts of partSize bytes, in a single part if
+// partSize is 0.
+func newS3ETagHash(partSize int64) *s3ETagHash {
+	return &s3ETagHash{partSize: partSize, part: md5.New()}
+}
+
+// Write hashes p, starting a new part whenever the current part is complete.
+func (h *s3ETagHash) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		chunk := p
+		if h.partSize > 0 && int64(len(chunk)) > h.partSize-h.written {
+			chunk = chunk[:h.partSize-h.written]
+		}
+		h.part.Write(chunk)
+		h.written += int64(len(chunk))
+		p = p[len(chunk):]
+		if h.partSize > 0 && h.written == h.partSize {
+			h.digests = append(h.digests, h.part.Sum(nil))
+			h.part.Reset()
+			h.written = 0
+		}
+	}
+	return n, nil
+}
+
+// etag returns the ETag of the data written.
+func (h *s3ETagHash) etag() string {
+	if h.partSize == 0 {
+		return hex.EncodeToString(h.part.Sum(nil))
+	}
+	digests := h.digests
+	if h.written > 0 || len(digests) == 0 {
+		digests = append(digests, h.part.Sum(nil))
+	}
+	return s3MultipartETag(digests)
+}
+
+// s3ETagVerifyingReader computes the ETag of the data read from reader, and fails at the end of the data if it doesn't
+// match the expected ETag.
+type s3ETagVerifyingReader struct {
+	reader   io.ReadCloser
+	hash     *s3ETagHash
+	expected string
+	// computed is the ETag of the data, empty until the end of the data was reached.
+	computed string
+}
+
+// newS3ETagVerifyingReader returns a reader verifying the data of reader matches the ETag expected of an object
+// uploaded in parts of partSize bytes, in a single part if partSize is 0.
+func newS3ETagVerifyingReader(reader io.ReadCloser, expected string, partSize int64) *s3ETagVerifyingReader {
+	return &s3ETagVerifyingReader{
+		reader:   reader,
+		hash:     newS3ETagHash(partSize),
+		expected: expected,
+	}
+}
+
+// Read reads from the reader, verifying the ETag at EOF.
+func (r *s3ETagVerifyingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && r.computed == "" {
+		r.computed = r.hash.etag()
+		if err := checkS3ETag(r.expected, r.computed); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// verify reads the rest of the data, and fails if the ETag doesn't match.
+func (r *s3ETagVerifyingReader) verify() error {
+	if r.computed != "" {
+		return checkS3ETag(r.expected, r.computed)
+	}
+	_, err := io.Copy(ioutil.Discard, r)
+	return err
+}
+
+// Close closes the reader.
+func (r *s3ETagVerifyingReader) Close() error {
+	return r.reader.Close()
+}
+
+// checkS3ETag fails if the computed ETag doesn't match the expected ETag.
+func checkS3ETag(expected, computed string) error {
+	if computed != expected {
+		return errors.Errorf("ETag mismatch, expected %s, got %s", expected, computed)
+	}
+	return nil
+}
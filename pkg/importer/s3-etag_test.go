@@ -0,0 +1,231 @@
+package importer
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// multipartS3Client serves data uploaded in parts of partSize bytes, a single part if partSize is 0, honoring byte
+// ranges and part numbers.
+type multipartS3Client struct {
+	data     []byte
+	partSize int
+	// etag overrides the ETag computed from data if not empty.
+	etag                 string
+	serverSideEncryption string
+	mutex                sync.Mutex
+	inputs               []*s3.GetObjectInput
+}
+
+// expectedETag returns the ETag S3 computes for the upload of the client data.
+func (c *multipartS3Client) expectedETag() string {
+	if c.partSize == 0 {
+		sum := md5.Sum(c.data)
+		return hex.EncodeToString(sum[:])
+	}
+	var digests []byte
+	parts := 0
+	for start := 0; start < len(c.data); start += c.partSize {
+		end := start + c.partSize
+		if end > len(c.data) {
+			end = len(c.data)
+		}
+		sum := md5.Sum(c.data[start:end])
+		digests = append(digests, sum[:]...)
+		parts++
+	}
+	sum := md5.Sum(digests)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), parts)
+}
+
+func (c *multipartS3Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	c.mutex.Lock()
+	c.inputs = append(c.inputs, input)
+	c.mutex.Unlock()
+	start, end := 0, len(c.data)-1
+	if input.PartNumber != nil {
+		start = int(*input.PartNumber-1) * c.partSize
+		end = start + c.partSize - 1
+		if end >= len(c.data) {
+			end = len(c.data) - 1
+		}
+	} else if input.Range != nil {
+		bounds := strings.Split(strings.TrimPrefix(*input.Range, "bytes="), "-")
+		fmt.Sscan(bounds[0], &start)
+		if bounds[1] != "" {
+			fmt.Sscan(bounds[1], &end)
+		}
+	}
+	etag := c.etag
+	if etag == "" {
+		etag = c.expectedETag()
+	}
+	output := &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(&chunkedReader{data: c.data[start : end+1]}),
+		ContentLength: aws.Int64(int64(end + 1 - start)),
+		AcceptRanges:  aws.String("bytes"),
+		ETag:          aws.String("\"" + etag + "\""),
+	}
+	if c.serverSideEncryption != "" {
+		output.ServerSideEncryption = aws.String(c.serverSideEncryption)
+	}
+	return output, nil
+}
+
+// ranges returns the byte ranges requested by the client.
+func (c *multipartS3Client) ranges() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var ranges []string
+	for _, input := range c.inputs {
+		if input.Range != nil {
+			ranges = append(ranges, *input.Range)
+		}
+	}
+	return ranges
+}
+
+var _ = Describe("S3 ETag verification", func() {
+	const partSize = 5 * 1024 * 1024
+	var (
+		client *multipartS3Client
+		sd     *S3DataSource
+		tmpDir string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "etag")
+		Expect(err).NotTo(HaveOccurred())
+		client = &multipartS3Client{data: cirrosData}
+		newClientFunc = func(endpoint, accKey, secKey string, certDir string, options s3ClientOptions) (S3Client, error) {
+			return client, nil
+		}
+	})
+
+	AfterEach(func() {
+		newClientFunc = getS3Client
+		if sd != nil {
+			sd.Close()
+			sd = nil
+		}
+		os.RemoveAll(tmpDir)
+	})
+
+	transfer := func(concurrency int) error {
+		var err error
+		sd, err = NewS3DataSourceWithOptions("http://amazon.com/bucket/cirros.qcow2", "", "", "", S3Options{Concurrency: concurrency, VerifyETag: true})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := sd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseTransferScratch))
+		_, err = sd.Transfer(tmpDir)
+		return err
+	}
+
+	It("should verify single part objects against their MD5", func() {
+		Expect(transfer(1)).To(Succeed())
+		sum := md5.Sum(cirrosData)
+		Expect(sd.GetComputedChecksum()).To(Equal(hex.EncodeToString(sum[:])))
+	})
+
+	It("should verify single part objects in a single stream", func() {
+		Expect(transfer(4)).To(Succeed())
+		Expect(client.ranges()).To(BeEmpty())
+		Expect(sd.GetComputedChecksum()).To(Equal(client.expectedETag()))
+	})
+
+	It("should verify multipart objects read in a single stream", func() {
+		client.partSize = partSize
+		Expect(transfer(1)).To(Succeed())
+		Expect(sd.GetComputedChecksum()).To(Equal(client.expectedETag()))
+		Expect(sd.GetComputedChecksum()).To(HaveSuffix("-3"))
+		Expect(client.inputs[1].PartNumber).To(Equal(aws.Int64(1)))
+	})
+
+	It("should hash the parts of multipart objects downloaded concurrently", func() {
+		client.partSize = partSize
+		Expect(transfer(4)).To(Succeed())
+		Expect(sd.GetComputedChecksum()).To(Equal(client.expectedETag()))
+		Expect(client.ranges()).To(ConsistOf(
+			"bytes=0-5242879",
+			"bytes=5242880-10485759",
+			fmt.Sprintf("bytes=10485760-%d", len(cirrosData)-1),
+		))
+		data, err := ioutil.ReadFile(sd.GetTempPath())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(Equal(cirrosData))
+	})
+
+	table.DescribeTable("should fail on a mismatching ETag", func(concurrency, partSize int, etag string) {
+		client.partSize = partSize
+		client.etag = etag
+		err := transfer(concurrency)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("ETag mismatch, expected " + etag))
+		Expect(sd.GetComputedChecksum()).To(BeEmpty())
+	},
+		table.Entry("of a single part object", 1, 0, "00000000000000000000000000000000"),
+		table.Entry("of a multipart object", 1, partSize, "00000000000000000000000000000000-3"),
+		table.Entry("of a multipart object downloaded concurrently", 4, partSize, "00000000000000000000000000000000-3"),
+	)
+
+	It("should reject multipart objects whose parts differ in size", func() {
+		client.partSize = partSize
+		client.etag = "00000000000000000000000000000000-4"
+		var err error
+		sd, err = NewS3DataSourceWithOptions("http://amazon.com/bucket/cirros.qcow2", "", "", "", S3Options{VerifyETag: true})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = sd.Info()
+		Expect(err).To(MatchError(ContainSubstring("differ in size")))
+	})
+
+	It("should verify the objects written by TransferFile", func() {
+		client.data = bytes.Repeat([]byte{0x55}, 64*1024)
+		var err error
+		sd, err = NewS3DataSourceWithOptions("http://amazon.com/bucket/disk.raw", "", "", "", S3Options{VerifyETag: true})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := sd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseTransferDataFile))
+		_, err = sd.TransferFile(filepath.Join(tmpDir, "disk.img"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sd.GetComputedChecksum()).To(Equal(client.expectedETag()))
+	})
+
+	It("should reject objects encrypted with SSE-KMS", func() {
+		client.serverSideEncryption = s3.ServerSideEncryptionAwsKms
+		_, err := NewS3DataSourceWithOptions("http://amazon.com/bucket/cirros.qcow2", "", "", "", S3Options{VerifyETag: true})
+		Expect(err).To(MatchError(ContainSubstring("SSE-KMS or SSE-C")))
+	})
+
+	table.DescribeTable("parseS3ETag should", func(etag, want string, parts int, wantErr bool) {
+		parsed, n, err := parseS3ETag(etag)
+		if wantErr {
+			Expect(err).To(HaveOccurred())
+			return
+		}
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsed).To(Equal(want))
+		Expect(n).To(Equal(parts))
+	},
+		table.Entry("accept a quoted MD5", "\"9E107D9D372BB6826BD81D3542A419D6\"", "9e107d9d372bb6826bd81d3542a419d6", 0, false),
+		table.Entry("accept a multipart ETag", "9e107d9d372bb6826bd81d3542a419d6-12", "9e107d9d372bb6826bd81d3542a419d6-12", 12, false),
+		table.Entry("reject an ETag of no parts", "9e107d9d372bb6826bd81d3542a419d6-0", "", 0, true),
+		table.Entry("reject an opaque ETag", "etag-1", "", 0, true),
+	)
+})
@@ -0,0 +1,135 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+// s3TagSelectorParam is the endpoint query parameter selecting the object by its tags, for instance
+// os=fedora,release=34. The object name of the endpoint is then the prefix of the candidate objects.
+const s3TagSelectorParam = "tagSelector"
+
+// s3TagSelectorMaxObjects is the maximum number of objects starting with the prefix of a tag selector. S3 doesn't list
+// the tags of the objects, so selecting an object takes a request of the tags of every candidate more recent than the
+// selected one. The listing stops and the selection fails past this number, the prefix must then be narrowed.
+var s3TagSelectorMaxObjects = 1000
+
+// s3ObjectLister is the interface to the S3 client calls listing the objects of a bucket and their tags.
+type s3ObjectLister interface {
+	ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error
+	GetObjectTagging(input *s3.GetObjectTaggingInput) (*s3.GetObjectTaggingOutput, error)
+}
+
+// selectS3Object returns the endpoint of the most recently modified object whose tags match the tag selector of ep,
+// among at most s3TagSelectorMaxObjects objects. The tags of the objects are requested from the most recently
+// modified one, until one matches. Endpoints without tag selector are returned as is.
+func selectS3Object(ep *url.URL, accessKey, secKey string, certDir string, requesterPays bool, clientOptions s3ClientOptions) (*url.URL, error) {
+	query := ep.Query()
+	value := query.Get(s3TagSelectorParam)
+	if value == "" {
+		return ep, nil
+	}
+	selector, err := labels.Parse(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid s3 tag selector %q", value)
+	}
+	// The trailing slash of a prefix restricts the candidates to a folder.
+	bucket, prefix := extractBucketAndObject(strings.TrimPrefix(ep.Path, "/"))
+	svc, err := newClientFunc(ep.Host, accessKey, secKey, certDir, clientOptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not build s3 client for %q", ep.Host)
+	}
+	lister, ok := svc.(s3ObjectLister)
+	if !ok {
+		return nil, errors.New("s3 client can't list objects")
+	}
+
+	listInput := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	if requesterPays {
+		listInput.RequestPayer = aws.String(s3.RequestPayerRequester)
+	}
+	var candidates []*s3.Object
+	tooMany := false
+	err = lister.ListObjectsV2Pages(listInput, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		candidates = append(candidates, page.Contents...)
+		tooMany = len(candidates) > s3TagSelectorMaxObjects
+		return !tooMany
+	})
+	if isS3AnonymousDenied(err, accessKey, secKey) {
+		return nil, errors.Wrapf(err, "bucket %q requires authentication, no s3 credentials were provided", bucket)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not list s3 objects: \"%s/%s\"", bucket, prefix)
+	}
+	if tooMany {
+		return nil, errors.Errorf("more than %d s3 objects in \"%s/%s\" to select with tag selector %q, use a longer prefix", s3TagSelectorMaxObjects, bucket, prefix, value)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return aws.TimeValue(candidates[i].LastModified).After(aws.TimeValue(candidates[j].LastModified))
+	})
+	var selected *s3.Object
+	for _, object := range candidates {
+		tags, err := getS3ObjectTags(lister, bucket, aws.StringValue(object.Key))
+		if err != nil {
+			return nil, err
+		}
+		if selector.Matches(tags) {
+			selected = object
+			break
+		}
+	}
+	if selected == nil {
+		return nil, errors.Errorf("no s3 object in \"%s/%s\" matches tag selector %q", bucket, prefix, value)
+	}
+	klog.V(1).Infof("Selected object %s matching tag selector %q", aws.StringValue(selected.Key), value)
+
+	query.Del(s3TagSelectorParam)
+	selectedEp := *ep
+	selectedEp.Path = s3FolderSep + bucket + s3FolderSep + aws.StringValue(selected.Key)
+	selectedEp.RawPath = ""
+	selectedEp.RawQuery = query.Encode()
+	return &selectedEp, nil
+}
+
+// getS3ObjectTags returns the tags of the object.
+func getS3ObjectTags(lister s3ObjectLister, bucket, key string) (labels.Set, error) {
+	output, err := lister.GetObjectTagging(&s3.GetObjectTaggingInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not get the tags of s3 object: \"%s/%s\"", bucket, key)
+	}
+	tags := labels.Set{}
+	for _, tag := range output.TagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return tags, nil
+}
@@ -0,0 +1,154 @@
+package importer
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+)
+
+var _ = Describe("S3 object selection", func() {
+	var client *mockTaggedS3Client
+	modified := time.Date(2021, time.June, 1, 0, 0, 0, 0, time.UTC)
+
+	BeforeEach(func() {
+		client = &mockTaggedS3Client{
+			pages: [][]*s3.Object{
+				{
+					{Key: aws.String("images/fedora-33.qcow2"), LastModified: aws.Time(modified)},
+					{Key: aws.String("images/fedora-34-beta.qcow2"), LastModified: aws.Time(modified.Add(time.Hour))},
+				},
+				{
+					{Key: aws.String("images/fedora-34.qcow2"), LastModified: aws.Time(modified.Add(2 * time.Hour))},
+					{Key: aws.String("images/centos-8.qcow2"), LastModified: aws.Time(modified.Add(3 * time.Hour))},
+				},
+			},
+			tags: map[string][]*s3.Tag{
+				"images/fedora-33.qcow2":      s3Tags("os", "fedora", "release", "33", "channel", "stable"),
+				"images/fedora-34-beta.qcow2": s3Tags("os", "fedora", "release", "34", "channel", "beta"),
+				"images/fedora-34.qcow2":      s3Tags("os", "fedora", "release", "34", "channel", "stable"),
+				"images/centos-8.qcow2":       s3Tags("os", "centos", "release", "8", "channel", "stable"),
+			},
+		}
+		newClientFunc = func(endpoint, accKey, secKey string, certDir string, options s3ClientOptions) (S3Client, error) {
+			return client, nil
+		}
+	})
+
+	AfterEach(func() {
+		newClientFunc = getS3Client
+	})
+
+	table.DescribeTable("should download the most recent object matching the tags", func(selector, expectedKey string) {
+		sd, err := NewS3DataSource("http://rgw.example.com/bucket-1/images/?tagSelector="+selector, "", "", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.listInput.Bucket).To(Equal(aws.String("bucket-1")))
+		Expect(client.listInput.Prefix).To(Equal(aws.String("images/")))
+		Expect(client.input.Bucket).To(Equal(aws.String("bucket-1")))
+		Expect(client.input.Key).To(Equal(aws.String(expectedKey)))
+		Expect(sd.ep.Path).To(Equal("/bucket-1/" + expectedKey))
+		Expect(sd.ep.Query().Get(s3TagSelectorParam)).To(BeEmpty())
+	},
+		table.Entry("on the first page", "os%3Dfedora,release%3D33", "images/fedora-33.qcow2"),
+		table.Entry("on the last page", "os%3Dfedora,channel%3Dstable", "images/fedora-34.qcow2"),
+		table.Entry("with a set based selector", "os%3Dfedora,channel+in+(beta,stable)", "images/fedora-34.qcow2"),
+		table.Entry("with a single tag", "channel%3Dstable", "images/centos-8.qcow2"),
+	)
+
+	It("should accept the charges of listing a requester pays bucket", func() {
+		_, err := NewS3DataSourceWithOptions("http://rgw.example.com/bucket-1/images/?tagSelector=channel%3Dstable", "", "", "", S3Options{RequesterPays: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.listInput.RequestPayer).To(Equal(aws.String(s3.RequestPayerRequester)))
+		Expect(client.input.RequestPayer).To(Equal(aws.String(s3.RequestPayerRequester)))
+	})
+
+	It("should keep the other query parameters of the endpoint", func() {
+		sd, err := NewS3DataSource("http://rgw.example.com/bucket-1/images/?tagSelector=os%3Dcentos&partNumber=2", "", "", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.input.Key).To(Equal(aws.String("images/centos-8.qcow2")))
+		Expect(client.input.PartNumber).To(Equal(aws.Int64(2)))
+		Expect(sd.ep.RawQuery).To(Equal("partNumber=2"))
+	})
+
+	It("should not list objects without tag selector", func() {
+		_, err := NewS3DataSource("http://rgw.example.com/bucket-1/images/fedora-33.qcow2", "", "", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.listInput).To(BeNil())
+		Expect(client.input.Key).To(Equal(aws.String("images/fedora-33.qcow2")))
+	})
+
+	table.DescribeTable("should fail", func(selector, expectedErr string) {
+		_, err := NewS3DataSource("http://rgw.example.com/bucket-1/images/?tagSelector="+selector, "", "", "")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(expectedErr))
+		Expect(client.input).To(BeNil())
+	},
+		table.Entry("if no object matches", "os%3Dubuntu", "no s3 object in \"bucket-1/images/\" matches tag selector \"os=ubuntu\""),
+		table.Entry("with an invalid selector", "os%3D%3D%3D", "invalid s3 tag selector"),
+	)
+
+	It("should fail if the tags of an object can't be read", func() {
+		client.tagErr = errors.New("AccessDenied")
+		_, err := NewS3DataSource("http://rgw.example.com/bucket-1/images/?tagSelector=os%3Dfedora", "", "", "")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("could not get the tags of s3 object: \"bucket-1/images/centos-8.qcow2\": AccessDenied"))
+		Expect(client.input).To(BeNil())
+	})
+
+	It("should only read the tags of the objects more recent than the selected one", func() {
+		_, err := NewS3DataSource("http://rgw.example.com/bucket-1/images/?tagSelector=os%3Dfedora,channel%3Dstable", "", "", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.taggedKeys).To(Equal([]string{"images/centos-8.qcow2", "images/fedora-34.qcow2"}))
+	})
+
+	It("should fail without reading tags if the prefix has too many objects", func() {
+		defer func(max int) { s3TagSelectorMaxObjects = max }(s3TagSelectorMaxObjects)
+		s3TagSelectorMaxObjects = 3
+		_, err := NewS3DataSource("http://rgw.example.com/bucket-1/images/?tagSelector=os%3Dfedora", "", "", "")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("more than 3 s3 objects in \"bucket-1/images/\" to select with tag selector \"os=fedora\", use a longer prefix"))
+		Expect(client.taggedKeys).To(BeEmpty())
+	})
+})
+
+// mockTaggedS3Client lists pages of tagged objects.
+type mockTaggedS3Client struct {
+	MockS3Client
+	pages     [][]*s3.Object
+	tags      map[string][]*s3.Tag
+	tagErr    error
+	listInput *s3.ListObjectsV2Input
+	// taggedKeys are the keys of the objects whose tags were requested, in order.
+	taggedKeys []string
+}
+
+func (mc *mockTaggedS3Client) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	mc.listInput = input
+	for i, page := range mc.pages {
+		if !fn(&s3.ListObjectsV2Output{Contents: page}, i == len(mc.pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (mc *mockTaggedS3Client) GetObjectTagging(input *s3.GetObjectTaggingInput) (*s3.GetObjectTaggingOutput, error) {
+	mc.taggedKeys = append(mc.taggedKeys, aws.StringValue(input.Key))
+	if mc.tagErr != nil {
+		return nil, mc.tagErr
+	}
+	return &s3.GetObjectTaggingOutput{TagSet: mc.tags[aws.StringValue(input.Key)]}, nil
+}
+
+// s3Tags returns the tags of alternating keys and values.
+func s3Tags(keysAndValues ...string) []*s3.Tag {
+	var tags []*s3.Tag
+	for i := 0; i < len(keysAndValues); i += 2 {
+		tags = append(tags, &s3.Tag{Key: aws.String(keysAndValues[i]), Value: aws.String(keysAndValues[i+1])})
+	}
+	return tags
+}
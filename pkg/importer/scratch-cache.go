@@ -0,0 +1,196 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"k8s.io/klog/v2"
+
+	"kubevirt.io/containerized-data-importer/pkg/util"
+)
+
+// temporary files in the cache directory start with this prefix, they are never looked up or evicted.
+const scratchCacheTempPrefix = ".tmp-"
+
+// ScratchCache is a content addressed cache of downloaded scratch files, shared by the imports on a node.
+// Entries are keyed by the source URL and the version of the content reported by the source (ETag), so
+// an unchanged source is only downloaded once. Least recently used entries are evicted above the max size.
+type ScratchCache struct {
+	dir     string
+	maxSize int64
+}
+
+// NewScratchCache creates a scratch cache in dir, a maxSize of 0 means the cache size is not limited.
+func NewScratchCache(dir string, maxSize int64) (*ScratchCache, error) {
+	if maxSize < 0 {
+		return nil, errors.Errorf("invalid scratch cache size %d", maxSize)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "unable to create scratch cache directory %s", dir)
+	}
+	return &ScratchCache{
+		dir:     dir,
+		maxSize: maxSize,
+	}, nil
+}
+
+// scratchCacheKey returns the cache key of the content of source at version, or an empty string if the content
+// can't be cached. Weak ETags don't guarantee byte identical content and are not used.
+func scratchCacheKey(source *url.URL, version string) string {
+	if version == "" || strings.HasPrefix(version, "W/") {
+		return ""
+	}
+	// Credentials don't change the content, don't make them part of the key.
+	src := *source
+	src.User = nil
+	sum := sha256.Sum256([]byte(src.String() + "\n" + version))
+	return hex.EncodeToString(sum[:])
+}
+
+// Restore copies the entry for key to fileName, returns false if the key is not cached.
+func (c *ScratchCache) Restore(key, fileName string) (bool, error) {
+	entry := filepath.Join(c.dir, key)
+	file, err := os.Open(entry)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrapf(err, "unable to open scratch cache entry %s", entry)
+	}
+	defer file.Close()
+	// The modification time orders the entries for eviction.
+	now := time.Now()
+	if err := os.Chtimes(entry, now, now); err != nil {
+		klog.Warningf("Unable to update access time of scratch cache entry %s: %v", entry, err)
+	}
+	if err := util.StreamDataToFile(file, fileName); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Store adds a copy of fileName to the cache as key, and evicts the least recently used entries if the cache
+// grows above the max size.
+func (c *ScratchCache) Store(key, fileName string) error {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return errors.Wrapf(err, "unable to stat %s", fileName)
+	}
+	if c.maxSize > 0 && info.Size() > c.maxSize {
+		klog.V(1).Infof("%s is larger than the scratch cache, not caching", fileName)
+		return nil
+	}
+	source, err := os.Open(fileName)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open %s", fileName)
+	}
+	defer source.Close()
+	// Write to a temporary file and rename, so concurrent imports never see a partial entry.
+	tmp, err := ioutil.TempFile(c.dir, scratchCacheTempPrefix)
+	if err != nil {
+		return errors.Wrap(err, "unable to create scratch cache entry")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = io.Copy(tmp, source); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "unable to write scratch cache entry")
+	}
+	if err = tmp.Close(); err != nil {
+		return errors.Wrap(err, "unable to write scratch cache entry")
+	}
+	if err = os.Rename(tmp.Name(), filepath.Join(c.dir, key)); err != nil {
+		return errors.Wrap(err, "unable to add scratch cache entry")
+	}
+	return c.evict()
+}
+
+// evict removes the least recently used entries until the cache fits in the max size.
+func (c *ScratchCache) evict() error {
+	if c.maxSize == 0 {
+		return nil
+	}
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return errors.Wrapf(err, "unable to list scratch cache directory %s", c.dir)
+	}
+	entries := make([]os.FileInfo, 0, len(files))
+	var total int64
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), scratchCacheTempPrefix) {
+			continue
+		}
+		entries = append(entries, file)
+		total += file.Size()
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+	for _, entry := range entries {
+		if total <= c.maxSize {
+			break
+		}
+		klog.V(1).Infof("Evicting scratch cache entry %s", entry.Name())
+		// Another import may have evicted the entry already.
+		if err := os.Remove(filepath.Join(c.dir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "unable to evict scratch cache entry %s", entry.Name())
+		}
+		total -= entry.Size()
+	}
+	return nil
+}
+
+// transfer writes the cached content for key to fileName, or streams the reader of size bytes (-1 if unknown) to
+// fileName with options and caches the result on a miss. Without a cache, or an empty key, the reader is streamed
+// directly. Cache failures don't fail the transfer.
+func (c *ScratchCache) transfer(key string, reader io.Reader, size int64, fileName string, options util.StreamOptions) error {
+	return c.download(key, fileName, func(fileName string) error {
+		return util.StreamDataToFileWithSize(reader, fileName, size, options)
+	})
+}
+
+// download writes the cached content for key to fileName, or downloads fileName and caches the result on a miss.
+// Without a cache, or an empty key, fileName is downloaded directly. Cache failures don't fail the download.
+func (c *ScratchCache) download(key string, fileName string, download func(fileName string) error) error {
+	if c == nil || key == "" {
+		return download(fileName)
+	}
+	hit, err := c.Restore(key, fileName)
+	if err != nil {
+		klog.Warningf("Unable to restore scratch cache entry %s, downloading: %v", key, err)
+	} else if hit {
+		klog.V(1).Infof("Reusing scratch cache entry %s", key)
+		return nil
+	}
+	if err := download(fileName); err != nil {
+		return err
+	}
+	if err := c.Store(key, fileName); err != nil {
+		klog.Warningf("Unable to add %s to the scratch cache: %v", fileName, err)
+	}
+	return nil
+}
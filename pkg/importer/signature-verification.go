@@ -0,0 +1,244 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+	"k8s.io/klog/v2"
+)
+
+// maxSignatureBytes limits the size of the signatures fetched from a URL.
+const maxSignatureBytes = 1 << 20
+
+// armorHeader starts the ASCII armored keys and signatures.
+var armorHeader = []byte("-----BEGIN ")
+
+var (
+	// ErrSignatureMissing is returned when the signature of the source can't be found.
+	ErrSignatureMissing = errors.New("the signature of the source is missing")
+	// ErrSignatureInvalid is returned when the signature doesn't match the source data or the trusted keys.
+	ErrSignatureInvalid = errors.New("the signature of the source is invalid")
+)
+
+// SignatureVerifier verifies a detached signature of the source data, for instance a GPG signature.
+type SignatureVerifier interface {
+	// Verify reads data until EOF, and returns ErrSignatureInvalid unless signature is a valid signature of it.
+	Verify(data io.Reader, signature []byte) error
+}
+
+// SignatureVerification is the verification of the detached signature of the source data.
+type SignatureVerification struct {
+	verifier SignatureVerifier
+	// load returns the detached signature of the source data.
+	load func() ([]byte, error)
+}
+
+// signatureSource is implemented by the data sources verifying the signature of the source data while it is
+// transferred.
+type signatureSource interface {
+	// verifySourceSignature returns an error unless the source data is signed, reading the rest of the source data
+	// if the transfer didn't.
+	verifySourceSignature() error
+}
+
+// NewSignatureVerification returns the verification of the source data, for DataProcessor.SetSignatureVerification,
+// refusing the source data unless verifier accepts its detached signature, either the inline signature or the one
+// served at signatureURL. The source is refused if both are empty. A nil verifier returns a nil verification.
+func NewSignatureVerification(verifier SignatureVerifier, signature []byte, signatureURL string) (*SignatureVerification, error) {
+	if verifier == nil {
+		return nil, nil
+	}
+	verification := &SignatureVerification{verifier: verifier}
+	switch {
+	case len(signature) > 0 && signatureURL != "":
+		return nil, errors.New("the signature and the signature URL are mutually exclusive")
+	case signatureURL != "":
+		ep, err := parseValidEndpoint(signatureURL, "signature", "http", "https")
+		if err != nil {
+			return nil, err
+		}
+		verification.load = func() ([]byte, error) {
+			return fetchSignature(ep.String())
+		}
+	default:
+		verification.load = func() ([]byte, error) {
+			if len(signature) == 0 {
+				return nil, ErrSignatureMissing
+			}
+			return signature, nil
+		}
+	}
+	return verification, nil
+}
+
+// fetchSignature downloads the signature served at url.
+func fetchSignature(url string) ([]byte, error) {
+	client, err := createHTTPClient("", nil)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create the signature request")
+	}
+	req.Header.Set("User-Agent", DefaultUserAgent())
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(ErrSignatureMissing, "unable to fetch the signature: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Wrapf(ErrSignatureMissing, "unable to fetch the signature, HTTP status %d", resp.StatusCode)
+	}
+	signature, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSignatureBytes+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read the signature")
+	}
+	if len(signature) == 0 {
+		return nil, ErrSignatureMissing
+	}
+	if len(signature) > maxSignatureBytes {
+		return nil, errors.Errorf("the signature exceeds %d bytes", maxSignatureBytes)
+	}
+	return signature, nil
+}
+
+// verifySourceSignature returns an error unless the signature of the source is valid.
+func verifySourceSignature(source DataSourceInterface) error {
+	ss, ok := source.(signatureSource)
+	if !ok {
+		return errors.New("the data source doesn't support the signature verification")
+	}
+	if err := ss.verifySourceSignature(); err != nil {
+		return err
+	}
+	klog.V(1).Infof("The signature of the source is valid")
+	return nil
+}
+
+// gpgSignatureVerifier verifies detached GPG signatures, ASCII armored or binary.
+type gpgSignatureVerifier struct {
+	keyring openpgp.EntityList
+}
+
+// NewGPGSignatureVerifier returns a verifier of detached GPG signatures made by the keys of publicKeys, an ASCII
+// armored or binary keyring.
+func NewGPGSignatureVerifier(publicKeys []byte) (SignatureVerifier, error) {
+	var keyring openpgp.EntityList
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(publicKeys), armorHeader) {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(publicKeys))
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(publicKeys))
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read the public keys")
+	}
+	if len(keyring) == 0 {
+		return nil, errors.New("the keyring holds no public key")
+	}
+	return &gpgSignatureVerifier{keyring: keyring}, nil
+}
+
+// Verify reads data until EOF, and returns ErrSignatureInvalid unless signature is a valid signature of it.
+func (v *gpgSignatureVerifier) Verify(data io.Reader, signature []byte) error {
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(signature), armorHeader) {
+		_, err = openpgp.CheckArmoredDetachedSignature(v.keyring, data, bytes.NewReader(signature))
+	} else {
+		_, err = openpgp.CheckDetachedSignature(v.keyring, data, bytes.NewReader(signature))
+	}
+	if err == nil {
+		return nil
+	}
+	switch err.(type) {
+	case pgperrors.SignatureError, pgperrors.StructuralError, pgperrors.UnsupportedError:
+		return errors.Wrapf(ErrSignatureInvalid, "%v", err)
+	}
+	if err == pgperrors.ErrUnknownIssuer || err == io.EOF {
+		// No signature packet, or a signature made by an untrusted key.
+		return errors.Wrapf(ErrSignatureInvalid, "%v", err)
+	}
+	return errors.Wrap(err, "unable to verify the signature")
+}
+
+// signatureReader verifies the signature of the data read from reader.
+type signatureReader struct {
+	reader io.ReadCloser
+	pipe   *io.PipeWriter
+	result chan error
+	err    error
+	done   bool
+}
+
+// newSignatureReader returns a reader passing the data read from reader to the signature verifier of verification.
+func newSignatureReader(reader io.ReadCloser, verification *SignatureVerification) *signatureReader {
+	pr, pw := io.Pipe()
+	r := &signatureReader{
+		reader: reader,
+		pipe:   pw,
+		result: make(chan error, 1),
+	}
+	go func() {
+		signature, err := verification.load()
+		if err == nil {
+			err = verification.verifier.Verify(pr, signature)
+		}
+		// Unblock the reads if the verifier stopped early.
+		pr.CloseWithError(errors.New("the signature verification is over"))
+		r.result <- err
+	}()
+	return r
+}
+
+// Read reads from the reader, passing the data read to the signature verifier.
+func (r *signatureReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		// A write error means the verifier stopped early, its result holds the reason.
+		r.pipe.Write(p[:n])
+	}
+	return n, err
+}
+
+// Close closes the reader, stopping the verification.
+func (r *signatureReader) Close() error {
+	r.pipe.CloseWithError(errors.New("the source was closed"))
+	return r.reader.Close()
+}
+
+// verify reads the rest of the data, and returns the result of the signature verification.
+func (r *signatureReader) verify() error {
+	if r.done {
+		return r.err
+	}
+	_, err := io.Copy(ioutil.Discard, r)
+	r.pipe.CloseWithError(err)
+	r.err = <-r.result
+	if r.err == nil && err != nil {
+		r.err = errors.Wrap(err, "unable to read the source")
+	}
+	r.done = true
+	return r.err
+}
@@ -0,0 +1,210 @@
+package importer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
+	cdiv1 "kubevirt.io/containerized-data-importer/pkg/apis/core/v1beta1"
+	"kubevirt.io/containerized-data-importer/pkg/image"
+)
+
+// signingEntity is the key signing the fixtures, generated once since the key generation is slow.
+var signingEntity *openpgp.Entity
+
+func newSigningEntity() *openpgp.Entity {
+	entity, err := openpgp.NewEntity("CDI test", "", "cdi@example.com", nil)
+	Expect(err).NotTo(HaveOccurred())
+	return entity
+}
+
+func armoredPublicKey(entity *openpgp.Entity) []byte {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(entity.Serialize(w)).To(Succeed())
+	Expect(w.Close()).To(Succeed())
+	return buf.Bytes()
+}
+
+func armoredSignature(entity *openpgp.Entity, data []byte) []byte {
+	var buf bytes.Buffer
+	Expect(openpgp.ArmoredDetachSign(&buf, entity, bytes.NewReader(data), nil)).To(Succeed())
+	return buf.Bytes()
+}
+
+var _ = Describe("Signature verification", func() {
+	var (
+		tmpDir    string
+		verifier  SignatureVerifier
+		signature []byte
+		tampered  []byte
+	)
+
+	BeforeEach(func() {
+		var err error
+		if signingEntity == nil {
+			signingEntity = newSigningEntity()
+		}
+		verifier, err = NewGPGSignatureVerifier(armoredPublicKey(signingEntity))
+		Expect(err).NotTo(HaveOccurred())
+		signature = armoredSignature(signingEntity, cirrosData)
+		tampered = append([]byte{}, cirrosData...)
+		tampered[len(tampered)/2] ^= 0xff
+		tmpDir, err = ioutil.TempDir("", "signature")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	// newVerification returns the verification of the signatures with verifier.
+	newVerification := func(signature []byte, signatureURL string) *SignatureVerification {
+		verification, err := NewSignatureVerification(verifier, signature, signatureURL)
+		Expect(err).NotTo(HaveOccurred())
+		return verification
+	}
+
+	// readSignedData returns the format readers of data verifying its signature with verification.
+	readSignedData := func(data []byte, verification *SignatureVerification) *FormatReaders {
+		readers, err := newFormatReaders(ioutil.NopCloser(bytes.NewReader(data)), 0, sourceSizeLimits{}, sourceVerification{signature: verification})
+		Expect(err).NotTo(HaveOccurred())
+		return readers
+	}
+
+	// process imports data verifying its signature with verification, failing the conversion with convertErr.
+	process := func(data []byte, verification *SignatureVerification, convertErr error) (*DataProcessor, error) {
+		Expect(os.Mkdir(filepath.Join(tmpDir, "data"), 0755)).To(Succeed())
+		Expect(os.Mkdir(filepath.Join(tmpDir, "scratch"), 0755)).To(Succeed())
+		source := NewUploadDataSource(ioutil.NopCloser(bytes.NewReader(data)))
+		dp := NewDataProcessor(source, filepath.Join(tmpDir, "data", "disk.img"), filepath.Join(tmpDir, "data"), filepath.Join(tmpDir, "scratch"), "", 0.055, false)
+		dp.SetSignatureVerification(verification)
+		var err error
+		replaceQEMUOperations(NewFakeQEMUOperations(convertErr, nil, fakeInfoRet, nil, nil, nil), func() {
+			err = dp.ProcessData()
+		})
+		return dp, err
+	}
+
+	It("should accept the armored and binary signatures of the data", func() {
+		Expect(verifier.Verify(bytes.NewReader(cirrosData), signature)).To(Succeed())
+		var binarySignature bytes.Buffer
+		Expect(openpgp.DetachSign(&binarySignature, signingEntity, bytes.NewReader(cirrosData), nil)).To(Succeed())
+		Expect(verifier.Verify(bytes.NewReader(cirrosData), binarySignature.Bytes())).To(Succeed())
+	})
+
+	It("should reject the signature of tampered data", func() {
+		err := verifier.Verify(bytes.NewReader(tampered), signature)
+		Expect(errors.Cause(err)).To(Equal(ErrSignatureInvalid))
+	})
+
+	It("should reject the signatures of untrusted keys", func() {
+		err := verifier.Verify(bytes.NewReader(cirrosData), armoredSignature(newSigningEntity(), cirrosData))
+		Expect(errors.Cause(err)).To(Equal(ErrSignatureInvalid))
+	})
+
+	It("should reject invalid keyrings", func() {
+		_, err := NewGPGSignatureVerifier([]byte("not a key"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should import a signed source", func() {
+		dp, err := process(cirrosData, newVerification(signature, ""), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dp.currentPhase).To(Equal(ProcessingPhaseComplete))
+	})
+
+	It("should refuse a tampered source before converting it", func() {
+		dp, err := process(tampered, newVerification(signature, ""), errors.New("the tampered source was converted"))
+		Expect(errors.Cause(err)).To(Equal(ErrSignatureInvalid))
+		Expect(dp.currentPhase).To(Equal(ProcessingPhaseError))
+	})
+
+	It("should wipe a tampered raw source written to the target", func() {
+		raw := bytes.Repeat([]byte{0x55}, 64*1024)
+		tamperedRaw := append([]byte{}, raw...)
+		tamperedRaw[len(tamperedRaw)/2] ^= 0xff
+		dp, err := process(tamperedRaw, newVerification(armoredSignature(signingEntity, raw), ""), nil)
+		Expect(errors.Cause(err)).To(Equal(ErrSignatureInvalid))
+		Expect(dp.currentPhase).To(Equal(ProcessingPhaseError))
+		Expect(filepath.Join(tmpDir, "data", "disk.img")).NotTo(BeAnExistingFile())
+	})
+
+	It("should refuse a source without signature", func() {
+		dp, err := process(cirrosData, newVerification(nil, ""), nil)
+		Expect(errors.Cause(err)).To(Equal(ErrSignatureMissing))
+		Expect(dp.currentPhase).To(Equal(ProcessingPhaseError))
+	})
+
+	It("should fetch the signature from a URL", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/cirros.qcow2.asc" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(signature)
+		}))
+		defer server.Close()
+		readers := readSignedData(cirrosData, newVerification(nil, server.URL+"/cirros.qcow2.asc"))
+		Expect(readers.verifySourceSignature()).To(Succeed())
+		Expect(readers.Close()).To(Succeed())
+
+		readers = readSignedData(cirrosData, newVerification(nil, server.URL+"/missing.asc"))
+		Expect(errors.Cause(readers.verifySourceSignature())).To(Equal(ErrSignatureMissing))
+		Expect(readers.Close()).To(Succeed())
+	})
+
+	It("should verify the whole source even if the transfer stopped early", func() {
+		readers := readSignedData(cirrosData, newVerification(signature, ""))
+		_, err := readers.TopReader().Read(make([]byte, 100))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(readers.verifySourceSignature()).To(Succeed())
+		Expect(readers.Close()).To(Succeed())
+	})
+
+	It("should transfer http sources to scratch space to verify their signature", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(cirrosData)
+		}))
+		defer server.Close()
+		createNbdkitCurl = image.NewMockNbdkitCurl
+		defer func() { createNbdkitCurl = image.NewNbdkitCurl }()
+		hs, err := NewHTTPDataSource(server.URL+"/cirros.qcow2", "", "", "", cdiv1.DataVolumeKubeVirt)
+		Expect(err).NotTo(HaveOccurred())
+		defer hs.Close()
+		hs.setSignatureVerification(newVerification(signature, ""))
+		Expect(hs.Info()).To(Equal(ProcessingPhaseTransferScratch))
+	})
+
+	It("should reject an inline signature along with a signature URL", func() {
+		_, err := NewSignatureVerification(verifier, signature, "https://example.com/cirros.qcow2.asc")
+		Expect(err).To(HaveOccurred())
+		_, err = NewSignatureVerification(verifier, nil, "ftp://example.com/cirros.qcow2.asc")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should not verify the signature without verifier", func() {
+		verification, err := NewSignatureVerification(nil, signature, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(verification).To(BeNil())
+		dp, err := process(tampered, verification, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dp.currentPhase).To(Equal(ProcessingPhaseComplete))
+	})
+
+	It("should refuse data sources not verifying the signature", func() {
+		err := verifySourceSignature(&MockDataProvider{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("doesn't support the signature verification"))
+	})
+})
@@ -0,0 +1,94 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"kubevirt.io/containerized-data-importer/pkg/common"
+)
+
+const smbScheme = "smb"
+
+// ErrSMBAccessDenied is returned when the mounted share denies access to the file.
+var ErrSMBAccessDenied = errors.New("smb access denied")
+
+// ErrSMBShareNotFound is returned when the share isn't mounted in the pod.
+var ErrSMBShareNotFound = errors.New("smb share not found")
+
+// ErrSMBFileNotFound is returned when the file doesn't exist in the share.
+var ErrSMBFileNotFound = errors.New("smb file not found")
+
+// SMBDataSource is the struct containing the information needed to import a file from an SMB/CIFS share. The share is
+// mounted in the pod by the SMB CSI driver, which negotiates the SMB dialect, authenticates and signs the messages, the
+// file is then read like the files of the FileDataSource.
+// Sequence of phases:
+// 1a. Info -> TransferScratch, if the image needs to be converted.
+// 1b. Info -> TransferDataFile, if the image is raw.
+// 2a. TransferScratch -> Convert
+// 2b. TransferDataFile -> Resize
+type SMBDataSource struct {
+	*FileDataSource
+	// the smb endpoint
+	ep *url.URL
+}
+
+// NewSMBDataSource creates a new instance of the SMBDataSource importing the file of an smb://host/share/path endpoint
+// from the share mounted at root, common.ImporterFileSourceDir if empty. The file is read with the options of the
+// FileDataSource.
+func NewSMBDataSource(endpoint, root string, options FileOptions) (*SMBDataSource, error) {
+	ep, err := parseValidEndpoint(endpoint, "smb", smbScheme)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(strings.TrimPrefix(ep.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		return nil, errors.Errorf("no share in %q", manifestURL(ep))
+	}
+	if len(parts) == 1 || parts[1] == "" || strings.HasSuffix(parts[1], "/") {
+		return nil, errors.Errorf("no file in %q", manifestURL(ep))
+	}
+	if root == "" {
+		root = common.ImporterFileSourceDir
+	}
+	if _, err := os.Stat(root); err != nil {
+		return nil, errors.Wrapf(ErrSMBShareNotFound, "share %s of %s is not mounted at %s: %v", parts[0], ep.Hostname(), root, err)
+	}
+	fs, err := NewFileDataSource(root, parts[1], options)
+	switch {
+	case err == nil:
+	case os.IsPermission(errors.Cause(err)):
+		return nil, errors.Wrapf(ErrSMBAccessDenied, "access denied to %s, check the credentials and the permissions of the share: %v", manifestURL(ep), err)
+	case os.IsNotExist(errors.Cause(err)):
+		return nil, errors.Wrapf(ErrSMBFileNotFound, "file %s not found in share %s: %v", parts[1], parts[0], err)
+	default:
+		return nil, err
+	}
+	return &SMBDataSource{
+		FileDataSource: fs,
+		ep:             ep,
+	}, nil
+}
+
+func (sd *SMBDataSource) addToManifest(manifest *ImportManifest) {
+	sd.FileDataSource.addToManifest(manifest)
+	manifest.Source.URL = manifestURL(sd.ep)
+}
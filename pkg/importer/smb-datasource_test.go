@@ -0,0 +1,131 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/pkg/errors"
+)
+
+var _ = Describe("SMB data source", func() {
+	var (
+		share  string
+		tmpDir string
+		sd     *SMBDataSource
+		err    error
+	)
+
+	BeforeEach(func() {
+		share, err = ioutil.TempDir("", "share")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.MkdirAll(filepath.Join(share, "linux"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(share, "linux", "cirros.qcow2"), cirrosData, 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(share, "tinycore.iso"), tinyCoreData(), 0644)).To(Succeed())
+		tmpDir, err = ioutil.TempDir("", "scratch")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		if sd != nil {
+			sd.Close()
+			sd = nil
+		}
+		os.RemoveAll(share)
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should transfer a qcow2 image of the mounted share to scratch space", func() {
+		sd, err = NewSMBDataSource("smb://fileserver.corp.example.com/images/linux/cirros.qcow2", share, FileOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := sd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseTransferScratch))
+		result, err = sd.Transfer(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseConvert))
+		data, err := ioutil.ReadFile(filepath.Join(tmpDir, tempFile))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(Equal(cirrosData))
+		Expect(sd.GetURL().String()).To(Equal(filepath.Join(tmpDir, tempFile)))
+	})
+
+	It("should transfer a raw image of the mounted share to the target", func() {
+		sd, err = NewSMBDataSource("smb://fileserver/images/tinycore.iso", share, FileOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := sd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseTransferDataFile))
+		target := filepath.Join(tmpDir, "disk.img")
+		result, err = sd.TransferFile(target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseResize))
+		data, err := ioutil.ReadFile(target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Equal(data, tinyCoreData())).To(BeTrue())
+		manifest := newImportManifest()
+		sd.addToManifest(manifest)
+		Expect(manifest.Source.URL).To(Equal("smb://fileserver/images/tinycore.iso"))
+		Expect(manifest.SourceSize).To(Equal(int64(len(tinyCoreData()))))
+	})
+
+	It("should fail if the share isn't mounted", func() {
+		_, err := NewSMBDataSource("smb://fileserver/images/tinycore.iso", filepath.Join(share, "missing"), FileOptions{})
+		Expect(errors.Cause(err)).To(Equal(ErrSMBShareNotFound))
+		Expect(err.Error()).To(ContainSubstring("share images of fileserver is not mounted"))
+	})
+
+	It("should fail if the file doesn't exist", func() {
+		_, err := NewSMBDataSource("smb://fileserver/images/linux/missing.qcow2", share, FileOptions{})
+		Expect(errors.Cause(err)).To(Equal(ErrSMBFileNotFound))
+		Expect(err.Error()).To(ContainSubstring("file linux/missing.qcow2 not found in share images"))
+	})
+
+	It("should fail if the file can't be read", func() {
+		if os.Geteuid() == 0 {
+			Skip("root reads files without permissions")
+		}
+		Expect(os.Chmod(filepath.Join(share, "tinycore.iso"), 0)).To(Succeed())
+		_, err := NewSMBDataSource("smb://fileserver/images/tinycore.iso", share, FileOptions{})
+		Expect(errors.Cause(err)).To(Equal(ErrSMBAccessDenied))
+		Expect(err.Error()).To(ContainSubstring("access denied to smb://fileserver/images/tinycore.iso"))
+	})
+
+	It("should refuse files outside of the mounted share", func() {
+		_, err := NewSMBDataSource("smb://fileserver/images//etc/passwd", share, FileOptions{})
+		Expect(errors.Cause(err)).To(Equal(ErrFileOutsideRoot))
+	})
+
+	table.DescribeTable("should reject the endpoint", func(endpoint, message string) {
+		_, err := NewSMBDataSource(endpoint, share, FileOptions{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(message))
+	},
+		table.Entry("with another scheme", "ftp://fileserver/images/disk.img", `unsupported smb endpoint scheme "ftp"`),
+		table.Entry("without a host", "smb:///images/disk.img", "no host"),
+		table.Entry("without a share", "smb://fileserver/", "no share"),
+		table.Entry("without a file", "smb://fileserver/images", "no file"),
+		table.Entry("of a directory", "smb://fileserver/images/linux/", "no file"),
+	)
+})
@@ -0,0 +1,36 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+// SourceMetadataSource is implemented by the data sources exposing the metadata of the imported object, so it can be
+// recorded on the target.
+type SourceMetadataSource interface {
+	// GetSourceMetadata returns the metadata of the object found by Info, keyed by lower case header name, like
+	// content-type or x-amz-meta-<name> for the user defined metadata of S3 objects.
+	GetSourceMetadata() map[string]string
+}
+
+// GetSourceMetadata returns the metadata of the object imported by source, an empty map if the source doesn't expose
+// metadata.
+func GetSourceMetadata(source DataSourceInterface) map[string]string {
+	if ms, ok := source.(SourceMetadataSource); ok {
+		if metadata := ms.GetSourceMetadata(); metadata != nil {
+			return metadata
+		}
+	}
+	return map[string]string{}
+}
@@ -0,0 +1,111 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// s3MetadataClient serves data as every object, with the content type and the user defined metadata.
+type s3MetadataClient struct {
+	data        []byte
+	contentType *string
+	metadata    map[string]*string
+}
+
+func (c *s3MetadataClient) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(c.data)),
+		ContentLength: aws.Int64(int64(len(c.data))),
+		ContentType:   c.contentType,
+		Metadata:      c.metadata,
+	}, nil
+}
+
+var _ = Describe("Source metadata", func() {
+	var client *s3MetadataClient
+
+	BeforeEach(func() {
+		client = &s3MetadataClient{
+			data:        cirrosData,
+			contentType: aws.String("application/x-qemu-disk"),
+			// The SDK canonicalizes the names of the metadata headers.
+			metadata: map[string]*string{
+				"Build-Id": aws.String("1234"),
+				"Os":       aws.String("cirros"),
+				"Empty":    nil,
+			},
+		}
+		newClientFunc = func(endpoint, accKey, secKey string, certDir string, options s3ClientOptions) (S3Client, error) {
+			return client, nil
+		}
+	})
+
+	AfterEach(func() {
+		newClientFunc = getS3Client
+	})
+
+	It("should capture the metadata of the S3 object in Info", func() {
+		sd, err := NewS3DataSource("http://amazon.com/bucket/cirros.qcow2", "", "", "")
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		Expect(sd.GetSourceMetadata()).To(BeEmpty())
+		_, err = sd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(GetSourceMetadata(sd)).To(Equal(map[string]string{
+			"content-type":        "application/x-qemu-disk",
+			"x-amz-meta-build-id": "1234",
+			"x-amz-meta-os":       "cirros",
+		}))
+	})
+
+	It("should return no metadata of objects without metadata", func() {
+		client.contentType = nil
+		client.metadata = nil
+		sd, err := NewS3DataSource("http://amazon.com/bucket/cirros.qcow2", "", "", "")
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		_, err = sd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sd.GetSourceMetadata()).To(BeEmpty())
+	})
+
+	It("should return an empty map for sources without metadata", func() {
+		metadata := GetSourceMetadata(&MockDataProvider{})
+		Expect(metadata).NotTo(BeNil())
+		Expect(metadata).To(BeEmpty())
+	})
+
+	It("should record the metadata in the import manifest", func() {
+		tmpDir, err := ioutil.TempDir("", "metadata")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+		sd, err := NewS3DataSource("http://amazon.com/bucket/cirros.qcow2", "", "", "")
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		scratchDir := filepath.Join(tmpDir, "scratch")
+		dataDir := filepath.Join(tmpDir, "data")
+		Expect(os.Mkdir(scratchDir, 0755)).To(Succeed())
+		Expect(os.Mkdir(dataDir, 0755)).To(Succeed())
+		manifestFile := filepath.Join(tmpDir, "manifest.json")
+		dp := NewDataProcessor(sd, filepath.Join(dataDir, "disk.img"), dataDir, scratchDir, "", 0.055, false)
+		dp.SetManifestFile(manifestFile)
+		replaceQEMUOperations(&fakeCopyQEMUOperations{QEMUOperations: NewFakeQEMUOperations(nil, nil, fakeInfoRet, nil, nil, nil), format: "qcow2"}, func() {
+			Expect(dp.ProcessData()).To(Succeed())
+		})
+		data, err := ioutil.ReadFile(manifestFile)
+		Expect(err).NotTo(HaveOccurred())
+		manifest := &ImportManifest{}
+		Expect(json.Unmarshal(data, manifest)).To(Succeed())
+		Expect(manifest.Source.Metadata).To(HaveKeyWithValue("content-type", "application/x-qemu-disk"))
+		Expect(manifest.Source.Metadata).To(HaveKeyWithValue("x-amz-meta-build-id", "1234"))
+	})
+})
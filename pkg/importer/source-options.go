@@ -0,0 +1,51 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"kubevirt.io/containerized-data-importer/pkg/util"
+)
+
+// SourceOptions are the options of the size checks and of the scratch file common to the data sources reading the
+// source data with our client, embedded in their options.
+type SourceOptions struct {
+	// StrictSourceSize makes the transfers fail with ErrSourceLargerThanReported when the source streams more bytes
+	// than the size it reported. By default, a warning is logged and the source is read to its end, the progress total
+	// following the bytes read.
+	StrictSourceSize bool
+	// MaxSourceBytes makes the transfers fail with ErrSourceExceedsMaxSize when the source reports a larger size,
+	// before reading it, or streams more bytes, whatever size it reported. 0 or less doesn't limit the source.
+	MaxSourceBytes int64
+	// ScratchPreallocation allocates the size of the source data in the scratch file before writing it, which makes a
+	// scratch space too small for the source data fail the transfer early, and avoids fragmenting the scratch file.
+	// Only the sources reporting the size of the data they write preallocate.
+	ScratchPreallocation bool
+}
+
+// sizeLimits returns the size checks of the options.
+func (o SourceOptions) sizeLimits() sourceSizeLimits {
+	limits := sourceSizeLimits{strictSourceSize: o.StrictSourceSize}
+	if o.MaxSourceBytes > 0 {
+		limits.maxSourceBytes = uint64(o.MaxSourceBytes)
+	}
+	return limits
+}
+
+// streamOptions returns the options writing the source data to a file.
+func (o SourceOptions) streamOptions() sourceStreamOptions {
+	return sourceStreamOptions{options: util.StreamOptions{Preallocate: o.ScratchPreallocation}}
+}
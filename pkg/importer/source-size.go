@@ -0,0 +1,120 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+)
+
+// ErrSourceLargerThanReported is returned when reading more bytes from a source than the size it reported, like the
+// Content-Length of an object, with strict source size checks.
+var ErrSourceLargerThanReported = errors.New("source is larger than its reported size")
+
+// ErrSourceExceedsMaxSize is returned when the reported size of a source, or the bytes read from it, exceed the
+// MaxSourceBytes of SourceOptions.
+var ErrSourceExceedsMaxSize = errors.New("source exceeds maximum allowed size")
+
+// sourceSizeLimits are the size checks of a data source against the size it reported and against a maximum size,
+// embedded in the data sources and set by SourceOptions.
+type sourceSizeLimits struct {
+	// strictSourceSize fails the transfers of a source larger than reported.
+	strictSourceSize bool
+	// maxSourceBytes is the maximum number of bytes of the source, 0 if unlimited.
+	maxSourceBytes uint64
+}
+
+// enabled returns true if the source is checked against the size it reported or against a maximum size. The checks
+// happen while our client reads the source, not while nbdkit or qemu-img read it.
+func (l sourceSizeLimits) enabled() bool {
+	return l.strictSourceSize || l.maxSourceBytes > 0
+}
+
+// checkMaxSourceSize fails if the reported size of the source, 0 if unknown, exceeds the maximum size.
+func (l sourceSizeLimits) checkMaxSourceSize(size uint64) error {
+	if l.maxSourceBytes > 0 && size > l.maxSourceBytes {
+		return errors.Wrapf(ErrSourceExceedsMaxSize, "reported size %d bytes, maximum %d bytes", size, l.maxSourceBytes)
+	}
+	return nil
+}
+
+// maxSourceSizeReader fails once more bytes than the maximum size of the source are read.
+type maxSourceSizeReader struct {
+	reader io.ReadCloser
+	// max is the maximum number of bytes of the source.
+	max uint64
+	// read is the number of bytes read.
+	read uint64
+}
+
+func (r *maxSourceSizeReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += uint64(n)
+	if r.read > r.max {
+		return n, errors.Wrapf(ErrSourceExceedsMaxSize, "read %d bytes, maximum %d bytes", r.read, r.max)
+	}
+	return n, err
+}
+
+func (r *maxSourceSizeReader) Close() error {
+	return r.reader.Close()
+}
+
+// sourceSizeReader detects a source streaming more bytes than its reported size.
+type sourceSizeReader struct {
+	reader io.ReadCloser
+	// size is the reported size of the source.
+	size uint64
+	// strict fails the reads beyond the reported size instead of calling onLarger.
+	strict bool
+	// read is the number of bytes read.
+	read uint64
+	// onLarger is called with the number of bytes read after each read beyond the reported size.
+	onLarger func(read uint64)
+}
+
+// newSourceSizeReader returns a reader of the source of the reported size, failing once the bytes read exceed the size
+// if strict, or calling onLarger with the bytes read otherwise.
+func newSourceSizeReader(reader io.ReadCloser, size uint64, strict bool, onLarger func(read uint64)) *sourceSizeReader {
+	return &sourceSizeReader{reader: reader, size: size, strict: strict, onLarger: onLarger}
+}
+
+func (r *sourceSizeReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n == 0 {
+		return n, err
+	}
+	larger := r.read > r.size
+	r.read += uint64(n)
+	if r.read <= r.size {
+		return n, err
+	}
+	if r.strict {
+		return n, errors.Wrapf(ErrSourceLargerThanReported, "read %d bytes, reported size %d bytes", r.read, r.size)
+	}
+	if !larger {
+		klog.Warningf("The source is larger than its reported size of %d bytes, reading it to the end", r.size)
+	}
+	r.onLarger(r.read)
+	return n, err
+}
+
+func (r *sourceSizeReader) Close() error {
+	return r.reader.Close()
+}
@@ -0,0 +1,169 @@
+package importer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/pkg/errors"
+)
+
+var _ = Describe("Source size", func() {
+	var (
+		client *rangedMockS3Client
+		tmpDir string
+	)
+
+	BeforeEach(func() {
+		data := tinyCoreData()
+		// The object streams more than its reported length, like behind a CDN with a stale Content-Length.
+		client = &rangedMockS3Client{data: data, limit: len(data), reportedLength: len(data) / 2}
+		newClientFunc = func(endpoint, accKey, secKey string, certDir string, options s3ClientOptions) (S3Client, error) {
+			return client, nil
+		}
+		var err error
+		tmpDir, err = ioutil.TempDir("", "size")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		newClientFunc = getS3Client
+		progressFuncInterval = time.Second
+		os.RemoveAll(tmpDir)
+	})
+
+	table.DescribeTable("should read a source larger than reported to its end", func(retries int) {
+		var mutex sync.Mutex
+		var totals []int64
+		progressFuncInterval = 10 * time.Millisecond
+		sd, err := NewS3DataSourceWithOptions("http://amazon.com/bucket/disk.raw", "", "", "", S3Options{ReadRetries: retries, ReadRetryBackoff: time.Millisecond})
+		Expect(err).NotTo(HaveOccurred())
+		dp := NewDataProcessor(sd, "", tmpDir, "", "", 0.055, false)
+		dp.SetProgressFunc(func(current, total int64, elapsed time.Duration) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			totals = append(totals, total)
+		})
+		_, err = dp.sourceInfo()
+		Expect(err).NotTo(HaveOccurred())
+		target := filepath.Join(tmpDir, "disk.img")
+		_, err = sd.TransferFile(target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sd.Close()).To(Succeed())
+		data, err := ioutil.ReadFile(target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Equal(data, client.data)).To(BeTrue())
+		Expect(sd.readers.progressReader.Total()).To(BeEquivalentTo(len(client.data)))
+		mutex.Lock()
+		defer mutex.Unlock()
+		Expect(totals).NotTo(BeEmpty())
+		Expect(totals[len(totals)-1]).To(BeEquivalentTo(len(client.data)))
+	},
+		table.Entry("in a single request", 0),
+		table.Entry("with resumed reads", 3),
+	)
+
+	table.DescribeTable("should fail on a source larger than reported with strict checks", func(retries int) {
+		sd, err := NewS3DataSourceWithOptions("http://amazon.com/bucket/disk.raw", "", "", "", S3Options{
+			ReadRetries:      retries,
+			ReadRetryBackoff: time.Millisecond,
+			SourceOptions:    SourceOptions{StrictSourceSize: true},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		_, err = sd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = sd.TransferFile(filepath.Join(tmpDir, "disk.img"))
+		Expect(errors.Cause(err)).To(Equal(ErrSourceLargerThanReported))
+	},
+		table.Entry("in a single request", 0),
+		table.Entry("with resumed reads", 3),
+	)
+
+	It("should not complain about a source of the reported size", func() {
+		client.reportedLength = 0
+		sd, err := NewS3DataSourceWithOptions("http://amazon.com/bucket/disk.raw", "", "", "", S3Options{SourceOptions: SourceOptions{StrictSourceSize: true}})
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		_, err = sd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = sd.TransferFile(filepath.Join(tmpDir, "disk.img"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should fail Info on a source reporting more than the maximum size", func() {
+		client.reportedLength = 0
+		sd, err := NewS3DataSourceWithOptions("http://amazon.com/bucket/disk.raw", "", "", "", S3Options{SourceOptions: SourceOptions{MaxSourceBytes: int64(len(client.data) / 2)}})
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		phase, err := sd.Info()
+		Expect(phase).To(Equal(ProcessingPhaseError))
+		Expect(errors.Cause(err)).To(Equal(ErrSourceExceedsMaxSize))
+		Expect(err.Error()).To(ContainSubstring("source exceeds maximum allowed size"))
+	})
+
+	It("should fail the transfer of a source streaming past the maximum size", func() {
+		// The object reports half of its size, under the maximum, and streams all of it.
+		sd, err := NewS3DataSourceWithOptions("http://amazon.com/bucket/disk.raw", "", "", "", S3Options{SourceOptions: SourceOptions{MaxSourceBytes: int64(len(client.data) * 3 / 4)}})
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		_, err = sd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		phase, err := sd.TransferFile(filepath.Join(tmpDir, "disk.img"))
+		Expect(phase).To(Equal(ProcessingPhaseError))
+		Expect(errors.Cause(err)).To(Equal(ErrSourceExceedsMaxSize))
+	})
+
+	It("should stop a source of unknown size streaming forever at the maximum size", func() {
+		ud := NewUploadDataSource(ioutil.NopCloser(endlessData{}))
+		ud.sourceSizeLimits = SourceOptions{MaxSourceBytes: 1024 * 1024}.sizeLimits()
+		defer ud.Close()
+		_, err := ud.Info()
+		Expect(err).NotTo(HaveOccurred())
+		phase, err := ud.TransferFile(filepath.Join(tmpDir, "disk.img"))
+		Expect(phase).To(Equal(ProcessingPhaseError))
+		Expect(errors.Cause(err)).To(Equal(ErrSourceExceedsMaxSize))
+	})
+
+	It("should only limit the source the maximum size is set on", func() {
+		client.reportedLength = 0
+		limited, err := NewS3DataSourceWithOptions("http://amazon.com/bucket/disk.raw", "", "", "", S3Options{SourceOptions: SourceOptions{MaxSourceBytes: int64(len(client.data) / 2)}})
+		Expect(err).NotTo(HaveOccurred())
+		defer limited.Close()
+		unlimited, err := NewS3DataSource("http://amazon.com/bucket/disk.raw", "", "", "")
+		Expect(err).NotTo(HaveOccurred())
+		defer unlimited.Close()
+		_, err = limited.Info()
+		Expect(errors.Cause(err)).To(Equal(ErrSourceExceedsMaxSize))
+		_, err = unlimited.Info()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should not limit a source under the maximum size", func() {
+		client.reportedLength = 0
+		sd, err := NewS3DataSourceWithOptions("http://amazon.com/bucket/disk.raw", "", "", "", S3Options{SourceOptions: SourceOptions{MaxSourceBytes: int64(len(client.data))}})
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		_, err = sd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = sd.TransferFile(filepath.Join(tmpDir, "disk.img"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+// endlessData streams 0x55 bytes forever.
+type endlessData struct{}
+
+func (endlessData) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0x55
+	}
+	return len(p), nil
+}
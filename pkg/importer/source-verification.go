@@ -0,0 +1,46 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+// verifyingDataSource is implemented by the data sources which can verify the source data while it is transferred.
+// The verifications must be set before Info.
+type verifyingDataSource interface {
+	// setSourceDigest makes the source compute the sha256 digest of the source data, for the checksum allowlist.
+	setSourceDigest(enabled bool)
+	// setSignatureVerification makes the source verify the signature of the source data, nil disables the
+	// verification.
+	setSignatureVerification(verification *SignatureVerification)
+}
+
+// sourceVerification are the verifications of the source data the data sources make while they read it, embedded in
+// the data sources to implement verifyingDataSource.
+type sourceVerification struct {
+	// digest computes the digest of the source data.
+	digest bool
+	// signature verifies the signature of the source data, nil if not verified.
+	signature *SignatureVerification
+}
+
+// setSourceDigest implements verifyingDataSource.
+func (v *sourceVerification) setSourceDigest(enabled bool) {
+	v.digest = enabled
+}
+
+// setSignatureVerification implements verifyingDataSource.
+func (v *sourceVerification) setSignatureVerification(verification *SignatureVerification) {
+	v.signature = verification
+}
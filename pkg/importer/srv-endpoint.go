@@ -0,0 +1,134 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"k8s.io/klog/v2"
+)
+
+// srvSchemePrefix marks an endpoint whose host is the name of a DNS SRV record, for instance
+// srv+https://_s3._tcp.example.com/bucket/object. The record is resolved to the actual endpoints before connecting.
+const srvSchemePrefix = "srv+"
+
+// srvResolver looks up SRV records, implemented by net.Resolver.
+type srvResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// may be overridden in tests
+var srvLookup srvResolver = net.DefaultResolver
+
+// may be overridden in tests
+var srvRandom = rand.Intn
+
+// isSRVEndpoint returns true if the endpoint refers to a DNS SRV record.
+func isSRVEndpoint(ep *url.URL) bool {
+	return strings.HasPrefix(ep.Scheme, srvSchemePrefix)
+}
+
+// resolveSRVEndpoints looks up the SRV record named by the endpoint host, and returns the endpoints of the
+// targets in the order they should be tried.
+func resolveSRVEndpoints(ep *url.URL) ([]*url.URL, error) {
+	_, records, err := srvLookup.LookupSRV(context.Background(), "", "", ep.Hostname())
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to resolve SRV record %q", ep.Hostname())
+	}
+	if len(records) == 0 {
+		return nil, errors.Errorf("SRV record %q has no targets", ep.Hostname())
+	}
+	var endpoints []*url.URL
+	for _, record := range orderSRVRecords(records) {
+		target := *ep
+		target.Scheme = strings.TrimPrefix(ep.Scheme, srvSchemePrefix)
+		target.Host = net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+		endpoints = append(endpoints, &target)
+	}
+	return endpoints, nil
+}
+
+// orderSRVRecords sorts the records by priority, records with the same priority are ordered by a weighted
+// random selection as described in RFC 2782.
+func orderSRVRecords(records []*net.SRV) []*net.SRV {
+	remaining := make([]*net.SRV, len(records))
+	copy(remaining, records)
+	sort.SliceStable(remaining, func(i, j int) bool {
+		return remaining[i].Priority < remaining[j].Priority
+	})
+	ordered := make([]*net.SRV, 0, len(records))
+	for len(remaining) > 0 {
+		// Find the records with the lowest remaining priority.
+		end := 1
+		for end < len(remaining) && remaining[end].Priority == remaining[0].Priority {
+			end++
+		}
+		group := make([]*net.SRV, end)
+		copy(group, remaining[:end])
+		// Zero weight records go first, so they have a small chance of being selected.
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].Weight == 0 && group[j].Weight > 0
+		})
+		for len(group) > 0 {
+			total := 0
+			for _, record := range group {
+				total += int(record.Weight)
+			}
+			n := srvRandom(total + 1)
+			picked, sum := 0, 0
+			for i, record := range group {
+				sum += int(record.Weight)
+				if sum >= n {
+					picked = i
+					break
+				}
+			}
+			ordered = append(ordered, group[picked])
+			group = append(group[:picked], group[picked+1:]...)
+		}
+		remaining = remaining[end:]
+	}
+	return ordered
+}
+
+// connectEndpoint calls connect with the endpoint. If the endpoint refers to a SRV record, connect is called with
+// each of the targets in order until it succeeds. Returns the endpoint connect succeeded with.
+func connectEndpoint(ep *url.URL, connect func(*url.URL) error) (*url.URL, error) {
+	if !isSRVEndpoint(ep) {
+		return ep, connect(ep)
+	}
+	endpoints, err := resolveSRVEndpoints(ep)
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range endpoints {
+		klog.V(1).Infof("Connecting to SRV target %s", target.Host)
+		if err = connect(target); err == nil {
+			return target, nil
+		}
+		klog.Warningf("Unable to connect to SRV target %s: %v", target.Host, err)
+	}
+	return nil, errors.Wrapf(err, "unable to connect to any target of SRV record %q", ep.Hostname())
+}
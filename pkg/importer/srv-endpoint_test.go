@@ -0,0 +1,160 @@
+package importer
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pkg/errors"
+)
+
+// stubSRVResolver returns the configured records for any name.
+type stubSRVResolver struct {
+	records []*net.SRV
+	err     error
+	names   []string
+}
+
+func (r *stubSRVResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.names = append(r.names, name)
+	return name, r.records, r.err
+}
+
+func srvTargets(endpoints []*url.URL) []string {
+	var hosts []string
+	for _, ep := range endpoints {
+		hosts = append(hosts, ep.Host)
+	}
+	return hosts
+}
+
+var _ = Describe("SRV endpoints", func() {
+	var resolver *stubSRVResolver
+
+	BeforeEach(func() {
+		resolver = &stubSRVResolver{}
+		srvLookup = resolver
+		// Always pick the first record of the remaining ones.
+		srvRandom = func(n int) int { return 0 }
+	})
+
+	AfterEach(func() {
+		srvLookup = net.DefaultResolver
+		srvRandom = rand.Intn
+	})
+
+	It("should order the targets by priority", func() {
+		resolver.records = []*net.SRV{
+			{Target: "c.example.com.", Port: 443, Priority: 30, Weight: 10},
+			{Target: "a.example.com.", Port: 8443, Priority: 10, Weight: 10},
+			{Target: "b.example.com.", Port: 443, Priority: 20, Weight: 10},
+		}
+		ep, _ := url.Parse("srv+https://_s3._tcp.example.com/bucket/object")
+		endpoints, err := resolveSRVEndpoints(ep)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resolver.names).To(Equal([]string{"_s3._tcp.example.com"}))
+		Expect(srvTargets(endpoints)).To(Equal([]string{"a.example.com:8443", "b.example.com:443", "c.example.com:443"}))
+		for _, endpoint := range endpoints {
+			Expect(endpoint.Scheme).To(Equal("https"))
+			Expect(endpoint.Path).To(Equal("/bucket/object"))
+		}
+	})
+
+	It("should order targets with the same priority by weight", func() {
+		resolver.records = []*net.SRV{
+			{Target: "a.example.com.", Port: 80, Priority: 10, Weight: 10},
+			{Target: "b.example.com.", Port: 80, Priority: 10, Weight: 30},
+			{Target: "c.example.com.", Port: 80, Priority: 10, Weight: 0},
+			{Target: "d.example.com.", Port: 80, Priority: 5, Weight: 0},
+		}
+		// Pick the highest value, which selects the last record of the remaining ones.
+		srvRandom = func(n int) int { return n - 1 }
+		ep, _ := url.Parse("srv+http://_images._tcp.example.com/disk.img")
+		endpoints, err := resolveSRVEndpoints(ep)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(srvTargets(endpoints)).To(Equal([]string{"d.example.com:80", "b.example.com:80", "a.example.com:80", "c.example.com:80"}))
+	})
+
+	It("should fail if the SRV record has no targets", func() {
+		ep, _ := url.Parse("srv+http://_images._tcp.example.com/disk.img")
+		_, err := resolveSRVEndpoints(ep)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should fail if the SRV record cannot be resolved", func() {
+		resolver.err = errors.New("no such host")
+		ep, _ := url.Parse("srv+http://_images._tcp.example.com/disk.img")
+		_, err := resolveSRVEndpoints(ep)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("no such host"))
+	})
+
+	It("connectEndpoint should not resolve regular endpoints", func() {
+		ep, _ := url.Parse("http://www.example.com/disk.img")
+		result, err := connectEndpoint(ep, func(target *url.URL) error {
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(BeIdenticalTo(ep))
+		Expect(resolver.names).To(BeEmpty())
+	})
+
+	It("connectEndpoint should try the next target on failure", func() {
+		resolver.records = []*net.SRV{
+			{Target: "a.example.com.", Port: 80, Priority: 10},
+			{Target: "b.example.com.", Port: 80, Priority: 20},
+			{Target: "c.example.com.", Port: 80, Priority: 30},
+		}
+		var attempts []string
+		ep, _ := url.Parse("srv+http://_images._tcp.example.com/disk.img")
+		result, err := connectEndpoint(ep, func(target *url.URL) error {
+			attempts = append(attempts, target.Host)
+			if target.Host == "a.example.com:80" {
+				return errors.New("connection refused")
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.String()).To(Equal("http://b.example.com:80/disk.img"))
+		Expect(attempts).To(Equal([]string{"a.example.com:80", "b.example.com:80"}))
+	})
+
+	It("connectEndpoint should fail if no target can be reached", func() {
+		resolver.records = []*net.SRV{
+			{Target: "a.example.com.", Port: 80, Priority: 10},
+			{Target: "b.example.com.", Port: 80, Priority: 20},
+		}
+		ep, _ := url.Parse("srv+http://_images._tcp.example.com/disk.img")
+		_, err := connectEndpoint(ep, func(target *url.URL) error {
+			return errors.New("connection refused")
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("unable to connect to any target"))
+	})
+
+	It("NewHTTPDataSource should connect to the first healthy SRV target", func() {
+		ts := httptest.NewServer(http.FileServer(http.Dir(imageDir)))
+		defer ts.Close()
+		down := httptest.NewServer(http.NotFoundHandler())
+		down.Close()
+		tsURL, _ := url.Parse(ts.URL)
+		downURL, _ := url.Parse(down.URL)
+		port, _ := strconv.Atoi(tsURL.Port())
+		downPort, _ := strconv.Atoi(downURL.Port())
+		resolver.records = []*net.SRV{
+			{Target: "127.0.0.1.", Port: uint16(port), Priority: 20},
+			{Target: "127.0.0.1.", Port: uint16(downPort), Priority: 10},
+		}
+		dp, err := NewHTTPDataSource("srv+http://_images._tcp.example.com/"+cirrosFileName, "", "", "", "kubevirt")
+		Expect(err).NotTo(HaveOccurred())
+		defer dp.Close()
+		Expect(dp.endpoint.String()).To(Equal(ts.URL + "/" + cirrosFileName))
+	})
+})
@@ -0,0 +1,161 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+
+	"k8s.io/klog/v2"
+
+	"kubevirt.io/containerized-data-importer/pkg/util"
+)
+
+// StreamDataSource is the struct containing the information needed to import an image read from an arbitrary reader,
+// like the standard input of command line tools. The reader isn't seekable, Info only buffers the header of the image
+// and chains it back in front of the rest of the stream for Transfer.
+// Sequence of phases:
+// 1a. Info -> TransferScratch, if the image needs to be converted.
+// 1b. Info -> TransferDataFile, if the image is raw.
+// 2a. TransferScratch -> Convert
+// 2b. TransferDataFile -> Resize
+type StreamDataSource struct {
+	sourceSizeLimits
+	sourceVerification
+	sourceStreamOptions
+	// the image stream
+	stream io.ReadCloser
+	// size is the size of the stream, -1 if unknown.
+	size int64
+	// stack of readers
+	readers *FormatReaders
+	// fail if the virtual size of the image exceeds the capacity of the target, 0 if unknown.
+	targetCapacity int64
+	// The image file in scratch space.
+	url *url.URL
+}
+
+// NewStreamDataSource creates a new instance of the StreamDataSource importing the size bytes read from reader. A size
+// of -1 means unknown, the progress is then reported without percentage and the target capacity isn't checked. The
+// reader is closed by Close if it's an io.ReadCloser.
+func NewStreamDataSource(reader io.Reader, size int64) *StreamDataSource {
+	stream, ok := reader.(io.ReadCloser)
+	if !ok {
+		stream = ioutil.NopCloser(reader)
+	}
+	if size < 0 {
+		size = -1
+	}
+	return &StreamDataSource{
+		stream: stream,
+		size:   size,
+	}
+}
+
+// SetTargetCapacity makes Info fail if the virtual size of the image exceeds capacity bytes, before transferring any
+// data. A capacity of 0 disables the check, and so does an unknown stream size.
+func (sd *StreamDataSource) SetTargetCapacity(capacity int64) {
+	sd.targetCapacity = capacity
+}
+
+// Info is called to get initial information about the data.
+func (sd *StreamDataSource) Info() (ProcessingPhase, error) {
+	var err error
+	sd.readers, err = newSourceFormatReaders(sd.stream, sd.size, sd.sourceSizeLimits, sd.sourceVerification)
+	if err != nil {
+		klog.Errorf("Error creating readers: %v", err)
+		return ProcessingPhaseError, err
+	}
+	if err = checkBackingFile(sd.readers); err != nil {
+		return ProcessingPhaseError, err
+	}
+	if sd.size > 0 {
+		if err = checkTargetCapacity("stream", sd.readers, uint64(sd.size), sd.targetCapacity); err != nil {
+			return ProcessingPhaseError, err
+		}
+	}
+	if !sd.readers.Convert {
+		// Streaming a raw image, we can write that directly to the target.
+		return ProcessingPhaseTransferDataFile, nil
+	}
+	return ProcessingPhaseTransferScratch, nil
+}
+
+// Transfer is called to transfer the data from the source to a temporary location.
+func (sd *StreamDataSource) Transfer(path string) (ProcessingPhase, error) {
+	size, _ := util.GetAvailableSpace(path)
+	if size <= int64(0) {
+		//Path provided is invalid.
+		return ProcessingPhaseError, ErrInvalidPath
+	}
+	file := filepath.Join(path, tempFile)
+	sd.readers.StartProgressUpdate()
+	err := util.StreamDataToFileWithSize(sd.readers.TopReader(), file, sd.readers.topReaderSize(sd.size), sd.streamOptions())
+	if err != nil {
+		return ProcessingPhaseError, err
+	}
+	// If streaming succeeded, then parsing the file into URL will also succeed, no need to check error status
+	sd.url, _ = url.Parse(file)
+	return ProcessingPhaseConvert, nil
+}
+
+// TransferFile is called to transfer the data from the source to the passed in file.
+func (sd *StreamDataSource) TransferFile(fileName string) (ProcessingPhase, error) {
+	sd.readers.StartProgressUpdate()
+	err := util.StreamDataToFileWithSize(sd.readers.TopReader(), fileName, -1, sd.streamOptions())
+	if err != nil {
+		return ProcessingPhaseError, err
+	}
+	return ProcessingPhaseResize, nil
+}
+
+// TransferToWriter is called to stream the raw image from the source to w, without scratch space.
+func (sd *StreamDataSource) TransferToWriter(w io.Writer) (ProcessingPhase, error) {
+	return transferToWriter(sd.readers, w)
+}
+
+// TransferToWriterAt is called to write the raw image from the source at its offsets in w, without scratch space.
+func (sd *StreamDataSource) TransferToWriterAt(w io.WriterAt) (ProcessingPhase, error) {
+	return transferToWriterAt(sd.readers, w)
+}
+
+// GetURL returns the url that the data processor can use when converting the data.
+func (sd *StreamDataSource) GetURL() *url.URL {
+	return sd.url
+}
+
+func (sd *StreamDataSource) sourceDigest() (string, error) {
+	return sd.readers.sourceDigest()
+}
+
+func (sd *StreamDataSource) verifySourceSignature() error {
+	return sd.readers.verifySourceSignature()
+}
+
+func (sd *StreamDataSource) formatReaders() *FormatReaders {
+	return sd.readers
+}
+
+// Close closes any readers or other open resources.
+func (sd *StreamDataSource) Close() error {
+	if sd.readers != nil {
+		return sd.readers.Close()
+	}
+	return sd.stream.Close()
+}
@@ -0,0 +1,129 @@
+package importer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/pkg/errors"
+)
+
+// pipeReader returns a non-seekable reader streaming data.
+func pipeReader(data []byte) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := pw.Write(data)
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+var _ = Describe("Stream data source", func() {
+	var (
+		tmpDir string
+		sd     *StreamDataSource
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "scratch")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		if sd != nil {
+			sd.Close()
+			sd = nil
+		}
+		os.RemoveAll(tmpDir)
+	})
+
+	table.DescribeTable("should transfer a qcow2 image to scratch space", func(size int64) {
+		sd = NewStreamDataSource(pipeReader(cirrosData), size)
+		result, err := sd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseTransferScratch))
+		result, err = sd.Transfer(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseConvert))
+		data, err := ioutil.ReadFile(filepath.Join(tmpDir, tempFile))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Equal(data, cirrosData)).To(BeTrue())
+		Expect(sd.GetURL().String()).To(Equal(filepath.Join(tmpDir, tempFile)))
+	},
+		table.Entry("of known size", int64(len(cirrosData))),
+		table.Entry("of unknown size", int64(-1)),
+	)
+
+	table.DescribeTable("should transfer a raw image to the target", func(size int64) {
+		raw := tinyCoreData()
+		sd = NewStreamDataSource(pipeReader(raw), size)
+		result, err := sd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseTransferDataFile))
+		target := filepath.Join(tmpDir, "disk.img")
+		result, err = sd.TransferFile(target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseResize))
+		data, err := ioutil.ReadFile(target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Equal(data, raw)).To(BeTrue())
+	},
+		table.Entry("of known size", int64(len(tinyCoreData()))),
+		table.Entry("of unknown size", int64(-1)),
+	)
+
+	It("should decompress a stream to the writer", func() {
+		gz, err := ioutil.ReadFile(tinyCoreGzFilePath)
+		Expect(err).NotTo(HaveOccurred())
+		sd = NewStreamDataSource(bytes.NewBuffer(gz), -1)
+		result, err := sd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseTransferDataFile))
+		var buf bytes.Buffer
+		_, err = sd.TransferToWriter(&buf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Equal(buf.Bytes(), tinyCoreData())).To(BeTrue())
+	})
+
+	It("should import a stream with the data processor", func() {
+		Expect(os.Mkdir(filepath.Join(tmpDir, "data"), 0755)).To(Succeed())
+		Expect(os.Mkdir(filepath.Join(tmpDir, "scratch"), 0755)).To(Succeed())
+		sd = NewStreamDataSource(pipeReader(cirrosData), -1)
+		dp := NewDataProcessor(sd, filepath.Join(tmpDir, "data", "disk.img"), filepath.Join(tmpDir, "data"), filepath.Join(tmpDir, "scratch"), "", 0.055, false)
+		var err error
+		replaceQEMUOperations(NewFakeQEMUOperations(nil, nil, fakeInfoRet, nil, nil, nil), func() {
+			err = dp.ProcessData()
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dp.currentPhase).To(Equal(ProcessingPhaseComplete))
+	})
+
+	It("should fail on an empty stream", func() {
+		sd = NewStreamDataSource(pipeReader(nil), -1)
+		result, err := sd.Info()
+		Expect(errors.Cause(err)).To(Equal(ErrEmptySource))
+		Expect(result).To(Equal(ProcessingPhaseError))
+	})
+
+	It("should check the target capacity only if the size of the stream is known", func() {
+		raw := tinyCoreData()
+		sd = NewStreamDataSource(pipeReader(raw), int64(len(raw)))
+		sd.SetTargetCapacity(int64(len(raw)) / 2)
+		_, err := sd.Info()
+		Expect(errors.Cause(err)).To(Equal(ErrVirtualSizeExceedsCapacity))
+		sd.Close()
+
+		sd = NewStreamDataSource(pipeReader(raw), -1)
+		sd.SetTargetCapacity(int64(len(raw)) / 2)
+		result, err := sd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseTransferDataFile))
+	})
+})
@@ -0,0 +1,45 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"kubevirt.io/containerized-data-importer/pkg/util"
+)
+
+// flushingDataSource is implemented by the data sources writing the source data to a file in Transfer or
+// TransferFile, which sync the file while writing it according to a flush policy. The policy must be set before
+// the transfer.
+type flushingDataSource interface {
+	// setFlushPolicy sets the policy the file writes are synced with, util.DefaultFlushPolicy if it has no mode.
+	setFlushPolicy(policy util.FlushPolicy)
+}
+
+// sourceStreamOptions are the options the data sources write the source data to a file with, embedded in the data
+// sources to implement flushingDataSource. Preallocation is set by SourceOptions.
+type sourceStreamOptions struct {
+	options util.StreamOptions
+}
+
+// setFlushPolicy implements flushingDataSource.
+func (o *sourceStreamOptions) setFlushPolicy(policy util.FlushPolicy) {
+	o.options.FlushPolicy = policy
+}
+
+// streamOptions returns the options streaming the source data to a file.
+func (o sourceStreamOptions) streamOptions() util.StreamOptions {
+	return o.options
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+
+	"kubevirt.io/containerized-data-importer/pkg/util"
+)
+
+// defaultTarMemberPatterns are the names of the tar archive members extracted as the disk image, unless other patterns
+// are configured.
+var defaultTarMemberPatterns = []string{"*.img", "*.qcow2", "*.raw"}
+
+// parseTarMemberPatterns returns the trimmed non-empty patterns, the default patterns if there is none. It fails if one
+// of the patterns isn't a valid glob.
+func parseTarMemberPatterns(patterns []string) ([]string, error) {
+	var parsed []string
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid tar member pattern %q", pattern)
+		}
+		parsed = append(parsed, pattern)
+	}
+	if len(parsed) == 0 {
+		return defaultTarMemberPatterns, nil
+	}
+	return parsed, nil
+}
+
+// matchesTarMember returns true if the base name of the tar archive member name matches one of the patterns.
+func matchesTarMember(name string, patterns []string) bool {
+	base := path.Base(name)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// extractTarMember extracts the regular file of the tar archive read from reader whose name matches the patterns into
+// fileName, and returns the name of the member. The whole archive is read. When more than one regular file matches,
+// selection picks one of them by base name, size or extension, the selected candidate replacing the one extracted so
+// far. The default selection fails instead of picking one of the candidates arbitrarily. It fails if no file matches.
+func extractTarMember(reader io.Reader, patterns []string, selection ArchiveMemberSelection, fileName string) (string, error) {
+	tarReader := tar.NewReader(reader)
+	member := ""
+	var selected os.FileInfo
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			break // End of archive
+		}
+		if err != nil {
+			return "", errors.Wrap(err, "unable to read the tar archive")
+		}
+		if !hdr.FileInfo().Mode().IsRegular() || !matchesTarMember(hdr.Name, patterns) {
+			continue
+		}
+		candidate := hdr.FileInfo()
+		if member != "" {
+			best, err := selectArchiveMember([]os.FileInfo{selected, candidate}, selection)
+			if err != nil {
+				os.Remove(fileName)
+				return "", errors.Wrapf(err, "tar archive members %s and %s both match %s", member, hdr.Name, strings.Join(patterns, ", "))
+			}
+			if best == selected {
+				klog.Infof("Skipping tar archive member %s, %s is selected", hdr.Name, member)
+				continue
+			}
+			if err := os.Remove(fileName); err != nil {
+				return "", errors.Wrapf(err, "unable to remove tar archive member %s", member)
+			}
+		}
+		klog.Infof("Extracting tar archive member %s", hdr.Name)
+		if err := util.StreamDataToFile(tarReader, fileName); err != nil {
+			return "", errors.Wrapf(err, "unable to extract tar archive member %s", hdr.Name)
+		}
+		member = hdr.Name
+		selected = candidate
+	}
+	if member == "" {
+		return "", errors.Errorf("tar archive contains no regular file matching %s", strings.Join(patterns, ", "))
+	}
+	return member, nil
+}
@@ -0,0 +1,233 @@
+package importer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/pkg/errors"
+)
+
+// tarEntry is a member of a test tar archive, a directory if its name ends with a slash.
+type tarEntry struct {
+	name string
+	data []byte
+}
+
+// tarArchive returns a tar archive of the entries.
+func tarArchive(entries ...tarEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		hdr := &tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.data)), Typeflag: tar.TypeReg}
+		if entry.name[len(entry.name)-1] == '/' {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0755
+		}
+		Expect(tw.WriteHeader(hdr)).To(Succeed())
+		_, err := tw.Write(entry.data)
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(tw.Close()).To(Succeed())
+	return buf.Bytes()
+}
+
+// gzipData returns data compressed with gzip.
+func gzipData(data []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write(data)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(gw.Close()).To(Succeed())
+	return buf.Bytes()
+}
+
+var _ = Describe("Tar extraction", func() {
+	var (
+		tmpDir string
+		target string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "tar")
+		Expect(err).NotTo(HaveOccurred())
+		target = filepath.Join(tmpDir, "disk.img")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should extract the only regular file matching the patterns", func() {
+		archive := tarArchive(
+			tarEntry{name: "images/"},
+			tarEntry{name: "images/README", data: []byte("readme")},
+			tarEntry{name: "images/cirros.qcow2", data: cirrosData},
+			tarEntry{name: "images/cirros.qcow2.sha256", data: []byte("digest")},
+		)
+		member, err := extractTarMember(bytes.NewReader(archive), defaultTarMemberPatterns, "", target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(member).To(Equal("images/cirros.qcow2"))
+		data, err := ioutil.ReadFile(target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(Equal(cirrosData))
+	})
+
+	It("should skip the directories matching the patterns", func() {
+		archive := tarArchive(tarEntry{name: "disk.img/"}, tarEntry{name: "disk.img/disk.raw", data: []byte("disk")})
+		member, err := extractTarMember(bytes.NewReader(archive), defaultTarMemberPatterns, "", target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(member).To(Equal("disk.img/disk.raw"))
+	})
+
+	It("should reject archives with more than one candidate", func() {
+		archive := tarArchive(tarEntry{name: "disk.img", data: []byte("disk")}, tarEntry{name: "other.raw", data: []byte("other")})
+		_, err := extractTarMember(bytes.NewReader(archive), defaultTarMemberPatterns, "", target)
+		Expect(err).To(HaveOccurred())
+		Expect(errors.Cause(err)).To(Equal(ErrAmbiguousArchiveMember))
+		Expect(err.Error()).To(ContainSubstring("disk.img and other.raw"))
+		Expect(target).ToNot(BeAnExistingFile())
+	})
+
+	table.DescribeTable("should select one of several candidates", func(selection ArchiveMemberSelection, expected string) {
+		archive := tarArchive(
+			tarEntry{name: "b/disk.img", data: []byte("b disk")},
+			tarEntry{name: "c/disk.qcow2", data: []byte("c disk")},
+			tarEntry{name: "a/large.raw", data: []byte("a large disk")},
+			tarEntry{name: "README", data: []byte("readme")},
+		)
+		member, err := extractTarMember(bytes.NewReader(archive), defaultTarMemberPatterns, selection, target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(member).To(Equal(expected))
+		data, err := ioutil.ReadFile(target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(HavePrefix(path.Dir(expected) + " "))
+	},
+		table.Entry("with first by base name", ArchiveMemberSelectionFirst, "b/disk.img"),
+		table.Entry("with largest", ArchiveMemberSelectionLargest, "a/large.raw"),
+		table.Entry("with by-extension-priority", ArchiveMemberSelectionExtensionPriority, "c/disk.qcow2"),
+	)
+
+	It("should fail without candidate", func() {
+		archive := tarArchive(tarEntry{name: "README", data: []byte("readme")})
+		_, err := extractTarMember(bytes.NewReader(archive), defaultTarMemberPatterns, "", target)
+		Expect(err).To(MatchError("tar archive contains no regular file matching *.img, *.qcow2, *.raw"))
+	})
+
+	table.DescribeTable("should parse the member patterns", func(patterns, expected []string) {
+		parsed, err := parseTarMemberPatterns(patterns)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsed).To(Equal(expected))
+	},
+		table.Entry("as the defaults when empty", nil, defaultTarMemberPatterns),
+		table.Entry("as the defaults when blank", []string{""}, defaultTarMemberPatterns),
+		table.Entry("trimmed", []string{" disk-*.vmdk", "*.qcow2 "}, []string{"disk-*.vmdk", "*.qcow2"}),
+	)
+
+	It("should reject invalid member patterns", func() {
+		_, err := parseTarMemberPatterns([]string{"[disk"})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("invalid tar member pattern \"[disk\""))
+	})
+
+	Context("from S3", func() {
+		var (
+			client *s3DataClient
+			sd     *S3DataSource
+		)
+
+		BeforeEach(func() {
+			client = &s3DataClient{}
+			newClientFunc = func(endpoint, accKey, secKey string, certDir string, options s3ClientOptions) (S3Client, error) {
+				return client, nil
+			}
+		})
+
+		AfterEach(func() {
+			newClientFunc = getS3Client
+			if sd != nil {
+				sd.Close()
+				sd = nil
+			}
+		})
+
+		table.DescribeTable("should extract the disk image of", func(archive []byte, compression string) {
+			client.data = archive
+			var err error
+			sd, err = NewS3DataSourceWithOptions("http://amazon.com/bucket/cirros.tar", "", "", "", S3Options{TarExtraction: true})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := sd.Info()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal(ProcessingPhaseTransferScratch))
+			result, err = sd.Transfer(tmpDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal(ProcessingPhaseConvert))
+			data, err := ioutil.ReadFile(sd.GetURL().String())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data).To(Equal(cirrosData))
+
+			manifest := newImportManifest()
+			sd.addToManifest(manifest)
+			transforms := []ImportManifestTransform{{Type: ManifestTransformExtract, Format: "tar", Member: "cirros.qcow2"}}
+			if compression != "" {
+				transforms = append([]ImportManifestTransform{{Type: ManifestTransformDecompress, Format: compression}}, transforms...)
+			}
+			Expect(manifest.Transforms).To(Equal(transforms))
+		},
+			table.Entry("a tar archive", tarArchive(tarEntry{name: "cirros.qcow2", data: cirrosData}), ""),
+			table.Entry("a gzipped tar archive", gzipData(tarArchive(tarEntry{name: "cirros.qcow2", data: cirrosData})), "gz"),
+		)
+
+		It("should fail Transfer with more than one candidate", func() {
+			client.data = tarArchive(tarEntry{name: "disk.img", data: []byte("disk")}, tarEntry{name: "cirros.qcow2", data: cirrosData})
+			var err error
+			sd, err = NewS3DataSourceWithOptions("http://amazon.com/bucket/cirros.tar", "", "", "", S3Options{
+				TarExtraction:     true,
+				TarMemberPatterns: []string{"*.img", "*.qcow2"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = sd.Info()
+			Expect(err).NotTo(HaveOccurred())
+			_, err = sd.Transfer(tmpDir)
+			Expect(errors.Cause(err)).To(Equal(ErrAmbiguousArchiveMember))
+		})
+
+		It("should extract the candidate picked by the archive member selection", func() {
+			client.data = tarArchive(tarEntry{name: "disk.img", data: []byte("disk")}, tarEntry{name: "cirros.qcow2", data: cirrosData})
+			var err error
+			sd, err = NewS3DataSourceWithOptions("http://amazon.com/bucket/cirros.tar", "", "", "", S3Options{
+				TarExtraction:          true,
+				ArchiveMemberSelection: ArchiveMemberSelectionLargest,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = sd.Info()
+			Expect(err).NotTo(HaveOccurred())
+			_, err = sd.Transfer(tmpDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(sd.tarMember).To(Equal("cirros.qcow2"))
+			data, err := ioutil.ReadFile(sd.GetURL().String())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data).To(Equal(cirrosData))
+		})
+
+		It("should transfer tar archives as is when extraction is disabled", func() {
+			client.data = tarArchive(tarEntry{name: "cirros.qcow2", data: cirrosData})
+			var err error
+			sd, err = NewS3DataSource("http://amazon.com/bucket/cirros.tar", "", "", "")
+			Expect(err).NotTo(HaveOccurred())
+			result, err := sd.Info()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal(ProcessingPhaseTransferDataFile))
+			Expect(sd.readers.TarArchive).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,178 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"k8s.io/klog/v2"
+
+	"kubevirt.io/containerized-data-importer/pkg/util"
+)
+
+// transferProgressFile is the name of the progress marker of a resumable transfer, in scratch space.
+const transferProgressFile = "transfer-progress.json"
+
+// transferProgress is the progress marker of a resumable transfer. It identifies the version of the source and the
+// temp file, so a restarted importer only resumes a transfer of the same content.
+type transferProgress struct {
+	// Source is the url of the source, without credentials.
+	Source string `json:"source"`
+	// Version is the version of the content of the source, like its ETag.
+	Version string `json:"version"`
+	// Size is the size of the source, -1 if unknown.
+	Size int64 `json:"size"`
+	// File is the path of the temp file the source is transferred to.
+	File string `json:"file"`
+	// Written is the number of bytes of the source synced to the temp file.
+	Written int64 `json:"written"`
+}
+
+// readTransferProgress returns the progress marker in dir, nil if there is none or its temp file is missing.
+func readTransferProgress(dir string) *transferProgress {
+	data, err := ioutil.ReadFile(filepath.Join(dir, transferProgressFile))
+	if err != nil {
+		return nil
+	}
+	progress := &transferProgress{}
+	if err := json.Unmarshal(data, progress); err != nil {
+		klog.Warningf("Ignoring invalid transfer progress marker: %v", err)
+		return nil
+	}
+	if _, err := os.Stat(progress.File); err != nil {
+		klog.Warningf("Ignoring the transfer progress marker of %s, the temp file is missing", progress.Source)
+		return nil
+	}
+	return progress
+}
+
+// isInterruptedTransfer returns true if fileName is the temp file of an interrupted transfer a restarted importer
+// resumes.
+func isInterruptedTransfer(fileName string) bool {
+	progress := readTransferProgress(filepath.Dir(fileName))
+	return progress != nil && progress.File == fileName
+}
+
+// write persists the progress marker in dir, replacing the previous marker atomically.
+func (p *transferProgress) write(dir string) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal the transfer progress")
+	}
+	tmp := filepath.Join(dir, transferProgressFile+".tmp")
+	file, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrap(err, "unable to create the transfer progress marker")
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "unable to write the transfer progress marker")
+	}
+	return errors.Wrap(os.Rename(tmp, filepath.Join(dir, transferProgressFile)), "unable to write the transfer progress marker")
+}
+
+// removeTransferProgress removes the progress marker in dir, if any.
+func removeTransferProgress(dir string) error {
+	if err := os.Remove(filepath.Join(dir, transferProgressFile)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "unable to remove the transfer progress marker")
+	}
+	return nil
+}
+
+// resumableTransfer writes the source of size bytes (-1 if unknown) at version to fileName in dir, from reader or, to
+// resume the transfer of the same version interrupted by a previous importer, from the source opened at the offset
+// reached with openAt. The progress is recorded at each sync of the flush policy, a transfer of another version
+// restarts from the beginning.
+func resumableTransfer(dir, fileName, source, version string, size int64, reader io.Reader, policy util.FlushPolicy, openAt func(offset int64) (io.ReadCloser, error)) error {
+	var offset int64
+	if progress := readTransferProgress(dir); progress != nil && progress.File == fileName && progress.Source == source {
+		if progress.Version == version && progress.Size == size {
+			offset = progress.Written
+		} else {
+			klog.Warningf("The version of %s changed from %s to %s, restarting the transfer", source, progress.Version, version)
+		}
+	}
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "could not open file %q", fileName)
+	}
+	defer file.Close()
+	// The data written after the last recorded sync is discarded, the holes of the skipped zeroes are restored.
+	if err := file.Truncate(offset); err != nil {
+		return errors.Wrapf(err, "unable to truncate %s", fileName)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "unable to seek in %s", fileName)
+	}
+	if offset > 0 {
+		klog.Infof("Resuming the transfer of %s at offset %d of %d", source, offset, size)
+		resumed, err := openAt(offset)
+		if err != nil {
+			return err
+		}
+		defer resumed.Close()
+		reader = resumed
+	}
+	progress := &transferProgress{Source: source, Version: version, Size: size, File: fileName, Written: offset}
+	if err := progress.write(dir); err != nil {
+		return err
+	}
+	writer := &progressWriter{sparse: util.NewSparseWriterAt(file, offset), progress: progress, dir: dir}
+	if _, err := io.Copy(util.NewFlushWriter(writer, policy), reader); err != nil {
+		return errors.Wrap(err, "unable to write to file")
+	}
+	if err := writer.sparse.Finish(); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return errors.Wrapf(err, "unable to sync %s", fileName)
+	}
+	return removeTransferProgress(dir)
+}
+
+// progressWriter writes sparsely to the temp file of a resumable transfer, and records the bytes written at each
+// sync.
+type progressWriter struct {
+	sparse   *util.SparseWriter
+	progress *transferProgress
+	dir      string
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.sparse.Write(p)
+	w.progress.Written += int64(n)
+	return n, err
+}
+
+func (w *progressWriter) Sync() error {
+	if err := w.sparse.Sync(); err != nil {
+		return err
+	}
+	return w.progress.write(w.dir)
+}
@@ -0,0 +1,111 @@
+package importer
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go/aws"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"kubevirt.io/containerized-data-importer/pkg/util"
+)
+
+var _ = Describe("Transfer resume", func() {
+	var (
+		tmpDir string
+		resume bool
+		// transferred is the content of the temp file of the last successful transfer.
+		transferred []byte
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "resume")
+		Expect(err).NotTo(HaveOccurred())
+		resume = true
+	})
+
+	AfterEach(func() {
+		newClientFunc = getS3Client
+		os.RemoveAll(tmpDir)
+	})
+
+	// transfer runs the transfer of an importer reading the object from client, the data source is closed once the
+	// temp file is read.
+	transfer := func(client *rangedMockS3Client) error {
+		newClientFunc = func(endpoint, accKey, secKey string, certDir string, options s3ClientOptions) (S3Client, error) {
+			return client, nil
+		}
+		sd, err := NewS3DataSourceWithOptions("http://amazon.com/bucket/cirros.qcow2", "", "", "", S3Options{TransferResume: resume})
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		// The progress is recorded at each sync.
+		sd.setFlushPolicy(util.FlushPolicy{Mode: util.FlushPerWrite})
+		result, err := sd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseTransferScratch))
+		if _, err = sd.Transfer(tmpDir); err != nil {
+			return err
+		}
+		transferred, err = ioutil.ReadFile(filepath.Join(tmpDir, tempFile))
+		return err
+	}
+
+	It("should resume the transfer interrupted by a previous importer", func() {
+		half := len(cirrosData) / 2
+		first := &rangedMockS3Client{data: cirrosData, limit: half}
+		Expect(transfer(first)).To(HaveOccurred())
+		progress := readTransferProgress(tmpDir)
+		Expect(progress).NotTo(BeNil())
+		Expect(progress.Source).To(Equal("http://amazon.com/bucket/cirros.qcow2"))
+		Expect(progress.Version).To(Equal("\"etag-1\""))
+		Expect(progress.File).To(Equal(filepath.Join(tmpDir, tempFile)))
+		Expect(progress.Written).To(BeEquivalentTo(half))
+
+		second := &rangedMockS3Client{data: cirrosData, limit: len(cirrosData)}
+		Expect(transfer(second)).To(Succeed())
+		Expect(second.inputs).To(HaveLen(2))
+		Expect(second.inputs[1].Range).To(Equal(aws.String(fmt.Sprintf("bytes=%d-", half))))
+		Expect(second.inputs[1].IfMatch).To(Equal(aws.String("\"etag-1\"")))
+		Expect(bytes.Equal(transferred, cirrosData)).To(BeTrue())
+		Expect(readTransferProgress(tmpDir)).To(BeNil())
+	})
+
+	It("should restart the transfer of a changed object", func() {
+		first := &rangedMockS3Client{data: cirrosData, limit: len(cirrosData) / 2}
+		Expect(transfer(first)).To(HaveOccurred())
+		Expect(readTransferProgress(tmpDir)).NotTo(BeNil())
+
+		second := &rangedMockS3Client{data: cirrosData, limit: len(cirrosData), etag: "\"etag-2\""}
+		Expect(transfer(second)).To(Succeed())
+		Expect(second.inputs).To(HaveLen(1))
+		Expect(second.inputs[0].Range).To(BeNil())
+		Expect(bytes.Equal(transferred, cirrosData)).To(BeTrue())
+	})
+
+	It("should not record the progress without resume", func() {
+		resume = false
+		first := &rangedMockS3Client{data: cirrosData, limit: len(cirrosData) / 2}
+		Expect(transfer(first)).To(HaveOccurred())
+		Expect(readTransferProgress(tmpDir)).To(BeNil())
+	})
+
+	It("should keep the interrupted transfer in scratch space", func() {
+		first := &rangedMockS3Client{data: cirrosData, limit: len(cirrosData) / 2}
+		Expect(transfer(first)).To(HaveOccurred())
+		dp := NewDataProcessor(&MockDataProvider{}, filepath.Join(tmpDir, "disk.img"), tmpDir, tmpDir, "", 0.055, false)
+		dp.cleanScratchSpace()
+		Expect(readTransferProgress(tmpDir)).NotTo(BeNil())
+
+		Expect(ioutil.WriteFile(filepath.Join(tmpDir, "leftover"), []byte("data"), 0644)).To(Succeed())
+		Expect(cleanDirExcept(tmpDir, transferProgressFile, tempFile)).To(Succeed())
+		files, err := ioutil.ReadDir(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(2))
+		Expect(readTransferProgress(tmpDir)).NotTo(BeNil())
+	})
+})
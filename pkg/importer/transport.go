@@ -21,11 +21,15 @@ import (
 	"context"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
+	"github.com/blang/semver"
 	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
 	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/oci/archive"
 	"github.com/containers/image/v5/pkg/blobinfocache"
 	"github.com/containers/image/v5/types"
@@ -36,8 +40,24 @@ import (
 
 const (
 	whFilePrefix = ".wh."
+
+	// diskLayerMediaTypePrefix is the prefix of the media types of layers holding a disk image instead of a tar
+	// archive, for instance application/vnd.kubevirt.disk.qcow2.
+	diskLayerMediaTypePrefix = "application/vnd.kubevirt.disk"
+	// diskLayerAnnotation set to "true" marks a layer holding a disk image instead of a tar archive.
+	diskLayerAnnotation = "io.kubevirt.disk"
+	// ociTitleAnnotation is the annotation holding the file name of a layer.
+	ociTitleAnnotation = "org.opencontainers.image.title"
+	// diskLayerFile is the name of the disk image of a disk layer without title annotation.
+	diskLayerFile = "disk.img"
 )
 
+// ErrRegistryUnauthorized indicates that the registry rejected the pull credentials.
+var ErrRegistryUnauthorized = errors.New("registry rejected the pull credentials")
+
+// ErrNoDiskLayer indicates that no layer of the container image holds the disk image.
+var ErrNoDiskLayer = errors.New("container image contains no disk image")
+
 func commandTimeoutContext() (context.Context, context.CancelFunc) {
 	return context.WithCancel(context.Background())
 }
@@ -73,7 +93,7 @@ func readImageSource(ctx context.Context, sys *types.SystemContext, img string)
 	src, err := ref.NewImageSource(ctx, sys)
 	if err != nil {
 		klog.Errorf("Could not create image reference: %v", err)
-		return nil, errors.Wrap(err, "Could not create image reference")
+		return nil, wrapRegistryError(err, "Could not create image reference")
 	}
 
 	return src, nil
@@ -93,6 +113,79 @@ func parseImageName(img string) (types.ImageReference, error) {
 	return nil, errors.Errorf(`Invalid image name "%s", unknown transport`, img)
 }
 
+// latestRegistryTag returns the highest semver tag of the repository of the docker url that is in versionRange.
+// Tags that aren't semver are skipped.
+func latestRegistryTag(url string, versionRange semver.Range, accessKey, secKey, certDir string, insecureRegistry bool) (string, error) {
+	if !strings.HasPrefix(url, "docker://") {
+		return "", errors.Errorf("Tag selection requires a docker:// image name, got %q", url)
+	}
+	named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(url, "docker://"))
+	if err != nil {
+		return "", errors.Wrap(err, "Could not parse image")
+	}
+	if !reference.IsNameOnly(named) {
+		return "", errors.Errorf("Tag selection requires an image name without tag or digest, got %q", url)
+	}
+	ref, err := parseImageName(url)
+	if err != nil {
+		return "", errors.Wrap(err, "Could not parse image")
+	}
+
+	ctx, cancel := commandTimeoutContext()
+	defer cancel()
+	tags, err := docker.GetRepositoryTags(ctx, buildSourceContext(accessKey, secKey, certDir, insecureRegistry), ref)
+	if err != nil {
+		klog.Errorf("Could not list tags: %v", err)
+		return "", wrapRegistryError(err, "Could not list tags")
+	}
+
+	latestTag := ""
+	var latest semver.Version
+	for _, tag := range tags {
+		version, err := semver.ParseTolerant(tag)
+		if err != nil {
+			klog.V(3).Infof("Skipping tag %q, not a semantic version", tag)
+			continue
+		}
+		if versionRange(version) && (latestTag == "" || version.GT(latest)) {
+			latestTag = tag
+			latest = version
+		}
+	}
+	if latestTag == "" {
+		return "", errors.Errorf("None of the %d tags of %q matches the version constraint", len(tags), url)
+	}
+	klog.Infof("Selected tag %q out of %d tags", latestTag, len(tags))
+	return latestTag, nil
+}
+
+// registryAuthErrorCodes are the error codes of the registry API rejecting the credentials, the errors of the API
+// start with their code.
+var registryAuthErrorCodes = []string{"unauthorized", "denied"}
+
+// isRegistryUnauthorized returns true if err reports that the registry rejected the credentials.
+func isRegistryUnauthorized(err error) bool {
+	cause := errors.Cause(err)
+	if _, ok := cause.(docker.ErrUnauthorizedForCredentials); ok {
+		return true
+	}
+	message := cause.Error()
+	for _, code := range registryAuthErrorCodes {
+		if message == code || strings.HasPrefix(message, code+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// wrapRegistryError wraps err with message, as ErrRegistryUnauthorized if the registry rejected the credentials.
+func wrapRegistryError(err error, message string) error {
+	if isRegistryUnauthorized(err) {
+		return errors.Wrapf(ErrRegistryUnauthorized, "%s: %v", message, err)
+	}
+	return errors.Wrap(err, message)
+}
+
 func closeImage(src types.ImageSource) {
 	if err := src.Close(); err != nil {
 		klog.Warningf("Could not close image source: %v ", err)
@@ -112,6 +205,76 @@ func isDir(path string) bool {
 	return strings.HasSuffix(path, "/")
 }
 
+// registryImageInfo describes the registry image a file was extracted from.
+type registryImageInfo struct {
+	// digest of the image manifest
+	digest string
+	// size of the layer the file was extracted from
+	layerSize int64
+	// compression of the layer the file was extracted from
+	layerCompression string
+	// name of the first extracted file in the layer
+	member string
+	// the file is a disk layer, not a member of a tar archive
+	diskLayer bool
+}
+
+// isDiskLayer returns true if the layer holds a disk image instead of a tar archive.
+func isDiskLayer(layer types.BlobInfo) bool {
+	return strings.HasPrefix(layer.MediaType, diskLayerMediaTypePrefix) || layer.Annotations[diskLayerAnnotation] == "true"
+}
+
+// diskLayerFileName returns the path of the disk image of a disk layer in the container image, the title of the layer
+// in the container disk image directory.
+func diskLayerFileName(layer types.BlobInfo) string {
+	name := filepath.Base(layer.Annotations[ociTitleAnnotation])
+	if name == "." || name == "/" || name == ".." {
+		name = diskLayerFile
+	}
+	return path.Join(containerDiskImageDir, name)
+}
+
+// processDiskLayer copies the disk image of a disk layer to destDir, if its path in the container image has pathPrefix.
+func processDiskLayer(ctx context.Context,
+	src types.ImageSource,
+	layer types.BlobInfo,
+	destDir string,
+	pathPrefix string,
+	cache types.BlobInfoCache,
+	info *registryImageInfo) (bool, error) {
+
+	name := diskLayerFileName(layer)
+	if !hasPrefix(name, pathPrefix) {
+		return false, nil
+	}
+	reader, size, err := src.GetBlob(ctx, layer, cache)
+	if err != nil {
+		klog.Errorf("Could not read layer: %v", err)
+		return false, wrapRegistryError(err, "Could not read layer")
+	}
+	fr, err := NewFormatReaders(reader, 0)
+	if err != nil {
+		return false, errors.Wrap(err, "Could not read layer")
+	}
+	defer fr.Close()
+
+	klog.Infof("Disk layer found, copying it to '%v'", name)
+	destFile := filepath.Join(destDir, name)
+	if err = os.MkdirAll(filepath.Dir(destFile), os.ModePerm); err != nil {
+		klog.Errorf("Error creating output file's directory: %v", err)
+		return false, errors.Wrap(err, "Error creating output file's directory")
+	}
+	if err := util.StreamDataToFile(fr.TopReader(), destFile); err != nil {
+		klog.Errorf("Error copying file: %v", err)
+		return false, errors.Wrap(err, "Error copying file")
+	}
+	info.layerSize = size
+	info.layerCompression = compressionFormat(fr)
+	info.member = name
+	info.diskLayer = true
+	return true, nil
+}
+
 func processLayer(ctx context.Context,
 	sys *types.SystemContext,
 	src types.ImageSource,
@@ -119,10 +282,11 @@ func processLayer(ctx context.Context,
 	destDir string,
 	pathPrefix string,
 	cache types.BlobInfoCache,
-	stopAtFirst bool) (bool, error) {
+	stopAtFirst bool,
+	info *registryImageInfo) (bool, error) {
 
 	var reader io.ReadCloser
-	reader, _, err := src.GetBlob(ctx, layer, cache)
+	reader, size, err := src.GetBlob(ctx, layer, cache)
 	if err != nil {
 		klog.Errorf("Could not read layer: %v", err)
 		return false, errors.Wrap(err, "Could not read layer")
@@ -159,6 +323,11 @@ func processLayer(ctx context.Context,
 				return false, errors.Wrap(err, "Error copying file")
 			}
 
+			if !found {
+				info.layerSize = size
+				info.layerCompression = compressionFormat(fr)
+				info.member = hdr.Name
+			}
 			found = true
 			if stopAtFirst {
 				return found, nil
@@ -169,7 +338,7 @@ func processLayer(ctx context.Context,
 	return found, nil
 }
 
-func copyRegistryImage(url, destDir, pathPrefix, accessKey, secKey, certDir string, insecureRegistry, stopAtFirst bool) error {
+func copyRegistryImage(url, destDir, pathPrefix, accessKey, secKey, certDir string, insecureRegistry, stopAtFirst bool) (*registryImageInfo, error) {
 	klog.Infof("Downloading image from '%v', copying file from '%v' to '%v'", url, pathPrefix, destDir)
 
 	ctx, cancel := commandTimeoutContext()
@@ -178,17 +347,28 @@ func copyRegistryImage(url, destDir, pathPrefix, accessKey, secKey, certDir stri
 
 	src, err := readImageSource(ctx, srcCtx, url)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer closeImage(src)
 
 	imgCloser, err := image.FromSource(ctx, srcCtx, src)
 	if err != nil {
 		klog.Errorf("Error retrieving image: %v", err)
-		return errors.Wrap(err, "Error retrieving image")
+		return nil, wrapRegistryError(err, "Error retrieving image")
 	}
 	defer imgCloser.Close()
 
+	info := &registryImageInfo{}
+	manifestBytes, _, err := imgCloser.Manifest(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error retrieving image manifest")
+	}
+	digest, err := manifest.Digest(manifestBytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error computing image manifest digest")
+	}
+	info.digest = digest.String()
+
 	cache := blobinfocache.DefaultCache(srcCtx)
 	found := false
 	layers := imgCloser.LayerInfos()
@@ -196,7 +376,14 @@ func copyRegistryImage(url, destDir, pathPrefix, accessKey, secKey, certDir stri
 	for _, layer := range layers {
 		klog.Infof("Processing layer %+v", layer)
 
-		found, err = processLayer(ctx, srcCtx, src, layer, destDir, pathPrefix, cache, stopAtFirst)
+		if isDiskLayer(layer) {
+			found, err = processDiskLayer(ctx, src, layer, destDir, pathPrefix, cache, info)
+		} else {
+			found, err = processLayer(ctx, srcCtx, src, layer, destDir, pathPrefix, cache, stopAtFirst, info)
+		}
+		if errors.Cause(err) == ErrRegistryUnauthorized {
+			return nil, err
+		}
 		if found {
 			break
 		}
@@ -209,10 +396,10 @@ func copyRegistryImage(url, destDir, pathPrefix, accessKey, secKey, certDir stri
 
 	if !found {
 		klog.Errorf("Failed to find VM disk image file in the container image")
-		return errors.New("Failed to find VM disk image file in the container image")
+		return nil, errors.Wrapf(ErrNoDiskLayer, "no layer of %s contains %s", url, pathPrefix)
 	}
 
-	return nil
+	return info, nil
 }
 
 // CopyRegistryImage download image from registry with docker image API. It will extract first file under the pathPrefix
@@ -224,7 +411,8 @@ func copyRegistryImage(url, destDir, pathPrefix, accessKey, secKey, certDir stri
 // certDir: directory public CA keys are stored for registry identity verification
 // insecureRegistry: boolean if true will allow insecure registries.
 func CopyRegistryImage(url, destDir, pathPrefix, accessKey, secKey, certDir string, insecureRegistry bool) error {
-	return copyRegistryImage(url, destDir, pathPrefix, accessKey, secKey, certDir, insecureRegistry, true)
+	_, err := copyRegistryImage(url, destDir, pathPrefix, accessKey, secKey, certDir, insecureRegistry, true)
+	return err
 }
 
 // CopyRegistryImageAll download image from registry with docker image API. It will extract all files under the pathPrefix
@@ -236,5 +424,6 @@ func CopyRegistryImage(url, destDir, pathPrefix, accessKey, secKey, certDir stri
 // certDir: directory public CA keys are stored for registry identity verification
 // insecureRegistry: boolean if true will allow insecure registries.
 func CopyRegistryImageAll(url, destDir, pathPrefix, accessKey, secKey, certDir string, insecureRegistry bool) error {
-	return copyRegistryImage(url, destDir, pathPrefix, accessKey, secKey, certDir, insecureRegistry, false)
+	_, err := copyRegistryImage(url, destDir, pathPrefix, accessKey, secKey, certDir, insecureRegistry, false)
+	return err
 }
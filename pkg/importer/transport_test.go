@@ -16,12 +16,22 @@ limitations under the License.
 package importer
 
 import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"github.com/blang/semver"
 
 	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
 )
 
 var _ = Describe("Registry Importer", func() {
@@ -69,3 +79,215 @@ var _ = Describe("Registry Importer", func() {
 		Expect(err).To(HaveOccurred())
 	})
 })
+
+var _ = Describe("Registry tag selection", func() {
+	var ts *httptest.Server
+
+	BeforeEach(func() {
+		// A registry serving the tags of images/disk on two pages.
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/v2/":
+				w.WriteHeader(http.StatusOK)
+			case r.URL.Path == "/v2/images/disk/tags/list" && r.URL.Query().Get("last") == "":
+				w.Header().Set("Link", `</v2/images/disk/tags/list?n=3&last=v1.2.0>; rel="next"`)
+				json.NewEncoder(w).Encode(map[string]interface{}{"name": "images/disk", "tags": []string{"1.0.0", "latest", "v1.2.0"}})
+			case r.URL.Path == "/v2/images/disk/tags/list" && r.URL.Query().Get("last") == "v1.2.0":
+				json.NewEncoder(w).Encode(map[string]interface{}{"name": "images/disk", "tags": []string{"2.0.0", "1.10.1", "1.11.0-rc.1", "nightly"}})
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	table.DescribeTable("latestRegistryTag should select", func(constraint, want string) {
+		url := "docker://" + strings.TrimPrefix(ts.URL, "http://") + "/images/disk"
+		tag, err := latestRegistryTag(url, semver.MustParseRange(constraint), "", "", "", true)
+		if want == "" {
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("None of the 7 tags"))
+		} else {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tag).To(Equal(want))
+		}
+	},
+		table.Entry("the highest version across pages", ">=1.0.0", "2.0.0"),
+		table.Entry("the highest version in the range", ">=1.0.0 <2.0.0", "1.11.0-rc.1"),
+		table.Entry("the highest release in the range", ">=1.0.0 <1.11.0-0", "1.10.1"),
+		table.Entry("a tag with a v prefix", "<1.10.0 >1.0.0", "v1.2.0"),
+		table.Entry("nothing if no tag is in the range", ">=3.0.0", ""),
+	)
+
+	It("latestRegistryTag should reject image names with a tag", func() {
+		url := "docker://" + strings.TrimPrefix(ts.URL, "http://") + "/images/disk:latest"
+		_, err := latestRegistryTag(url, semver.MustParseRange(">=1.0.0"), "", "", "", true)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("without tag or digest"))
+	})
+
+	It("latestRegistryTag should reject other transports", func() {
+		_, err := latestRegistryTag("oci-archive:"+imageFile, semver.MustParseRange(">=1.0.0"), "", "", "", true)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("NewRegistryDataSourceWithOptions should reject an invalid tag constraint", func() {
+		endpoint := "docker://example.com/images/disk"
+		_, err := NewRegistryDataSourceWithOptions(endpoint, "", "", "", RegistryOptions{TagConstraint: "newest"})
+		Expect(err).To(HaveOccurred())
+		ds, err := NewRegistryDataSourceWithOptions(endpoint, "", "", "", RegistryOptions{TagConstraint: ">=1.0.0"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ds.tagConstraint).NotTo(BeNil())
+		ds, err = NewRegistryDataSourceWithOptions(endpoint, "", "", "", RegistryOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ds.tagConstraint).To(BeNil())
+	})
+})
+
+// registryLayer is a layer of the image served by a fake registry.
+type registryLayer struct {
+	mediaType   string
+	annotations map[string]string
+	data        []byte
+}
+
+// newFakeRegistry returns a registry serving images/disk:latest as an OCI image of the layers.
+func newFakeRegistry(layers ...registryLayer) *httptest.Server {
+	blobs := map[string][]byte{}
+	addBlob := func(data []byte) string {
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+		blobs[digest] = data
+		return digest
+	}
+	config := []byte("{}")
+	descriptors := []map[string]interface{}{}
+	for _, layer := range layers {
+		descriptors = append(descriptors, map[string]interface{}{
+			"mediaType":   layer.mediaType,
+			"digest":      addBlob(layer.data),
+			"size":        len(layer.data),
+			"annotations": layer.annotations,
+		})
+	}
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"config":        map[string]interface{}{"mediaType": "application/vnd.oci.image.config.v1+json", "digest": addBlob(config), "size": len(config)},
+		"layers":        descriptors,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case r.URL.Path == "/v2/images/disk/manifests/latest":
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Write(manifest)
+		case strings.HasPrefix(r.URL.Path, "/v2/images/disk/blobs/"):
+			data, ok := blobs[strings.TrimPrefix(r.URL.Path, "/v2/images/disk/blobs/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+var _ = Describe("Registry disk layers", func() {
+	var (
+		ts     *httptest.Server
+		tmpDir string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "scratch")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		if ts != nil {
+			ts.Close()
+			ts = nil
+		}
+		os.RemoveAll(tmpDir)
+	})
+
+	endpoint := func() string {
+		return "docker://" + strings.TrimPrefix(ts.URL, "http://") + "/images/disk:latest"
+	}
+
+	table.DescribeTable("should import the disk image of a layer marked by", func(layer registryLayer, file string) {
+		ts = newFakeRegistry(layer)
+		ds := NewRegistryDataSource(endpoint(), "", "", "", true)
+		result, err := ds.Transfer(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseConvert))
+		Expect(ds.GetURL().String()).To(Equal(filepath.Join(tmpDir, containerDiskImageDir, file)))
+		data, err := ioutil.ReadFile(ds.GetURL().String())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(Equal(cirrosData))
+
+		manifest := newImportManifest()
+		ds.addToManifest(manifest)
+		Expect(manifest.Transforms).To(BeEmpty())
+	},
+		table.Entry("its media type", registryLayer{mediaType: "application/vnd.kubevirt.disk.qcow2", data: cirrosData}, "disk.img"),
+		table.Entry("an annotation", registryLayer{
+			mediaType:   "application/octet-stream",
+			annotations: map[string]string{"io.kubevirt.disk": "true", "org.opencontainers.image.title": "cirros.qcow2"},
+			data:        cirrosData,
+		}, "cirros.qcow2"),
+	)
+
+	It("should decompress a compressed disk layer", func() {
+		ts = newFakeRegistry(registryLayer{mediaType: "application/vnd.kubevirt.disk.qcow2+gzip", data: gzipData(cirrosData)})
+		ds := NewRegistryDataSource(endpoint(), "", "", "", true)
+		_, err := ds.Transfer(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		data, err := ioutil.ReadFile(ds.GetURL().String())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(Equal(cirrosData))
+		manifest := newImportManifest()
+		ds.addToManifest(manifest)
+		Expect(manifest.Transforms).To(Equal([]ImportManifestTransform{{Type: ManifestTransformDecompress, Format: "gz"}}))
+	})
+
+	It("should keep the disk/* convention for tar layers", func() {
+		ts = newFakeRegistry(registryLayer{
+			mediaType: "application/vnd.oci.image.layer.v1.tar",
+			data:      tarArchive(tarEntry{name: "disk/"}, tarEntry{name: "disk/cirros.qcow2", data: cirrosData}),
+		})
+		ds := NewRegistryDataSource(endpoint(), "", "", "", true)
+		_, err := ds.Transfer(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ds.GetURL().String()).To(Equal(filepath.Join(tmpDir, containerDiskImageDir, "cirros.qcow2")))
+	})
+
+	It("should fail with ErrNoDiskLayer without disk image", func() {
+		ts = newFakeRegistry(registryLayer{
+			mediaType: "application/vnd.oci.image.layer.v1.tar",
+			data:      tarArchive(tarEntry{name: "etc/hosts", data: []byte("127.0.0.1 localhost")}),
+		})
+		ds := NewRegistryDataSource(endpoint(), "", "", "", true)
+		_, err := ds.Transfer(tmpDir)
+		Expect(errors.Cause(err)).To(Equal(ErrNoDiskLayer))
+	})
+
+	It("should fail with ErrRegistryUnauthorized when the registry rejects the credentials", func() {
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`))
+		}))
+		ds := NewRegistryDataSource(endpoint(), "user", "wrong", "", true)
+		_, err := ds.Transfer(tmpDir)
+		Expect(errors.Cause(err)).To(Equal(ErrRegistryUnauthorized))
+	})
+})
@@ -17,6 +17,9 @@ import (
 // 2a. ProcessingPhaseTransferScratch -> ProcessingPhaseConvert
 // 2b. ProcessingPhaseTransferDataFile -> ProcessingPhaseResize
 type UploadDataSource struct {
+	sourceSizeLimits
+	sourceVerification
+	sourceStreamOptions
 	// Data strean
 	stream io.ReadCloser
 	// stack of readers
@@ -36,7 +39,7 @@ func NewUploadDataSource(stream io.ReadCloser) *UploadDataSource {
 func (ud *UploadDataSource) Info() (ProcessingPhase, error) {
 	var err error
 	// Hardcoded to only accept kubevirt content type.
-	ud.readers, err = NewFormatReaders(ud.stream, uint64(0))
+	ud.readers, err = newFormatReaders(ud.stream, uint64(0), ud.sourceSizeLimits, ud.sourceVerification)
 	if err != nil {
 		klog.Errorf("Error creating readers: %v", err)
 		return ProcessingPhaseError, err
@@ -59,7 +62,8 @@ func (ud *UploadDataSource) Transfer(path string) (ProcessingPhase, error) {
 		return ProcessingPhaseError, ErrInvalidPath
 	}
 	file := filepath.Join(path, tempFile)
-	err = util.StreamDataToFile(ud.readers.TopReader(), file)
+	ud.readers.StartProgressUpdate()
+	err = util.StreamDataToFileWithSize(ud.readers.TopReader(), file, -1, ud.streamOptions())
 	if err != nil {
 		return ProcessingPhaseError, err
 	}
@@ -70,7 +74,8 @@ func (ud *UploadDataSource) Transfer(path string) (ProcessingPhase, error) {
 
 // TransferFile is called to transfer the data from the source to the passed in file.
 func (ud *UploadDataSource) TransferFile(fileName string) (ProcessingPhase, error) {
-	err := util.StreamDataToFile(ud.readers.TopReader(), fileName)
+	ud.readers.StartProgressUpdate()
+	err := util.StreamDataToFileWithSize(ud.readers.TopReader(), fileName, -1, ud.streamOptions())
 	if err != nil {
 		return ProcessingPhaseError, err
 	}
@@ -84,8 +89,23 @@ func (ud *UploadDataSource) GetURL() *url.URL {
 	return ud.url
 }
 
+func (ud *UploadDataSource) sourceDigest() (string, error) {
+	return ud.readers.sourceDigest()
+}
+
+func (ud *UploadDataSource) verifySourceSignature() error {
+	return ud.readers.verifySourceSignature()
+}
+
+func (ud *UploadDataSource) formatReaders() *FormatReaders {
+	return ud.readers
+}
+
 // Close closes any readers or other open resources.
 func (ud *UploadDataSource) Close() error {
+	if ud.readers != nil {
+		ud.readers.stopProgressUpdate()
+	}
 	if ud.stream != nil {
 		return ud.stream.Close()
 	}
@@ -126,7 +146,8 @@ func (aud *AsyncUploadDataSource) Transfer(path string) (ProcessingPhase, error)
 		return ProcessingPhaseError, ErrInvalidPath
 	}
 	file := filepath.Join(path, tempFile)
-	err = util.StreamDataToFile(aud.uploadDataSource.readers.TopReader(), file)
+	aud.uploadDataSource.readers.StartProgressUpdate()
+	err = util.StreamDataToFileWithSize(aud.uploadDataSource.readers.TopReader(), file, -1, aud.uploadDataSource.streamOptions())
 	if err != nil {
 		return ProcessingPhaseError, err
 	}
@@ -138,7 +159,8 @@ func (aud *AsyncUploadDataSource) Transfer(path string) (ProcessingPhase, error)
 
 // TransferFile is called to transfer the data from the source to the passed in file.
 func (aud *AsyncUploadDataSource) TransferFile(fileName string) (ProcessingPhase, error) {
-	err := util.StreamDataToFile(aud.uploadDataSource.readers.TopReader(), fileName)
+	aud.uploadDataSource.readers.StartProgressUpdate()
+	err := util.StreamDataToFileWithSize(aud.uploadDataSource.readers.TopReader(), fileName, -1, aud.uploadDataSource.streamOptions())
 	if err != nil {
 		return ProcessingPhaseError, err
 	}
@@ -148,6 +170,10 @@ func (aud *AsyncUploadDataSource) TransferFile(fileName string) (ProcessingPhase
 	return ProcessingPhaseValidatePause, nil
 }
 
+func (aud *AsyncUploadDataSource) formatReaders() *FormatReaders {
+	return aud.uploadDataSource.readers
+}
+
 // Close closes any readers or other open resources.
 func (aud *AsyncUploadDataSource) Close() error {
 	return aud.uploadDataSource.Close()
@@ -46,6 +46,30 @@ func CleanDir(dest string) error {
 	return nil
 }
 
+// cleanDirExcept cleans the contents of a directory like CleanDir, except the files named keep.
+func cleanDirExcept(dest string, keep ...string) error {
+	dir, err := ioutil.ReadDir(dest)
+	if err != nil {
+		klog.Errorf("Unable read directory to clean: %s, %v", dest, err)
+		return err
+	}
+	kept := make(map[string]bool, len(keep))
+	for _, name := range keep {
+		kept[name] = true
+	}
+	for _, d := range dir {
+		if kept[d.Name()] {
+			continue
+		}
+		klog.V(1).Infoln("deleting file: " + filepath.Join(dest, d.Name()))
+		if err = os.RemoveAll(filepath.Join(dest, d.Name())); err != nil {
+			klog.Errorf("Unable to delete file: %s, %v", filepath.Join(dest, d.Name()), err)
+			return err
+		}
+	}
+	return nil
+}
+
 // GetTerminationChannel returns a channel that listens for SIGTERM
 func GetTerminationChannel() <-chan os.Signal {
 	terminationChannel := make(chan os.Signal, 1)
@@ -55,3 +79,31 @@ func GetTerminationChannel() <-chan os.Signal {
 
 // newTerminationChannel should be overriden for unit tests
 var newTerminationChannel = GetTerminationChannel
+
+// may be overridden in tests
+var getAvailableInodesFunc = util.GetAvailableInodes
+
+// ErrInsufficientInodes indicates that the filesystem doesn't have enough free inodes to extract an archive.
+var ErrInsufficientInodes = errors.New("not enough free inodes to extract the archive")
+
+// checkFreeInodes fails if the filesystem of path has less free inodes than the number of entries expected in an
+// archive extracted to path. Checking before extracting avoids failing midway once the filesystem runs out of inodes
+// while space is left. No check is done if entries isn't positive.
+func checkFreeInodes(path string, entries int64) error {
+	if entries <= 0 {
+		return nil
+	}
+	inodes, err := getAvailableInodesFunc(path)
+	if err != nil {
+		return errors.Wrapf(err, "unable to get the free inodes of %s", path)
+	}
+	if inodes < 0 {
+		klog.V(1).Infof("The filesystem of %s has no inode limit", path)
+		return nil
+	}
+	klog.V(1).Infof("The filesystem of %s has %d free inodes, the archive has %d entries", path, inodes, entries)
+	if inodes < entries {
+		return errors.Wrapf(ErrInsufficientInodes, "%s has %d free inodes, %d required", path, inodes, entries)
+	}
+	return nil
+}
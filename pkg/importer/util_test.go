@@ -7,10 +7,12 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	. "github.com/onsi/ginkgo"
 	"github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
 
 	"kubevirt.io/containerized-data-importer/pkg/common"
 	"kubevirt.io/containerized-data-importer/pkg/util"
@@ -121,6 +123,28 @@ var _ = Describe("Clean dir", func() {
 	})
 })
 
+var _ = Describe("Check free inodes", func() {
+	table.DescribeTable("should", func(inodes int64, inodesErr error, entries int64, expectedErr error) {
+		origFunc := getAvailableInodesFunc
+		defer func() { getAvailableInodesFunc = origFunc }()
+		getAvailableInodesFunc = func(path string) (int64, error) {
+			return inodes, inodesErr
+		}
+		err := checkFreeInodes("/scratch", entries)
+		if expectedErr == nil {
+			Expect(err).NotTo(HaveOccurred())
+		} else {
+			Expect(errors.Cause(err)).To(Equal(expectedErr))
+		}
+	},
+		table.Entry("succeed with enough free inodes", int64(1000), nil, int64(1000), nil),
+		table.Entry("fail with less free inodes than entries", int64(10), nil, int64(1000), ErrInsufficientInodes),
+		table.Entry("succeed without inode limit", int64(-1), nil, int64(1000), nil),
+		table.Entry("succeed without expected entries", int64(0), nil, int64(0), nil),
+		table.Entry("fail if statfs fails", int64(-1), syscall.ENOENT, int64(1000), syscall.ENOENT),
+	)
+})
+
 // For use in transfer cancellation unit tests, currently VDDK/ImageIO
 var mockTerminationChannel chan os.Signal
 
@@ -729,6 +729,28 @@ func NewVDDKDataSource(endpoint string, accessKey string, secKey string, thumbpr
 	return newVddkDataSource(endpoint, accessKey, secKey, thumbprint, uuid, backingFile, currentCheckpoint, previousCheckpoint, finalCheckpoint, volumeMode)
 }
 
+// VDDKOptions are the options of the vddk data provider.
+type VDDKOptions struct {
+	// Thumbprint is the SHA1 thumbprint of the certificate of the vCenter or ESX host.
+	Thumbprint string
+	// UUID is the UUID of the virtual machine.
+	UUID string
+	// BackingFile is the disk file of the virtual machine to import.
+	BackingFile string
+	// CurrentCheckpoint, PreviousCheckpoint and FinalCheckpoint are the snapshots of a warm import, empty for a cold
+	// import.
+	CurrentCheckpoint  string
+	PreviousCheckpoint string
+	FinalCheckpoint    string
+	// VolumeMode is the volume mode of the target PVC.
+	VolumeMode v1.PersistentVolumeMode
+}
+
+// NewVDDKDataSourceWithOptions creates a new instance of the vddk data provider with options.
+func NewVDDKDataSourceWithOptions(endpoint, accessKey, secKey string, options VDDKOptions) (*VDDKDataSource, error) {
+	return newVddkDataSource(endpoint, accessKey, secKey, options.Thumbprint, options.UUID, options.BackingFile, options.CurrentCheckpoint, options.PreviousCheckpoint, options.FinalCheckpoint, options.VolumeMode)
+}
+
 func createVddkDataSource(endpoint string, accessKey string, secKey string, thumbprint string, uuid string, backingFile string, currentCheckpoint string, previousCheckpoint string, finalCheckpoint string, volumeMode v1.PersistentVolumeMode) (*VDDKDataSource, error) {
 	klog.Infof("Creating VDDK data source: backingFile [%s], currentCheckpoint [%s], previousCheckpoint [%s], finalCheckpoint [%s]", backingFile, currentCheckpoint, previousCheckpoint, finalCheckpoint)
 
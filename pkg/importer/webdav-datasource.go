@@ -0,0 +1,407 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+
+	"kubevirt.io/containerized-data-importer/pkg/util"
+)
+
+const (
+	webDAVScheme  = "dav"
+	webDAVSScheme = "davs"
+	// webDAVPropfindBody asks for the properties needed to read the file, servers answer allprop requests slowly.
+	webDAVPropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:getcontentlength/><d:getetag/><d:resourcetype/></d:prop></d:propfind>`
+)
+
+// ErrWebDAVNotFound is returned when the WebDAV resource doesn't exist.
+var ErrWebDAVNotFound = errors.New("webdav resource not found")
+
+// ErrWebDAVLocked is returned when the WebDAV resource is locked, for instance while a client uploads it.
+var ErrWebDAVLocked = errors.New("webdav resource is locked")
+
+// WebDAVDataSource is the struct containing the information needed to import a file from a WebDAV server, like the
+// ones of Nextcloud and ownCloud.
+// Sequence of phases:
+// 1a. Info -> TransferScratch, if the image needs to be converted.
+// 1b. Info -> TransferDataFile, if the image is raw.
+// 2a. TransferScratch -> Convert
+// 2b. TransferDataFile -> Resize
+type WebDAVDataSource struct {
+	sourceSizeLimits
+	sourceVerification
+	sourceStreamOptions
+	// the dav or davs endpoint
+	ep *url.URL
+	// fileURL is the http or https URL of the file, without the user info.
+	fileURL  *url.URL
+	client   *http.Client
+	user     string
+	password string
+	// size is the size of the file, -1 if unknown.
+	size int64
+	// etag is the entity tag of the file, empty if unknown.
+	etag string
+	// Reader
+	davReader io.ReadCloser
+	// limits the bytes read from the file per second, nil if unlimited.
+	rateLimit *tokenBucket
+	// readRetries are the settings of resuming the failed reads of the file.
+	readRetries readRetries
+	// stack of readers
+	readers *FormatReaders
+	// fail if the virtual size of the image exceeds the capacity of the target, 0 if unknown.
+	targetCapacity int64
+	// The image file in scratch space.
+	url *url.URL
+	// header holds the extra headers of every request.
+	header http.Header
+}
+
+// WebDAVOptions are the options of the WebDAVDataSource.
+type WebDAVOptions struct {
+	// UserAgent replaces the User-Agent of the requests, DefaultUserAgent if empty.
+	UserAgent string
+	// ExtraHeaders are sent in every request after the extra headers of the environment, in the form "Name: value".
+	// The Authorization, Proxy-Authorization and Cookie headers are redacted from the logs.
+	ExtraHeaders []string
+	// PinnedSPKIHashes fail the TLS handshake of davs servers unless a certificate of the chain presented by the
+	// server has one of the pinned subject public key infos, on top of the CA validation. No pins disable pinning.
+	PinnedSPKIHashes []string
+	// RetryAfterBudget is the total time a request waits for the delays asked by the Retry-After headers of 503 and
+	// 429 responses before it is sent again, 0 disables retrying.
+	RetryAfterBudget time.Duration
+	// TargetCapacity makes Info fail if the virtual size of the image exceeds it, before transferring any data, 0
+	// disables the check.
+	TargetCapacity int64
+	// RateLimit limits the bytes read from the file per second, 0 disables the limit.
+	RateLimit int64
+	// ReadRetries is the number of times a failed or truncated read of the file is resumed with a ranged request from
+	// the offset reached, 0 disables resuming.
+	ReadRetries int
+	// ReadRetryBackoff is the delay before resuming the first time, doubled on each further attempt, 1s if 0.
+	ReadRetryBackoff time.Duration
+	SourceOptions
+}
+
+// NewWebDAVDataSource creates a new instance of the WebDAVDataSource. The endpoint is dav://host/path, read over
+// http, or davs://host/path, read over https and trusting the CAs in certDir. The user and the password, an app
+// password with Nextcloud and ownCloud, authenticate with basic authentication, the user info of the endpoint is used
+// if there is no user, and no authentication if neither.
+func NewWebDAVDataSource(endpoint, user, password, certDir string, options WebDAVOptions) (*WebDAVDataSource, error) {
+	ep, err := parseValidEndpoint(endpoint, "webdav", webDAVScheme, webDAVSScheme)
+	if err != nil {
+		return nil, err
+	}
+	fileURL := *ep
+	fileURL.Scheme = "http"
+	if ep.Scheme == webDAVSScheme {
+		fileURL.Scheme = "https"
+	}
+	if ep.Path == "" || strings.HasSuffix(ep.Path, "/") {
+		return nil, errors.Errorf("no file in %q", manifestURL(ep))
+	}
+	if user == "" && ep.User != nil {
+		user = ep.User.Username()
+		password, _ = ep.User.Password()
+	}
+	fileURL.User = nil
+	extraHeaders, secretExtraHeaders, err := requestHeaders(options.UserAgent, options.ExtraHeaders)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get extra headers")
+	}
+	header, err := parseExtraHeaders(extraHeaders, secretExtraHeaders)
+	if err != nil {
+		return nil, err
+	}
+	pins, err := parseSPKIPins(options.PinnedSPKIHashes)
+	if err != nil {
+		return nil, err
+	}
+	client, err := createHTTPClient(certDir, pins)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating http client for webdav")
+	}
+	client.Transport = newRetryAfterTransport(client.Transport, options.RetryAfterBudget)
+	return &WebDAVDataSource{
+		sourceSizeLimits:    options.sizeLimits(),
+		sourceStreamOptions: options.streamOptions(),
+		ep:                  ep,
+		fileURL:             &fileURL,
+		client:              client,
+		user:                user,
+		password:            password,
+		size:                -1,
+		rateLimit:           newRateLimit(options.RateLimit),
+		readRetries:         newReadRetries(options.ReadRetries, options.ReadRetryBackoff),
+		targetCapacity:      options.TargetCapacity,
+		header:              header,
+	}, nil
+}
+
+// Info is called to get initial information about the data.
+func (wd *WebDAVDataSource) Info() (ProcessingPhase, error) {
+	if err := wd.stat(); err != nil {
+		return ProcessingPhaseError, err
+	}
+	reader, err := wd.get(0)
+	if err != nil {
+		return ProcessingPhaseError, err
+	}
+	if wd.readRetries.enabled() {
+		// The rest of the file is read from the offset reached.
+		reader = newResumableReader(context.Background(), reader, wd.size, wd.readRetries, wd.get)
+	}
+	wd.davReader = withRateLimit(context.Background(), reader, wd.rateLimit)
+	var total uint64
+	if wd.size > 0 {
+		total = uint64(wd.size)
+	}
+	wd.readers, err = newSourceFormatReaders(wd.davReader, wd.size, wd.sourceSizeLimits, wd.sourceVerification)
+	if err != nil {
+		klog.Errorf("Error creating readers: %v", err)
+		return ProcessingPhaseError, err
+	}
+	if err = checkBackingFile(wd.readers); err != nil {
+		return ProcessingPhaseError, err
+	}
+	if err = checkTargetCapacity(wd.ep.Path, wd.readers, total, wd.targetCapacity); err != nil {
+		return ProcessingPhaseError, err
+	}
+	if !wd.readers.Convert {
+		// Downloading a raw file, we can write that directly to the target.
+		return ProcessingPhaseTransferDataFile, nil
+	}
+	return ProcessingPhaseTransferScratch, nil
+}
+
+// Transfer is called to transfer the data from the source to a temporary location.
+func (wd *WebDAVDataSource) Transfer(path string) (ProcessingPhase, error) {
+	size, _ := util.GetAvailableSpace(path)
+	if size <= int64(0) {
+		//Path provided is invalid.
+		return ProcessingPhaseError, ErrInvalidPath
+	}
+	file := filepath.Join(path, tempFile)
+	wd.readers.StartProgressUpdate()
+	err := util.StreamDataToFileWithSize(wd.readers.TopReader(), file, wd.readers.topReaderSize(wd.size), wd.streamOptions())
+	if err != nil {
+		return ProcessingPhaseError, err
+	}
+	// If streaming succeeded, then parsing the file into URL will also succeed, no need to check error status
+	wd.url, _ = url.Parse(file)
+	return ProcessingPhaseConvert, nil
+}
+
+// TransferFile is called to transfer the data from the source to the passed in file.
+func (wd *WebDAVDataSource) TransferFile(fileName string) (ProcessingPhase, error) {
+	wd.readers.StartProgressUpdate()
+	err := util.StreamDataToFileWithSize(wd.readers.TopReader(), fileName, -1, wd.streamOptions())
+	if err != nil {
+		return ProcessingPhaseError, err
+	}
+	return ProcessingPhaseResize, nil
+}
+
+// TransferToWriter is called to stream the raw image from the source to w, without scratch space.
+func (wd *WebDAVDataSource) TransferToWriter(w io.Writer) (ProcessingPhase, error) {
+	return transferToWriter(wd.readers, w)
+}
+
+// TransferToWriterAt is called to write the raw image from the source at its offsets in w, without scratch space.
+func (wd *WebDAVDataSource) TransferToWriterAt(w io.WriterAt) (ProcessingPhase, error) {
+	return transferToWriterAt(wd.readers, w)
+}
+
+// GetURL returns the url that the data processor can use when converting the data.
+func (wd *WebDAVDataSource) GetURL() *url.URL {
+	return wd.url
+}
+
+func (wd *WebDAVDataSource) sourceDigest() (string, error) {
+	return wd.readers.sourceDigest()
+}
+
+func (wd *WebDAVDataSource) verifySourceSignature() error {
+	return wd.readers.verifySourceSignature()
+}
+
+func (wd *WebDAVDataSource) probe() (*FormatReaders, int64) {
+	return wd.readers, wd.size
+}
+
+func (wd *WebDAVDataSource) addToManifest(manifest *ImportManifest) {
+	manifest.Source.URL = manifestURL(wd.ep)
+	if wd.size > 0 {
+		manifest.SourceSize = wd.size
+	}
+	manifest.addDecompress(compressionFormat(wd.readers))
+}
+
+func (wd *WebDAVDataSource) formatReaders() *FormatReaders {
+	return wd.readers
+}
+
+// Close closes any readers or other open resources.
+func (wd *WebDAVDataSource) Close() error {
+	if wd.readers != nil {
+		return wd.readers.Close()
+	}
+	if wd.davReader != nil {
+		return wd.davReader.Close()
+	}
+	return nil
+}
+
+// webDAVMultistatus is the part of a PROPFIND response the data source reads.
+type webDAVMultistatus struct {
+	Responses []struct {
+		Propstats []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				ContentLength string `xml:"DAV: getcontentlength"`
+				ETag          string `xml:"DAV: getetag"`
+				ResourceType  struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// newRequest creates a request of the file, authenticated if there is a user.
+func (wd *WebDAVDataSource) newRequest(method string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, wd.fileURL.String(), body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create webdav %s request", method)
+	}
+	addExtraHeaders(req, wd.header)
+	if wd.user != "" {
+		req.SetBasicAuth(wd.user, wd.password)
+	}
+	return req, nil
+}
+
+// stat reads the size and the entity tag of the file with a PROPFIND request, and fails if it's a collection.
+func (wd *WebDAVDataSource) stat() error {
+	req, err := wd.newRequest("PROPFIND", strings.NewReader(webDAVPropfindBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := wd.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "webdav PROPFIND of %s failed", wd.fileURL)
+	}
+	defer resp.Body.Close()
+	if err := checkWebDAVStatus(resp, http.StatusMultiStatus); err != nil {
+		return err
+	}
+	var multistatus webDAVMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil {
+		return errors.Wrapf(err, "invalid webdav PROPFIND response of %s", wd.fileURL)
+	}
+	if len(multistatus.Responses) == 0 {
+		return errors.Errorf("empty webdav PROPFIND response of %s", wd.fileURL)
+	}
+	// With a depth of 0, the only response is the one of the file.
+	for _, propstat := range multistatus.Responses[0].Propstats {
+		if fields := strings.Fields(propstat.Status); len(fields) < 2 || fields[1] != strconv.Itoa(http.StatusOK) {
+			continue
+		}
+		prop := propstat.Prop
+		if prop.ResourceType.Collection != nil {
+			return errors.Errorf("%s is a webdav collection, not a file", wd.fileURL)
+		}
+		if prop.ContentLength != "" {
+			if wd.size, err = strconv.ParseInt(strings.TrimSpace(prop.ContentLength), 10, 64); err != nil {
+				return errors.Wrapf(err, "invalid webdav content length %q", prop.ContentLength)
+			}
+		}
+		wd.etag = strings.TrimSpace(prop.ETag)
+	}
+	if wd.size < 0 {
+		klog.Warningf("Unable to get the size of %s", manifestURL(wd.fileURL))
+	}
+	klog.V(1).Infof("file %s of %d bytes, etag %s", manifestURL(wd.fileURL), wd.size, wd.etag)
+	return nil
+}
+
+// get reads the file from offset with a GET request. Reading from an offset requires the file to be unchanged, when
+// its entity tag is known.
+func (wd *WebDAVDataSource) get(offset int64) (io.ReadCloser, error) {
+	req, err := wd.newRequest("GET", nil)
+	if err != nil {
+		return nil, err
+	}
+	expected := http.StatusOK
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if wd.etag != "" && !strings.HasPrefix(wd.etag, "W/") {
+			req.Header.Set("If-Range", wd.etag)
+		}
+		expected = http.StatusPartialContent
+	}
+	resp, err := wd.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "webdav GET of %s failed", wd.fileURL)
+	}
+	if offset > 0 && resp.StatusCode == http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Errorf("%s changed or doesn't support reading from offset %d", wd.fileURL, offset)
+	}
+	if err := checkWebDAVStatus(resp, expected); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// checkWebDAVStatus returns an error if the status of resp isn't expected, wrapping ErrWebDAVNotFound or
+// ErrWebDAVLocked when the resource is missing or locked.
+func checkWebDAVStatus(resp *http.Response, expected int) error {
+	if resp.StatusCode == expected {
+		return nil
+	}
+	if err := checkHTTPUnauthorized(resp); err != nil {
+		return err
+	}
+	u := *resp.Request.URL
+	u.User = nil
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return errors.Wrapf(ErrWebDAVNotFound, "%s %s answered %s", resp.Request.Method, u.String(), resp.Status)
+	case http.StatusLocked:
+		return errors.Wrapf(ErrWebDAVLocked, "%s %s answered %s, retry once the lock is released", resp.Request.Method, u.String(), resp.Status)
+	}
+	return errors.Errorf("%s %s answered %s, expected %d", resp.Request.Method, u.String(), resp.Status, expected)
+}
@@ -0,0 +1,276 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/pkg/errors"
+
+	"kubevirt.io/containerized-data-importer/pkg/common"
+	"kubevirt.io/containerized-data-importer/pkg/util/cert"
+)
+
+// fakeWebDAVServer serves data as the file at path, answering PROPFIND requests with a multistatus of its properties.
+type fakeWebDAVServer struct {
+	data []byte
+	path string
+	// user and password are the required basic authentication, none if user is empty.
+	user     string
+	password string
+	// status fails the requests of method with the status, if set.
+	method string
+	status int
+	// collection makes path a collection.
+	collection bool
+	// truncateFirst makes the first GET end after half of the data.
+	truncateFirst bool
+	gets          int
+	ranges        []string
+	ifRanges      []string
+	// headers are the headers of the requests.
+	headers []http.Header
+}
+
+func (s *fakeWebDAVServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.headers = append(s.headers, r.Header.Clone())
+	if s.user != "" {
+		if user, password, ok := r.BasicAuth(); !ok || user != s.user || password != s.password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Nextcloud"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	if r.URL.Path != s.path {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method == s.method {
+		w.WriteHeader(s.status)
+		return
+	}
+	switch r.Method {
+	case "PROPFIND":
+		Expect(r.Header.Get("Depth")).To(Equal("0"))
+		resourceType := "<d:resourcetype/>"
+		if s.collection {
+			resourceType = "<d:resourcetype><d:collection/></d:resourcetype>"
+		}
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprintf(w, `<?xml version="1.0"?>
+<d:multistatus xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+ <d:response>
+  <d:href>%s</d:href>
+  <d:propstat>
+   <d:prop><d:getcontentlength>%d</d:getcontentlength><d:getetag>"5f3a"</d:getetag>%s</d:prop>
+   <d:status>HTTP/1.1 200 OK</d:status>
+  </d:propstat>
+  <d:propstat>
+   <d:prop><oc:checksums/></d:prop>
+   <d:status>HTTP/1.1 404 Not Found</d:status>
+  </d:propstat>
+ </d:response>
+</d:multistatus>`, s.path, len(s.data), resourceType)
+	case "GET":
+		s.gets++
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		s.ifRanges = append(s.ifRanges, r.Header.Get("If-Range"))
+		var offset int
+		if byteRange := r.Header.Get("Range"); byteRange != "" {
+			fmt.Sscanf(byteRange, "bytes=%d-", &offset)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(s.data)-1, len(s.data)))
+			w.Header().Set("Content-Length", strconv.Itoa(len(s.data)-offset))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(s.data)))
+		}
+		if s.truncateFirst && s.gets == 1 {
+			w.Write(s.data[:len(s.data)/2])
+			return
+		}
+		w.Write(s.data[offset:])
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+var _ = Describe("WebDAV data source", func() {
+	var (
+		wd     *WebDAVDataSource
+		dav    *fakeWebDAVServer
+		server *httptest.Server
+		tmpDir string
+		err    error
+	)
+
+	BeforeEach(func() {
+		dav = &fakeWebDAVServer{
+			data:     cirrosData,
+			path:     "/remote.php/dav/files/importer/images/cirros.qcow2",
+			user:     "importer",
+			password: "app-password",
+		}
+		server = httptest.NewServer(dav)
+		tmpDir, err = ioutil.TempDir("", "scratch")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		readRetrySleep = sleepWithContext
+		if wd != nil {
+			wd.Close()
+			wd = nil
+		}
+		server.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	endpoint := func(userInfo string) string {
+		return "dav://" + userInfo + server.Listener.Addr().String() + dav.path
+	}
+
+	It("should transfer a qcow2 image to scratch space", func() {
+		wd, err = NewWebDAVDataSource(endpoint(""), "importer", "app-password", "", WebDAVOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := wd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseTransferScratch))
+		Expect(wd.size).To(Equal(int64(len(cirrosData))))
+		result, err = wd.Transfer(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseConvert))
+		data, err := ioutil.ReadFile(filepath.Join(tmpDir, tempFile))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(Equal(cirrosData))
+		Expect(wd.GetURL().String()).To(Equal(filepath.Join(tmpDir, tempFile)))
+	})
+
+	It("should send the User-Agent and the extra headers with every request", func() {
+		os.Setenv(common.ImporterExtraHeader+"0", "X-Request-Source: test")
+		defer os.Unsetenv(common.ImporterExtraHeader + "0")
+		wd, err = NewWebDAVDataSource(endpoint(""), "importer", "app-password", "", WebDAVOptions{
+			UserAgent:    "custom-agent/1.0",
+			ExtraHeaders: []string{"X-Tenant: tenant1"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = wd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = wd.Transfer(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dav.headers).To(HaveLen(2))
+		for _, header := range dav.headers {
+			Expect(header.Get("User-Agent")).To(Equal("custom-agent/1.0"))
+			Expect(header.Get("X-Request-Source")).To(Equal("test"))
+			Expect(header.Get("X-Tenant")).To(Equal("tenant1"))
+		}
+	})
+
+	It("should transfer a raw image to the target with the user info of the endpoint", func() {
+		dav.data = tinyCoreData()
+		wd, err = NewWebDAVDataSource(endpoint("importer:app-password@"), "", "", "", WebDAVOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := wd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseTransferDataFile))
+		target := filepath.Join(tmpDir, "disk.img")
+		result, err = wd.TransferFile(target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseResize))
+		data, err := ioutil.ReadFile(target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(Equal(dav.data))
+
+		manifest := newImportManifest()
+		wd.addToManifest(manifest)
+		Expect(manifest.Source.URL).To(Equal(endpoint("")))
+		Expect(manifest.SourceSize).To(Equal(int64(len(dav.data))))
+	})
+
+	It("should read a davs endpoint trusting the certificates of certDir", func() {
+		tlsServer := httptest.NewTLSServer(dav)
+		defer tlsServer.Close()
+		certDir, err := ioutil.TempDir("", "webdav-certs")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(certDir)
+		Expect(ioutil.WriteFile(filepath.Join(certDir, "tls.crt"), cert.EncodeCertPEM(tlsServer.Certificate()), 0644)).To(Succeed())
+		wd, err = NewWebDAVDataSource("davs://"+tlsServer.Listener.Addr().String()+dav.path, "importer", "app-password", certDir, WebDAVOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := wd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseTransferScratch))
+		// The server waits for the body to be closed.
+		Expect(wd.Close()).To(Succeed())
+		wd = nil
+	})
+
+	It("should resume an interrupted transfer if the file is unchanged", func() {
+		readRetrySleep = func(ctx context.Context, delay time.Duration) error {
+			return nil
+		}
+		dav.truncateFirst = true
+		wd, err = NewWebDAVDataSource(endpoint(""), "importer", "app-password", "", WebDAVOptions{ReadRetries: 1, ReadRetryBackoff: time.Second})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = wd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = wd.Transfer(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		data, err := ioutil.ReadFile(filepath.Join(tmpDir, tempFile))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(Equal(cirrosData))
+		Expect(dav.ranges).To(Equal([]string{"", fmt.Sprintf("bytes=%d-", len(cirrosData)/2)}))
+		Expect(dav.ifRanges).To(Equal([]string{"", `"5f3a"`}))
+	})
+
+	It("should fail Info when the image exceeds the target capacity", func() {
+		dav.data = tinyCoreData()
+		wd, err = NewWebDAVDataSource(endpoint(""), "importer", "app-password", "", WebDAVOptions{TargetCapacity: int64(len(dav.data) - 1)})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := wd.Info()
+		Expect(err).To(HaveOccurred())
+		Expect(errors.Cause(err)).To(Equal(ErrVirtualSizeExceedsCapacity))
+		Expect(result).To(Equal(ProcessingPhaseError))
+	})
+
+	table.DescribeTable("should fail Info with", func(setup func(), user string, expected error, message string) {
+		ep := endpoint("")
+		setup()
+		wd, err = NewWebDAVDataSource(ep, user, "app-password", "", WebDAVOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := wd.Info()
+		Expect(err).To(HaveOccurred())
+		if expected != nil {
+			Expect(errors.Cause(err)).To(Equal(expected))
+		}
+		Expect(err.Error()).To(ContainSubstring(message))
+		Expect(err.Error()).NotTo(ContainSubstring("app-password"))
+		Expect(result).To(Equal(ProcessingPhaseError))
+	},
+		table.Entry("a missing file", func() { dav.path = "/remote.php/dav/files/importer/other.qcow2" }, "importer", ErrWebDAVNotFound, "PROPFIND"),
+		table.Entry("a file locked while reading it", func() { dav.method, dav.status = "GET", http.StatusLocked }, "importer", ErrWebDAVLocked, "GET"),
+		table.Entry("a locked file", func() { dav.method, dav.status = "PROPFIND", http.StatusLocked }, "importer", ErrWebDAVLocked, "423 Locked"),
+		table.Entry("a collection", func() { dav.collection = true }, "importer", nil, "is a webdav collection"),
+		table.Entry("wrong credentials", func() {}, "other", ErrHTTPAuthenticationFailed, "expects Basic credentials"),
+		table.Entry("an unexpected status", func() { dav.method, dav.status = "PROPFIND", http.StatusMethodNotAllowed }, "importer", nil, "expected 207"),
+	)
+
+	table.DescribeTable("should fail to parse", func(endpoint, expected string) {
+		wd, err = NewWebDAVDataSource(endpoint, "", "", "", WebDAVOptions{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(expected))
+	},
+		table.Entry("an endpoint without file", "dav://cloud.example.com", "no file"),
+		table.Entry("an endpoint of a directory", "davs://cloud.example.com/remote.php/dav/files/importer/", "no file"),
+		table.Entry("an unsupported scheme", "webdav://cloud.example.com/cirros.qcow2", "unsupported webdav endpoint scheme"),
+	)
+})
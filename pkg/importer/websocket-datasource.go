@@ -0,0 +1,341 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+
+	"k8s.io/klog/v2"
+
+	"kubevirt.io/containerized-data-importer/pkg/util"
+)
+
+const (
+	// wsOffsetParam is the query parameter used to ask the streaming endpoint to resume at an offset.
+	wsOffsetParam = "offset"
+	// wsMaxReconnects is the number of times we attempt to reconnect after the connection dropped.
+	wsMaxReconnects = 5
+)
+
+// WebSocketHeader is the JSON header frame the streaming endpoint sends before the disk bytes.
+type WebSocketHeader struct {
+	// Format is the format of the disk image as reported by the endpoint, informational only.
+	Format string `json:"format,omitempty"`
+	// Size is the number of bytes that will be streamed.
+	Size uint64 `json:"size,omitempty"`
+	// Checksum is the expected checksum of the streamed bytes in the form sha256:<hex>.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// WebSocketDataSource is the data provider for WebSocket streaming endpoints. The endpoint sends a single
+// JSON text frame describing the stream, followed by binary frames containing the disk image. If the
+// connection drops the source reconnects, passing the number of bytes received so far as the offset query parameter.
+// Sequence of phases:
+// 1a. Info -> TransferScratch, if the image needs to be converted.
+// 1b. Info -> TransferDataFile, if the image is raw.
+// 2a. TransferScratch -> Convert
+// 2b. TransferDataFile -> Resize
+type WebSocketDataSource struct {
+	sourceSizeLimits
+	sourceVerification
+	sourceStreamOptions
+	// endpoint is the ws(s) endpoint to stream the data from.
+	endpoint *url.URL
+	// header is the header frame received from the endpoint.
+	header WebSocketHeader
+	// wsReader reads the binary frames from the connection.
+	wsReader *webSocketReader
+	// stack of readers
+	readers *FormatReaders
+	// url the url to report to the caller of getURL, a file in scratch space.
+	url *url.URL
+}
+
+// WebSocketOptions are the options of the WebSocket data provider.
+type WebSocketOptions struct {
+	// PinnedSPKIHashes fail the TLS handshake of wss endpoints unless a certificate of the chain presented by the
+	// endpoint has one of the pinned subject public key infos, on top of the CA validation. No pins disable pinning.
+	PinnedSPKIHashes []string
+	SourceOptions
+}
+
+// NewWebSocketDataSource creates a new instance of the WebSocket data provider. The token, if not blank,
+// is passed as a bearer token in the handshake.
+func NewWebSocketDataSource(endpoint, token, certDir string, options WebSocketOptions) (*WebSocketDataSource, error) {
+	ep, err := ParseEndpoint(endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, fmt.Sprintf("unable to parse endpoint %q", endpoint))
+	}
+	if ep.Scheme != "ws" && ep.Scheme != "wss" {
+		return nil, errors.Errorf("unsupported websocket scheme %q", ep.Scheme)
+	}
+	pins, err := parseSPKIPins(options.PinnedSPKIHashes)
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := createWebSocketDialer(certDir, pins)
+	if err != nil {
+		return nil, err
+	}
+	wsReader := &webSocketReader{
+		endpoint: ep,
+		dialer:   dialer,
+		token:    token,
+	}
+	header, err := wsReader.connect()
+	if err != nil {
+		return nil, err
+	}
+	if header.Checksum != "" {
+		if !strings.HasPrefix(header.Checksum, "sha256:") {
+			wsReader.Close()
+			return nil, errors.Errorf("unsupported checksum %q", header.Checksum)
+		}
+		wsReader.expectedChecksum = strings.TrimPrefix(header.Checksum, "sha256:")
+		wsReader.hash = sha256.New()
+	}
+	return &WebSocketDataSource{
+		sourceSizeLimits:    options.sizeLimits(),
+		sourceStreamOptions: options.streamOptions(),
+		endpoint:            ep,
+		header:              *header,
+		wsReader:            wsReader,
+	}, nil
+}
+
+// Info is called to get initial information about the data.
+func (ws *WebSocketDataSource) Info() (ProcessingPhase, error) {
+	var err error
+	klog.V(1).Infof("WebSocket endpoint reported format %q, size %d", ws.header.Format, ws.header.Size)
+	ws.readers, err = newFormatReaders(ws.wsReader, ws.header.Size, ws.sourceSizeLimits, ws.sourceVerification)
+	if err != nil {
+		klog.Errorf("Error creating readers: %v", err)
+		return ProcessingPhaseError, err
+	}
+	if !ws.readers.Convert {
+		// Streaming a raw file, we can write that directly to the target.
+		return ProcessingPhaseTransferDataFile, nil
+	}
+	return ProcessingPhaseTransferScratch, nil
+}
+
+// Transfer is called to transfer the data from the source to a scratch location.
+func (ws *WebSocketDataSource) Transfer(path string) (ProcessingPhase, error) {
+	size, _ := util.GetAvailableSpace(path)
+	if size <= int64(0) {
+		//Path provided is invalid.
+		return ProcessingPhaseError, ErrInvalidPath
+	}
+	file := filepath.Join(path, tempFile)
+	ws.readers.StartProgressUpdate()
+	err := util.StreamDataToFileWithSize(ws.readers.TopReader(), file, -1, ws.streamOptions())
+	if err != nil {
+		return ProcessingPhaseError, err
+	}
+	// If streaming succeeded, then parsing the file into URL will also succeed, no need to check error status
+	ws.url, _ = url.Parse(file)
+	return ProcessingPhaseConvert, nil
+}
+
+// TransferFile is called to transfer the data from the source to the passed in file.
+func (ws *WebSocketDataSource) TransferFile(fileName string) (ProcessingPhase, error) {
+	ws.readers.StartProgressUpdate()
+	err := util.StreamDataToFileWithSize(ws.readers.TopReader(), fileName, -1, ws.streamOptions())
+	if err != nil {
+		return ProcessingPhaseError, err
+	}
+	return ProcessingPhaseResize, nil
+}
+
+// GetURL returns the url that the data processor can use when converting the data.
+func (ws *WebSocketDataSource) GetURL() *url.URL {
+	return ws.url
+}
+
+func (ws *WebSocketDataSource) sourceDigest() (string, error) {
+	return ws.readers.sourceDigest()
+}
+
+func (ws *WebSocketDataSource) verifySourceSignature() error {
+	return ws.readers.verifySourceSignature()
+}
+
+func (ws *WebSocketDataSource) formatReaders() *FormatReaders {
+	return ws.readers
+}
+
+// Close closes any readers or other open resources.
+func (ws *WebSocketDataSource) Close() error {
+	var err error
+	if ws.readers != nil {
+		err = ws.readers.Close()
+	}
+	if ws.wsReader != nil {
+		if closeErr := ws.wsReader.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func createWebSocketDialer(certDir string, pins spkiPins) (*websocket.Dialer, error) {
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+	}
+	if certDir == "" && len(pins) == 0 {
+		return dialer, nil
+	}
+	// Reuse the http client logic to build the certificate pool and check the pins.
+	client, err := createHTTPClient(certDir, pins)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating websocket dialer")
+	}
+	dialer.TLSClientConfig = client.Transport.(*http.Transport).TLSClientConfig
+	return dialer, nil
+}
+
+// webSocketReader is an io.ReadCloser over the binary frames of a websocket connection, it reconnects at
+// the current offset if the connection drops before the endpoint closed the stream normally.
+type webSocketReader struct {
+	endpoint *url.URL
+	dialer   *websocket.Dialer
+	token    string
+	conn     *websocket.Conn
+	frame    io.Reader
+	// offset is the number of bytes read so far.
+	offset     uint64
+	reconnects int
+	// hash and expectedChecksum are set if the endpoint provided a checksum in the header frame.
+	hash             hash.Hash
+	expectedChecksum string
+}
+
+// connect dials the endpoint at the current offset and reads the header frame.
+func (r *webSocketReader) connect() (*WebSocketHeader, error) {
+	ep := *r.endpoint
+	if r.offset > 0 {
+		query := ep.Query()
+		query.Set(wsOffsetParam, strconv.FormatUint(r.offset, 10))
+		ep.RawQuery = query.Encode()
+	}
+	requestHeader := http.Header{}
+	if r.token != "" {
+		requestHeader.Set("Authorization", "Bearer "+r.token)
+	}
+	klog.V(2).Infof("Attempting to connect to websocket %q at offset %d\n", manifestURL(r.endpoint), r.offset)
+	conn, resp, err := r.dialer.Dial(ep.String(), requestHeader)
+	if err != nil {
+		if resp != nil {
+			return nil, errors.Wrapf(err, "websocket handshake failed with status %d", resp.StatusCode)
+		}
+		return nil, errors.Wrap(err, "websocket handshake failed")
+	}
+	header := &WebSocketHeader{}
+	if err := conn.ReadJSON(header); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "unable to read websocket header frame")
+	}
+	r.conn = conn
+	r.frame = nil
+	return header, nil
+}
+
+// Read reads from the current binary frame, moving to the next frame or reconnecting as needed.
+func (r *webSocketReader) Read(p []byte) (int, error) {
+	for {
+		if r.frame == nil {
+			messageType, frame, err := r.conn.NextReader()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return 0, r.verifyChecksum()
+			}
+			if err != nil {
+				if err = r.reconnect(err); err != nil {
+					return 0, err
+				}
+				continue
+			}
+			if messageType != websocket.BinaryMessage {
+				klog.V(3).Infof("Skipping non binary websocket frame")
+				continue
+			}
+			r.frame = frame
+		}
+		n, err := r.frame.Read(p)
+		r.offset += uint64(n)
+		if r.hash != nil {
+			r.hash.Write(p[:n])
+		}
+		if err == io.EOF {
+			r.frame = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			if err != nil {
+				err = r.reconnect(err)
+			}
+			return n, err
+		}
+	}
+}
+
+func (r *webSocketReader) reconnect(cause error) error {
+	r.conn.Close()
+	if r.reconnects >= wsMaxReconnects {
+		return errors.Wrapf(cause, "websocket connection lost after %d reconnects", r.reconnects)
+	}
+	r.reconnects++
+	klog.Warningf("Websocket connection lost at offset %d, reconnecting: %v", r.offset, cause)
+	_, err := r.connect()
+	return err
+}
+
+func (r *webSocketReader) verifyChecksum() error {
+	if r.hash == nil {
+		return io.EOF
+	}
+	// The hash covers the whole stream since we always resume at our own offset.
+	actual := hex.EncodeToString(r.hash.Sum(nil))
+	if actual != r.expectedChecksum {
+		return errors.Errorf("checksum mismatch, expected sha256:%s, got sha256:%s", r.expectedChecksum, actual)
+	}
+	return io.EOF
+}
+
+// Close closes the websocket connection, it is safe to call Close more than once.
+func (r *webSocketReader) Close() error {
+	if r.conn == nil {
+		return nil
+	}
+	conn := r.conn
+	r.conn = nil
+	// Best effort, the endpoint may have closed the connection already.
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	return conn.Close()
+}
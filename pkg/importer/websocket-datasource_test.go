@@ -0,0 +1,170 @@
+package importer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	wsTestToken     = "test-token"
+	wsTestChunkSize = 64 * 1024
+)
+
+// wsTestServer streams a file over a websocket, optionally dropping the first connection after dropAfter bytes.
+type wsTestServer struct {
+	data      []byte
+	checksum  string
+	dropAfter int
+	mutex     sync.Mutex
+	offsets   []int
+}
+
+func (s *wsTestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+wsTestToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get(wsOffsetParam))
+	s.mutex.Lock()
+	s.offsets = append(s.offsets, offset)
+	drop := len(s.offsets) == 1 && s.dropAfter > 0
+	s.mutex.Unlock()
+
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	err = conn.WriteJSON(WebSocketHeader{Size: uint64(len(s.data)), Checksum: s.checksum})
+	if err != nil {
+		return
+	}
+	for start := offset; start < len(s.data); start += wsTestChunkSize {
+		if drop && start >= s.dropAfter {
+			// Drop the connection without a close frame.
+			return
+		}
+		end := start + wsTestChunkSize
+		if end > len(s.data) {
+			end = len(s.data)
+		}
+		if err = conn.WriteMessage(websocket.BinaryMessage, s.data[start:end]); err != nil {
+			return
+		}
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+func wsURL(ts *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+var _ = Describe("WebSocket data source", func() {
+	var (
+		ts     *httptest.Server
+		server *wsTestServer
+		ws     *WebSocketDataSource
+		tmpDir string
+		err    error
+	)
+
+	BeforeEach(func() {
+		server = &wsTestServer{data: cirrosData}
+		ts = httptest.NewServer(server)
+		tmpDir, err = ioutil.TempDir("", "scratch")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		if ws != nil {
+			ws.Close()
+			ws = nil
+		}
+		ts.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	It("NewWebSocketDataSource should fail with a non websocket scheme", func() {
+		ws, err = NewWebSocketDataSource(ts.URL, wsTestToken, "", WebSocketOptions{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("unsupported websocket scheme"))
+	})
+
+	It("NewWebSocketDataSource should fail without the bearer token", func() {
+		ws, err = NewWebSocketDataSource(wsURL(ts), "", "", WebSocketOptions{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("status 401"))
+	})
+
+	It("Info should return TransferScratch and Transfer should write the image, when passed a qcow2 image", func() {
+		ws, err = NewWebSocketDataSource(wsURL(ts), wsTestToken, "", WebSocketOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := ws.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ProcessingPhaseTransferScratch).To(Equal(result))
+		result, err = ws.Transfer(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ProcessingPhaseConvert).To(Equal(result))
+		resultBuffer, err := ioutil.ReadFile(filepath.Join(tmpDir, tempFile))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reflect.DeepEqual(resultBuffer, cirrosData)).To(BeTrue())
+		Expect(filepath.Join(tmpDir, tempFile)).To(Equal(ws.GetURL().String()))
+	})
+
+	It("Info should return TransferDataFile, when passed a raw image", func() {
+		server.data, err = ioutil.ReadFile(tinyCoreFilePath)
+		Expect(err).NotTo(HaveOccurred())
+		ws, err = NewWebSocketDataSource(wsURL(ts), wsTestToken, "", WebSocketOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := ws.Info()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ProcessingPhaseTransferDataFile).To(Equal(result))
+		result, err = ws.TransferFile(filepath.Join(tmpDir, "file"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ProcessingPhaseResize).To(Equal(result))
+	})
+
+	It("Transfer should reconnect at the received offset when the connection drops", func() {
+		server.dropAfter = 10 * wsTestChunkSize
+		sum := sha256.Sum256(cirrosData)
+		server.checksum = "sha256:" + hex.EncodeToString(sum[:])
+		ws, err = NewWebSocketDataSource(wsURL(ts), wsTestToken, "", WebSocketOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = ws.Info()
+		Expect(err).NotTo(HaveOccurred())
+		result, err := ws.Transfer(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ProcessingPhaseConvert).To(Equal(result))
+		resultBuffer, err := ioutil.ReadFile(filepath.Join(tmpDir, tempFile))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reflect.DeepEqual(resultBuffer, cirrosData)).To(BeTrue())
+		Expect(server.offsets).To(Equal([]int{0, server.dropAfter}))
+	})
+
+	It("Transfer should fail when the checksum doesn't match", func() {
+		server.checksum = "sha256:" + strings.Repeat("0", 64)
+		ws, err = NewWebSocketDataSource(wsURL(ts), wsTestToken, "", WebSocketOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = ws.Info()
+		Expect(err).NotTo(HaveOccurred())
+		result, err := ws.Transfer(tmpDir)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("checksum mismatch"))
+		Expect(ProcessingPhaseError).To(Equal(result))
+	})
+})
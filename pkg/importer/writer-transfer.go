@@ -0,0 +1,93 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ErrRequiresConversion is returned by TransferToWriter for images qemu-img has to convert, which have to be
+// transferred to scratch space instead.
+var ErrRequiresConversion = errors.New("image requires conversion, transfer it to scratch space instead")
+
+// WriterDataSource is implemented by the data sources able to stream a raw image, or a compressed raw image
+// transparently decompressed, straight to a writer, like the block device of the target, without an intermediate file.
+type WriterDataSource interface {
+	// TransferToWriter copies the raw image to w after Info and returns ProcessingPhaseComplete, skipping the
+	// conversion and the resize. Images requiring conversion fail with ErrRequiresConversion.
+	TransferToWriter(w io.Writer) (ProcessingPhase, error)
+}
+
+// transferToWriter copies the raw image read through readers to w.
+func transferToWriter(readers *FormatReaders, w io.Writer) (ProcessingPhase, error) {
+	if readers == nil {
+		return ProcessingPhaseError, errors.New("the source must be inspected with Info before the transfer")
+	}
+	if readers.Snapshots > 0 {
+		return ProcessingPhaseError, errors.Wrapf(ErrRequiresConversion, "%s image with %d internal snapshots to flatten", readers.Format, readers.Snapshots)
+	}
+	if readers.Convert {
+		return ProcessingPhaseError, errors.Wrapf(ErrRequiresConversion, "%s image", readers.Format)
+	}
+	readers.StartProgressUpdate()
+	if _, err := io.Copy(w, readers.TopReader()); err != nil {
+		return ProcessingPhaseError, errors.Wrap(err, "unable to write the image")
+	}
+	return ProcessingPhaseComplete, nil
+}
+
+// WriterAtDataSource is implemented by the data sources able to write the image at its offsets in a writer, like the
+// opened block device of the target, without an intermediate file. Raw images are written as they are streamed.
+type WriterAtDataSource interface {
+	// TransferToWriterAt writes the raw image at its offsets in w after Info and returns ProcessingPhaseComplete,
+	// skipping the conversion and the resize. Images qemu-img has to convert fail with ErrRequiresConversion before
+	// the image is read.
+	TransferToWriterAt(w io.WriterAt) (ProcessingPhase, error)
+}
+
+// transferToWriterAt writes the raw image read through readers at its offsets in w.
+func transferToWriterAt(readers *FormatReaders, w io.WriterAt) (ProcessingPhase, error) {
+	if readers == nil {
+		return ProcessingPhaseError, errors.New("the source must be inspected with Info before the transfer")
+	}
+	if readers.Snapshots > 0 {
+		return ProcessingPhaseError, errors.Wrapf(ErrRequiresConversion, "%s image with %d internal snapshots to flatten", readers.Format, readers.Snapshots)
+	}
+	if readers.Convert {
+		return ProcessingPhaseError, errors.Wrapf(ErrRequiresConversion, "%s image", readers.Format)
+	}
+	readers.StartProgressUpdate()
+	if _, err := io.Copy(&offsetWriter{w: w}, readers.TopReader()); err != nil {
+		return ProcessingPhaseError, errors.Wrap(err, "unable to write the image")
+	}
+	return ProcessingPhaseComplete, nil
+}
+
+// offsetWriter writes sequentially to w from offset.
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+// Write writes p at the current offset, and moves the offset past it.
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.offset)
+	o.offset += int64(n)
+	return n, err
+}
@@ -0,0 +1,232 @@
+package importer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+var _ = Describe("Transfer to writer", func() {
+	var client *mockFTPClient
+
+	BeforeEach(func() {
+		client = &mockFTPClient{}
+		newFTPClientFunc = func(ep *url.URL, user, password, certDir string, pins spkiPins) (FTPClient, error) {
+			return client, nil
+		}
+	})
+
+	AfterEach(func() {
+		newFTPClientFunc = getFTPClient
+		newClientFunc = getS3Client
+	})
+
+	table.DescribeTable("should stream the raw image to the writer", func(fileName string) {
+		var err error
+		client.data, err = ioutil.ReadFile(fileName)
+		Expect(err).NotTo(HaveOccurred())
+		fd, err := NewFTPDataSource("ftp://images.example.com/disk.img", "", "", "", FTPOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		defer fd.Close()
+		_, err = fd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		var buf bytes.Buffer
+		var source WriterDataSource = fd
+		result, err := source.TransferToWriter(&buf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseComplete))
+		Expect(bytes.Equal(buf.Bytes(), tinyCoreData())).To(BeTrue())
+	},
+		table.Entry("as is", tinyCoreFilePath),
+		table.Entry("decompressing gz", tinyCoreGzFilePath),
+		table.Entry("decompressing xz", tinyCoreXzFilePath),
+	)
+
+	It("should require scratch space for images to convert", func() {
+		client.data = cirrosData
+		fd, err := NewFTPDataSource("ftp://images.example.com/cirros.qcow2", "", "", "", FTPOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		defer fd.Close()
+		_, err = fd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		var buf bytes.Buffer
+		result, err := fd.TransferToWriter(&buf)
+		Expect(errors.Cause(err)).To(Equal(ErrRequiresConversion))
+		Expect(result).To(Equal(ProcessingPhaseError))
+		Expect(buf.Len()).To(BeZero())
+	})
+
+	It("should require scratch space to flatten internal snapshots", func() {
+		var err error
+		client.data, err = ioutil.ReadFile(filepath.Join(imageDir, "snapshot.qcow2"))
+		Expect(err).NotTo(HaveOccurred())
+		fd, err := NewFTPDataSource("ftp://images.example.com/snapshot.qcow2", "", "", "", FTPOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		defer fd.Close()
+		_, err = fd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		result, err := fd.TransferToWriter(&bytes.Buffer{})
+		Expect(errors.Cause(err)).To(Equal(ErrRequiresConversion))
+		Expect(err.Error()).To(ContainSubstring("1 internal snapshots"))
+		Expect(result).To(Equal(ProcessingPhaseError))
+	})
+
+	It("should fail before Info", func() {
+		client.data = tinyCoreData()
+		fd, err := NewFTPDataSource("ftp://images.example.com/disk.img", "", "", "", FTPOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		defer fd.Close()
+		_, err = fd.TransferToWriter(&bytes.Buffer{})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should verify the checksum of s3 objects streamed to the writer", func() {
+		s3Client := &rangedMockS3Client{data: tinyCoreData()}
+		s3Client.limit = len(s3Client.data)
+		newClientFunc = func(endpoint, accKey, secKey string, certDir string, options s3ClientOptions) (S3Client, error) {
+			return s3Client, nil
+		}
+		sd, err := NewS3DataSourceWithOptions("http://amazon.com/bucket/disk.raw", "", "", "", S3Options{
+			ExpectedChecksum: "md5:00000000000000000000000000000000",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		_, err = sd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		var buf bytes.Buffer
+		result, err := sd.TransferToWriter(&buf)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("checksum"))
+		Expect(result).To(Equal(ProcessingPhaseError))
+	})
+})
+
+var _ = Describe("Transfer to writer at", func() {
+	var (
+		client *mockFTPClient
+		tmpDir string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "writerat")
+		Expect(err).NotTo(HaveOccurred())
+		client = &mockFTPClient{}
+		newFTPClientFunc = func(ep *url.URL, user, password, certDir string, pins spkiPins) (FTPClient, error) {
+			return client, nil
+		}
+	})
+
+	AfterEach(func() {
+		newFTPClientFunc = getFTPClient
+		newClientFunc = getS3Client
+		os.RemoveAll(tmpDir)
+	})
+
+	// openTarget opens the target standing for the block device, holding former data.
+	openTarget := func(size int) *os.File {
+		fileName := filepath.Join(tmpDir, "device")
+		Expect(ioutil.WriteFile(fileName, bytes.Repeat([]byte{0xff}, size), 0644)).To(Succeed())
+		target, err := os.OpenFile(fileName, os.O_WRONLY, 0)
+		Expect(err).NotTo(HaveOccurred())
+		return target
+	}
+
+	readTarget := func() []byte {
+		data, err := ioutil.ReadFile(filepath.Join(tmpDir, "device"))
+		Expect(err).NotTo(HaveOccurred())
+		return data
+	}
+
+	table.DescribeTable("should write the raw image at its offsets", func(fileName string, expected func() []byte) {
+		var err error
+		client.data, err = ioutil.ReadFile(fileName)
+		Expect(err).NotTo(HaveOccurred())
+		fd, err := NewFTPDataSource("ftp://images.example.com/disk.img", "", "", "", FTPOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		defer fd.Close()
+		_, err = fd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		want := expected()
+		target := openTarget(len(want))
+		defer target.Close()
+		var source WriterAtDataSource = fd
+		result, err := source.TransferToWriterAt(target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseComplete))
+		Expect(bytes.Equal(readTarget(), want)).To(BeTrue())
+	},
+		table.Entry("as is", tinyCoreFilePath, tinyCoreData),
+		table.Entry("decompressing xz", tinyCoreXzFilePath, tinyCoreData),
+	)
+
+	table.DescribeTable("should require scratch space for qcow2 images before reading them", func(fileName string) {
+		var err error
+		client.data, err = ioutil.ReadFile(fileName)
+		Expect(err).NotTo(HaveOccurred())
+		fd, err := NewFTPDataSource("ftp://images.example.com/disk.qcow2", "", "", "", FTPOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		defer fd.Close()
+		_, err = fd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		target := openTarget(4096)
+		defer target.Close()
+		result, err := fd.TransferToWriterAt(target)
+		Expect(errors.Cause(err)).To(Equal(ErrRequiresConversion))
+		Expect(result).To(Equal(ProcessingPhaseError))
+		Expect(readTarget()).To(Equal(bytes.Repeat([]byte{0xff}, 4096)))
+	},
+		table.Entry("uncompressed", filepath.Join(imageDir, "uncompressed.qcow2")),
+		table.Entry("with compressed clusters", filepath.Join(imageDir, "compressed.qcow2")),
+		table.Entry("cirros", cirrosFilePath),
+	)
+
+	It("should require scratch space to flatten internal snapshots", func() {
+		var err error
+		client.data, err = ioutil.ReadFile(filepath.Join(imageDir, "snapshot.qcow2"))
+		Expect(err).NotTo(HaveOccurred())
+		fd, err := NewFTPDataSource("ftp://images.example.com/snapshot.qcow2", "", "", "", FTPOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		defer fd.Close()
+		_, err = fd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		target := openTarget(0)
+		defer target.Close()
+		result, err := fd.TransferToWriterAt(target)
+		Expect(errors.Cause(err)).To(Equal(ErrRequiresConversion))
+		Expect(result).To(Equal(ProcessingPhaseError))
+	})
+
+	It("should write the byte ranges of s3 objects downloaded concurrently", func() {
+		s3Client := &rangedMockS3Client{data: tinyCoreData()}
+		s3Client.limit = len(s3Client.data)
+		newClientFunc = func(endpoint, accKey, secKey string, certDir string, options s3ClientOptions) (S3Client, error) {
+			return s3Client, nil
+		}
+		sd, err := NewS3DataSourceWithOptions("http://amazon.com/bucket/disk.raw", "", "", "", S3Options{Concurrency: 2})
+		Expect(err).NotTo(HaveOccurred())
+		defer sd.Close()
+		_, err = sd.Info()
+		Expect(err).NotTo(HaveOccurred())
+		target := openTarget(len(s3Client.data))
+		defer target.Close()
+		result, err := sd.TransferToWriterAt(target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ProcessingPhaseComplete))
+		Expect(bytes.Equal(readTarget(), s3Client.data)).To(BeTrue())
+		var ranges []string
+		for _, input := range s3Client.inputs[1:] {
+			ranges = append(ranges, aws.StringValue(input.Range))
+		}
+		Expect(ranges).To(HaveLen(2))
+	})
+})
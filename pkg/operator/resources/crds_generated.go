@@ -143,6 +143,14 @@ spec:
                   preallocation:
                     description: Preallocation controls whether storage for DataVolumes should be allocated in advance.
                     type: boolean
+                  qemuImgConvertFlags:
+                    description: QemuImgConvertFlags are extra flags of the qemu-img convert invocations of the import pods, for instance -t none. Only -t, -T, -m, -r, -W, -U and --salvage are allowed
+                    items:
+                      type: string
+                    type: array
+                  qemuImgPath:
+                    description: QemuImgPath is the absolute path of the qemu-img binary in the importer image the import pods run, qemu-img of the PATH if not set
+                    type: string
                   scratchSpaceStorageClass:
                     description: 'Override the storage class to used for scratch space during transfer operations. The scratch space storage class is determined in the following order: 1. value of scratchSpaceStorageClass, if that doesn''t exist, use the default storage class, if there is no default storage class, use the storage class of the DataVolume, if no storage class specified, use no storage class for scratch space'
                     type: string
@@ -1079,6 +1087,14 @@ spec:
                   preallocation:
                     description: Preallocation controls whether storage for DataVolumes should be allocated in advance.
                     type: boolean
+                  qemuImgConvertFlags:
+                    description: QemuImgConvertFlags are extra flags of the qemu-img convert invocations of the import pods, for instance -t none. Only -t, -T, -m, -r, -W, -U and --salvage are allowed
+                    items:
+                      type: string
+                    type: array
+                  qemuImgPath:
+                    description: QemuImgPath is the absolute path of the qemu-img binary in the importer image the import pods run, qemu-img of the PATH if not set
+                    type: string
                   scratchSpaceStorageClass:
                     description: 'Override the storage class to used for scratch space during transfer operations. The scratch space storage class is determined in the following order: 1. value of scratchSpaceStorageClass, if that doesn''t exist, use the default storage class, if there is no default storage class, use the storage class of the DataVolume, if no storage class specified, use no storage class for scratch space'
                     type: string
@@ -1998,6 +2014,14 @@ spec:
               preallocation:
                 description: Preallocation controls whether storage for DataVolumes should be allocated in advance.
                 type: boolean
+              qemuImgConvertFlags:
+                description: QemuImgConvertFlags are extra flags of the qemu-img convert invocations of the import pods, for instance -t none. Only -t, -T, -m, -r, -W, -U and --salvage are allowed
+                items:
+                  type: string
+                type: array
+              qemuImgPath:
+                description: QemuImgPath is the absolute path of the qemu-img binary in the importer image the import pods run, qemu-img of the PATH if not set
+                type: string
               scratchSpaceStorageClass:
                 description: 'Override the storage class to used for scratch space during transfer operations. The scratch space storage class is determined in the following order: 1. value of scratchSpaceStorageClass, if that doesn''t exist, use the default storage class, if there is no default storage class, use the storage class of the DataVolume, if no storage class specified, use no storage class for scratch space'
                 type: string
@@ -2158,6 +2182,14 @@ spec:
               preallocation:
                 description: Preallocation controls whether storage for DataVolumes should be allocated in advance.
                 type: boolean
+              qemuImgConvertFlags:
+                description: QemuImgConvertFlags are extra flags of the qemu-img convert invocations of the import pods, for instance -t none. Only -t, -T, -m, -r, -W, -U and --salvage are allowed
+                items:
+                  type: string
+                type: array
+              qemuImgPath:
+                description: QemuImgPath is the absolute path of the qemu-img binary in the importer image the import pods run, qemu-img of the PATH if not set
+                type: string
               scratchSpaceStorageClass:
                 description: 'Override the storage class to used for scratch space during transfer operations. The scratch space storage class is determined in the following order: 1. value of scratchSpaceStorageClass, if that doesn''t exist, use the default storage class, if there is no default storage class, use the storage class of the DataVolume, if no storage class specified, use no storage class for scratch space'
                 type: string
@@ -0,0 +1,174 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FlushMode controls when written data is synced to the storage.
+type FlushMode string
+
+const (
+	// FlushPerWrite syncs after every write.
+	FlushPerWrite FlushMode = "per-write"
+	// FlushPeriodic syncs when the flush interval elapsed since the last sync, and once the data is written.
+	FlushPeriodic FlushMode = "periodic"
+	// FlushFinalOnly syncs once the data is written.
+	FlushFinalOnly FlushMode = "final-only"
+)
+
+// DefaultFlushInterval is the interval of a periodic flush policy without an explicit interval.
+const DefaultFlushInterval = 30 * time.Second
+
+// FlushPolicy controls when the target file is synced during transfer and conversion.
+type FlushPolicy struct {
+	Mode FlushMode
+	// Interval between syncs of the periodic mode.
+	Interval time.Duration
+}
+
+// DefaultFlushPolicy is the flush policy used when none is configured.
+var DefaultFlushPolicy = FlushPolicy{Mode: FlushPeriodic, Interval: DefaultFlushInterval}
+
+// ParseFlushPolicy converts per-write, final-only, periodic or periodic(<duration>) into a FlushPolicy, an empty
+// string returns the default policy.
+func ParseFlushPolicy(policy string) (FlushPolicy, error) {
+	switch {
+	case policy == "":
+		return DefaultFlushPolicy, nil
+	case policy == string(FlushPerWrite):
+		return FlushPolicy{Mode: FlushPerWrite}, nil
+	case policy == string(FlushFinalOnly):
+		return FlushPolicy{Mode: FlushFinalOnly}, nil
+	case policy == string(FlushPeriodic):
+		return FlushPolicy{Mode: FlushPeriodic, Interval: DefaultFlushInterval}, nil
+	case strings.HasPrefix(policy, string(FlushPeriodic)+"(") && strings.HasSuffix(policy, ")"):
+		value := strings.TrimSuffix(strings.TrimPrefix(policy, string(FlushPeriodic)+"("), ")")
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return FlushPolicy{}, errors.Errorf("invalid flush interval %q", value)
+		}
+		return FlushPolicy{Mode: FlushPeriodic, Interval: interval}, nil
+	}
+	return FlushPolicy{}, errors.Errorf("unknown flush policy %q", policy)
+}
+
+// orDefault returns the policy, or DefaultFlushPolicy if the policy has no mode.
+func (p FlushPolicy) orDefault() FlushPolicy {
+	if p.Mode == "" {
+		return DefaultFlushPolicy
+	}
+	return p
+}
+
+// SyncWriter is a writer able to sync the written data to the storage, like os.File.
+type SyncWriter interface {
+	io.Writer
+	Sync() error
+}
+
+// FlushWriter syncs the underlying writer according to a flush policy.
+type FlushWriter struct {
+	writer    SyncWriter
+	policy    FlushPolicy
+	lastFlush time.Time
+	// may be overridden in tests
+	now func() time.Time
+}
+
+// NewFlushWriter creates a FlushWriter syncing writer according to policy, DefaultFlushPolicy if it has no mode.
+func NewFlushWriter(writer SyncWriter, policy FlushPolicy) *FlushWriter {
+	return &FlushWriter{
+		writer:    writer,
+		policy:    policy.orDefault(),
+		lastFlush: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// Write writes to the underlying writer, and syncs it if the policy requires it.
+func (w *FlushWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, syncAfterWrite(w.policy, &w.lastFlush, w.now, w.writer.Sync)
+}
+
+// Flush syncs the underlying writer once all the data is written, regardless of the policy.
+func (w *FlushWriter) Flush() error {
+	return w.writer.Sync()
+}
+
+// SyncWriterAt is a writer at offsets able to sync the written data to the storage, like os.File.
+type SyncWriterAt interface {
+	io.WriterAt
+	Sync() error
+}
+
+// FlushWriterAt syncs the underlying writer at offsets according to a flush policy. It is not safe for concurrent
+// use.
+type FlushWriterAt struct {
+	writer    SyncWriterAt
+	policy    FlushPolicy
+	lastFlush time.Time
+	// may be overridden in tests
+	now func() time.Time
+}
+
+// NewFlushWriterAt creates a FlushWriterAt syncing writer according to policy, DefaultFlushPolicy if it has no mode.
+func NewFlushWriterAt(writer SyncWriterAt, policy FlushPolicy) *FlushWriterAt {
+	return &FlushWriterAt{
+		writer:    writer,
+		policy:    policy.orDefault(),
+		lastFlush: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// WriteAt writes to the underlying writer at off, and syncs it if the policy requires it.
+func (w *FlushWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	n, err := w.writer.WriteAt(p, off)
+	if err != nil {
+		return n, err
+	}
+	return n, syncAfterWrite(w.policy, &w.lastFlush, w.now, w.writer.Sync)
+}
+
+// Flush syncs the underlying writer once all the data is written, regardless of the policy.
+func (w *FlushWriterAt) Flush() error {
+	return w.writer.Sync()
+}
+
+// syncAfterWrite calls sync after a write if policy requires it, lastFlush is the time of the previous periodic sync.
+func syncAfterWrite(policy FlushPolicy, lastFlush *time.Time, now func() time.Time, sync func() error) error {
+	switch policy.Mode {
+	case FlushPerWrite:
+		return sync()
+	case FlushPeriodic:
+		if t := now(); t.Sub(*lastFlush) >= policy.Interval {
+			*lastFlush = t
+			return sync()
+		}
+	}
+	return nil
+}
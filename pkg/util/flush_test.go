@@ -0,0 +1,128 @@
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// countingSyncWriter counts the writes and syncs of the written data.
+type countingSyncWriter struct {
+	bytes.Buffer
+	writes int
+	syncs  int
+}
+
+func (w *countingSyncWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func (w *countingSyncWriter) Sync() error {
+	w.syncs++
+	return nil
+}
+
+// countingSyncWriterAt counts the writes at offsets and syncs of the written data.
+type countingSyncWriterAt struct {
+	data   []byte
+	writes int
+	syncs  int
+}
+
+func (w *countingSyncWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	w.writes++
+	if end := int(off) + len(p); end > len(w.data) {
+		w.data = append(w.data, make([]byte, end-len(w.data))...)
+	}
+	return copy(w.data[off:], p), nil
+}
+
+func (w *countingSyncWriterAt) Sync() error {
+	w.syncs++
+	return nil
+}
+
+var _ = Describe("Flush policy", func() {
+	table.DescribeTable("ParseFlushPolicy should", func(value string, want FlushPolicy, wantErr bool) {
+		policy, err := ParseFlushPolicy(value)
+		if wantErr {
+			Expect(err).To(HaveOccurred())
+		} else {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(policy).To(Equal(want))
+		}
+	},
+		table.Entry("default to periodic", "", DefaultFlushPolicy, false),
+		table.Entry("parse per-write", "per-write", FlushPolicy{Mode: FlushPerWrite}, false),
+		table.Entry("parse final-only", "final-only", FlushPolicy{Mode: FlushFinalOnly}, false),
+		table.Entry("parse periodic with the default interval", "periodic", FlushPolicy{Mode: FlushPeriodic, Interval: DefaultFlushInterval}, false),
+		table.Entry("parse periodic with an interval", "periodic(5s)", FlushPolicy{Mode: FlushPeriodic, Interval: 5 * time.Second}, false),
+		table.Entry("fail on an invalid interval", "periodic(soon)", FlushPolicy{}, true),
+		table.Entry("fail on a zero interval", "periodic(0s)", FlushPolicy{}, true),
+		table.Entry("fail on an unknown policy", "never", FlushPolicy{}, true),
+	)
+
+	table.DescribeTable("FlushWriter should sync", func(policy FlushPolicy, wantSyncs int) {
+		file := &countingSyncWriter{}
+		writer := NewFlushWriter(file, policy)
+		// Every write happens one second after the previous one.
+		clock := writer.lastFlush
+		writer.now = func() time.Time {
+			clock = clock.Add(time.Second)
+			return clock
+		}
+		for i := 0; i < 10; i++ {
+			_, err := writer.Write([]byte("data"))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(writer.Flush()).To(Succeed())
+		Expect(file.writes).To(Equal(10))
+		Expect(file.syncs).To(Equal(wantSyncs))
+		Expect(file.String()).To(Equal(strings.Repeat("data", 10)))
+	},
+		table.Entry("after every write and at the end with per-write", FlushPolicy{Mode: FlushPerWrite}, 11),
+		table.Entry("every interval and at the end with periodic", FlushPolicy{Mode: FlushPeriodic, Interval: 3 * time.Second}, 4),
+		table.Entry("only at the end with final-only", FlushPolicy{Mode: FlushFinalOnly}, 1),
+	)
+
+	table.DescribeTable("FlushWriterAt should sync", func(policy FlushPolicy, wantSyncs int) {
+		file := &countingSyncWriterAt{}
+		writer := NewFlushWriterAt(file, policy)
+		// Every write happens one second after the previous one.
+		clock := writer.lastFlush
+		writer.now = func() time.Time {
+			clock = clock.Add(time.Second)
+			return clock
+		}
+		// Write the blocks backwards.
+		for i := 9; i >= 0; i-- {
+			_, err := writer.WriteAt([]byte("data"), int64(i*4))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(writer.Flush()).To(Succeed())
+		Expect(file.writes).To(Equal(10))
+		Expect(file.syncs).To(Equal(wantSyncs))
+		Expect(string(file.data)).To(Equal(strings.Repeat("data", 10)))
+	},
+		table.Entry("after every write and at the end with per-write", FlushPolicy{Mode: FlushPerWrite}, 11),
+		table.Entry("every interval and at the end with periodic", FlushPolicy{Mode: FlushPeriodic, Interval: 3 * time.Second}, 4),
+		table.Entry("only at the end with final-only", FlushPolicy{Mode: FlushFinalOnly}, 1),
+	)
+
+	It("StreamDataToFileWithSize should write with the passed in policy", func() {
+		tmpDir, err := ioutil.TempDir("", "flush")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+		fileName := filepath.Join(tmpDir, "disk.img")
+		Expect(StreamDataToFileWithSize(strings.NewReader("data"), fileName, -1, StreamOptions{FlushPolicy: FlushPolicy{Mode: FlushPerWrite}})).To(Succeed())
+		Expect(ioutil.ReadFile(fileName)).To(Equal([]byte("data")))
+	})
+})
@@ -0,0 +1,57 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// LogLevelDebug logs the details of the V(3) log statements and below.
+	LogLevelDebug = "debug"
+	// LogLevelInfo logs the V(1) log statements and below, the default verbosity of the pods.
+	LogLevelInfo = "info"
+	// LogLevelError only logs the errors.
+	LogLevelError = "error"
+)
+
+// SetLogLevel sets the verbosity of klog from a log level, debug, info or error. An empty level keeps the verbosity of
+// the -v flag.
+func SetLogLevel(level string) error {
+	var verbosity klog.Level
+	switch level {
+	case "":
+		return nil
+	case LogLevelDebug:
+		return verbosity.Set("3")
+	case LogLevelInfo:
+		return verbosity.Set("1")
+	case LogLevelError:
+		if err := verbosity.Set("0"); err != nil {
+			return err
+		}
+		// Without logging to stderr exclusively, only the severities above the stderr threshold, errors by default,
+		// are copied to stderr, the rest goes to the outputs.
+		klog.LogToStderr(false)
+		klog.SetOutput(ioutil.Discard)
+		return nil
+	}
+	return errors.Errorf("log level %q is not one of %s, %s or %s", level, LogLevelDebug, LogLevelInfo, LogLevelError)
+}
@@ -0,0 +1,39 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+)
+
+// preallocateFile allocates size bytes of file with fallocate. It returns false without error if the filesystem
+// doesn't support fallocate, the file is then written without preallocation.
+func preallocateFile(file *os.File, size int64) (bool, error) {
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, size)
+	if err == nil {
+		return true, nil
+	}
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		klog.Warningf("Unable to preallocate %d bytes for %s, fallocate is not supported: %v", size, file.Name(), err)
+		return false, nil
+	}
+	return false, errors.Wrapf(err, "unable to preallocate %d bytes for %s", size, file.Name())
+}
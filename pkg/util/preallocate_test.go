@@ -0,0 +1,73 @@
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// allocationReader records the allocated size of a file when the data is first read.
+type allocationReader struct {
+	reader    *bytes.Reader
+	fileName  string
+	allocated int64
+	read      bool
+}
+
+func (r *allocationReader) Read(p []byte) (int, error) {
+	if !r.read {
+		r.read = true
+		info, err := os.Stat(r.fileName)
+		if err != nil {
+			return 0, err
+		}
+		r.allocated = info.Sys().(*syscall.Stat_t).Blocks * 512
+	}
+	return r.reader.Read(p)
+}
+
+var _ = Describe("Scratch preallocation", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "preallocate")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should allocate the size of the data before writing it", func() {
+		data := bytes.Repeat([]byte{1}, 1024*1024)
+		fileName := filepath.Join(tmpDir, "tmpimage")
+		reader := &allocationReader{reader: bytes.NewReader(data), fileName: fileName}
+		Expect(StreamDataToFileWithSize(reader, fileName, int64(len(data)), StreamOptions{Preallocate: true})).To(Succeed())
+		Expect(reader.allocated).To(BeNumerically(">=", len(data)))
+		info, err := os.Stat(fileName)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Size()).To(BeEquivalentTo(len(data)))
+	})
+
+	It("should truncate the file to the written data", func() {
+		fileName := filepath.Join(tmpDir, "tmpimage")
+		Expect(StreamDataToFileWithSize(bytes.NewReader([]byte("data")), fileName, 1024*1024, StreamOptions{Preallocate: true})).To(Succeed())
+		content, err := ioutil.ReadFile(fileName)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(content).To(Equal([]byte("data")))
+	})
+
+	It("should not allocate anything without preallocation", func() {
+		data := bytes.Repeat([]byte{1}, 1024*1024)
+		fileName := filepath.Join(tmpDir, "tmpimage")
+		reader := &allocationReader{reader: bytes.NewReader(data), fileName: fileName}
+		Expect(StreamDataToFileWithSize(reader, fileName, int64(len(data)), StreamOptions{})).To(Succeed())
+		Expect(reader.allocated).To(BeZero())
+	})
+})
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"path"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -55,12 +56,31 @@ func (r *ProgressReader) timedUpdateProgress() {
 	}
 }
 
+// Total returns the total number of bytes to read, 0 if unknown.
+func (r *ProgressReader) Total() uint64 {
+	return atomic.LoadUint64(&r.total)
+}
+
+// SetTotal updates the total number of bytes to read, like when the source turns out to be larger than reported.
+func (r *ProgressReader) SetTotal(total uint64) {
+	atomic.StoreUint64(&r.total, total)
+}
+
+// Progress returns the percentage of the total read so far, 0 if the total is unknown.
+func (r *ProgressReader) Progress() float64 {
+	total := r.Total()
+	if total == 0 {
+		return 0
+	}
+	if r.Done || r.Current >= total {
+		return 100.0
+	}
+	return float64(r.Current) / float64(total) * 100.0
+}
+
 func (r *ProgressReader) updateProgress() bool {
-	if r.total > 0 {
-		currentProgress := 100.0
-		if !r.Done && r.Current < r.total {
-			currentProgress = float64(r.Current) / float64(r.total) * 100.0
-		}
+	if r.Total() > 0 {
+		currentProgress := r.Progress()
 		metric := &dto.Metric{}
 		r.progress.WithLabelValues(r.ownerUID).Write(metric)
 		if currentProgress > *metric.Counter.Value {
@@ -108,3 +108,24 @@ var _ = Describe("Update Progress", func() {
 	})
 
 })
+
+var _ = Describe("Progress", func() {
+	It("should report the percentage of the total read", func() {
+		r := ioutil.NopCloser(bytes.NewReader([]byte("hello world")))
+		progressReader := NewProgressReader(r, uint64(20), progress, ownerUID)
+		Expect(progressReader.Progress()).To(Equal(float64(0)))
+		_, err := progressReader.Read(make([]byte, 5))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(progressReader.Progress()).To(Equal(float64(25)))
+		progressReader.Done = true
+		Expect(progressReader.Progress()).To(Equal(float64(100)))
+	})
+
+	It("should report 0 if the total is unknown", func() {
+		r := ioutil.NopCloser(bytes.NewReader([]byte("hello world")))
+		progressReader := NewProgressReader(r, uint64(0), progress, ownerUID)
+		_, err := ioutil.ReadAll(progressReader)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(progressReader.Progress()).To(Equal(float64(0)))
+	})
+})
@@ -0,0 +1,75 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"net/url"
+	"strings"
+)
+
+// RedactedValue replaces the secrets of the urls in the logs.
+const RedactedValue = "REDACTED"
+
+// sensitiveQueryParams are the query parameters of presigned and shared access urls whose values grant access, matched
+// case-insensitively.
+var sensitiveQueryParams = []string{
+	"X-Amz-Signature",
+	"X-Amz-Credential",
+	"X-Amz-Security-Token",
+	"X-Goog-Signature",
+	"X-Goog-Credential",
+	"Signature",
+	"sig",
+	"token",
+	"access_token",
+}
+
+// RedactURL returns the url s with the password of its user info and the values of its sensitive query parameters
+// replaced by RedactedValue, for logging. s is returned as is if it isn't a valid url.
+func RedactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), RedactedValue)
+		}
+	}
+	if u.RawQuery != "" {
+		// The parameters are redacted in place, url.Values would sort them.
+		params := strings.Split(u.RawQuery, "&")
+		for i, param := range params {
+			name := strings.SplitN(param, "=", 2)[0]
+			if unescaped, err := url.QueryUnescape(name); err == nil && isSensitiveQueryParam(unescaped) {
+				params[i] = name + "=" + RedactedValue
+			}
+		}
+		u.RawQuery = strings.Join(params, "&")
+	}
+	return u.String()
+}
+
+// isSensitiveQueryParam returns true if the value of the query parameter name grants access.
+func isSensitiveQueryParam(name string) bool {
+	for _, sensitive := range sensitiveQueryParams {
+		if strings.EqualFold(name, sensitive) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// SparseBlockSize is the granularity of SparseWriter, only entirely zero blocks aligned on it are skipped.
+const SparseBlockSize = ZeroBlockSize
+
+var zeroBlock = make([]byte, SparseBlockSize)
+
+// SparseFile is a file SparseWriter can seek past the zeroes of, like os.File.
+type SparseFile interface {
+	SyncWriter
+	io.Seeker
+	Truncate(size int64) error
+}
+
+// SparseWriter writes to a file without writing its zero blocks, the file position is moved past them instead and
+// they are left as holes. Finish must be called once the data is written, to extend the file over a trailing hole.
+type SparseWriter struct {
+	file SparseFile
+	// offset is the number of bytes written, including the skipped zeroes.
+	offset int64
+	// position is the position of the file, behind offset while zeroes are skipped.
+	position int64
+}
+
+// NewSparseWriter creates a SparseWriter writing to the start of file.
+func NewSparseWriter(file SparseFile) *SparseWriter {
+	return &SparseWriter{file: file}
+}
+
+// NewSparseWriterAt creates a SparseWriter writing to file from offset, the position of the file.
+func NewSparseWriterAt(file SparseFile, offset int64) *SparseWriter {
+	return &SparseWriter{file: file, offset: offset, position: offset}
+}
+
+// Write writes the data of p, and skips its zero blocks.
+func (w *SparseWriter) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		// The first block ends at the next block boundary, so the following ones are aligned.
+		end := n + SparseBlockSize - int(w.offset%SparseBlockSize)
+		zero := isZeroBlock(p, n, end)
+		for end < len(p) && isZeroBlock(p, end, end+SparseBlockSize) == zero {
+			end += SparseBlockSize
+		}
+		if end > len(p) {
+			end = len(p)
+		}
+		if zero {
+			w.offset += int64(end - n)
+			n = end
+			continue
+		}
+		if w.position != w.offset {
+			if _, err := w.file.Seek(w.offset, io.SeekStart); err != nil {
+				return n, errors.Wrap(err, "unable to seek past zeroes")
+			}
+			w.position = w.offset
+		}
+		written, err := w.file.Write(p[n:end])
+		w.offset += int64(written)
+		w.position = w.offset
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// isZeroBlock returns true if p[start:end] is an entire zero block, a block cut short by the end of p is written.
+func isZeroBlock(p []byte, start, end int) bool {
+	return end-start == SparseBlockSize && end <= len(p) && bytes.Equal(p[start:end], zeroBlock)
+}
+
+// Sync syncs the file.
+func (w *SparseWriter) Sync() error {
+	return w.file.Sync()
+}
+
+// Finish extends the file over the zeroes skipped at its end.
+func (w *SparseWriter) Finish() error {
+	if w.position == w.offset {
+		return nil
+	}
+	if err := w.file.Truncate(w.offset); err != nil {
+		return errors.Wrap(err, "unable to extend the file over the trailing zeroes")
+	}
+	w.position = w.offset
+	return nil
+}
@@ -0,0 +1,88 @@
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sparse writer", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "sparse")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	// allocated returns the size of the blocks allocated to fileName.
+	allocated := func(fileName string) int64 {
+		info, err := os.Stat(fileName)
+		Expect(err).NotTo(HaveOccurred())
+		return info.Sys().(*syscall.Stat_t).Blocks * 512
+	}
+
+	It("should skip the zero blocks and keep the data", func() {
+		data := make([]byte, 64*SparseBlockSize)
+		copy(data[10*SparseBlockSize:], bytes.Repeat([]byte{1}, SparseBlockSize))
+		fileName := filepath.Join(tmpDir, "tmpimage")
+		Expect(StreamDataToFile(bytes.NewReader(data), fileName)).To(Succeed())
+		content, err := ioutil.ReadFile(fileName)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Equal(content, data)).To(BeTrue())
+		Expect(allocated(fileName)).To(BeNumerically("<", len(data)/4))
+	})
+
+	It("should write the zeroes of unaligned writes that don't fill a block", func() {
+		fileName := filepath.Join(tmpDir, "tmpimage")
+		file, err := os.Create(fileName)
+		Expect(err).NotTo(HaveOccurred())
+		defer file.Close()
+		writer := NewSparseWriter(file)
+		chunks := [][]byte{
+			[]byte("data"),
+			make([]byte, SparseBlockSize),
+			make([]byte, 3*SparseBlockSize),
+			[]byte("more data"),
+			make([]byte, SparseBlockSize/2),
+		}
+		var expected []byte
+		for _, chunk := range chunks {
+			n, err := writer.Write(chunk)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(len(chunk)))
+			expected = append(expected, chunk...)
+		}
+		Expect(writer.Finish()).To(Succeed())
+		content, err := ioutil.ReadFile(fileName)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Equal(content, expected)).To(BeTrue())
+	})
+
+	It("should extend the file over trailing zeroes", func() {
+		data := append([]byte("data"), make([]byte, 2*SparseBlockSize-4)...)
+		fileName := filepath.Join(tmpDir, "tmpimage")
+		Expect(StreamDataToFile(bytes.NewReader(data), fileName)).To(Succeed())
+		content, err := ioutil.ReadFile(fileName)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Equal(content, data)).To(BeTrue())
+	})
+
+	It("should keep the size of a preallocated file with trailing zeroes", func() {
+		data := append([]byte("data"), make([]byte, 4*SparseBlockSize)...)
+		fileName := filepath.Join(tmpDir, "tmpimage")
+		Expect(StreamDataToFileWithSize(bytes.NewReader(data), fileName, int64(len(data)), StreamOptions{Preallocate: true})).To(Succeed())
+		content, err := ioutil.ReadFile(fileName)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Equal(content, data)).To(BeTrue())
+	})
+})
@@ -112,6 +112,21 @@ func GetAvailableSpace(path string) (int64, error) {
 	return int64(stat.Bavail) * int64(stat.Bsize), nil
 }
 
+// GetAvailableInodes gets the number of free inodes of the filesystem at the path specified, -1 if the filesystem
+// doesn't have a fixed number of inodes.
+func GetAvailableInodes(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return int64(-1), err
+	}
+	if stat.Files == 0 {
+		// Filesystems allocating inodes dynamically, like btrfs, report no inodes at all.
+		return int64(-1), nil
+	}
+	return int64(stat.Ffree), nil
+}
+
 // GetAvailableSpaceBlock gets the amount of available space at the block device path specified.
 func GetAvailableSpaceBlock(deviceName string) (int64, error) {
 	// Check if device exists.
@@ -147,8 +162,24 @@ func MinQuantity(availableSpace, imageSize *resource.Quantity) resource.Quantity
 	return *imageSize
 }
 
+// StreamOptions are the options of StreamDataToFileWithSize.
+type StreamOptions struct {
+	// FlushPolicy controls when the file is synced while it is written, DefaultFlushPolicy if it has no mode.
+	FlushPolicy FlushPolicy
+	// Preallocate allocates the size of the data in a file before writing it, so a scratch space too small for the
+	// data fails early and the file isn't fragmented.
+	Preallocate bool
+}
+
 // StreamDataToFile provides a function to stream the specified io.Reader to the specified local file
 func StreamDataToFile(r io.Reader, fileName string) error {
+	return StreamDataToFileWithSize(r, fileName, -1, StreamOptions{})
+}
+
+// StreamDataToFileWithSize is StreamDataToFile for a reader of size bytes, -1 if unknown, with options. With
+// preallocation, the size is allocated in a file before writing it, and the file is truncated to the written data at
+// the end. The zero blocks of the data are left as holes of a file.
+func StreamDataToFileWithSize(r io.Reader, fileName string, size int64, options StreamOptions) error {
 	var outFile *os.File
 	blockSize, err := GetAvailableSpaceBlock(fileName)
 	if err != nil {
@@ -165,13 +196,41 @@ func StreamDataToFile(r io.Reader, fileName string) error {
 		return errors.Wrapf(err, "could not open file %q", fileName)
 	}
 	defer outFile.Close()
+	preallocated := false
+	if options.Preallocate && blockSize < 0 && size > 0 {
+		if preallocated, err = preallocateFile(outFile, size); err != nil {
+			os.Remove(outFile.Name())
+			return err
+		}
+	}
 	klog.V(1).Infof("Writing data...\n")
-	if _, err = io.Copy(outFile, r); err != nil {
+	var target SyncWriter = outFile
+	var sparseWriter *SparseWriter
+	if blockSize < 0 {
+		// The zeroes are only skipped in files, a block device would keep its previous content.
+		sparseWriter = NewSparseWriter(outFile)
+		target = sparseWriter
+	}
+	writer := NewFlushWriter(target, options.FlushPolicy)
+	written, err := io.Copy(writer, r)
+	if err != nil {
 		klog.Errorf("Unable to write file from dataReader: %v\n", err)
 		os.Remove(outFile.Name())
 		return errors.Wrapf(err, "unable to write to file")
 	}
-	err = outFile.Sync()
+	if sparseWriter != nil {
+		if err = sparseWriter.Finish(); err != nil {
+			os.Remove(outFile.Name())
+			return err
+		}
+	}
+	if preallocated && written < size {
+		if err = outFile.Truncate(written); err != nil {
+			os.Remove(outFile.Name())
+			return errors.Wrapf(err, "unable to truncate file")
+		}
+	}
+	err = writer.Flush()
 	return err
 }
 
@@ -62,6 +62,18 @@ var _ = Describe("Util", func() {
 		table.Entry("Valid namespace", filepath.Join(fileDir, "namespace.txt"), "test-namespace"),
 		table.Entry("Invalid file", "doesnotexist", "cdi"),
 	)
+
+	It("Should get the free inodes of a directory", func() {
+		inodes, err := GetAvailableInodes(os.TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(inodes).To(BeNumerically(">=", -1))
+	})
+
+	It("Should fail to get the free inodes of a missing directory", func() {
+		inodes, err := GetAvailableInodes("/doesnotexist")
+		Expect(err).To(HaveOccurred())
+		Expect(inodes).To(Equal(int64(-1)))
+	})
 })
 
 var _ = Describe("GetNameSpace", func() {
@@ -0,0 +1,111 @@
+/*
+Copyright 2021 The CDI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// lseek whence values finding the data and the holes of sparse files, see lseek(2).
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// ZeroBlockSize is the granularity of CountZeroBytes, only entirely zero blocks are counted.
+const ZeroBlockSize = 4096
+
+// CountZeroBytes returns the number of bytes of fileName in entirely zero blocks, and the size of fileName. Holes of
+// sparse files are zero without being read, so only the data of the file is scanned.
+func CountZeroBytes(fileName string) (int64, int64, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "unable to open %s", fileName)
+	}
+	defer file.Close()
+	// Seeking to the end also gets the size of block devices.
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "unable to get the size of %s", fileName)
+	}
+
+	var zeroes, offset int64
+	block := make([]byte, ZeroBlockSize)
+	zeroBlock := make([]byte, ZeroBlockSize)
+	for offset < size {
+		dataStart, dataEnd, err := nextDataExtent(file, offset, size)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "unable to find the data of %s", fileName)
+		}
+		zeroes += dataStart - offset
+		if dataStart == size {
+			break
+		}
+		if _, err := file.Seek(dataStart, io.SeekStart); err != nil {
+			return 0, 0, errors.Wrapf(err, "unable to seek in %s", fileName)
+		}
+		reader := io.LimitReader(file, dataEnd-dataStart)
+		for {
+			n, err := io.ReadFull(reader, block)
+			if n > 0 && bytes.Equal(block[:n], zeroBlock[:n]) {
+				zeroes += int64(n)
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return 0, 0, errors.Wrapf(err, "unable to read %s", fileName)
+			}
+		}
+		offset = dataEnd
+	}
+	return zeroes, size, nil
+}
+
+// nextDataExtent returns the start and the end of the first data extent at or after offset, the start is size if
+// there is no data left. Without support for finding holes, the rest of the file is a single data extent.
+func nextDataExtent(file *os.File, offset, size int64) (int64, int64, error) {
+	start, err := file.Seek(offset, seekData)
+	if err != nil {
+		if isErrno(err, syscall.ENXIO) {
+			// No data after offset, the rest of the file is a hole.
+			return size, size, nil
+		}
+		if isErrno(err, syscall.EINVAL) {
+			return offset, size, nil
+		}
+		return 0, 0, err
+	}
+	end, err := file.Seek(start, seekHole)
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+// isErrno returns true if err is caused by the errno system call error.
+func isErrno(err error, errno syscall.Errno) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	return err == errno
+}
@@ -0,0 +1,68 @@
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Count zero bytes", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "zeroes")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	// writeFile writes the blocks at the passed in block offsets of a sparse file of size bytes.
+	writeFile := func(size int64, blocks map[int64][]byte) string {
+		fileName := filepath.Join(tmpDir, "disk.img")
+		file, err := os.Create(fileName)
+		Expect(err).NotTo(HaveOccurred())
+		defer file.Close()
+		Expect(file.Truncate(size)).To(Succeed())
+		for block, data := range blocks {
+			_, err := file.WriteAt(data, block*ZeroBlockSize)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		return fileName
+	}
+
+	It("Should count the holes of a sparse file as zeroes", func() {
+		fileName := writeFile(1024*ZeroBlockSize, nil)
+		zeroes, size, err := CountZeroBytes(fileName)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(size).To(Equal(int64(1024 * ZeroBlockSize)))
+		Expect(zeroes).To(Equal(size))
+	})
+
+	It("Should count written zero blocks as zeroes", func() {
+		fileName := writeFile(16*ZeroBlockSize, map[int64][]byte{0: make([]byte, 16*ZeroBlockSize)})
+		zeroes, size, err := CountZeroBytes(fileName)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(zeroes).To(Equal(size))
+	})
+
+	It("Should not count blocks with data", func() {
+		data := bytes.Repeat([]byte{1}, ZeroBlockSize)
+		fileName := writeFile(1024*ZeroBlockSize, map[int64][]byte{3: data, 700: data, 1023: data[:100]})
+		zeroes, size, err := CountZeroBytes(fileName)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(size).To(Equal(int64(1024 * ZeroBlockSize)))
+		Expect(zeroes).To(Equal(size - 3*ZeroBlockSize))
+	})
+
+	It("Should fail on a missing file", func() {
+		_, _, err := CountZeroBytes(filepath.Join(tmpDir, "missing"))
+		Expect(err).To(HaveOccurred())
+	})
+})